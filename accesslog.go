@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogConfig configures the access log, which records every HTTP request
+// as a line of JSON, separately from the application logs
+type AccessLogConfig struct {
+	Enabled bool `json:"enabled"`
+	// Path is the file the log is appended to, defaulting to stdout
+	Path string `json:"path"`
+}
+
+// accessLogEntry is a line of the access log
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_seconds"`
+	RemoteIP  string    `json:"remote_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// accessLogger writes access log entries, one at a time
+type accessLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAccessLogger(w io.Writer) *accessLogger {
+	return &accessLogger{enc: json.NewEncoder(w)}
+}
+
+// accessLoggerFromConfig opens the access log, returning nil if it's disabled
+func accessLoggerFromConfig(cfg AccessLogConfig) (*accessLogger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Path == "" || cfg.Path == "-" {
+		return newAccessLogger(os.Stdout), nil
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("opening access log: %w", err)
+	}
+	return newAccessLogger(f), nil
+}
+
+func (l *accessLogger) log(entry accessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		logError("Error writing access log: %v", err)
+	}
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLogMiddleware logs every request to l once it has been served. The
+// query string is left out, since it may carry secrets.
+func accessLogMiddleware(l *accessLogger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		l.log(accessLogEntry{
+			Time:      started.UTC(),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    status,
+			Bytes:     recorder.bytes,
+			Duration:  time.Since(started).Seconds(),
+			RemoteIP:  requestClientIP(r),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
+
+// requestClientIP returns the address of the client that made a request,
+// from the trusted proxy header when the webhook allowlist configures one
+func requestClientIP(r *http.Request) string {
+	if webhookAllowlist != nil {
+		if addr, err := webhookAllowlist.clientAddr(r); err == nil {
+			return addr.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
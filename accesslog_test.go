@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	origAllowlist := webhookAllowlist
+	defer func() { webhookAllowlist = origAllowlist }()
+
+	tests := []struct {
+		name      string
+		allowlist *ipAllowlist
+		handler   http.HandlerFunc
+		header    http.Header
+		expect    accessLogEntry
+	}{
+		{
+			name:    "Default status",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) },
+			header:  http.Header{"User-Agent": {"Monzo"}},
+			expect:  accessLogEntry{Method: "POST", Path: "/webhook", Status: 200, Bytes: 2, RemoteIP: "192.0.2.1", UserAgent: "Monzo"},
+		},
+		{
+			name:    "Error",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "Forbidden", http.StatusForbidden) },
+			expect:  accessLogEntry{Method: "POST", Path: "/webhook", Status: 403, Bytes: 10, RemoteIP: "192.0.2.1"},
+		},
+		{
+			name: "Client behind a trusted proxy",
+			allowlist: &ipAllowlist{
+				allowed:        []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+				trustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+				header:         "X-Forwarded-For",
+			},
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			header:  http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			expect:  accessLogEntry{Method: "POST", Path: "/webhook", Status: 204, RemoteIP: "203.0.113.7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookAllowlist = tt.allowlist
+			var out bytes.Buffer
+			handler := accessLogMiddleware(newAccessLogger(&out), tt.handler)
+
+			req := httptest.NewRequest("POST", "/webhook?token=secret", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			var entry accessLogEntry
+			if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+				t.Fatalf("Invalid access log line %q: %v", out.String(), err)
+			}
+			if entry.Time.IsZero() || entry.Duration < 0 {
+				t.Errorf("Expected a time and duration, got %+v", entry)
+			}
+			entry.Time, entry.Duration = tt.expect.Time, tt.expect.Duration
+			if entry != tt.expect {
+				t.Errorf("Expected %+v, got %+v", tt.expect, entry)
+			}
+		})
+	}
+}
+
+func TestAccessLoggerFromConfig(t *testing.T) {
+	if l, err := accessLoggerFromConfig(AccessLogConfig{}); l != nil || err != nil {
+		t.Errorf("Expected no access log when disabled, got %v, %v", l, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := accessLoggerFromConfig(AccessLogConfig{Enabled: true, Path: path})
+	if err != nil {
+		t.Fatalf("accessLoggerFromConfig failed: %v", err)
+	}
+	l.log(accessLogEntry{Method: "GET", Path: "/readyz", Status: 200})
+	data, err := os.ReadFile(path)
+	if err != nil || !bytes.Contains(data, []byte(`"path":"/readyz"`)) {
+		t.Errorf("Expected the entry to be appended to the file, got %q, %v", data, err)
+	}
+
+	if _, err := accessLoggerFromConfig(AccessLogConfig{Enabled: true, Path: filepath.Join(path, "missing", "access.log")}); err == nil {
+		t.Error("Expected an error for a path that can't be opened")
+	}
+}
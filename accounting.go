@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// ofxDateLayout is the layout of dates and times in OFX files
+const ofxDateLayout = "20060102150405"
+
+// monzoSortCode is the bank ID of Monzo accounts in OFX files
+const monzoSortCode = "040004"
+
+// accountingFields are the fields a column of a transactions CSV can hold
+var accountingFields = []string{"date", "time", "id", "account_id", "account", "description", "merchant", "category",
+	"amount", "amount_minor", "debit", "credit", "currency", "local_amount", "local_currency", "settled", "notes"}
+
+// accountingValue returns a field of a transaction, with amounts in major
+// units. debit and credit are the amount spent or received, and empty
+// otherwise.
+func accountingValue(field string, tx monzo.Transaction, label func(string) string) string {
+	switch field {
+	case "date":
+		return tx.Created.UTC().Format(exportDateLayout)
+	case "time":
+		return tx.Created.UTC().Format(time.RFC3339)
+	case "id":
+		return tx.ID
+	case "account_id":
+		return tx.AccountID
+	case "account":
+		return csvText(label(tx.AccountID))
+	case "description":
+		return csvText(tx.Description)
+	case "merchant":
+		return csvText(accountingPayee(tx))
+	case "category":
+		return tx.Category
+	case "amount":
+		return formatMinorUnits(tx.Amount, tx.Currency)
+	case "amount_minor":
+		return strconv.FormatInt(tx.Amount, 10)
+	case "debit":
+		if tx.Amount < 0 {
+			return formatMinorUnits(-tx.Amount, tx.Currency)
+		}
+	case "credit":
+		if tx.Amount >= 0 {
+			return formatMinorUnits(tx.Amount, tx.Currency)
+		}
+	case "currency":
+		return tx.Currency
+	case "local_amount":
+		if tx.LocalCurrency != "" {
+			return formatMinorUnits(tx.LocalAmount, tx.LocalCurrency)
+		}
+	case "local_currency":
+		return tx.LocalCurrency
+	case "settled":
+		return tx.Settled
+	case "notes":
+		return csvText(tx.Notes)
+	}
+	return ""
+}
+
+// defaultAccountingColumns are the columns of a transactions CSV when none
+// are given
+const defaultAccountingColumns = "date,description,amount,currency,merchant,category"
+
+// accountingColumn is a column of a transactions CSV: the field it holds and
+// its header
+type accountingColumn struct {
+	field  string
+	header string
+}
+
+// parseAccountingColumns parses a column mapping, a comma-separated list of
+// fields each optionally followed by a colon and the header to give it, such
+// as date:Date,amount:Amount,merchant:Payee. A field without a header is
+// headed by its name.
+func parseAccountingColumns(spec string) ([]accountingColumn, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = defaultAccountingColumns
+	}
+	var columns []accountingColumn
+	for _, item := range strings.Split(spec, ",") {
+		field, header, found := strings.Cut(strings.TrimSpace(item), ":")
+		field = strings.TrimSpace(field)
+		if !slices.Contains(accountingFields, field) {
+			return nil, fmt.Errorf("unknown column '%s', must be one of %s", field, strings.Join(accountingFields, ", "))
+		}
+		if !found {
+			header = field
+		}
+		columns = append(columns, accountingColumn{field: field, header: header})
+	}
+	return columns, nil
+}
+
+// accountingPayee is who a transaction was with: its merchant, the
+// counterparty of a transfer, or else its description
+func accountingPayee(tx monzo.Transaction) string {
+	switch {
+	case tx.Merchant != nil && tx.Merchant.Name != "":
+		return tx.Merchant.Name
+	case tx.Counterparty != nil && tx.Counterparty.Name != "":
+		return tx.Counterparty.Name
+	}
+	return tx.Description
+}
+
+// storedTransactions reads the transactions of the stored transaction.created
+// events created on the days from first to last, inclusive, in UTC, for one
+// account if accountID is set, oldest first. Declined transactions are left
+// out, as are repeated deliveries of a transaction.
+func storedTransactions(ctx context.Context, source eventSource, first, last time.Time, accountID string) ([]monzo.Transaction, error) {
+	to := last.AddDate(0, 0, 1)
+	query := eventQuery{Types: []string{monzo.TypeTransactionCreated}, AccountID: accountID, Limit: maxEventsLimit}
+	seen := make(map[string]bool)
+	var txs []monzo.Transaction
+	for {
+		stored, next, err := source.queryEvents(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stored {
+			var event struct {
+				Data monzo.Transaction `json:"data"`
+			}
+			if err := json.Unmarshal(s.Body, &event); err != nil {
+				logWarn("Skipping unreadable stored event %s: %v", s.ID, err)
+				continue
+			}
+			tx := event.Data
+			if tx.IsDeclined() || seen[tx.ID] || tx.Created.Before(first) || !tx.Created.Before(to) {
+				continue
+			}
+			seen[tx.ID] = true
+			txs = append(txs, tx)
+		}
+		if next == "" {
+			break
+		}
+		query.After = next
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].Created.Before(txs[j].Created) })
+	return txs, nil
+}
+
+// writeAccountingCSV writes transactions as CSV with the given columns. It
+// writes the CSVs of both accounting exports and export bundles.
+func writeAccountingCSV(w io.Writer, txs []monzo.Transaction, columns []accountingColumn, label func(string) string) error {
+	cw := csv.NewWriter(w)
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = column.header
+	}
+	cw.Write(row)
+	for _, tx := range txs {
+		for i, column := range columns {
+			row[i] = accountingValue(column.field, tx, label)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvText stops spreadsheets from reading free text, such as a note, as a
+// formula. A leading tab or carriage return is escaped too, as some
+// spreadsheets skip it and read the formula after it.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// currencyDecimals are the ISO 4217 currencies whose minor unit isn't a
+// hundredth of the major unit, by the number of decimal places
+var currencyDecimals = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// formatMinorUnits formats an amount in a currency's minor units, such as
+// pence, in major units, with as many decimal places as the currency has:
+// -1250 is -12.50 GBP but -1250 JPY. Amounts without a currency have two.
+func formatMinorUnits(amount int64, currency string) string {
+	decimals, ok := currencyDecimals[strings.ToUpper(currency)]
+	if !ok {
+		decimals = 2
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if decimals == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	scale := int64(math.Pow10(decimals))
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, decimals, amount%scale)
+}
+
+// writeAccountingOFX writes transactions as an OFX 2.2 bank statement for
+// each account and currency, covering the days from first to last. Each
+// transaction's payee is its NAME and its category its MEMO. The ledger
+// balance is the last balance Monzo sent with a transaction, or zero.
+func writeAccountingOFX(w io.Writer, txs []monzo.Transaction, first, last, generated time.Time) error {
+	type statementKey struct{ account, currency string }
+	statements := make(map[statementKey][]monzo.Transaction)
+	var keys []statementKey
+	for _, tx := range txs {
+		key := statementKey{tx.AccountID, tx.Currency}
+		if statements[key] == nil {
+			keys = append(keys, key)
+		}
+		statements[key] = append(statements[key], tx)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].account < keys[j].account || keys[i].account == keys[j].account && keys[i].currency < keys[j].currency
+	})
+
+	var b strings.Builder
+	status := "<STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>"
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n")
+	b.WriteString(`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n")
+	b.WriteString("<OFX>\n")
+	fmt.Fprintf(&b, "<SIGNONMSGSRSV1><SONRS>%s<DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n",
+		status, generated.UTC().Format(ofxDateLayout))
+	b.WriteString("<BANKMSGSRSV1>\n")
+	for i, key := range keys {
+		fmt.Fprintf(&b, "<STMTTRNRS><TRNUID>%d</TRNUID>%s<STMTRS><CURDEF>%s</CURDEF>\n", i+1, status, ofxText(key.currency, 3))
+		fmt.Fprintf(&b, "<BANKACCTFROM><BANKID>%s</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n",
+			monzoSortCode, ofxText(key.account, 255))
+		fmt.Fprintf(&b, "<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>\n",
+			first.Format(ofxDateLayout), last.AddDate(0, 0, 1).Add(-time.Second).Format(ofxDateLayout))
+		var balance int64
+		for _, tx := range statements[key] {
+			trnType := "CREDIT"
+			if tx.Amount < 0 {
+				trnType = "DEBIT"
+			}
+			if tx.AccountBalance != nil {
+				balance = *tx.AccountBalance
+			}
+			fmt.Fprintf(&b, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s</NAME>",
+				trnType, tx.Created.UTC().Format(ofxDateLayout), formatMinorUnits(tx.Amount, tx.Currency), ofxText(tx.ID, 255), ofxText(accountingPayee(tx), 32))
+			if tx.Category != "" {
+				fmt.Fprintf(&b, "<MEMO>%s</MEMO>", ofxText(tx.Category, 255))
+			}
+			b.WriteString("</STMTTRN>\n")
+		}
+		b.WriteString("</BANKTRANLIST>\n")
+		fmt.Fprintf(&b, "<LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>\n</STMTRS></STMTTRNRS>\n",
+			formatMinorUnits(balance, key.currency), generated.UTC().Format(ofxDateLayout))
+	}
+	b.WriteString("</BANKMSGSRSV1>\n</OFX>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ofxText escapes up to max characters of s for an OFX element
+func ofxText(s string, max int) string {
+	if r := []rune(s); len(r) > max {
+		s = string(r[:max])
+	}
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// accountingExport is an export of stored transactions for accounting tools
+type accountingExport struct {
+	format  string
+	columns []accountingColumn
+	first   time.Time
+	last    time.Time
+	account string
+}
+
+// parseAccountingExport checks an export's format, column mapping and
+// dates, which are YYYY-MM-DD in UTC
+func parseAccountingExport(format, columns, from, to, account string) (accountingExport, error) {
+	export := accountingExport{format: format, account: account}
+	if format != "csv" && format != "ofx" {
+		return export, fmt.Errorf("unknown format '%s', must be csv or ofx", format)
+	}
+	var err error
+	if export.columns, err = parseAccountingColumns(columns); err != nil {
+		return export, err
+	}
+	if export.first, err = time.Parse(exportDateLayout, from); err != nil {
+		return export, errors.New("from must be a date such as 2024-04-06")
+	}
+	if export.last, err = time.Parse(exportDateLayout, to); err != nil {
+		return export, errors.New("to must be a date such as 2025-04-05")
+	}
+	if export.last.Before(export.first) {
+		return export, errors.New("to must not be before from")
+	}
+	return export, nil
+}
+
+// write reads the export's transactions from source and writes them
+func (e accountingExport) write(ctx context.Context, w io.Writer, source eventSource, accounts []AccountConfig, now time.Time) (int, error) {
+	txs, err := storedTransactions(ctx, source, e.first, e.last, e.account)
+	if err != nil {
+		return 0, err
+	}
+	if e.format == "ofx" {
+		return len(txs), writeAccountingOFX(w, txs, e.first, e.last, now)
+	}
+	label := func(id string) string {
+		if label, _ := knownAccounts.lookup(accounts, id); label != "" {
+			return label
+		}
+		return id
+	}
+	return len(txs), writeAccountingCSV(w, txs, e.columns, label)
+}
+
+// filename names an export after its date range and format
+func (e accountingExport) filename() string {
+	return fmt.Sprintf("monzo-transactions-%s-to-%s.%s", e.first.Format(exportDateLayout), e.last.Format(exportDateLayout), e.format)
+}
+
+// adminTransactionsExportHandler serves the stored transactions created
+// between the from and to dates, inclusive, as CSV or OFX
+func adminTransactionsExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	export, err := parseAccountingExport(format, query.Get("columns"), query.Get("from"), query.Get("to"), query.Get("account"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body strings.Builder
+	count, err := export.write(r.Context(), &body, storedEventSource, currentConfig().Accounts, clock.Now())
+	if err != nil {
+		logError("Error exporting stored transactions: %v", err)
+		http.Error(w, "Error reading stored events", http.StatusServiceUnavailable)
+		return
+	}
+	logInfo("Exported %d stored transactions from %s to %s as %s", count,
+		export.first.Format(exportDateLayout), export.last.Format(exportDateLayout), format)
+	contentType := "text/csv; charset=utf-8"
+	if format == "ofx" {
+		contentType = "application/x-ofx"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, export.filename()))
+	io.WriteString(w, body.String())
+}
+
+// runExportTransactions implements the export-transactions command, which
+// writes the transactions in the event store as CSV or OFX. It returns the
+// process exit code.
+func runExportTransactions(args []string, out io.Writer) int {
+	flags, configFlag := newSettingsFlags("export-transactions", out)
+	format := flags.String("format", "csv", "file format: csv or ofx")
+	columns := flags.String("columns", defaultAccountingColumns, "CSV columns, as field or field:Header, comma separated")
+	from := flags.String("from", "", "first day to export, as YYYY-MM-DD in UTC (required)")
+	to := flags.String("to", "", "last day to export, as YYYY-MM-DD in UTC (required)")
+	account := flags.String("account", "", "only export this account ID's transactions")
+	output := flags.String("output", "", "file to write to (default: standard output)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	export, err := parseAccountingExport(*format, *columns, *from, *to, *account)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	config, err := readEventConfig(configFilePath(*configFlag))
+	if err != nil {
+		fmt.Fprintf(out, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	if config.Store.Path == "" {
+		fmt.Fprintln(out, "The event store isn't configured: set store.path or STORE_PATH")
+		return 1
+	}
+	// Don't create a database where there isn't one
+	if _, err := os.Stat(config.Store.Path); err != nil {
+		fmt.Fprintf(out, "Error opening event store: %v\n", err)
+		return 1
+	}
+	store, err := openEventStore(config.Store)
+	if err != nil {
+		fmt.Fprintf(out, "Error opening event store: %v\n", err)
+		return 1
+	}
+	defer store.db.Close()
+
+	if *output == "" {
+		if _, err := export.write(context.Background(), out, store, config.Accounts, clock.Now()); err != nil {
+			fmt.Fprintf(out, "Error exporting transactions: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintf(out, "Error creating %s: %v\n", *output, err)
+		return 1
+	}
+	count, err := export.write(context.Background(), f, store, config.Accounts, clock.Now())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Error exporting transactions: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "Wrote %d transactions to %s\n", count, *output)
+	return 0
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// newTestAccountingStore returns an event store holding transaction.created
+// events for the transactions, in order
+func newTestAccountingStore(t *testing.T, txs []monzo.Transaction) (*eventStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.db")
+	store, err := openEventStore(StoreConfig{Path: path})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	for i, tx := range txs {
+		body, _ := json.Marshal(map[string]interface{}{"type": monzo.TypeTransactionCreated, "data": tx})
+		store.record(&webhookEvent{
+			ID:        "evt_" + tx.ID,
+			Type:      monzo.TypeTransactionCreated,
+			AccountID: tx.AccountID,
+			Received:  tx.Created.Add(time.Duration(i) * time.Millisecond),
+		}, body, storedDelivery{}, "")
+	}
+	return store, path
+}
+
+func testAccountingTransactions() []monzo.Transaction {
+	day := func(d int, hour int) time.Time { return time.Date(2024, 4, d, hour, 0, 0, 0, time.UTC) }
+	balance := int64(123456)
+	return []monzo.Transaction{
+		{ID: "tx_before", Created: day(5, 23), Amount: -100, Currency: "GBP", AccountID: "acc_1"},
+		{ID: "tx_salary", Created: day(6, 9), Amount: 250000, Currency: "GBP", AccountID: "acc_1", Category: "income", Description: "ACME LTD",
+			Counterparty: &monzo.Counterparty{Name: "Acme Ltd"}},
+		{ID: "tx_coffee", Created: day(7, 8), Amount: -350, Currency: "GBP", AccountID: "acc_1", Category: "eating_out", Description: "COFFEE SOHO",
+			Merchant: &monzo.Merchant{ID: "merch_1", Name: "Coffee & Cake"}, AccountBalance: &balance},
+		{ID: "tx_coffee", Created: day(7, 8), Amount: -350, Currency: "GBP", AccountID: "acc_1", Category: "eating_out", Description: "COFFEE SOHO"},
+		{ID: "tx_declined", Created: day(7, 9), Amount: -5000, Currency: "GBP", AccountID: "acc_1", DeclineReason: "INSUFFICIENT_FUNDS"},
+		{ID: "tx_joint", Created: day(8, 12), Amount: -12000, Currency: "GBP", AccountID: "acc_2", Category: "groceries", Description: "=TESCO"},
+		{ID: "tx_after", Created: day(9, 0), Amount: -100, Currency: "GBP", AccountID: "acc_1"},
+	}
+}
+
+func TestParseAccountingColumns(t *testing.T) {
+	columns, err := parseAccountingColumns("date:Date, merchant:Payee,amount")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []accountingColumn{{"date", "Date"}, {"merchant", "Payee"}, {"amount", "amount"}}
+	if len(columns) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, columns)
+	}
+	for i := range expected {
+		if columns[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], columns[i])
+		}
+	}
+
+	if columns, err := parseAccountingColumns(""); err != nil || len(columns) != 6 {
+		t.Errorf("Expected the default columns, got %v, %v", columns, err)
+	}
+	if _, err := parseAccountingColumns("date,payee"); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+}
+
+func TestStoredTransactions(t *testing.T) {
+	store, _ := newTestAccountingStore(t, testAccountingTransactions())
+	first, last := time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 8, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		account string
+		ids     []string
+	}{
+		{name: "All accounts", ids: []string{"tx_salary", "tx_coffee", "tx_joint"}},
+		{name: "One account", account: "acc_2", ids: []string{"tx_joint"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txs, err := storedTransactions(context.Background(), store, first, last, tt.account)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var ids []string
+			for _, tx := range txs {
+				ids = append(ids, tx.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+				t.Errorf("Expected transactions %v, got %v", tt.ids, ids)
+			}
+		})
+	}
+}
+
+func TestWriteAccountingCSV(t *testing.T) {
+	txs := testAccountingTransactions()
+	columns, _ := parseAccountingColumns("date:Date,merchant:Payee,debit:Paid out,credit:Paid in,currency,category:Category")
+	var buf bytes.Buffer
+	if err := writeAccountingCSV(&buf, []monzo.Transaction{txs[1], txs[2], txs[5]}, columns, func(id string) string { return id }); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	expected := [][]string{
+		{"Date", "Payee", "Paid out", "Paid in", "currency", "Category"},
+		{"2024-04-06", "Acme Ltd", "", "2500.00", "GBP", "income"},
+		{"2024-04-07", "Coffee & Cake", "3.50", "", "GBP", "eating_out"},
+		{"2024-04-08", "'=TESCO", "120.00", "", "GBP", "groceries"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, records)
+	}
+	for i := range expected {
+		if strings.Join(records[i], "|") != strings.Join(expected[i], "|") {
+			t.Errorf("Expected row %v, got %v", expected[i], records[i])
+		}
+	}
+}
+
+func TestCSVText(t *testing.T) {
+	tests := map[string]string{
+		"":              "",
+		"Coffee":        "Coffee",
+		"=SUM(A1)":      "'=SUM(A1)",
+		"+44 20":        "'+44 20",
+		"-2+3":          "'-2+3",
+		"@SUM(A1)":      "'@SUM(A1)",
+		"\t=SUM(A1)":    "'\t=SUM(A1)",
+		"\r=SUM(A1)":    "'\r=SUM(A1)",
+		"Lunch = 12.50": "Lunch = 12.50",
+	}
+	for input, expected := range tests {
+		if got := csvText(input); got != expected {
+			t.Errorf("csvText(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestFormatMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		expected string
+	}{
+		{-1250, "GBP", "-12.50"},
+		{5, "EUR", "0.05"},
+		{-1250, "JPY", "-1250"},
+		{1250, "jpy", "1250"},
+		{-12500, "KWD", "-12.500"},
+		{1, "BHD", "0.001"},
+		{10000, "CLF", "1.0000"},
+		{-1250, "", "-12.50"},
+	}
+	for _, tt := range tests {
+		if got := formatMinorUnits(tt.amount, tt.currency); got != tt.expected {
+			t.Errorf("formatMinorUnits(%d, %q) = %s, expected %s", tt.amount, tt.currency, got, tt.expected)
+		}
+	}
+}
+
+func TestWriteAccountingOFX(t *testing.T) {
+	txs := testAccountingTransactions()
+	first, last := time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 8, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	err := writeAccountingOFX(&buf, []monzo.Transaction{txs[1], txs[2], txs[5]}, first, last, time.Date(2024, 4, 10, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var ofx struct {
+		Statements []struct {
+			Currency string `xml:"STMTRS>CURDEF"`
+			Account  string `xml:"STMTRS>BANKACCTFROM>ACCTID"`
+			Start    string `xml:"STMTRS>BANKTRANLIST>DTSTART"`
+			End      string `xml:"STMTRS>BANKTRANLIST>DTEND"`
+			Balance  string `xml:"STMTRS>LEDGERBAL>BALAMT"`
+			Lines    []struct {
+				Type   string `xml:"TRNTYPE"`
+				Posted string `xml:"DTPOSTED"`
+				Amount string `xml:"TRNAMT"`
+				ID     string `xml:"FITID"`
+				Name   string `xml:"NAME"`
+				Memo   string `xml:"MEMO"`
+			} `xml:"STMTRS>BANKTRANLIST>STMTTRN"`
+		} `xml:"BANKMSGSRSV1>STMTTRNRS"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &ofx); err != nil {
+		t.Fatalf("Invalid OFX: %v\n%s", err, buf.String())
+	}
+	if len(ofx.Statements) != 2 {
+		t.Fatalf("Expected a statement per account, got %d", len(ofx.Statements))
+	}
+	personal := ofx.Statements[0]
+	if personal.Account != "acc_1" || personal.Currency != "GBP" || personal.Start != "20240406000000" || personal.End != "20240408235959" {
+		t.Errorf("Unexpected statement %+v", personal)
+	}
+	if personal.Balance != "1234.56" {
+		t.Errorf("Expected the last balance, got %s", personal.Balance)
+	}
+	if len(personal.Lines) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(personal.Lines))
+	}
+	coffee := personal.Lines[1]
+	if coffee.Type != "DEBIT" || coffee.Posted != "20240407080000" || coffee.Amount != "-3.50" || coffee.ID != "tx_coffee" ||
+		coffee.Name != "Coffee & Cake" || coffee.Memo != "eating_out" {
+		t.Errorf("Unexpected transaction %+v", coffee)
+	}
+	if personal.Lines[0].Type != "CREDIT" || ofx.Statements[1].Balance != "0.00" {
+		t.Errorf("Unexpected statements %+v", ofx.Statements)
+	}
+}
+
+func TestAdminTransactionsExportHandler(t *testing.T) {
+	originalSource := storedEventSource
+	defer func() { storedEventSource = originalSource }()
+	store, _ := newTestAccountingStore(t, testAccountingTransactions())
+	storedEventSource = store
+
+	tests := []struct {
+		name        string
+		query       string
+		expect      int
+		contentType string
+	}{
+		{name: "CSV", query: "from=2024-04-06&to=2024-04-08", expect: http.StatusOK, contentType: "text/csv; charset=utf-8"},
+		{name: "OFX", query: "from=2024-04-06&to=2024-04-08&format=ofx", expect: http.StatusOK, contentType: "application/x-ofx"},
+		{name: "Unknown format", query: "from=2024-04-06&to=2024-04-08&format=qif", expect: http.StatusBadRequest},
+		{name: "Unknown column", query: "from=2024-04-06&to=2024-04-08&columns=payee", expect: http.StatusBadRequest},
+		{name: "Missing dates", query: "", expect: http.StatusBadRequest},
+		{name: "Reversed dates", query: "from=2024-04-08&to=2024-04-06", expect: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminTransactionsExportHandler(w, httptest.NewRequest(http.MethodGet, "/admin/transactions/export?"+tt.query, nil))
+			if w.Code != tt.expect {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expect, w.Code, w.Body.String())
+			}
+			if tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("Expected content type %s, got %s", tt.contentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	adminTransactionsExportHandler(w, httptest.NewRequest(http.MethodGet, "/admin/transactions/export?from=2024-04-06&to=2024-04-08", nil))
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="monzo-transactions-2024-04-06-to-2024-04-08.csv"` {
+		t.Errorf("Unexpected disposition %s", disposition)
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 4 {
+		t.Errorf("Expected a header and 3 transactions, got %d lines: %s", lines, w.Body.String())
+	}
+}
+
+func TestRunExportTransactions(t *testing.T) {
+	_, path := newTestAccountingStore(t, testAccountingTransactions())
+	output := filepath.Join(t.TempDir(), "transactions.csv")
+	t.Setenv("CONFIG_FILE", "")
+	origFlags := configFlags
+	defer func() { configFlags = origFlags }()
+	configFlags = map[string]string{}
+
+	var out bytes.Buffer
+	code := runExportTransactions([]string{"-channel", "monzo", "-store-path", path, "-from", "2024-04-06", "-to", "2024-04-08",
+		"-columns", "id", "-output", output}, &out)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, out.String())
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "id\ntx_salary\ntx_coffee\ntx_joint\n" {
+		t.Errorf("Unexpected export %q", data)
+	}
+
+	out.Reset()
+	if code := runExportTransactions([]string{"-channel", "monzo", "-store-path", filepath.Join(t.TempDir(), "missing.db"), "-from", "2024-04-06", "-to", "2024-04-08"}, &out); code != 1 {
+		t.Errorf("Expected exit code 1 without a store, got %d: %s", code, out.String())
+	}
+}
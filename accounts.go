@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// AccountConfig names an account, so that events carry a friendly label
+// instead of its ID, and can route its events to their own channel. Without
+// a label, one is made from the account's details in the Monzo API.
+type AccountConfig struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	// Channel is the Redis channel the account's events are published to,
+	// instead of the top-level channel
+	Channel string `json:"channel"`
+	// Tokens gives the account its own Monzo API tokens, for an account the
+	// shared tokens can't see
+	Tokens *AccountTokenConfig `json:"tokens"`
+}
+
+// accountDetails describe an account. The sort code is masked to its last
+// two digits.
+type accountDetails struct {
+	Type     string `json:"type,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	SortCode string `json:"sort_code,omitempty"`
+}
+
+// monzoAccount is an account as returned by the Monzo API
+type monzoAccount struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Closed      bool   `json:"closed"`
+	SortCode    string `json:"sort_code"`
+	Owners      []struct {
+		PreferredName string `json:"preferred_name"`
+	} `json:"owners"`
+}
+
+// accountTypes are friendly names for Monzo's account types
+var accountTypes = map[string]string{
+	"uk_retail":       "personal",
+	"uk_retail_joint": "joint",
+	"uk_business":     "business",
+	"uk_monzo_flex":   "flex",
+	"uk_prepaid":      "prepaid",
+}
+
+// validateAccounts checks the configured accounts for missing or duplicate IDs
+func validateAccounts(accounts []AccountConfig) error {
+	seen := make(map[string]bool, len(accounts))
+	for i, account := range accounts {
+		if account.ID == "" {
+			return fmt.Errorf("account %d must have an id", i+1)
+		}
+		if seen[account.ID] {
+			return fmt.Errorf("account '%s' is configured more than once", account.ID)
+		}
+		seen[account.ID] = true
+	}
+	return nil
+}
+
+// accountChannel returns the channel configured for an account, if any
+func accountChannel(accounts []AccountConfig, id string) string {
+	if id == "" {
+		return ""
+	}
+	for _, account := range accounts {
+		if account.ID == id {
+			return account.Channel
+		}
+	}
+	return ""
+}
+
+// accountDirectory holds the details of the configured accounts, read from
+// the Monzo API
+type accountDirectory struct {
+	mu      sync.RWMutex
+	details map[string]accountDetails
+}
+
+var knownAccounts = &accountDirectory{details: make(map[string]accountDetails)}
+
+// accounts lists the accounts the access token can see
+func (c *monzoClient) accounts(ctx context.Context) ([]monzoAccount, error) {
+	var result struct {
+		Accounts []monzoAccount `json:"accounts"`
+	}
+	err := c.do(ctx, "accounts", http.MethodGet, "/accounts", nil, &result)
+	return result.Accounts, err
+}
+
+// load reads the details of the configured accounts from the Monzo API, with
+// the tokens of each. Accounts whose tokens fail keep the details read before.
+func (d *accountDirectory) load(ctx context.Context, client *monzoClient, accounts []AccountConfig) error {
+	var found []monzoAccount
+	var keep []string
+	var errs []error
+	for _, c := range client.clientsFor(accounts) {
+		visible, err := c.accounts(ctx)
+		if err != nil {
+			errs = append(errs, c.wrapError(err))
+			keep = append(keep, c.servedAccounts(accounts)...)
+			continue
+		}
+		found = append(found, visible...)
+	}
+	d.set(found, accounts, keep)
+	return errors.Join(errs...)
+}
+
+// set replaces the details of the configured accounts with those of the
+// accounts found in the Monzo API, except for the accounts in keep, which
+// weren't looked up and keep their details
+func (d *accountDirectory) set(found []monzoAccount, accounts []AccountConfig, keep []string) {
+	byID := make(map[string]monzoAccount, len(found))
+	for _, account := range found {
+		byID[account.ID] = account
+	}
+
+	details := make(map[string]accountDetails, len(accounts))
+	for _, configured := range accounts {
+		if slices.Contains(keep, configured.ID) {
+			continue
+		}
+		account, ok := byID[configured.ID]
+		if !ok {
+			logWarn("Account %s isn't visible to the Monzo access token, so it's labelled from config only", configured.ID)
+			continue
+		}
+		var owners []string
+		for _, owner := range account.Owners {
+			owners = append(owners, owner.PreferredName)
+		}
+		accountType := accountTypes[account.Type]
+		if accountType == "" {
+			accountType = account.Type
+		}
+		details[account.ID] = accountDetails{
+			Type:     accountType,
+			Owner:    strings.Join(owners, " & "),
+			SortCode: maskSortCode(account.SortCode),
+		}
+	}
+
+	d.mu.Lock()
+	for _, id := range keep {
+		if previous, ok := d.details[id]; ok {
+			details[id] = previous
+		}
+	}
+	d.details = details
+	d.mu.Unlock()
+}
+
+// lookup returns an account's label and details, if the account is configured
+func (d *accountDirectory) lookup(accounts []AccountConfig, id string) (string, *accountDetails) {
+	for _, configured := range accounts {
+		if configured.ID != id {
+			continue
+		}
+		d.mu.RLock()
+		details, ok := d.details[id]
+		d.mu.RUnlock()
+		if !ok {
+			return configured.Label, nil
+		}
+		label := configured.Label
+		if label == "" && details.Owner != "" {
+			label = fmt.Sprintf("%s (%s)", details.Owner, details.Type)
+		}
+		return label, &details
+	}
+	return "", nil
+}
+
+// maskSortCode hides all but the last two digits of a sort code
+func maskSortCode(sortCode string) string {
+	digits := strings.ReplaceAll(sortCode, "-", "")
+	if len(digits) != 6 {
+		return ""
+	}
+	return "**-**-" + digits[4:]
+}
+
+// labelAccount adds data.account_label, and data.account_details when they
+// were read from the Monzo API, to events for configured accounts. It
+// returns whether the payload changed. Tenants' events aren't labelled, as
+// their account ID is whatever the tenant sent, and a configured account's
+// label and details would be disclosed to a tenant that sent its ID.
+func labelAccount(d *accountDirectory, accounts []AccountConfig, event *webhookEvent) bool {
+	if event.AccountID == "" || event.Tenant != nil {
+		return false
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	label, details := d.lookup(accounts, event.AccountID)
+	if label == "" {
+		return false
+	}
+
+	data["account_label"] = label
+	if details != nil {
+		data["account_details"] = details
+	}
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding labelled %s event %s: %v", event.Type, event.ID, err)
+		return false
+	}
+	event.Body = body
+	return true
+}
+
+// eventAccountLabel returns an event's account label, or its account ID if
+// the account isn't labelled
+func eventAccountLabel(event *webhookEvent) string {
+	data, _ := event.Payload["data"].(map[string]interface{})
+	if label, _ := data["account_label"].(string); label != "" {
+		return label
+	}
+	return event.AccountID
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccountDirectory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/accounts" {
+			t.Errorf("Unexpected request: %s", r.URL)
+		}
+		w.Write([]byte(`{"accounts": [
+			{"id": "acc_1", "type": "uk_retail", "sort_code": "040004", "owners": [{"preferred_name": "Alice"}]},
+			{"id": "acc_2", "type": "uk_retail_joint", "sort_code": "04-00-04", "owners": [{"preferred_name": "Alice"}, {"preferred_name": "Bob"}]},
+			{"id": "acc_3", "type": "uk_business"}
+		]}`))
+	}))
+	defer server.Close()
+
+	accounts := []AccountConfig{{ID: "acc_1"}, {ID: "acc_2", Label: "Household"}, {ID: "acc_4", Label: "Savings"}}
+	directory := &accountDirectory{details: make(map[string]accountDetails)}
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+	if err := directory.load(context.Background(), client, accounts); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	tests := []struct {
+		id      string
+		label   string
+		details *accountDetails
+	}{
+		{id: "acc_1", label: "Alice (personal)", details: &accountDetails{Type: "personal", Owner: "Alice", SortCode: "**-**-04"}},
+		{id: "acc_2", label: "Household", details: &accountDetails{Type: "joint", Owner: "Alice & Bob", SortCode: "**-**-04"}},
+		{id: "acc_3"},
+		{id: "acc_4", label: "Savings"},
+	}
+	for _, tt := range tests {
+		label, details := directory.lookup(accounts, tt.id)
+		if label != tt.label {
+			t.Errorf("Expected %s to be labelled '%s', got '%s'", tt.id, tt.label, label)
+		}
+		if (details == nil) != (tt.details == nil) || details != nil && *details != *tt.details {
+			t.Errorf("Expected %s to have details %+v, got %+v", tt.id, tt.details, details)
+		}
+	}
+}
+
+func TestAccountDirectoryWithAccountTokens(t *testing.T) {
+	var mu sync.Mutex
+	expired := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Header.Get("Authorization") {
+		case "Bearer shared":
+			w.Write([]byte(`{"accounts": [{"id": "acc_1", "type": "uk_retail", "owners": [{"preferred_name": "Alice"}]}]}`))
+		case "Bearer bob":
+			if expired {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"accounts": [{"id": "acc_2", "type": "uk_retail", "owners": [{"preferred_name": "Bob"}]}]}`))
+		}
+	}))
+	defer server.Close()
+
+	accounts := []AccountConfig{{ID: "acc_1"}, {ID: "acc_2", Tokens: &AccountTokenConfig{RateLimit: 1}}}
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "shared"}, time.Now)
+	bob := client.addAccount(MonzoAPIConfig{URL: server.URL}, accounts[1], &credentialValue{value: "bob"})
+	if client.forAccount("acc_2") != bob || bob.forAccount("acc_1") != client || client.forAccount("acc_1") != client {
+		t.Error("Expected requests for acc_2 to use its own client")
+	}
+	if bob.limiter == client.limiter || bob.limiter.rate != 1 {
+		t.Errorf("Expected acc_2 to have its own rate limit, got %g", bob.limiter.rate)
+	}
+
+	directory := &accountDirectory{details: make(map[string]accountDetails)}
+	if err := directory.load(context.Background(), client, accounts); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	mu.Lock()
+	expired = true
+	mu.Unlock()
+	if err := directory.load(context.Background(), client, accounts); err == nil || !strings.Contains(err.Error(), "account acc_2 tokens") {
+		t.Errorf("Expected acc_2's tokens to fail, got %v", err)
+	}
+	for id, expect := range map[string]string{"acc_1": "Alice (personal)", "acc_2": "Bob (personal)"} {
+		if label, _ := directory.lookup(accounts, id); label != expect {
+			t.Errorf("Expected %s to be labelled %q, got %q", id, expect, label)
+		}
+	}
+}
+
+func TestLabelAccount(t *testing.T) {
+	directory := &accountDirectory{details: map[string]accountDetails{
+		"acc_1": {Type: "personal", Owner: "Alice", SortCode: "**-**-04"},
+	}}
+	accounts := []AccountConfig{{ID: "acc_1", Label: "Main"}}
+
+	payload := map[string]interface{}{"type": "transaction.created", "data": map[string]interface{}{"id": "tx_1", "account_id": "acc_1"}}
+	event := &webhookEvent{ID: "evt_1", Type: "transaction.created", AccountID: "acc_1", Payload: payload}
+	if !labelAccount(directory, accounts, event) {
+		t.Fatal("Expected the event to be labelled")
+	}
+	var body struct {
+		Data struct {
+			AccountLabel   string         `json:"account_label"`
+			AccountDetails accountDetails `json:"account_details"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(event.Body, &body); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if body.Data.AccountLabel != "Main" || body.Data.AccountDetails.SortCode != "**-**-04" {
+		t.Errorf("Unexpected labelled body: %s", event.Body)
+	}
+	if got := eventAccountLabel(event); got != "Main" {
+		t.Errorf("Expected the alert label 'Main', got '%s'", got)
+	}
+
+	tenant := &webhookEvent{Type: "transaction.created", AccountID: "acc_1", Tenant: &TenantConfig{Name: "alice"},
+		Payload: map[string]interface{}{"data": map[string]interface{}{"account_id": "acc_1"}}}
+	if labelAccount(directory, accounts, tenant) {
+		t.Error("Expected a tenant's event not to be labelled")
+	}
+
+	other := &webhookEvent{Type: "transaction.created", AccountID: "acc_2", Payload: map[string]interface{}{"data": map[string]interface{}{"account_id": "acc_2"}}}
+	if labelAccount(directory, accounts, other) {
+		t.Error("Expected an unconfigured account not to be labelled")
+	}
+	if got := eventAccountLabel(other); got != "acc_2" {
+		t.Errorf("Expected the alert label to fall back to the ID, got '%s'", got)
+	}
+}
+
+func TestValidateAccounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts []AccountConfig
+		hasErr   bool
+	}{
+		{name: "Valid", accounts: []AccountConfig{{ID: "acc_1", Label: "Main"}, {ID: "acc_2"}}},
+		{name: "Missing ID", accounts: []AccountConfig{{Label: "Main"}}, hasErr: true},
+		{name: "Duplicate", accounts: []AccountConfig{{ID: "acc_1"}, {ID: "acc_1"}}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAccounts(tt.accounts); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error: %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+func TestAccountChannel(t *testing.T) {
+	accounts := []AccountConfig{{ID: "acc_joint", Channel: "monzo-joint"}, {ID: "acc_personal"}}
+	tests := []struct {
+		id     string
+		expect string
+	}{
+		{id: "acc_joint", expect: "monzo-joint"},
+		{id: "acc_personal", expect: ""},
+		{id: "acc_other", expect: ""},
+		{id: "", expect: ""},
+	}
+	for _, tt := range tests {
+		if got := accountChannel(accounts, tt.id); got != tt.expect {
+			t.Errorf("accountChannel(%q) = %q, expected %q", tt.id, got, tt.expect)
+		}
+	}
+}
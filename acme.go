@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager obtains and renews certificates from an ACME certificate
+// authority such as Let's Encrypt, proving control of the domains with the
+// tls-alpn-01 challenge on the HTTPS port itself. Certificates and the ACME
+// account key are cached on disk so that restarts don't request new ones.
+type acmeManager struct {
+	*autocert.Manager
+	domains      []string
+	cacheDir     string
+	directoryURL string
+}
+
+// acmeManagerFromEnv configures automatic certificates from ACME_DOMAIN,
+// ACME_CACHE_DIR, ACME_EMAIL and ACME_DIRECTORY_URL. It returns nil if
+// ACME_DOMAIN is not set.
+func acmeManagerFromEnv() (*acmeManager, error) {
+	rawDomains := os.Getenv("ACME_DOMAIN")
+	if rawDomains == "" {
+		return nil, nil
+	}
+
+	m := &acmeManager{
+		cacheDir:     os.Getenv("ACME_CACHE_DIR"),
+		directoryURL: os.Getenv("ACME_DIRECTORY_URL"),
+	}
+	for _, domain := range strings.Split(rawDomains, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			m.domains = append(m.domains, domain)
+		}
+	}
+	if len(m.domains) == 0 {
+		return nil, fmt.Errorf("ACME_DOMAIN must list at least one domain")
+	}
+	if m.cacheDir == "" {
+		m.cacheDir = "acme-cache"
+	}
+	if m.directoryURL == "" {
+		m.directoryURL = autocert.DefaultACMEDirectory
+	}
+	if err := os.MkdirAll(m.cacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating ACME_CACHE_DIR: %w", err)
+	}
+	m.Manager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(m.cacheDir),
+		HostPolicy: autocert.HostWhitelist(m.domains...),
+		Email:      os.Getenv("ACME_EMAIL"),
+		Client:     &acme.Client{DirectoryURL: m.directoryURL},
+	}
+	return m, nil
+}
+
+// tlsConfig returns the server TLS settings, with certificates from the
+// manager and the ALPN protocol used by the ACME server to validate challenges
+func (m *acmeManager) tlsConfig() *tls.Config {
+	cfg := newServerTLSConfig()
+	cfg.GetCertificate = m.GetCertificate
+	cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	return cfg
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEManagerFromEnv(t *testing.T) {
+	t.Setenv("ACME_DOMAIN", "")
+	if m, err := acmeManagerFromEnv(); m != nil || err != nil {
+		t.Errorf("Expected no manager without ACME_DOMAIN, got %v, %v", m, err)
+	}
+
+	t.Setenv("ACME_DOMAIN", " , ")
+	if _, err := acmeManagerFromEnv(); err == nil {
+		t.Error("Expected an error for an empty domain list")
+	}
+
+	t.Setenv("ACME_DOMAIN", "webhooks.example.com, Example.com")
+	t.Setenv("ACME_CACHE_DIR", t.TempDir())
+	t.Setenv("ACME_DIRECTORY_URL", "")
+	m, err := acmeManagerFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.directoryURL != autocert.DefaultACMEDirectory || m.Client.DirectoryURL != autocert.DefaultACMEDirectory {
+		t.Errorf("Expected the Let's Encrypt directory by default, got %s", m.directoryURL)
+	}
+	if len(m.domains) != 2 || m.domains[1] != "example.com" {
+		t.Errorf("Unexpected domains: %v", m.domains)
+	}
+	cfg := m.tlsConfig()
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.NextProtos[len(cfg.NextProtos)-1] != acme.ALPNProto {
+		t.Errorf("Unexpected TLS config: min version %x, protocols %v", cfg.MinVersion, cfg.NextProtos)
+	}
+}
+
+func TestACMEManagerCertificates(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("ACME_DOMAIN", "example.com")
+	t.Setenv("ACME_CACHE_DIR", cacheDir)
+	t.Setenv("ACME_DIRECTORY_URL", "https://acme.invalid/directory")
+	m, err := acmeManagerFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A certificate left in the cache by an earlier run is served
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	var cached bytes.Buffer
+	pem.Encode(&cached, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&cached, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := autocert.DirCache(cacheDir).Put(context.Background(), "example.com", cached.Bytes()); err != nil {
+		t.Fatalf("Error caching the certificate: %v", err)
+	}
+
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        name,
+			CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		}
+	}
+	cert, err := m.tlsConfig().GetCertificate(hello("Example.com"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], der) {
+		t.Error("Expected the cached certificate")
+	}
+
+	// Certificates are only requested for the configured domains
+	if _, err := m.tlsConfig().GetCertificate(hello("other.example.com")); err == nil {
+		t.Error("Expected an error for a domain that isn't configured")
+	}
+}
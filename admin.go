@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var adminToken string
+
+// adminAuthMiddleware requires the admin bearer token on admin API requests
+func adminAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		expected := currentAdminToken()
+		if expected == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			logWarn("Unauthorized admin request to %s", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logError("Error writing JSON response: %v", err)
+	}
+}
+
+// adminUsageHandler reports per-tenant usage for the current quota window
+func adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenants": tenantUsage.snapshot(currentConfig().Tenants),
+	})
+}
+
+// configEnvVar is an environment variable the server reads its settings
+// from. The values of secret ones are never shown, and they have no command
+// line flag; they're set with their _FILE variable's flag instead.
+type configEnvVar struct {
+	name   string
+	secret bool
+}
+
+// configEnvVars are the environment variables the server reads its settings
+// from, reported by the config endpoint when they are set
+var configEnvVars = []configEnvVar{
+	{name: "LOG_LEVEL"}, {name: "PORT"}, {name: "CONFIG_FILE"}, {name: "DEMO_MODE"},
+	{name: "REDIS_CHANNEL"}, {name: "REDIS_STREAM"}, {name: "REDIS_STREAM_MAX_LEN"}, {name: "REDIS_STREAM_MAX_AGE"},
+	{name: "WORKER_COUNT"}, {name: "WORKER_QUEUE_SIZE"}, {name: "SPOOL_DIR"}, {name: "RETRY_ATTEMPTS"}, {name: "RETRY_TIMEOUT"}, {name: "REQUEST_BUDGET"}, {name: "STRICT_DECODING"},
+	{name: "REDIS_HOST"}, {name: "REDIS_PORT"}, {name: "REDIS_USERNAME"}, {name: "REDIS_PASSWORD", secret: true},
+	{name: "WEBHOOK_USERNAME"}, {name: "WEBHOOK_PASSWORD", secret: true}, {name: "WEBHOOK_HTPASSWD_FILE"}, {name: "WEBHOOK_ALLOWED_CIDRS"},
+	{name: "WEBHOOK_TRUSTED_PROXY_HEADER"}, {name: "WEBHOOK_TRUSTED_PROXIES"}, {name: "WEBHOOK_MAX_BODY_BYTES"},
+	{name: "ADMIN_TOKEN", secret: true}, {name: "TLS_CERT_FILE"}, {name: "TLS_KEY_FILE"},
+	{name: "ACME_DOMAIN"}, {name: "ACME_CACHE_DIR"}, {name: "ACME_EMAIL"}, {name: "ACME_DIRECTORY_URL"},
+	{name: "KAFKA_BROKERS"}, {name: "KAFKA_CLIENT_ID"}, {name: "KAFKA_SASL_MECHANISM"},
+	{name: "KAFKA_SASL_USERNAME"}, {name: "KAFKA_SASL_PASSWORD", secret: true}, {name: "KAFKA_TLS"}, {name: "KAFKA_TLS_CA_FILE"},
+	{name: "AMQP_URL", secret: true},
+	{name: "MQTT_URL", secret: true}, {name: "MQTT_CLIENT_ID"},
+	{name: "AWS_SNS_TOPIC_ARN"}, {name: "AWS_SQS_QUEUE_URL"}, {name: "AWS_REGION"}, {name: "AWS_DEFAULT_REGION"},
+	{name: "AWS_ENDPOINT_URL"}, {name: "AWS_ENDPOINT_URL_SNS"}, {name: "AWS_ENDPOINT_URL_SQS"}, {name: "AWS_ENDPOINT_URL_S3"}, {name: "AWS_CONFIG_FILE"}, {name: "AWS_PROFILE"}, {name: "AWS_ACCESS_KEY_ID"}, {name: "AWS_SECRET_ACCESS_KEY", secret: true},
+	{name: "AWS_SESSION_TOKEN", secret: true}, {name: "AWS_ROLE_ARN"}, {name: "AWS_WEB_IDENTITY_TOKEN_FILE"}, {name: "AWS_ROLE_SESSION_NAME"},
+	{name: "AWS_SHARED_CREDENTIALS_FILE"}, {name: "AWS_CONTAINER_CREDENTIALS_FULL_URI"}, {name: "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"},
+	{name: "AWS_CONTAINER_AUTHORIZATION_TOKEN", secret: true}, {name: "AWS_EC2_METADATA_DISABLED"},
+	{name: "MIRROR_URL"}, {name: "MIRROR_SECRET", secret: true}, {name: "MIRROR_INSTANCE_ID"},
+	{name: "REDIS_PASSWORD_FILE"}, {name: "WEBHOOK_PASSWORD_FILE"}, {name: "ADMIN_TOKEN_FILE"}, {name: "KAFKA_SASL_PASSWORD_FILE"},
+	{name: "AMQP_URL_FILE"}, {name: "MQTT_URL_FILE"}, {name: "AWS_SECRET_ACCESS_KEY_FILE"}, {name: "MIRROR_SECRET_FILE"},
+	{name: "VAULT_ADDR"}, {name: "VAULT_NAMESPACE"}, {name: "VAULT_TOKEN", secret: true}, {name: "VAULT_TOKEN_FILE"}, {name: "VAULT_KUBERNETES_ROLE"},
+	{name: "VAULT_KUBERNETES_MOUNT"}, {name: "VAULT_KUBERNETES_TOKEN_FILE"}, {name: "VAULT_REDIS_PATH"}, {name: "VAULT_WEBHOOK_AUTH_PATH"},
+	{name: "MONZO_ACCESS_TOKEN", secret: true}, {name: "MONZO_ACCESS_TOKEN_FILE"}, {name: "VAULT_MONZO_PATH"}, {name: "PPROF_ADDR"},
+	{name: "SENTRY_DSN", secret: true}, {name: "SENTRY_DSN_FILE"}, {name: "SENTRY_ENVIRONMENT"}, {name: "EXPORT_SIGNING_KEY", secret: true}, {name: "EXPORT_SIGNING_KEY_FILE"},
+	{name: "METRICS_PUSH_URL"}, {name: "METRICS_PUSH_FORMAT"}, {name: "METRICS_PUSH_INTERVAL"}, {name: "METRICS_PUSH_JOB"}, {name: "METRICS_PUSH_INSTANCE"},
+	{name: "METRICS_PUSH_USERNAME"}, {name: "METRICS_PUSH_PASSWORD", secret: true}, {name: "METRICS_PUSH_PASSWORD_FILE"},
+	{name: "WEBHOOK_PUBLIC_URL", secret: true}, {name: "WEBHOOK_PUBLIC_URL_FILE"},
+	{name: "MONZO_CLIENT_ID"}, {name: "MONZO_CLIENT_SECRET", secret: true}, {name: "MONZO_CLIENT_SECRET_FILE"}, {name: "MONZO_REFRESH_TOKEN", secret: true}, {name: "MONZO_REFRESH_TOKEN_FILE"},
+	{name: "MONZO_REDIRECT_URL"}, {name: "FEATURE_FLAGS_ENVIRONMENT"}, {name: "STORE_PATH"}, {name: "REPLICAS"},
+	{name: "POSTGRES_URL", secret: true}, {name: "POSTGRES_URL_FILE"}, {name: "POSTGRES_MAX_CONNS"},
+	{name: "SMTP_HOST"}, {name: "SMTP_PORT"}, {name: "SMTP_USERNAME"}, {name: "SMTP_PASSWORD", secret: true}, {name: "SMTP_PASSWORD_FILE"}, {name: "SMTP_FROM"},
+}
+
+// eventConfigFile is the path the event configuration was loaded from
+var eventConfigFile string
+
+// effectiveConfig returns the configuration the server is running with: the
+// environment variables that are set, the event configuration file and the
+// overrides made through the admin API, with secrets redacted
+func effectiveConfig() (interface{}, error) {
+	_, aliasOverrides := merchantAliases.list()
+	redacted, err := redactConfig(map[string]interface{}{
+		"config_file":   eventConfigFile,
+		"config":        currentConfig(),
+		"feature_flags": featureFlags.list(),
+		"overrides": map[string]interface{}{
+			"muted_merchants":  merchantMutes.list(),
+			"merchant_aliases": aliasOverrides,
+			"settings":         runtimeOverrides.list(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Environment variables are redacted by whether they're marked secret,
+	// rather than by their names
+	environment := make(map[string]string)
+	for _, env := range configEnvVars {
+		value, ok := os.LookupEnv(env.name)
+		switch {
+		case !ok:
+			continue
+		case env.secret && value != "":
+			value = redactedValue
+		default:
+			value = redactURL(value)
+		}
+		environment[env.name] = value
+	}
+	redacted.(map[string]interface{})["environment"] = environment
+	return redacted, nil
+}
+
+// adminConfigHandler reports the effective configuration, with secrets
+// redacted
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := effectiveConfig()
+	if err != nil {
+		logError("Error rendering effective configuration: %v", err)
+		http.Error(w, "Error rendering configuration", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, config)
+}
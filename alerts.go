@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AlertConfig represents where operational alerts are delivered
+type AlertConfig struct {
+	Channel    string `json:"channel"`
+	WebhookURL string `json:"webhook_url"`
+}
+
+// Alert statuses
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is a notification about the health of the service or its consumers
+type Alert struct {
+	Name    string            `json:"alert"`
+	Status  string            `json:"status"`
+	Message string            `json:"message"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+var alertsSent = metrics.newCounterVec("monzo_webhook_alerts_total",
+	"Alerts sent, by alert name and status.", "alert", "status")
+
+var alertHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// sendAlert logs an alert and delivers it to the configured alert channel
+// and webhook URL. Delivery failures are logged but otherwise ignored.
+func sendAlert(ctx context.Context, alert Alert) {
+	if alert.Time.IsZero() {
+		alert.Time = clock.Now().UTC()
+	}
+
+	if alert.Status == AlertResolved {
+		logInfo("Alert %s resolved: %s", alert.Name, alert.Message)
+	} else {
+		logWarn("Alert %s firing: %s", alert.Name, alert.Message)
+	}
+	alertsSent.WithLabelValues(alert.Name, alert.Status).Inc()
+
+	cfg := currentConfig().Alerts
+	if cfg.Channel == "" && cfg.WebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		logError("Error encoding alert %s: %v", alert.Name, err)
+		return
+	}
+
+	if cfg.Channel != "" && redisClient != nil {
+		if err := redisClient.Publish(ctx, cfg.Channel, body).Err(); err != nil {
+			logError("Error publishing alert to Redis channel '%s': %v", cfg.Channel, err)
+		}
+	}
+
+	if cfg.WebhookURL != "" {
+		if err := postAlert(ctx, cfg.WebhookURL, body); err != nil {
+			logError("Error sending alert to webhook: %v", err)
+		}
+	}
+}
+
+// postAlert POSTs an encoded alert to a webhook URL
+func postAlert(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := alertHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
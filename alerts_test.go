@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendAlertToWebhook(t *testing.T) {
+	received := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("Failed to decode alert: %v", err)
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	origConfig := eventConfig
+	origRedisClient := redisClient
+	defer func() {
+		eventConfig = origConfig
+		redisClient = origRedisClient
+	}()
+	eventConfig.Alerts = AlertConfig{WebhookURL: server.URL}
+	redisClient = nil
+
+	sendAlert(context.Background(), Alert{
+		Name:    "consumer_lag",
+		Status:  AlertFiring,
+		Message: "Consumer group 'notifier' is falling behind",
+	})
+
+	select {
+	case alert := <-received:
+		if alert.Name != "consumer_lag" || alert.Status != AlertFiring {
+			t.Errorf("Unexpected alert received: %+v", alert)
+		}
+		if alert.Time.IsZero() {
+			t.Error("Expected alert time to be set")
+		}
+	default:
+		t.Fatal("Expected alert to be delivered to webhook")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// merchantAliasesKey is the Redis hash holding alias overrides, from pattern
+// to alias
+const merchantAliasesKey = "monzo-webhook:merchant-aliases"
+
+// MerchantAlias maps transaction descriptions matching a pattern to a clean
+// merchant name. Patterns are case-insensitive and may use * as a wildcard.
+type MerchantAlias struct {
+	Pattern string `json:"pattern"`
+	Alias   string `json:"alias"`
+}
+
+// aliasRule is a compiled MerchantAlias
+type aliasRule struct {
+	MerchantAlias
+	re *regexp.Regexp
+}
+
+// merchantAliasTable normalises transaction descriptions using aliases from
+// the config file, and overrides stored in Redis which take precedence
+type merchantAliasTable struct {
+	client *redis.Client
+	config []aliasRule
+
+	mu        sync.RWMutex
+	overrides []aliasRule
+}
+
+var merchantAliases = &merchantAliasTable{}
+
+// compileAlias checks an alias and compiles its pattern
+func compileAlias(alias MerchantAlias) (aliasRule, error) {
+	if strings.TrimSpace(alias.Pattern) == "" {
+		return aliasRule{}, fmt.Errorf("merchant alias pattern is required")
+	}
+	if strings.TrimSpace(alias.Alias) == "" {
+		return aliasRule{}, fmt.Errorf("merchant alias for '%s' is empty", alias.Pattern)
+	}
+	return aliasRule{MerchantAlias: alias, re: compileWildcard(alias.Pattern)}, nil
+}
+
+// compileWildcard compiles a pattern where * matches any characters into an
+// anchored, case-insensitive regexp
+func compileWildcard(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile(`(?i)^\s*` + strings.Join(parts, ".*") + `\s*$`)
+}
+
+// validateMerchantAliases checks the configured aliases for missing values
+func validateMerchantAliases(aliases []MerchantAlias) error {
+	for _, alias := range aliases {
+		if _, err := compileAlias(alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMerchantAliasTable(aliases []MerchantAlias, client *redis.Client) *merchantAliasTable {
+	t := &merchantAliasTable{client: client}
+	for _, alias := range aliases {
+		rule, _ := compileAlias(alias)
+		t.config = append(t.config, rule)
+	}
+	return t
+}
+
+// load replaces the overrides with the ones stored in Redis
+func (t *merchantAliasTable) load(ctx context.Context) error {
+	if t.client == nil {
+		return nil
+	}
+	stored, err := t.client.HGetAll(ctx, merchantAliasesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	var overrides []aliasRule
+	for pattern, alias := range stored {
+		rule, err := compileAlias(MerchantAlias{Pattern: pattern, Alias: alias})
+		if err != nil {
+			logWarn("Ignoring stored merchant alias: %v", err)
+			continue
+		}
+		overrides = append(overrides, rule)
+	}
+	sortAliasRules(overrides)
+
+	t.mu.Lock()
+	t.overrides = overrides
+	t.mu.Unlock()
+	return nil
+}
+
+// sortAliasRules orders rules so that longer, more specific patterns are
+// tried first
+func sortAliasRules(rules []aliasRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].Pattern) != len(rules[j].Pattern) {
+			return len(rules[i].Pattern) > len(rules[j].Pattern)
+		}
+		return rules[i].Pattern < rules[j].Pattern
+	})
+}
+
+// set adds or replaces an override
+func (t *merchantAliasTable) set(ctx context.Context, alias MerchantAlias) error {
+	rule, err := compileAlias(alias)
+	if err != nil {
+		return err
+	}
+	if t.client != nil {
+		if err := t.client.HSet(ctx, merchantAliasesKey, alias.Pattern, alias.Alias).Err(); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	overrides := []aliasRule{rule}
+	for _, existing := range t.overrides {
+		if existing.Pattern != alias.Pattern {
+			overrides = append(overrides, existing)
+		}
+	}
+	sortAliasRules(overrides)
+	t.overrides = overrides
+	return nil
+}
+
+// remove deletes an override, reporting whether it existed
+func (t *merchantAliasTable) remove(ctx context.Context, pattern string) (bool, error) {
+	t.mu.RLock()
+	found := false
+	for _, existing := range t.overrides {
+		found = found || existing.Pattern == pattern
+	}
+	t.mu.RUnlock()
+	if !found {
+		return false, nil
+	}
+
+	if t.client != nil {
+		if err := t.client.HDel(ctx, merchantAliasesKey, pattern).Err(); err != nil {
+			return false, err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var overrides []aliasRule
+	for _, existing := range t.overrides {
+		if existing.Pattern != pattern {
+			overrides = append(overrides, existing)
+		}
+	}
+	t.overrides = overrides
+	return true, nil
+}
+
+// list returns the aliases from the configuration file and the runtime
+// overrides
+func (t *merchantAliasTable) list() (config, overrides []MerchantAlias) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	config = []MerchantAlias{}
+	for _, rule := range t.config {
+		config = append(config, rule.MerchantAlias)
+	}
+	overrides = []MerchantAlias{}
+	for _, rule := range t.overrides {
+		overrides = append(overrides, rule.MerchantAlias)
+	}
+	return config, overrides
+}
+
+// lookup returns the alias for a description. Overrides are tried before the
+// config file's aliases, which are tried in order.
+func (t *merchantAliasTable) lookup(description string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, rules := range [][]aliasRule{t.overrides, t.config} {
+		for _, rule := range rules {
+			if rule.re.MatchString(description) {
+				return rule.Alias, true
+			}
+		}
+	}
+	return "", false
+}
+
+// normaliseMerchant replaces an event's data.description with its alias,
+// keeping the original as data.original_description. It returns whether the
+// payload changed.
+func normaliseMerchant(t *merchantAliasTable, event *webhookEvent) bool {
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	description, _ := data["description"].(string)
+	if description == "" {
+		return false
+	}
+	alias, ok := t.lookup(description)
+	if !ok || alias == description {
+		return false
+	}
+
+	data["original_description"] = description
+	data["description"] = alias
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding normalised %s event %s: %v", event.Type, event.ID, err)
+		return false
+	}
+	logDebug("Normalised description of %s event %s from '%s' to '%s'", event.Type, event.ID, description, alias)
+	event.Body = body
+	return true
+}
+
+// adminMerchantAliasesHandler lists the configured aliases and overrides
+func adminMerchantAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, overrides := merchantAliases.list()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"config":    config,
+		"overrides": overrides,
+	})
+}
+
+// adminMerchantAliasHandler sets an override with PUT and removes it with
+// DELETE. PUT takes a body like {"alias": "Amazon"}.
+func adminMerchantAliasHandler(w http.ResponseWriter, r *http.Request) {
+	pattern := r.PathValue("pattern")
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+			return
+		}
+		alias := MerchantAlias{Pattern: pattern, Alias: body.Alias}
+		if _, err := compileAlias(alias); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := merchantAliases.set(r.Context(), alias); err != nil {
+			logError("Error saving merchant alias '%s': %v", pattern, err)
+			http.Error(w, "Error saving merchant alias", http.StatusServiceUnavailable)
+			return
+		}
+		logInfo("Set merchant alias '%s' -> '%s'", pattern, body.Alias)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		removed, err := merchantAliases.remove(r.Context(), pattern)
+		if err != nil {
+			logError("Error removing merchant alias '%s': %v", pattern, err)
+			http.Error(w, "Error saving merchant alias", http.StatusServiceUnavailable)
+			return
+		}
+		if !removed {
+			http.Error(w, "No override for pattern", http.StatusNotFound)
+			return
+		}
+		logInfo("Removed merchant alias '%s'", pattern)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMerchantAliasLookup(t *testing.T) {
+	table := newMerchantAliasTable([]MerchantAlias{
+		{Pattern: "AMZN Mktp UK*", Alias: "Amazon"},
+		{Pattern: "*amazon*", Alias: "Amazon (other)"},
+		{Pattern: "TFL.GOV.UK/CP", Alias: "TfL"},
+	}, nil)
+
+	tests := []struct {
+		description string
+		expected    string
+	}{
+		{description: "AMZN Mktp UK*2A3BC45DE", expected: "Amazon"},
+		{description: "amzn mktp uk*xyz", expected: "Amazon"},
+		{description: "WWW.AMAZON.CO.UK", expected: "Amazon (other)"},
+		{description: "TFL.GOV.UK/CP", expected: "TfL"},
+		{description: "TFL.GOV.UK/CP LONDON"},
+		{description: "Tesco Stores 1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			alias, ok := table.lookup(tt.description)
+			if ok != (tt.expected != "") || alias != tt.expected {
+				t.Errorf("Expected '%s', got '%s' (matched=%v)", tt.expected, alias, ok)
+			}
+		})
+	}
+
+	// Overrides take precedence over the config file
+	table.set(context.Background(), MerchantAlias{Pattern: "TFL*", Alias: "Transport for London"})
+	if alias, _ := table.lookup("TFL.GOV.UK/CP"); alias != "Transport for London" {
+		t.Errorf("Expected the override to win, got '%s'", alias)
+	}
+}
+
+func TestValidateMerchantAliases(t *testing.T) {
+	if err := validateMerchantAliases([]MerchantAlias{{Pattern: "AMZN*", Alias: "Amazon"}}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := validateMerchantAliases([]MerchantAlias{{Pattern: "", Alias: "Amazon"}}); err == nil {
+		t.Error("Expected an error for an empty pattern")
+	}
+	if err := validateMerchantAliases([]MerchantAlias{{Pattern: "AMZN*", Alias: " "}}); err == nil {
+		t.Error("Expected an error for an empty alias")
+	}
+}
+
+func TestNormaliseMerchant(t *testing.T) {
+	table := newMerchantAliasTable([]MerchantAlias{{Pattern: "AMZN Mktp UK*", Alias: "Amazon"}}, nil)
+
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"transaction.created","data":{"description":"AMZN Mktp UK*2A3","amount":-999}}`), &payload)
+	event := &webhookEvent{Type: "transaction.created", Payload: payload}
+
+	if !normaliseMerchant(table, event) {
+		t.Fatal("Expected the description to be normalised")
+	}
+	var published map[string]interface{}
+	json.Unmarshal(event.Body, &published)
+	data := published["data"].(map[string]interface{})
+	if data["description"] != "Amazon" || data["original_description"] != "AMZN Mktp UK*2A3" || data["amount"] != float64(-999) {
+		t.Errorf("Unexpected data: %v", data)
+	}
+
+	json.Unmarshal([]byte(`{"type":"transaction.created","data":{"description":"Tesco"}}`), &payload)
+	if normaliseMerchant(table, &webhookEvent{Payload: payload}) {
+		t.Error("Expected a description without an alias to be left alone")
+	}
+}
+
+func TestAdminMerchantAliasHandlers(t *testing.T) {
+	origAliases := merchantAliases
+	defer func() { merchantAliases = origAliases }()
+
+	server, client := newFakeRedis(t)
+	merchantAliases = newMerchantAliasTable([]MerchantAlias{{Pattern: "AMZN*", Alias: "Amazon"}}, client)
+
+	request := func(method, pattern, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/merchant-aliases/"+url.PathEscape(pattern), strings.NewReader(body))
+		req.SetPathValue("pattern", pattern)
+		rr := httptest.NewRecorder()
+		adminMerchantAliasHandler(rr, req)
+		return rr
+	}
+
+	if rr := request(http.MethodPut, "PRET A MANGER*", `{"alias":"Pret"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code 204, got %d", rr.Code)
+	}
+	if server.hashes[merchantAliasesKey]["PRET A MANGER*"] != "Pret" {
+		t.Error("Expected the override to be stored in Redis")
+	}
+	if rr := request(http.MethodPut, "COSTA*", `{"alias":""}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code 400 for an empty alias, got %d", rr.Code)
+	}
+
+	// Another instance picks up the override from Redis
+	reloaded := newMerchantAliasTable(nil, client)
+	if err := reloaded.load(context.Background()); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if alias, _ := reloaded.lookup("PRET A MANGER 123"); alias != "Pret" {
+		t.Errorf("Expected the reloaded override to apply, got '%s'", alias)
+	}
+
+	rr := httptest.NewRecorder()
+	adminMerchantAliasesHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/merchant-aliases", nil))
+	var response struct {
+		Config    []MerchantAlias `json:"config"`
+		Overrides []MerchantAlias `json:"overrides"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(response.Config) != 1 || len(response.Overrides) != 1 || response.Overrides[0].Alias != "Pret" {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+
+	if rr := request(http.MethodDelete, "PRET A MANGER*", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code 204, got %d", rr.Code)
+	}
+	if _, ok := server.hashes[merchantAliasesKey]["PRET A MANGER*"]; ok {
+		t.Error("Expected the override to be removed from Redis")
+	}
+	if rr := request(http.MethodDelete, "AMZN*", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code 404 for an alias from the config file, got %d", rr.Code)
+	}
+}
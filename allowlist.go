@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// ipAllowlist restricts requests to clients in a set of CIDR ranges. The
+// client address is taken from a proxy header only when the request comes
+// from a trusted proxy, since anyone can set the header.
+type ipAllowlist struct {
+	allowed        []netip.Prefix
+	trustedProxies []netip.Prefix
+	header         string
+}
+
+// webhookAllowlist restricts the webhook endpoint when configured, or is nil
+var webhookAllowlist *ipAllowlist
+
+// ipAllowlistFromEnv builds the webhook allowlist from environment variables.
+// It returns nil if WEBHOOK_ALLOWED_CIDRS is not set.
+func ipAllowlistFromEnv() (*ipAllowlist, error) {
+	rawAllowed := os.Getenv("WEBHOOK_ALLOWED_CIDRS")
+	if rawAllowed == "" {
+		return nil, nil
+	}
+
+	allowed, err := parseCIDRList(rawAllowed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_ALLOWED_CIDRS: %w", err)
+	}
+	a := &ipAllowlist{allowed: allowed, header: os.Getenv("WEBHOOK_TRUSTED_PROXY_HEADER")}
+
+	if rawProxies := os.Getenv("WEBHOOK_TRUSTED_PROXIES"); rawProxies != "" {
+		a.trustedProxies, err = parseCIDRList(rawProxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_TRUSTED_PROXIES: %w", err)
+		}
+	}
+	if a.header != "" && len(a.trustedProxies) == 0 {
+		return nil, fmt.Errorf("WEBHOOK_TRUSTED_PROXIES must be set when WEBHOOK_TRUSTED_PROXY_HEADER is configured")
+	}
+	return a, nil
+}
+
+// parseCIDRList parses a comma-separated list of CIDR ranges. Bare addresses
+// are treated as single-address ranges.
+func parseCIDRList(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no CIDR ranges given")
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether any of the prefixes contains addr
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client that made a request. When the
+// request comes from a trusted proxy, the proxy header is used instead. For
+// X-Forwarded-For style lists, the rightmost address that isn't a trusted
+// proxy is the client, as addresses further left could be forged.
+func (a *ipAllowlist) clientAddr(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address '%s'", r.RemoteAddr)
+	}
+	peer = peer.Unmap()
+
+	if a.header == "" || !containsAddr(a.trustedProxies, peer) {
+		return peer, nil
+	}
+
+	values := r.Header.Values(a.header)
+	if len(values) == 0 {
+		return peer, nil
+	}
+	hops := strings.Split(strings.Join(values, ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid address in %s header: '%s'", a.header, hops[i])
+		}
+		client = addr.Unmap()
+		if !containsAddr(a.trustedProxies, client) {
+			break
+		}
+	}
+	return client, nil
+}
+
+// ipAllowlistMiddleware rejects requests from clients outside the allowlist
+// with 403 Forbidden
+func ipAllowlistMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhookAllowlist == nil {
+			next(w, r)
+			return
+		}
+
+		client, err := webhookAllowlist.clientAddr(r)
+		if err != nil {
+			logWarn("Forbidden webhook request: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !containsAddr(webhookAllowlist.allowed, client) {
+			logWarn("Forbidden webhook request from %s", client)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPAllowlistFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     string
+		header      string
+		proxies     string
+		expectNil   bool
+		expectError bool
+	}{
+		{name: "Not configured", expectNil: true},
+		{name: "Ranges and addresses", allowed: "10.0.0.0/8, 192.168.1.5 ,2001:db8::/32"},
+		{name: "Proxy header with trusted proxies", allowed: "10.0.0.0/8", header: "X-Forwarded-For", proxies: "127.0.0.1"},
+		{name: "Proxy header without trusted proxies", allowed: "10.0.0.0/8", header: "X-Forwarded-For", expectError: true},
+		{name: "Invalid range", allowed: "10.0.0.0/33", expectError: true},
+		{name: "Invalid trusted proxy", allowed: "10.0.0.0/8", proxies: "proxy", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_ALLOWED_CIDRS", tt.allowed)
+			t.Setenv("WEBHOOK_TRUSTED_PROXY_HEADER", tt.header)
+			t.Setenv("WEBHOOK_TRUSTED_PROXIES", tt.proxies)
+
+			allowlist, err := ipAllowlistFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (allowlist == nil) != tt.expectNil {
+				t.Errorf("Expected nil=%v, got %+v", tt.expectNil, allowlist)
+			}
+		})
+	}
+}
+
+func TestIPAllowlistMiddleware(t *testing.T) {
+	origAllowlist := webhookAllowlist
+	defer func() { webhookAllowlist = origAllowlist }()
+
+	allowed, _ := parseCIDRList("203.0.113.0/24,2001:db8::/32")
+	proxies, _ := parseCIDRList("10.0.0.1,10.0.0.2")
+	webhookAllowlist = &ipAllowlist{allowed: allowed, trustedProxies: proxies, header: "X-Forwarded-For"}
+
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	tests := []struct {
+		name               string
+		remoteAddr         string
+		forwardedFor       string
+		expectedStatusCode int
+	}{
+		{name: "Allowed client", remoteAddr: "203.0.113.7:51234", expectedStatusCode: http.StatusOK},
+		{name: "Allowed IPv6 client", remoteAddr: "[2001:db8::1]:51234", expectedStatusCode: http.StatusOK},
+		{name: "Client outside the ranges", remoteAddr: "198.51.100.7:51234", expectedStatusCode: http.StatusForbidden},
+		{name: "Allowed client via trusted proxy", remoteAddr: "10.0.0.1:443", forwardedFor: "203.0.113.7", expectedStatusCode: http.StatusOK},
+		{name: "Client via two trusted proxies", remoteAddr: "10.0.0.1:443", forwardedFor: "203.0.113.7, 10.0.0.2", expectedStatusCode: http.StatusOK},
+		{name: "Forged address left of the client", remoteAddr: "10.0.0.1:443", forwardedFor: "203.0.113.7, 198.51.100.7", expectedStatusCode: http.StatusForbidden},
+		{name: "Header from an untrusted peer is ignored", remoteAddr: "198.51.100.7:51234", forwardedFor: "203.0.113.7", expectedStatusCode: http.StatusForbidden},
+		{name: "Trusted proxy without header", remoteAddr: "10.0.0.1:443", expectedStatusCode: http.StatusForbidden},
+		{name: "Malformed header", remoteAddr: "10.0.0.1:443", forwardedFor: "not-an-ip", expectedStatusCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			rr := httptest.NewRecorder()
+			ipAllowlistMiddleware(okHandler)(rr, req)
+
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatusCode, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpDialTimeout bounds connecting to the broker and the AMQP handshake
+const amqpDialTimeout = 10 * time.Second
+
+// AMQPConfig holds the connection settings for the RabbitMQ broker that amqp
+// sinks publish to
+type AMQPConfig struct {
+	URI amqp.URI
+	TLS *tls.Config
+}
+
+// amqpConfigFromEnv builds an AMQPConfig from environment variables.
+// It returns nil if AMQP_URL is not set.
+func amqpConfigFromEnv() (*AMQPConfig, error) {
+	rawURL, err := getenvSecret("AMQP_URL")
+	if err != nil || rawURL == "" {
+		return nil, err
+	}
+	return parseAMQPURL(rawURL)
+}
+
+// parseAMQPURL parses an amqp:// or amqps:// URI as described by the RabbitMQ URI spec
+func parseAMQPURL(rawURL string) (*AMQPConfig, error) {
+	uri, err := amqp.ParseURI(rawURL)
+	if err != nil {
+		// url.Error includes the URL, and with it the password
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid AMQP_URL: %w", err)
+	}
+
+	cfg := &AMQPConfig{URI: uri}
+	if uri.Scheme == "amqps" {
+		cfg.TLS = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: uri.Host}
+	}
+	return cfg, nil
+}
+
+// sharedAMQPPublisher creates the publisher for the broker in AMQP_URL when
+// an amqp sink is first created. The sinks share its connection.
+var sharedAMQPPublisher = sync.OnceValues(func() (*AMQPPublisher, error) {
+	cfg, err := amqpConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("AMQP_URL must be set to publish to RabbitMQ")
+	}
+	logInfo("AMQP publishing enabled: host=%s:%d vhost=%s", cfg.URI.Host, cfg.URI.Port, cfg.URI.Vhost)
+	return NewAMQPPublisher(*cfg), nil
+})
+
+// AMQPPublisher publishes messages to RabbitMQ exchanges with publisher
+// confirms, reconnecting automatically when the connection is lost
+type AMQPPublisher struct {
+	cfg AMQPConfig
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	returns chan amqp.Return
+}
+
+// NewAMQPPublisher creates a publisher for the given configuration.
+// The connection is established lazily on the first publish.
+func NewAMQPPublisher(cfg AMQPConfig) *AMQPPublisher {
+	return &AMQPPublisher{cfg: cfg}
+}
+
+// Publish sends a message as persistent and mandatory, and waits until the
+// broker has confirmed it. Messages the broker nacks or can't route are
+// errors. If an existing connection turns out to be broken, it reconnects and
+// tries once more. The message ID is set as the message-id property when not
+// empty.
+func (p *AMQPPublisher) Publish(ctx context.Context, exchange, routingKey, messageID, eventType string, body []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reused := p.channel != nil && !p.channel.IsClosed()
+	err := p.publish(ctx, exchange, routingKey, messageID, eventType, body)
+	if err != nil && reused && p.channel == nil && ctx.Err() == nil {
+		logWarn("AMQP publish failed on existing connection, reconnecting: %v", err)
+		err = p.publish(ctx, exchange, routingKey, messageID, eventType, body)
+	}
+	return err
+}
+
+func (p *AMQPPublisher) publish(ctx context.Context, exchange, routingKey, messageID, eventType string, body []byte) error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	confirm, err := p.channel.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, true, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    messageID,
+		Timestamp:    clock.Now(),
+		Type:         eventType,
+		Body:         body,
+	})
+	if err != nil {
+		// The channel or connection is no longer usable
+		p.close()
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		// A late confirm or return would be taken for the next message's
+		p.close()
+		return err
+	}
+
+	// The broker returns unroutable messages before confirming them
+	select {
+	case ret := <-p.returns:
+		return fmt.Errorf("message was returned by the broker: %d %s", ret.ReplyCode, ret.ReplyText)
+	default:
+	}
+	if !acked {
+		return amqpNackError{}
+	}
+	return nil
+}
+
+// connect opens a connection and a channel in confirm mode, unless the
+// current channel is still open
+func (p *AMQPPublisher) connect() error {
+	if p.channel != nil && !p.channel.IsClosed() {
+		return nil
+	}
+	p.close()
+
+	conn, err := amqp.DialConfig(p.cfg.URI.String(), amqp.Config{
+		TLSClientConfig: p.cfg.TLS,
+		Dial:            amqp.DefaultDial(amqpDialTimeout),
+		Properties:      amqp.Table{"connection_name": "monzo-webhook"},
+	})
+	if err != nil {
+		return fmt.Errorf("connecting to AMQP broker: %w", err)
+	}
+	channel, err := conn.Channel()
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("opening AMQP channel: %w", err)
+	}
+	p.conn = conn
+	p.channel = channel
+	p.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
+
+func (p *AMQPPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = nil
+	p.channel = nil
+	p.returns = nil
+}
+
+// Connect connects to the broker, if not already connected, so that the
+// first publish doesn't have to
+func (p *AMQPPublisher) Connect(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connect()
+}
+
+// Close closes the broker connection
+func (p *AMQPPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.close()
+	return nil
+}
+
+// amqpNackError is returned when the broker explicitly refuses a message
+type amqpNackError struct{}
+
+func (amqpNackError) Error() string { return "message was nacked by the broker" }
+
+// validateAMQPSink checks an amqp sink's settings
+func validateAMQPSink(cfg SinkConfig) error {
+	if cfg.Exchange == "" && cfg.RoutingKey == "" {
+		return errors.New("amqp sinks must have an exchange or a routing_key")
+	}
+	return nil
+}
+
+// newAMQPSink creates a sink publishing to an exchange with the shared
+// publisher
+func newAMQPSink(name string, cfg SinkConfig, publisher func() (*AMQPPublisher, error)) (*amqpSink, error) {
+	p, err := publisher()
+	if err != nil {
+		return nil, err
+	}
+	return &amqpSink{name: name, publisher: p, exchange: cfg.Exchange, routingKey: cfg.RoutingKey}, nil
+}
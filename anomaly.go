@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AnomalyConfig configures detection of unusual spending
+type AnomalyConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Multiplier float64 `json:"multiplier"`
+	MinSamples int     `json:"min_samples"`
+}
+
+// Reasons a transaction is reported as an anomaly
+const (
+	anomalyUnusualAmount   = "unusual_amount"
+	anomalyUnusualCategory = "new_merchant_unusual_category"
+)
+
+// anomalyBaselineMaxCount is the number of recent transactions a baseline is
+// weighted towards
+const anomalyBaselineMaxCount = 20
+
+var anomaliesDetected = metrics.newCounterVec("monzo_webhook_anomalies_total",
+	"Transactions reported as spending anomalies, by reason.", "reason")
+
+// validate checks the anomaly detection configuration for invalid values
+func (c AnomalyConfig) validate() error {
+	if c.Multiplier != 0 && c.Multiplier <= 1 {
+		return fmt.Errorf("anomalies multiplier must be greater than 1")
+	}
+	if c.MinSamples < 0 {
+		return fmt.Errorf("anomalies min_samples must not be negative")
+	}
+	return nil
+}
+
+// multiplier returns how many times the usual amount a transaction must be
+// to be reported, defaulting to 3
+func (c AnomalyConfig) multiplier() float64 {
+	if c.Multiplier == 0 {
+		return 3
+	}
+	return c.Multiplier
+}
+
+// minSamples returns how many transactions make a baseline, defaulting to 5
+func (c AnomalyConfig) minSamples() int {
+	if c.MinSamples == 0 {
+		return 5
+	}
+	return c.MinSamples
+}
+
+// spendBaseline is the usual amount spent at a merchant or in a category,
+// weighted towards recent transactions so that it follows changes in spending
+type spendBaseline struct {
+	count int
+	mean  float64
+}
+
+// add includes an amount in the baseline
+func (b *spendBaseline) add(amount float64) {
+	if b.count < anomalyBaselineMaxCount {
+		b.count++
+	}
+	b.mean += (amount - b.mean) / float64(b.count)
+}
+
+// anomalyDetector tracks spending baselines per merchant and category, and
+// sends an alert for transactions that deviate from them
+type anomalyDetector struct {
+	cfg  AnomalyConfig
+	send func(context.Context, Alert)
+
+	mu         sync.Mutex
+	merchants  map[string]*spendBaseline
+	categories map[string]*spendBaseline
+	total      int
+}
+
+// spendAnomalies is set when anomaly detection is enabled
+var spendAnomalies *anomalyDetector
+
+func newAnomalyDetector(cfg AnomalyConfig, send func(context.Context, Alert)) *anomalyDetector {
+	return &anomalyDetector{
+		cfg:        cfg,
+		send:       send,
+		merchants:  make(map[string]*spendBaseline),
+		categories: make(map[string]*spendBaseline),
+	}
+}
+
+// spend is the part of a transaction that anomaly detection looks at
+type spend struct {
+	merchantKey  string
+	merchantName string
+	category     string
+	currency     string
+	amount       float64
+}
+
+// transactionSpend extracts the spend from a transaction.created event,
+// returning false for other events, credits and transactions without a
+// merchant
+func transactionSpend(event *webhookEvent) (spend, bool) {
+	if event.Type != "transaction.created" {
+		return spend{}, false
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return spend{}, false
+	}
+
+	var s spend
+	amount, _ := data["amount"].(float64)
+	if amount >= 0 {
+		return spend{}, false
+	}
+	s.amount = -amount
+	s.category, _ = data["category"].(string)
+	s.currency, _ = data["currency"].(string)
+	switch merchant := data["merchant"].(type) {
+	case map[string]interface{}:
+		s.merchantKey, _ = merchant["id"].(string)
+		s.merchantName, _ = merchant["name"].(string)
+	case string:
+		s.merchantKey = merchant
+	}
+	if s.merchantName == "" {
+		s.merchantName, _ = data["description"].(string)
+	}
+	if s.merchantKey == "" {
+		s.merchantKey = strings.ToLower(s.merchantName)
+	}
+	if s.merchantKey == "" {
+		return spend{}, false
+	}
+	return s, true
+}
+
+// check compares a transaction against the baselines, sending an alert if it
+// is unusual, and then adds it to them. It returns the reason the transaction
+// was reported, or "" if it wasn't.
+func (d *anomalyDetector) check(ctx context.Context, event *webhookEvent) string {
+	if d == nil {
+		return ""
+	}
+	s, ok := transactionSpend(event)
+	if !ok {
+		return ""
+	}
+
+	merchantKey := s.currency + ":" + s.merchantKey
+	categoryKey := s.currency + ":" + s.category
+	minSamples := d.cfg.minSamples()
+	multiplier := runtimeOverrides.float(overrideAnomalyMultiplier, d.cfg.multiplier())
+
+	d.mu.Lock()
+	merchant := d.merchants[merchantKey]
+	category := d.categories[categoryKey]
+	warm := d.total >= minSamples
+
+	var reason, message string
+	var baseline float64
+	switch {
+	case merchant != nil && merchant.count >= minSamples && s.amount > multiplier*merchant.mean:
+		reason, baseline = anomalyUnusualAmount, merchant.mean
+		message = fmt.Sprintf("%s %.2f at '%s' is %.1fx the usual %.2f",
+			s.currency, s.amount/100, s.merchantName, s.amount/merchant.mean, merchant.mean/100)
+	case merchant == nil && s.category != "" && warm && (category == nil || category.count < minSamples):
+		reason = anomalyUnusualCategory
+		if category != nil {
+			baseline = category.mean
+		}
+		message = fmt.Sprintf("%s %.2f at new merchant '%s' in rarely used category '%s'",
+			s.currency, s.amount/100, s.merchantName, s.category)
+	}
+
+	if merchant == nil {
+		merchant = &spendBaseline{}
+		d.merchants[merchantKey] = merchant
+	}
+	merchant.add(s.amount)
+	if s.category != "" {
+		if category == nil {
+			category = &spendBaseline{}
+			d.categories[categoryKey] = category
+		}
+		category.add(s.amount)
+	}
+	d.total++
+	d.mu.Unlock()
+
+	if reason == "" {
+		return ""
+	}
+
+	anomaliesDetected.WithLabelValues(reason).Inc()
+	eventTraces.update(event.ID, func(trace *eventTrace) {
+		trace.MatchedRules = append(trace.MatchedRules, traceRule{Kind: "anomaly", Rule: reason})
+	})
+	d.send(ctx, Alert{
+		Name:    "spend_anomaly",
+		Status:  AlertFiring,
+		Message: message,
+		Labels: map[string]string{
+			"reason":   reason,
+			"event_id": event.ID,
+			"account":  eventAccountLabel(event),
+			"merchant": s.merchantName,
+			"category": s.category,
+			"currency": s.currency,
+			"amount":   strconv.FormatFloat(s.amount, 'f', 0, 64),
+			"baseline": strconv.FormatFloat(math.Round(baseline), 'f', 0, 64),
+		},
+	})
+	return reason
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// spendEvent builds a transaction.created event for a debit in GBP
+func spendEvent(merchant, category string, amount int) *webhookEvent {
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(fmt.Sprintf(
+		`{"type":"transaction.created","data":{"amount":%d,"currency":"GBP","category":%q,"merchant":{"id":"merch_%s","name":%q}}}`,
+		amount, category, merchant, merchant)), &payload)
+	return &webhookEvent{ID: "evt_" + merchant, Type: "transaction.created", Payload: payload}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	var sent []Alert
+	detector := newAnomalyDetector(AnomalyConfig{Enabled: true, MinSamples: 3}, func(ctx context.Context, alert Alert) {
+		sent = append(sent, alert)
+	})
+
+	steps := []struct {
+		name           string
+		event          *webhookEvent
+		expectedReason string
+	}{
+		{name: "First transactions build baselines", event: spendEvent("pret", "eating_out", -450)},
+		{name: "New merchant before warm-up", event: spendEvent("tfl", "transport", -280)},
+		{name: "Usual amount", event: spendEvent("pret", "eating_out", -500)},
+		{name: "Usual amount again", event: spendEvent("pret", "eating_out", -400)},
+		{name: "Slightly more than usual", event: spendEvent("pret", "eating_out", -900)},
+		{name: "Three times the usual amount", event: spendEvent("pret", "eating_out", -2500), expectedReason: anomalyUnusualAmount},
+		{name: "New merchant in a common category", event: spendEvent("leon", "eating_out", -800)},
+		{name: "New merchant in an unusual category", event: spendEvent("casino", "gambling", -5000), expectedReason: anomalyUnusualCategory},
+		{name: "Second visit to the merchant", event: spendEvent("casino", "gambling", -5000)},
+		{name: "Refunds are ignored", event: spendEvent("pret", "eating_out", 10000)},
+		{name: "Other event types are ignored", event: &webhookEvent{Type: "account.updated", Payload: map[string]interface{}{}}},
+	}
+
+	for _, step := range steps {
+		sent = nil
+		reason := detector.check(context.Background(), step.event)
+		if reason != step.expectedReason {
+			t.Fatalf("%s: expected reason '%s', got '%s'", step.name, step.expectedReason, reason)
+		}
+		if step.expectedReason == "" {
+			if len(sent) != 0 {
+				t.Fatalf("%s: expected no alert, got %+v", step.name, sent)
+			}
+			continue
+		}
+		if len(sent) != 1 || sent[0].Name != "spend_anomaly" || sent[0].Status != AlertFiring {
+			t.Fatalf("%s: expected one spend_anomaly alert, got %+v", step.name, sent)
+		}
+		if sent[0].Labels["reason"] != step.expectedReason || sent[0].Labels["event_id"] != step.event.ID {
+			t.Errorf("%s: unexpected labels %v", step.name, sent[0].Labels)
+		}
+	}
+}
+
+func TestSpendBaselineFollowsRecentSpending(t *testing.T) {
+	var b spendBaseline
+	for i := 0; i < 100; i++ {
+		b.add(100)
+	}
+	for i := 0; i < 100; i++ {
+		b.add(1000)
+	}
+	if b.mean < 950 {
+		t.Errorf("Expected the baseline to follow recent spending, got %.1f", b.mean)
+	}
+}
+
+func TestAnomalyConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         AnomalyConfig
+		expectError bool
+	}{
+		{name: "Defaults", cfg: AnomalyConfig{Enabled: true}},
+		{name: "Custom", cfg: AnomalyConfig{Enabled: true, Multiplier: 2.5, MinSamples: 10}},
+		{name: "Multiplier too small", cfg: AnomalyConfig{Multiplier: 0.5}, expectError: true},
+		{name: "Negative min_samples", cfg: AnomalyConfig{MinSamples: -1}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err != nil) != tt.expectError {
+				t.Errorf("Expected error=%v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
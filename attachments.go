@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// AttachmentsConfig configures archiving of transaction attachments, such as
+// receipts, which Monzo serves from URLs that expire. Attachments are stored
+// in a directory or an S3 bucket.
+type AttachmentsConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Dir      string `json:"dir"`
+	S3Bucket string `json:"s3_bucket"`
+	S3Prefix string `json:"s3_prefix"`
+	// MaxBytes is the largest attachment archived, defaulting to 20 MiB
+	MaxBytes int64 `json:"max_bytes"`
+	// Timeout limits each download, defaulting to 30s
+	Timeout string `json:"timeout"`
+	// AllowedURLs are the https URL prefixes attachments are downloaded
+	// from, defaulting to Monzo's upload bucket
+	AllowedURLs []string `json:"allowed_urls"`
+}
+
+// defaultAttachmentURLs are where Monzo serves attachments from, in both of
+// S3's URL styles
+var defaultAttachmentURLs = []string{
+	"https://mondo-image-uploads.s3.eu-west-1.amazonaws.com/",
+	"https://s3-eu-west-1.amazonaws.com/mondo-image-uploads/",
+}
+
+var (
+	attachmentsArchived = metrics.newCounterVec("monzo_webhook_attachments_total",
+		"Transaction attachments seen, by result (archived, existing, error).", "result")
+)
+
+// validate checks the attachments configuration for invalid values
+func (c AttachmentsConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if (c.Dir == "") == (c.S3Bucket == "") {
+		return fmt.Errorf("attachments must have either a dir or an s3_bucket")
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("attachments max_bytes must not be negative")
+	}
+	if _, err := parsePositiveDuration(c.Timeout, 30*time.Second); err != nil {
+		return fmt.Errorf("invalid attachments timeout: %w", err)
+	}
+	for _, prefix := range c.AllowedURLs {
+		u, err := url.Parse(prefix)
+		if err != nil || u.Scheme != "https" || u.Host == "" || !strings.HasSuffix(u.Path, "/") {
+			return fmt.Errorf("invalid attachments allowed_urls entry '%s' (expected an https URL ending in /)", prefix)
+		}
+	}
+	return nil
+}
+
+// allowedURLs returns the URL prefixes attachments are downloaded from
+func (c AttachmentsConfig) allowedURLs() []string {
+	if len(c.AllowedURLs) == 0 {
+		return defaultAttachmentURLs
+	}
+	return c.AllowedURLs
+}
+
+// attachmentStore stores archived attachments by key
+type attachmentStore interface {
+	// exists reports whether an attachment has already been stored
+	exists(ctx context.Context, key string) (bool, error)
+	put(ctx context.Context, key, contentType string, data []byte) error
+	// location describes where an attachment is stored, for consumers
+	location(key string) string
+}
+
+// dirAttachmentStore stores attachments as files under a directory
+type dirAttachmentStore struct {
+	dir string
+}
+
+func (s *dirAttachmentStore) exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.location(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *dirAttachmentStore) put(ctx context.Context, key, contentType string, data []byte) error {
+	filename := s.location(key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a partial file is never archived
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (s *dirAttachmentStore) location(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// s3AttachmentStore stores attachments as objects in an S3 bucket
+type s3AttachmentStore struct {
+	client *s3Client
+	prefix string
+}
+
+func (s *s3AttachmentStore) exists(ctx context.Context, key string) (bool, error) {
+	return s.client.exists(ctx, s.prefix+key)
+}
+
+func (s *s3AttachmentStore) put(ctx context.Context, key, contentType string, data []byte) error {
+	return s.client.put(ctx, s.prefix+key, contentType, data)
+}
+
+func (s *s3AttachmentStore) location(key string) string {
+	return "s3://" + s.client.bucket + "/" + s.prefix + key
+}
+
+// attachmentArchiver downloads the attachments of transaction events and
+// stores them, before their URLs expire
+type attachmentArchiver struct {
+	store       attachmentStore
+	client      *http.Client
+	maxBytes    int64
+	allowedURLs []string
+}
+
+// attachmentArchive is set when attachment archiving is enabled
+var attachmentArchive *attachmentArchiver
+
+func newAttachmentArchiver(cfg AttachmentsConfig, loadAWSConfig func() (aws.Config, error)) (*attachmentArchiver, error) {
+	var store attachmentStore = &dirAttachmentStore{dir: cfg.Dir}
+	if cfg.S3Bucket != "" {
+		client, err := newS3Client(cfg.S3Bucket, loadAWSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("archiving attachments to S3: %w", err)
+		}
+		store = &s3AttachmentStore{client: client, prefix: cfg.S3Prefix}
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = 20 << 20
+	}
+	timeout, _ := parsePositiveDuration(cfg.Timeout, 30*time.Second)
+	client := &http.Client{
+		Timeout: timeout,
+		// A redirect could lead anywhere, so it's an error like any other
+		// unexpected status
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &attachmentArchiver{store: store, client: client, maxBytes: maxBytes, allowedURLs: cfg.allowedURLs()}, nil
+}
+
+// monzoIDPattern matches Monzo object IDs, which are used in archive keys
+var monzoIDPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// transactionIDPattern and attachmentIDPattern match the IDs of Monzo
+// transactions and attachments
+var (
+	transactionIDPattern = regexp.MustCompile(`^tx_[A-Za-z0-9]+$`)
+	attachmentIDPattern  = regexp.MustCompile(`^attach_[A-Za-z0-9]+$`)
+)
+
+// archive stores the attachments of a transaction event that haven't been
+// archived yet, and adds where each is stored to the event as
+// data.attachments[].archived_location. Attachments that fail are logged
+// and left out, so the event is still published. Tenants' events are left
+// alone, so that they can't fill the archive or have the server fetch URLs
+// for them.
+func (a *attachmentArchiver) archive(ctx context.Context, event *webhookEvent) {
+	if a == nil || !strings.HasPrefix(event.Type, "transaction.") || event.Tenant != nil {
+		return
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	transactionID, _ := data["id"].(string)
+	attachments, _ := data["attachments"].([]interface{})
+	if len(attachments) == 0 || !transactionIDPattern.MatchString(transactionID) {
+		return
+	}
+
+	original := event.Body
+	changed := false
+	for _, item := range attachments {
+		attachment, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		location, err := a.archiveAttachment(ctx, transactionID, attachment)
+		if err != nil {
+			attachmentsArchived.WithLabelValues("error").Inc()
+			logWarn("Error archiving attachment of %s event %s: %v", event.Type, event.ID, err)
+			continue
+		}
+		attachment["archived_location"] = location
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding %s event %s with archived attachments: %v", event.Type, event.ID, err)
+		return
+	}
+	eventTraces.recordTransformation(event.ID, "attachments", original, body)
+	event.Body = body
+}
+
+// archiveAttachment stores an attachment, returning its location. Keys end
+// with a hash of the content, so an attachment stored under a transaction's
+// and attachment's IDs from another event can't stand in for this one.
+func (a *attachmentArchiver) archiveAttachment(ctx context.Context, transactionID string, attachment map[string]interface{}) (string, error) {
+	id, _ := attachment["id"].(string)
+	fileURL, _ := attachment["file_url"].(string)
+	fileType, _ := attachment["file_type"].(string)
+	if !attachmentIDPattern.MatchString(id) || fileURL == "" {
+		return "", fmt.Errorf("attachment has no valid id or file_url")
+	}
+	if !a.allowed(fileURL) {
+		return "", fmt.Errorf("attachment %s isn't served from an allowed URL", id)
+	}
+
+	data, contentType, err := a.download(ctx, fileURL)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", id, err)
+	}
+	sum := sha256.Sum256(data)
+	key := transactionID + "/" + id + "-" + hex.EncodeToString(sum[:8]) + attachmentExtension(fileType, fileURL)
+	exists, err := a.store.exists(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		attachmentsArchived.WithLabelValues("existing").Inc()
+		return a.store.location(key), nil
+	}
+
+	if fileType != "" {
+		contentType = fileType
+	}
+	if err := a.store.put(ctx, key, contentType, data); err != nil {
+		return "", fmt.Errorf("storing %s: %w", id, err)
+	}
+	attachmentsArchived.WithLabelValues("archived").Inc()
+	logInfo("Archived attachment %s of transaction %s to %s", id, transactionID, a.store.location(key))
+	return a.store.location(key), nil
+}
+
+// allowed reports whether an attachment's URL starts with one of the allowed
+// prefixes. The URL is parsed first, so that one such as
+// https://allowed.example.com@other.example.com/ or with a path climbing out
+// of the prefix with .. doesn't pass.
+func (a *attachmentArchiver) allowed(fileURL string) bool {
+	u, err := url.Parse(fileURL)
+	if err != nil || u.Scheme != "https" || u.User != nil || path.Clean(u.Path) != u.Path {
+		return false
+	}
+	normalized := u.Scheme + "://" + u.Host + u.Path
+	for _, prefix := range a.allowedURLs {
+		if strings.HasPrefix(normalized, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// download fetches an attachment, up to maxBytes
+func (a *attachmentArchiver) download(ctx context.Context, fileURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		// The URL may be signed, so keep it out of logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, a.maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > a.maxBytes {
+		return nil, "", fmt.Errorf("attachment is larger than %d bytes", a.maxBytes)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// attachmentExtension returns the file extension for an attachment, from its
+// type or else its URL
+func attachmentExtension(fileType, fileURL string) string {
+	if extensions, _ := mime.ExtensionsByType(fileType); len(extensions) > 0 {
+		// Prefer the common extension, such as .jpg over .jfif
+		for _, ext := range extensions {
+			if ext == ".jpg" || ext == ".png" || ext == ".pdf" {
+				return ext
+			}
+		}
+		return extensions[0]
+	}
+	if u, err := url.Parse(fileURL); err == nil {
+		if ext := path.Ext(u.Path); monzoIDPattern.MatchString(strings.TrimPrefix(ext, ".")) {
+			return ext
+		}
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAttachmentArchiver(t *testing.T) {
+	var downloads atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		switch r.URL.Path {
+		case "/uploads/receipt.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("receipt"))
+		case "/uploads/large.pdf":
+			w.Write(make([]byte, 100))
+		case "/uploads/redirect.png":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	archiver, err := newAttachmentArchiver(AttachmentsConfig{Enabled: true, Dir: dir, MaxBytes: 50, AllowedURLs: []string{server.URL + "/uploads/"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiver.client.Transport = server.Client().Transport
+
+	// A file stored under the attachment's IDs by someone else isn't taken
+	// for it
+	os.MkdirAll(filepath.Join(dir, "tx_1"), 0750)
+	os.WriteFile(filepath.Join(dir, "tx_1", "attach_1.jpg"), []byte("forged"), 0640)
+
+	newEvent := func() *webhookEvent {
+		payload := map[string]interface{}{}
+		json.Unmarshal([]byte(`{"type": "transaction.updated", "data": {"id": "tx_1", "attachments": [
+			{"id": "attach_1", "file_url": "`+server.URL+`/uploads/receipt.jpg?signature=secret", "file_type": "image/jpeg"},
+			{"id": "attach_2", "file_url": "`+server.URL+`/uploads/large.pdf"},
+			{"id": "attach_3", "file_url": "`+server.URL+`/uploads/expired.png"},
+			{"id": "attach_4", "file_url": "`+server.URL+`/uploads/redirect.png"},
+			{"id": "attach_5", "file_url": "`+server.URL+`/other/receipt.jpg"},
+			{"id": "attach_6", "file_url": "`+server.URL+`/uploads/../other/receipt.jpg"},
+			{"id": "attach_7", "file_url": "`+strings.Replace(server.URL, "https", "http", 1)+`/uploads/receipt.jpg"},
+			{"id": "../escape", "file_url": "`+server.URL+`/uploads/receipt.jpg"}
+		]}}`), &payload)
+		return &webhookEvent{ID: "evt_1", Type: "transaction.updated", Payload: payload}
+	}
+
+	event := newEvent()
+	archiver.archive(context.Background(), event)
+	sum := sha256.Sum256([]byte("receipt"))
+	stored := filepath.Join(dir, "tx_1", "attach_1-"+hex.EncodeToString(sum[:8])+".jpg")
+	if data, err := os.ReadFile(stored); err != nil || string(data) != "receipt" {
+		t.Fatalf("Expected the receipt to be archived, got %q, %v", data, err)
+	}
+	var body struct {
+		Data struct {
+			Attachments []struct {
+				ID               string `json:"id"`
+				ArchivedLocation string `json:"archived_location"`
+			} `json:"attachments"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(event.Body, &body); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	for _, attachment := range body.Data.Attachments {
+		expected := ""
+		if attachment.ID == "attach_1" {
+			expected = stored
+		}
+		if attachment.ArchivedLocation != expected {
+			t.Errorf("Expected %s to have archived_location '%s', got '%s'", attachment.ID, expected, attachment.ArchivedLocation)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "tx_1", "attach_2*")); len(files) != 0 {
+		t.Error("Expected an attachment larger than max_bytes not to be archived")
+	}
+	// Only the attachments with allowed URLs are downloaded, and the
+	// redirect isn't followed
+	if got := downloads.Load(); got != 4 {
+		t.Errorf("Expected 4 downloads, got %d", got)
+	}
+
+	// Tenants' attachments aren't archived
+	before := downloads.Load()
+	tenantEvent := newEvent()
+	tenantEvent.Tenant = &TenantConfig{Name: "alice"}
+	archiver.archive(context.Background(), tenantEvent)
+	if downloads.Load() != before || tenantEvent.Body != nil {
+		t.Errorf("Expected a tenant's event to be left alone, got %d downloads", downloads.Load()-before)
+	}
+
+	// Archived attachments are downloaded again to check they're unchanged,
+	// but not stored again
+	before = downloads.Load()
+	existing := testutil.ToFloat64(attachmentsArchived.WithLabelValues("existing"))
+	event = newEvent()
+	archiver.archive(context.Background(), event)
+	if got := downloads.Load() - before; got != 4 {
+		t.Errorf("Expected the 4 allowed attachments to be downloaded again, got %d downloads", got)
+	}
+	if testutil.ToFloat64(attachmentsArchived.WithLabelValues("existing"))-existing != 1 {
+		t.Error("Expected the archived attachment to be counted as existing")
+	}
+}
+
+func TestAttachmentExtension(t *testing.T) {
+	tests := []struct {
+		fileType string
+		fileURL  string
+		expect   string
+	}{
+		{fileType: "image/jpeg", fileURL: "https://example.com/a", expect: ".jpg"},
+		{fileType: "application/pdf", expect: ".pdf"},
+		{fileURL: "https://example.com/receipt.png?x=1", expect: ".png"},
+		{fileURL: "https://example.com/receipt", expect: ""},
+	}
+	for _, tt := range tests {
+		if got := attachmentExtension(tt.fileType, tt.fileURL); got != tt.expect {
+			t.Errorf("attachmentExtension(%q, %q) = %q, expected %q", tt.fileType, tt.fileURL, got, tt.expect)
+		}
+	}
+}
+
+func TestAttachmentsConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    AttachmentsConfig
+		hasErr bool
+	}{
+		{name: "Disabled", cfg: AttachmentsConfig{}},
+		{name: "Directory", cfg: AttachmentsConfig{Enabled: true, Dir: "/var/lib/monzo-webhook/attachments"}},
+		{name: "S3", cfg: AttachmentsConfig{Enabled: true, S3Bucket: "receipts", Timeout: "1m"}},
+		{name: "No store", cfg: AttachmentsConfig{Enabled: true}, hasErr: true},
+		{name: "Both stores", cfg: AttachmentsConfig{Enabled: true, Dir: "/tmp", S3Bucket: "receipts"}, hasErr: true},
+		{name: "Invalid timeout", cfg: AttachmentsConfig{Enabled: true, Dir: "/tmp", Timeout: "later"}, hasErr: true},
+		{name: "Allowed URLs", cfg: AttachmentsConfig{Enabled: true, Dir: "/tmp", AllowedURLs: []string{"https://uploads.example.com/receipts/"}}},
+		{name: "Allowed http URL", cfg: AttachmentsConfig{Enabled: true, Dir: "/tmp", AllowedURLs: []string{"http://uploads.example.com/"}}, hasErr: true},
+		{name: "Allowed URL without a slash", cfg: AttachmentsConfig{Enabled: true, Dir: "/tmp", AllowedURLs: []string{"https://uploads.example.com"}}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error: %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+func TestNewAttachmentArchiverS3(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	if _, err := newAttachmentArchiver(AttachmentsConfig{Enabled: true, S3Bucket: "receipts"}, loadAWSConfig); err == nil {
+		t.Error("Expected an error without a region")
+	}
+	t.Setenv("AWS_REGION", "eu-west-2")
+	archiver, err := newAttachmentArchiver(AttachmentsConfig{Enabled: true, S3Bucket: "receipts", S3Prefix: "monzo/", Timeout: "5s"}, loadAWSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := archiver.store.location("tx_1/attach_1.jpg"); got != "s3://receipts/monzo/tx_1/attach_1.jpg" {
+		t.Errorf("Unexpected location: %s", got)
+	}
+	if archiver.client.Timeout != 5*time.Second {
+		t.Errorf("Expected a 5s timeout, got %v", archiver.client.Timeout)
+	}
+}
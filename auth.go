@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// EndpointAuthConfig selects how requests to an endpoint are authenticated.
+// Type is basic (the default, using WEBHOOK_USERNAME and WEBHOOK_PASSWORD or
+// the tenants), bearer for a static token, or jwt for signed JSON Web Tokens.
+type EndpointAuthConfig struct {
+	Type          string `json:"type"`
+	Token         string `json:"token"`
+	Algorithm     string `json:"algorithm"`
+	Secret        string `json:"secret"`
+	PublicKeyFile string `json:"public_key_file"`
+	Issuer        string `json:"issuer"`
+	Audience      string `json:"audience"`
+}
+
+// Endpoint authentication types
+const (
+	authTypeBasic  = "basic"
+	authTypeBearer = "bearer"
+	authTypeJWT    = "jwt"
+)
+
+// webhookEndpoint is the name of the webhook endpoint in the auth config
+const webhookEndpoint = "webhook"
+
+// authEndpoints are the endpoints whose authentication can be configured
+var authEndpoints = map[string]bool{webhookEndpoint: true}
+
+// jwtLeeway allows for clock skew when checking a JWT's exp and nbf claims
+const jwtLeeway = time.Minute
+
+// validateEndpointAuth checks the authentication configured for each endpoint
+func validateEndpointAuth(auth map[string]EndpointAuthConfig, tenants []TenantConfig) error {
+	for endpoint, cfg := range auth {
+		if !authEndpoints[endpoint] {
+			return fmt.Errorf("auth: unknown endpoint '%s'", endpoint)
+		}
+		switch cfg.Type {
+		case "", authTypeBasic:
+		case authTypeBearer:
+			if cfg.Token == "" {
+				return fmt.Errorf("auth %s: bearer authentication requires a token", endpoint)
+			}
+		case authTypeJWT:
+			switch cfg.Algorithm {
+			case "HS256":
+				if cfg.Secret == "" {
+					return fmt.Errorf("auth %s: HS256 requires a secret", endpoint)
+				}
+			case "RS256":
+				if cfg.PublicKeyFile == "" {
+					return fmt.Errorf("auth %s: RS256 requires a public_key_file", endpoint)
+				}
+			default:
+				return fmt.Errorf("auth %s: unsupported JWT algorithm '%s' (expected HS256 or RS256)", endpoint, cfg.Algorithm)
+			}
+		default:
+			return fmt.Errorf("auth %s: unknown type '%s' (expected basic, bearer or jwt)", endpoint, cfg.Type)
+		}
+		if endpoint == webhookEndpoint && cfg.Type != "" && cfg.Type != authTypeBasic && len(tenants) > 0 {
+			return fmt.Errorf("auth %s: tenants are identified by basic authentication, so it can't use %s", endpoint, cfg.Type)
+		}
+	}
+	return nil
+}
+
+// tokenAuthenticator checks bearer tokens or JWTs on requests to an endpoint
+type tokenAuthenticator struct {
+	kind      string
+	token     string
+	algorithm string
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	now       func() time.Time
+}
+
+// webhookAuth is set when the webhook endpoint uses bearer or JWT
+// authentication instead of basic authentication
+var webhookAuth *tokenAuthenticator
+
+// newTokenAuthenticator returns the authenticator for an endpoint's config,
+// or nil if the endpoint uses basic authentication
+func newTokenAuthenticator(cfg EndpointAuthConfig) (*tokenAuthenticator, error) {
+	a := &tokenAuthenticator{
+		kind:      cfg.Type,
+		token:     cfg.Token,
+		algorithm: cfg.Algorithm,
+		secret:    []byte(cfg.Secret),
+		issuer:    cfg.Issuer,
+		audience:  cfg.Audience,
+		now:       clock.Now,
+	}
+	switch cfg.Type {
+	case authTypeBearer:
+		return a, nil
+	case authTypeJWT:
+		if cfg.Algorithm == "RS256" {
+			key, err := loadRSAPublicKey(cfg.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			a.publicKey = key
+		}
+		return a, nil
+	}
+	return nil, nil
+}
+
+// loadRSAPublicKey reads a PEM-encoded RSA public key or certificate
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unexpected PEM block '%s' in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key in %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// authenticate checks the request's bearer token, returning the JWT subject
+// if there is one
+func (a *tokenAuthenticator) authenticate(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("missing bearer token")
+	}
+	if a.kind == authTypeBearer {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			return "", errors.New("invalid bearer token")
+		}
+		return "", nil
+	}
+	return a.verifyJWT(token)
+}
+
+// jwtClaims are the registered claims checked on a JWT. The audience may be a
+// string or a list of strings, and the expiry is required.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// verifyJWT checks a compact JWT's signature and claims, returning its
+// subject. Only the configured algorithm is accepted, so a token can't
+// choose a weaker one such as none.
+func (a *tokenAuthenticator) verifyJWT(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg != a.algorithm {
+		return "", fmt.Errorf("unexpected JWT algorithm '%s'", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("invalid JWT signature encoding")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch a.algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "", errors.New("invalid JWT signature")
+		}
+	case "RS256":
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return "", errors.New("invalid JWT signature")
+		}
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	now := a.now()
+	// A token without an expiry would be accepted for as long as the key is
+	if claims.ExpiresAt == nil {
+		return "", errors.New("JWT has no exp claim")
+	}
+	if !now.Before(unixTime(*claims.ExpiresAt).Add(jwtLeeway)) {
+		return "", errors.New("JWT has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)) {
+		return "", errors.New("JWT is not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return "", fmt.Errorf("unexpected JWT issuer '%s'", claims.Issuer)
+	}
+	if a.audience != "" && !jwtAudienceContains(claims.Audience, a.audience) {
+		return "", errors.New("JWT audience doesn't include " + a.audience)
+	}
+	return claims.Subject, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// jwtAudienceContains reports whether an aud claim, a string or a list of
+// strings, includes the audience
+func jwtAudienceContains(aud json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(aud, &list) == nil {
+		for _, value := range list {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webhookAuthMiddleware authenticates webhook requests with the method
+// configured for the endpoint, falling back to basic authentication
+func webhookAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	basic := basicAuthMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhookAuth == nil {
+			basic(w, r)
+			return
+		}
+
+		subject, err := webhookAuth.authenticate(r)
+		if err != nil {
+			logWarn("Unauthorized webhook request - %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Webhook"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if subject != "" {
+			logDebug("JWT auth successful for subject: %s", subject)
+		} else {
+			logDebug("Bearer auth successful")
+		}
+		next(w, r)
+	}
+}
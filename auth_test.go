@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signTestJWT returns a compact JWT for the claims, signed with an HMAC secret
+// or an RSA private key
+func signTestJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("Failed to sign JWT: %v", err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestValidateEndpointAuth(t *testing.T) {
+	tenants := []TenantConfig{{Name: "alice", Username: "alice", Password: "a"}}
+	tests := []struct {
+		name        string
+		auth        map[string]EndpointAuthConfig
+		tenants     []TenantConfig
+		expectError bool
+	}{
+		{name: "Default", auth: nil},
+		{name: "Basic with tenants", auth: map[string]EndpointAuthConfig{"webhook": {Type: "basic"}}, tenants: tenants},
+		{name: "Bearer", auth: map[string]EndpointAuthConfig{"webhook": {Type: "bearer", Token: "t"}}},
+		{name: "HS256", auth: map[string]EndpointAuthConfig{"webhook": {Type: "jwt", Algorithm: "HS256", Secret: "s", Issuer: "monzo"}}},
+		{name: "RS256", auth: map[string]EndpointAuthConfig{"webhook": {Type: "jwt", Algorithm: "RS256", PublicKeyFile: "key.pem"}}},
+		{name: "Unknown endpoint", auth: map[string]EndpointAuthConfig{"metrics": {Type: "bearer", Token: "t"}}, expectError: true},
+		{name: "Unknown type", auth: map[string]EndpointAuthConfig{"webhook": {Type: "digest"}}, expectError: true},
+		{name: "Bearer without token", auth: map[string]EndpointAuthConfig{"webhook": {Type: "bearer"}}, expectError: true},
+		{name: "HS256 without secret", auth: map[string]EndpointAuthConfig{"webhook": {Type: "jwt", Algorithm: "HS256"}}, expectError: true},
+		{name: "RS256 without key", auth: map[string]EndpointAuthConfig{"webhook": {Type: "jwt", Algorithm: "RS256"}}, expectError: true},
+		{name: "Unsupported algorithm", auth: map[string]EndpointAuthConfig{"webhook": {Type: "jwt", Algorithm: "none"}}, expectError: true},
+		{name: "Bearer with tenants", auth: map[string]EndpointAuthConfig{"webhook": {Type: "bearer", Token: "t"}}, tenants: tenants, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEndpointAuth(tt.auth, tt.tenants)
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticatorJWT(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	secret := []byte("hmac-secret")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	keyFile := filepath.Join(t.TempDir(), "public.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	hs256, err := newTokenAuthenticator(EndpointAuthConfig{Type: "jwt", Algorithm: "HS256", Secret: string(secret), Issuer: "issuer", Audience: "monzo-webhook"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rs256, err := newTokenAuthenticator(EndpointAuthConfig{Type: "jwt", Algorithm: "RS256", PublicKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hs256.now = func() time.Time { return now }
+	rs256.now = func() time.Time { return now }
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "issuer", "sub": "monzo", "aud": []string{"other", "monzo-webhook"}, "exp": now.Add(time.Hour).Unix()}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name          string
+		authenticator *tokenAuthenticator
+		token         string
+		expectError   bool
+	}{
+		{name: "HS256", authenticator: hs256, token: signTestJWT(t, "HS256", secret, valid())},
+		{name: "HS256 audience string", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("aud", "monzo-webhook"))},
+		{name: "Within leeway", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("exp", now.Add(-30*time.Second).Unix()))},
+		{name: "Wrong secret", authenticator: hs256, token: signTestJWT(t, "HS256", []byte("other"), valid()), expectError: true},
+		{name: "Missing expiry", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("exp", nil)), expectError: true},
+		{name: "Expired", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("exp", now.Add(-time.Hour).Unix())), expectError: true},
+		{name: "Not valid yet", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("nbf", now.Add(time.Hour).Unix())), expectError: true},
+		{name: "Wrong issuer", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("iss", "someone")), expectError: true},
+		{name: "Wrong audience", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("aud", "other")), expectError: true},
+		{name: "Missing audience", authenticator: hs256, token: signTestJWT(t, "HS256", secret, with("aud", nil)), expectError: true},
+		{name: "Algorithm none", authenticator: hs256, token: signTestJWT(t, "none", nil, valid()), expectError: true},
+		{name: "Malformed", authenticator: hs256, token: "not-a-jwt", expectError: true},
+		{name: "RS256", authenticator: rs256, token: signTestJWT(t, "RS256", rsaKey, with("aud", nil))},
+		{name: "RS256 token signed with HS256", authenticator: rs256, token: signTestJWT(t, "HS256", der, valid()), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			subject, err := tt.authenticator.authenticate(req)
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && (err != nil || subject != "monzo") {
+				t.Errorf("Expected subject monzo, got %q, %v", subject, err)
+			}
+		})
+	}
+}
+
+func TestWebhookAuthMiddleware(t *testing.T) {
+	origAuth := webhookAuth
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		webhookAuth = origAuth
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+	basicAuthUsername, basicAuthPassword = "user", "pass"
+
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	bearer, _ := newTokenAuthenticator(EndpointAuthConfig{Type: "bearer", Token: "webhook-token"})
+
+	tests := []struct {
+		name               string
+		auth               *tokenAuthenticator
+		setAuth            func(r *http.Request)
+		expectedStatusCode int
+	}{
+		{name: "Basic", setAuth: func(r *http.Request) { r.SetBasicAuth("user", "pass") }, expectedStatusCode: http.StatusOK},
+		{name: "Bearer", auth: bearer, setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer webhook-token") }, expectedStatusCode: http.StatusOK},
+		{name: "Wrong bearer token", auth: bearer, setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, expectedStatusCode: http.StatusUnauthorized},
+		{name: "Basic credentials with bearer", auth: bearer, setAuth: func(r *http.Request) { r.SetBasicAuth("user", "pass") }, expectedStatusCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookAuth = tt.auth
+			req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			tt.setAuth(req)
+			rr := httptest.NewRecorder()
+			webhookAuthMiddleware(okHandler)(rr, req)
+
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatusCode, rr.Code)
+			}
+			if tt.auth != nil && rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != `Bearer realm="Webhook"` {
+				t.Errorf("Unexpected WWW-Authenticate header: %q", rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
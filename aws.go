@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+// loadAWSConfig loads the AWS SDK's default configuration, with credentials
+// from its chain: environment variables, the shared config and credentials
+// files and their profiles, web identity tokens, ECS container credentials
+// and the EC2 instance metadata service. The region and endpoint overrides
+// come from the environment too. Credentials are resolved when they're first
+// used, and temporary ones are refreshed before they expire.
+//
+// AWS_SECRET_ACCESS_KEY_FILE is read like the service's other secret files,
+// which the SDK doesn't know about.
+func loadAWSConfig() (aws.Config, error) {
+	var options []func(*config.LoadOptions) error
+	if os.Getenv("AWS_SECRET_ACCESS_KEY_FILE") != "" {
+		secretKey, err := getenvSecret("AWS_SECRET_ACCESS_KEY")
+		if err != nil {
+			return aws.Config{}, err
+		}
+		options = append(options, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			os.Getenv("AWS_ACCESS_KEY_ID"), secretKey, os.Getenv("AWS_SESSION_TOKEN"))))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("loading AWS configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// sharedAWSConfig loads the AWS configuration once, when an AWS client is
+// first needed, so every client shares one credential cache
+var sharedAWSConfig = sync.OnceValues(loadAWSConfig)
+
+// awsEndpointFromEnv returns the endpoint override for a service, if any
+func awsEndpointFromEnv(service string) string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_" + strings.ToUpper(service)); endpoint != "" {
+		return endpoint
+	}
+	return os.Getenv("AWS_ENDPOINT_URL")
+}
+
+// awsAPIError shortens an AWS API error to its code and message, leaving
+// other errors, such as failing to resolve credentials, as they are
+func awsAPIError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Errorf("%s: %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
+	}
+	return err
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SNSPublisher publishes webhook payloads to an SNS topic
+type SNSPublisher struct {
+	TopicARN string
+	client   *sns.Client
+}
+
+// SQSPublisher sends webhook payloads to an SQS queue
+type SQSPublisher struct {
+	QueueURL string
+	client   *sqs.Client
+}
+
+// snsPublisherFromEnv creates an SNS publisher if AWS_SNS_TOPIC_ARN is set
+func snsPublisherFromEnv(loadConfig func() (aws.Config, error)) (*SNSPublisher, error) {
+	topicARN := os.Getenv("AWS_SNS_TOPIC_ARN")
+	if topicARN == "" {
+		return nil, nil
+	}
+
+	// arn:aws:sns:<region>:<account>:<topic>
+	parts := strings.Split(topicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		return nil, fmt.Errorf("invalid AWS_SNS_TOPIC_ARN '%s'", topicARN)
+	}
+	region := parts[3]
+
+	awsConfig, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &SNSPublisher{
+		TopicARN: topicARN,
+		client: sns.NewFromConfig(awsConfig, func(o *sns.Options) {
+			o.Region = region
+		}),
+	}, nil
+}
+
+// sqsPublisherFromEnv creates an SQS publisher if AWS_SQS_QUEUE_URL is set
+func sqsPublisherFromEnv(loadConfig func() (aws.Config, error)) (*SQSPublisher, error) {
+	queueURL := os.Getenv("AWS_SQS_QUEUE_URL")
+	if queueURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid AWS_SQS_QUEUE_URL '%s'", queueURL)
+	}
+	awsConfig, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// sqs.<region>.amazonaws.com, or the legacy <region>.queue.amazonaws.com.
+	// Requests for other queues, such as LocalStack's, go to the queue's
+	// host unless an endpoint is set.
+	region := awsConfig.Region
+	var endpoint string
+	hostParts := strings.Split(u.Hostname(), ".")
+	if len(hostParts) >= 4 && hostParts[0] == "sqs" {
+		region = hostParts[1]
+	} else if len(hostParts) >= 4 && hostParts[1] == "queue" {
+		region = hostParts[0]
+	} else if awsEndpointFromEnv("sqs") == "" {
+		endpoint = u.Scheme + "://" + u.Host
+	}
+	if region == "" {
+		return nil, errors.New("AWS_REGION must be set when the region can't be derived from AWS_SQS_QUEUE_URL")
+	}
+
+	return &SQSPublisher{
+		QueueURL: queueURL,
+		client: sqs.NewFromConfig(awsConfig, func(o *sqs.Options) {
+			o.Region = region
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+		}),
+	}, nil
+}
+
+// Publish sends the payload to the topic with the event ID and type as message
+// attributes. FIFO topics are grouped by account ID.
+func (p *SNSPublisher) Publish(ctx context.Context, eventID, eventType, accountID string, body []byte) error {
+	input := &sns.PublishInput{
+		TopicArn: aws.String(p.TopicARN),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: aws.String(eventType)},
+		},
+	}
+	if eventID != "" {
+		input.MessageAttributes["event_id"] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(eventID)}
+	}
+	if strings.HasSuffix(p.TopicARN, ".fifo") {
+		input.MessageGroupId, input.MessageDeduplicationId = fifoParameters(accountID, body)
+	}
+
+	_, err := p.client.Publish(ctx, input)
+	return awsAPIError(err)
+}
+
+// Publish sends the payload to the queue with the event ID and type as message
+// attributes. FIFO queues are grouped by account ID.
+func (p *SQSPublisher) Publish(ctx context.Context, eventID, eventType, accountID string, body []byte) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.QueueURL),
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: aws.String(eventType)},
+		},
+	}
+	if eventID != "" {
+		input.MessageAttributes["event_id"] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(eventID)}
+	}
+	if strings.HasSuffix(p.QueueURL, ".fifo") {
+		input.MessageGroupId, input.MessageDeduplicationId = fifoParameters(accountID, body)
+	}
+
+	_, err := p.client.SendMessage(ctx, input)
+	return awsAPIError(err)
+}
+
+// fifoParameters returns the message group and a content-based deduplication
+// ID
+func fifoParameters(accountID string, body []byte) (group, deduplicationID *string) {
+	if accountID == "" {
+		accountID = "monzo-webhook"
+	}
+	return aws.String(accountID), aws.String(sha256Hex(body))
+}
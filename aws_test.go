@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadAWSConfig(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("filesecret\n"), 0o600)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY_FILE", secretFile)
+	t.Setenv("AWS_REGION", "eu-west-2")
+
+	cfg, err := loadAWSConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if creds.AccessKeyID != "AKIDEXAMPLE" || creds.SecretAccessKey != "filesecret" || cfg.Region != "eu-west-2" {
+		t.Errorf("Unexpected configuration: %+v, region %s", creds, cfg.Region)
+	}
+}
+
+func TestSNSPublisherFromEnv(t *testing.T) {
+	tests := []struct {
+		name           string
+		topicARN       string
+		expectedRegion string
+		expectError    bool
+	}{
+		{name: "Standard topic", topicARN: "arn:aws:sns:eu-west-2:123456789012:monzo", expectedRegion: "eu-west-2"},
+		{name: "Not an SNS ARN", topicARN: "arn:aws:sqs:eu-west-2:123456789012:monzo", expectError: true},
+		{name: "Malformed", topicARN: "monzo", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_SNS_TOPIC_ARN", tt.topicARN)
+			publisher, err := snsPublisherFromEnv(loadAWSConfig)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if region := publisher.client.Options().Region; region != tt.expectedRegion {
+				t.Errorf("Expected region '%s', got '%s'", tt.expectedRegion, region)
+			}
+		})
+	}
+}
+
+func TestSQSPublisherFromEnv(t *testing.T) {
+	tests := []struct {
+		name           string
+		queueURL       string
+		envRegion      string
+		expectedRegion string
+		expectError    bool
+	}{
+		{name: "Regional endpoint", queueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/monzo", expectedRegion: "eu-west-1"},
+		{name: "Legacy endpoint", queueURL: "https://us-east-2.queue.amazonaws.com/123456789012/monzo", expectedRegion: "us-east-2"},
+		{name: "Custom endpoint with AWS_REGION", queueURL: "http://localhost:4566/000000000000/monzo", envRegion: "eu-west-2", expectedRegion: "eu-west-2"},
+		{name: "Custom endpoint without region", queueURL: "http://localhost:4566/000000000000/monzo", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_SQS_QUEUE_URL", tt.queueURL)
+			t.Setenv("AWS_REGION", tt.envRegion)
+			t.Setenv("AWS_DEFAULT_REGION", "")
+			publisher, err := sqsPublisherFromEnv(loadAWSConfig)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if region := publisher.client.Options().Region; region != tt.expectedRegion {
+				t.Errorf("Expected region '%s', got '%s'", tt.expectedRegion, region)
+			}
+		})
+	}
+}
+
+func TestSQSPublisherPublish(t *testing.T) {
+	var received struct {
+		QueueURL          string `json:"QueueUrl"`
+		MessageBody       string
+		MessageAttributes map[string]struct{ StringValue string }
+		MessageGroupID    string `json:"MessageGroupId"`
+		MessageDedupID    string `json:"MessageDeduplicationId"`
+	}
+	var authorization, target string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		target = r.Header.Get("X-Amz-Target")
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{"MessageId":"1"}`)
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-2")
+	t.Setenv("AWS_SQS_QUEUE_URL", server.URL+"/123456789012/monzo.fifo")
+
+	publisher, err := sqsPublisherFromEnv(loadAWSConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	body := `{"type":"transaction.created","data":{"account_id":"acc_123"}}`
+	if err := publisher.Publish(context.Background(), "01ARYZ6S410000000000000000", "transaction.created", "acc_123", []byte(body)); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(authorization, "/eu-west-2/sqs/aws4_request") {
+		t.Errorf("Unexpected Authorization header: %s", authorization)
+	}
+	if target != "AmazonSQS.SendMessage" {
+		t.Errorf("Expected a SendMessage request, got %s", target)
+	}
+	if received.QueueURL != server.URL+"/123456789012/monzo.fifo" || received.MessageBody != body || received.MessageGroupID != "acc_123" {
+		t.Errorf("Unexpected message %+v", received)
+	}
+	if received.MessageAttributes["event_type"].StringValue != "transaction.created" || received.MessageAttributes["event_id"].StringValue != "01ARYZ6S410000000000000000" {
+		t.Errorf("Unexpected message attributes %+v", received.MessageAttributes)
+	}
+	if received.MessageDedupID == "" {
+		t.Error("Expected a MessageDeduplicationId for a FIFO queue")
+	}
+}
+
+func TestSNSPublisherError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<ErrorResponse><Error><Type>Sender</Type><Code>NotFound</Code><Message>Topic does not exist</Message></Error></ErrorResponse>`)
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SNS_TOPIC_ARN", "arn:aws:sns:eu-west-2:123456789012:monzo")
+	t.Setenv("AWS_ENDPOINT_URL_SNS", server.URL)
+
+	publisher, err := snsPublisherFromEnv(loadAWSConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	err = publisher.Publish(context.Background(), "", "transaction.created", "", []byte(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "NotFound: Topic does not exist") {
+		t.Errorf("Expected a NotFound error, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// defaultMaxBodyBytes is the largest webhook body accepted unless
+// WEBHOOK_MAX_BODY_BYTES says otherwise. Monzo's payloads are a few KiB.
+const defaultMaxBodyBytes = 1 << 20
+
+// maxBodyBytes is the largest webhook body accepted
+var maxBodyBytes int64 = defaultMaxBodyBytes
+
+var oversizedBodies = metrics.newCounter("monzo_webhook_oversized_bodies_total",
+	"Webhook requests rejected because their body exceeded the size limit.")
+
+// maxBodyBytesFromEnv returns the body size limit from WEBHOOK_MAX_BODY_BYTES,
+// defaulting to 1 MiB
+func maxBodyBytesFromEnv() (int64, error) {
+	raw := os.Getenv("WEBHOOK_MAX_BODY_BYTES")
+	if raw == "" {
+		return defaultMaxBodyBytes, nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("WEBHOOK_MAX_BODY_BYTES must be a positive number of bytes, got '%s'", raw)
+	}
+	return n, nil
+}
+
+// maxBodyMiddleware limits the size of request bodies, so that a client can't
+// exhaust memory by sending an endless body
+func maxBodyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		next(w, r)
+	}
+}
+
+// writeBodyReadError responds to an error reading a request body, with 413 if
+// the body was larger than the limit
+func writeBodyReadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		oversizedBodies.Inc()
+		logWarn("Rejected webhook request with a body larger than %d bytes", tooLarge.Limit)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Error reading request body", http.StatusBadRequest)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxBodyBytesFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		expected    int64
+		expectError bool
+	}{
+		{name: "Default", expected: 1 << 20},
+		{name: "Custom", value: "65536", expected: 65536},
+		{name: "Zero", value: "0", expectError: true},
+		{name: "Not a number", value: "1MiB", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_MAX_BODY_BYTES", tt.value)
+			n, err := maxBodyBytesFromEnv()
+			if (err != nil) != tt.expectError {
+				t.Fatalf("Expected error=%v, got %v", tt.expectError, err)
+			}
+			if n != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, n)
+			}
+		})
+	}
+}
+
+func TestMaxBodyMiddleware(t *testing.T) {
+	origMax := maxBodyBytes
+	defer func() { maxBodyBytes = origMax }()
+	maxBodyBytes = 16
+
+	handler := maxBodyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			writeBodyReadError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Within the limit", body: `{"type":"x"}`, expectedStatus: http.StatusOK},
+		{name: "Exactly the limit", body: strings.Repeat("a", 16), expectedStatus: http.StatusOK},
+		{name: "Over the limit", body: strings.Repeat("a", 17), expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body)))
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerRejectsOversizedBody(t *testing.T) {
+	origMax := maxBodyBytes
+	defer func() { maxBodyBytes = origMax }()
+	maxBodyBytes = 64
+
+	body := `{"type":"transaction.created","data":{"description":"` + strings.Repeat("a", 100) + `"}}`
+	rr := httptest.NewRecorder()
+	maxBodyMiddleware(webhookHandler)(rr, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code 413, got %d", rr.Code)
+	}
+}
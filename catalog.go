@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// catalogEventType describes an event type and how this instance handles it.
+// Types that are only named in the config have no schema or example.
+type catalogEventType struct {
+	monzo.EventType
+
+	// AddedFields are the fields this instance may add to the payload's
+	// data before publishing it, with when they are added
+	AddedFields map[string]string `json:"added_fields,omitempty"`
+
+	// Priority is the event's priority when no rule matching on a field
+	// applies, and PriorityRules are the rules that can match it
+	Priority      int            `json:"priority"`
+	PriorityRules []PriorityRule `json:"priority_rules,omitempty"`
+
+	// Filtered is set when the event_types filter drops the type, in which
+	// case it's published to no sinks
+	Filtered bool          `json:"filtered,omitempty"`
+	Sinks    []catalogSink `json:"sinks"`
+}
+
+// catalogSink is a sink events are published to
+type catalogSink struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	Channel  string `json:"channel,omitempty"`
+	Stream   string `json:"stream,omitempty"`
+	Notify   bool   `json:"notify,omitempty"`
+}
+
+// eventCatalog lists the event types Monzo sends and any others named by the
+// priority rules or demo scenarios, with their schemas, examples and the
+// sinks they are published to
+func eventCatalog(cfg EventConfig, entries []sinkEntry) []catalogEventType {
+	specs := make(map[string]SinkConfig)
+	if cfg.Channel != "" {
+		specs["redis"] = SinkConfig{Type: "redis", Channel: cfg.Channel}
+	}
+	for _, spec := range cfg.Sinks {
+		name := spec.Name
+		if name == "" {
+			name = spec.Type
+		}
+		specs[name] = spec
+	}
+	catalogSinks := make([]catalogSink, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.sink.Name()
+		sink := catalogSink{Name: name, Type: name, Required: entry.required}
+		if spec, ok := specs[name]; ok {
+			sink.Type, sink.Channel, sink.Notify = spec.Type, spec.Channel, spec.Notify
+		}
+		if name == "redis_stream" {
+			sink.Stream = cfg.Stream.Name
+		}
+		catalogSinks = append(catalogSinks, sink)
+	}
+
+	types := monzo.EventTypes()
+	known := make(map[string]bool, len(types))
+	for _, t := range types {
+		known[t.Type] = true
+	}
+	var named []string
+	for _, rule := range cfg.Priorities {
+		if rule.Type != "" && !strings.HasSuffix(rule.Type, "*") {
+			named = append(named, rule.Type)
+		}
+	}
+	for _, scenario := range cfg.Demo {
+		named = append(named, scenario.eventType())
+	}
+	for _, name := range named {
+		if !known[name] {
+			known[name] = true
+			types = append(types, monzo.EventType{Type: name})
+		}
+	}
+
+	catalog := make([]catalogEventType, 0, len(types))
+	for _, t := range types {
+		entry := catalogEventType{
+			EventType: t,
+			Priority:  eventPriority(cfg.Priorities, t.Type, nil),
+			Sinks:     catalogSinks,
+		}
+		if !cfg.EventTypes.allows(t.Type) {
+			entry.Filtered, entry.Sinks = true, []catalogSink{}
+		}
+		for _, rule := range cfg.Priorities {
+			if (PriorityRule{Type: rule.Type}).matches(t.Type, nil) {
+				entry.PriorityRules = append(entry.PriorityRules, rule)
+			}
+		}
+		if strings.HasPrefix(t.Type, "transaction.") {
+			entry.AddedFields = map[string]string{
+				"original_description": "Monzo's description, when the description was replaced by a merchant alias",
+			}
+			if len(cfg.Accounts) > 0 {
+				entry.AddedFields["account_label"] = "The account's label, for configured accounts"
+				entry.AddedFields["account_details"] = "The account's type, owner and masked sort code, when read from the Monzo API"
+			}
+			if cfg.Pots.Enabled {
+				entry.AddedFields["pot_name"] = "The name of the pot in data.metadata.pot_id, for transfers to and from pots"
+			}
+			if cfg.Attachments.Enabled {
+				entry.AddedFields["attachments[].archived_location"] = "Where the attachment was archived, since Monzo's file_url expires"
+			}
+			if transactionClassifier != nil {
+				entry.AddedFields["monzo_category"] = "Monzo's category, when the category was replaced by the classifier"
+			}
+		}
+		catalog = append(catalog, entry)
+	}
+	return catalog
+}
+
+// catalogHandler serves the event catalog, so that consumers can discover
+// the events this instance publishes and where
+func catalogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"event_types": eventCatalog(currentConfig(), currentSinks()),
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventCatalog(t *testing.T) {
+	cfg := EventConfig{
+		Channel: "monzo",
+		Stream:  StreamConfig{Name: "monzo-events"},
+		Sinks:   []SinkConfig{{Type: "redis", Name: "alerts", Channel: "monzo-alerts", Notify: true}},
+		Priorities: []PriorityRule{
+			{Type: "transaction.*", Field: "data.decline_reason", Priority: 10},
+			{Type: "transaction.created", Priority: 5},
+			{Type: "balance.updated", Priority: 1},
+		},
+		Demo:       []DemoScenario{{Name: "coffee", Type: "pot.deposit"}},
+		EventTypes: EventTypeFilter{Deny: []string{"balance.*"}},
+	}
+	entries := []sinkEntry{
+		{sink: &fakeSink{name: "redis"}, required: true},
+		{sink: &fakeSink{name: "redis_stream"}},
+		{sink: &fakeSink{name: "alerts"}},
+		{sink: &fakeSink{name: "kafka"}},
+	}
+
+	catalog := eventCatalog(cfg, entries)
+	byType := make(map[string]catalogEventType)
+	var order []string
+	for _, entry := range catalog {
+		byType[entry.Type] = entry
+		order = append(order, entry.Type)
+	}
+	expectedOrder := []string{"transaction.created", "transaction.updated", "balance.updated", "pot.deposit"}
+	if len(order) != len(expectedOrder) {
+		t.Fatalf("Expected types %v, got %v", expectedOrder, order)
+	}
+	for i := range expectedOrder {
+		if order[i] != expectedOrder[i] {
+			t.Fatalf("Expected types %v, got %v", expectedOrder, order)
+		}
+	}
+
+	created := byType["transaction.created"]
+	if created.Schema == nil || len(created.Example) == 0 {
+		t.Error("Expected transaction.created to have a schema and an example")
+	}
+	if created.Priority != 5 || len(created.PriorityRules) != 2 {
+		t.Errorf("Expected priority 5 with 2 rules, got %d with %v", created.Priority, created.PriorityRules)
+	}
+	if updated := byType["transaction.updated"]; updated.Priority != 0 || len(updated.PriorityRules) != 1 {
+		t.Errorf("Expected priority 0 with 1 rule, got %d with %v", updated.Priority, updated.PriorityRules)
+	}
+	if _, ok := created.AddedFields["original_description"]; !ok {
+		t.Errorf("Expected original_description to be an added field, got %v", created.AddedFields)
+	}
+	if balance := byType["balance.updated"]; !balance.Filtered || len(balance.Sinks) != 0 {
+		t.Errorf("Expected balance.updated to be filtered with no sinks, got %+v", balance)
+	}
+	if created.Filtered {
+		t.Error("Expected transaction.created not to be filtered")
+	}
+	if pot := byType["pot.deposit"]; pot.Schema != nil || pot.AddedFields != nil {
+		t.Errorf("Expected no schema or added fields for pot.deposit, got %+v", pot)
+	}
+
+	expectedSinks := []catalogSink{
+		{Name: "redis", Type: "redis", Required: true, Channel: "monzo"},
+		{Name: "redis_stream", Type: "redis_stream", Stream: "monzo-events"},
+		{Name: "alerts", Type: "redis", Channel: "monzo-alerts", Notify: true},
+		{Name: "kafka", Type: "kafka"},
+	}
+	if len(created.Sinks) != len(expectedSinks) {
+		t.Fatalf("Expected sinks %+v, got %+v", expectedSinks, created.Sinks)
+	}
+	for i := range expectedSinks {
+		if created.Sinks[i] != expectedSinks[i] {
+			t.Errorf("Expected sink %+v, got %+v", expectedSinks[i], created.Sinks[i])
+		}
+	}
+}
+
+func TestCatalogHandler(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+	}()
+	eventConfig = EventConfig{Channel: "monzo"}
+	sinks = []sinkEntry{{sink: &fakeSink{name: "redis"}}}
+
+	rec := httptest.NewRecorder()
+	catalogHandler(rec, httptest.NewRequest("GET", "/catalog", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var body struct {
+		EventTypes []struct {
+			Type    string          `json:"type"`
+			Example json.RawMessage `json:"example"`
+			Sinks   []catalogSink   `json:"sinks"`
+		} `json:"event_types"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if len(body.EventTypes) != 2 || body.EventTypes[0].Type != "transaction.created" {
+		t.Fatalf("Unexpected event types: %+v", body.EventTypes)
+	}
+	var example map[string]interface{}
+	if err := json.Unmarshal(body.EventTypes[0].Example, &example); err != nil || example["type"] != "transaction.created" {
+		t.Errorf("Expected the example to be an event, got %s", body.EventTypes[0].Example)
+	}
+	if len(body.EventTypes[0].Sinks) != 1 || body.EventTypes[0].Sinks[0].Channel != "monzo" {
+		t.Errorf("Unexpected sinks: %+v", body.EventTypes[0].Sinks)
+	}
+
+	rec = httptest.NewRecorder()
+	catalogHandler(rec, httptest.NewRequest("POST", "/catalog", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/ext"
+)
+
+// Rules are written in CEL, the Common Expression Language, and evaluated with
+// cel-go. An expression sees two variables:
+//
+//   - event: the whole payload, such as event.type and event.tags
+//   - data: the payload's data field, so data.amount is event.data.amount
+//
+// The event type can't be a variable of its own, as type is the name of a CEL
+// builtin. Payloads are decoded from JSON, so as with JSON in CEL their numbers
+// are doubles: data.amount < -10000 compares as expected, but data.amount / 100
+// needs 100.0, or int(data.amount) for integer division. Besides the standard
+// library, the string extensions such as lowerAscii() and replace() are
+// available.
+
+// celEnv declares the variables expressions can use
+var celEnv = func() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("event", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("data", cel.DynType),
+		ext.Strings(),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("creating CEL environment: %v", err))
+	}
+	return env
+}()
+
+// celCostLimit bounds the work one evaluation can do, so a rule such as a
+// comprehension over a large list can't hold up an event
+const celCostLimit = 100000
+
+// celExpr is a compiled expression
+type celExpr struct {
+	program cel.Program
+}
+
+var celCache sync.Map
+
+// compileCEL parses and type-checks an expression, caching the result
+func compileCEL(source string) (*celExpr, error) {
+	if cached, ok := celCache.Load(source); ok {
+		return cached.(*celExpr), nil
+	}
+	parsed, issues := celEnv.Parse(source)
+	if issues.Err() != nil {
+		return nil, celIssuesError(issues)
+	}
+	checked, issues := celEnv.Check(parsed)
+	if issues.Err() != nil {
+		err := celIssuesError(issues)
+		if referencesCELIdent(parsed, "type") {
+			// Such as type == 'transaction.created', from before rules
+			// were evaluated with cel-go
+			err = fmt.Errorf("%w (type is a CEL builtin; use event.type for the event type)", err)
+		}
+		return nil, err
+	}
+	program, err := celEnv.Program(checked, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, err
+	}
+	expr := &celExpr{program: program}
+	celCache.Store(source, expr)
+	return expr, nil
+}
+
+// celIssuesError returns the first of an expression's issues as a one-line
+// error
+func celIssuesError(issues *cel.Issues) error {
+	errs := issues.Errors()
+	if len(errs) == 0 {
+		return issues.Err()
+	}
+	first := errs[0]
+	if first.Location.Line() > 1 {
+		return fmt.Errorf("%s at line %d, column %d", first.Message, first.Location.Line(), first.Location.Column()+1)
+	}
+	return fmt.Errorf("%s at position %d", first.Message, first.Location.Column()+1)
+}
+
+// referencesCELIdent reports whether a parsed expression uses an identifier
+func referencesCELIdent(parsed *cel.Ast, name string) bool {
+	var found bool
+	celast.PreOrderVisit(parsed.NativeRep().Expr(), celast.NewExprVisitor(func(e celast.Expr) {
+		if e.Kind() == celast.IdentKind && e.AsIdent() == name {
+			found = true
+		}
+	}))
+	return found
+}
+
+// eval evaluates an expression against a payload
+func (e *celExpr) eval(payload map[string]interface{}) (interface{}, error) {
+	vars := map[string]interface{}{"event": payload}
+	// Left unset when the payload has no data, so that using it is an error
+	// rather than null
+	if data, ok := payload["data"]; ok {
+		vars["data"] = data
+	}
+	out, _, err := e.program.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return out.Value(), nil
+}
+
+// evalCELBool evaluates a compiled condition against a payload
+func evalCELBool(expr *celExpr, payload map[string]interface{}) (bool, error) {
+	value, err := expr.eval(payload)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, errors.New("expected a bool")
+	}
+	return b, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCEL(t *testing.T) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"type": "transaction.created",
+		"data": {
+			"amount": -12500,
+			"currency": "GBP",
+			"category": "eating_out",
+			"merchant": {"name": "Pret A Manger", "address": {"city": "London"}},
+			"metadata": {},
+			"labels": ["lunch", "work"]
+		}
+	}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+		wantErr  bool
+	}{
+		{expr: `event.type == 'transaction.created' && data.amount < -10000`, expected: true},
+		{expr: `event.type == "transaction.created" && data.amount < -20000`, expected: false},
+		{expr: `data.amount == -12500`, expected: true},
+		{expr: `data.amount / 100.0 == -125.0`, expected: true},
+		{expr: `int(data.amount) / 100`, expected: int64(-125)},
+		{expr: `int(data.amount) % 1000`, expected: int64(-500)},
+		{expr: `7 / 2`, expected: int64(3)},
+		{expr: `7.0 / 2.0`, expected: 3.5},
+		{expr: `-data.amount >= double(100 * 100 + 2500)`, expected: true},
+		{expr: `data.category in ['eating_out', 'groceries']`, expected: true},
+		{expr: `'lunch' in data.labels && data.labels[1] == 'work'`, expected: true},
+		{expr: `'merchant' in data && 'data' in event`, expected: true},
+		{expr: `data['merchant']['address'].city == 'London'`, expected: true},
+		{expr: `data.merchant.name.startsWith('Pret') && data.merchant.name.lowerAscii().contains('manger')`, expected: true},
+		{expr: `data.merchant.name.matches('^Pret\\s')`, expected: true},
+		{expr: `data.merchant.name.endsWith("Manger") ? 'pret' : 'other'`, expected: "pret"},
+		{expr: `size(data.labels) == 2 && data.currency.size() == 3`, expected: true},
+		{expr: `string(int(data.amount)) + ' ' + data.currency`, expected: "-12500 GBP"},
+		{expr: `int('42') == 42 && double('1.5') == 1.5 && int(2.7) == 2`, expected: true},
+		{expr: `data.labels.exists(l, l == 'work')`, expected: true},
+		{expr: `has(data.notes) || has(event.tags)`, expected: false},
+		{expr: `has(data.merchant.address)`, expected: true},
+		{expr: `!has(data.notes) || data.notes == ''`, expected: true},
+		{expr: `data.notes == 'x' || data.amount < 0`, expected: true},
+		{expr: `data.amount > 0 && data.notes == 'x'`, expected: false},
+		{expr: `data.metadata == {}`, expected: true},
+		{expr: `data.notes == 'x'`, wantErr: true},
+		{expr: `data.notes == 'x' && data.amount < 0`, wantErr: true},
+		{expr: `data.amount == '12500'`, expected: false},
+		{expr: `data.amount < 'a'`, wantErr: true},
+		{expr: `data.amount / 100`, wantErr: true},
+		{expr: `data.labels[5]`, wantErr: true},
+		{expr: `data.amount.name`, wantErr: true},
+		{expr: `null == null && [1, 'a'] == [1, 'a'] && !false`, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := compileCEL(tt.expr)
+			if err != nil {
+				t.Fatalf("Unexpected compile error: %v", err)
+			}
+			got, err := expr.eval(payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v (%v)", tt.wantErr, err, got)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v (%T), got %v (%T)", tt.expected, tt.expected, got, got)
+			}
+		})
+	}
+}
+
+func TestCompileCELErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`data.amount <`,
+		`data.amount < -10000 )`,
+		`'unterminated`,
+		`data.amount # 2`,
+		`missing(data)`,
+		`tags`,
+		`data.name.contains()`,
+		`has(data)`,
+		`data.labels[0`,
+		`true ? 1`,
+		`7.0 / 2`,
+		`1 + 'a'`,
+	} {
+		if _, err := compileCEL(expr); err == nil {
+			t.Errorf("Expected a compile error for %q", expr)
+		} else if strings.Contains(err.Error(), "\n") {
+			t.Errorf("Expected a one-line error for %q, got %q", expr, err)
+		}
+	}
+
+	_, err := compileCEL(`type == 'transaction.created'`)
+	if err == nil || !strings.Contains(err.Error(), "event.type") {
+		t.Errorf("Expected a hint to use event.type, got %v", err)
+	}
+}
+
+func TestEvalCELBool(t *testing.T) {
+	payload := map[string]interface{}{"type": "transaction.created"}
+	expr, _ := compileCEL(`event.type`)
+	if _, err := evalCELBool(expr, payload); err == nil {
+		t.Error("Expected an error for an expression that isn't a bool")
+	}
+	expr, _ = compileCEL(`event.type.startsWith('transaction.')`)
+	if matched, err := evalCELBool(expr, payload); err != nil || !matched {
+		t.Errorf("Expected a match, got %v, %v", matched, err)
+	}
+	expr, _ = compileCEL(`data.amount < 0`)
+	if _, err := evalCELBool(expr, payload); err == nil {
+		t.Error("Expected an error for a payload without data")
+	}
+}
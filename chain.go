@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A file sink with chain set hash-chains its records: each record includes
+// the hash of the one before it, and its own hash is the SHA-256 of the
+// record's JSON without the hash. Editing, removing or reordering a record
+// breaks the chain from that point on, which verify-chain reports.
+
+// chainHashField is appended to a record's JSON to hold its hash
+const chainHashField = `,"hash":"`
+
+// chainLine encodes a record that follows the record with hash prev,
+// returning the line and the record's hash
+func chainLine(record fileRecord, prev string) ([]byte, string, error) {
+	record.PrevHash = prev
+	record.Hash = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	line := make([]byte, 0, len(data)+len(chainHashField)+len(hash)+3)
+	line = append(line, data[:len(data)-1]...)
+	line = append(line, chainHashField...)
+	line = append(line, hash...)
+	line = append(line, '"', '}', '\n')
+	return line, hash, nil
+}
+
+// lastChainHash returns the hash of the last record in an archive, so that
+// the chain continues across restarts. It is empty for a new archive.
+func lastChainHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Read backwards from the end until the start of the last line
+	const chunkSize = 64 * 1024
+	end := info.Size()
+	var tail []byte
+	for offset := end; offset > 0; {
+		n := int64(chunkSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return "", err
+		}
+		tail = append(chunk, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 || offset == 0 {
+			last := trimmed[i+1:]
+			if len(last) == 0 {
+				return "", nil
+			}
+			var record fileRecord
+			if err := json.Unmarshal(last, &record); err != nil {
+				return "", fmt.Errorf("reading last record: %w", err)
+			}
+			if record.Hash == "" {
+				return "", errors.New("the last record has no hash - use a new file for a hash-chained archive")
+			}
+			return record.Hash, nil
+		}
+	}
+	return "", nil
+}
+
+// chainSummary describes a verified archive
+type chainSummary struct {
+	Records int
+	// First is the hash the first record follows, which is empty unless
+	// the archive continues a chain from an earlier file
+	First string
+	Last  string
+}
+
+// verifyChain checks every record's hash and link to the record before it,
+// returning an error naming the first line that doesn't match
+func verifyChain(r io.Reader) (chainSummary, error) {
+	var summary chainSummary
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			return summary, nil
+		}
+		if err != nil && err != io.EOF {
+			return summary, err
+		}
+		line = bytes.TrimRight(line, "\n")
+
+		var record fileRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return summary, fmt.Errorf("line %d: invalid record: %w", lineNumber, err)
+		}
+		if record.Hash == "" {
+			return summary, fmt.Errorf("line %d: record %s has no hash", lineNumber, record.ID)
+		}
+		suffix := chainHashField + record.Hash + `"}`
+		if !bytes.HasSuffix(line, []byte(suffix)) {
+			return summary, fmt.Errorf("line %d: record %s has been modified", lineNumber, record.ID)
+		}
+		signed := append(line[:len(line)-len(suffix):len(line)-len(suffix)], '}')
+		sum := sha256.Sum256(signed)
+		if hex.EncodeToString(sum[:]) != record.Hash {
+			return summary, fmt.Errorf("line %d: record %s has been modified", lineNumber, record.ID)
+		}
+
+		if summary.Records == 0 {
+			summary.First = record.PrevHash
+		} else if record.PrevHash != summary.Last {
+			return summary, fmt.Errorf("line %d: record %s doesn't follow the record before it - records have been removed or reordered", lineNumber, record.ID)
+		}
+		summary.Records++
+		summary.Last = record.Hash
+	}
+}
+
+// runVerifyChain implements the verify-chain command, which checks the hash
+// chains of file sink archives. It returns the process exit code.
+func runVerifyChain(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(out, "usage: webhook-server verify-chain FILE...")
+		return 2
+	}
+
+	status := 0
+	for _, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		summary, err := verifyChain(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(out, "%s: FAILED after %d valid records: %v\n", path, summary.Records, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(out, "%s: OK, %d records, last hash %s\n", path, summary.Records, summary.Last)
+		if summary.First != "" {
+			fmt.Fprintf(out, "%s: continues the chain after hash %s\n", path, summary.First)
+		}
+	}
+	return status
+}
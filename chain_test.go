@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeChainedArchive publishes n events to a new hash-chained file sink,
+// reopening it halfway through, and returns the archive's lines
+func writeChainedArchive(t *testing.T, n int) (string, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var sink *fileSink
+	for i := 0; i < n; i++ {
+		// Reopening the sink continues the chain from the last record
+		if i == 0 || i == n/2 {
+			if sink != nil {
+				sink.Close()
+			}
+			var err error
+			if sink, err = newFileSink("audit", path, true); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		event := &webhookEvent{
+			ID:       "evt_" + string(rune('a'+i)),
+			Type:     "transaction.created",
+			Body:     []byte(`{"type": "transaction.created", "data": {"amount": -350}}`),
+			Received: received.Add(time.Duration(i) * time.Minute),
+		}
+		if err := sink.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	sink.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestVerifyChain(t *testing.T) {
+	_, lines := writeChainedArchive(t, 4)
+	join := func(lines ...string) string { return strings.Join(lines, "\n") + "\n" }
+
+	tests := []struct {
+		name        string
+		archive     string
+		expectCount int
+		expectError string
+	}{
+		{name: "Intact", archive: join(lines...), expectCount: 4},
+		{name: "Empty", archive: ""},
+		{name: "Modified payload", archive: join(lines[0], strings.Replace(lines[1], "-350", "-3500", 1), lines[2], lines[3]), expectCount: 1, expectError: "line 2: record evt_b has been modified"},
+		{name: "Removed record", archive: join(lines[0], lines[2], lines[3]), expectCount: 1, expectError: "line 2: record evt_c doesn't follow"},
+		{name: "Reordered records", archive: join(lines[0], lines[2], lines[1], lines[3]), expectCount: 1, expectError: "line 2: record evt_c doesn't follow"},
+		{name: "Truncated", archive: join(lines[:3]...), expectCount: 3},
+		{name: "Unchained record", archive: join(lines[0], `{"id":"evt_x","type":"transaction.created"}`), expectCount: 1, expectError: "line 2: record evt_x has no hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary, err := verifyChain(strings.NewReader(tt.archive))
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Errorf("Expected an error containing %q, got %v", tt.expectError, err)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if summary.Records != tt.expectCount {
+				t.Errorf("Expected %d valid records, got %d", tt.expectCount, summary.Records)
+			}
+		})
+	}
+}
+
+func TestVerifyChainContinuesAcrossFiles(t *testing.T) {
+	_, lines := writeChainedArchive(t, 4)
+
+	summary, err := verifyChain(strings.NewReader(strings.Join(lines[2:], "\n")))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first, err := verifyChain(strings.NewReader(strings.Join(lines[:2], "\n")))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if summary.First != first.Last {
+		t.Errorf("Expected the second file to continue after %s, got %s", first.Last, summary.First)
+	}
+}
+
+func TestNewFileSinkRejectsUnchainedArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	sink, err := newFileSink("archive", path, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := sink.Publish(context.Background(), &webhookEvent{ID: "evt_a", Body: []byte(`{}`)}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	sink.Close()
+
+	if _, err := newFileSink("archive", path, true); err == nil {
+		t.Error("Expected an error for chaining an archive without hashes, got nil")
+	}
+}
+
+func TestRunVerifyChain(t *testing.T) {
+	path, lines := writeChainedArchive(t, 2)
+	tampered := filepath.Join(t.TempDir(), "tampered.jsonl")
+	if err := os.WriteFile(tampered, []byte(lines[1]+"\n"+lines[0]+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if status := runVerifyChain([]string{path}, &out); status != 0 {
+		t.Errorf("Expected status 0, got %d: %s", status, out.String())
+	}
+	if !strings.Contains(out.String(), "OK, 2 records") {
+		t.Errorf("Expected the record count, got %q", out.String())
+	}
+
+	out.Reset()
+	if status := runVerifyChain([]string{path, tampered}, &out); status != 1 {
+		t.Errorf("Expected status 1, got %d: %s", status, out.String())
+	}
+	if !strings.Contains(out.String(), "tampered.jsonl: FAILED") {
+		t.Errorf("Expected the tampered archive to fail, got %q", out.String())
+	}
+
+	if status := runVerifyChain(nil, &out); status != 2 {
+		t.Errorf("Expected status 2 without files, got %d", status)
+	}
+}
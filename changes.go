@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// ChangesConfig configures publishing what changed in each transaction.updated
+// event, compared with the last event seen for the transaction
+type ChangesConfig struct {
+	Enabled bool `json:"enabled"`
+	// TTL is how long a transaction is remembered after its last event,
+	// defaulting to 30 days
+	TTL       string `json:"ttl"`
+	KeyPrefix string `json:"key_prefix"`
+}
+
+var transactionChanges = metrics.newCounterVec("monzo_webhook_transaction_changes_total",
+	"transaction.updated events compared with the transaction's last event, by result (changed, unchanged, unknown, error).", "result")
+
+// fieldChange is a field of a transaction's data that an update changed. Old
+// is nil for an added field and New for a removed one.
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// transactionSnapshot is the data of the last event seen for a transaction,
+// with the changes it was published with, so a redelivery gets the same ones
+type transactionSnapshot struct {
+	Data    map[string]interface{} `json:"data"`
+	Changes []fieldChange          `json:"changes"`
+}
+
+// validate checks the changes configuration for invalid values
+func (c ChangesConfig) validate() error {
+	if _, err := parsePositiveDuration(c.TTL, 30*24*time.Hour); err != nil {
+		return fmt.Errorf("invalid changes ttl: %w", err)
+	}
+	return nil
+}
+
+// keyPrefix returns the prefix of transaction snapshot keys
+func (c ChangesConfig) keyPrefix() string {
+	if c.KeyPrefix == "" {
+		return "monzo-webhook:transactions:"
+	}
+	return c.KeyPrefix
+}
+
+// recordChanges remembers the data of a transaction event, and adds what
+// changed since the last one to a transaction.updated event's payload as
+// changes. Events that already have changes, such as mirrored ones, are left
+// as they are. It returns whether the payload changed.
+func recordChanges(ctx context.Context, state stateStore, cfg ChangesConfig, event *webhookEvent) bool {
+	if !cfg.Enabled || state == nil || (event.Type != "transaction.created" && event.Type != "transaction.updated") {
+		return false
+	}
+	if _, ok := event.Payload["changes"]; ok {
+		return false
+	}
+	data, _ := event.Payload["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+	if id == "" {
+		return false
+	}
+	key := cfg.keyPrefix()
+	if event.Tenant != nil {
+		key += event.Tenant.Name + ":"
+	}
+	key += id
+	ttl, _ := parsePositiveDuration(cfg.TTL, 30*24*time.Hour)
+
+	var previous *transactionSnapshot
+	if event.Type == "transaction.updated" {
+		stored, ok, err := state.get(ctx, key)
+		if ok {
+			previous = &transactionSnapshot{}
+			err = json.Unmarshal([]byte(stored), previous)
+		}
+		switch {
+		case err == nil && !ok:
+			transactionChanges.WithLabelValues("unknown").Inc()
+		case err != nil:
+			transactionChanges.WithLabelValues("error").Inc()
+			logWarn("Error reading the last event of transaction %s: %v", id, err)
+			return false
+		}
+	}
+
+	snapshot := transactionSnapshot{Data: data}
+	if previous != nil {
+		if reflect.DeepEqual(previous.Data, data) {
+			snapshot.Changes = previous.Changes
+		} else {
+			snapshot.Changes = diffFields("", previous.Data, data, nil)
+		}
+		if snapshot.Changes == nil {
+			snapshot.Changes = []fieldChange{}
+		}
+	}
+	encoded, err := json.Marshal(snapshot)
+	if err == nil {
+		err = state.set(ctx, key, string(encoded), ttl)
+	}
+	if err != nil {
+		logWarn("Error remembering the data of transaction %s: %v", id, err)
+	}
+	if previous == nil {
+		return false
+	}
+
+	if len(snapshot.Changes) == 0 {
+		transactionChanges.WithLabelValues("unchanged").Inc()
+	} else {
+		transactionChanges.WithLabelValues("changed").Inc()
+	}
+	event.Payload["changes"] = snapshot.Changes
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding the changes of %s event %s: %v", event.Type, event.ID, err)
+		delete(event.Payload, "changes")
+		return false
+	}
+	event.Body = body
+	return true
+}
+
+// diffFields appends the fields that differ between before and after to changes,
+// sorted by their dotted paths under prefix. Objects are compared field by
+// field, and lists as a whole. Both are decoded from JSON, so their values
+// can be compared directly.
+func diffFields(prefix string, before, after map[string]interface{}, changes []fieldChange) []fieldChange {
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := prefix + name
+		oldValue, newValue := before[name], after[name]
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			changes = diffFields(field+".", oldMap, newMap, changes)
+			continue
+		}
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, fieldChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		after  string
+		expect []fieldChange
+	}{
+		{name: "Unchanged", before: `{"id":"tx_1","amount":-350}`, after: `{"id":"tx_1","amount":-350}`},
+		{name: "Category edit", before: `{"category":"eating_out","notes":""}`, after: `{"category":"groceries","notes":""}`,
+			expect: []fieldChange{{Field: "category", Old: "eating_out", New: "groceries"}}},
+		{name: "Settled", before: `{"settled":"","amount":-350}`, after: `{"settled":"2024-01-02T00:00:00Z","amount":-360}`,
+			expect: []fieldChange{{Field: "amount", Old: -350.0, New: -360.0}, {Field: "settled", Old: "", New: "2024-01-02T00:00:00Z"}}},
+		{name: "Nested", before: `{"merchant":{"id":"merch_1","address":{"city":"London"}}}`, after: `{"merchant":{"id":"merch_1","address":{"city":"Leeds"}}}`,
+			expect: []fieldChange{{Field: "merchant.address.city", Old: "London", New: "Leeds"}}},
+		{name: "Added and removed", before: `{"decline_reason":"INSUFFICIENT_FUNDS"}`, after: `{"notes":"lunch"}`,
+			expect: []fieldChange{{Field: "decline_reason", Old: "INSUFFICIENT_FUNDS"}, {Field: "notes", New: "lunch"}}},
+		{name: "Lists compared whole", before: `{"attachments":[]}`, after: `{"attachments":[{"id":"attach_1"}]}`,
+			expect: []fieldChange{{Field: "attachments", Old: []interface{}{}, New: []interface{}{map[string]interface{}{"id": "attach_1"}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after map[string]interface{}
+			json.Unmarshal([]byte(tt.before), &before)
+			json.Unmarshal([]byte(tt.after), &after)
+			if got := diffFields("", before, after, nil); !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("Expected %+v, got %+v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestRecordChanges(t *testing.T) {
+	_, client := newFakeRedis(t)
+	cfg := ChangesConfig{Enabled: true}
+	tenant := &TenantConfig{Name: "alice"}
+
+	steps := []struct {
+		name          string
+		eventType     string
+		tenant        *TenantConfig
+		data          string
+		expectChanges string
+	}{
+		{name: "Created", eventType: "transaction.created", data: `{"id":"tx_1","category":"eating_out","settled":""}`},
+		{name: "Category edit", eventType: "transaction.updated", data: `{"id":"tx_1","category":"groceries","settled":""}`,
+			expectChanges: `[{"field":"category","old":"eating_out","new":"groceries"}]`},
+		{name: "Redelivery", eventType: "transaction.updated", data: `{"id":"tx_1","category":"groceries","settled":""}`,
+			expectChanges: `[{"field":"category","old":"eating_out","new":"groceries"}]`},
+		{name: "Settled", eventType: "transaction.updated", data: `{"id":"tx_1","category":"groceries","settled":"2024-01-02T00:00:00Z"}`,
+			expectChanges: `[{"field":"settled","old":"","new":"2024-01-02T00:00:00Z"}]`},
+		{name: "Unknown transaction", eventType: "transaction.updated", data: `{"id":"tx_2","category":"groceries"}`},
+		{name: "Another tenant's transaction", eventType: "transaction.updated", tenant: tenant, data: `{"id":"tx_1","category":"bills"}`},
+		{name: "Other event type", eventType: "account.balance_updated", data: `{"id":"tx_1"}`},
+	}
+	for _, step := range steps {
+		body := `{"type":"` + step.eventType + `","data":` + step.data + `}`
+		event := &webhookEvent{ID: "evt_1", Type: step.eventType, Tenant: step.tenant, Body: []byte(body)}
+		json.Unmarshal(event.Body, &event.Payload)
+
+		changed := recordChanges(context.Background(), redisState{client: client}, cfg, event)
+		var published struct {
+			Changes json.RawMessage `json:"changes"`
+		}
+		json.Unmarshal(event.Body, &published)
+		if changed != (step.expectChanges != "") || string(published.Changes) != step.expectChanges {
+			t.Errorf("%s: expected changes %s, got %v %s", step.name, step.expectChanges, changed, published.Changes)
+		}
+	}
+}
+
+func TestRecordChangesDisabled(t *testing.T) {
+	_, client := newFakeRedis(t)
+	data := func(category string) map[string]interface{} {
+		return map[string]interface{}{"data": map[string]interface{}{"id": "tx_1", "category": category}}
+	}
+	created := &webhookEvent{Type: "transaction.created", Payload: data("eating_out")}
+	recordChanges(context.Background(), redisState{client: client}, ChangesConfig{Enabled: true}, created)
+
+	updated := &webhookEvent{Type: "transaction.updated", Payload: data("groceries")}
+	if recordChanges(context.Background(), redisState{client: client}, ChangesConfig{}, updated) {
+		t.Errorf("Expected no changes when disabled, got %v", updated.Payload["changes"])
+	}
+}
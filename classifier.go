@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClassifierConfig configures re-classification of transaction categories by
+// an external classification API
+type ClassifierConfig struct {
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	Timeout  string `json:"timeout"`
+	CacheTTL string `json:"cache_ttl"`
+}
+
+// enrichmentComponent is the name classification is reported under in the
+// service status
+const enrichmentComponent = "enrichment"
+
+// errClassifierUnauthorized is returned when the classification API rejects
+// the token, usually because it has expired
+var errClassifierUnauthorized = errors.New("classifier rejected the token")
+
+// classificationRequest is sent to the classification API
+type classificationRequest struct {
+	MerchantID   string  `json:"merchant_id,omitempty"`
+	MerchantName string  `json:"merchant_name,omitempty"`
+	Description  string  `json:"description,omitempty"`
+	Category     string  `json:"category,omitempty"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency,omitempty"`
+}
+
+// classificationResponse is returned by the classification API. An empty
+// category keeps Monzo's.
+type classificationResponse struct {
+	Category string `json:"category"`
+}
+
+var (
+	classifierRequests = metrics.newCounterVec("monzo_webhook_classifier_requests_total",
+		"Category classifications, by result (cached, success, error).", "result")
+)
+
+// classifier assigns categories to transactions using an external API,
+// caching the category of each merchant
+type classifier struct {
+	url      string
+	token    string
+	client   *http.Client
+	cacheTTL time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedCategory
+}
+
+// cachedCategory is a merchant's category with its expiry time
+type cachedCategory struct {
+	category string
+	expires  time.Time
+}
+
+// transactionClassifier is set when a classification API is configured
+var transactionClassifier *classifier
+
+// validate checks the classifier configuration for invalid values
+func (c ClassifierConfig) validate() error {
+	if c.URL != "" && !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("classifier url must be an http or https URL")
+	}
+	if _, err := parsePositiveDuration(c.Timeout, 2*time.Second); err != nil {
+		return fmt.Errorf("invalid classifier timeout: %w", err)
+	}
+	if _, err := parsePositiveDuration(c.CacheTTL, 24*time.Hour); err != nil {
+		return fmt.Errorf("invalid classifier cache_ttl: %w", err)
+	}
+	return nil
+}
+
+func newClassifier(cfg ClassifierConfig, now func() time.Time) *classifier {
+	timeout, _ := parsePositiveDuration(cfg.Timeout, 2*time.Second)
+	cacheTTL, _ := parsePositiveDuration(cfg.CacheTTL, 24*time.Hour)
+	return &classifier{
+		url:      cfg.URL,
+		token:    cfg.Token,
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		now:      now,
+		cache:    make(map[string]cachedCategory),
+	}
+}
+
+// classify returns the category for a transaction, from the cache if the
+// merchant has been classified recently
+func (c *classifier) classify(ctx context.Context, merchantKey string, req classificationRequest) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[merchantKey]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expires) {
+		classifierRequests.WithLabelValues("cached").Inc()
+		return cached.category, nil
+	}
+
+	category, err := c.request(ctx, req)
+	if err != nil {
+		classifierRequests.WithLabelValues("error").Inc()
+		return "", err
+	}
+	classifierRequests.WithLabelValues("success").Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired entries now and then so the cache doesn't grow forever
+	if len(c.cache) >= 10000 {
+		for key, entry := range c.cache {
+			if !c.now().Before(entry.expires) {
+				delete(c.cache, key)
+			}
+		}
+	}
+	c.cache[merchantKey] = cachedCategory{category: category, expires: c.now().Add(c.cacheTTL)}
+	return category, nil
+}
+
+func (c *classifier) request(ctx context.Context, req classificationRequest) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("%w (status %d)", errClassifierUnauthorized, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("classifier returned status %d", resp.StatusCode)
+	}
+
+	var result classificationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid classifier response: %w", err)
+	}
+	return result.Category, nil
+}
+
+// classifyEvent re-classifies a transaction event's category. The new
+// category replaces data.category, and Monzo's is kept as
+// data.monzo_category. Events without a merchant are left alone, as are
+// events the classifier fails on. When the classifier rejects its token,
+// enrichment is reported as degraded until a classification succeeds again.
+func classifyEvent(ctx context.Context, c *classifier, event *webhookEvent) {
+	if c == nil || !strings.HasPrefix(event.Type, "transaction.") {
+		return
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	req := classificationRequest{}
+	req.Description, _ = data["description"].(string)
+	req.Category, _ = data["category"].(string)
+	req.Amount, _ = data["amount"].(float64)
+	req.Currency, _ = data["currency"].(string)
+	switch merchant := data["merchant"].(type) {
+	case map[string]interface{}:
+		req.MerchantID, _ = merchant["id"].(string)
+		req.MerchantName, _ = merchant["name"].(string)
+	case string:
+		req.MerchantID = merchant
+	}
+	merchantKey := req.MerchantID
+	if merchantKey == "" {
+		merchantKey = strings.ToLower(req.MerchantName)
+	}
+	if merchantKey == "" {
+		return
+	}
+
+	category, err := c.classify(ctx, merchantKey, req)
+	if errors.Is(err, errClassifierUnauthorized) {
+		serviceStatus.degrade(enrichmentComponent, "enrichment disabled: "+err.Error())
+	}
+	if err != nil {
+		logWarn("Error classifying %s event %s, keeping Monzo's category: %v", event.Type, event.ID, err)
+		return
+	}
+	serviceStatus.recover(enrichmentComponent)
+	if category == "" || category == req.Category {
+		return
+	}
+
+	data["monzo_category"] = req.Category
+	data["category"] = category
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding classified %s event %s: %v", event.Type, event.ID, err)
+		return
+	}
+	logDebug("Re-classified %s event %s from '%s' to '%s'", event.Type, event.ID, req.Category, category)
+	eventTraces.recordTransformation(event.ID, "classifier", event.Body, body)
+	event.Body = body
+}
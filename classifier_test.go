@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassifierConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      ClassifierConfig
+		expectError bool
+	}{
+		{name: "Disabled", config: ClassifierConfig{}},
+		{name: "Valid", config: ClassifierConfig{URL: "http://classifier:8000/classify", Timeout: "500ms", CacheTTL: "1h"}},
+		{name: "Not an HTTP URL", config: ClassifierConfig{URL: "classifier:8000"}, expectError: true},
+		{name: "Invalid timeout", config: ClassifierConfig{URL: "http://classifier", Timeout: "0s"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestClassifyEvent(t *testing.T) {
+	var requests []classificationRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req classificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		if req.MerchantName == "Broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(classificationResponse{Category: "coffee"})
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	c := newClassifier(ClassifierConfig{URL: server.URL, CacheTTL: "1h"}, func() time.Time { return now })
+
+	newEvent := func(body string) *webhookEvent {
+		var payload map[string]interface{}
+		json.Unmarshal([]byte(body), &payload)
+		return &webhookEvent{Type: payload["type"].(string), Body: []byte(body), Payload: payload}
+	}
+
+	body := `{"type":"transaction.created","data":{"amount":-350,"category":"eating_out","merchant":{"id":"merch_1","name":"Pret"}}}`
+	event := newEvent(body)
+	classifyEvent(context.Background(), c, event)
+
+	var published map[string]interface{}
+	json.Unmarshal(event.Body, &published)
+	data := published["data"].(map[string]interface{})
+	if data["category"] != "coffee" || data["monzo_category"] != "eating_out" {
+		t.Errorf("Expected the category to be replaced, got %v", data)
+	}
+	if len(requests) != 1 || requests[0].MerchantID != "merch_1" || requests[0].Amount != -350 {
+		t.Errorf("Unexpected classifier requests: %+v", requests)
+	}
+
+	// The merchant's category is cached until the TTL expires
+	classifyEvent(context.Background(), c, newEvent(body))
+	if len(requests) != 1 {
+		t.Errorf("Expected the cached category to be used, got %d requests", len(requests))
+	}
+	now = now.Add(2 * time.Hour)
+	classifyEvent(context.Background(), c, newEvent(body))
+	if len(requests) != 2 {
+		t.Errorf("Expected the expired category to be refreshed, got %d requests", len(requests))
+	}
+
+	// Errors and events without a merchant leave the payload unchanged
+	for _, body := range []string{
+		`{"type":"transaction.created","data":{"category":"shopping","merchant":{"name":"Broken"}}}`,
+		`{"type":"transaction.created","data":{"category":"transfers","merchant":null}}`,
+		`{"type":"account.updated","data":{"merchant":{"id":"merch_1"}}}`,
+	} {
+		event := newEvent(body)
+		classifyEvent(context.Background(), c, event)
+		if string(event.Body) != body {
+			t.Errorf("Expected the payload to be unchanged, got %s", event.Body)
+		}
+	}
+}
+
+func TestClassifyEventExpiredToken(t *testing.T) {
+	originalStatus := serviceStatus
+	defer func() { serviceStatus = originalStatus }()
+	var published []string
+	serviceStatus = &statusTracker{
+		now:      time.Now,
+		degraded: make(map[string]componentStatus),
+		publish: func(eventType string, body []byte, auth string) error {
+			published = append(published, eventType)
+			return nil
+		},
+	}
+
+	token := "expired"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(classificationResponse{Category: "coffee"})
+	}))
+	defer server.Close()
+	c := newClassifier(ClassifierConfig{URL: server.URL, Token: token}, time.Now)
+
+	body := `{"type":"transaction.created","data":{"category":"eating_out","merchant":{"id":"merch_1","name":"Pret"}}}`
+	for i := 0; i < 2; i++ {
+		event := &webhookEvent{Type: "transaction.created", Body: []byte(body)}
+		json.Unmarshal(event.Body, &event.Payload)
+		classifyEvent(context.Background(), c, event)
+		if string(event.Body) != body {
+			t.Errorf("Expected the payload to be unchanged, got %s", event.Body)
+		}
+	}
+
+	components := serviceStatus.components()
+	if len(components) != 1 || components[0].Component != enrichmentComponent || components[0].Status != "degraded" {
+		t.Fatalf("Expected enrichment to be degraded, got %+v", components)
+	}
+	if len(published) != 1 || published[0] != statusDegradedEventType {
+		t.Errorf("Expected a single status.degraded event, got %v", published)
+	}
+
+	// Enrichment recovers once the classifier accepts the token again
+	c.token = "valid"
+	event := &webhookEvent{Type: "transaction.created", Body: []byte(body)}
+	json.Unmarshal(event.Body, &event.Payload)
+	classifyEvent(context.Background(), c, event)
+	if components := serviceStatus.components(); len(components) != 0 {
+		t.Errorf("Expected enrichment to recover, got %+v", components)
+	}
+	if len(published) != 2 || published[1] != statusRecoveredEventType {
+		t.Errorf("Expected a status.recovered event, got %v", published)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is the release the binary was built from, set at build time with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+const cliUsage = `Usage: webhook-server [command] [flags]
+
+Commands:
+  serve                Run the webhook server (the default)
+  validate-config      Check the configuration and exit
+  version              Print the version and exit
+  verify-chain         Verify the hash chain of a file sink archive
+  generate             Generate Grafana dashboards and Prometheus alert rules
+  import-har           Replay webhook requests captured in HAR files to a server
+  schema export        Write JSON Schemas and protobuf definitions of published payloads
+  export-transactions  Write stored transactions as CSV or OFX for accounting tools
+
+Run 'webhook-server <command> -h' for a command's flags.
+`
+
+// runCLI runs the command named by the first argument, or serve if there's
+// none. serve only returns if its flags are invalid. It returns the process
+// exit code.
+func runCLI(args []string, out io.Writer) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		flags, configFile := newSettingsFlags("serve", out)
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		serve(*configFile)
+		return 0
+	case "validate-config":
+		return runValidateConfig(args, out)
+	case "version":
+		fmt.Fprintln(out, versionString())
+		return 0
+	case "verify-chain":
+		return runVerifyChain(args, out)
+	case "generate":
+		return runGenerate(args, out)
+	case "import-har":
+		return runImportHAR(args, out)
+	case "schema":
+		return runSchema(args, out)
+	case "export-transactions":
+		return runExportTransactions(args, out)
+	case "help":
+		fmt.Fprint(out, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(out, "Unknown command '%s'\n\n%s", command, cliUsage)
+		return 2
+	}
+}
+
+// envFlagName returns the flag that mirrors an environment variable, such
+// as -redis-host for REDIS_HOST
+func envFlagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// envFlag is a flag.Value that sets an environment variable, so that flags
+// take precedence over the environment
+type envFlag string
+
+func (f envFlag) String() string {
+	return ""
+}
+
+func (f envFlag) Set(value string) error {
+	return os.Setenv(string(f), value)
+}
+
+// newSettingsFlags returns a flag set with -config, a flag for each config
+// setting and a flag mirroring each other environment variable the server
+// reads, except secrets, and the value of -config. Secrets are set with the
+// flags of their _FILE variables, since arguments are visible to other users.
+func newSettingsFlags(name string, out io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	configFile := flags.String("config", "", "path to the config file (CONFIG_FILE)")
+	registerConfigFlags(flags, configFlags)
+
+	settings := make(map[string]bool, len(configSettings))
+	for _, setting := range configSettings {
+		settings[setting.env] = true
+	}
+	for _, env := range configEnvVars {
+		if env.name == "CONFIG_FILE" || settings[env.name] || env.secret {
+			continue
+		}
+		flags.Var(envFlag(env.name), envFlagName(env.name), "sets "+env.name)
+	}
+	return flags, configFile
+}
+
+// runValidateConfig implements the validate-config command, which checks the
+// configuration serve would load and prints every problem it finds. It
+// returns the process exit code, which is 1 if there are errors.
+func runValidateConfig(args []string, out io.Writer) int {
+	flags, configFlag := newSettingsFlags("validate-config", out)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	configFile := configFilePath(*configFlag)
+	source := configFile
+	if configFile == "" {
+		source = "environment variables and flags"
+	}
+	check := checkEventConfig(configFile)
+	for _, message := range check.errors {
+		fmt.Fprintf(out, "error: %s\n", message)
+	}
+	for _, message := range check.warnings {
+		fmt.Fprintf(out, "warning: %s\n", message)
+	}
+	if len(check.errors) > 0 {
+		fmt.Fprintf(out, "%s is invalid: %d errors, %d warnings\n", source, len(check.errors), len(check.warnings))
+		return 1
+	}
+	fmt.Fprintf(out, "%s is valid\n", source)
+	return 0
+}
+
+// versionString describes the build: the version, the commit it was built
+// from if known, and the Go version
+func versionString() string {
+	s := "webhook-server " + version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var revision string
+		modified := false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		if revision != "" && modified {
+			revision += "-dirty"
+		}
+		if revision != "" {
+			s += " (" + revision + ")"
+		}
+	}
+	return fmt.Sprintf("%s %s %s/%s", s, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
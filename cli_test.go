@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestConfigEnvVarsCoverSource(t *testing.T) {
+	// Every environment variable the server reads must be listed, so that it
+	// has a flag and is reported by the config endpoint, and those read as
+	// secrets must be marked secret
+	listed := make(map[string]bool, len(configEnvVars))
+	secret := make(map[string]bool)
+	for _, env := range configEnvVars {
+		listed[env.name] = true
+		secret[env.name] = env.secret
+	}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern := regexp.MustCompile(`(Getenv|LookupEnv|getenvSecret)\("([A-Z0-9_]+)"\)`)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range pattern.FindAllStringSubmatch(string(data), -1) {
+			names := []string{match[2]}
+			if match[1] == "getenvSecret" {
+				names = append(names, match[2]+"_FILE")
+				if !secret[match[2]] {
+					t.Errorf("%s reads %s as a secret, but it isn't marked secret in configEnvVars", file, match[2])
+				}
+			}
+			for _, name := range names {
+				if !listed[name] {
+					t.Errorf("%s reads %s, which is missing from configEnvVars", file, name)
+				}
+			}
+		}
+	}
+}
+
+func TestNewSettingsFlags(t *testing.T) {
+	origFlags := configFlags
+	defer func() { configFlags = origFlags }()
+	configFlags = map[string]string{}
+	t.Setenv("REDIS_HOST", "env-host")
+	t.Setenv("KAFKA_TLS", "")
+
+	flags, configFile := newSettingsFlags("serve", &strings.Builder{})
+	args := []string{"-config", "my-config.yaml", "-redis-host", "flag-host", "-kafka-tls=true", "-channel", "monzo"}
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if *configFile != "my-config.yaml" {
+		t.Errorf("Expected config file 'my-config.yaml', got '%s'", *configFile)
+	}
+	if got := os.Getenv("REDIS_HOST"); got != "flag-host" {
+		t.Errorf("Expected the flag to override REDIS_HOST, got '%s'", got)
+	}
+	if got := os.Getenv("KAFKA_TLS"); got != "true" {
+		t.Errorf("Expected KAFKA_TLS to be set by its flag, got '%s'", got)
+	}
+	if configFlags["REDIS_CHANNEL"] != "monzo" {
+		t.Errorf("Expected -channel to be recorded as a config setting, got %v", configFlags)
+	}
+
+	// Config settings have their own flags instead of mirrored ones, and
+	// secrets are only read from files, since arguments are visible to
+	// other users
+	for _, name := range []string{"redis-channel", "config-file", "webhook-password", "admin-token"} {
+		if flags.Lookup(name) != nil {
+			t.Errorf("Expected no -%s flag", name)
+		}
+	}
+	if flags.Lookup("webhook-password-file") == nil {
+		t.Error("Expected a -webhook-password-file flag")
+	}
+}
+
+func TestRunCLI(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		output string
+	}{
+		{name: "Version", args: []string{"version"}, code: 0, output: "webhook-server dev"},
+		{name: "Help", args: []string{"help"}, code: 0, output: "validate-config"},
+		{name: "Unknown command", args: []string{"deploy"}, code: 2, output: "Unknown command 'deploy'"},
+		{name: "Unknown flag", args: []string{"-no-such-flag"}, code: 2, output: "flag provided but not defined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if code := runCLI(tt.args, &out); code != tt.code {
+				t.Errorf("Expected exit code %d, got %d", tt.code, code)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("Expected output to contain '%s', got: %s", tt.output, out.String())
+			}
+		})
+	}
+}
+
+func TestRunValidateConfig(t *testing.T) {
+	for _, setting := range configSettings {
+		t.Setenv(setting.env, "")
+	}
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(valid, []byte(`{"channel": "monzo"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(invalid, []byte(`{"channel": "monzo", "workers": {"count": -1}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		output string
+	}{
+		{name: "Valid", args: []string{"-config", valid}, code: 0, output: valid + " is valid"},
+		{name: "Invalid", args: []string{"-config", invalid}, code: 1, output: invalid + " is invalid"},
+		{name: "Missing", args: []string{"-config", filepath.Join(dir, "missing.json")}, code: 1, output: "no such file"},
+		{name: "Flags only", args: []string{"-channel", "monzo"}, code: 0, output: "environment variables and flags is valid"},
+		{name: "Nothing to publish to", code: 1, output: "channel is empty and no stream or sinks are configured"},
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("CONFIG_FILE", "")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origFlags := configFlags
+			defer func() { configFlags = origFlags }()
+			configFlags = map[string]string{}
+
+			var out strings.Builder
+			if code := runValidateConfig(tt.args, &out); code != tt.code {
+				t.Errorf("Expected exit code %d, got %d: %s", tt.code, code, out.String())
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("Expected output to contain '%s', got: %s", tt.output, out.String())
+			}
+		})
+	}
+}
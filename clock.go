@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass. Time-dependent behaviour
+// reads the time from a Clock, or from its Now as a now function, so that
+// tests can control time and replays can simulate it faster than real time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is a timer started by a Clock
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// clock is the server's clock
+var clock Clock = systemClock{}
+
+// systemClock is real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) clockTimer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.timer.C }
+
+func (t systemTimer) Stop() bool { return t.timer.Stop() }
+
+// simulatedClock starts at a given time and runs speed times faster than
+// real time, so that an hour of events replays in a minute at speed 60
+type simulatedClock struct {
+	start   time.Time
+	started time.Time
+	speed   float64
+}
+
+func newSimulatedClock(start time.Time, speed float64) *simulatedClock {
+	return &simulatedClock{start: start, started: time.Now(), speed: speed}
+}
+
+func (c *simulatedClock) Now() time.Time {
+	return c.start.Add(time.Duration(float64(time.Since(c.started)) * c.speed))
+}
+
+func (c *simulatedClock) NewTimer(d time.Duration) clockTimer {
+	return systemClock{}.NewTimer(time.Duration(float64(d) / c.speed))
+}
+
+// sleepUntil waits until the clock reaches t, returning ctx's error if it's
+// cancelled first
+func sleepUntil(ctx context.Context, c Clock, t time.Time) error {
+	timer := c.NewTimer(t.Sub(c.Now()))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// clockNow reads the server's clock, for state created before the clock is
+// set, such as in tests
+func clockNow() time.Time { return clock.Now() }
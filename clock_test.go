@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when it's advanced, firing the timers
+// that are due
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+// Advance moves the clock on by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// waitForTimers waits until n timers are waiting to fire
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		waiting := len(c.timers)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d timers", n)
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestSimulatedClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	c := newSimulatedClock(start, 3600)
+
+	if now := c.Now(); now.Before(start) || now.After(start.Add(time.Hour)) {
+		t.Errorf("Expected the clock to start at %v, got %v", start, now)
+	}
+
+	// An hour passes in a second
+	began := time.Now()
+	if err := sleepUntil(context.Background(), c, start.Add(36*time.Second)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(began); elapsed > time.Second {
+		t.Errorf("Expected 36 simulated seconds to take 10ms, took %v", elapsed)
+	}
+	if now := c.Now(); now.Before(start.Add(36 * time.Second)) {
+		t.Errorf("Expected the clock to have reached the deadline, got %v", now)
+	}
+}
+
+func TestSleepUntilCancelled(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepUntil(ctx, c, c.Now().Add(time.Hour)); err != context.Canceled {
+		t.Errorf("Expected the sleep to be cancelled, got %v", err)
+	}
+	if len(c.timers) != 0 {
+		t.Errorf("Expected the timer to be stopped, got %d", len(c.timers))
+	}
+}
+
+func TestRunReloadUsesClock(t *testing.T) {
+	originalClock := clock
+	defer func() { clock = originalClock }()
+	fake := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	clock = fake
+
+	var loads atomic.Int32
+	loaded := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runReload(ctx, "test", func(context.Context) error {
+		loads.Add(1)
+		loaded <- struct{}{}
+		return nil
+	}, time.Minute)
+
+	fake.waitForTimers(t, 1)
+	fake.Advance(59 * time.Second)
+	if loads.Load() != 0 {
+		t.Fatalf("Expected no reload before the interval, got %d", loads.Load())
+	}
+	for i := 1; i <= 3; i++ {
+		fake.Advance(time.Minute)
+		select {
+		case <-loaded:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected reload %d after the interval", i)
+		}
+		fake.waitForTimers(t, 1)
+	}
+	if loads.Load() != 3 {
+		t.Errorf("Expected 3 reloads, got %d", loads.Load())
+	}
+}
+
+func TestWebhookEventsUseClock(t *testing.T) {
+	originalClock := clock
+	defer func() { clock = originalClock }()
+	fake := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	clock = fake
+
+	event := newWebhookEvent("transaction.created", []byte(`{}`), map[string]interface{}{}, nil, "disabled")
+	if !event.Received.Equal(fake.Now()) {
+		t.Errorf("Expected the event to be received at %v, got %v", fake.Now(), event.Received)
+	}
+
+	store := newOverrideStore(clockNow)
+	if !store.now().Equal(fake.Now()) {
+		t.Errorf("Expected runtime overrides to read the clock, got %v", store.now())
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CommandsConfig configures the commands channel, which lets downstream
+// systems perform Monzo actions through the service's access token
+type CommandsConfig struct {
+	// Channel is the Redis channel commands are received on. Commands are
+	// disabled without one.
+	Channel string `json:"channel"`
+	// ResultsChannel is the Redis channel the result of each command is
+	// published to, if set
+	ResultsChannel string `json:"results_channel"`
+	// Actions are the actions commands may perform. None are allowed
+	// unless they're listed.
+	Actions []string `json:"actions"`
+	// Secret verifies each command's HMAC-SHA256 signature. Commands are
+	// rejected unless they're signed with it.
+	Secret string `json:"secret"`
+	// MaxDeposit is the largest pot deposit in minor units, which deposit
+	// needs
+	MaxDeposit int64 `json:"max_deposit"`
+	// MaxDepositTotal is the most that may be deposited in minor units
+	// within DepositWindow, which deposit needs
+	MaxDepositTotal int64 `json:"max_deposit_total"`
+	// DepositWindow is the rolling window MaxDepositTotal applies to,
+	// defaulting to 24 hours
+	DepositWindow string `json:"deposit_window"`
+}
+
+// Command actions
+const (
+	commandAnnotate = "annotate"
+	commandDeposit  = "deposit"
+	commandFeedItem = "feed_item"
+)
+
+var commandActions = []string{commandAnnotate, commandDeposit, commandFeedItem}
+
+// commandTimeout limits the Monzo API requests of a command, including
+// retries
+const commandTimeout = 30 * time.Second
+
+// commandClaimTTL is how long a command's ID is remembered, so that a
+// command isn't performed twice by one instance or by several subscribed to
+// the channel
+const commandClaimTTL = 24 * time.Hour
+
+const commandClaimPrefix = "monzo-webhook:command:"
+
+// commandMaxSkew is how old a command's signature may be, so that a command
+// can't be replayed once its ID is forgotten
+const commandMaxSkew = 5 * time.Minute
+
+// Deposits are totalled in keys of a part of the window each, so a deposit
+// counts towards max_deposit_total for up to a part longer than the window
+const (
+	depositTotalPrefix = "monzo-webhook:deposits:"
+	depositTotalParts  = 60
+)
+
+// errDepositTotal is returned for a deposit that would take the total
+// deposited within the window over max_deposit_total
+var errDepositTotal = errors.New("deposit would exceed max_deposit_total")
+
+var commandsExecuted = metrics.newCounterVec("monzo_webhook_commands_total",
+	"Commands received on the commands channel, by action and result (ok, rejected, duplicate, error).", "action", "result")
+
+// validate checks the commands configuration for invalid values
+func (c CommandsConfig) validate() error {
+	for _, action := range c.Actions {
+		if !slices.Contains(commandActions, action) {
+			return fmt.Errorf("commands: unknown action '%s' (expected annotate, deposit or feed_item)", action)
+		}
+	}
+	if c.MaxDeposit < 0 || c.MaxDepositTotal < 0 {
+		return fmt.Errorf("commands: max_deposit and max_deposit_total must not be negative")
+	}
+	if _, err := parsePositiveDuration(c.DepositWindow, 24*time.Hour); err != nil {
+		return fmt.Errorf("commands: invalid deposit_window: %w", err)
+	}
+	if c.Channel != "" && len(c.Actions) == 0 {
+		return fmt.Errorf("commands: actions must list the actions commands may perform")
+	}
+	if c.Channel != "" && c.Secret == "" {
+		return fmt.Errorf("commands: secret is required to verify commands")
+	}
+	if c.allows(commandDeposit) && (c.MaxDeposit == 0 || c.MaxDepositTotal == 0) {
+		return fmt.Errorf("commands: deposit requires a max_deposit and max_deposit_total")
+	}
+	if c.MaxDepositTotal > 0 && c.MaxDepositTotal < c.MaxDeposit {
+		return fmt.Errorf("commands: max_deposit_total must not be less than max_deposit")
+	}
+	return nil
+}
+
+// depositWindow returns the window max_deposit_total applies to
+func (c CommandsConfig) depositWindow() time.Duration {
+	d, _ := parsePositiveDuration(c.DepositWindow, 24*time.Hour)
+	return d
+}
+
+// allows reports whether commands may perform an action. Deposits also need
+// a max_deposit and max_deposit_total.
+func (c CommandsConfig) allows(action string) bool {
+	return slices.Contains(c.Actions, action)
+}
+
+// signedCommand is a message received on the commands channel: a command and
+// its signature, an HMAC-SHA256 of the timestamp and the command as sent
+type signedCommand struct {
+	Command   json.RawMessage `json:"command"`
+	Timestamp int64           `json:"timestamp"`
+	Signature string          `json:"signature"`
+}
+
+// signCommand returns the hex signature of a command sent at timestamp
+func signCommand(secret string, timestamp int64, command []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(command)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a message's signature and timestamp, returning its command
+func (m signedCommand) verify(secret string, now time.Time) ([]byte, error) {
+	if len(m.Command) == 0 || m.Signature == "" {
+		return nil, errors.New("command and signature are required")
+	}
+	if skew := now.Sub(time.Unix(m.Timestamp, 0)); skew > commandMaxSkew || skew < -commandMaxSkew {
+		return nil, errors.New("signature timestamp is too old")
+	}
+	if !hmac.Equal([]byte(m.Signature), []byte(signCommand(secret, m.Timestamp, m.Command))) {
+		return nil, errors.New("invalid signature")
+	}
+	return m.Command, nil
+}
+
+// monzoCommand is a command received on the commands channel. Which fields
+// are needed depends on the action.
+type monzoCommand struct {
+	// ID identifies the command in its result, and is the deposit's dedupe
+	// ID, so a command that is sent again isn't performed twice
+	ID     string `json:"id"`
+	Action string `json:"action"`
+
+	// annotate sets metadata on a transaction, such as notes. Its account
+	// is optional, and picks the tokens of an account with its own.
+	TransactionID string            `json:"transaction_id"`
+	Metadata      map[string]string `json:"metadata"`
+
+	// deposit moves an amount from an account into a pot
+	AccountID string `json:"account_id"`
+	PotID     string `json:"pot_id"`
+	Amount    int64  `json:"amount"`
+
+	// feed_item adds an item to an account's feed
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	ImageURL string `json:"image_url"`
+	URL      string `json:"url"`
+}
+
+// commandResult is published to the results channel for each command
+type commandResult struct {
+	ID     string `json:"id,omitempty"`
+	Action string `json:"action,omitempty"`
+	// Status is ok, rejected for a command that isn't valid or allowed,
+	// duplicate for one that was already received, or error
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// validate checks that a command is complete and allowed
+func (c monzoCommand) validate(cfg CommandsConfig, accounts []AccountConfig) error {
+	if c.ID == "" {
+		return errors.New("id is required")
+	}
+	if !slices.Contains(commandActions, c.Action) {
+		return fmt.Errorf("unknown action '%s'", c.Action)
+	}
+	if !cfg.allows(c.Action) {
+		return fmt.Errorf("action %s isn't allowed", c.Action)
+	}
+	switch c.Action {
+	case commandAnnotate:
+		if c.TransactionID == "" || len(c.Metadata) == 0 {
+			return errors.New("annotate requires transaction_id and metadata")
+		}
+		if c.AccountID == "" {
+			return nil
+		}
+	case commandDeposit:
+		if c.AccountID == "" || c.PotID == "" || c.Amount <= 0 {
+			return errors.New("deposit requires account_id, pot_id and a positive amount")
+		}
+		if c.Amount > cfg.MaxDeposit {
+			return fmt.Errorf("amount %d is more than max_deposit %d", c.Amount, cfg.MaxDeposit)
+		}
+	case commandFeedItem:
+		if c.AccountID == "" || c.Title == "" || c.ImageURL == "" {
+			return errors.New("feed_item requires account_id, title and image_url")
+		}
+	}
+	// With accounts configured, commands can only act on them
+	if len(accounts) > 0 && !slices.ContainsFunc(accounts, func(a AccountConfig) bool { return a.ID == c.AccountID }) {
+		return fmt.Errorf("account %s isn't configured", c.AccountID)
+	}
+	return nil
+}
+
+// perform makes a command's Monzo API request, with the tokens of its account
+func (c monzoCommand) perform(ctx context.Context, client *monzoClient) error {
+	client = client.forAccount(c.AccountID)
+	switch c.Action {
+	case commandAnnotate:
+		return client.annotateTransaction(ctx, c.TransactionID, c.Metadata)
+	case commandDeposit:
+		return client.depositIntoPot(ctx, c.PotID, c.AccountID, c.Amount, c.ID)
+	case commandFeedItem:
+		return client.createFeedItem(ctx, c.AccountID, c.Title, c.Body, c.ImageURL, c.URL)
+	}
+	return nil
+}
+
+// annotateTransaction sets metadata keys on a transaction. Setting notes
+// changes the notes shown in the Monzo app.
+func (c *monzoClient) annotateTransaction(ctx context.Context, id string, metadata map[string]string) error {
+	form := url.Values{}
+	for key, value := range metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+	err := c.do(ctx, "annotate_transaction", http.MethodPatch, "/transactions/"+url.PathEscape(id), form, nil)
+	if err == nil {
+		c.cache.forget(ctx, "transaction", id)
+	}
+	return err
+}
+
+// depositIntoPot moves an amount in minor units from an account into a pot.
+// Monzo performs a deposit once for each dedupe ID.
+func (c *monzoClient) depositIntoPot(ctx context.Context, potID, accountID string, amount int64, dedupeID string) error {
+	form := url.Values{
+		"source_account_id": {accountID},
+		"amount":            {fmt.Sprint(amount)},
+		"dedupe_id":         {dedupeID},
+	}
+	return c.do(ctx, "pot_deposit", http.MethodPut, "/pots/"+url.PathEscape(potID)+"/deposit", form, nil)
+}
+
+// createFeedItem adds a basic item to an account's feed, opening link when
+// it's tapped if set
+func (c *monzoClient) createFeedItem(ctx context.Context, accountID, title, body, imageURL, link string) error {
+	form := url.Values{
+		"account_id":        {accountID},
+		"type":              {"basic"},
+		"params[title]":     {title},
+		"params[image_url]": {imageURL},
+	}
+	if body != "" {
+		form.Set("params[body]", body)
+	}
+	if link != "" {
+		form.Set("url", link)
+	}
+	return c.do(ctx, "feed_item", http.MethodPost, "/feed", form, nil)
+}
+
+// reserveDeposit adds a deposit to the total deposited within the window
+// before now, unless that would take the total over max_deposit_total. It
+// returns a function that takes the deposit off again, for when it wasn't
+// made.
+func reserveDeposit(ctx context.Context, state stateStore, cfg CommandsConfig, amount int64, now time.Time) (func(), error) {
+	window := cfg.depositWindow()
+	part := window / depositTotalParts
+	index := now.UnixNano() / int64(part)
+	key := func(i int64) string { return fmt.Sprintf("%s%s:%d", depositTotalPrefix, part, i) }
+
+	// The deposit is added first, so that deposits made at once by several
+	// instances can't all fit under the total
+	total, err := state.incrBy(ctx, key(index), amount, window+part)
+	if err != nil {
+		return nil, err
+	}
+	release := func() {
+		if _, err := state.incrBy(context.Background(), key(index), -amount, window+part); err != nil {
+			logWarn("Error taking a deposit of %d off the deposit total: %v", amount, err)
+		}
+	}
+	for i := index - depositTotalParts; i < index; i++ {
+		value, ok, err := state.get(ctx, key(i))
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if ok {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			total += n
+		}
+	}
+	if total > cfg.MaxDepositTotal {
+		release()
+		return nil, fmt.Errorf("%w %d within %s", errDepositTotal, cfg.MaxDepositTotal, window)
+	}
+	return release, nil
+}
+
+// executeCommand performs a signed command received on the commands channel,
+// on one of accounts if any are configured. Commands whose ID was claimed
+// before are skipped when there's a state store to claim them in. Deposits
+// need a state store to total them in.
+func executeCommand(ctx context.Context, client *monzoClient, state stateStore, cfg CommandsConfig, accounts []AccountConfig, payload []byte, now time.Time) commandResult {
+	var message signedCommand
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return commandResult{Status: "rejected", Error: fmt.Sprintf("invalid command: %v", err)}
+	}
+	data, err := message.verify(cfg.Secret, now)
+	if err != nil {
+		return commandResult{Status: "rejected", Error: err.Error()}
+	}
+	var command monzoCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		return commandResult{Status: "rejected", Error: fmt.Sprintf("invalid command: %v", err)}
+	}
+	result := commandResult{ID: command.ID, Action: command.Action}
+	if err := command.validate(cfg, accounts); err != nil {
+		result.Status, result.Error = "rejected", err.Error()
+		return result
+	}
+	if command.Action == commandDeposit && state == nil {
+		result.Status, result.Error = "rejected", "deposits need Redis or the event store to total them"
+		return result
+	}
+
+	key := commandClaimPrefix + command.ID
+	if state != nil {
+		claimed, err := state.setNX(ctx, key, command.Action, commandClaimTTL)
+		if err != nil {
+			logWarn("Error claiming command %s, performing it anyway: %v", command.ID, err)
+		} else if !claimed {
+			result.Status = "duplicate"
+			return result
+		}
+	}
+
+	// Let the command be sent again if it fails. Monzo performs a deposit
+	// once for its dedupe ID, even if it was performed before the error.
+	unclaim := func() {
+		if state != nil {
+			state.del(context.Background(), key)
+		}
+	}
+	release := func() {}
+	if command.Action == commandDeposit {
+		release, err = reserveDeposit(ctx, state, cfg, command.Amount, now)
+		if err != nil {
+			unclaim()
+			result.Status, result.Error = "error", err.Error()
+			if errors.Is(err, errDepositTotal) {
+				result.Status = "rejected"
+			}
+			return result
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	if err := command.perform(ctx, client); err != nil {
+		release()
+		unclaim()
+		result.Status, result.Error = "error", err.Error()
+		return result
+	}
+	result.Status = "ok"
+	return result
+}
+
+// runCommands performs the commands received on the commands channel until
+// ctx is cancelled, publishing each result to the results channel if one is
+// configured. Commands are performed one at a time, in the order received.
+func runCommands(ctx context.Context, client *redis.Client, api *monzoClient, cfg CommandsConfig) {
+	sub := client.Subscribe(ctx, cfg.Channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		logWarn("Error subscribing to the commands channel %s, retrying in the background: %v", cfg.Channel, err)
+	}
+	messages := sub.Channel()
+	state := stateFor(client)
+	for {
+		var message *redis.Message
+		select {
+		case <-ctx.Done():
+			return
+		case message = <-messages:
+		}
+		if message == nil {
+			return
+		}
+
+		result := executeCommand(ctx, api, state, cfg, currentConfig().Accounts, []byte(message.Payload), clock.Now())
+		action := result.Action
+		if !slices.Contains(commandActions, action) {
+			action = "unknown"
+		}
+		commandsExecuted.WithLabelValues(action, result.Status).Inc()
+		switch result.Status {
+		case "ok":
+			logInfo("Performed %s command %s", result.Action, result.ID)
+		case "duplicate":
+			logInfo("Skipped %s command %s, which was already received", result.Action, result.ID)
+		default:
+			logWarn("Command %s %s: %s", result.ID, result.Status, result.Error)
+		}
+		if cfg.ResultsChannel == "" {
+			continue
+		}
+		data, _ := json.Marshal(result)
+		if err := client.Publish(ctx, cfg.ResultsChannel, data).Err(); err != nil {
+			logError("Error publishing the result of command %s: %v", result.ID, err)
+		}
+	}
+}
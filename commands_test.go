@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCommandsConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       CommandsConfig
+		expectErr bool
+	}{
+		{name: "Empty", cfg: CommandsConfig{}},
+		{name: "Valid", cfg: CommandsConfig{Channel: "monzo-commands", Secret: "s3cret", Actions: []string{"annotate", "feed_item"}, MaxDeposit: 5000}},
+		{name: "Unknown action", cfg: CommandsConfig{Actions: []string{"transfer"}}, expectErr: true},
+		{name: "Negative max_deposit", cfg: CommandsConfig{MaxDeposit: -1}, expectErr: true},
+		{name: "Negative max_deposit_total", cfg: CommandsConfig{MaxDepositTotal: -1}, expectErr: true},
+		{name: "Invalid deposit_window", cfg: CommandsConfig{DepositWindow: "daily"}, expectErr: true},
+		{name: "No actions", cfg: CommandsConfig{Channel: "monzo-commands", Secret: "s3cret"}, expectErr: true},
+		{name: "No secret", cfg: CommandsConfig{Channel: "monzo-commands", Actions: []string{"annotate"}}, expectErr: true},
+		{name: "Deposit without max_deposit", cfg: CommandsConfig{Channel: "monzo-commands", Secret: "s3cret", Actions: []string{"deposit"}, MaxDepositTotal: 5000},
+			expectErr: true},
+		{name: "Deposit without max_deposit_total", cfg: CommandsConfig{Channel: "monzo-commands", Secret: "s3cret", Actions: []string{"deposit"}, MaxDeposit: 5000},
+			expectErr: true},
+		{name: "Total under max_deposit", cfg: CommandsConfig{Channel: "monzo-commands", Secret: "s3cret", Actions: []string{"deposit"}, MaxDeposit: 5000,
+			MaxDepositTotal: 1000}, expectErr: true},
+		{name: "Deposit", cfg: CommandsConfig{Channel: "monzo-commands", Secret: "s3cret", Actions: []string{"deposit"}, MaxDeposit: 5000,
+			MaxDepositTotal: 20000, DepositWindow: "168h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.expectErr {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.PostForm.Encode())
+		mu.Unlock()
+		if r.URL.Path == "/pots/pot_missing/deposit" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": "not_found", "message": "Pot not found"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	state := openTestState(t, filepath.Join(t.TempDir(), "events.db"), &now)
+	cfg := CommandsConfig{Secret: "s3cret", Actions: []string{"annotate", "deposit"}, MaxDeposit: 10000, MaxDepositTotal: 12000}
+	accounts := []AccountConfig{{ID: "acc_1"}}
+
+	tests := []struct {
+		name    string
+		payload string
+		message string // sent instead of the signed payload
+		advance time.Duration
+		status  string
+		request string
+		err     string
+	}{
+		{
+			name:    "Annotate",
+			payload: `{"id": "cmd_1", "action": "annotate", "transaction_id": "tx_1", "metadata": {"notes": "Lunch with Sam"}}`,
+			status:  "ok",
+			request: "PATCH /transactions/tx_1 metadata%5Bnotes%5D=Lunch+with+Sam",
+		},
+		{
+			name:    "Deposit",
+			payload: `{"id": "cmd_2", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 500}`,
+			status:  "ok",
+			request: "PUT /pots/pot_1/deposit amount=500&dedupe_id=cmd_2&source_account_id=acc_1",
+		},
+		{
+			name:    "Sent again",
+			payload: `{"id": "cmd_2", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 500}`,
+			status:  "duplicate",
+		},
+		{
+			name:    "Monzo error",
+			payload: `{"id": "cmd_3", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_missing", "amount": 500}`,
+			status:  "error",
+			request: "PUT /pots/pot_missing/deposit amount=500&dedupe_id=cmd_3&source_account_id=acc_1",
+			err:     "Pot not found",
+		},
+		{
+			name:    "Retried after an error",
+			payload: `{"id": "cmd_3", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_missing", "amount": 500}`,
+			status:  "error",
+			request: "PUT /pots/pot_missing/deposit amount=500&dedupe_id=cmd_3&source_account_id=acc_1",
+		},
+		{name: "Not JSON", message: `deposit`, status: "rejected", err: "invalid command"},
+		{name: "Unsigned", message: `{"command": {"id": "cmd_8", "action": "annotate", "transaction_id": "tx_1", "metadata": {"notes": "Hi"}}}`,
+			status: "rejected", err: "signature"},
+		{name: "Invalid signature", message: `{"command": {"id": "cmd_8", "action": "annotate", "transaction_id": "tx_1", "metadata": {"notes": "Hi"}},
+			"timestamp": 1709283600, "signature": "0000"}`, status: "rejected", err: "invalid signature"},
+		{name: "Signed with another secret", message: string(signedTestCommand("other", now,
+			`{"id": "cmd_8", "action": "annotate", "transaction_id": "tx_1", "metadata": {"notes": "Hi"}}`)), status: "rejected", err: "invalid signature"},
+		{name: "Stale signature", message: string(signedTestCommand("s3cret", now.Add(-time.Hour),
+			`{"id": "cmd_8", "action": "annotate", "transaction_id": "tx_1", "metadata": {"notes": "Hi"}}`)), status: "rejected", err: "too old"},
+		{name: "Not a command", payload: `"deposit"`, status: "rejected", err: "invalid command"},
+		{name: "No ID", payload: `{"action": "annotate"}`, status: "rejected", err: "id is required"},
+		{name: "Not allowed", payload: `{"id": "cmd_4", "action": "feed_item", "account_id": "acc_1", "title": "Hi", "image_url": "https://example.com/a.png"}`,
+			status: "rejected", err: "isn't allowed"},
+		{name: "Over max_deposit", payload: `{"id": "cmd_5", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 10001}`,
+			status: "rejected", err: "more than max_deposit"},
+		{name: "Unconfigured account", payload: `{"id": "cmd_6", "action": "deposit", "account_id": "acc_2", "pot_id": "pot_1", "amount": 100}`,
+			status: "rejected", err: "isn't configured"},
+		{name: "Incomplete", payload: `{"id": "cmd_7", "action": "annotate", "transaction_id": "tx_1"}`, status: "rejected", err: "requires"},
+		{
+			name:    "Up to max_deposit_total",
+			payload: `{"id": "cmd_9", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 10000}`,
+			advance: time.Hour,
+			status:  "ok",
+			request: "PUT /pots/pot_1/deposit amount=10000&dedupe_id=cmd_9&source_account_id=acc_1",
+		},
+		{name: "Over max_deposit_total", payload: `{"id": "cmd_10", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 1600}`,
+			advance: 22 * time.Hour, status: "rejected", err: "exceed max_deposit_total"},
+		{
+			name:    "Earlier deposits out of the window",
+			payload: `{"id": "cmd_10", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 1600}`,
+			advance: 2 * time.Hour,
+			status:  "ok",
+			request: "PUT /pots/pot_1/deposit amount=1600&dedupe_id=cmd_10&source_account_id=acc_1",
+		},
+		{name: "Over max_deposit_total again", payload: `{"id": "cmd_11", "action": "deposit", "account_id": "acc_1", "pot_id": "pot_1", "amount": 500}`,
+			status: "rejected", err: "exceed max_deposit_total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+			now = now.Add(tt.advance)
+			message := []byte(tt.message)
+			if tt.message == "" {
+				message = signedTestCommand(cfg.Secret, now, tt.payload)
+			}
+			result := executeCommand(context.Background(), client, state, cfg, accounts, message, now)
+			if result.Status != tt.status || !strings.Contains(result.Error, tt.err) {
+				t.Errorf("Expected %s with error containing %q, got %+v", tt.status, tt.err, result)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.request == "" && len(requests) > 0 || tt.request != "" && (len(requests) != 1 || requests[0] != tt.request) {
+				t.Errorf("Expected request %q, got %q", tt.request, requests)
+			}
+		})
+	}
+}
+
+func TestCreateFeedItem(t *testing.T) {
+	var form string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.URL.Path + " " + r.PostForm.Encode()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+
+	now := time.Now()
+	message := signedTestCommand("s3cret", now, `{"id": "cmd_1", "action": "feed_item",
+		"account_id": "acc_1", "title": "Budget", "body": "80% spent", "image_url": "https://example.com/a.png", "url": "https://example.com"}`)
+	result := executeCommand(context.Background(), client, nil, CommandsConfig{Secret: "s3cret", Actions: []string{"feed_item"}}, nil, message, now)
+	if result.Status != "ok" {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	expect := "/feed account_id=acc_1&params%5Bbody%5D=80%25+spent&params%5Bimage_url%5D=https%3A%2F%2Fexample.com%2Fa.png&params%5Btitle%5D=Budget&type=basic&url=https%3A%2F%2Fexample.com"
+	if form != expect {
+		t.Errorf("Expected %s, got %s", expect, form)
+	}
+}
+
+// signedTestCommand returns a message with a command signed at now
+func signedTestCommand(secret string, now time.Time, command string) []byte {
+	return fmt.Appendf(nil, `{"command": %s, "timestamp": %d, "signature": "%s"}`,
+		command, now.Unix(), signCommand(secret, now.Unix(), []byte(command)))
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// configCheck is the result of checking a configuration. Errors are settings
+// that are invalid or would have no effect, such as unknown keys; warnings
+// are likely mistakes.
+type configCheck struct {
+	errors   []string
+	warnings []string
+}
+
+func (c *configCheck) errorf(format string, v ...interface{}) {
+	c.errors = append(c.errors, fmt.Sprintf(format, v...))
+}
+
+func (c *configCheck) warnf(format string, v ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, v...))
+}
+
+// sinkEnvVars are the environment variables that add a sink outside the
+// config file
+var sinkEnvVars = []string{"AWS_SNS_TOPIC_ARN", "AWS_SQS_QUEUE_URL", "MIRROR_URL"}
+
+// checkEventConfig checks the configuration serve would load from a config
+// file, or from environment variables and flags alone if filename is empty.
+// Unlike readEventConfig, it reports every problem it finds rather than the
+// first, and warns about unknown keys and rules that can't match.
+func checkEventConfig(filename string) configCheck {
+	var check configCheck
+	var config EventConfig
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			check.errorf("%v", err)
+			return check
+		}
+		parsed, err := parseConfigFile(filename, data)
+		if err != nil {
+			check.errorf("%s", describeDecodeError(filename, data, err))
+			return check
+		}
+		checkUnknownKeys(&check, parsed, reflect.TypeOf(config), "")
+		if err := decodeConfigFile(filename, data, &config); err != nil {
+			check.errorf("%s", describeDecodeError(filename, data, err))
+			return check
+		}
+	}
+	if err := applyConfigSettings(&config, configFlags); err != nil {
+		check.errorf("%v", err)
+		return check
+	}
+
+	for _, err := range config.checks() {
+		if err != nil {
+			check.errorf("%v", err)
+		}
+	}
+
+	if config.Channel == "" && config.Stream.Name == "" && len(config.Sinks) == 0 {
+		configured := false
+		for _, env := range sinkEnvVars {
+			configured = configured || os.Getenv(env) != ""
+		}
+		if !configured {
+			check.errorf("channel is empty and no stream or sinks are configured, so events wouldn't be published anywhere - set channel, or REDIS_CHANNEL")
+		}
+	}
+	checkPriorityRules(&check, config.Priorities)
+	checkEventTypeFilter(&check, config.EventTypes)
+	checkBestPractices(&check, config)
+	return check
+}
+
+// productionEnvironments are the environment names taken to be production
+var productionEnvironments = map[string]bool{"prod": true, "production": true}
+
+// checkBestPractices warns about setups that work but are risky, from the
+// configuration and the environment variables serve reads alongside it
+func checkBestPractices(check *configCheck, c EventConfig) {
+	// The server listens on every interface, so without authentication or
+	// an allowlist anyone who can reach it can publish events
+	webhookAuthType := c.Auth[webhookEndpoint].Type
+	authenticated := (webhookAuthType != "" && webhookAuthType != authTypeBasic) || len(c.Tenants) > 0
+	for _, env := range []string{"WEBHOOK_USERNAME", "WEBHOOK_HTPASSWD_FILE", "VAULT_WEBHOOK_AUTH_PATH"} {
+		authenticated = authenticated || os.Getenv(env) != ""
+	}
+	if !authenticated && os.Getenv("WEBHOOK_ALLOWED_CIDRS") == "" {
+		check.warnf("the webhook endpoint has no authentication or IP allowlist and listens on every interface, so anyone who can reach it can publish events - set WEBHOOK_USERNAME and WEBHOOK_PASSWORD, auth.webhook or WEBHOOK_ALLOWED_CIDRS")
+	}
+
+	environment := c.FeatureFlags.Environment
+	if environment == "" {
+		environment = os.Getenv("SENTRY_ENVIRONMENT")
+	}
+	if productionEnvironments[strings.ToLower(environment)] && parseLogLevel(os.Getenv("LOG_LEVEL")) == DEBUG {
+		check.warnf("LOG_LEVEL is DEBUG in the %s environment, which logs every webhook payload with its transaction details - use INFO", environment)
+	}
+
+	if c.Replicas > 1 && !c.Dedup.Enabled {
+		check.warnf("replicas is %d but dedup isn't enabled, so a delivery Monzo retries to another replica is published again - enable dedup, which shares claims in Redis", c.Replicas)
+	}
+}
+
+// describeDecodeError makes an error decoding a config file actionable, with
+// the key a value has the wrong type for and, in JSON files, the line
+func describeDecodeError(filename string, data []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr) && isJSONConfigFile(filename):
+		// The offset is just past the byte that was invalid
+		line, column := jsonPosition(data, syntaxErr.Offset-1)
+		return fmt.Sprintf("line %d, column %d: %v", line, column, err)
+	case errors.As(err, &typeErr):
+		message := fmt.Sprintf("%s: expected %s, got %s", configPath(typeErr.Field), describeGoType(typeErr.Type), describeJSONValue(typeErr.Value))
+		if isJSONConfigFile(filename) {
+			line, _ := jsonPosition(data, typeErr.Offset)
+			message = fmt.Sprintf("line %d: %s", line, message)
+		}
+		return message
+	}
+	return err.Error()
+}
+
+// jsonPosition returns the line and column of an offset into a JSON file
+func jsonPosition(data []byte, offset int64) (int, int) {
+	offset = max(0, min(offset, int64(len(data))))
+	before := string(data[:offset])
+	return 1 + strings.Count(before, "\n"), len(before) - strings.LastIndex(before, "\n")
+}
+
+// configPath formats a dotted path from encoding/json, such as sinks.0.name,
+// as sinks[0].name
+func configPath(field string) string {
+	var sb strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			sb.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			sb.WriteString(".")
+		}
+		sb.WriteString(part)
+	}
+	return sb.String()
+}
+
+func describeGoType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return t.String()
+}
+
+func describeJSONValue(value string) string {
+	switch {
+	case value == "string":
+		return "a string"
+	case value == "bool":
+		return "true or false"
+	case value == "array":
+		return "a list"
+	case value == "object":
+		return "an object"
+	case strings.HasPrefix(value, "number "):
+		return strings.TrimPrefix(value, "number ")
+	case value == "number":
+		return "a number"
+	}
+	return value
+}
+
+// checkUnknownKeys reports the keys of a parsed config file that don't
+// match a field of t, which are otherwise silently ignored
+func checkUnknownKeys(check *configCheck, value interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			// Values of the wrong type are reported when decoding
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		var names []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = field.Type
+			names = append(names, name)
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				// encoding/json matches keys case-insensitively
+				for _, name := range names {
+					if strings.EqualFold(name, key) {
+						fieldType, ok = fields[name], true
+						break
+					}
+				}
+			}
+			if !ok {
+				check.errorf("unknown key '%s'%s", joinConfigPath(path, key), suggestion(key, names))
+				continue
+			}
+			checkUnknownKeys(check, object[key], fieldType, joinConfigPath(path, key))
+		}
+	case reflect.Slice, reflect.Array:
+		items, _ := value.([]interface{})
+		for i, item := range items {
+			checkUnknownKeys(check, item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		object, _ := value.(map[string]interface{})
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			checkUnknownKeys(check, object[key], t.Elem(), joinConfigPath(path, key))
+		}
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// suggestion returns a " - did you mean" hint naming the candidate closest
+// to s, if any is close enough to be a likely typo
+func suggestion(s string, candidates []string) string {
+	best, bestDistance := "", len(s)/3+2
+	for _, candidate := range candidates {
+		if d := editDistance(s, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" - did you mean '%s'?", best)
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// checkEventTypeFilter warns about event_types patterns that don't match any
+// type Monzo sends, which are likely to be typos
+func checkEventTypeFilter(check *configCheck, filter EventTypeFilter) {
+	var names []string
+	for _, t := range monzo.EventTypes() {
+		names = append(names, t.Type)
+	}
+	for _, list := range []struct {
+		name     string
+		patterns []string
+	}{{"allow", filter.Allow}, {"deny", filter.Deny}} {
+		for i, pattern := range list.patterns {
+			matched := false
+			for _, name := range names {
+				matched = matched || (PriorityRule{Type: pattern}).matches(name, nil)
+			}
+			if pattern != "" && !matched {
+				check.warnf("event_types.%s[%d]: '%s' doesn't match any event type Monzo is known to send%s", list.name, i, pattern, suggestion(pattern, names))
+			}
+		}
+	}
+}
+
+// checkPriorityRules warns about priority rules that can't match the events
+// Monzo sends: types that aren't known, and fields that aren't in the payload
+func checkPriorityRules(check *configCheck, rules []PriorityRule) {
+	types := monzo.EventTypes()
+	var names []string
+	for _, t := range types {
+		names = append(names, t.Type)
+	}
+
+	for i, rule := range rules {
+		var matched []monzo.EventType
+		for _, t := range types {
+			if (PriorityRule{Type: rule.Type}).matches(t.Type, nil) {
+				matched = append(matched, t)
+			}
+		}
+		if rule.Type != "" && len(matched) == 0 {
+			check.warnf("priority rule %d: type '%s' doesn't match any event type Monzo is known to send%s", i+1, rule.Type, suggestion(rule.Type, names))
+			continue
+		}
+		if rule.Field == "" {
+			continue
+		}
+		found := false
+		var paths []string
+		for _, t := range matched {
+			event := map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"type": map[string]interface{}{"type": "string"}, "data": t.Schema},
+			}
+			found = found || schemaHasPath(event, strings.Split(rule.Field, "."))
+			paths = append(paths, schemaPaths(event, "")...)
+		}
+		sort.Strings(paths)
+		if !found {
+			check.warnf("priority rule %d: field '%s' isn't in the payload of the events it matches%s", i+1, rule.Field, suggestion(rule.Field, paths))
+		}
+	}
+}
+
+// schemaHasPath reports whether a JSON Schema has a property at a path
+func schemaHasPath(schema map[string]interface{}, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	if options, ok := schema["oneOf"].([]interface{}); ok {
+		for _, option := range options {
+			if o, ok := option.(map[string]interface{}); ok && schemaHasPath(o, path) {
+				return true
+			}
+		}
+		return false
+	}
+	if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+		return schemaHasPath(additional, path[1:])
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	property, ok := properties[path[0]].(map[string]interface{})
+	return ok && schemaHasPath(property, path[1:])
+}
+
+// schemaPaths returns the dotted paths of a JSON Schema's properties
+func schemaPaths(schema map[string]interface{}, prefix string) []string {
+	var paths []string
+	if options, ok := schema["oneOf"].([]interface{}); ok {
+		for _, option := range options {
+			if o, ok := option.(map[string]interface{}); ok {
+				paths = append(paths, schemaPaths(o, prefix)...)
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, property := range properties {
+		path := joinConfigPath(prefix, name)
+		paths = append(paths, path)
+		if p, ok := property.(map[string]interface{}); ok {
+			paths = append(paths, schemaPaths(p, path)...)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckEventConfig(t *testing.T) {
+	for _, setting := range configSettings {
+		t.Setenv(setting.env, "")
+	}
+	for _, env := range sinkEnvVars {
+		t.Setenv(env, "")
+	}
+	t.Setenv("WEBHOOK_USERNAME", "monzo")
+	origFlags := configFlags
+	defer func() { configFlags = origFlags }()
+	configFlags = map[string]string{}
+
+	tests := []struct {
+		name     string
+		file     string
+		data     string
+		errors   []string
+		warnings []string
+	}{
+		{
+			name: "Valid",
+			file: "config.json",
+			data: `{"channel": "monzo", "priorities": [{"type": "transaction.*", "field": "data.merchant.name", "priority": 5}]}`,
+		},
+		{
+			name: "Unknown keys",
+			file: "config.json",
+			data: `{"chanel": "monzo", "sinks": [{"type": "file", "pth": "/tmp/a.jsonl"}], "retry": {"Attempts": 2, "backof": "1s"}}`,
+			errors: []string{
+				"unknown key 'chanel' - did you mean 'channel'?",
+				"unknown key 'retry.backof'",
+				"unknown key 'sinks[0].pth' - did you mean 'path'?",
+				"sink 1: file sinks must have a path",
+			},
+		},
+		{
+			name: "Unknown key in YAML",
+			file: "config.yaml",
+			data: "channel: monzo\nstream:\n  name: events\n  max_lenght: 100\n",
+			errors: []string{
+				"unknown key 'stream.max_lenght' - did you mean 'max_len'?",
+			},
+		},
+		{
+			name:   "Wrong type",
+			file:   "config.json",
+			data:   "{\n  \"channel\": \"monzo\",\n  \"retry\": {\"attempts\": \"three\"}\n}",
+			errors: []string{"line 3: retry.attempts: expected an integer, got a string"},
+		},
+		{
+			name:   "Wrong type in a list",
+			file:   "config.toml",
+			data:   "channel = \"monzo\"\n[[sinks]]\ntype = \"file\"\nname = 1\n",
+			errors: []string{"sinks[0].name: expected a string, got a number"},
+		},
+		{
+			name:   "Syntax error",
+			file:   "config.json",
+			data:   "{\n  \"channel\": \"monzo\",\n}",
+			errors: []string{"line 3, column 1: invalid character '}' looking for beginning of object key string"},
+		},
+		{
+			name: "Every invalid section",
+			file: "config.json",
+			data: `{"channel": "monzo", "workers": {"count": -1}, "priorities": [{"priority": 1}]}`,
+			errors: []string{
+				"workers count must not be negative",
+				"priority rule 1 must have a type or field",
+			},
+		},
+		{
+			name:   "Empty channel",
+			file:   "config.json",
+			data:   `{"channel": ""}`,
+			errors: []string{"channel is empty and no stream or sinks are configured, so events wouldn't be published anywhere - set channel, or REDIS_CHANNEL"},
+		},
+		{
+			name: "Priority rules that can't match",
+			file: "config.json",
+			data: `{"channel": "monzo", "priorities": [
+				{"type": "transaction.create", "priority": 1},
+				{"type": "transaction.*", "field": "data.merchant.nme", "priority": 2},
+				{"field": "data.metadata.pot_id", "priority": 3}
+			]}`,
+			warnings: []string{
+				"priority rule 1: type 'transaction.create' doesn't match any event type Monzo is known to send - did you mean 'transaction.created'?",
+				"priority rule 2: field 'data.merchant.nme' isn't in the payload of the events it matches - did you mean 'data.merchant.name'?",
+			},
+		},
+		{
+			name: "Event type filter typo",
+			file: "config.json",
+			data: `{"channel": "monzo-events", "event_types": {"allow": ["transaction.*"], "deny": ["transaction.update"]}}`,
+			warnings: []string{
+				"event_types.deny[0]: 'transaction.update' doesn't match any event type Monzo is known to send - did you mean 'transaction.updated'?",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			check := checkEventConfig(path)
+			if !reflect.DeepEqual(check.errors, tt.errors) {
+				t.Errorf("Expected errors:\n%q\ngot:\n%q", tt.errors, check.errors)
+			}
+			if !reflect.DeepEqual(check.warnings, tt.warnings) {
+				t.Errorf("Expected warnings:\n%q\ngot:\n%q", tt.warnings, check.warnings)
+			}
+		})
+	}
+}
+
+func TestCheckBestPractices(t *testing.T) {
+	for _, env := range []string{"WEBHOOK_USERNAME", "WEBHOOK_HTPASSWD_FILE", "VAULT_WEBHOOK_AUTH_PATH", "WEBHOOK_ALLOWED_CIDRS", "SENTRY_ENVIRONMENT", "LOG_LEVEL"} {
+		t.Setenv(env, "")
+	}
+	const unauthenticated = "the webhook endpoint has no authentication or IP allowlist and listens on every interface, so anyone who can reach it can publish events - set WEBHOOK_USERNAME and WEBHOOK_PASSWORD, auth.webhook or WEBHOOK_ALLOWED_CIDRS"
+
+	tests := []struct {
+		name     string
+		config   EventConfig
+		env      map[string]string
+		warnings []string
+	}{
+		{name: "Unauthenticated", warnings: []string{unauthenticated}},
+		{name: "Basic auth", env: map[string]string{"WEBHOOK_USERNAME": "monzo"}},
+		{name: "Allowlist", env: map[string]string{"WEBHOOK_ALLOWED_CIDRS": "10.0.0.0/8"}},
+		{name: "Tenants", config: EventConfig{Tenants: []TenantConfig{{Name: "alice"}}}},
+		{name: "JWT", config: EventConfig{Auth: map[string]EndpointAuthConfig{webhookEndpoint: {Type: authTypeJWT}}}},
+		{
+			name:   "Debug logging in production",
+			config: EventConfig{FeatureFlags: FeatureFlagsConfig{Environment: "Production"}},
+			env:    map[string]string{"WEBHOOK_USERNAME": "monzo", "LOG_LEVEL": "debug"},
+			warnings: []string{
+				"LOG_LEVEL is DEBUG in the Production environment, which logs every webhook payload with its transaction details - use INFO",
+			},
+		},
+		{name: "Debug logging in staging", config: EventConfig{FeatureFlags: FeatureFlagsConfig{Environment: "staging"}},
+			env: map[string]string{"WEBHOOK_USERNAME": "monzo", "LOG_LEVEL": "DEBUG"}},
+		{
+			name: "Debug logging with the Sentry environment",
+			env:  map[string]string{"WEBHOOK_USERNAME": "monzo", "LOG_LEVEL": "DEBUG", "SENTRY_ENVIRONMENT": "prod"},
+			warnings: []string{
+				"LOG_LEVEL is DEBUG in the prod environment, which logs every webhook payload with its transaction details - use INFO",
+			},
+		},
+		{
+			name:   "Replicas without dedup",
+			config: EventConfig{Replicas: 3},
+			env:    map[string]string{"WEBHOOK_USERNAME": "monzo"},
+			warnings: []string{
+				"replicas is 3 but dedup isn't enabled, so a delivery Monzo retries to another replica is published again - enable dedup, which shares claims in Redis",
+			},
+		},
+		{name: "Replicas with dedup", config: EventConfig{Replicas: 3, Dedup: DedupConfig{Enabled: true}},
+			env: map[string]string{"WEBHOOK_USERNAME": "monzo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+			var check configCheck
+			checkBestPractices(&check, tt.config)
+			if !reflect.DeepEqual(check.warnings, tt.warnings) {
+				t.Errorf("Expected warnings:\n%q\ngot:\n%q", tt.warnings, check.warnings)
+			}
+		})
+	}
+}
+
+func TestSuggestion(t *testing.T) {
+	candidates := []string{"channel", "stream", "sinks", "retry"}
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{input: "chanel", expect: " - did you mean 'channel'?"},
+		{input: "sink", expect: " - did you mean 'sinks'?"},
+		{input: "Stream", expect: " - did you mean 'stream'?"},
+		{input: "workers", expect: ""},
+	}
+	for _, tt := range tests {
+		if got := suggestion(tt.input, candidates); got != tt.expect {
+			t.Errorf("suggestion(%q) = %q, expected %q", tt.input, got, tt.expect)
+		}
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	tests := map[string]string{
+		"retry.attempts":        "retry.attempts",
+		"sinks.0.name":          "sinks[0].name",
+		"tenants.2.quota.bytes": "tenants[2].quota.bytes",
+	}
+	for input, expect := range tests {
+		if got := configPath(input); got != expect {
+			t.Errorf("configPath(%q) = %q, expected %q", input, got, expect)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// defaultConfigFile is loaded when no config file is named, if it exists
+const defaultConfigFile = "config.json"
+
+// configSetting is an event configuration setting that can also be given by
+// an environment variable or a command line flag. Flags take precedence over
+// environment variables, which take precedence over the config file.
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	bool  bool
+	apply func(c *EventConfig, value string) error
+}
+
+// stringSetting sets a string field of the configuration
+func stringSetting(field func(*EventConfig) *string) func(*EventConfig, string) error {
+	return func(c *EventConfig, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+// intSetting sets an integer field of the configuration
+func intSetting(field func(*EventConfig) *int) func(*EventConfig, string) error {
+	return func(c *EventConfig, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// int64Setting sets a 64-bit integer field of the configuration
+func int64Setting(field func(*EventConfig) *int64) func(*EventConfig, string) error {
+	return func(c *EventConfig, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// boolSetting sets a boolean field of the configuration
+func boolSetting(field func(*EventConfig) *bool) func(*EventConfig, string) error {
+	return func(c *EventConfig, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a boolean", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// configSettings are the settings that can be given without a config file
+var configSettings = []configSetting{
+	{
+		env: "REDIS_CHANNEL", flag: "channel", usage: "Redis channel to publish events to",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.Channel }),
+	},
+	{
+		env: "REDIS_STREAM", flag: "stream", usage: "Redis stream to publish events to",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.Stream.Name }),
+	},
+	{
+		env: "REDIS_STREAM_MAX_LEN", flag: "stream-max-len", usage: "approximate maximum length of the Redis stream",
+		apply: int64Setting(func(c *EventConfig) *int64 { return &c.Stream.MaxLen }),
+	},
+	{
+		env: "REDIS_STREAM_MAX_AGE", flag: "stream-max-age", usage: "age after which Redis stream entries are trimmed",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.Stream.MaxAge }),
+	},
+	{
+		env: "WORKER_COUNT", flag: "workers", usage: "number of workers publishing events",
+		apply: intSetting(func(c *EventConfig) *int { return &c.Workers.Count }),
+	},
+	{
+		env: "WORKER_QUEUE_SIZE", flag: "queue-size", usage: "number of events that can wait for a worker",
+		apply: intSetting(func(c *EventConfig) *int { return &c.Workers.QueueSize }),
+	},
+	{
+		env: "SPOOL_DIR", flag: "spool-dir", usage: "directory to spool events to while Redis is unavailable",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.Spool.Dir }),
+	},
+	{
+		env: "RETRY_ATTEMPTS", flag: "retry-attempts", usage: "attempts to publish each event to a sink",
+		apply: intSetting(func(c *EventConfig) *int { return &c.Retry.Attempts }),
+	},
+	{
+		env: "RETRY_TIMEOUT", flag: "retry-timeout", usage: "time limit for publishing an event to a sink, including retries",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.Retry.Timeout }),
+	},
+	{
+		env: "REQUEST_BUDGET", flag: "request-budget", usage: "time limit for a webhook request to publish its event, from when it was received",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.RequestBudget }),
+	},
+	{
+		env: "STORE_PATH", flag: "store-path", usage: "SQLite database to keep every received webhook in",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.Store.Path }),
+	},
+	{
+		env: "FEATURE_FLAGS_ENVIRONMENT", flag: "environment", usage: "environment the server runs in, selecting feature flags' per-environment states",
+		apply: stringSetting(func(c *EventConfig) *string { return &c.FeatureFlags.Environment }),
+	},
+	{
+		env: "REPLICAS", flag: "replicas", usage: "number of instances serving webhooks behind a load balancer",
+		apply: intSetting(func(c *EventConfig) *int { return &c.Replicas }),
+	},
+	{
+		env: "STRICT_DECODING", flag: "strict-decoding", usage: "reject events that don't match the Monzo payload types", bool: true,
+		apply: boolSetting(func(c *EventConfig) *bool { return &c.StrictDecoding }),
+	},
+}
+
+// configFlags holds the config settings given as command line flags, by
+// environment variable name
+var configFlags = map[string]string{}
+
+// settingFlag is a flag.Value that records a config setting
+type settingFlag struct {
+	setting configSetting
+	values  map[string]string
+}
+
+func (f *settingFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.setting.env]
+}
+
+func (f *settingFlag) Set(value string) error {
+	if err := f.setting.apply(&EventConfig{}, value); err != nil {
+		return err
+	}
+	f.values[f.setting.env] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -flag
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.setting.bool
+}
+
+// registerConfigFlags defines a flag for each config setting, recording the
+// ones that are set in values
+func registerConfigFlags(flags *flag.FlagSet, values map[string]string) {
+	for _, setting := range configSettings {
+		flags.Var(&settingFlag{setting: setting, values: values}, setting.flag,
+			fmt.Sprintf("%s (%s)", setting.usage, setting.env))
+	}
+}
+
+// applyConfigSettings overrides the configuration with the settings given by
+// environment variables, then by flags
+func applyConfigSettings(c *EventConfig, flags map[string]string) error {
+	for _, setting := range configSettings {
+		if value := os.Getenv(setting.env); value != "" {
+			if err := setting.apply(c, value); err != nil {
+				return fmt.Errorf("invalid %s: %w", setting.env, err)
+			}
+		}
+		if value, ok := flags[setting.env]; ok {
+			if err := setting.apply(c, value); err != nil {
+				return fmt.Errorf("invalid -%s: %w", setting.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configFilePath returns the config file to load: the one named by the
+// -config flag or CONFIG_FILE, or config.json if it exists. It returns ""
+// when there's no config file, so the configuration comes from environment
+// variables and flags alone.
+func configFilePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	if _, err := os.Stat(defaultConfigFile); errors.Is(err, fs.ErrNotExist) {
+		return ""
+	}
+	return defaultConfigFile
+}
+
+// readEventConfig reads the event configuration from a JSON, YAML or TOML
+// file, if one is named, and applies the settings given by environment
+// variables and flags. Without a file, a channel or stream must be set.
+func readEventConfig(filename string) (EventConfig, error) {
+	var config EventConfig
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return EventConfig{}, err
+		}
+		if err := decodeConfigFile(filename, data, &config); err != nil {
+			return EventConfig{}, err
+		}
+	}
+	if err := applyConfigSettings(&config, configFlags); err != nil {
+		return EventConfig{}, err
+	}
+	if filename == "" && config.Channel == "" && config.Stream.Name == "" {
+		return EventConfig{}, fmt.Errorf("no configuration file found at %s, and neither REDIS_CHANNEL nor REDIS_STREAM is set", defaultConfigFile)
+	}
+	if err := config.validate(); err != nil {
+		return EventConfig{}, err
+	}
+	return config, nil
+}
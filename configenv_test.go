@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfigSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		flags   map[string]string
+		expect  EventConfig
+		wantErr string
+	}{
+		{
+			name:   "File values are kept",
+			expect: EventConfig{Channel: "file-channel", Workers: WorkerConfig{Count: 2}},
+		},
+		{
+			name: "Environment overrides the file",
+			env:  map[string]string{"REDIS_CHANNEL": "env-channel", "WORKER_COUNT": "4", "STRICT_DECODING": "true"},
+			expect: EventConfig{
+				Channel:        "env-channel",
+				Workers:        WorkerConfig{Count: 4},
+				StrictDecoding: true,
+			},
+		},
+		{
+			name:   "Flags override the environment",
+			env:    map[string]string{"REDIS_CHANNEL": "env-channel", "REDIS_STREAM_MAX_LEN": "100"},
+			flags:  map[string]string{"REDIS_CHANNEL": "flag-channel"},
+			expect: EventConfig{Channel: "flag-channel", Workers: WorkerConfig{Count: 2}, Stream: StreamConfig{MaxLen: 100}},
+		},
+		{
+			name:    "Invalid environment variable",
+			env:     map[string]string{"WORKER_COUNT": "many"},
+			wantErr: "invalid WORKER_COUNT: 'many' is not an integer",
+		},
+		{
+			name:    "Invalid flag",
+			flags:   map[string]string{"STRICT_DECODING": "maybe"},
+			wantErr: "invalid -strict-decoding: 'maybe' is not a boolean",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, setting := range configSettings {
+				t.Setenv(setting.env, tt.env[setting.env])
+			}
+			config := EventConfig{Channel: "file-channel", Workers: WorkerConfig{Count: 2}}
+			err := applyConfigSettings(&config, tt.flags)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Expected error '%s', got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if config.Channel != tt.expect.Channel || config.Workers != tt.expect.Workers ||
+				config.Stream.MaxLen != tt.expect.Stream.MaxLen || config.StrictDecoding != tt.expect.StrictDecoding {
+				t.Errorf("Expected %+v, got %+v", tt.expect, config)
+			}
+		})
+	}
+}
+
+func TestRegisterConfigFlags(t *testing.T) {
+	values := map[string]string{}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerConfigFlags(flags, values)
+
+	if err := flags.Parse([]string{"-channel", "monzo", "-strict-decoding", "-workers=3"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	expected := map[string]string{"REDIS_CHANNEL": "monzo", "STRICT_DECODING": "true", "WORKER_COUNT": "3"}
+	if len(values) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+	for env, value := range expected {
+		if values[env] != value {
+			t.Errorf("Expected %s=%s, got '%s'", env, value, values[env])
+		}
+	}
+
+	// Invalid values are rejected when the flags are parsed
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(&strings.Builder{})
+	registerConfigFlags(flags, map[string]string{})
+	if err := flags.Parse([]string{"-stream-max-len", "long"}); err == nil {
+		t.Error("Expected an error for an invalid integer")
+	}
+}
+
+func TestConfigFilePath(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	t.Setenv("CONFIG_FILE", "")
+	if got := configFilePath(""); got != "" {
+		t.Errorf("Expected no config file, got '%s'", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, defaultConfigFile), []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := configFilePath(""); got != defaultConfigFile {
+		t.Errorf("Expected '%s', got '%s'", defaultConfigFile, got)
+	}
+
+	t.Setenv("CONFIG_FILE", "env.yaml")
+	if got := configFilePath(""); got != "env.yaml" {
+		t.Errorf("Expected 'env.yaml', got '%s'", got)
+	}
+	if got := configFilePath("flag.toml"); got != "flag.toml" {
+		t.Errorf("Expected 'flag.toml', got '%s'", got)
+	}
+}
+
+func TestReadEventConfigWithoutFile(t *testing.T) {
+	for _, setting := range configSettings {
+		t.Setenv(setting.env, "")
+	}
+	t.Setenv("REDIS_CHANNEL", "monzo")
+	t.Setenv("REDIS_STREAM", "monzo-events")
+	t.Setenv("REDIS_STREAM_MAX_AGE", "24h")
+
+	config, err := readEventConfig("")
+	if err != nil {
+		t.Fatalf("readEventConfig failed: %v", err)
+	}
+	if config.Channel != "monzo" || config.Stream.Name != "monzo-events" || config.Stream.MaxAge != "24h" {
+		t.Errorf("Unexpected configuration: %+v", config)
+	}
+
+	// Settings are validated like the config file
+	t.Setenv("REDIS_STREAM_MAX_AGE", "soon")
+	if _, err := readEventConfig(""); err == nil {
+		t.Error("Expected an error for an invalid stream max age")
+	}
+}
+
+func TestReadEventConfigMissingFile(t *testing.T) {
+	if _, err := readEventConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error for a named config file that doesn't exist")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// decodeConfigFile decodes a config file into v, choosing the format by the
+// file's extension: .yaml or .yml for YAML, .toml for TOML and JSON for
+// anything else. Whatever the format, the file is decoded through v's JSON
+// field names, so every format has the same sections and keys.
+func decodeConfigFile(path string, data []byte, v interface{}) error {
+	if isJSONConfigFile(path) {
+		return json.Unmarshal(data, v)
+	}
+	parsed, err := parseConfigFile(path, data)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(parsed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// isJSONConfigFile reports whether a config file is JSON, going by its
+// extension
+func isJSONConfigFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".toml":
+		return false
+	}
+	return true
+}
+
+// parseConfigFile parses a config file into JSON values, choosing the format
+// as decodeConfigFile does. YAML timestamps are kept as strings, and TOML
+// dates and times become RFC 3339 strings when they're decoded.
+func parseConfigFile(path string, data []byte) (interface{}, error) {
+	var parsed interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &parsed)
+	case ".toml":
+		var table map[string]interface{}
+		err = toml.Unmarshal(data, &table)
+		parsed = table
+	default:
+		err = json.Unmarshal(data, &parsed)
+	}
+	return parsed, err
+}
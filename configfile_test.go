@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConfigFile(t *testing.T) {
+	expected := EventConfig{
+		Channel: "monzo-webhook",
+		Workers: WorkerConfig{Count: 4},
+		Sinks: []SinkConfig{
+			{Type: "redis", Name: "audit", Channel: "monzo-audit"},
+			{Type: "file", Name: "archive", Path: "/var/lib/monzo-webhook/archive.jsonl", Required: true},
+		},
+		Priorities:     []PriorityRule{{Type: "transaction.created", Priority: 10}},
+		Retry:          RetryConfig{Attempts: 3, Jitter: 0.2, InitialBackoff: "100ms"},
+		StrictDecoding: true,
+	}
+
+	files := map[string]string{
+		"config.json": `{
+			"channel": "monzo-webhook",
+			"workers": {"count": 4},
+			"sinks": [
+				{"type": "redis", "name": "audit", "channel": "monzo-audit"},
+				{"type": "file", "name": "archive", "path": "/var/lib/monzo-webhook/archive.jsonl", "required": true}
+			],
+			"priorities": [{"type": "transaction.created", "priority": 10}],
+			"retry": {"attempts": 3, "jitter": 0.2, "initial_backoff": "100ms"},
+			"strict_decoding": true
+		}`,
+		"config.yaml": `
+# Publish every event to Redis
+channel: monzo-webhook
+workers:
+  count: 4
+sinks:
+  - type: redis
+    name: audit
+    channel: monzo-audit
+  - {type: file, name: archive, path: /var/lib/monzo-webhook/archive.jsonl, required: true}
+priorities: [{type: transaction.created, priority: 10}]
+retry:
+  attempts: 3
+  jitter: 0.2
+  initial_backoff: 100ms  # doubled on each retry
+strict_decoding: true
+`,
+		"config.TOML": `
+# Publish every event to Redis
+channel = "monzo-webhook"
+strict_decoding = true
+priorities = [{type = "transaction.created", priority = 10}]
+
+[workers]
+count = 4
+
+[retry]
+attempts = 3
+jitter = 0.2
+initial_backoff = "100ms" # doubled on each retry
+
+[[sinks]]
+type = "redis"
+name = "audit"
+channel = "monzo-audit"
+
+[[sinks]]
+type = "file"
+name = "archive"
+path = "/var/lib/monzo-webhook/archive.jsonl"
+required = true
+`,
+	}
+
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			var cfg EventConfig
+			if err := decodeConfigFile(name, []byte(data), &cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(cfg, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, cfg)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "config.yaml", data: "channel: monzo\n  workers: 4\n"},
+		{name: "config.yml", data: "channel: [monzo\n"},
+		{name: "config.toml", data: "channel = monzo\n"},
+		{name: "config.toml", data: "[workers]\ncount = \"four\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg EventConfig
+			if err := decodeConfigFile(tt.name, []byte(tt.data), &cfg); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The generate dashboards command builds a Grafana dashboard and Prometheus
+// alert rules from the metrics registry, so that monitoring uses the metric
+// names and labels the running code exposes.
+
+// alertRule is a Prometheus alerting rule on one of the service's metrics.
+// Its expression is a format string given the metric's name. The labels the
+// expression uses are checked against the metric's, so a rule can't drift
+// from the metric it watches.
+type alertRule struct {
+	alert    string
+	metric   prometheus.Collector
+	expr     string
+	duration string
+	severity string
+	summary  string
+}
+
+// serviceAlertRules are the alert rules generated for the service
+func serviceAlertRules() []alertRule {
+	return []alertRule{
+		{
+			alert:    "MonzoWebhookSinkPublishErrors",
+			metric:   sinkPublishTotal,
+			expr:     `sum by (sink) (rate(%s{result="error"}[5m])) > 0`,
+			duration: "10m",
+			severity: "warning",
+			summary:  "Events are failing to publish to sink {{ $labels.sink }}",
+		},
+		{
+			alert:    "MonzoWebhookSlowResponses",
+			metric:   webhookRequestDuration,
+			expr:     `histogram_quantile(0.95, sum by (le) (rate(%s_bucket[5m]))) > 2`,
+			duration: "10m",
+			severity: "warning",
+			summary:  "95% of webhook responses take up to {{ $value | humanizeDuration }}, risking Monzo's timeout",
+		},
+		{
+			alert:    "MonzoWebhookBackpressure",
+			metric:   backpressureRejections,
+			expr:     `sum by (status) (rate(%s[5m])) > 0`,
+			duration: "5m",
+			severity: "warning",
+			summary:  "Webhook events are being rejected with {{ $labels.status }} because the event queue is under pressure",
+		},
+		{
+			alert:    "MonzoWebhookSpoolBacklog",
+			metric:   spoolPending,
+			expr:     `%s > 0`,
+			duration: "15m",
+			severity: "warning",
+			summary:  "{{ $value }} events for sink {{ $labels.sink }} have been spooled for over 15 minutes",
+		},
+		{
+			alert:    "MonzoWebhookComponentDegraded",
+			metric:   componentsDegraded,
+			expr:     `%s == 1`,
+			duration: "10m",
+			severity: "warning",
+			summary:  "The {{ $labels.component }} component has been degraded for 10 minutes",
+		},
+		{
+			alert:    "MonzoWebhookStreamConsumerLag",
+			metric:   streamGroupLag,
+			expr:     `%s > 1000`,
+			duration: "15m",
+			severity: "warning",
+			summary:  "Consumer group {{ $labels.group }} is {{ $value }} entries behind on stream {{ $labels.stream }}",
+		},
+		{
+			alert:    "MonzoWebhookNoActiveInstance",
+			metric:   failoverActive,
+			expr:     `sum(%s) < 1`,
+			duration: "2m",
+			severity: "critical",
+			summary:  "No instance holds the failover lease, so events are only being buffered",
+		},
+		{
+			alert:    "MonzoWebhookConfigReloadFailed",
+			metric:   configReloads,
+			expr:     `increase(%s{result="error"}[15m]) > 0`,
+			severity: "warning",
+			summary:  "The config file failed to reload, so the previous configuration is still in use",
+		},
+	}
+}
+
+var (
+	// promqlGroupingPattern matches the labels of by and without clauses
+	promqlGroupingPattern = regexp.MustCompile(`\b(?:by|without) \(([^)]*)\)`)
+	// promqlMatcherPattern matches the label matchers of a selector
+	promqlMatcherPattern = regexp.MustCompile(`\{([^}]*)\}`)
+)
+
+// exprLabels returns the label names an expression groups by or matches on
+func exprLabels(expr string) []string {
+	var labels []string
+	for _, match := range promqlGroupingPattern.FindAllStringSubmatch(expr, -1) {
+		for _, label := range strings.Split(match[1], ",") {
+			labels = append(labels, strings.TrimSpace(label))
+		}
+	}
+	for _, match := range promqlMatcherPattern.FindAllStringSubmatch(expr, -1) {
+		for _, matcher := range strings.Split(match[1], ",") {
+			name, _, _ := strings.Cut(matcher, "=")
+			labels = append(labels, strings.TrimRight(strings.TrimSpace(name), "!"))
+		}
+	}
+	return labels
+}
+
+// validate checks that the rule's metric is registered and has the labels
+// its expression uses
+func (a alertRule) validate(r *metricsRegistry) error {
+	def, ok := r.definition(a.metric)
+	if !ok {
+		return fmt.Errorf("alert %s: metric is not registered", a.alert)
+	}
+
+	available := append([]string(nil), def.labels...)
+	if def.kind == "histogram" {
+		available = append(available, "le")
+	}
+	for _, label := range exprLabels(a.expr) {
+		if !containsString(available, label) {
+			return fmt.Errorf("alert %s: metric %s has no label '%s'", a.alert, def.name, label)
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAlertRules writes the alert rules as a Prometheus rules file. Strings
+// are quoted as JSON, which is valid YAML.
+func writeAlertRules(w io.Writer, r *metricsRegistry, rules []alertRule) error {
+	var sb strings.Builder
+	sb.WriteString("# Generated by webhook-server generate dashboards - do not edit\n")
+	sb.WriteString("groups:\n  - name: monzo-webhook\n    rules:\n")
+	for _, rule := range rules {
+		if err := rule.validate(r); err != nil {
+			return err
+		}
+		def, _ := r.definition(rule.metric)
+		quote := func(s string) string {
+			var buf strings.Builder
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.Encode(s)
+			return strings.TrimSuffix(buf.String(), "\n")
+		}
+		fmt.Fprintf(&sb, "      - alert: %s\n", rule.alert)
+		fmt.Fprintf(&sb, "        expr: %s\n", quote(fmt.Sprintf(rule.expr, def.name)))
+		if rule.duration != "" {
+			fmt.Fprintf(&sb, "        for: %s\n", rule.duration)
+		}
+		fmt.Fprintf(&sb, "        labels:\n          severity: %s\n", rule.severity)
+		fmt.Fprintf(&sb, "        annotations:\n          summary: %s\n", quote(rule.summary))
+		fmt.Fprintf(&sb, "          description: %s\n", quote(def.help))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// grafanaPanel is a time series panel in a Grafana dashboard
+type grafanaPanel struct {
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	Datasource  map[string]string      `json:"datasource,omitempty"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Targets     []grafanaTarget        `json:"targets,omitempty"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Collapsed   *bool                  `json:"collapsed,omitempty"`
+	Panels      []grafanaPanel         `json:"panels,omitempty"`
+}
+
+// grafanaTarget is a Prometheus query in a Grafana panel
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+	Exemplar     bool   `json:"exemplar,omitempty"`
+}
+
+// metricPanel returns a panel that graphs a metric: the rate of a counter,
+// the value of a gauge, or a histogram's percentiles
+func metricPanel(vec metricDef) grafanaPanel {
+	title, _, _ := strings.Cut(strings.TrimSuffix(vec.help, "."), ", by ")
+	panel := grafanaPanel{
+		Type:        "timeseries",
+		Title:       title,
+		Description: fmt.Sprintf("%s (%s)", vec.help, vec.name),
+		Datasource:  map[string]string{"type": "prometheus", "uid": "${datasource}"},
+	}
+
+	grouping := ""
+	var legend []string
+	for _, label := range vec.labels {
+		legend = append(legend, "{{"+label+"}}")
+	}
+	if len(vec.labels) > 0 {
+		grouping = " by (" + strings.Join(vec.labels, ", ") + ")"
+	}
+
+	unit := "short"
+	switch vec.kind {
+	case "counter":
+		panel.Targets = []grafanaTarget{{
+			Expr: fmt.Sprintf("sum%s (rate(%s[$__rate_interval]))", grouping, vec.name),
+		}}
+		switch {
+		case strings.HasSuffix(vec.name, "_bytes_total"):
+			unit = "Bps"
+		case !strings.HasSuffix(vec.name, "_seconds_total"):
+			unit = "ops"
+		}
+	case "gauge":
+		panel.Targets = []grafanaTarget{{Expr: fmt.Sprintf("sum%s (%s)", grouping, vec.name)}}
+		if strings.HasSuffix(vec.name, "_seconds") {
+			unit = "s"
+		}
+	case "histogram":
+		bucketGrouping := " by (" + strings.Join(append([]string{"le"}, vec.labels...), ", ") + ")"
+		for _, percentile := range []int{50, 95, 99} {
+			panel.Targets = append(panel.Targets, grafanaTarget{
+				Expr:         fmt.Sprintf("histogram_quantile(%g, sum%s (rate(%s_bucket[$__rate_interval])))", float64(percentile)/100, bucketGrouping, vec.name),
+				LegendFormat: strings.TrimSpace(fmt.Sprintf("p%d %s", percentile, strings.Join(legend, " "))),
+				Exemplar:     true,
+			})
+		}
+		unit = "s"
+	}
+	for i := range panel.Targets {
+		panel.Targets[i].RefID = string(rune('A' + i))
+		if panel.Targets[i].LegendFormat == "" {
+			panel.Targets[i].LegendFormat = strings.Join(legend, " ")
+		}
+	}
+	panel.FieldConfig = map[string]interface{}{"defaults": map[string]string{"unit": unit}}
+	return panel
+}
+
+// metricGroup returns the word a metric's name starts with after the
+// service's prefix, such as "sink" or "stream", which the dashboard groups
+// its panels by
+func metricGroup(name string) string {
+	group, _, _ := strings.Cut(strings.TrimPrefix(name, "monzo_webhook_"), "_")
+	return group
+}
+
+// grafanaDashboard returns a dashboard with a panel for each metric, in rows
+// by metric group
+func grafanaDashboard(r *metricsRegistry) map[string]interface{} {
+	var groups []string
+	byGroup := make(map[string][]metricDef)
+	for _, vec := range r.definitions() {
+		group := metricGroup(vec.name)
+		if _, ok := byGroup[group]; !ok {
+			groups = append(groups, group)
+		}
+		byGroup[group] = append(byGroup[group], vec)
+	}
+
+	var panels []grafanaPanel
+	y := 0
+	collapsed := false
+	for _, group := range groups {
+		panels = append(panels, grafanaPanel{
+			Type:      "row",
+			Title:     strings.ToUpper(group[:1]) + group[1:],
+			GridPos:   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+			Collapsed: &collapsed,
+		})
+		y++
+		for i, vec := range byGroup[group] {
+			panel := metricPanel(vec)
+			panel.GridPos = map[string]int{"h": 8, "w": 12, "x": 12 * (i % 2), "y": y + 8*(i/2)}
+			panels = append(panels, panel)
+		}
+		y += 8 * ((len(byGroup[group]) + 1) / 2)
+	}
+
+	return map[string]interface{}{
+		"uid":           "monzo-webhook",
+		"title":         "Monzo Webhook",
+		"description":   "Generated by webhook-server generate dashboards - do not edit",
+		"tags":          []string{"monzo-webhook"},
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": panels,
+	}
+}
+
+// runGenerate implements the generate command. generate dashboards writes
+// the Grafana dashboard and Prometheus alert rules to a directory. It
+// returns the process exit code.
+func runGenerate(args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "dashboards" {
+		fmt.Fprintln(out, "usage: webhook-server generate dashboards [-dir DIR]")
+		return 2
+	}
+	flags := flag.NewFlagSet("generate dashboards", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dir := flags.String("dir", ".", "directory to write the dashboard and alert rules to")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	dashboard, err := json.MarshalIndent(grafanaDashboard(metrics), "", "  ")
+	if err != nil {
+		fmt.Fprintf(out, "Error generating dashboard: %v\n", err)
+		return 1
+	}
+	var rules strings.Builder
+	if err := writeAlertRules(&rules, metrics, serviceAlertRules()); err != nil {
+		fmt.Fprintf(out, "Error generating alert rules: %v\n", err)
+		return 1
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"monzo-webhook-dashboard.json", append(dashboard, '\n')},
+		{"monzo-webhook-alerts.yml", []byte(rules.String())},
+	}
+	for _, file := range files {
+		path := filepath.Join(*dir, file.name)
+		if err := os.WriteFile(path, file.data, 0o644); err != nil {
+			fmt.Fprintf(out, "Error writing %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Fprintf(out, "Wrote %s\n", path)
+	}
+	return 0
+}
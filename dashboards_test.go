@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+func TestServiceAlertRulesMatchMetrics(t *testing.T) {
+	for _, rule := range serviceAlertRules() {
+		if err := rule.validate(metrics); err != nil {
+			t.Errorf("Invalid alert rule: %v", err)
+		}
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	registry := newMetricsRegistry()
+	published := registry.newCounterVec("test_published_total", "Publish attempts.", "sink", "result")
+	latency := registry.newHistogramVec("test_duration_seconds", "Test durations.", "sink")
+	unregistered := newMetricsRegistry().newGauge("test_other", "Another metric.")
+
+	tests := []struct {
+		name    string
+		rule    alertRule
+		wantErr string
+	}{
+		{
+			name: "Grouping and matchers",
+			rule: alertRule{alert: "A", metric: published, expr: `sum by (sink) (rate(%s{result="error"}[5m])) > 0`},
+		},
+		{
+			name: "Histogram bucket label",
+			rule: alertRule{alert: "A", metric: latency, expr: `histogram_quantile(0.95, sum by (le, sink) (rate(%s_bucket[5m]))) > 1`},
+		},
+		{
+			name: "Negative matcher",
+			rule: alertRule{alert: "A", metric: published, expr: `%s{result!="success"} > 0`},
+		},
+		{
+			name:    "Unknown grouping label",
+			rule:    alertRule{alert: "A", metric: published, expr: `sum by (type) (rate(%s[5m])) > 0`},
+			wantErr: "alert A: metric test_published_total has no label 'type'",
+		},
+		{
+			name:    "Unknown matcher label",
+			rule:    alertRule{alert: "A", metric: published, expr: `%s{status="error"} > 0`},
+			wantErr: "has no label 'status'",
+		},
+		{
+			name:    "Bucket label on a counter",
+			rule:    alertRule{alert: "A", metric: published, expr: `sum by (le) (rate(%s[5m])) > 0`},
+			wantErr: "has no label 'le'",
+		},
+		{
+			name:    "Unregistered metric",
+			rule:    alertRule{alert: "A", metric: unregistered, expr: `%s > 0`},
+			wantErr: "alert A: metric is not registered",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate(registry)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing '%s', got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWriteAlertRules(t *testing.T) {
+	registry := newMetricsRegistry()
+	published := registry.newCounterVec("test_published_total", "Publish attempts, by sink.", "sink")
+	rules := []alertRule{{
+		alert:    "TestPublishErrors",
+		metric:   published,
+		expr:     `sum by (sink) (rate(%s[5m])) > 0`,
+		duration: "10m",
+		severity: "warning",
+		summary:  "Sink {{ $labels.sink }} is \"failing\"",
+	}}
+
+	var sb strings.Builder
+	if err := writeAlertRules(&sb, registry, rules); err != nil {
+		t.Fatalf("writeAlertRules failed: %v", err)
+	}
+	expected := `# Generated by webhook-server generate dashboards - do not edit
+groups:
+  - name: monzo-webhook
+    rules:
+      - alert: TestPublishErrors
+        expr: "sum by (sink) (rate(test_published_total[5m])) > 0"
+        for: 10m
+        labels:
+          severity: warning
+        annotations:
+          summary: "Sink {{ $labels.sink }} is \"failing\""
+          description: "Publish attempts, by sink."
+`
+	if sb.String() != expected {
+		t.Errorf("Unexpected rules:\n%s\nexpected:\n%s", sb.String(), expected)
+	}
+
+	// The generated rules must be valid YAML with the same structure
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(sb.String()), &parsed); err != nil {
+		t.Fatalf("Generated rules are not valid YAML: %v", err)
+	}
+	groups := parsed.(map[string]interface{})["groups"].([]interface{})
+	rule := groups[0].(map[string]interface{})["rules"].([]interface{})[0].(map[string]interface{})
+	if rule["expr"] != "sum by (sink) (rate(test_published_total[5m])) > 0" {
+		t.Errorf("Unexpected parsed expr: %v", rule["expr"])
+	}
+}
+
+func TestMetricPanel(t *testing.T) {
+	registry := newMetricsRegistry()
+	def := func(c prometheus.Collector) metricDef {
+		d, _ := registry.definition(c)
+		return d
+	}
+	tests := []struct {
+		name    string
+		vec     metricDef
+		title   string
+		unit    string
+		exprs   []string
+		legends []string
+	}{
+		{
+			name:    "Counter",
+			vec:     def(registry.newCounterVec("test_published_total", "Publish attempts, by sink and result.", "sink", "result")),
+			title:   "Publish attempts",
+			unit:    "ops",
+			exprs:   []string{"sum by (sink, result) (rate(test_published_total[$__rate_interval]))"},
+			legends: []string{"{{sink}} {{result}}"},
+		},
+		{
+			name:    "Byte counter",
+			vec:     def(registry.newCounter("test_bytes_total", "Bytes accepted.")),
+			title:   "Bytes accepted",
+			unit:    "Bps",
+			exprs:   []string{"sum (rate(test_bytes_total[$__rate_interval]))"},
+			legends: []string{""},
+		},
+		{
+			name:    "Gauge in seconds",
+			vec:     def(registry.newGaugeVec("test_age_seconds", "Age of the oldest entry.", "stream")),
+			title:   "Age of the oldest entry",
+			unit:    "s",
+			exprs:   []string{"sum by (stream) (test_age_seconds)"},
+			legends: []string{"{{stream}}"},
+		},
+		{
+			name:  "Histogram",
+			vec:   def(registry.newHistogramVec("test_duration_seconds", "Test durations, by sink.", "sink")),
+			title: "Test durations",
+			unit:  "s",
+			exprs: []string{
+				"histogram_quantile(0.5, sum by (le, sink) (rate(test_duration_seconds_bucket[$__rate_interval])))",
+				"histogram_quantile(0.95, sum by (le, sink) (rate(test_duration_seconds_bucket[$__rate_interval])))",
+				"histogram_quantile(0.99, sum by (le, sink) (rate(test_duration_seconds_bucket[$__rate_interval])))",
+			},
+			legends: []string{"p50 {{sink}}", "p95 {{sink}}", "p99 {{sink}}"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panel := metricPanel(tt.vec)
+			if panel.Title != tt.title {
+				t.Errorf("Expected title '%s', got '%s'", tt.title, panel.Title)
+			}
+			if unit := panel.FieldConfig["defaults"].(map[string]string)["unit"]; unit != tt.unit {
+				t.Errorf("Expected unit '%s', got '%s'", tt.unit, unit)
+			}
+			if len(panel.Targets) != len(tt.exprs) {
+				t.Fatalf("Expected %d targets, got %d", len(tt.exprs), len(panel.Targets))
+			}
+			for i, target := range panel.Targets {
+				if target.Expr != tt.exprs[i] {
+					t.Errorf("Expected expr '%s', got '%s'", tt.exprs[i], target.Expr)
+				}
+				if target.LegendFormat != tt.legends[i] {
+					t.Errorf("Expected legend '%s', got '%s'", tt.legends[i], target.LegendFormat)
+				}
+			}
+		})
+	}
+}
+
+func TestRunGenerateDashboards(t *testing.T) {
+	dir := t.TempDir()
+	var out strings.Builder
+	if code := runGenerate([]string{"dashboards", "-dir", dir}, &out); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, out.String())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "monzo-webhook-dashboard.json"))
+	if err != nil {
+		t.Fatalf("Failed to read dashboard: %v", err)
+	}
+	var dashboard struct {
+		UID    string         `json:"uid"`
+		Panels []grafanaPanel `json:"panels"`
+	}
+	if err := json.Unmarshal(data, &dashboard); err != nil {
+		t.Fatalf("Dashboard is not valid JSON: %v", err)
+	}
+	if dashboard.UID != "monzo-webhook" {
+		t.Errorf("Expected uid 'monzo-webhook', got '%s'", dashboard.UID)
+	}
+
+	// Every registered metric has a panel
+	for _, vec := range metrics.definitions() {
+		found := false
+		for _, panel := range dashboard.Panels {
+			for _, target := range panel.Targets {
+				found = found || strings.Contains(target.Expr, vec.name)
+			}
+		}
+		if !found {
+			t.Errorf("Expected a panel for %s", vec.name)
+		}
+	}
+
+	rules, err := os.ReadFile(filepath.Join(dir, "monzo-webhook-alerts.yml"))
+	if err != nil {
+		t.Fatalf("Failed to read alert rules: %v", err)
+	}
+	if err := yaml.Unmarshal(rules, new(interface{})); err != nil {
+		t.Errorf("Alert rules are not valid YAML: %v", err)
+	}
+	if !strings.Contains(out.String(), "monzo-webhook-alerts.yml") {
+		t.Errorf("Expected the written paths in the output, got: %s", out.String())
+	}
+
+	if code := runGenerate([]string{"graphs"}, &out); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown target, got %d", code)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DedupConfig configures suppression of duplicate deliveries of the same
+// event, identified by event type and data.id, using keys in Redis or, without
+// it, the event store
+type DedupConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Window    string `json:"window"`
+	KeyPrefix string `json:"key_prefix"`
+}
+
+var (
+	duplicatesSuppressed = metrics.newCounterVec("monzo_webhook_duplicates_suppressed_total",
+		"Duplicate deliveries that were not published, by event type.", "type")
+)
+
+// validate checks the dedup configuration for invalid values
+func (c DedupConfig) validate() error {
+	if _, err := parsePositiveDuration(c.Window, 24*time.Hour); err != nil {
+		return fmt.Errorf("invalid dedup window: %w", err)
+	}
+	return nil
+}
+
+// window returns how long a delivery is remembered, defaulting to 24 hours
+func (c DedupConfig) window() time.Duration {
+	d, _ := parsePositiveDuration(c.Window, 24*time.Hour)
+	return d
+}
+
+// keyPrefix returns the prefix of dedup keys
+func (c DedupConfig) keyPrefix() string {
+	if c.KeyPrefix == "" {
+		return "monzo-webhook:dedup:"
+	}
+	return c.KeyPrefix
+}
+
+// dedupKey returns the key for an event, or an empty string if the
+// event has no data.id to deduplicate on
+func (c DedupConfig) dedupKey(event *webhookEvent) string {
+	data, _ := event.Payload["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+	if id == "" {
+		return ""
+	}
+	key := c.keyPrefix()
+	if event.Tenant != nil {
+		key += event.Tenant.Name + ":"
+	}
+	return key + event.Type + ":" + id
+}
+
+// claimDelivery records an event in the state unless it has been seen
+// within the window before now. For a duplicate, it returns the ID of the
+// event first seen. The returned release function forgets the event again,
+// for use when it could not be published so that Monzo's retry isn't
+// suppressed. Errors are logged and the event is treated as new.
+func claimDelivery(ctx context.Context, state stateStore, cfg DedupConfig, event *webhookEvent, now time.Time) (string, func()) {
+	release := func() {}
+	key := cfg.dedupKey(event)
+	if state == nil || key == "" {
+		return "", release
+	}
+
+	// The key's TTL expires it in real time. The claim time is kept with
+	// the event ID, so the window is also checked against the clock, which
+	// runs faster during an accelerated replay.
+	claim := event.ID + "@" + strconv.FormatInt(now.UnixMilli(), 10)
+	claimed, err := state.setNX(ctx, key, claim, cfg.window())
+	if err != nil {
+		logWarn("Error checking %s event %s for duplicates: %v", event.Type, event.ID, err)
+		return "", release
+	}
+	if !claimed {
+		stored, ok, err := state.get(ctx, key)
+		if err != nil || !ok {
+			return "unknown", release
+		}
+		original, claimedAt := parseDedupClaim(stored)
+		if claimedAt.IsZero() || now.Sub(claimedAt) < cfg.window() {
+			return original, release
+		}
+		if err := state.set(ctx, key, claim, cfg.window()); err != nil {
+			logWarn("Error checking %s event %s for duplicates: %v", event.Type, event.ID, err)
+			return "", release
+		}
+	}
+
+	return "", func() {
+		if err := state.del(context.Background(), key); err != nil {
+			logWarn("Error releasing dedup key for %s event %s: %v", event.Type, event.ID, err)
+		}
+	}
+}
+
+// parseDedupClaim splits a dedup key's value into the event ID and the time
+// it was claimed, which is zero for keys set before the time was kept
+func parseDedupClaim(value string) (string, time.Time) {
+	id, millis, ok := strings.Cut(value, "@")
+	if !ok {
+		return value, time.Time{}
+	}
+	claimed, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return id, time.Time{}
+	}
+	return id, time.UnixMilli(claimed)
+}
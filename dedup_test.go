@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is a minimal RESP2 server supporting the string, set, hash and
+// publish commands and scripts used by the webhook server
+type fakeRedis struct {
+	listener net.Listener
+
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]time.Duration
+	sets   map[string]map[string]bool
+	hashes map[string]map[string]string
+
+	// published are the messages published, by channel
+	published map[string][]string
+}
+
+func newFakeRedis(t *testing.T) (*fakeRedis, *redis.Client) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	r := &fakeRedis{listener: listener, values: map[string]string{}, ttls: map[string]time.Duration{}, sets: map[string]map[string]bool{}, hashes: map[string]map[string]string{}, published: map[string][]string{}}
+	go r.serve()
+
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), Protocol: 2, DisableIdentity: true})
+	t.Cleanup(func() {
+		client.Close()
+		listener.Close()
+	})
+	return r, client
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte(r.execute(args))); err != nil {
+			return
+		}
+	}
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected an array")
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(value, "\r\n")
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) execute(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := r.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		key, value := args[1], args[2]
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "EX":
+				seconds, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(seconds) * time.Second
+				i++
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, exists := r.values[key]; nx && exists {
+			return "$-1\r\n"
+		}
+		r.values[key] = value
+		r.ttls[key] = ttl
+		return "+OK\r\n"
+	case "EXISTS":
+		exists := 0
+		for _, key := range args[1:] {
+			if _, ok := r.values[key]; ok {
+				exists++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", exists)
+	case "EVALSHA":
+		// Scripts are recognised by their hash rather than interpreted
+		if args[1] == renewLeaseScript.Hash() {
+			key, identity := args[3], args[4]
+			if r.values[key] != identity {
+				return ":0\r\n"
+			}
+			ms, _ := strconv.Atoi(args[5])
+			r.ttls[key] = time.Duration(ms) * time.Millisecond
+			return ":1\r\n"
+		}
+		return "-NOSCRIPT No matching script\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := r.values[key]; ok {
+				delete(r.values, key)
+				delete(r.ttls, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SADD":
+		if r.sets[args[1]] == nil {
+			r.sets[args[1]] = map[string]bool{}
+		}
+		added := 0
+		for _, member := range args[2:] {
+			if !r.sets[args[1]][member] {
+				r.sets[args[1]][member] = true
+				added++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", added)
+	case "SREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if r.sets[args[1]][member] {
+				delete(r.sets[args[1]], member)
+				removed++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", removed)
+	case "SMEMBERS":
+		reply := fmt.Sprintf("*%d\r\n", len(r.sets[args[1]]))
+		for member := range r.sets[args[1]] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+		return reply
+	case "HSET":
+		if r.hashes[args[1]] == nil {
+			r.hashes[args[1]] = map[string]string{}
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := r.hashes[args[1]][args[i]]; !ok {
+				added++
+			}
+			r.hashes[args[1]][args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", added)
+	case "HDEL":
+		removed := 0
+		for _, field := range args[2:] {
+			if _, ok := r.hashes[args[1]][field]; ok {
+				delete(r.hashes[args[1]], field)
+				removed++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", removed)
+	case "HGETALL":
+		reply := fmt.Sprintf("*%d\r\n", 2*len(r.hashes[args[1]]))
+		for field, value := range r.hashes[args[1]] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+		}
+		return reply
+	case "PUBLISH":
+		r.published[args[1]] = append(r.published[args[1]], args[2])
+		return ":0\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	tenant := &TenantConfig{Name: "alice"}
+	tests := []struct {
+		name     string
+		event    *webhookEvent
+		expected string
+	}{
+		{
+			name:     "Transaction ID",
+			event:    &webhookEvent{Type: "transaction.created", Payload: map[string]interface{}{"data": map[string]interface{}{"id": "tx_1"}}},
+			expected: "monzo-webhook:dedup:transaction.created:tx_1",
+		},
+		{
+			name:     "Scoped to tenant",
+			event:    &webhookEvent{Type: "transaction.created", Tenant: tenant, Payload: map[string]interface{}{"data": map[string]interface{}{"id": "tx_1"}}},
+			expected: "monzo-webhook:dedup:alice:transaction.created:tx_1",
+		},
+		{
+			name:  "No data.id",
+			event: &webhookEvent{Type: "transaction.created", Payload: map[string]interface{}{"data": map[string]interface{}{}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (DedupConfig{}).dedupKey(tt.event); got != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestClaimDelivery(t *testing.T) {
+	server, client := newFakeRedis(t)
+	cfg := DedupConfig{Enabled: true, Window: "1h"}
+	payload := map[string]interface{}{"data": map[string]interface{}{"id": "tx_1"}}
+
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	first := &webhookEvent{ID: "01FIRST", Type: "transaction.created", Payload: payload}
+	original, release := claimDelivery(context.Background(), redisState{client: client}, cfg, first, now)
+	if original != "" {
+		t.Fatalf("Expected the first delivery to be new, got duplicate of '%s'", original)
+	}
+	if ttl := server.ttls["monzo-webhook:dedup:transaction.created:tx_1"]; ttl != time.Hour {
+		t.Errorf("Expected a TTL of 1h, got %v", ttl)
+	}
+
+	second := &webhookEvent{ID: "01SECOND", Type: "transaction.created", Payload: payload}
+	if original, _ := claimDelivery(context.Background(), redisState{client: client}, cfg, second, now.Add(59*time.Minute)); original != "01FIRST" {
+		t.Errorf("Expected a duplicate of '01FIRST', got '%s'", original)
+	}
+
+	// An update to the same transaction is a different event
+	update := &webhookEvent{ID: "01UPDATE", Type: "transaction.updated", Payload: payload}
+	if original, _ := claimDelivery(context.Background(), redisState{client: client}, cfg, update, now); original != "" {
+		t.Errorf("Expected transaction.updated not to be a duplicate, got '%s'", original)
+	}
+
+	// Once the window has passed by the clock, a redelivery is accepted
+	// again, even if the key hasn't expired yet
+	if original, _ := claimDelivery(context.Background(), redisState{client: client}, cfg, second, now.Add(time.Hour)); original != "" {
+		t.Errorf("Expected a delivery after the window to be accepted, got duplicate of '%s'", original)
+	}
+	if original, _ := claimDelivery(context.Background(), redisState{client: client}, cfg, first, now.Add(90*time.Minute)); original != "01SECOND" {
+		t.Errorf("Expected a duplicate of '01SECOND', got '%s'", original)
+	}
+
+	// Once released, a redelivery is accepted again
+	release()
+	if original, _ := claimDelivery(context.Background(), redisState{client: client}, cfg, second, now); original != "" {
+		t.Errorf("Expected a released delivery to be accepted, got duplicate of '%s'", original)
+	}
+
+	// Keys set without a claim time last until they expire
+	server.mu.Lock()
+	server.values["monzo-webhook:dedup:transaction.created:tx_1"] = "01OLD"
+	server.mu.Unlock()
+	if original, _ := claimDelivery(context.Background(), redisState{client: client}, cfg, second, now.Add(48*time.Hour)); original != "01OLD" {
+		t.Errorf("Expected a duplicate of '01OLD', got '%s'", original)
+	}
+}
+
+func TestWebhookHandlerDedup(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	origClient := redisClient
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+		redisClient = origClient
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+
+	basicAuthUsername, basicAuthPassword = "", ""
+	_, redisClient = newFakeRedis(t)
+	eventConfig = EventConfig{Dedup: DedupConfig{Enabled: true}}
+	sink := &fakeSink{name: "redis"}
+	sinks = []sinkEntry{{sink: sink, required: true}}
+
+	body := `{"type":"transaction.created","data":{"id":"tx_1"}}`
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		webhookHandler(rr, req)
+		return rr
+	}
+
+	// A failed publish releases the delivery so that Monzo's retry goes through
+	sink.err = errors.New("connection refused")
+	if rr := post(); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code 503, got %d", rr.Code)
+	}
+	sink.err = nil
+	if rr := post(); rr.Code != http.StatusOK || rr.Body.String() != "Webhook received" {
+		t.Fatalf("Expected the retry to be published, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	before := testutil.ToFloat64(duplicatesSuppressed.WithLabelValues("transaction.created"))
+	if rr := post(); rr.Code != http.StatusOK || rr.Body.String() != "Duplicate webhook ignored" {
+		t.Errorf("Expected the duplicate to be ignored, got %d %q", rr.Code, rr.Body.String())
+	}
+	if sink.count() != 2 {
+		t.Errorf("Expected 2 publish attempts, got %d", sink.count())
+	}
+	if got := testutil.ToFloat64(duplicatesSuppressed.WithLabelValues("transaction.created")) - before; got != 1 {
+		t.Errorf("Expected 1 suppressed duplicate, got %v", got)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// storeDeletionsSchema creates the event store's table of deletions, whose
+// events have their deletion_id set
+const storeDeletionsSchema = `CREATE TABLE IF NOT EXISTS deletions (
+  deletion_id TEXT PRIMARY KEY,
+  reason TEXT NOT NULL,
+  deleted_at TEXT NOT NULL
+)`
+
+var storeDeletions = metrics.newCounterVec("monzo_webhook_store_deletions_total",
+	"Stored events deleted and restored, by reason and action (deleted, restored).", "reason", "action")
+
+// errDeletionNotFound is returned for a deletion that doesn't exist, or has
+// been restored or purged
+var errDeletionNotFound = errors.New("deletion not found")
+
+// eventDeletion is a set of stored events deleted together, which are kept
+// until they're purged so that they can be restored
+type eventDeletion struct {
+	ID        string    `json:"id"`
+	Reason    string    `json:"reason"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+	Events    int       `json:"events"`
+}
+
+// softDelete deletes the stored events matching a query, apart from its
+// cursor and limit, keeping them until they're purged. It returns the
+// deletion, or nil if no events matched.
+func (s *eventStore) softDelete(query eventQuery, reason string, now time.Time) (*eventDeletion, error) {
+	deletion := &eventDeletion{ID: newEventID(now), Reason: reason, DeletedAt: now.UTC()}
+	deletion.PurgeAt = deletion.DeletedAt.Add(s.purgeDelay)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO deletions (deletion_id, reason, deleted_at) VALUES (?, ?, ?)`,
+		deletion.ID, reason, deletion.DeletedAt.Format(storeTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	where, args := query.sqliteWhere()
+	if query.MinAmount == nil && query.MaxAmount == nil {
+		result, err := tx.Exec(`UPDATE events SET deletion_id = ? WHERE `+where, append([]interface{}{deletion.ID}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		deleted, _ := result.RowsAffected()
+		deletion.Events = int(deleted)
+	} else if deletion.Events, err = softDeleteMatching(tx, query, deletion.ID); err != nil {
+		return nil, err
+	}
+	if deletion.Events == 0 {
+		return nil, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	storeDeletions.WithLabelValues(reason, "deleted").Add(float64(deletion.Events))
+	return deletion, nil
+}
+
+// softDeleteMatching sets the deletion of the events matching a query with
+// an amount range, which is checked on each event's body
+func softDeleteMatching(tx *sql.Tx, query eventQuery, id string) (int, error) {
+	where, args := query.sqliteWhere()
+	rows, err := tx.Query(`SELECT `+storedEventColumns+` FROM events WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	var rowids []int64
+	for rows.Next() {
+		event, err := scanStoredEvent(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if query.matches(event) {
+			rowids = append(rowids, event.Rowid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, rowid := range rowids {
+		if _, err := tx.Exec(`UPDATE events SET deletion_id = ? WHERE rowid = ?`, id, rowid); err != nil {
+			return 0, err
+		}
+	}
+	return len(rowids), nil
+}
+
+// restore restores the events of a deletion that hasn't been purged
+func (s *eventStore) restore(id string, now time.Time) (*eventDeletion, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	deletion := &eventDeletion{ID: id}
+	var deletedAt string
+	err = tx.QueryRow(`SELECT reason, deleted_at FROM deletions WHERE deletion_id = ?`, id).Scan(&deletion.Reason, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errDeletionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	deletion.DeletedAt, _ = time.Parse(storeTimeLayout, deletedAt)
+	deletion.PurgeAt = deletion.DeletedAt.Add(s.purgeDelay)
+
+	result, err := tx.Exec(`UPDATE events SET deletion_id = NULL WHERE deletion_id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM deletions WHERE deletion_id = ?`, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	restored, _ := result.RowsAffected()
+	deletion.Events = int(restored)
+	storeDeletions.WithLabelValues(deletion.Reason, "restored").Add(float64(deletion.Events))
+	return deletion, nil
+}
+
+// listDeletions returns the deletions that haven't been restored or purged,
+// oldest first
+func (s *eventStore) listDeletions() ([]eventDeletion, error) {
+	rows, err := s.db.Query(`SELECT d.deletion_id, d.reason, d.deleted_at, count(e.rowid)
+FROM deletions d LEFT JOIN events e ON e.deletion_id = d.deletion_id
+GROUP BY d.deletion_id ORDER BY d.deletion_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deletions := []eventDeletion{}
+	for rows.Next() {
+		var deletion eventDeletion
+		var deletedAt string
+		if err := rows.Scan(&deletion.ID, &deletion.Reason, &deletedAt, &deletion.Events); err != nil {
+			return nil, err
+		}
+		deletion.DeletedAt, _ = time.Parse(storeTimeLayout, deletedAt)
+		deletion.PurgeAt = deletion.DeletedAt.Add(s.purgeDelay)
+		deletions = append(deletions, deletion)
+	}
+	return deletions, rows.Err()
+}
+
+// adminDeletionsHandler lists the deletions that can be restored with GET,
+// and deletes the stored events matching the query parameters with POST,
+// such as ?account=acc_1&reason=erasure
+func adminDeletionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		deletions, err := storedEvents.listDeletions()
+		if err != nil {
+			logError("Error listing deletions: %v", err)
+			http.Error(w, "Error listing deletions", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deletions": deletions})
+	case http.MethodPost:
+		params := r.URL.Query()
+		query, err := parseEventQuery(params, 0, 0)
+		if err == nil && (params.Has("after") || params.Has("limit")) {
+			err = errors.New("after and limit can't be used to delete events")
+		}
+		if err == nil && query.From.IsZero() && query.To.IsZero() && len(query.Types) == 0 &&
+			query.AccountID == "" && query.MinAmount == nil && query.MaxAmount == nil {
+			err = errors.New("at least one of from, to, type, account, min_amount and max_amount is required")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reason := params.Get("reason")
+		if reason == "" {
+			reason = "admin"
+		}
+
+		deletion, err := storedEvents.softDelete(query, reason, clock.Now())
+		if err != nil {
+			logError("Error deleting stored events: %v", err)
+			http.Error(w, "Error deleting stored events", http.StatusServiceUnavailable)
+			return
+		}
+		if deletion == nil {
+			http.Error(w, "No stored events match", http.StatusNotFound)
+			return
+		}
+		logWarn("Deleted %d stored events as %s (reason: %s), to be purged after %s",
+			deletion.Events, deletion.ID, reason, deletion.PurgeAt.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, deletion)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminDeletionRestoreHandler restores the events of a deletion that hasn't
+// been purged
+func adminDeletionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	deletion, err := storedEvents.restore(id, clock.Now())
+	if errors.Is(err, errDeletionNotFound) {
+		http.Error(w, "Deletion not found, or already restored or purged", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("Error restoring deletion %s: %v", id, err)
+		http.Error(w, "Error restoring stored events", http.StatusServiceUnavailable)
+		return
+	}
+	logInfo("Restored %d stored events deleted as %s", deletion.Events, id)
+	writeJSON(w, http.StatusOK, deletion)
+}
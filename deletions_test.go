@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// storedIDs returns the IDs of the events a store returns
+func storedIDs(t *testing.T, store *eventStore) string {
+	t.Helper()
+	events, _, err := store.queryEvents(context.Background(), eventQuery{Limit: 100})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestEventStoreSoftDelete(t *testing.T) {
+	store := newReplayStore(t, "transaction.created", "transaction.updated", "transaction.created", "account.balance_updated")
+	now := time.Date(2024, 3, 2, 9, 0, 0, 0, time.UTC)
+
+	deletion, err := store.softDelete(eventQuery{Types: []string{"transaction.*"}}, "admin", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deletion.Events != 3 || !deletion.PurgeAt.Equal(now.Add(defaultPurgeDelay)) {
+		t.Errorf("Unexpected deletion: %+v", deletion)
+	}
+	if got := storedIDs(t, store); got != "[evt_4]" {
+		t.Errorf("Expected deleted events to be hidden, got %s", got)
+	}
+	if again, err := store.softDelete(eventQuery{Types: []string{"transaction.*"}}, "admin", now); again != nil || err != nil {
+		t.Errorf("Expected nothing left to delete, got %+v, %v", again, err)
+	}
+
+	// Deletions are kept when the store is reopened
+	reopened := &eventStore{db: store.db, purgeDelay: time.Hour}
+	if got := storedIDs(t, reopened); got != "[evt_4]" {
+		t.Errorf("Expected deleted events to stay hidden, got %s", got)
+	}
+	listed, err := reopened.listDeletions()
+	if err != nil || len(listed) != 1 || listed[0].Events != 3 || listed[0].ID != deletion.ID || listed[0].Reason != "admin" || !listed[0].PurgeAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Unexpected deletions: %+v", listed)
+	}
+
+	if restored, err := reopened.restore(deletion.ID, now); err != nil || restored.Events != 3 {
+		t.Fatalf("Expected 3 events restored, got %+v, %v", restored, err)
+	}
+	if _, err := reopened.restore(deletion.ID, now); err != errDeletionNotFound {
+		t.Errorf("Expected a restored deletion not to be found, got %v", err)
+	}
+	if got := storedIDs(t, store); got != "[evt_1 evt_2 evt_3 evt_4]" {
+		t.Errorf("Expected restored events, got %s", got)
+	}
+	if listed, _ := store.listDeletions(); len(listed) != 0 {
+		t.Errorf("Expected no deletions, got %+v", listed)
+	}
+
+	// Purged events can't be restored
+	purged, _ := store.softDelete(eventQuery{From: time.Date(2024, 3, 1, 9, 1, 0, 0, time.UTC)}, "erasure", now)
+	if events, err := store.prune(now); err != nil || events != 0 {
+		t.Errorf("Expected nothing purged before the deletion, got %d, %v", events, err)
+	}
+	events, err := store.prune(now.Add(time.Second))
+	if err != nil || events != 3 {
+		t.Errorf("Expected 3 events purged, got %d, %v", events, err)
+	}
+	if _, err := store.restore(purged.ID, now); err != errDeletionNotFound {
+		t.Errorf("Expected a purged deletion not to be found, got %v", err)
+	}
+	if listed, _ := store.listDeletions(); storedIDs(t, store) != "[evt_1]" || len(listed) != 0 {
+		t.Errorf("Expected evt_1 and no deletions, got %s and %+v", storedIDs(t, store), listed)
+	}
+}
+
+func TestAdminDeletionsHandler(t *testing.T) {
+	originalEvents := storedEvents
+	defer func() { storedEvents = originalEvents }()
+	storedEvents = newReplayStore(t, "transaction.created", "transaction.updated", "account.balance_updated")
+
+	tests := []struct {
+		name   string
+		query  string
+		expect int
+	}{
+		{name: "No filter", query: "", expect: http.StatusBadRequest},
+		{name: "Only a reason", query: "reason=oops", expect: http.StatusBadRequest},
+		{name: "Limit", query: "type=transaction.created&limit=1", expect: http.StatusBadRequest},
+		{name: "Invalid time", query: "to=yesterday", expect: http.StatusBadRequest},
+		{name: "No match", query: "account=acc_2", expect: http.StatusNotFound},
+		{name: "Deleted", query: "type=transaction.*&reason=erasure", expect: http.StatusOK},
+	}
+	var deletion eventDeletion
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminDeletionsHandler(w, httptest.NewRequest(http.MethodPost, "/admin/deletions?"+tt.query, nil))
+			if w.Code != tt.expect {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expect, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK {
+				json.Unmarshal(w.Body.Bytes(), &deletion)
+			}
+		})
+	}
+	if deletion.Events != 2 || deletion.Reason != "erasure" {
+		t.Fatalf("Unexpected deletion: %+v", deletion)
+	}
+
+	w := httptest.NewRecorder()
+	adminDeletionsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/deletions", nil))
+	var listed struct {
+		Deletions []eventDeletion `json:"deletions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed.Deletions) != 1 || listed.Deletions[0].ID != deletion.ID {
+		t.Errorf("Expected the deletion to be listed, got %s", w.Body.String())
+	}
+
+	for _, expect := range []int{http.StatusOK, http.StatusNotFound} {
+		r := httptest.NewRequest(http.MethodPost, "/admin/deletions/"+deletion.ID+"/restore", nil)
+		r.SetPathValue("id", deletion.ID)
+		w := httptest.NewRecorder()
+		adminDeletionRestoreHandler(w, r)
+		if w.Code != expect {
+			t.Errorf("Expected status %d, got %d: %s", expect, w.Code, w.Body.String())
+		}
+	}
+	if got := storedIDs(t, storedEvents); got != "[evt_1 evt_2 evt_3]" {
+		t.Errorf("Expected every event after restoring, got %s", got)
+	}
+}
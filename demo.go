@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DemoScenario is a synthetic event published on a schedule when DEMO_MODE
+// is on. It runs either every interval, or at a time of day on given days.
+type DemoScenario struct {
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Every string          `json:"every"`
+	At    string          `json:"at"`
+	Days  []string        `json:"days"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// demoWeekdays maps day names accepted in a scenario's days to weekdays
+var demoWeekdays = map[string][]time.Weekday{
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"sun":      {time.Sunday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// validateDemoScenarios checks the demo scenarios for missing or invalid values
+func validateDemoScenarios(scenarios []DemoScenario) error {
+	for i, s := range scenarios {
+		if s.Name == "" {
+			return fmt.Errorf("demo scenario %d: name is required", i+1)
+		}
+		if (s.Every == "") == (s.At == "") {
+			return fmt.Errorf("demo scenario '%s': exactly one of every and at must be set", s.Name)
+		}
+		if s.Every != "" {
+			if _, err := parsePositiveDuration(s.Every, 0); err != nil {
+				return fmt.Errorf("demo scenario '%s': invalid every: %w", s.Name, err)
+			}
+			if len(s.Days) > 0 {
+				return fmt.Errorf("demo scenario '%s': days can only be used with at", s.Name)
+			}
+		}
+		if s.At != "" {
+			if _, err := time.Parse("15:04", s.At); err != nil {
+				return fmt.Errorf("demo scenario '%s': at must be HH:MM", s.Name)
+			}
+		}
+		if _, err := s.weekdays(); err != nil {
+			return fmt.Errorf("demo scenario '%s': %w", s.Name, err)
+		}
+		if len(s.Data) > 0 {
+			var data map[string]interface{}
+			if err := json.Unmarshal(s.Data, &data); err != nil {
+				return fmt.Errorf("demo scenario '%s': data must be a JSON object", s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// eventType returns the scenario's event type, defaulting to transaction.created
+func (s DemoScenario) eventType() string {
+	if s.Type == "" {
+		return "transaction.created"
+	}
+	return s.Type
+}
+
+// weekdays returns the days the scenario runs on, defaulting to every day
+func (s DemoScenario) weekdays() (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, name := range s.Days {
+		weekdays, ok := demoWeekdays[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day '%s'", name)
+		}
+		for _, day := range weekdays {
+			days[day] = true
+		}
+	}
+	if len(days) == 0 {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			days[day] = true
+		}
+	}
+	return days, nil
+}
+
+// next returns when the scenario should next run after now
+func (s DemoScenario) next(now time.Time) time.Time {
+	if s.Every != "" {
+		every, _ := parsePositiveDuration(s.Every, 0)
+		return now.Add(every)
+	}
+
+	at, _ := time.Parse("15:04", s.At)
+	days, _ := s.weekdays()
+	for i := 0; i <= 7; i++ {
+		day := now.AddDate(0, 0, i)
+		run := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+		if run.After(now) && days[run.Weekday()] {
+			return run
+		}
+	}
+	return time.Time{}
+}
+
+// payload builds a webhook body for the scenario, filling in the transaction
+// ID, creation time and account ID unless the scenario's data sets them
+func (s DemoScenario) payload(id string, now time.Time) ([]byte, error) {
+	data := make(map[string]interface{})
+	if len(s.Data) > 0 {
+		if err := json.Unmarshal(s.Data, &data); err != nil {
+			return nil, err
+		}
+	}
+	defaults := map[string]interface{}{
+		"id":         "tx_demo_" + id,
+		"created":    now.UTC().Format(time.RFC3339),
+		"account_id": "acc_demo",
+	}
+	for key, value := range defaults {
+		if _, ok := data[key]; !ok {
+			data[key] = value
+		}
+	}
+	return json.Marshal(map[string]interface{}{"type": s.eventType(), "data": data})
+}
+
+// publishDemoEvent publishes one synthetic event through the same pipeline as
+// received webhooks
+func publishDemoEvent(s DemoScenario, now time.Time) error {
+	body, err := s.payload(newEventID(now), now)
+	if err != nil {
+		return err
+	}
+	logInfo("Publishing demo event for scenario '%s'", s.Name)
+	return publishGeneratedEvent(s.eventType(), body, "demo "+s.Name)
+}
+
+// runDemoScenarios publishes each scenario's events on its schedule until ctx
+// is cancelled
+func runDemoScenarios(ctx context.Context, scenarios []DemoScenario) {
+	nextRuns := make([]time.Time, len(scenarios))
+	for i, s := range scenarios {
+		nextRuns[i] = s.next(clock.Now())
+		logInfo("Demo scenario '%s' first runs at %s", s.Name, nextRuns[i].Format(time.RFC3339))
+	}
+
+	for {
+		soonest := 0
+		for i := range nextRuns {
+			if nextRuns[i].Before(nextRuns[soonest]) {
+				soonest = i
+			}
+		}
+
+		if sleepUntil(ctx, clock, nextRuns[soonest]) != nil {
+			return
+		}
+
+		s := scenarios[soonest]
+		if err := publishDemoEvent(s, clock.Now()); err != nil {
+			logError("Error publishing demo event for scenario '%s': %v", s.Name, err)
+		}
+		nextRuns[soonest] = s.next(clock.Now())
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestValidateDemoScenarios(t *testing.T) {
+	tests := []struct {
+		name        string
+		scenario    DemoScenario
+		expectError bool
+	}{
+		{name: "Daily time", scenario: DemoScenario{Name: "coffee", At: "08:30", Days: []string{"weekdays"}}},
+		{name: "Interval", scenario: DemoScenario{Name: "tick", Every: "15m"}},
+		{name: "Missing name", scenario: DemoScenario{Every: "15m"}, expectError: true},
+		{name: "Neither every nor at", scenario: DemoScenario{Name: "coffee"}, expectError: true},
+		{name: "Both every and at", scenario: DemoScenario{Name: "coffee", Every: "1h", At: "08:30"}, expectError: true},
+		{name: "Invalid time", scenario: DemoScenario{Name: "coffee", At: "8.30am"}, expectError: true},
+		{name: "Unknown day", scenario: DemoScenario{Name: "coffee", At: "08:30", Days: []string{"someday"}}, expectError: true},
+		{name: "Days with interval", scenario: DemoScenario{Name: "tick", Every: "1h", Days: []string{"mon"}}, expectError: true},
+		{name: "Data not an object", scenario: DemoScenario{Name: "tick", Every: "1h", Data: json.RawMessage(`[1]`)}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDemoScenarios([]DemoScenario{tt.scenario})
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDemoScenarioNext(t *testing.T) {
+	// 2026-01-23 is a Friday
+	friday := func(hour, minute int) time.Time { return time.Date(2026, 1, 23, hour, minute, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		scenario DemoScenario
+		now      time.Time
+		expected time.Time
+	}{
+		{name: "Later today", scenario: DemoScenario{At: "08:30", Days: []string{"weekdays"}}, now: friday(8, 0), expected: friday(8, 30)},
+		{name: "Skips the weekend", scenario: DemoScenario{At: "08:30", Days: []string{"weekdays"}}, now: friday(9, 0), expected: time.Date(2026, 1, 26, 8, 30, 0, 0, time.UTC)},
+		{name: "Every day by default", scenario: DemoScenario{At: "08:30"}, now: friday(8, 30), expected: time.Date(2026, 1, 24, 8, 30, 0, 0, time.UTC)},
+		{name: "Single day", scenario: DemoScenario{At: "18:00", Days: []string{"Wed"}}, now: friday(9, 0), expected: time.Date(2026, 1, 28, 18, 0, 0, 0, time.UTC)},
+		{name: "Interval", scenario: DemoScenario{Every: "15m"}, now: friday(9, 0), expected: friday(9, 15)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scenario.next(tt.now); !got.Equal(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPublishDemoEvent(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+	}()
+
+	eventConfig = EventConfig{}
+	sink := &fakeSink{name: "redis"}
+	sinks = []sinkEntry{{sink: sink, required: true}}
+
+	scenario := DemoScenario{
+		Name:  "coffee",
+		Every: "1h",
+		Data:  json.RawMessage(`{"amount":-350,"currency":"GBP","merchant":{"name":"Coffee Shop"},"account_id":"acc_123"}`),
+	}
+	if err := publishDemoEvent(scenario, time.Now()); err != nil {
+		t.Fatalf("publishDemoEvent failed: %v", err)
+	}
+	if sink.count() != 1 {
+		t.Fatalf("Expected 1 published event, got %d", sink.count())
+	}
+
+	event := sink.events[0]
+	if event.Type != "transaction.created" || event.AccountID != "acc_123" || event.ID == "" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+	data := event.Payload["data"].(map[string]interface{})
+	if id, _ := data["id"].(string); len(id) != len("tx_demo_")+26 {
+		t.Errorf("Expected a generated transaction ID, got '%v'", data["id"])
+	}
+	if data["amount"] != float64(-350) || data["created"] == nil {
+		t.Errorf("Unexpected data: %v", data)
+	}
+}
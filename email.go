@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultEmailBatch is how long an email sink collects events before sending
+// them in one email when no batch window is configured
+const defaultEmailBatch = time.Minute
+
+// emailMaxEvents is the most events listed in one email. Events beyond it
+// are counted but not listed, so a flood of events sends one short email.
+const emailMaxEvents = 50
+
+// emailTimeout limits connecting to the SMTP server and sending an email
+const emailTimeout = 30 * time.Second
+
+const defaultEmailSubject = `{{if eq .Count 1}}Monzo {{(index .Events 0).Type}}{{else}}{{.Count}} Monzo events{{end}}`
+
+const defaultEmailBody = `{{range .Events}}- {{.Type}} at {{.Received.Format "2006-01-02 15:04:05 MST"}}` +
+	`{{if .Data.description}}: {{.Data.description}}{{end}}` +
+	`{{if .Data.amount}} ({{money .Data.amount .Data.currency}}){{end}}` +
+	`{{if .Data.decline_reason}}, declined: {{.Data.decline_reason}}{{end}}
+{{end}}{{if .Omitted}}...and {{.Omitted}} more
+{{end}}`
+
+var emailsSent = metrics.newCounterVec("monzo_webhook_emails_sent_total",
+	"Emails sent by email sinks, by sink and result (success, error).", "sink", "result")
+
+// SMTPConfig holds the SMTP server email sinks send through
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// smtpConfigFromEnv builds an SMTPConfig from environment variables. It
+// returns nil if SMTP_HOST is not set.
+func smtpConfigFromEnv() (*SMTPConfig, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	password, err := getenvSecret("SMTP_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	cfg := &SMTPConfig{
+		Host:     host,
+		Port:     587,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: password,
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		cfg.Port, err = strconv.Atoi(port)
+		if err != nil || cfg.Port <= 0 || cfg.Port > 65535 {
+			return nil, fmt.Errorf("invalid SMTP_PORT '%s'", port)
+		}
+	}
+	if cfg.From == "" {
+		return nil, errors.New("SMTP_FROM must be set when SMTP_HOST is configured")
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return nil, errors.New("SMTP_USERNAME and SMTP_PASSWORD must be set together")
+	}
+	return cfg, nil
+}
+
+// dial connects to the SMTP server, over TLS from the start on port 465 and
+// upgrading with STARTTLS elsewhere when the server offers it, and logs in
+// if a username is set
+func (c *SMTPConfig) dial(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	tlsConfig := &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+	var conn net.Conn
+	var err error
+	if c.Port == 465 {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.Port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+	if c.Username != "" {
+		// PlainAuth refuses to send the password unencrypted to anything
+		// but localhost
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// send sends a plain text email to the recipients
+func (c *SMTPConfig) send(ctx context.Context, to []string, subject, body string) error {
+	client, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	from, _ := mail.ParseAddress(c.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		address, _ := mail.ParseAddress(recipient)
+		if err := client.Rcpt(address.Address); err != nil {
+			return fmt.Errorf("recipient %s: %w", address.Address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(emailMessage(c.From, to, subject, body, clock.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// emailMessage builds a plain text message with CRLF line endings
+func emailMessage(from string, to []string, subject, body string, date time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// emailEvent is an event as email templates see it. Data is the payload's
+// data object, such as a transaction.
+type emailEvent struct {
+	ID        string
+	Type      string
+	AccountID string
+	Tenant    string
+	Received  time.Time
+	Data      map[string]interface{}
+}
+
+// emailData is what an email's subject and body templates are executed with.
+// Count includes the events beyond the most an email lists, which are
+// counted in Omitted.
+type emailData struct {
+	Sink    string
+	Events  []emailEvent
+	Count   int
+	Omitted int
+}
+
+var emailFuncs = template.FuncMap{
+	// money formats an amount in minor units with its currency, such as
+	// "-12.50 GBP"
+	"money": func(amount, currency interface{}) string {
+		var minor int64
+		switch v := amount.(type) {
+		case float64:
+			minor = int64(v)
+		case int64:
+			minor = v
+		case int:
+			minor = int64(v)
+		}
+		if currency, ok := currency.(string); ok && currency != "" {
+			return formatMinorUnits(minor, currency) + " " + currency
+		}
+		return formatMinorUnits(minor, "")
+	},
+}
+
+// parseEmailTemplates parses a sink's subject and body templates, or the
+// defaults for those that aren't set
+func parseEmailTemplates(cfg SinkConfig) (*template.Template, *template.Template, error) {
+	subject, body := cfg.Subject, cfg.Template
+	if subject == "" {
+		subject = defaultEmailSubject
+	}
+	if body == "" {
+		body = defaultEmailBody
+	}
+	subjectTemplate, err := template.New("subject").Funcs(emailFuncs).Parse(subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subject: %w", err)
+	}
+	bodyTemplate, err := template.New("template").Funcs(emailFuncs).Parse(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return subjectTemplate, bodyTemplate, nil
+}
+
+// validateEmailSink checks an email sink's recipients, templates and batch
+// window
+func validateEmailSink(cfg SinkConfig) error {
+	if len(cfg.To) == 0 {
+		return errors.New("email sinks must have recipients in to")
+	}
+	for _, recipient := range cfg.To {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			return fmt.Errorf("invalid recipient '%s': %w", recipient, err)
+		}
+	}
+	if _, _, err := parseEmailTemplates(cfg); err != nil {
+		return err
+	}
+	if _, err := parsePositiveDuration(cfg.Batch, defaultEmailBatch); err != nil {
+		return fmt.Errorf("invalid batch '%s': %w", cfg.Batch, err)
+	}
+	return nil
+}
+
+// emailSink sends templated emails for events. Events are collected for a
+// batch window after the first one and sent together, so a burst of events
+// sends one email rather than flooding the recipients.
+type emailSink struct {
+	name    string
+	smtp    *SMTPConfig
+	to      []string
+	subject *template.Template
+	body    *template.Template
+	batch   time.Duration
+	cancel  context.CancelFunc
+	// wake is signalled when an event starts a batch
+	wake chan struct{}
+
+	mu      sync.Mutex
+	pending []emailEvent
+	// omitted counts the pending events beyond the most an email lists
+	omitted int
+	started time.Time
+}
+
+// newEmailSink creates an email sink sending through the SMTP server, and
+// starts sending its batches
+func newEmailSink(name string, cfg SinkConfig, smtpConfig *SMTPConfig) (*emailSink, error) {
+	if smtpConfig == nil {
+		return nil, fmt.Errorf("SMTP_HOST must be set to send email")
+	}
+	subject, body, err := parseEmailTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := parsePositiveDuration(cfg.Batch, defaultEmailBatch)
+	if err != nil {
+		return nil, err
+	}
+	s := &emailSink{
+		name:    name,
+		smtp:    smtpConfig,
+		to:      cfg.To,
+		subject: subject,
+		body:    body,
+		batch:   batch,
+		wake:    make(chan struct{}, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *emailSink) Name() string { return s.name }
+
+// Publish adds an event to the current batch, starting one if there isn't
+// one. Events are sent when the batch window ends.
+func (s *emailSink) Publish(ctx context.Context, event *webhookEvent) error {
+	e := emailEvent{ID: event.ID, Type: event.Type, AccountID: event.AccountID, Received: event.Received}
+	if event.Tenant != nil {
+		e.Tenant = event.Tenant.Name
+	}
+	e.Data, _ = event.Payload["data"].(map[string]interface{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 && s.omitted == 0 {
+		s.started = clock.Now()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	if len(s.pending) < emailMaxEvents {
+		s.pending = append(s.pending, e)
+	} else {
+		s.omitted++
+	}
+	return nil
+}
+
+// run sends each batch when its window ends, until ctx is cancelled
+func (s *emailSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+		s.mu.Lock()
+		due := s.started.Add(s.batch)
+		s.mu.Unlock()
+		if sleepUntil(ctx, clock, due) != nil {
+			return
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, emailTimeout)
+		s.flush(sendCtx)
+		cancel()
+	}
+}
+
+// flush sends the pending events in one email. Events that fail to send
+// start the next batch, so they're sent with it.
+func (s *emailSink) flush(ctx context.Context) {
+	s.mu.Lock()
+	data := emailData{Sink: s.name, Events: s.pending, Count: len(s.pending) + s.omitted, Omitted: s.omitted}
+	s.pending, s.omitted = nil, 0
+	s.mu.Unlock()
+	if data.Count == 0 {
+		return
+	}
+
+	subject, body, err := s.render(data)
+	if err != nil {
+		// Rendering the same events again would fail again
+		logError("Error rendering email for %d events from sink '%s', dropping them: %v", data.Count, s.name, err)
+		emailsSent.WithLabelValues(s.name, "error").Inc()
+		return
+	}
+	err = s.smtp.send(ctx, s.to, subject, body)
+	if err == nil {
+		logInfo("Sent email for %d events from sink '%s'", data.Count, s.name)
+		emailsSent.WithLabelValues(s.name, "success").Inc()
+		return
+	}
+	logError("Error sending email for %d events from sink '%s': %v", data.Count, s.name, err)
+	emailsSent.WithLabelValues(s.name, "error").Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := append(data.Events, s.pending...)
+	omitted := data.Omitted + s.omitted
+	if len(events) > emailMaxEvents {
+		omitted += len(events) - emailMaxEvents
+		events = events[:emailMaxEvents]
+	}
+	if len(s.pending) == 0 && s.omitted == 0 {
+		s.started = clock.Now()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	s.pending, s.omitted = events, omitted
+}
+
+// render executes the subject and body templates for a batch
+func (s *emailSink) render(data emailData) (string, string, error) {
+	var subject, body strings.Builder
+	if err := s.subject.Execute(&subject, data); err != nil {
+		return "", "", fmt.Errorf("subject: %w", err)
+	}
+	if err := s.body.Execute(&body, data); err != nil {
+		return "", "", fmt.Errorf("template: %w", err)
+	}
+	// Header values can't span lines
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
+
+// warm checks that the SMTP server can be reached and logged in to
+func (s *emailSink) warm(ctx context.Context) error {
+	client, err := s.smtp.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Quit()
+}
+
+// Close stops the sink and sends the events of the current batch
+func (s *emailSink) Close() error {
+	s.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+	defer cancel()
+	s.flush(ctx)
+	return nil
+}
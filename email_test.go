@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSMTPServer accepts emails over plain SMTP, keeping each message, or
+// refuses them while reject is set
+type fakeSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	reject   bool
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch command {
+		case "EHLO", "HELO":
+			fmt.Fprint(conn, "250-localhost\r\n250 8BITMIME\r\n")
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.reject
+			s.mu.Unlock()
+			if reject {
+				fmt.Fprint(conn, "550 Mailbox unavailable\r\n")
+			} else {
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		case "DATA":
+			fmt.Fprint(conn, "354 Go ahead\r\n")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			s.mu.Unlock()
+			fmt.Fprint(conn, "250 OK\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 OK\r\n")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) config() *SMTPConfig {
+	return &SMTPConfig{Host: "127.0.0.1", Port: s.listener.Addr().(*net.TCPAddr).Port, From: "Monzo Webhook <alerts@example.com>"}
+}
+
+func (s *fakeSMTPServer) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func TestValidateEmailSinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    SinkConfig
+		hasErr bool
+	}{
+		{name: "Valid", cfg: SinkConfig{Type: "email", To: []string{"Sam <sam@example.com>"}, Batch: "5m",
+			Subject: "Declined: {{(index .Events 0).Data.description}}"}},
+		{name: "No recipients", cfg: SinkConfig{Type: "email"}, hasErr: true},
+		{name: "Invalid recipient", cfg: SinkConfig{Type: "email", To: []string{"sam"}}, hasErr: true},
+		{name: "Invalid template", cfg: SinkConfig{Type: "email", To: []string{"sam@example.com"}, Template: "{{range .Events}}"}, hasErr: true},
+		{name: "Unknown function", cfg: SinkConfig{Type: "email", To: []string{"sam@example.com"}, Subject: "{{pounds .Count}}"}, hasErr: true},
+		{name: "Invalid batch", cfg: SinkConfig{Type: "email", To: []string{"sam@example.com"}, Batch: "0s"}, hasErr: true},
+		{name: "Chained", cfg: SinkConfig{Type: "email", To: []string{"sam@example.com"}, Chain: true}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSinks([]SinkConfig{tt.cfg}); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+func TestSMTPConfigFromEnv(t *testing.T) {
+	if cfg, err := smtpConfigFromEnv(); cfg != nil || err != nil {
+		t.Fatalf("Expected no config without SMTP_HOST, got %+v, %v", cfg, err)
+	}
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	if _, err := smtpConfigFromEnv(); err == nil {
+		t.Error("Expected an error without SMTP_FROM")
+	}
+	t.Setenv("SMTP_FROM", "alerts@example.com")
+	t.Setenv("SMTP_USERNAME", "alerts")
+	if _, err := smtpConfigFromEnv(); err == nil {
+		t.Error("Expected an error with a username but no password")
+	}
+	t.Setenv("SMTP_PASSWORD", "secret")
+	t.Setenv("SMTP_PORT", "465")
+	cfg, err := smtpConfigFromEnv()
+	if err != nil || cfg.Port != 465 || cfg.Password != "secret" {
+		t.Errorf("Unexpected config %+v, %v", cfg, err)
+	}
+}
+
+func TestEmailSinkBatches(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	sink, err := newEmailSink("alerts", SinkConfig{To: []string{"sam@example.com"}, Batch: "1h"}, server.config())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sink.Close()
+
+	received := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	declined := &webhookEvent{ID: "evt_1", Type: "transaction.created", Received: received, Payload: map[string]interface{}{
+		"data": map[string]interface{}{"description": "COFFEE SHOP", "amount": float64(-350), "currency": "GBP", "decline_reason": "INSUFFICIENT_FUNDS"},
+	}}
+	sink.Publish(context.Background(), declined)
+	sink.flush(context.Background())
+	sent := server.sent()
+	if len(sent) != 1 || !strings.Contains(sent[0], "Subject: Monzo transaction.created\r\n") ||
+		!strings.Contains(sent[0], "- transaction.created at 2024-03-01 09:30:00 UTC: COFFEE SHOP (-3.50 GBP), declined: INSUFFICIENT_FUNDS\r\n") {
+		t.Fatalf("Unexpected email: %q", sent)
+	}
+
+	// A flood of events sends one email listing the first of them
+	for i := 0; i < emailMaxEvents+5; i++ {
+		sink.Publish(context.Background(), &webhookEvent{ID: fmt.Sprintf("evt_%d", i), Type: "account.balance_updated", Received: received})
+	}
+	sink.flush(context.Background())
+	sent = server.sent()
+	if len(sent) != 2 || !strings.Contains(sent[1], fmt.Sprintf("Subject: %d Monzo events", emailMaxEvents+5)) ||
+		strings.Count(sent[1], "- account.balance_updated") != emailMaxEvents || !strings.Contains(sent[1], "...and 5 more") {
+		t.Fatalf("Unexpected email: %q", sent[len(sent)-1])
+	}
+
+	// Events that fail to send are sent with the next batch
+	server.mu.Lock()
+	server.reject = true
+	server.mu.Unlock()
+	sink.Publish(context.Background(), declined)
+	sink.flush(context.Background())
+	server.mu.Lock()
+	server.reject = false
+	server.mu.Unlock()
+	sink.Publish(context.Background(), declined)
+	sink.flush(context.Background())
+	sent = server.sent()
+	if len(sent) != 3 || !strings.Contains(sent[2], "Subject: 2 Monzo events") {
+		t.Fatalf("Expected the failed event to be sent again, got %q", sent[len(sent)-1])
+	}
+	if testutil.ToFloat64(emailsSent.WithLabelValues("alerts", "error")) != 1 || testutil.ToFloat64(emailsSent.WithLabelValues("alerts", "success")) != 3 {
+		t.Errorf("Unexpected emails counted: %v errors, %v sent", testutil.ToFloat64(emailsSent.WithLabelValues("alerts", "error")), testutil.ToFloat64(emailsSent.WithLabelValues("alerts", "success")))
+	}
+}
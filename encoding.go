@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings of webhook bodies that weren't sent as plain UTF-8, as flagged
+// on their events
+const (
+	encodingUTF8BOM     = "utf-8-bom"
+	encodingUTF16LE     = "utf-16le"
+	encodingUTF16BE     = "utf-16be"
+	encodingLatin1      = "iso-8859-1"
+	encodingWindows1252 = "windows-1252"
+	encodingInvalidUTF8 = "invalid-utf-8"
+)
+
+var bodyEncodings = metrics.newCounterVec("monzo_webhook_body_encodings_total",
+	"Webhook bodies that weren't plain UTF-8 and were converted, by the encoding they were in.", "encoding")
+
+// windows1252 maps the bytes 0x80 to 0x9F of Windows-1252 to the characters
+// they stand for. Bytes it leaves undefined map to the C1 control character
+// of the same value, as they do in ISO-8859-1, so that every byte maps to a
+// different character and nothing is lost.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// decodeBodyEncoding returns a webhook body as UTF-8, and the encoding it
+// was in when it wasn't plain UTF-8, since proxies occasionally change it.
+// UTF-16 is recognised by its byte order mark, its Content-Type charset or
+// the zero bytes around the opening brace. In a body that isn't valid UTF-8,
+// valid characters are kept and each other byte is read as Windows-1252, of
+// which ISO-8859-1 is a subset, so the original bytes can still be told apart.
+func decodeBodyEncoding(body []byte, contentType string) ([]byte, string) {
+	var charset string
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		charset = strings.ToLower(params["charset"])
+	}
+
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return body[3:], encodingUTF8BOM
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return decodeUTF16(body[2:], binary.LittleEndian), encodingUTF16LE
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return decodeUTF16(body[2:], binary.BigEndian), encodingUTF16BE
+	case charset == "utf-16le" || bytes.HasPrefix(body, []byte{'{', 0}):
+		return decodeUTF16(body, binary.LittleEndian), encodingUTF16LE
+	case charset == "utf-16be" || charset == "utf-16" || bytes.HasPrefix(body, []byte{0, '{'}):
+		return decodeUTF16(body, binary.BigEndian), encodingUTF16BE
+	}
+
+	// A body that's valid UTF-8 is taken as it is, even if it's labelled
+	// as something else
+	if utf8.Valid(body) {
+		return body, ""
+	}
+	encoding := encodingInvalidUTF8
+	switch charset {
+	case "iso-8859-1", "latin1", "latin-1":
+		encoding = encodingLatin1
+	case "windows-1252", "cp1252":
+		encoding = encodingWindows1252
+	}
+
+	decoded := make([]byte, 0, len(body)+len(body)/2)
+	for len(body) > 0 {
+		r, size := utf8.DecodeRune(body)
+		if r == utf8.RuneError && size == 1 {
+			r = rune(body[0])
+			if r >= 0x80 && r < 0xA0 {
+				r = windows1252[r-0x80]
+			}
+		}
+		decoded = utf8.AppendRune(decoded, r)
+		body = body[size:]
+	}
+	return decoded, encoding
+}
+
+// utf8Body converts a received webhook body to UTF-8, counting and logging
+// bodies that weren't. It returns the encoding they were in.
+func utf8Body(r *http.Request, body []byte) ([]byte, string) {
+	decoded, encoding := decodeBodyEncoding(body, r.Header.Get("Content-Type"))
+	if encoding != "" {
+		bodyEncodings.WithLabelValues(encoding).Inc()
+		logWarn("Received a webhook body encoded as %s - converted it to UTF-8", encoding)
+	}
+	return decoded, encoding
+}
+
+// decodeStoredBody converts a body kept as it was received back to UTF-8,
+// given the encoding it was flagged with
+func decodeStoredBody(body []byte, encoding string) []byte {
+	if encoding == "" {
+		return body
+	}
+	decoded, _ := decodeBodyEncoding(body, "application/json; charset="+encoding)
+	return decoded
+}
+
+// decodeUTF16 converts UTF-16 to UTF-8. A trailing odd byte is dropped.
+func decodeUTF16(body []byte, order binary.ByteOrder) []byte {
+	units := make([]uint16, len(body)/2)
+	for i := range units {
+		units[i] = order.Uint16(body[2*i:])
+	}
+	decoded := []byte(string(utf16.Decode(units)))
+	return bytes.TrimPrefix(decoded, []byte("\uFEFF"))
+}
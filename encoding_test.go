@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16Body encodes s as UTF-16 in the given byte order, after prefix
+func utf16Body(prefix []byte, s string, order binary.AppendByteOrder) []byte {
+	body := append([]byte{}, prefix...)
+	for _, unit := range utf16.Encode([]rune(s)) {
+		body = order.AppendUint16(body, unit)
+	}
+	return body
+}
+
+func TestDecodeBodyEncoding(t *testing.T) {
+	const body = `{"type":"transaction.created","data":{"description":"Café – £5"}}`
+	tests := []struct {
+		name           string
+		body           []byte
+		contentType    string
+		expect         string
+		expectEncoding string
+	}{
+		{name: "UTF-8", body: []byte(body), contentType: "application/json", expect: body},
+		{name: "UTF-8 labelled as Latin-1", body: []byte(body), contentType: "application/json; charset=ISO-8859-1", expect: body},
+		{name: "UTF-8 with a byte order mark", body: append([]byte{0xEF, 0xBB, 0xBF}, body...), expect: body, expectEncoding: "utf-8-bom"},
+		{name: "UTF-16LE with a byte order mark", body: utf16Body([]byte{0xFF, 0xFE}, body, binary.LittleEndian), expect: body, expectEncoding: "utf-16le"},
+		{name: "UTF-16BE with a byte order mark", body: utf16Body([]byte{0xFE, 0xFF}, body, binary.BigEndian), expect: body, expectEncoding: "utf-16be"},
+		{name: "UTF-16LE without a byte order mark", body: utf16Body(nil, body, binary.LittleEndian), expect: body, expectEncoding: "utf-16le"},
+		{name: "UTF-16 by charset", body: utf16Body(nil, body, binary.BigEndian), contentType: "application/json; charset=utf-16", expect: body, expectEncoding: "utf-16be"},
+		{
+			name:           "Latin-1",
+			body:           []byte("{\"description\":\"Caf\xe9 \xa35\"}"),
+			contentType:    "application/json; charset=latin1",
+			expect:         `{"description":"Café £5"}`,
+			expectEncoding: "iso-8859-1",
+		},
+		{
+			name:           "Windows-1252",
+			body:           []byte("{\"description\":\"\x93Caf\xe9\x94 \x80\x81\"}"),
+			contentType:    "application/json; charset=windows-1252",
+			expect:         "{\"description\":\"“Café” €\u0081\"}",
+			expectEncoding: "windows-1252",
+		},
+		{
+			name:           "Invalid UTF-8 mixed with valid",
+			body:           []byte("{\"description\":\"Café \xa35\"}"),
+			expect:         `{"description":"Café £5"}`,
+			expectEncoding: "invalid-utf-8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, encoding := decodeBodyEncoding(tt.body, tt.contentType)
+			if string(decoded) != tt.expect || encoding != tt.expectEncoding {
+				t.Errorf("Expected %s (%q), got %s (%q)", tt.expect, tt.expectEncoding, decoded, encoding)
+			}
+			if stored := decodeStoredBody(tt.body, encoding); string(stored) != tt.expect {
+				t.Errorf("Expected the stored body to decode to %s, got %s", tt.expect, stored)
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerEncodings(t *testing.T) {
+	origConfig, origSinks, origStore := eventConfig, sinks, storedEvents
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		eventConfig, sinks, storedEvents = origConfig, origSinks, origStore
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+
+	basicAuthUsername, basicAuthPassword = "", ""
+	eventConfig = EventConfig{SinkProfiles: map[string]string{"encoded-envelope": "envelope"}}
+	raw := &fakeSink{name: "encoded-raw"}
+	envelope := &fakeSink{name: "encoded-envelope"}
+	sinks = []sinkEntry{{sink: raw}, {sink: envelope}}
+	store, err := openEventStore(StoreConfig{Path: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.db.Close()
+	storedEvents = store
+
+	body := utf16Body([]byte{0xFF, 0xFE}, `{"type":"transaction.created","data":{"id":"tx_1","description":"Café"}}`, binary.LittleEndian)
+	w := httptest.NewRecorder()
+	webhookHandler(w, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the UTF-16 body to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if raw.count() != 1 || string(raw.events[0].Body) != `{"type":"transaction.created","data":{"id":"tx_1","description":"Café"}}` {
+		t.Fatalf("Expected the body to be published as UTF-8, got %v", raw.events)
+	}
+	if got := raw.events[0].Encoding; got != "utf-16le" {
+		t.Errorf("Expected the event to be flagged as utf-16le, got %q", got)
+	}
+	if envelope.count() != 1 || !bytes.Contains(envelope.events[0].Body, []byte(`"encoding":"utf-16le"`)) {
+		t.Errorf("Expected the envelope to flag the encoding, got %v", envelope.events)
+	}
+
+	var stored []storedEvent
+	store.each(func(event storedEvent) error {
+		stored = append(stored, event)
+		return nil
+	})
+	if len(stored) != 1 || !bytes.Equal(stored[0].RawBody, body) || string(stored[0].Body) != string(raw.events[0].Body) {
+		t.Errorf("Expected the raw body to be stored and read back as UTF-8, got %+v", stored)
+	}
+}
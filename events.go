@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultEventsLimit and maxEventsLimit bound the events returned by one
+// request to the query API
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// eventQuery selects stored events: those received in [From, To) of any of
+// Types, for AccountID, with an amount in [MinAmount, MaxAmount], after the
+// cursor a previous query stopped at. Unset fields match every event.
+type eventQuery struct {
+	From      time.Time
+	To        time.Time
+	Types     []string
+	AccountID string
+	MinAmount *int64
+	MaxAmount *int64
+	After     string
+	Limit     int
+}
+
+// matches reports whether a stored event is selected by the query, apart
+// from its cursor
+func (q eventQuery) matches(event storedEvent) bool {
+	switch {
+	case !q.From.IsZero() && event.ReceivedAt.Before(q.From),
+		!q.To.IsZero() && !event.ReceivedAt.Before(q.To),
+		!(EventTypeFilter{Allow: q.Types}).allows(event.Type),
+		q.AccountID != "" && event.AccountID != q.AccountID:
+		return false
+	}
+	if q.MinAmount == nil && q.MaxAmount == nil {
+		return true
+	}
+	var payload struct {
+		Data struct {
+			Amount *int64 `json:"amount"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(event.Body, &payload) != nil || payload.Data.Amount == nil {
+		return false
+	}
+	amount := *payload.Data.Amount
+	return (q.MinAmount == nil || amount >= *q.MinAmount) && (q.MaxAmount == nil || amount <= *q.MaxAmount)
+}
+
+// errInvalidEventCursor is returned for an after cursor that a source didn't
+// return
+var errInvalidEventCursor = errors.New("invalid after cursor")
+
+// eventSource reads stored events, oldest first. When there are more than
+// the limit, it returns the cursor to continue after.
+type eventSource interface {
+	queryEvents(ctx context.Context, query eventQuery) ([]storedEvent, string, error)
+}
+
+// storedEventSource is where stored events are read from: the event store
+// when it's enabled, as it keeps the bodies as received, or else the
+// PostgreSQL sink's table. It is nil when neither is configured.
+var storedEventSource eventSource
+
+// parseEventQuery reads an event query from request parameters, with the
+// limit defaulting to defaultLimit and at most maxLimit
+func parseEventQuery(params url.Values, defaultLimit, maxLimit int) (eventQuery, error) {
+	query := eventQuery{AccountID: params.Get("account"), After: params.Get("after"), Limit: defaultLimit}
+	for _, value := range params["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				query.Types = append(query.Types, eventType)
+			}
+		}
+	}
+	for name, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*t = parsed
+		}
+	}
+	if !query.To.IsZero() && !query.To.After(query.From) {
+		return query, errors.New("to must be after from")
+	}
+	for name, amount := range map[string]**int64{"min_amount": &query.MinAmount, "max_amount": &query.MaxAmount} {
+		if value := params.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an integer amount in minor units", name)
+			}
+			*amount = &parsed
+		}
+	}
+	if query.MinAmount != nil && query.MaxAmount != nil && *query.MaxAmount < *query.MinAmount {
+		return query, errors.New("max_amount must not be less than min_amount")
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+// queriedEvent is a stored event in a query API response
+type queriedEvent struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	AccountID  string          `json:"account_id,omitempty"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Encoding   string          `json:"encoding,omitempty"`
+	FilteredBy string          `json:"filtered_by,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// eventsHandler returns the stored events matching the query parameters,
+// oldest first, such as ?type=transaction.created&account=acc_1&min_amount=-5000
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseEventQuery(r.URL.Query(), defaultEventsLimit, maxEventsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stored, next, err := storedEventSource.queryEvents(r.Context(), query)
+	if errors.Is(err, errInvalidEventCursor) {
+		http.Error(w, "after must be a previous response's next", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logError("Error querying stored events: %v", err)
+		http.Error(w, "Error querying stored events", http.StatusServiceUnavailable)
+		return
+	}
+
+	events := make([]queriedEvent, 0, len(stored))
+	for _, s := range stored {
+		payload := json.RawMessage(s.Body)
+		if !json.Valid(s.Body) {
+			payload, _ = json.Marshal(string(s.Body))
+		}
+		events = append(events, queriedEvent{
+			ID:         s.ID,
+			Type:       s.Type,
+			AccountID:  s.AccountID,
+			ReceivedAt: s.ReceivedAt,
+			Encoding:   s.Delivery.Encoding,
+			FilteredBy: s.FilteredBy,
+			Payload:    payload,
+		})
+	}
+	response := map[string]interface{}{"events": events}
+	if next != "" {
+		response["next"] = next
+	}
+	writeJSON(w, http.StatusOK, response)
+}
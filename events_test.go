@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseEventQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		expectError bool
+		check       func(t *testing.T, q eventQuery)
+	}{
+		{
+			name:  "Defaults",
+			query: "",
+			check: func(t *testing.T, q eventQuery) {
+				if q.Limit != 100 || q.Types != nil || q.MinAmount != nil || !q.From.IsZero() {
+					t.Errorf("Unexpected query %+v", q)
+				}
+			},
+		},
+		{
+			name:  "Every filter",
+			query: "type=transaction.created,card.*&type=pot.*&account=acc_1&from=2024-03-01T00:00:00Z&to=2024-03-02T00:00:00Z&min_amount=-5000&max_amount=0&after=42&limit=10",
+			check: func(t *testing.T, q eventQuery) {
+				if len(q.Types) != 3 || q.AccountID != "acc_1" || *q.MinAmount != -5000 || *q.MaxAmount != 0 || q.After != "42" || q.Limit != 10 {
+					t.Errorf("Unexpected query %+v", q)
+				}
+				if !q.To.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)) {
+					t.Errorf("Unexpected to %v", q.To)
+				}
+			},
+		},
+		{name: "Invalid time", query: "from=yesterday", expectError: true},
+		{name: "To before from", query: "from=2024-03-02T00:00:00Z&to=2024-03-01T00:00:00Z", expectError: true},
+		{name: "Invalid amount", query: "min_amount=12.50", expectError: true},
+		{name: "Amount range reversed", query: "min_amount=100&max_amount=-100", expectError: true},
+		{name: "Limit too high", query: "limit=1001", expectError: true},
+		{name: "Limit too low", query: "limit=0", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _ := url.ParseQuery(tt.query)
+			q, err := parseEventQuery(params, defaultEventsLimit, maxEventsLimit)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			tt.check(t, q)
+		})
+	}
+}
+
+func TestEventQueryMatches(t *testing.T) {
+	amount := func(v int64) *int64 { return &v }
+	event := storedEvent{
+		Type:       "transaction.created",
+		AccountID:  "acc_1",
+		ReceivedAt: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+		Body:       []byte(`{"type":"transaction.created","data":{"amount":-6250}}`),
+	}
+
+	tests := []struct {
+		name   string
+		query  eventQuery
+		event  storedEvent
+		expect bool
+	}{
+		{name: "Empty query", event: event, expect: true},
+		{name: "Type prefix", query: eventQuery{Types: []string{"transaction.*"}}, event: event, expect: true},
+		{name: "Other type", query: eventQuery{Types: []string{"pot.*"}}, event: event, expect: false},
+		{name: "Account", query: eventQuery{AccountID: "acc_1"}, event: event, expect: true},
+		{name: "Other account", query: eventQuery{AccountID: "acc_2"}, event: event, expect: false},
+		{name: "In range", query: eventQuery{From: event.ReceivedAt, To: event.ReceivedAt.Add(time.Second)}, event: event, expect: true},
+		{name: "At the end of the range", query: eventQuery{To: event.ReceivedAt}, event: event, expect: false},
+		{name: "Amount in range", query: eventQuery{MinAmount: amount(-10000), MaxAmount: amount(-5000)}, event: event, expect: true},
+		{name: "Amount below minimum", query: eventQuery{MinAmount: amount(-5000)}, event: event, expect: false},
+		{name: "Amount above maximum", query: eventQuery{MaxAmount: amount(-7000)}, event: event, expect: false},
+		{name: "No amount", query: eventQuery{MaxAmount: amount(0)}, event: storedEvent{Body: []byte(`{"data":{}}`)}, expect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.matches(tt.event); got != tt.expect {
+				t.Errorf("Expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	originalSource := storedEventSource
+	defer func() { storedEventSource = originalSource }()
+
+	store, err := openEventStore(StoreConfig{Path: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.db.Close()
+	storedEventSource = store
+
+	for i, amount := range []int{-6250, 1000, -250} {
+		event := &webhookEvent{
+			ID:        []string{"evt_1", "evt_2", "evt_3"}[i],
+			Type:      "transaction.created",
+			AccountID: "acc_1",
+			Received:  time.Date(2024, 3, 1, 9, i, 0, 0, time.UTC),
+		}
+		body, _ := json.Marshal(map[string]interface{}{"type": event.Type, "data": map[string]interface{}{"amount": amount}})
+		store.record(event, body, storedDelivery{}, "")
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		expect     int
+		expectIDs  []string
+		expectNext string
+	}{
+		{name: "Wrong method", method: http.MethodPost, expect: http.StatusMethodNotAllowed},
+		{name: "Invalid query", method: http.MethodGet, query: "limit=-1", expect: http.StatusBadRequest},
+		{name: "Invalid cursor", method: http.MethodGet, query: "after=evt_1", expect: http.StatusBadRequest},
+		{name: "Every event", method: http.MethodGet, expect: http.StatusOK, expectIDs: []string{"evt_1", "evt_2", "evt_3"}},
+		{name: "Spending", method: http.MethodGet, query: "max_amount=-1", expect: http.StatusOK, expectIDs: []string{"evt_1", "evt_3"}},
+		{name: "First page", method: http.MethodGet, query: "limit=2", expect: http.StatusOK, expectIDs: []string{"evt_1", "evt_2"}, expectNext: "2"},
+		{name: "Next page", method: http.MethodGet, query: "limit=2&after=2", expect: http.StatusOK, expectIDs: []string{"evt_3"}},
+		{name: "No matches", method: http.MethodGet, query: "account=acc_2", expect: http.StatusOK, expectIDs: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			eventsHandler(w, httptest.NewRequest(tt.method, "/events?"+tt.query, nil))
+			if w.Code != tt.expect {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expect, w.Code, w.Body.String())
+			}
+			if tt.expectIDs == nil {
+				return
+			}
+
+			var response struct {
+				Events []queriedEvent `json:"events"`
+				Next   string         `json:"next"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+			if response.Events == nil {
+				t.Fatal("Expected an events array, got null")
+			}
+			var ids []string
+			for _, event := range response.Events {
+				ids = append(ids, event.ID)
+			}
+			if len(ids) != len(tt.expectIDs) || (len(ids) > 0 && ids[len(ids)-1] != tt.expectIDs[len(tt.expectIDs)-1]) {
+				t.Errorf("Expected %v, got %v", tt.expectIDs, ids)
+			}
+			if response.Next != tt.expectNext {
+				t.Errorf("Expected next %q, got %q", tt.expectNext, response.Next)
+			}
+			if len(ids) > 0 && ids[0] == "evt_1" {
+				var payload bytes.Buffer
+				json.Compact(&payload, response.Events[0].Payload)
+				if payload.String() != `{"data":{"amount":-6250},"type":"transaction.created"}` {
+					t.Errorf("Expected the stored payload, got %s", payload.String())
+				}
+			}
+		})
+	}
+}
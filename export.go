@@ -0,0 +1,364 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+var exportsTotal = metrics.newCounterVec("monzo_webhook_exports_total",
+	"Export bundles requested through the admin API, by result.", "result")
+
+// exportDateLayout is the layout of the dates bounding an export
+const exportDateLayout = "2006-01-02"
+
+// exportColumns are the columns of a bundle's transactions.csv
+var exportColumns, _ = parseAccountingColumns("time:created,id,account_id,account,description,merchant,category," +
+	"amount,currency,local_amount,local_currency,settled,notes")
+
+// transactionExporter builds export bundles when a signing key is configured
+// and the event store or a Redis stream holds the transaction history. It's
+// set in main.
+var transactionExporter *exporter
+
+// exporter builds signed bundles of the transactions in a date range, for
+// handing to an accountant: a CSV of the transactions, a PDF summary, and a
+// SHA256SUMS manifest of both with a detached Ed25519 signature
+type exporter struct {
+	history func(context.Context, time.Time) ([]monzo.Transaction, error)
+	key     ed25519.PrivateKey
+	now     func() time.Time
+}
+
+// exportSigningKeyFromEnv reads the PEM-encoded Ed25519 private key bundles
+// are signed with from EXPORT_SIGNING_KEY, returning nil if it's not set
+func exportSigningKeyFromEnv() (ed25519.PrivateKey, error) {
+	value, err := getenvSecret("EXPORT_SIGNING_KEY")
+	if err != nil || value == "" {
+		return nil, err
+	}
+	return parseEd25519PrivateKey([]byte(value))
+}
+
+// parseEd25519PrivateKey parses a PKCS #8 Ed25519 private key, such as one
+// made by openssl genpkey -algorithm ed25519
+func parseEd25519PrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid EXPORT_SIGNING_KEY: not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EXPORT_SIGNING_KEY: %w", err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid EXPORT_SIGNING_KEY: expected an Ed25519 key, got %T", key)
+	}
+	return ed, nil
+}
+
+// publicKeyPEM returns the PEM-encoded public key bundles can be verified with
+func (e *exporter) publicKeyPEM() []byte {
+	der, _ := x509.MarshalPKIXPublicKey(e.key.Public())
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// fingerprint returns the SHA-256 of the public key, for checking it
+// against a copy shared separately
+func (e *exporter) fingerprint() string {
+	sum := sha256.Sum256(e.key.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// transactions returns the settled and pending transactions created in
+// [from, to), for one account if accountID is set, oldest first
+func (e *exporter) transactions(ctx context.Context, from, to time.Time, accountID string) ([]monzo.Transaction, error) {
+	history, err := e.history(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	var result []monzo.Transaction
+	for _, tx := range history {
+		if tx.IsDeclined() || tx.Created.Before(from) || !tx.Created.Before(to) {
+			continue
+		}
+		if accountID != "" && tx.AccountID != accountID {
+			continue
+		}
+		result = append(result, tx)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result, nil
+}
+
+// bundle builds the zip of the transactions created on the days from first
+// to last, inclusive, in UTC
+func (e *exporter) bundle(ctx context.Context, first, last time.Time, accountID string) ([]byte, error) {
+	txs, err := e.transactions(ctx, first, last.AddDate(0, 0, 1), accountID)
+	if err != nil {
+		return nil, err
+	}
+	accounts := currentConfig().Accounts
+	label := func(id string) string {
+		if label, _ := knownAccounts.lookup(accounts, id); label != "" {
+			return label
+		}
+		return id
+	}
+
+	var transactionsCSV bytes.Buffer
+	if err := writeAccountingCSV(&transactionsCSV, txs, exportColumns, label); err != nil {
+		return nil, err
+	}
+	csvSum := sha256.Sum256(transactionsCSV.Bytes())
+	generated := e.now().UTC()
+	summary := textPDF(exportSummary(txs, label, first, last, accountID, generated, hex.EncodeToString(csvSum[:]), e.fingerprint()))
+
+	files := []exportFile{
+		{"transactions.csv", transactionsCSV.Bytes()},
+		{"summary.pdf", summary},
+	}
+	var manifest strings.Builder
+	for _, f := range files {
+		sum := sha256.Sum256(f.data)
+		fmt.Fprintf(&manifest, "%x  %s\n", sum, f.name)
+	}
+	files = append(files,
+		exportFile{"SHA256SUMS", []byte(manifest.String())},
+		exportFile{"SHA256SUMS.sig", ed25519.Sign(e.key, []byte(manifest.String()))},
+		exportFile{"public_key.pem", e.publicKeyPEM()},
+	)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	dir := exportName(first, last)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: dir + "/" + f.name, Method: zip.Deflate, Modified: generated})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportFile is a file in an export bundle
+type exportFile struct {
+	name string
+	data []byte
+}
+
+// exportName names a bundle after its date range
+func exportName(first, last time.Time) string {
+	return fmt.Sprintf("monzo-export-%s-to-%s", first.Format(exportDateLayout), last.Format(exportDateLayout))
+}
+
+// exportSummary returns the lines of a bundle's PDF summary: totals in and
+// out by account and currency, and spending by category
+func exportSummary(txs []monzo.Transaction, label func(string) string, first, last time.Time, accountID string, generated time.Time, csvSum, fingerprint string) []string {
+	type totalKey struct{ account, currency string }
+	type total struct{ in, out int64 }
+	totals := make(map[totalKey]*total)
+	type categoryKey struct{ category, currency string }
+	spending := make(map[categoryKey]int64)
+	for _, tx := range txs {
+		key := totalKey{label(tx.AccountID), tx.Currency}
+		if totals[key] == nil {
+			totals[key] = &total{}
+		}
+		if tx.Amount >= 0 {
+			totals[key].in += tx.Amount
+		} else {
+			totals[key].out += -tx.Amount
+			category := tx.Category
+			if category == "" {
+				category = "uncategorised"
+			}
+			spending[categoryKey{category, tx.Currency}] += -tx.Amount
+		}
+	}
+
+	account := "All accounts"
+	if accountID != "" {
+		account = fmt.Sprintf("%s (%s)", label(accountID), accountID)
+	}
+	lines := []string{
+		"Transaction export",
+		"",
+		"Period:        " + first.Format(exportDateLayout) + " to " + last.Format(exportDateLayout) + " (UTC)",
+		"Generated:     " + generated.Format(time.RFC3339),
+		"Account:       " + account,
+		fmt.Sprintf("Transactions:  %d", len(txs)),
+		"",
+		"Totals",
+		fmt.Sprintf("%-32s %-8s %14s %14s %14s", "Account", "Currency", "Money in", "Money out", "Net"),
+	}
+	keys := make([]totalKey, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].account < keys[j].account || keys[i].account == keys[j].account && keys[i].currency < keys[j].currency
+	})
+	for _, key := range keys {
+		t := totals[key]
+		lines = append(lines, fmt.Sprintf("%-32.32s %-8s %14s %14s %14s", key.account, key.currency,
+			formatMinorUnits(t.in, key.currency), formatMinorUnits(t.out, key.currency), formatMinorUnits(t.in-t.out, key.currency)))
+	}
+
+	lines = append(lines, "", "Spending by category",
+		fmt.Sprintf("%-32s %-8s %14s", "Category", "Currency", "Amount"))
+	categories := make([]categoryKey, 0, len(spending))
+	for key := range spending {
+		categories = append(categories, key)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		a, b := categories[i], categories[j]
+		return spending[a] > spending[b] || spending[a] == spending[b] && a.category < b.category
+	})
+	for _, key := range categories {
+		lines = append(lines, fmt.Sprintf("%-32.32s %-8s %14s", key.category, key.currency, formatMinorUnits(spending[key], key.currency)))
+	}
+
+	return append(lines, "",
+		"Verification",
+		"SHA-256 of transactions.csv:",
+		"  "+csvSum,
+		"SHA256SUMS is signed with the Ed25519 key with SHA-256 fingerprint:",
+		"  "+fingerprint,
+	)
+}
+
+// textPDF renders lines of text in a monospaced font as a PDF, across as many
+// A4 pages as they need. Lines longer than a page is wide are cut off.
+func textPDF(lines []string) []byte {
+	const linesPerPage, maxColumns = 64, 90
+	pages := [][]string{}
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1 to 3 are the catalog, page tree and font, followed by each
+	// page and its content
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i))
+		var content bytes.Buffer
+		content.WriteString("BT /F1 9 Tf 11 TL 50 792 Td\n")
+		for _, line := range page {
+			content.WriteByte('(')
+			content.Write(pdfText(line, maxColumns))
+			content.WriteString(") Tj T*\n")
+		}
+		content.WriteString("ET")
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfText encodes up to max characters of a line as a PDF string in
+// WinAnsiEncoding, which matches Latin-1 for the characters used here.
+// Others, such as emoji, are replaced with ?.
+func pdfText(line string, max int) []byte {
+	var out []byte
+	n := 0
+	for _, r := range line {
+		if n == max {
+			break
+		}
+		n++
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out = append(out, '\\', byte(r))
+		case r >= 0x20 && r < 0x7f || r >= 0xa0 && r <= 0xff:
+			out = append(out, byte(r))
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+// adminExportHandler serves an export bundle of the transactions created
+// between the from and to dates, inclusive, optionally for one account_id
+func adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	first, err := time.Parse(exportDateLayout, query.Get("from"))
+	if err != nil {
+		http.Error(w, "from must be a date such as 2024-04-06", http.StatusBadRequest)
+		return
+	}
+	last, err := time.Parse(exportDateLayout, query.Get("to"))
+	if err != nil {
+		http.Error(w, "to must be a date such as 2025-04-05", http.StatusBadRequest)
+		return
+	}
+	if last.Before(first) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	bundle, err := transactionExporter.bundle(r.Context(), first, last, query.Get("account_id"))
+	if err != nil {
+		logError("Error building export bundle: %v", err)
+		exportsTotal.WithLabelValues("error").Inc()
+		if errors.Is(err, errHistoryTrimmed) {
+			http.Error(w, "Transaction history is incomplete: "+err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error reading transaction history", http.StatusServiceUnavailable)
+		return
+	}
+	logInfo("Exported transactions from %s to %s", first.Format(exportDateLayout), last.Format(exportDateLayout))
+	exportsTotal.WithLabelValues("success").Inc()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, exportName(first, last)))
+	w.Write(bundle)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+func newTestExporter(t *testing.T) *exporter {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int, hour int) time.Time { return time.Date(2024, 4, d, hour, 0, 0, 0, time.UTC) }
+	history := []monzo.Transaction{
+		{ID: "tx_before", Created: day(5, 23), Amount: -100, Currency: "GBP", AccountID: "acc_1"},
+		{ID: "tx_salary", Created: day(6, 9), Amount: 250000, Currency: "GBP", AccountID: "acc_1", Category: "income", Description: "ACME LTD"},
+		{ID: "tx_coffee", Created: day(7, 8), Amount: -350, Currency: "GBP", AccountID: "acc_1", Category: "eating_out", Merchant: &monzo.Merchant{Name: "Coffee (Soho)"}, Notes: "=SUM(A1)"},
+		{ID: "tx_declined", Created: day(7, 9), Amount: -5000, Currency: "GBP", AccountID: "acc_1", DeclineReason: "INSUFFICIENT_FUNDS"},
+		{ID: "tx_joint", Created: day(8, 12), Amount: -12000, Currency: "GBP", AccountID: "acc_2", Category: "groceries"},
+		{ID: "tx_after", Created: day(9, 0), Amount: -100, Currency: "GBP", AccountID: "acc_1"},
+	}
+	return &exporter{
+		history: func(ctx context.Context, since time.Time) ([]monzo.Transaction, error) { return history, nil },
+		key:     key,
+		now:     func() time.Time { return day(10, 12) },
+	}
+}
+
+// readExport returns the files in an export bundle, by name without the
+// directory
+func readExport(t *testing.T, bundle []byte) map[string][]byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "monzo-export-2024-04-06-to-2024-04-08/") {
+			t.Errorf("Unexpected file %s", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name[strings.LastIndex(f.Name, "/")+1:]] = data
+	}
+	return files
+}
+
+func TestExporterBundle(t *testing.T) {
+	origConfig := eventConfig
+	defer func() { eventConfig = origConfig }()
+	eventConfig = EventConfig{Accounts: []AccountConfig{{ID: "acc_1", Label: "Personal"}, {ID: "acc_2", Label: "Joint"}}}
+
+	e := newTestExporter(t)
+	first, last := time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 8, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		account string
+		ids     []string
+	}{
+		{name: "All accounts", ids: []string{"tx_salary", "tx_coffee", "tx_joint"}},
+		{name: "One account", account: "acc_1", ids: []string{"tx_salary", "tx_coffee"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle, err := e.bundle(context.Background(), first, last, tt.account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := readExport(t, bundle)
+
+			records, err := csv.NewReader(bytes.NewReader(files["transactions.csv"])).ReadAll()
+			if err != nil {
+				t.Fatalf("Invalid CSV: %v", err)
+			}
+			var ids []string
+			for _, record := range records[1:] {
+				ids = append(ids, record[1])
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+				t.Errorf("Expected transactions %v, got %v", tt.ids, ids)
+			}
+			coffee := records[2]
+			if coffee[3] != "Personal" || coffee[5] != "Coffee (Soho)" || coffee[7] != "-3.50" || coffee[12] != "'=SUM(A1)" {
+				t.Errorf("Unexpected CSV record: %v", coffee)
+			}
+
+			// The manifest covers the CSV and summary, and is signed
+			manifest := files["SHA256SUMS"]
+			for _, name := range []string{"transactions.csv", "summary.pdf"} {
+				line := fmt.Sprintf("%x  %s\n", sha256.Sum256(files[name]), name)
+				if !strings.Contains(string(manifest), line) {
+					t.Errorf("Expected the manifest to contain %q, got %s", line, manifest)
+				}
+			}
+			block, _ := pem.Decode(files["public_key.pem"])
+			if block == nil {
+				t.Fatal("Expected a PEM public key")
+			}
+			public, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ed25519.Verify(public.(ed25519.PublicKey), manifest, files["SHA256SUMS.sig"]) {
+				t.Error("Expected the manifest's signature to verify")
+			}
+
+			if pdf := string(files["summary.pdf"]); !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.Contains(pdf, e.fingerprint()) {
+				t.Error("Expected a PDF summary with the key's fingerprint")
+			}
+		})
+	}
+}
+
+func TestExportSummary(t *testing.T) {
+	e := newTestExporter(t)
+	txs, _ := e.transactions(context.Background(), time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 9, 0, 0, 0, 0, time.UTC), "")
+	label := func(id string) string { return map[string]string{"acc_1": "Personal", "acc_2": "Joint"}[id] }
+	lines := strings.Join(exportSummary(txs, label, time.Time{}, time.Time{}, "", time.Time{}, "csvsum", "fingerprint"), "\n")
+
+	for _, expected := range []string{
+		"Transactions:  3",
+		fmt.Sprintf("%-32s %-8s %14s %14s %14s", "Personal", "GBP", "2500.00", "3.50", "2496.50"),
+		fmt.Sprintf("%-32s %-8s %14s %14s %14s", "Joint", "GBP", "0.00", "120.00", "-120.00"),
+		fmt.Sprintf("%-32s %-8s %14s", "groceries", "GBP", "120.00"),
+	} {
+		if !strings.Contains(lines, expected) {
+			t.Errorf("Expected the summary to contain %q, got:\n%s", expected, lines)
+		}
+	}
+	if strings.Index(lines, "groceries") > strings.Index(lines, "eating_out") {
+		t.Error("Expected categories to be sorted by spending, largest first")
+	}
+}
+
+func TestTextPDF(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("Line %d (£%d)", i, i)
+	}
+	pdf := textPDF(lines)
+
+	if got := bytes.Count(pdf, []byte("/Type /Page /Parent")); got != 2 {
+		t.Errorf("Expected 2 pages, got %d", got)
+	}
+	if !bytes.Contains(pdf, []byte("(Line 99 \\(\xa399\\)) Tj")) {
+		t.Error("Expected text to be escaped and encoded in WinAnsiEncoding")
+	}
+
+	// startxref points at the cross-reference table
+	i := bytes.LastIndex(pdf, []byte("startxref\n"))
+	var offset int
+	fmt.Sscanf(string(pdf[i+len("startxref\n"):]), "%d", &offset)
+	if !bytes.HasPrefix(pdf[offset:], []byte("xref\n")) {
+		t.Errorf("Expected startxref to point at the xref table, got offset %d", offset)
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	tests := []struct {
+		line   string
+		max    int
+		expect string
+	}{
+		{line: `Coffee (Soho) \ tea`, max: 90, expect: `Coffee \(Soho\) \\ tea`},
+		{line: "Café 🍕", max: 90, expect: "Caf\xe9 ?"},
+		{line: "abcdef", max: 3, expect: "abc"},
+	}
+	for _, tt := range tests {
+		if got := string(pdfText(tt.line, tt.max)); got != tt.expect {
+			t.Errorf("pdfText(%q) = %q, expected %q", tt.line, got, tt.expect)
+		}
+	}
+}
+
+func TestParseEd25519PrivateKey(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseEd25519PrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil || !parsed.Equal(key) {
+		t.Errorf("Expected the key to be parsed, got %v", err)
+	}
+	if _, err := parseEd25519PrivateKey([]byte("not a key")); err == nil {
+		t.Error("Expected an error for a key that isn't PEM encoded")
+	}
+}
+
+func TestAdminExportHandler(t *testing.T) {
+	origExporter := transactionExporter
+	defer func() { transactionExporter = origExporter }()
+	transactionExporter = newTestExporter(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{name: "Date range", query: "from=2024-04-06&to=2024-04-08", status: http.StatusOK},
+		{name: "Missing from", query: "to=2024-04-08", status: http.StatusBadRequest},
+		{name: "Invalid to", query: "from=2024-04-06&to=tomorrow", status: http.StatusBadRequest},
+		{name: "Reversed range", query: "from=2024-04-08&to=2024-04-06", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			adminExportHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/exports?"+tt.query, nil))
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="monzo-export-2024-04-06-to-2024-04-08.zip"` {
+				t.Errorf("Unexpected Content-Disposition: %s", got)
+			}
+			if files := readExport(t, rr.Body.Bytes()); len(files) != 5 {
+				t.Errorf("Expected 5 files in the bundle, got %d", len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FailoverConfig configures active/standby failover between two instances
+// that receive the same webhooks, such as two webhooks registered with Monzo
+// for the same account. The instance holding a lease in Redis is active and
+// publishes events. The standby buffers them instead, and if the lease
+// expires it takes over and publishes the buffered events that the active
+// instance didn't.
+type FailoverConfig struct {
+	Enabled      bool   `json:"enabled"`
+	LeaseTTL     string `json:"lease_ttl"`
+	BufferWindow string `json:"buffer_window"`
+	BufferSize   int    `json:"buffer_size"`
+	KeyPrefix    string `json:"key_prefix"`
+}
+
+var (
+	failoverActive = metrics.newGauge("monzo_webhook_failover_active",
+		"Whether this instance holds the failover lease and publishes events.")
+	failoverBuffered = metrics.newGauge("monzo_webhook_failover_buffered",
+		"Events buffered by this instance while it is the standby.")
+	failoverTakeoverEvents = metrics.newCounterVec("monzo_webhook_failover_takeover_events_total",
+		"Buffered events handled when this instance took over, by result.", "result")
+)
+
+// validate checks the failover configuration for invalid values
+func (c FailoverConfig) validate() error {
+	ttl, err := parsePositiveDuration(c.LeaseTTL, 15*time.Second)
+	if err != nil {
+		return fmt.Errorf("invalid failover lease_ttl: %w", err)
+	}
+	window, err := parsePositiveDuration(c.BufferWindow, 5*time.Minute)
+	if err != nil {
+		return fmt.Errorf("invalid failover buffer_window: %w", err)
+	}
+	if window <= ttl {
+		return fmt.Errorf("failover buffer_window must be longer than lease_ttl")
+	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("failover buffer_size must not be negative")
+	}
+	return nil
+}
+
+// leaseTTL returns how long the lease lasts without being renewed,
+// defaulting to 15 seconds
+func (c FailoverConfig) leaseTTL() time.Duration {
+	d, _ := parsePositiveDuration(c.LeaseTTL, 15*time.Second)
+	return d
+}
+
+// bufferWindow returns how long the standby keeps events, and how long the
+// active instance remembers publishing them, defaulting to 5 minutes
+func (c FailoverConfig) bufferWindow() time.Duration {
+	d, _ := parsePositiveDuration(c.BufferWindow, 5*time.Minute)
+	return d
+}
+
+// bufferSize returns how many events the standby keeps, defaulting to 1000
+func (c FailoverConfig) bufferSize() int {
+	if c.BufferSize == 0 {
+		return 1000
+	}
+	return c.BufferSize
+}
+
+// keyPrefix returns the prefix of failover keys in Redis
+func (c FailoverConfig) keyPrefix() string {
+	if c.KeyPrefix == "" {
+		return "monzo-webhook:failover:"
+	}
+	return c.KeyPrefix
+}
+
+// publishedKey returns the Redis key recording that an event was published,
+// or an empty string if it has no data.id. Each instance assigns its own event
+// IDs, so events are matched on their type and data.id.
+func (c FailoverConfig) publishedKey(event *webhookEvent) string {
+	data, _ := event.Payload["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+	if id == "" {
+		return ""
+	}
+	key := c.keyPrefix() + "published:"
+	if event.Tenant != nil {
+		key += event.Tenant.Name + ":"
+	}
+	return key + event.Type + ":" + id
+}
+
+// renewLeaseScript extends the lease if this instance still holds it
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// failoverCoordinator holds or waits for the failover lease, buffering events
+// while this instance is the standby
+type failoverCoordinator struct {
+	cfg      FailoverConfig
+	client   *redis.Client
+	identity string
+	now      func() time.Time
+	dispatch func(*webhookEvent) error
+
+	mu          sync.Mutex
+	activeUntil time.Time
+	wasActive   bool
+	buffered    []*webhookEvent
+}
+
+// failoverStandbyReason is why the failover component is degraded while this
+// instance is the standby
+const failoverStandbyReason = "standby instance - events are buffered until it takes over"
+
+// failover is set when failover is enabled
+var failover *failoverCoordinator
+
+func newFailoverCoordinator(cfg FailoverConfig, client *redis.Client, dispatch func(*webhookEvent) error, now func() time.Time) *failoverCoordinator {
+	hostname, _ := os.Hostname()
+	return &failoverCoordinator{
+		cfg:      cfg,
+		client:   client,
+		identity: hostname + "/" + newEventID(now()),
+		now:      now,
+		dispatch: dispatch,
+	}
+}
+
+// active reports whether this instance holds the lease. The lease is
+// considered lost once it could have expired in Redis, even if Redis can't
+// be reached to confirm it, so two instances are never active at once.
+func (f *failoverCoordinator) active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now().Before(f.activeUntil)
+}
+
+// renew acquires the lease if it is free, or extends it if this instance
+// holds it, and takes over if this instance has just become active
+func (f *failoverCoordinator) renew(ctx context.Context) error {
+	started := f.now()
+	key := f.cfg.keyPrefix() + "lease"
+	ttl := f.cfg.leaseTTL()
+
+	held, err := f.client.SetNX(ctx, key, f.identity, ttl).Result()
+	if err == nil && !held {
+		var renewed int64
+		renewed, err = renewLeaseScript.Run(ctx, f.client, []string{key}, f.identity, ttl.Milliseconds()).Int64()
+		held = renewed == 1
+	}
+
+	f.mu.Lock()
+	if err == nil {
+		if held {
+			f.activeUntil = started.Add(ttl)
+		} else {
+			f.activeUntil = time.Time{}
+		}
+	}
+	active := f.now().Before(f.activeUntil)
+	tookOver := active && !f.wasActive
+	steppedDown := !active && f.wasActive
+	f.wasActive = active
+	var pending []*webhookEvent
+	if tookOver {
+		pending, f.buffered = f.buffered, nil
+	}
+	f.mu.Unlock()
+
+	switch {
+	case tookOver:
+		failoverActive.Set(1)
+		failoverBuffered.Set(0)
+		logInfo("Failover: %s is now the active instance", f.identity)
+		serviceStatus.recover(failoverComponent)
+		f.takeover(ctx, pending)
+	case steppedDown:
+		failoverActive.Set(0)
+		logWarn("Failover: %s is now the standby instance - buffering events", f.identity)
+		serviceStatus.degrade(failoverComponent, failoverStandbyReason)
+	}
+	return err
+}
+
+// buffer keeps an event received while this instance is the standby, dropping
+// the oldest events beyond the buffer size
+func (f *failoverCoordinator) buffer(event *webhookEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buffered = append(f.buffered, event)
+	if excess := len(f.buffered) - f.cfg.bufferSize(); excess > 0 {
+		logWarn("Failover buffer is full - dropping %d events", excess)
+		f.buffered = f.buffered[excess:]
+	}
+	failoverBuffered.Set(float64(len(f.buffered)))
+}
+
+// takeover publishes the buffered events that the previous active instance
+// didn't record publishing. Events older than the buffer window, or without
+// a data.id to match on, are dropped.
+func (f *failoverCoordinator) takeover(ctx context.Context, events []*webhookEvent) {
+	cutoff := f.now().Add(-f.cfg.bufferWindow())
+	published, skipped := 0, 0
+	for _, event := range events {
+		key := f.cfg.publishedKey(event)
+		if key == "" || event.Received.Before(cutoff) {
+			failoverTakeoverEvents.WithLabelValues("dropped").Inc()
+			skipped++
+			continue
+		}
+		exists, err := f.client.Exists(ctx, key).Result()
+		if err != nil {
+			logWarn("Error checking whether %s event %s was published: %v", event.Type, event.ID, err)
+		}
+		if err == nil && exists > 0 {
+			failoverTakeoverEvents.WithLabelValues("already_published").Inc()
+			skipped++
+			continue
+		}
+		if err := f.dispatch(event); err != nil {
+			logError("Error publishing buffered %s event %s: %v", event.Type, event.ID, err)
+			failoverTakeoverEvents.WithLabelValues("error").Inc()
+			continue
+		}
+		failoverTakeoverEvents.WithLabelValues("published").Inc()
+		published++
+	}
+	if len(events) > 0 {
+		logInfo("Failover: published %d buffered events, skipped %d", published, skipped)
+	}
+}
+
+// markPublished records that the active instance published an event, so that
+// a standby taking over doesn't publish it again
+func (f *failoverCoordinator) markPublished(ctx context.Context, event *webhookEvent) {
+	key := f.cfg.publishedKey(event)
+	if key == "" {
+		return
+	}
+	if err := f.client.Set(ctx, key, event.ID, f.cfg.bufferWindow()).Err(); err != nil {
+		logWarn("Error recording %s event %s as published for failover: %v", event.Type, event.ID, err)
+	}
+}
+
+// run renews the lease until ctx is cancelled
+func (f *failoverCoordinator) run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.leaseTTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.renew(ctx); err != nil {
+				logWarn("Error renewing failover lease: %v", err)
+			}
+		}
+	}
+}
+
+// bufferOnStandby buffers an event instead of publishing it when this
+// instance is the failover standby, returning whether it did
+func bufferOnStandby(event *webhookEvent) bool {
+	if failover == nil || failover.active() {
+		return false
+	}
+	failover.buffer(event)
+	logDebug("Buffered %s event %s on standby", event.Type, event.ID)
+	eventTraces.setOutcome(event.ID, "buffered on standby")
+	return true
+}
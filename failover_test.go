@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailoverConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      FailoverConfig
+		expectError bool
+	}{
+		{name: "Defaults", config: FailoverConfig{Enabled: true}},
+		{name: "Custom", config: FailoverConfig{LeaseTTL: "10s", BufferWindow: "1m", BufferSize: 50}},
+		{name: "Invalid lease TTL", config: FailoverConfig{LeaseTTL: "soon"}, expectError: true},
+		{name: "Invalid buffer window", config: FailoverConfig{BufferWindow: "-1m"}, expectError: true},
+		{name: "Window shorter than lease", config: FailoverConfig{LeaseTTL: "1m", BufferWindow: "30s"}, expectError: true},
+		{name: "Negative buffer size", config: FailoverConfig{BufferSize: -1}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func failoverEvent(id, transaction string, received time.Time) *webhookEvent {
+	return &webhookEvent{
+		ID:       id,
+		Type:     "transaction.created",
+		Payload:  map[string]interface{}{"data": map[string]interface{}{"id": transaction}},
+		Received: received,
+	}
+}
+
+func TestFailoverTakeover(t *testing.T) {
+	server, client := newFakeRedis(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	cfg := FailoverConfig{Enabled: true}
+
+	var dispatched []string
+	primary := newFailoverCoordinator(cfg, client, func(*webhookEvent) error { return nil }, clock)
+	standby := newFailoverCoordinator(cfg, client, func(event *webhookEvent) error {
+		dispatched = append(dispatched, event.ID)
+		return nil
+	}, clock)
+
+	if err := primary.renew(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := standby.renew(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !primary.active() || standby.active() {
+		t.Fatalf("Expected the first instance to be active, got primary=%v standby=%v", primary.active(), standby.active())
+	}
+
+	// Both instances receive every event, but only the active one publishes
+	primary.markPublished(context.Background(), failoverEvent("01PRIMARY1", "tx_1", now))
+	standby.buffer(failoverEvent("01STANDBY1", "tx_1", now))
+	standby.buffer(failoverEvent("01STANDBY2", "tx_2", now))
+	standby.buffer(failoverEvent("01STALE", "tx_0", now.Add(-time.Hour)))
+
+	// Renewing keeps the lease with the active instance
+	if err := primary.renew(context.Background()); err != nil || !primary.active() {
+		t.Fatalf("Expected the lease to be renewed, got active=%v err=%v", primary.active(), err)
+	}
+
+	// The lease expires when the active instance stops renewing it
+	server.mu.Lock()
+	delete(server.values, cfg.keyPrefix()+"lease")
+	server.mu.Unlock()
+
+	if err := standby.renew(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !standby.active() {
+		t.Fatal("Expected the standby to take over")
+	}
+	if len(dispatched) != 1 || dispatched[0] != "01STANDBY2" {
+		t.Errorf("Expected only the unpublished event to be published, got %v", dispatched)
+	}
+	if len(standby.buffered) != 0 {
+		t.Errorf("Expected the buffer to be emptied, got %d events", len(standby.buffered))
+	}
+
+	if err := primary.renew(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if primary.active() {
+		t.Error("Expected the previous active instance to become the standby")
+	}
+}
+
+func TestFailoverLeaseExpiresLocally(t *testing.T) {
+	_, client := newFakeRedis(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := newFailoverCoordinator(FailoverConfig{LeaseTTL: "15s"}, client, nil, func() time.Time { return now })
+
+	if err := f.renew(context.Background()); err != nil || !f.active() {
+		t.Fatalf("Expected the lease to be acquired, got active=%v err=%v", f.active(), err)
+	}
+
+	// Without a renewal, the lease is treated as lost once it could have expired
+	now = now.Add(15 * time.Second)
+	if f.active() {
+		t.Error("Expected the lease to have expired")
+	}
+}
+
+func TestFailoverBufferSize(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := newFailoverCoordinator(FailoverConfig{BufferSize: 2}, nil, nil, func() time.Time { return now })
+
+	f.buffer(failoverEvent("01A", "tx_1", now))
+	f.buffer(failoverEvent("01B", "tx_2", now))
+	f.buffer(failoverEvent("01C", "tx_3", now))
+
+	if len(f.buffered) != 2 || f.buffered[0].ID != "01B" || f.buffered[1].ID != "01C" {
+		t.Errorf("Expected the oldest event to be dropped, got %d events", len(f.buffered))
+	}
+}
+
+func TestWebhookHandlerStandby(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	origFailover := failover
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+		failover = origFailover
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+
+	basicAuthUsername, basicAuthPassword = "", ""
+	eventConfig = EventConfig{}
+	sink := &fakeSink{name: "redis"}
+	sinks = []sinkEntry{{sink: sink, required: true}}
+
+	// An instance that hasn't acquired the lease is the standby
+	_, client := newFakeRedis(t)
+	failover = newFailoverCoordinator(FailoverConfig{Enabled: true}, client, dispatchEvent, time.Now)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"type":"transaction.created","data":{"id":"tx_1"}}`))
+	rr := httptest.NewRecorder()
+	webhookHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", rr.Code)
+	}
+	if sink.count() != 0 {
+		t.Errorf("Expected the standby not to publish, got %d events", sink.count())
+	}
+	if len(failover.buffered) != 1 {
+		t.Errorf("Expected 1 buffered event, got %d", len(failover.buffered))
+	}
+
+	// Taking over publishes the buffered event
+	if err := failover.renew(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sink.count() != 1 {
+		t.Errorf("Expected the buffered event to be published, got %d events", sink.count())
+	}
+}
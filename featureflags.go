@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Built-in feature flags, gating the features that are risky to turn on in
+// a new environment. Both are on unless configured otherwise, so that
+// existing deployments keep working.
+const (
+	// flagMonzoWrites allows requests that change something in Monzo, such
+	// as registering the webhook
+	flagMonzoWrites = "monzo_writes"
+	// flagAsyncProcessing hands events to the worker pool, when one is
+	// configured, rather than publishing them before responding
+	flagAsyncProcessing = "async_processing"
+)
+
+// builtinFeatureFlags are the built-in flags, with their defaults
+var builtinFeatureFlags = map[string]bool{
+	flagMonzoWrites:     true,
+	flagAsyncProcessing: true,
+}
+
+// defaultFeatureFlagsKey is the Redis hash holding the flags' overrides
+const defaultFeatureFlagsKey = "monzo-webhook:feature-flags"
+
+// featureFlagNamePattern is what flag names may contain
+var featureFlagNamePattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// errMonzoWritesDisabled is returned for requests that would change something
+// in Monzo while the monzo_writes flag is off
+var errMonzoWritesDisabled = errors.New("writes to Monzo are disabled by the monzo_writes feature flag")
+
+var (
+	featureFlagState = metrics.newGaugeVec("monzo_webhook_feature_flag",
+		"1 for each feature flag's current state (on or off) and where it came from (redis, environment, config, default).", "flag", "state", "source")
+	featureFlagGated = metrics.newCounterVec("monzo_webhook_feature_flag_gated_total",
+		"Actions skipped because the feature flag gating them is off, by flag.", "flag")
+)
+
+// FeatureFlagsConfig configures the feature flags. Each flag is on or off in
+// every environment, unless it's set for the one the server runs in, and can
+// be overridden at runtime in Redis.
+type FeatureFlagsConfig struct {
+	// Environment is the environment the server runs in, such as staging
+	Environment string `json:"environment"`
+	// Key is the Redis hash holding the overrides, by flag name
+	Key   string                       `json:"key"`
+	Flags map[string]FeatureFlagConfig `json:"flags"`
+}
+
+// FeatureFlagConfig is a flag's state: Enabled in every environment, unless
+// Environments sets it for the one the server runs in. Enabled defaults to
+// the built-in flags' default, or off.
+type FeatureFlagConfig struct {
+	Enabled      *bool           `json:"enabled"`
+	Environments map[string]bool `json:"environments"`
+}
+
+func (c FeatureFlagsConfig) key() string {
+	if c.Key == "" {
+		return defaultFeatureFlagsKey
+	}
+	return c.Key
+}
+
+// validateFeatureFlags checks the flags' names, and that the flags sinks
+// are gated by are defined
+func validateFeatureFlags(c FeatureFlagsConfig, sinks []SinkConfig, pipelines []PipelineConfig) error {
+	for name := range c.Flags {
+		if !featureFlagNamePattern.MatchString(name) {
+			return fmt.Errorf("feature_flags: invalid flag name '%s', must be lowercase letters, digits, '_', '.' and '-'", name)
+		}
+	}
+	defined := func(name string) bool {
+		_, builtin := builtinFeatureFlags[name]
+		_, configured := c.Flags[name]
+		return builtin || configured
+	}
+	for i, sink := range sinks {
+		if sink.Flag != "" && !defined(sink.Flag) {
+			return fmt.Errorf("sink %d: unknown feature flag '%s'", i+1, sink.Flag)
+		}
+	}
+	for _, p := range pipelines {
+		for i, sink := range p.Sinks {
+			if sink.Flag != "" && !defined(sink.Flag) {
+				return fmt.Errorf("pipeline '%s': sink %d: unknown feature flag '%s'", p.Name, i+1, sink.Flag)
+			}
+		}
+	}
+	return nil
+}
+
+// featureFlag is a flag's current state and where it came from
+type featureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+}
+
+// featureFlagSet resolves the feature flags from the configuration and the
+// overrides in Redis, which are reloaded periodically so that every instance
+// picks them up. Without Redis, flags come from the configuration alone.
+type featureFlagSet struct {
+	client *redis.Client
+
+	mu        sync.RWMutex
+	overrides map[string]bool
+}
+
+var featureFlags = newFeatureFlagSet(nil)
+
+func newFeatureFlagSet(client *redis.Client) *featureFlagSet {
+	return &featureFlagSet{client: client, overrides: make(map[string]bool)}
+}
+
+// resolveFeatureFlag returns a flag's state under a configuration, without
+// the overrides
+func resolveFeatureFlag(c FeatureFlagsConfig, name string) featureFlag {
+	flag := featureFlag{Name: name, Enabled: builtinFeatureFlags[name], Source: "default"}
+	if configured, ok := c.Flags[name]; ok {
+		if enabled, ok := configured.Environments[c.Environment]; ok && c.Environment != "" {
+			return featureFlag{Name: name, Enabled: enabled, Source: "environment"}
+		}
+		if configured.Enabled != nil {
+			return featureFlag{Name: name, Enabled: *configured.Enabled, Source: "config"}
+		}
+	}
+	return flag
+}
+
+// get returns a flag's current state
+func (s *featureFlagSet) get(name string) featureFlag {
+	s.mu.RLock()
+	enabled, ok := s.overrides[name]
+	s.mu.RUnlock()
+	if ok {
+		return featureFlag{Name: name, Enabled: enabled, Source: "redis"}
+	}
+	return resolveFeatureFlag(currentConfig().FeatureFlags, name)
+}
+
+// enabled reports whether a flag is on
+func (s *featureFlagSet) enabled(name string) bool {
+	return s.get(name).Enabled
+}
+
+// gate reports whether a flag is on, counting the action it gates as skipped
+// if it's off
+func (s *featureFlagSet) gate(name string) bool {
+	if s.enabled(name) {
+		return true
+	}
+	featureFlagGated.WithLabelValues(name).Inc()
+	return false
+}
+
+// list returns the state of every flag that is built in, configured or
+// overridden, in order of name
+func (s *featureFlagSet) list() []featureFlag {
+	names := make(map[string]bool)
+	for name := range builtinFeatureFlags {
+		names[name] = true
+	}
+	for name := range currentConfig().FeatureFlags.Flags {
+		names[name] = true
+	}
+	s.mu.RLock()
+	for name := range s.overrides {
+		names[name] = true
+	}
+	s.mu.RUnlock()
+
+	flags := make([]featureFlag, 0, len(names))
+	for name := range names {
+		flags = append(flags, s.get(name))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// record sets the flags' metrics to their current states
+func (s *featureFlagSet) record() {
+	featureFlagState.Reset()
+	for _, flag := range s.list() {
+		state := "off"
+		if flag.Enabled {
+			state = "on"
+		}
+		featureFlagState.WithLabelValues(flag.Name, state, flag.Source).Set(1)
+	}
+}
+
+// load replaces the overrides with the ones stored in Redis, and records the
+// flags' states
+func (s *featureFlagSet) load(ctx context.Context) error {
+	defer s.record()
+	if s.client == nil {
+		return nil
+	}
+	values, err := s.client.HGetAll(ctx, currentConfig().FeatureFlags.key()).Result()
+	if err != nil {
+		return err
+	}
+
+	overrides := make(map[string]bool, len(values))
+	for name, value := range values {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			logWarn("Ignoring feature flag override %s=%s: not true or false", name, value)
+			continue
+		}
+		overrides[name] = enabled
+	}
+	s.mu.Lock()
+	s.overrides = overrides
+	s.mu.Unlock()
+	return nil
+}
+
+// set overrides a flag, in Redis when connected
+func (s *featureFlagSet) set(ctx context.Context, name string, enabled bool) error {
+	if s.client != nil {
+		if err := s.client.HSet(ctx, currentConfig().FeatureFlags.key(), name, strconv.FormatBool(enabled)).Err(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.overrides[name] = enabled
+	s.mu.Unlock()
+	s.record()
+	return nil
+}
+
+// clear removes a flag's override, reporting whether it had one
+func (s *featureFlagSet) clear(ctx context.Context, name string) (bool, error) {
+	s.mu.RLock()
+	_, ok := s.overrides[name]
+	s.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	if s.client != nil {
+		if err := s.client.HDel(ctx, currentConfig().FeatureFlags.key(), name).Err(); err != nil {
+			return false, err
+		}
+	}
+	s.mu.Lock()
+	delete(s.overrides, name)
+	s.mu.Unlock()
+	s.record()
+	return true, nil
+}
+
+// asyncEnabled reports whether events are handed to the worker pool
+func asyncEnabled() bool {
+	return asyncQueue != nil && featureFlags.enabled(flagAsyncProcessing)
+}
+
+// adminFeatureFlagsHandler lists the feature flags' states
+func adminFeatureFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"environment": currentConfig().FeatureFlags.Environment,
+		"flags":       featureFlags.list(),
+	})
+}
+
+// adminFeatureFlagHandler overrides a flag with PUT, which takes a body like
+// {"enabled": false}, and removes the override with DELETE
+func adminFeatureFlagHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `Body must be {"enabled": true} or {"enabled": false}`, http.StatusBadRequest)
+			return
+		}
+		if !featureFlagNamePattern.MatchString(name) {
+			http.Error(w, "Invalid flag name", http.StatusBadRequest)
+			return
+		}
+		if err := featureFlags.set(r.Context(), name, *req.Enabled); err != nil {
+			logError("Error overriding feature flag '%s': %v", name, err)
+			http.Error(w, "Error saving feature flag", http.StatusServiceUnavailable)
+			return
+		}
+		logInfo("Feature flag '%s' overridden: enabled=%t", name, *req.Enabled)
+		writeJSON(w, http.StatusOK, featureFlags.get(name))
+	case http.MethodDelete:
+		removed, err := featureFlags.clear(r.Context(), name)
+		if err != nil {
+			logError("Error removing feature flag override '%s': %v", name, err)
+			http.Error(w, "Error saving feature flag", http.StatusServiceUnavailable)
+			return
+		}
+		if !removed {
+			http.Error(w, "Feature flag is not overridden", http.StatusNotFound)
+			return
+		}
+		logInfo("Feature flag '%s' override removed", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResolveFeatureFlag(t *testing.T) {
+	off, on := false, true
+	cfg := FeatureFlagsConfig{
+		Environment: "staging",
+		Flags: map[string]FeatureFlagConfig{
+			flagMonzoWrites: {Enabled: &on, Environments: map[string]bool{"staging": false}},
+			"new_sink":      {Enabled: &off, Environments: map[string]bool{"production": true}},
+			"configured":    {Enabled: &on},
+			"undecided":     {},
+		},
+	}
+	tests := []struct {
+		name          string
+		expectEnabled bool
+		expectSource  string
+	}{
+		{name: flagMonzoWrites, expectEnabled: false, expectSource: "environment"},
+		{name: "new_sink", expectEnabled: false, expectSource: "config"},
+		{name: "configured", expectEnabled: true, expectSource: "config"},
+		{name: "undecided", expectEnabled: false, expectSource: "default"},
+		{name: flagAsyncProcessing, expectEnabled: true, expectSource: "default"},
+		{name: "unknown", expectEnabled: false, expectSource: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag := resolveFeatureFlag(cfg, tt.name)
+			if flag.Enabled != tt.expectEnabled || flag.Source != tt.expectSource {
+				t.Errorf("Expected enabled=%t from %s, got %+v", tt.expectEnabled, tt.expectSource, flag)
+			}
+		})
+	}
+}
+
+func TestValidateFeatureFlags(t *testing.T) {
+	flags := map[string]FeatureFlagConfig{"new_sink": {}}
+	tests := []struct {
+		name      string
+		cfg       FeatureFlagsConfig
+		sinks     []SinkConfig
+		pipelines []PipelineConfig
+		expectErr string
+	}{
+		{name: "Defined flag", cfg: FeatureFlagsConfig{Flags: flags}, sinks: []SinkConfig{{Type: "file", Path: "x", Flag: "new_sink"}}},
+		{name: "Built-in flag", sinks: []SinkConfig{{Type: "file", Path: "x", Flag: flagMonzoWrites}}},
+		{name: "Invalid name", cfg: FeatureFlagsConfig{Flags: map[string]FeatureFlagConfig{"New Sink": {}}}, expectErr: "invalid flag name"},
+		{name: "Unknown sink flag", sinks: []SinkConfig{{Type: "file", Path: "x", Flag: "new_sink"}}, expectErr: "sink 1: unknown feature flag"},
+		{
+			name:      "Unknown pipeline sink flag",
+			pipelines: []PipelineConfig{{Name: "receipts", Sinks: []SinkConfig{{Type: "file", Path: "x", Flag: "new_sink"}}}},
+			expectErr: "pipeline 'receipts': sink 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFeatureFlags(tt.cfg, tt.sinks, tt.pipelines)
+			if tt.expectErr == "" && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if tt.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tt.expectErr)) {
+				t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestFeatureFlagSetOverrides(t *testing.T) {
+	originalConfig := eventConfig
+	defer func() { eventConfig = originalConfig }()
+	eventConfig = EventConfig{FeatureFlags: FeatureFlagsConfig{Flags: map[string]FeatureFlagConfig{"new_sink": {}}}}
+
+	fake, client := newFakeRedis(t)
+	flags := newFeatureFlagSet(client)
+	if err := flags.set(context.Background(), "new_sink", true); err != nil {
+		t.Fatal(err)
+	}
+	if flag := flags.get("new_sink"); !flag.Enabled || flag.Source != "redis" {
+		t.Errorf("Expected the override to turn the flag on, got %+v", flag)
+	}
+	if testutil.ToFloat64(featureFlagState.WithLabelValues("new_sink", "on", "redis")) != 1 || testutil.ToFloat64(featureFlagState.WithLabelValues("new_sink", "off", "default")) != 0 {
+		t.Error("Expected the metrics to record the flag's new state")
+	}
+
+	// Another instance picks the override up from Redis
+	other := newFeatureFlagSet(client)
+	if err := other.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !other.enabled("new_sink") {
+		t.Error("Expected the override to be loaded from Redis")
+	}
+
+	fake.mu.Lock()
+	fake.hashes[defaultFeatureFlagsKey]["monzo_writes"] = "maybe"
+	fake.mu.Unlock()
+	if err := other.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if flag := other.get(flagMonzoWrites); flag.Source != "default" {
+		t.Errorf("Expected an invalid override to be ignored, got %+v", flag)
+	}
+
+	if removed, err := flags.clear(context.Background(), "new_sink"); err != nil || !removed {
+		t.Fatalf("Expected the override to be removed, got %t %v", removed, err)
+	}
+	if err := other.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if other.enabled("new_sink") {
+		t.Error("Expected the flag to be off once the override is removed")
+	}
+	if removed, _ := flags.clear(context.Background(), "new_sink"); removed {
+		t.Error("Expected nothing to remove")
+	}
+}
+
+func TestFeatureFlagGates(t *testing.T) {
+	originalConfig, originalFlags := eventConfig, featureFlags
+	defer func() { eventConfig, featureFlags = originalConfig, originalFlags }()
+	eventConfig = EventConfig{FeatureFlags: FeatureFlagsConfig{Flags: map[string]FeatureFlagConfig{"new_sink": {}}}}
+	featureFlags = newFeatureFlagSet(nil)
+
+	t.Run("Sinks", func(t *testing.T) {
+		gated := &fakeSink{name: "gated"}
+		entries := []sinkEntry{{sink: gated, flag: "new_sink"}}
+		event := newWebhookEvent("transaction.created", []byte(`{"type":"transaction.created"}`), map[string]interface{}{"type": "transaction.created"}, nil, "")
+		publishToSinks(context.Background(), entries, nil, event)
+		if gated.count() != 0 {
+			t.Error("Expected the sink to be skipped while its flag is off")
+		}
+		featureFlags.set(context.Background(), "new_sink", true)
+		publishToSinks(context.Background(), entries, nil, event)
+		if gated.count() != 1 {
+			t.Error("Expected the sink to be published to once its flag is on")
+		}
+	})
+
+	t.Run("Monzo writes", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(`{}`))
+		}))
+		defer server.Close()
+		client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+
+		featureFlags.set(context.Background(), flagMonzoWrites, false)
+		before := testutil.ToFloat64(featureFlagGated.WithLabelValues(flagMonzoWrites))
+		if err := client.do(context.Background(), "register_webhook", http.MethodPost, "/webhooks", nil, nil); !errors.Is(err, errMonzoWritesDisabled) {
+			t.Errorf("Expected writes to be disabled, got %v", err)
+		}
+		if err := client.do(context.Background(), "whoami", http.MethodGet, "/ping/whoami", nil, nil); err != nil {
+			t.Errorf("Expected reads to be allowed, got %v", err)
+		}
+		if requests != 1 || testutil.ToFloat64(featureFlagGated.WithLabelValues(flagMonzoWrites)) != before+1 {
+			t.Errorf("Expected only the read to be sent and the write to be counted, got %d requests", requests)
+		}
+	})
+}
+
+func TestAdminFeatureFlagHandler(t *testing.T) {
+	originalFlags := featureFlags
+	defer func() { featureFlags = originalFlags }()
+	featureFlags = newFeatureFlagSet(nil)
+
+	tests := []struct {
+		name   string
+		method string
+		flag   string
+		body   string
+		expect int
+	}{
+		{name: "Override", method: http.MethodPut, flag: "async_processing", body: `{"enabled": false}`, expect: http.StatusOK},
+		{name: "No value", method: http.MethodPut, flag: "async_processing", body: `{}`, expect: http.StatusBadRequest},
+		{name: "Invalid name", method: http.MethodPut, flag: "Async", body: `{"enabled": true}`, expect: http.StatusBadRequest},
+		{name: "Remove", method: http.MethodDelete, flag: "async_processing", expect: http.StatusNoContent},
+		{name: "Not overridden", method: http.MethodDelete, flag: "async_processing", expect: http.StatusNotFound},
+		{name: "Wrong method", method: http.MethodPost, flag: "async_processing", expect: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/admin/feature-flags/"+tt.flag, strings.NewReader(tt.body))
+			r.SetPathValue("name", tt.flag)
+			w := httptest.NewRecorder()
+			adminFeatureFlagHandler(w, r)
+			if w.Code != tt.expect {
+				t.Errorf("Expected status %d, got %d: %s", tt.expect, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var eventsFiltered = metrics.newCounterVec("monzo_webhook_events_filtered_total",
+	"Webhook events acknowledged but not published because of the event_types, publish_when or rules filters, by type.", "type")
+
+// EventTypeFilter selects the event types that are published. Patterns are
+// event types, or prefixes ending in *, such as transaction.*. Events that
+// aren't selected are acknowledged to Monzo but dropped.
+type EventTypeFilter struct {
+	// Allow lists the types that are published. All types are when empty.
+	Allow []string `json:"allow"`
+	// Deny lists types that aren't published, even if allowed
+	Deny []string `json:"deny"`
+}
+
+func (f EventTypeFilter) validate() error {
+	for _, list := range []struct {
+		name     string
+		patterns []string
+	}{{"allow", f.Allow}, {"deny", f.Deny}} {
+		for i, pattern := range list.patterns {
+			if pattern == "" {
+				return fmt.Errorf("event_types.%s[%d] is empty", list.name, i)
+			}
+			if strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+				return fmt.Errorf("event_types.%s[%d] '%s' can only have * at the end", list.name, i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether events of a type are published
+func (f EventTypeFilter) allows(eventType string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if (PriorityRule{Type: pattern}).matches(eventType, nil) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.Allow) > 0 && !matches(f.Allow) {
+		return false
+	}
+	return !matches(f.Deny)
+}
+
+// filteredBy returns the config section that stops an event from being
+// published, or "" if it's published
+func filteredBy(cfg EventConfig, eventType string, payload map[string]interface{}) string {
+	if !cfg.EventTypes.allows(eventType) {
+		return "event_types"
+	}
+	if !matchesAny(cfg.PublishWhen, eventType, payload) {
+		return "publish_when"
+	}
+	if rule := droppingRule(cfg.Rules, payload); rule != nil {
+		return "rules"
+	}
+	return ""
+}
+
+// EventRule selects events by type and the value of a numeric field, such as
+// transactions where data.amount is at least 500 either way. An event matches
+// when it's of the rule's type and the field meets every comparison given.
+type EventRule struct {
+	// Type is an event type, or a prefix ending in *. Any type matches when
+	// it's empty.
+	Type  string `json:"type"`
+	Field string `json:"field"`
+	// Abs compares the field's absolute value, since Monzo reports spending
+	// as negative amounts
+	Abs bool     `json:"abs"`
+	GT  *float64 `json:"gt"`
+	GTE *float64 `json:"gte"`
+	LT  *float64 `json:"lt"`
+	LTE *float64 `json:"lte"`
+	// Exists matches events where the field is set to any value, such as a
+	// transaction's decline reason, rather than comparing it
+	Exists bool `json:"exists"`
+}
+
+// validateEventRules checks the rules of a config section, named in errors
+func validateEventRules(section string, rules []EventRule) error {
+	for i, rule := range rules {
+		compares := rule.GT != nil || rule.GTE != nil || rule.LT != nil || rule.LTE != nil
+		switch {
+		case rule.Type == "" && rule.Field == "":
+			return fmt.Errorf("%s rule %d must have a type or field", section, i+1)
+		case strings.Contains(strings.TrimSuffix(rule.Type, "*"), "*"):
+			return fmt.Errorf("%s rule %d: type '%s' can only have * at the end", section, i+1, rule.Type)
+		case rule.Exists && (compares || rule.Abs):
+			return fmt.Errorf("%s rule %d: exists can't be combined with comparisons", section, i+1)
+		case rule.Field != "" && !compares && !rule.Exists:
+			return fmt.Errorf("%s rule %d: field '%s' needs a comparison (gt, gte, lt or lte) or exists", section, i+1, rule.Field)
+		case rule.Field == "" && (compares || rule.Abs || rule.Exists):
+			return fmt.Errorf("%s rule %d: comparisons need a field", section, i+1)
+		}
+	}
+	return nil
+}
+
+// matches reports whether an event matches the rule. Events without the
+// field, or where it isn't a number, don't. With exists, any value other
+// than null or an empty string does.
+func (r EventRule) matches(eventType string, payload map[string]interface{}) bool {
+	if r.Type != "" && !(PriorityRule{Type: r.Type}).matches(eventType, nil) {
+		return false
+	}
+	if r.Field == "" {
+		return true
+	}
+	value, ok := lookupField(payload, r.Field)
+	if !ok {
+		return false
+	}
+	if r.Exists {
+		return value != nil && value != ""
+	}
+	n, ok := value.(float64)
+	if !ok {
+		return false
+	}
+	if r.Abs && n < 0 {
+		n = -n
+	}
+	return (r.GT == nil || n > *r.GT) && (r.GTE == nil || n >= *r.GTE) &&
+		(r.LT == nil || n < *r.LT) && (r.LTE == nil || n <= *r.LTE)
+}
+
+// matchesAny reports whether an event matches any of the rules, or true if
+// there are none
+func matchesAny(rules []EventRule, eventType string, payload map[string]interface{}) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if rule.matches(eventType, payload) {
+			return true
+		}
+	}
+	return false
+}
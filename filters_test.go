@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEventTypeFilterAllows(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    EventTypeFilter
+		eventType string
+		expect    bool
+	}{
+		{name: "No filter", eventType: "account.updated", expect: true},
+		{name: "Allowed type", filter: EventTypeFilter{Allow: []string{"transaction.created"}}, eventType: "transaction.created", expect: true},
+		{name: "Type not allowed", filter: EventTypeFilter{Allow: []string{"transaction.created"}}, eventType: "transaction.updated", expect: false},
+		{name: "Allowed prefix", filter: EventTypeFilter{Allow: []string{"transaction.*"}}, eventType: "transaction.updated", expect: true},
+		{name: "Denied type", filter: EventTypeFilter{Deny: []string{"account.*"}}, eventType: "account.updated", expect: false},
+		{name: "Deny overrides allow", filter: EventTypeFilter{Allow: []string{"transaction.*"}, Deny: []string{"transaction.updated"}}, eventType: "transaction.updated", expect: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.allows(tt.eventType); got != tt.expect {
+				t.Errorf("Expected allows(%q) = %v, got %v", tt.eventType, tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestEventTypeFilterValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter EventTypeFilter
+		hasErr bool
+	}{
+		{name: "Empty"},
+		{name: "Types and prefixes", filter: EventTypeFilter{Allow: []string{"transaction.*"}, Deny: []string{"transaction.updated"}}},
+		{name: "Empty pattern", filter: EventTypeFilter{Deny: []string{""}}, hasErr: true},
+		{name: "Wildcard in the middle", filter: EventTypeFilter{Allow: []string{"*.created"}}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.validate(); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error: %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerEventTypeFilter(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	origStore := storedEvents
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+		storedEvents = origStore
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+
+	basicAuthUsername, basicAuthPassword = "", ""
+	storedEvents = newReplayStore(t)
+	sink := &fakeSink{name: "redis"}
+	sinks = []sinkEntry{{sink: sink, required: true}}
+	threshold := 500.0
+	eventConfig = EventConfig{
+		EventTypes:  EventTypeFilter{Allow: []string{"transaction.*"}, Deny: []string{"transaction.updated"}},
+		PublishWhen: []EventRule{{Type: "transaction.*", Field: "data.amount", Abs: true, GTE: &threshold}},
+	}
+
+	before := testutil.ToFloat64(eventsFiltered.WithLabelValues("transaction.updated"))
+	beforeSmall := testutil.ToFloat64(eventsFiltered.WithLabelValues("transaction.created"))
+	for _, body := range []string{
+		`{"type":"transaction.created","data":{"id":"tx_1","amount":-2500}}`,
+		`{"type":"transaction.created","data":{"id":"tx_2","amount":-120}}`,
+		`{"type":"transaction.updated","data":{"id":"tx_1","amount":-2500}}`,
+	} {
+		rr := httptest.NewRecorder()
+		webhookHandler(rr, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body)))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected every event to be acknowledged, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	if len(sink.events) != 1 || sink.events[0].Type != "transaction.created" {
+		t.Errorf("Expected only the large transaction.created event to be published, got %d events", len(sink.events))
+	}
+	if testutil.ToFloat64(eventsFiltered.WithLabelValues("transaction.updated"))-before != 1 || testutil.ToFloat64(eventsFiltered.WithLabelValues("transaction.created"))-beforeSmall != 1 {
+		t.Error("Expected the filtered events to be counted")
+	}
+
+	// Every event is stored, with the section that filtered it out
+	var filtered []string
+	storedEvents.each(func(event storedEvent) error {
+		filtered = append(filtered, event.FilteredBy)
+		return nil
+	})
+	if fmt.Sprintf("%q", filtered) != `["" "publish_when" "event_types"]` {
+		t.Errorf("Expected the filter outcomes to be stored, got %q", filtered)
+	}
+}
+
+func TestEventRuleMatches(t *testing.T) {
+	threshold, ceiling := 500.0, 10000.0
+	payload := func(amount interface{}) map[string]interface{} {
+		return map[string]interface{}{"data": map[string]interface{}{"amount": amount}}
+	}
+
+	tests := []struct {
+		name      string
+		rule      EventRule
+		eventType string
+		payload   map[string]interface{}
+		expect    bool
+	}{
+		{name: "Type only", rule: EventRule{Type: "balance.*"}, eventType: "balance.updated", expect: true},
+		{name: "Other type", rule: EventRule{Type: "transaction.*", Field: "data.amount", GTE: &threshold}, eventType: "balance.updated", payload: payload(1000.0), expect: false},
+		{name: "Large income", rule: EventRule{Field: "data.amount", Abs: true, GTE: &threshold}, eventType: "transaction.created", payload: payload(1000.0), expect: true},
+		{name: "Large spend", rule: EventRule{Field: "data.amount", Abs: true, GTE: &threshold}, eventType: "transaction.created", payload: payload(-500.0), expect: true},
+		{name: "Small spend", rule: EventRule{Field: "data.amount", Abs: true, GTE: &threshold}, eventType: "transaction.created", payload: payload(-499.0), expect: false},
+		{name: "Spend without abs", rule: EventRule{Field: "data.amount", GTE: &threshold}, eventType: "transaction.created", payload: payload(-1000.0), expect: false},
+		{name: "Range", rule: EventRule{Field: "data.amount", Abs: true, GT: &threshold, LTE: &ceiling}, eventType: "transaction.created", payload: payload(-20000.0), expect: false},
+		{name: "Missing field", rule: EventRule{Field: "data.amount", GTE: &threshold}, eventType: "transaction.created", payload: map[string]interface{}{}, expect: false},
+		{name: "Not a number", rule: EventRule{Field: "data.amount", GTE: &threshold}, eventType: "transaction.created", payload: payload("lots"), expect: false},
+		{name: "Exists", rule: EventRule{Field: "data.amount", Exists: true}, eventType: "transaction.created", payload: payload("INSUFFICIENT_FUNDS"), expect: true},
+		{name: "Exists but empty", rule: EventRule{Field: "data.amount", Exists: true}, eventType: "transaction.created", payload: payload(""), expect: false},
+		{name: "Doesn't exist", rule: EventRule{Field: "data.amount", Exists: true}, eventType: "transaction.created", payload: map[string]interface{}{}, expect: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(tt.eventType, tt.payload); got != tt.expect {
+				t.Errorf("Expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestValidateEventRules(t *testing.T) {
+	threshold := 500.0
+	tests := []struct {
+		name   string
+		rules  []EventRule
+		hasErr bool
+	}{
+		{name: "No rules"},
+		{name: "Type and comparison", rules: []EventRule{{Type: "transaction.*", Field: "data.amount", Abs: true, GTE: &threshold}, {Type: "balance.updated"}}},
+		{name: "Empty rule", rules: []EventRule{{}}, hasErr: true},
+		{name: "Field without comparison", rules: []EventRule{{Field: "data.amount"}}, hasErr: true},
+		{name: "Comparison without field", rules: []EventRule{{Type: "transaction.created", GTE: &threshold}}, hasErr: true},
+		{name: "Wildcard in the middle", rules: []EventRule{{Type: "*.created"}}, hasErr: true},
+		{name: "Exists", rules: []EventRule{{Type: "transaction.created", Field: "data.decline_reason", Exists: true}}},
+		{name: "Exists with a comparison", rules: []EventRule{{Field: "data.amount", Exists: true, GTE: &threshold}}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateEventRules("publish_when", tt.rules); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error: %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
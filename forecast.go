@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+	"github.com/redis/go-redis/v9"
+)
+
+// ForecastConfig configures the cashflow forecast, which projects account
+// balances from recurring payments found in the transaction history
+type ForecastConfig struct {
+	Enabled     bool   `json:"enabled"`
+	HistoryDays int    `json:"history_days"`
+	HorizonDays int    `json:"horizon_days"`
+	PublishAt   string `json:"publish_at"`
+}
+
+// forecastEventType is the type of the daily forecast events
+const forecastEventType = "forecast.daily"
+
+// minRecurringOccurrences is how many times a payment must be seen before it
+// is treated as recurring
+const minRecurringOccurrences = 3
+
+// recurringCadence is a schedule that recurring payments can follow, matched
+// by the number of days between payments
+type recurringCadence struct {
+	name     string
+	min, max float64
+	next     func(time.Time) time.Time
+}
+
+var recurringCadences = []recurringCadence{
+	{name: "weekly", min: 6, max: 8, next: func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }},
+	{name: "fortnightly", min: 13, max: 15, next: func(t time.Time) time.Time { return t.AddDate(0, 0, 14) }},
+	{name: "monthly", min: 27, max: 33, next: func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+}
+
+// recurringPayment is a payment that repeats on a regular cadence. Amounts
+// are in minor units, negative for debits.
+type recurringPayment struct {
+	Description string    `json:"description"`
+	Cadence     string    `json:"cadence"`
+	Amount      int64     `json:"amount"`
+	Occurrences int       `json:"occurrences"`
+	Last        time.Time `json:"last"`
+	Next        time.Time `json:"next"`
+
+	cadence recurringCadence
+}
+
+// forecastDay is the projected balance at the end of a day
+type forecastDay struct {
+	Date     string   `json:"date"`
+	Change   int64    `json:"change"`
+	Balance  int64    `json:"balance"`
+	Payments []string `json:"payments,omitempty"`
+}
+
+// accountForecast is the projected balance of an account over the horizon.
+// Without a known balance, the projection starts from zero and shows the net
+// change.
+type accountForecast struct {
+	AccountID       string             `json:"account_id"`
+	Currency        string             `json:"currency"`
+	Generated       time.Time          `json:"generated"`
+	StartingBalance int64              `json:"starting_balance"`
+	BalanceKnown    bool               `json:"balance_known"`
+	Recurring       []recurringPayment `json:"recurring"`
+	Days            []forecastDay      `json:"days"`
+}
+
+// forecaster builds cashflow forecasts from transaction history
+type forecaster struct {
+	cfg     ForecastConfig
+	history func(ctx context.Context, since time.Time) ([]monzo.Transaction, error)
+	now     func() time.Time
+}
+
+// cashflowForecaster is set when the forecast is enabled
+var cashflowForecaster *forecaster
+
+// validate checks the forecast configuration for invalid values
+func (c ForecastConfig) validate(stream StreamConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if stream.Name == "" {
+		return fmt.Errorf("forecast requires stream.name, as history is read from the Redis stream")
+	}
+	if c.HistoryDays < 0 || c.HorizonDays < 0 {
+		return fmt.Errorf("forecast history_days and horizon_days must not be negative")
+	}
+	if c.PublishAt != "" {
+		if _, err := time.Parse("15:04", c.PublishAt); err != nil {
+			return fmt.Errorf("forecast publish_at must be HH:MM")
+		}
+	}
+	return nil
+}
+
+// historyDays returns how far back history is read, defaulting to 120 days
+// so that monthly payments are seen at least three times
+func (c ForecastConfig) historyDays() int {
+	if c.HistoryDays == 0 {
+		return 120
+	}
+	return c.HistoryDays
+}
+
+// horizonDays returns how many days ahead are projected, defaulting to 30
+func (c ForecastConfig) horizonDays() int {
+	if c.HorizonDays == 0 {
+		return 30
+	}
+	return c.HorizonDays
+}
+
+// errHistoryTrimmed is returned when part of the requested transaction
+// history has been trimmed from the Redis stream
+var errHistoryTrimmed = errors.New("the Redis stream has been trimmed since the start of the requested history")
+
+// transactionHistory returns the history function for forecasts and exports:
+// the stored events when an event source is configured, as they aren't
+// trimmed, or else the Redis stream. It returns nil if there is neither.
+func transactionHistory(source eventSource, client *redis.Client, stream string) func(context.Context, time.Time) ([]monzo.Transaction, error) {
+	switch {
+	case source != nil:
+		return storedTransactionHistory(source)
+	case client != nil && stream != "":
+		return streamTransactionHistory(client, stream)
+	}
+	return nil
+}
+
+// storedTransactionHistory returns a history function that reads the stored
+// transaction.created events
+func storedTransactionHistory(source eventSource) func(context.Context, time.Time) ([]monzo.Transaction, error) {
+	return func(ctx context.Context, since time.Time) ([]monzo.Transaction, error) {
+		return storedTransactions(ctx, source, since, clock.Now(), "")
+	}
+}
+
+// streamTransactionHistory returns a history function that reads the
+// transaction.created events in a Redis stream. Stream entry IDs start with
+// the time they were added, so only the entries since then are read. If
+// entries since then have been trimmed, by max_len or max_age, it returns
+// errHistoryTrimmed rather than a partial history.
+func streamTransactionHistory(client *redis.Client, stream string) func(context.Context, time.Time) ([]monzo.Transaction, error) {
+	return func(ctx context.Context, since time.Time) ([]monzo.Transaction, error) {
+		info, err := client.XInfoStream(ctx, stream).Result()
+		if err != nil {
+			// XINFO STREAM fails on a stream that was never created
+			if exists, existsErr := client.Exists(ctx, stream).Result(); existsErr == nil && exists == 0 {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if streamTrimmedSince(info.MaxDeletedEntryID, since) {
+			return nil, errHistoryTrimmed
+		}
+
+		entries, err := client.XRange(ctx, stream, strconv.FormatInt(since.UnixMilli(), 10), "+").Result()
+		if err != nil {
+			return nil, err
+		}
+
+		var transactions []monzo.Transaction
+		for _, entry := range entries {
+			if entry.Values["type"] != monzo.TypeTransactionCreated {
+				continue
+			}
+			payload, _ := entry.Values["payload"].(string)
+			event, err := monzo.Decode([]byte(payload))
+			if err != nil {
+				continue
+			}
+			tx, err := event.Transaction()
+			if err != nil {
+				continue
+			}
+			transactions = append(transactions, *tx)
+		}
+		return transactions, nil
+	}
+}
+
+// streamTrimmedSince reports whether the last entry removed from a stream,
+// as given by XINFO STREAM, was added at or after since. Redis before 7.0
+// doesn't report it, so those streams are never seen as trimmed.
+func streamTrimmedSince(maxDeletedEntryID string, since time.Time) bool {
+	if maxDeletedEntryID == "" || maxDeletedEntryID == "0-0" {
+		return false
+	}
+	deleted, err := streamIDTime(maxDeletedEntryID)
+	return err == nil && deleted.UnixMilli() >= since.UnixMilli()
+}
+
+// forecast builds a forecast for each account in the history, or only the
+// given account if accountID is set. A non-nil balance replaces the latest
+// balance seen in the history.
+func (f *forecaster) forecast(ctx context.Context, accountID string, balance *int64) ([]accountForecast, error) {
+	now := f.now().UTC()
+	transactions, err := f.history(ctx, now.AddDate(0, 0, -f.cfg.historyDays()))
+	if err != nil {
+		return nil, err
+	}
+
+	byAccount := make(map[string][]monzo.Transaction)
+	for _, tx := range transactions {
+		if tx.IsDeclined() || tx.Amount == 0 || (accountID != "" && tx.AccountID != accountID) {
+			continue
+		}
+		byAccount[tx.AccountID] = append(byAccount[tx.AccountID], tx)
+	}
+	if accountID != "" && len(byAccount) == 0 {
+		byAccount[accountID] = nil
+	}
+
+	forecasts := make([]accountForecast, 0, len(byAccount))
+	for id, txs := range byAccount {
+		forecasts = append(forecasts, f.accountForecast(id, txs, balance, now))
+	}
+	sort.Slice(forecasts, func(i, j int) bool { return forecasts[i].AccountID < forecasts[j].AccountID })
+	return forecasts, nil
+}
+
+// accountForecast projects an account's balance from its transactions
+func (f *forecaster) accountForecast(accountID string, txs []monzo.Transaction, balance *int64, now time.Time) accountForecast {
+	sort.Slice(txs, func(i, j int) bool { return txs[i].Created.Before(txs[j].Created) })
+
+	result := accountForecast{AccountID: accountID, Generated: now, Recurring: []recurringPayment{}}
+	if len(txs) > 0 {
+		result.Currency = txs[len(txs)-1].Currency
+	}
+	for i := len(txs) - 1; i >= 0; i-- {
+		if txs[i].AccountBalance != nil {
+			result.StartingBalance, result.BalanceKnown = *txs[i].AccountBalance, true
+			break
+		}
+	}
+	if balance != nil {
+		result.StartingBalance, result.BalanceKnown = *balance, true
+	}
+
+	horizon := now.AddDate(0, 0, f.cfg.horizonDays())
+	changes := make(map[string]int64)
+	payments := make(map[string][]string)
+	for _, payment := range detectRecurringPayments(txs, result.Currency, now) {
+		result.Recurring = append(result.Recurring, payment)
+		for next := payment.Next; next.Before(horizon); next = payment.cadence.next(next) {
+			date := next.Format("2006-01-02")
+			changes[date] += payment.Amount
+			payments[date] = append(payments[date], payment.Description)
+		}
+	}
+
+	running := result.StartingBalance
+	for i := 1; i <= f.cfg.horizonDays(); i++ {
+		date := now.AddDate(0, 0, i).Format("2006-01-02")
+		running += changes[date]
+		result.Days = append(result.Days, forecastDay{
+			Date:     date,
+			Change:   changes[date],
+			Balance:  running,
+			Payments: payments[date],
+		})
+	}
+	return result
+}
+
+// detectRecurringPayments finds payments in a currency that repeat on one of
+// the recurring cadences, sorted by when they are next due. Payments are
+// grouped by merchant, or by description when there is no merchant, and by
+// whether they are debits or credits. Payments that have missed two due dates
+// are treated as cancelled.
+func detectRecurringPayments(txs []monzo.Transaction, currency string, now time.Time) []recurringPayment {
+	groups := make(map[string][]monzo.Transaction)
+	var keys []string
+	for _, tx := range txs {
+		if tx.Currency != currency {
+			continue
+		}
+		key := strings.ToLower(tx.Description)
+		if tx.Merchant != nil && tx.Merchant.ID != "" {
+			key = tx.Merchant.ID
+		}
+		if tx.Amount < 0 {
+			key = "debit:" + key
+		} else {
+			key = "credit:" + key
+		}
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], tx)
+	}
+
+	var recurring []recurringPayment
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < minRecurringOccurrences {
+			continue
+		}
+		cadence, ok := matchCadence(group)
+		if !ok {
+			continue
+		}
+
+		last := group[len(group)-1]
+		next := cadence.next(last.Created)
+		if cadence.next(next).Before(now) {
+			continue
+		}
+		for !next.After(now) {
+			next = cadence.next(next)
+		}
+
+		payment := recurringPayment{
+			Description: last.Description,
+			Cadence:     cadence.name,
+			Amount:      medianAmount(group),
+			Occurrences: len(group),
+			Last:        last.Created,
+			Next:        next,
+			cadence:     cadence,
+		}
+		if last.Merchant != nil && last.Merchant.Name != "" {
+			payment.Description = last.Merchant.Name
+		}
+		recurring = append(recurring, payment)
+	}
+	sort.Slice(recurring, func(i, j int) bool { return recurring[i].Next.Before(recurring[j].Next) })
+	return recurring
+}
+
+// matchCadence returns the cadence that every gap between the transactions
+// falls within, if there is one. The transactions must be in time order.
+func matchCadence(txs []monzo.Transaction) (recurringCadence, bool) {
+	for _, cadence := range recurringCadences {
+		matched := true
+		for i := 1; i < len(txs); i++ {
+			days := txs[i].Created.Sub(txs[i-1].Created).Hours() / 24
+			if days < cadence.min || days > cadence.max {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return cadence, true
+		}
+	}
+	return recurringCadence{}, false
+}
+
+// medianAmount returns the median amount of the transactions, so that a one
+// off difference doesn't skew the forecast
+func medianAmount(txs []monzo.Transaction) int64 {
+	amounts := make([]int64, len(txs))
+	for i, tx := range txs {
+		amounts[i] = tx.Amount
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+	return amounts[len(amounts)/2]
+}
+
+// statsForecastHandler returns the cashflow forecast. The account_id query
+// parameter limits it to one account, and balance sets that account's
+// current balance in minor units.
+func statsForecastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	accountID := r.URL.Query().Get("account_id")
+	var balance *int64
+	if value := r.URL.Query().Get("balance"); value != "" {
+		if accountID == "" {
+			http.Error(w, "balance requires account_id", http.StatusBadRequest)
+			return
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "balance must be an integer amount in minor units", http.StatusBadRequest)
+			return
+		}
+		balance = &n
+	}
+
+	forecasts, err := cashflowForecaster.forecast(r.Context(), accountID, balance)
+	if err != nil {
+		logError("Error building cashflow forecast: %v", err)
+		if errors.Is(err, errHistoryTrimmed) {
+			http.Error(w, "Transaction history is incomplete: "+err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error reading transaction history", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"accounts": forecasts})
+}
+
+// nextForecastRun returns when the daily forecast should next be published
+func nextForecastRun(at string, now time.Time) time.Time {
+	t, _ := time.Parse("15:04", at)
+	run := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !run.After(now) {
+		run = run.AddDate(0, 0, 1)
+	}
+	return run
+}
+
+// publishForecasts publishes a forecast.daily event for each account through
+// the same pipeline as received webhooks
+func publishForecasts(ctx context.Context, f *forecaster) error {
+	forecasts, err := f.forecast(ctx, "", nil)
+	if err != nil {
+		return err
+	}
+	for _, forecast := range forecasts {
+		body, err := json.Marshal(map[string]interface{}{"type": forecastEventType, "data": forecast})
+		if err != nil {
+			return err
+		}
+		if err := publishGeneratedEvent(forecastEventType, body, "forecast"); err != nil {
+			return err
+		}
+	}
+	logInfo("Published cashflow forecasts for %d accounts", len(forecasts))
+	return nil
+}
+
+// runForecastPublisher publishes the forecasts every day at the configured
+// time until ctx is cancelled
+func runForecastPublisher(ctx context.Context, f *forecaster) {
+	for {
+		if sleepUntil(ctx, clock, nextForecastRun(f.cfg.PublishAt, clock.Now().UTC())) != nil {
+			return
+		}
+
+		if err := publishForecasts(ctx, f); err != nil {
+			logError("Error publishing cashflow forecasts: %v", err)
+		}
+	}
+}
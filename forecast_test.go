@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// forecastHistory returns the transactions for a salary, rent, a gym
+// membership that was cancelled, a weekly shop and some one-off spending
+func forecastHistory() []monzo.Transaction {
+	day := func(month time.Month, d int) time.Time { return time.Date(2026, month, d, 9, 0, 0, 0, time.UTC) }
+	tx := func(created time.Time, description string, amount int64) monzo.Transaction {
+		return monzo.Transaction{AccountID: "acc_1", Currency: "GBP", Created: created, Description: description, Amount: amount}
+	}
+
+	var txs []monzo.Transaction
+	for _, month := range []time.Month{time.June, time.July, time.August, time.September} {
+		txs = append(txs, tx(day(month, 25), "ACME LTD SALARY", 250000))
+		txs = append(txs, tx(day(month, 1), "LANDLORD RENT", -120000))
+	}
+	for _, month := range []time.Month{time.May, time.June, time.July} {
+		txs = append(txs, tx(day(month, 3), "GYM", -3000))
+	}
+	for d := 5; d <= 26; d += 7 {
+		shop := tx(day(time.September, d), "TESCO STORES 1234", -6000)
+		shop.Merchant = &monzo.Merchant{ID: "merch_tesco", Name: "Tesco"}
+		txs = append(txs, shop)
+	}
+	txs = append(txs, tx(day(time.September, 10), "AMAZON", -2599), tx(day(time.September, 20), "AMAZON", -1599))
+
+	balance := int64(500000)
+	txs[len(txs)-1].AccountBalance = &balance
+	return txs
+}
+
+func TestDetectRecurringPayments(t *testing.T) {
+	now := time.Date(2026, time.September, 28, 12, 0, 0, 0, time.UTC)
+	recurring := detectRecurringPayments(forecastHistory(), "GBP", now)
+
+	expected := []struct {
+		description string
+		cadence     string
+		amount      int64
+		next        string
+	}{
+		{description: "LANDLORD RENT", cadence: "monthly", amount: -120000, next: "2026-10-01"},
+		{description: "Tesco", cadence: "weekly", amount: -6000, next: "2026-10-03"},
+		{description: "ACME LTD SALARY", cadence: "monthly", amount: 250000, next: "2026-10-25"},
+	}
+	if len(recurring) != len(expected) {
+		t.Fatalf("Expected %d recurring payments, got %+v", len(expected), recurring)
+	}
+	for i, e := range expected {
+		got := recurring[i]
+		if got.Description != e.description || got.Cadence != e.cadence || got.Amount != e.amount || got.Next.Format("2006-01-02") != e.next {
+			t.Errorf("Expected %s %s %d on %s, got %s %s %d on %s", e.description, e.cadence, e.amount, e.next,
+				got.Description, got.Cadence, got.Amount, got.Next.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestForecast(t *testing.T) {
+	f := &forecaster{
+		cfg: ForecastConfig{Enabled: true, HorizonDays: 30},
+		history: func(ctx context.Context, since time.Time) ([]monzo.Transaction, error) {
+			return forecastHistory(), nil
+		},
+		now: func() time.Time { return time.Date(2026, time.September, 28, 12, 0, 0, 0, time.UTC) },
+	}
+
+	forecasts, err := f.forecast(context.Background(), "", nil)
+	if err != nil {
+		t.Fatalf("forecast failed: %v", err)
+	}
+	if len(forecasts) != 1 {
+		t.Fatalf("Expected one account, got %d", len(forecasts))
+	}
+	forecast := forecasts[0]
+	if !forecast.BalanceKnown || forecast.StartingBalance != 500000 || len(forecast.Days) != 30 {
+		t.Fatalf("Unexpected forecast: %+v", forecast)
+	}
+
+	balances := map[string]int64{}
+	for _, day := range forecast.Days {
+		balances[day.Date] = day.Balance
+	}
+	tests := []struct {
+		date     string
+		expected int64
+	}{
+		{date: "2026-09-29", expected: 500000},
+		{date: "2026-10-01", expected: 380000},
+		{date: "2026-10-03", expected: 374000},
+		{date: "2026-10-24", expected: 356000},
+		{date: "2026-10-25", expected: 606000},
+		{date: "2026-10-28", expected: 606000},
+	}
+	for _, tt := range tests {
+		if balances[tt.date] != tt.expected {
+			t.Errorf("Expected balance %d on %s, got %d", tt.expected, tt.date, balances[tt.date])
+		}
+	}
+
+	// A given balance replaces the one from the history
+	balance := int64(1000)
+	forecasts, _ = f.forecast(context.Background(), "acc_1", &balance)
+	if forecasts[0].StartingBalance != 1000 || forecasts[0].Days[2].Balance != 1000-120000 {
+		t.Errorf("Expected the forecast to start from the given balance, got %+v", forecasts[0].Days[:3])
+	}
+}
+
+func TestStatsForecastHandler(t *testing.T) {
+	origForecaster := cashflowForecaster
+	defer func() { cashflowForecaster = origForecaster }()
+
+	cashflowForecaster = &forecaster{
+		cfg: ForecastConfig{Enabled: true},
+		history: func(ctx context.Context, since time.Time) ([]monzo.Transaction, error) {
+			return forecastHistory(), nil
+		},
+		now: func() time.Time { return time.Date(2026, time.September, 28, 12, 0, 0, 0, time.UTC) },
+	}
+
+	tests := []struct {
+		name             string
+		query            string
+		expectedStatus   int
+		expectedAccounts int
+	}{
+		{name: "All accounts", expectedStatus: http.StatusOK, expectedAccounts: 1},
+		{name: "Unknown account", query: "?account_id=acc_other", expectedStatus: http.StatusOK, expectedAccounts: 1},
+		{name: "Balance without account", query: "?balance=100", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid balance", query: "?account_id=acc_1&balance=ten", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			statsForecastHandler(rr, httptest.NewRequest(http.MethodGet, "/stats/forecast"+tt.query, nil))
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var response struct {
+				Accounts []accountForecast `json:"accounts"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Error decoding response: %v", err)
+			}
+			if len(response.Accounts) != tt.expectedAccounts {
+				t.Errorf("Expected %d accounts, got %d", tt.expectedAccounts, len(response.Accounts))
+			}
+		})
+	}
+}
+
+func TestForecastConfigValidate(t *testing.T) {
+	stream := StreamConfig{Name: "monzo-events"}
+	tests := []struct {
+		name        string
+		cfg         ForecastConfig
+		stream      StreamConfig
+		expectError bool
+	}{
+		{name: "Disabled", cfg: ForecastConfig{}},
+		{name: "Defaults", cfg: ForecastConfig{Enabled: true}, stream: stream},
+		{name: "Daily event", cfg: ForecastConfig{Enabled: true, PublishAt: "07:00"}, stream: stream},
+		{name: "No stream", cfg: ForecastConfig{Enabled: true}, expectError: true},
+		{name: "Invalid publish_at", cfg: ForecastConfig{Enabled: true, PublishAt: "7am"}, stream: stream, expectError: true},
+		{name: "Negative horizon", cfg: ForecastConfig{Enabled: true, HorizonDays: -1}, stream: stream, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate(tt.stream)
+			if (err != nil) != tt.expectError {
+				t.Errorf("Expected error=%v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestNextForecastRun(t *testing.T) {
+	now := time.Date(2026, time.September, 28, 12, 0, 0, 0, time.UTC)
+	if got := nextForecastRun("07:00", now); !got.Equal(time.Date(2026, time.September, 29, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected tomorrow at 07:00, got %s", got)
+	}
+	if got := nextForecastRun("18:30", now); !got.Equal(time.Date(2026, time.September, 28, 18, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected today at 18:30, got %s", got)
+	}
+}
+
+func TestStoredTransactionHistory(t *testing.T) {
+	originalClock := clock
+	defer func() { clock = originalClock }()
+	clock = newFakeClock(time.Date(2024, 4, 8, 18, 0, 0, 0, time.UTC))
+
+	store, _ := newTestAccountingStore(t, testAccountingTransactions())
+	history := transactionHistory(store, nil, "")
+	if history == nil {
+		t.Fatal("Expected the event store to be read")
+	}
+	txs, err := history(context.Background(), time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ids []string
+	for _, tx := range txs {
+		ids = append(ids, tx.ID)
+	}
+	if got := strings.Join(ids, ","); got != "tx_salary,tx_coffee,tx_joint,tx_after" {
+		t.Errorf("Unexpected transactions %s", got)
+	}
+
+	if transactionHistory(nil, nil, "webhooks") != nil {
+		t.Error("Expected no history without an event store or Redis")
+	}
+}
+
+func TestStreamTrimmedSince(t *testing.T) {
+	since := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name              string
+		maxDeletedEntryID string
+		expected          bool
+	}{
+		{name: "Never trimmed", maxDeletedEntryID: "0-0", expected: false},
+		{name: "Not reported", maxDeletedEntryID: "", expected: false},
+		{name: "Trimmed before", maxDeletedEntryID: "1699999999999-5", expected: false},
+		{name: "Trimmed at", maxDeletedEntryID: "1700000000000-0", expected: true},
+		{name: "Trimmed after", maxDeletedEntryID: "1700000000500-1", expected: true},
+		{name: "Invalid", maxDeletedEntryID: "latest", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamTrimmedSince(tt.maxDeletedEntryID, since); got != tt.expected {
+				t.Errorf("Expected %t, got %t", tt.expected, got)
+			}
+		})
+	}
+}
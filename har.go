@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// harFile is the part of an HTTP Archive used to replay requests
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Request         struct {
+		Method   string      `json:"method"`
+		URL      string      `json:"url"`
+		Headers  []harHeader `json:"headers"`
+		PostData *struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harReplayHeaders are the request headers replayed along with the body.
+// Others, such as Host and Content-Length, describe the original connection.
+var harReplayHeaders = map[string]bool{
+	"authorization":   true,
+	"content-type":    true,
+	"idempotency-key": true,
+	"traceparent":     true,
+	"user-agent":      true,
+}
+
+// harFilter selects the entries of a HAR file to replay
+type harFilter struct {
+	path       string
+	since      time.Time
+	until      time.Time
+	failedOnly bool
+}
+
+// matches reports whether an entry is a webhook delivery to replay
+func (f harFilter) matches(entry harEntry) bool {
+	if entry.Request.Method != http.MethodPost || entry.Request.PostData == nil {
+		return false
+	}
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil || u.Path != f.path {
+		return false
+	}
+	if !f.since.IsZero() && entry.StartedDateTime.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !entry.StartedDateTime.Before(f.until) {
+		return false
+	}
+	// A status of 0 means the proxy got no response
+	delivered := entry.Response.Status >= 200 && entry.Response.Status <= 299
+	return !f.failedOnly || !delivered
+}
+
+// body returns the request body of an entry
+func (e harEntry) body() ([]byte, error) {
+	if e.Request.PostData.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(e.Request.PostData.Text)
+	}
+	return []byte(e.Request.PostData.Text), nil
+}
+
+// replayHAREntry POSTs an entry's body and headers to target, returning the
+// response status
+func replayHAREntry(ctx context.Context, client *http.Client, target string, entry harEntry, username, password string) (int, error) {
+	body, err := entry.body()
+	if err != nil {
+		return 0, fmt.Errorf("invalid body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for _, header := range entry.Request.Headers {
+		if harReplayHeaders[strings.ToLower(header.Name)] {
+			req.Header.Add(header.Name, header.Value)
+		}
+	}
+	if req.Header.Get("Content-Type") == "" && entry.Request.PostData.MimeType != "" {
+		req.Header.Set("Content-Type", entry.Request.PostData.MimeType)
+	}
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// runImportHAR implements the import-har command, which replays the webhook
+// deliveries captured in HAR files, such as by a proxy during an outage, to a
+// running server. They go through its whole pipeline, including idempotency
+// and duplicate suppression. It returns the process exit code, which is 1 if
+// any delivery failed.
+func runImportHAR(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("import-har", flag.ContinueOnError)
+	flags.SetOutput(out)
+	target := flags.String("url", "http://localhost:8080/webhook", "webhook URL of the server to replay to")
+	path := flags.String("path", "/webhook", "path of the webhook requests in the HAR file")
+	since := flags.String("since", "", "only replay requests made at or after this time (RFC 3339)")
+	until := flags.String("until", "", "only replay requests made before this time (RFC 3339)")
+	failedOnly := flags.Bool("failed-only", false, "only replay requests that didn't get a 2xx response")
+	username := flags.String("username", "", "basic authentication username, replacing the captured Authorization header")
+	password := flags.String("password", "", "basic authentication password")
+	dryRun := flags.Bool("dry-run", false, "list the requests that would be replayed without sending them")
+	flags.Usage = func() {
+		fmt.Fprintln(out, "usage: webhook-server import-har [flags] FILE...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	filter := harFilter{path: *path, failedOnly: *failedOnly}
+	for _, t := range []struct {
+		name  string
+		value string
+		into  *time.Time
+	}{{"since", *since, &filter.since}, {"until", *until, &filter.until}} {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			fmt.Fprintf(out, "invalid -%s: %v\n", t.name, err)
+			return 2
+		}
+		*t.into = parsed
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	replayed, failed := 0, 0
+	for _, filename := range flags.Args() {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", filename, err)
+			return 1
+		}
+		var har harFile
+		if err := json.Unmarshal(data, &har); err != nil {
+			fmt.Fprintf(out, "%s: invalid HAR file: %v\n", filename, err)
+			return 1
+		}
+
+		for _, entry := range har.Log.Entries {
+			if !filter.matches(entry) {
+				continue
+			}
+			var event struct {
+				Type string `json:"type"`
+			}
+			body, _ := entry.body()
+			json.Unmarshal(body, &event)
+			prefix := fmt.Sprintf("%s %s", entry.StartedDateTime.UTC().Format(time.RFC3339), event.Type)
+			if *dryRun {
+				fmt.Fprintf(out, "%s: would replay (originally %d)\n", prefix, entry.Response.Status)
+				replayed++
+				continue
+			}
+
+			status, err := replayHAREntry(context.Background(), client, *target, entry, *username, *password)
+			switch {
+			case err != nil:
+				fmt.Fprintf(out, "%s: FAILED: %v\n", prefix, err)
+				failed++
+			case status < 200 || status > 299:
+				fmt.Fprintf(out, "%s: FAILED: %d %s\n", prefix, status, http.StatusText(status))
+				failed++
+			default:
+				fmt.Fprintf(out, "%s: %d %s\n", prefix, status, http.StatusText(status))
+				replayed++
+			}
+		}
+	}
+
+	if *dryRun {
+		fmt.Fprintf(out, "%d requests would be replayed\n", replayed)
+		return 0
+	}
+	fmt.Fprintf(out, "Replayed %d requests, %d failed\n", replayed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
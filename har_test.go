@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testHAR = `{"log": {"entries": [
+	{"startedDateTime": "2024-01-15T10:00:00Z",
+	 "request": {"method": "POST", "url": "https://webhooks.example.com/webhook", "headers": [{"name": "Authorization", "value": "Basic bW9uem86c2VjcmV0"}, {"name": "Host", "value": "webhooks.example.com"}],
+	             "postData": {"mimeType": "application/json", "text": "{\"type\": \"transaction.created\", \"data\": {\"id\": \"tx_1\"}}"}},
+	 "response": {"status": 502}},
+	{"startedDateTime": "2024-01-15T10:05:00Z",
+	 "request": {"method": "POST", "url": "https://webhooks.example.com/webhook",
+	             "postData": {"mimeType": "application/json", "encoding": "base64", "text": "eyJ0eXBlIjogInRyYW5zYWN0aW9uLnVwZGF0ZWQifQ=="}},
+	 "response": {"status": 200}},
+	{"startedDateTime": "2024-01-15T10:06:00Z",
+	 "request": {"method": "GET", "url": "https://webhooks.example.com/readyz"},
+	 "response": {"status": 200}},
+	{"startedDateTime": "2024-01-15T12:00:00Z",
+	 "request": {"method": "POST", "url": "https://webhooks.example.com/webhook",
+	             "postData": {"mimeType": "application/json", "text": "{\"type\": \"transaction.created\", \"data\": {\"id\": \"tx_2\"}}"}},
+	 "response": {"status": 0}}
+]}}`
+
+func TestRunImportHAR(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(body, &event)
+		mu.Lock()
+		received = append(received, event.Type)
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if strings.Contains(string(body), "tx_2") {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "outage.har")
+	if err := os.WriteFile(file, []byte(testHAR), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		code     int
+		received []string
+		output   string
+	}{
+		{
+			name:     "Every delivery",
+			args:     []string{"-url", server.URL, file},
+			code:     1,
+			received: []string{"transaction.created", "transaction.updated", "transaction.created"},
+			output:   "Replayed 2 requests, 1 failed",
+		},
+		{
+			name:     "Failed deliveries in a window",
+			args:     []string{"-url", server.URL, "-failed-only", "-until", "2024-01-15T11:00:00Z", file},
+			code:     0,
+			received: []string{"transaction.created"},
+			output:   "2024-01-15T10:00:00Z transaction.created: 200 OK",
+		},
+		{
+			name:   "Dry run",
+			args:   []string{"-url", server.URL, "-dry-run", "-since", "2024-01-15T10:01:00Z", file},
+			code:   0,
+			output: "2 requests would be replayed",
+		},
+		{name: "Invalid time", args: []string{"-since", "yesterday", file}, code: 2, output: "invalid -since"},
+		{name: "No files", code: 2, output: "usage: webhook-server import-har"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			received, auth = nil, nil
+			mu.Unlock()
+
+			var out strings.Builder
+			if code := runImportHAR(tt.args, &out); code != tt.code {
+				t.Errorf("Expected exit code %d, got %d: %s", tt.code, code, out.String())
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("Expected output to contain '%s', got: %s", tt.output, out.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(received, ",") != strings.Join(tt.received, ",") {
+				t.Errorf("Expected %v to be replayed, got %v", tt.received, received)
+			}
+			if len(auth) > 0 && auth[0] != "Basic bW9uem86c2VjcmV0" {
+				t.Errorf("Expected the captured Authorization header to be replayed, got '%s'", auth[0])
+			}
+		})
+	}
+}
+
+func TestReplayHAREntryCredentials(t *testing.T) {
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+	}))
+	defer server.Close()
+
+	var har harFile
+	if err := json.Unmarshal([]byte(testHAR), &har); err != nil {
+		t.Fatal(err)
+	}
+	status, err := replayHAREntry(t.Context(), server.Client(), server.URL, har.Log.Entries[0], "replay", "new-secret")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d, %v", status, err)
+	}
+	if username != "replay" || password != "new-secret" {
+		t.Errorf("Expected the given credentials to replace the captured ones, got %s:%s", username, password)
+	}
+}
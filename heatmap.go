@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	// Embedded so that timezones load in the scratch image
+	_ "time/tzdata"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+	"github.com/redis/go-redis/v9"
+)
+
+// HeatmapConfig configures the spending heatmap, which buckets spending by
+// day of the week and hour of the day from the Redis stream
+type HeatmapConfig struct {
+	Enabled bool `json:"enabled"`
+	// Timezone is the IANA timezone the days and hours are in, defaulting
+	// to UTC
+	Timezone string `json:"timezone"`
+}
+
+// heatmapPageSize is how many stream entries are read at a time
+const heatmapPageSize = 1000
+
+// heatmapDays names the rows of a heatmap, which start on Monday
+var heatmapDays = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+// validate checks the heatmap configuration for invalid values
+func (c HeatmapConfig) validate(stream StreamConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if stream.Name == "" {
+		return fmt.Errorf("heatmap requires stream.name, as spending is read from the Redis stream")
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("heatmap: unknown timezone '%s'", c.Timezone)
+	}
+	return nil
+}
+
+// heatmapKey is the spending of one category in one currency on one account
+type heatmapKey struct {
+	account, category, currency string
+}
+
+// heatmapCells is spending by day of the week, from Monday, and hour of the
+// day. Spend is in minor units, positive for money spent.
+type heatmapCells struct {
+	spend [7][24]int64
+	count [7][24]int64
+}
+
+// spendHeatmap keeps the spending heatmap, adding the transactions added to
+// the stream since it was last updated rather than reading the whole stream
+// for each request
+type spendHeatmap struct {
+	location *time.Location
+	read     func(ctx context.Context, start string, count int64) ([]redis.XMessage, error)
+
+	mu sync.Mutex
+	// lastID is the ID of the last stream entry read, empty before the
+	// first update
+	lastID      string
+	first, last time.Time
+	cells       map[heatmapKey]*heatmapCells
+}
+
+// spendingHeatmap is set when the heatmap is enabled
+var spendingHeatmap *spendHeatmap
+
+func newSpendHeatmap(cfg HeatmapConfig, client *redis.Client, stream string) *spendHeatmap {
+	location, _ := time.LoadLocation(cfg.Timezone)
+	return &spendHeatmap{
+		location: location,
+		read: func(ctx context.Context, start string, count int64) ([]redis.XMessage, error) {
+			return client.XRangeN(ctx, stream, start, "+", count).Result()
+		},
+		cells: make(map[heatmapKey]*heatmapCells),
+	}
+}
+
+// update adds the spending in the stream entries added since the last
+// update. The first update reads the whole stream.
+func (h *spendHeatmap) update(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		start := "-"
+		if h.lastID != "" {
+			start = "(" + h.lastID
+		}
+		entries, err := h.read(ctx, start, heatmapPageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			h.add(entry)
+			h.lastID = entry.ID
+		}
+		if len(entries) < heatmapPageSize {
+			return nil
+		}
+	}
+}
+
+// add adds a stream entry's transaction to the heatmap if it's spending.
+// Declined transactions, credits and other events are skipped.
+func (h *spendHeatmap) add(entry redis.XMessage) {
+	if entry.Values["type"] != monzo.TypeTransactionCreated {
+		return
+	}
+	payload, _ := entry.Values["payload"].(string)
+	event, err := monzo.Decode([]byte(payload))
+	if err != nil {
+		return
+	}
+	tx, err := event.Transaction()
+	if err != nil || tx.IsDeclined() || tx.Amount >= 0 || tx.Created.IsZero() {
+		return
+	}
+
+	category := tx.Category
+	if category == "" {
+		category = "general"
+	}
+	key := heatmapKey{account: tx.AccountID, category: category, currency: tx.Currency}
+	cells := h.cells[key]
+	if cells == nil {
+		cells = &heatmapCells{}
+		h.cells[key] = cells
+	}
+	local := tx.Created.In(h.location)
+	day := (int(local.Weekday()) + 6) % 7
+	cells.spend[day][local.Hour()] -= tx.Amount
+	cells.count[day][local.Hour()]++
+
+	if h.first.IsZero() || tx.Created.Before(h.first) {
+		h.first = tx.Created
+	}
+	if tx.Created.After(h.last) {
+		h.last = tx.Created
+	}
+}
+
+// heatmapCategory is a category's spending in one currency. Spend and
+// Transactions have a row for each day of the week, from Monday, and a
+// column for each hour of the day.
+type heatmapCategory struct {
+	Category     string      `json:"category"`
+	Currency     string      `json:"currency"`
+	Total        int64       `json:"total"`
+	Count        int64       `json:"count"`
+	Spend        [][24]int64 `json:"spend"`
+	Transactions [][24]int64 `json:"transactions"`
+}
+
+// heatmapResult is the heatmap returned by the endpoint
+type heatmapResult struct {
+	Timezone   string            `json:"timezone"`
+	Days       []string          `json:"days"`
+	From       *time.Time        `json:"from,omitempty"`
+	To         *time.Time        `json:"to,omitempty"`
+	Categories []heatmapCategory `json:"categories"`
+}
+
+// result returns the heatmap of each category, summed over the accounts or
+// limited to one account or category if set, with the most spent first
+func (h *spendHeatmap) result(accountID, category string) heatmapResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := heatmapResult{Timezone: h.location.String(), Days: heatmapDays, Categories: []heatmapCategory{}}
+	if !h.first.IsZero() {
+		from, to := h.first, h.last
+		result.From, result.To = &from, &to
+	}
+	merged := make(map[heatmapKey]*heatmapCells)
+	for key, cells := range h.cells {
+		if (accountID != "" && key.account != accountID) || (category != "" && key.category != category) {
+			continue
+		}
+		key.account = ""
+		sum := merged[key]
+		if sum == nil {
+			sum = &heatmapCells{}
+			merged[key] = sum
+		}
+		for day := range cells.spend {
+			for hour := range cells.spend[day] {
+				sum.spend[day][hour] += cells.spend[day][hour]
+				sum.count[day][hour] += cells.count[day][hour]
+			}
+		}
+	}
+
+	for key, cells := range merged {
+		c := heatmapCategory{Category: key.category, Currency: key.currency, Spend: cells.spend[:], Transactions: cells.count[:]}
+		for day := range cells.spend {
+			for hour := range cells.spend[day] {
+				c.Total += cells.spend[day][hour]
+				c.Count += cells.count[day][hour]
+			}
+		}
+		result.Categories = append(result.Categories, c)
+	}
+	sort.Slice(result.Categories, func(i, j int) bool {
+		a, b := result.Categories[i], result.Categories[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		return a.Currency < b.Currency
+	})
+	return result
+}
+
+// statsHeatmapHandler returns the spending heatmap, first adding the
+// transactions added to the stream since the last request. The account_id
+// and category query parameters limit it to one account or category.
+func statsHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := spendingHeatmap.update(r.Context()); err != nil {
+		logError("Error updating the spending heatmap: %v", err)
+		http.Error(w, "Error reading transaction history", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	writeJSON(w, http.StatusOK, spendingHeatmap.result(query.Get("account_id"), query.Get("category")))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestHeatmapConfigValidate(t *testing.T) {
+	stream := StreamConfig{Name: "monzo-events"}
+	tests := []struct {
+		name   string
+		cfg    HeatmapConfig
+		stream StreamConfig
+		hasErr bool
+	}{
+		{name: "Disabled", cfg: HeatmapConfig{Timezone: "Nowhere/Special"}},
+		{name: "Valid", cfg: HeatmapConfig{Enabled: true, Timezone: "Europe/London"}, stream: stream},
+		{name: "UTC by default", cfg: HeatmapConfig{Enabled: true}, stream: stream},
+		{name: "No stream", cfg: HeatmapConfig{Enabled: true}, hasErr: true},
+		{name: "Unknown timezone", cfg: HeatmapConfig{Enabled: true, Timezone: "Nowhere/Special"}, stream: stream, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(tt.stream); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+// heatmapEntry returns a stream entry for a transaction
+func heatmapEntry(id, account, category string, amount int64, created, declineReason string) redis.XMessage {
+	data, _ := json.Marshal(map[string]interface{}{"type": "transaction.created", "data": map[string]interface{}{
+		"id": "tx_" + id, "account_id": account, "category": category, "amount": amount, "currency": "GBP",
+		"created": created, "description": "SHOP", "decline_reason": declineReason,
+	}})
+	return redis.XMessage{ID: id, Values: map[string]interface{}{"type": "transaction.created", "payload": string(data)}}
+}
+
+func TestSpendHeatmap(t *testing.T) {
+	stream := []redis.XMessage{
+		// Monday 2026-03-02, 08:15 in London (GMT)
+		heatmapEntry("1-0", "acc_1", "eating_out", -350, "2026-03-02T08:15:00Z", ""),
+		heatmapEntry("1-1", "acc_2", "eating_out", -420, "2026-03-02T08:45:00Z", ""),
+		// Income and declined transactions aren't spending
+		heatmapEntry("1-2", "acc_1", "income", 250000, "2026-03-02T09:00:00Z", ""),
+		heatmapEntry("1-3", "acc_1", "eating_out", -999, "2026-03-02T08:30:00Z", "INSUFFICIENT_FUNDS"),
+		{ID: "1-4", Values: map[string]interface{}{"type": "account.balance_updated", "payload": `{"type":"account.balance_updated"}`}},
+	}
+	var reads []string
+	london, _ := time.LoadLocation("Europe/London")
+	h := &spendHeatmap{
+		location: london,
+		read: func(ctx context.Context, start string, count int64) ([]redis.XMessage, error) {
+			reads = append(reads, start)
+			var entries []redis.XMessage
+			for _, entry := range stream {
+				if start == "-" || entry.ID > start[1:] {
+					entries = append(entries, entry)
+				}
+			}
+			return entries, nil
+		},
+		cells: make(map[heatmapKey]*heatmapCells),
+	}
+	if err := h.update(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Saturday 2026-04-04, 19:30 in London (BST), is read by the next update
+	stream = append(stream, heatmapEntry("2-0", "acc_1", "groceries", -6000, "2026-04-04T18:30:00Z", ""))
+	if err := h.update(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fmt.Sprint(reads) != "[- (1-4]" {
+		t.Errorf("Expected only new entries to be read, got %v", reads)
+	}
+
+	result := h.result("", "")
+	if len(result.Categories) != 2 || result.Categories[0].Category != "groceries" || result.Categories[1].Category != "eating_out" {
+		t.Fatalf("Unexpected categories: %+v", result.Categories)
+	}
+	eatingOut := result.Categories[1]
+	if eatingOut.Total != 770 || eatingOut.Count != 2 || eatingOut.Spend[0][8] != 770 || eatingOut.Transactions[0][8] != 2 {
+		t.Errorf("Expected both accounts' spending on Monday at 8am, got %+v", eatingOut)
+	}
+	if groceries := result.Categories[0]; groceries.Spend[5][19] != 6000 {
+		t.Errorf("Expected spending on Saturday at 7pm local time, got %+v", groceries)
+	}
+	if !result.From.Equal(time.Date(2026, 3, 2, 8, 15, 0, 0, time.UTC)) || !result.To.Equal(time.Date(2026, 4, 4, 18, 30, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected range %v to %v", result.From, result.To)
+	}
+
+	if limited := h.result("acc_2", ""); len(limited.Categories) != 1 || limited.Categories[0].Total != 420 {
+		t.Errorf("Expected acc_2's spending only, got %+v", limited.Categories)
+	}
+	if limited := h.result("", "groceries"); len(limited.Categories) != 1 || limited.Categories[0].Category != "groceries" {
+		t.Errorf("Expected groceries only, got %+v", limited.Categories)
+	}
+}
+
+func TestStatsHeatmapHandler(t *testing.T) {
+	original := spendingHeatmap
+	defer func() { spendingHeatmap = original }()
+	spendingHeatmap = &spendHeatmap{
+		location: time.UTC,
+		read: func(ctx context.Context, start string, count int64) ([]redis.XMessage, error) {
+			return nil, fmt.Errorf("connection refused")
+		},
+		cells: make(map[heatmapKey]*heatmapCells),
+	}
+	w := httptest.NewRecorder()
+	statsHeatmapHandler(w, httptest.NewRequest(http.MethodGet, "/stats/heatmap", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", w.Code)
+	}
+
+	spendingHeatmap.read = func(ctx context.Context, start string, count int64) ([]redis.XMessage, error) { return nil, nil }
+	w = httptest.NewRecorder()
+	statsHeatmapHandler(w, httptest.NewRequest(http.MethodGet, "/stats/heatmap", nil))
+	var result heatmapResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK ||
+		result.Timezone != "UTC" || len(result.Days) != 7 || result.Categories == nil || result.From != nil {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
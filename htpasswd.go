@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdFile holds basic authentication credentials loaded from an
+// htpasswd-style file of username:hash lines, so several can be valid at once
+// while credentials are rotated
+type htpasswdFile struct {
+	path string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	entries map[string]string
+}
+
+// webhookCredentials is set when WEBHOOK_HTPASSWD_FILE is configured
+var webhookCredentials *htpasswdFile
+
+// htpasswdFromEnv loads the credentials file named by WEBHOOK_HTPASSWD_FILE.
+// It returns nil if the variable is not set.
+func htpasswdFromEnv() (*htpasswdFile, error) {
+	path := os.Getenv("WEBHOOK_HTPASSWD_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	f := &htpasswdFile{path: path}
+	if err := f.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load re-reads the file if it has changed since it was last loaded. A file
+// with invalid entries is rejected as a whole, keeping the previous
+// credentials.
+func (f *htpasswdFile) load(ctx context.Context) error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	unchanged := f.entries != nil && info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	entries, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	f.entries = entries
+	f.modTime = info.ModTime()
+	f.mu.Unlock()
+	logInfo("Loaded %d webhook credentials from %s", len(entries), f.path)
+	for _, username := range weakHtpasswdUsers(entries) {
+		logWarn("Webhook credentials for '%s' in %s are an unsalted SHA-1 hash - replace them with bcrypt (htpasswd -B)", username, f.path)
+	}
+	return nil
+}
+
+// parseHtpasswd parses username:hash lines, skipping blank lines and
+// comments. Hashes must be in a format verifyHtpasswdHash supports, so plain
+// text passwords are rejected.
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", line)
+		}
+		if !supportedHtpasswdHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash or plain text password for user '%s' (use htpasswd -B)", line, username)
+		}
+		if _, exists := entries[username]; exists {
+			return nil, fmt.Errorf("line %d: duplicate user '%s'", line, username)
+		}
+		entries[username] = hash
+	}
+	return entries, scanner.Err()
+}
+
+// verify reports whether the password is valid for the user
+func (f *htpasswdFile) verify(username, password string) bool {
+	f.mu.RLock()
+	hash, ok := f.entries[username]
+	f.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return verifyHtpasswdHash(hash, password)
+}
+
+// supportedHtpasswdHash reports whether verifyHtpasswdHash can check a hash
+func supportedHtpasswdHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$apr1$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// weakHtpasswdUsers returns the users whose hashes are unsalted SHA-1, which
+// is fast to brute force
+func weakHtpasswdUsers(entries map[string]string) []string {
+	var users []string
+	for username, hash := range entries {
+		if strings.HasPrefix(hash, "{SHA}") {
+			users = append(users, username)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// verifyHtpasswdHash checks a password against an htpasswd hash: bcrypt
+// ($2y$, from htpasswd -B), Apache's MD5 ($apr1$, from htpasswd -m) or
+// SHA-1 ({SHA}, from htpasswd -s)
+func verifyHtpasswdHash(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		computed = apr1Crypt(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1Crypt hashes a password with Apache's variant of the MD5-based crypt
+// algorithm
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	alt := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	// Stretch the hash to slow down brute force attacks
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyHtpasswdHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		expected bool
+	}{
+		{name: "APR1", hash: "$apr1$r31qBk2B$H0sh9u3dgdeDG0c6xRUAt0", password: "secret", expected: true},
+		{name: "APR1 long password", hash: "$apr1$abc$NAIsKPvtOFYH6zh3Xs.hj1", password: "a longer password over sixteen bytes", expected: true},
+		{name: "APR1 wrong password", hash: "$apr1$r31qBk2B$H0sh9u3dgdeDG0c6xRUAt0", password: "Secret", expected: false},
+		{name: "SHA", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "secret", expected: true},
+		{name: "SHA wrong password", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "other", expected: false},
+		{name: "Bcrypt", hash: "$2y$05$AjF1XrdRD/uY5bVnlk1qteyGeuUT51DtxQA4z8S3piss7c6LZDGCi", password: "secret", expected: true},
+		{name: "Bcrypt wrong password", hash: "$2y$05$AjF1XrdRD/uY5bVnlk1qteyGeuUT51DtxQA4z8S3piss7c6LZDGCi", password: "secret2", expected: false},
+		{name: "Plain text", hash: "secret", password: "secret", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyHtpasswdHash(tt.hash, tt.password); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expected    int
+		expectError bool
+	}{
+		{name: "Entries and comments", data: "# rotated 2024-03-01\nmonzo:$apr1$r31qBk2B$H0sh9u3dgdeDG0c6xRUAt0\n\nmonzo-next:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", expected: 2},
+		{name: "Empty", data: "", expected: 0},
+		{name: "Missing hash", data: "monzo\n", expectError: true},
+		{name: "Empty hash", data: "monzo:\n", expectError: true},
+		{name: "Duplicate user", data: "monzo:{SHA}a\nmonzo:{SHA}b\n", expectError: true},
+		{name: "Bcrypt", data: "monzo:$2y$05$AjF1XrdRD/uY5bVnlk1qteyGeuUT51DtxQA4z8S3piss7c6LZDGCi\n", expected: 1},
+		{name: "Plain text", data: "monzo:secret\n", expectError: true},
+		{name: "SHA-512 crypt", data: "monzo:$6$salt$hash\n", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseHtpasswd([]byte(tt.data))
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(entries) != tt.expected {
+				t.Errorf("Expected %d entries, got %d", tt.expected, len(entries))
+			}
+		})
+	}
+}
+
+func TestWeakHtpasswdUsers(t *testing.T) {
+	entries := map[string]string{
+		"monzo":      "$2y$05$AjF1XrdRD/uY5bVnlk1qteyGeuUT51DtxQA4z8S3piss7c6LZDGCi",
+		"monzo-next": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"legacy":     "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+	}
+	if got := weakHtpasswdUsers(entries); len(got) != 2 || got[0] != "legacy" || got[1] != "monzo-next" {
+		t.Errorf("Expected legacy and monzo-next, got %v", got)
+	}
+}
+
+func TestHtpasswdFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(path, []byte("old:$2y$05$AjF1XrdRD/uY5bVnlk1qteyGeuUT51DtxQA4z8S3piss7c6LZDGCi\n"), 0o600)
+	t.Setenv("WEBHOOK_HTPASSWD_FILE", path)
+
+	f, err := htpasswdFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !f.verify("old", "secret") || f.verify("new", "secret") || f.verify("old", "wrong") {
+		t.Error("Unexpected credentials after the first load")
+	}
+
+	// Both credentials are valid while rotating
+	os.WriteFile(path, []byte("old:$2y$05$AjF1XrdRD/uY5bVnlk1qteyGeuUT51DtxQA4z8S3piss7c6LZDGCi\nnew:$apr1$r31qBk2B$H0sh9u3dgdeDG0c6xRUAt0\n"), 0o600)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if err := f.load(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !f.verify("old", "secret") || !f.verify("new", "secret") {
+		t.Error("Expected both credentials to be valid")
+	}
+
+	// An invalid file keeps the previous credentials
+	os.WriteFile(path, []byte("broken\n"), 0o600)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))
+	if err := f.load(context.Background()); err == nil {
+		t.Error("Expected an error for an invalid file")
+	}
+	if !f.verify("new", "secret") {
+		t.Error("Expected the previous credentials to be kept")
+	}
+
+	t.Setenv("WEBHOOK_HTPASSWD_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := htpasswdFromEnv(); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+	t.Setenv("WEBHOOK_HTPASSWD_FILE", "")
+	if f, err := htpasswdFromEnv(); f != nil || err != nil {
+		t.Errorf("Expected no credentials file, got %v, %v", f, err)
+	}
+}
+
+func TestBasicAuthMiddlewareWithHtpasswd(t *testing.T) {
+	origCredentials := webhookCredentials
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		webhookCredentials = origCredentials
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+	basicAuthUsername, basicAuthPassword = "", ""
+	webhookCredentials = &htpasswdFile{entries: map[string]string{
+		"monzo":      "$apr1$r31qBk2B$H0sh9u3dgdeDG0c6xRUAt0",
+		"monzo-next": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+	}}
+
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	tests := []struct {
+		name               string
+		username           string
+		password           string
+		expectedStatusCode int
+	}{
+		{name: "First credentials", username: "monzo", password: "secret", expectedStatusCode: http.StatusOK},
+		{name: "Second credentials", username: "monzo-next", password: "secret", expectedStatusCode: http.StatusOK},
+		{name: "Wrong password", username: "monzo", password: "wrong", expectedStatusCode: http.StatusUnauthorized},
+		{name: "Unknown user", username: "someone", password: "secret", expectedStatusCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			req.SetBasicAuth(tt.username, tt.password)
+			rr := httptest.NewRecorder()
+			basicAuthMiddleware(okHandler)(rr, req)
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatusCode, rr.Code)
+			}
+		})
+	}
+
+	// Requests without credentials are rejected rather than let through
+	rr := httptest.NewRecorder()
+	basicAuthMiddleware(okHandler)(rr, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Headers on forwarded requests
+const (
+	forwardEventIDHeader   = "X-Webhook-Event-ID"
+	forwardEventTypeHeader = "X-Webhook-Event-Type"
+	forwardSignatureHeader = "X-Webhook-Signature"
+)
+
+// Defaults for http sink targets
+const (
+	defaultForwardTimeout   = 5 * time.Second
+	defaultForwardAttempts  = 3
+	defaultForwardThreshold = 5
+	defaultForwardCooldown  = 30 * time.Second
+)
+
+// forwardDeliveredSize is how many recent events an http sink remembers the
+// targets it delivered to, so that a retried publish skips them
+const forwardDeliveredSize = 1000
+
+// errCircuitOpen is returned for a target whose circuit breaker is open
+var errCircuitOpen = errors.New("circuit open")
+
+// forwardBackoff is the backoff between attempts to deliver to a target
+var forwardBackoff = RetryConfig{InitialBackoff: "200ms", MaxBackoff: "2s", Jitter: 0.2}
+
+var (
+	forwardRequests = metrics.newCounterVec("monzo_webhook_http_forwards_total",
+		"Events forwarded by http sinks, by sink, target and result (success, error, rejected, circuit_open).", "sink", "target", "result")
+	forwardCircuitOpen = metrics.newGaugeVec("monzo_webhook_http_target_circuit_open",
+		"1 while an http sink target's circuit breaker is open.", "sink", "target")
+)
+
+// HTTPTargetConfig is a downstream endpoint an http sink forwards events to
+type HTTPTargetConfig struct {
+	// Name is used in logs and metrics, defaulting to the URL's host
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Secret signs each request with an HMAC-SHA256 of its timestamp and
+	// body, if set
+	Secret string `json:"secret"`
+	// Timeout limits each request
+	Timeout string `json:"timeout"`
+	// Attempts is how many times a request is tried, including the first
+	Attempts int `json:"attempts"`
+	// FailureThreshold consecutive failures open the target's circuit
+	// breaker, and requests fail straight away until Cooldown has passed
+	FailureThreshold int    `json:"failure_threshold"`
+	Cooldown         string `json:"cooldown"`
+}
+
+// name returns the target's name, or its URL's host
+func (c HTTPTargetConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if u, err := url.Parse(c.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return c.URL
+}
+
+// validateHTTPTargets checks an http sink's targets
+func validateHTTPTargets(targets []HTTPTargetConfig) error {
+	if len(targets) == 0 {
+		return errors.New("http sinks must have targets")
+	}
+	names := make(map[string]bool)
+	for i, target := range targets {
+		u, err := url.Parse(target.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("target %d: invalid url '%s' (expected an http or https URL)", i+1, redactURL(target.URL))
+		}
+		if names[target.name()] {
+			return fmt.Errorf("target %d: duplicate name '%s'", i+1, target.name())
+		}
+		names[target.name()] = true
+		if _, err := parsePositiveDuration(target.Timeout, defaultForwardTimeout); err != nil {
+			return fmt.Errorf("target '%s': invalid timeout: %w", target.name(), err)
+		}
+		if _, err := parsePositiveDuration(target.Cooldown, defaultForwardCooldown); err != nil {
+			return fmt.Errorf("target '%s': invalid cooldown: %w", target.name(), err)
+		}
+		if target.Attempts < 0 || target.FailureThreshold < 0 {
+			return fmt.Errorf("target '%s': attempts and failure_threshold must not be negative", target.name())
+		}
+	}
+	return nil
+}
+
+// signForwardRequest returns the signature of a forwarded request: an
+// HMAC-SHA256 of the timestamp, a dot and the body
+func signForwardRequest(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// circuitBreaker stops requests to a target after consecutive failures. Once
+// the cooldown has passed, one request is let through to test the target,
+// and the breaker closes if it succeeds or opens again if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a request may be made
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a request, returning whether it opened or
+// closed the breaker
+func (b *circuitBreaker) record(ok bool, now time.Time) (opened, closed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		closed = !b.openUntil.IsZero()
+		b.failures, b.openUntil, b.probing = 0, time.Time{}, false
+		return false, closed
+	}
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		opened = b.openUntil.IsZero()
+		b.openUntil, b.probing = now.Add(b.cooldown), false
+	}
+	return opened, false
+}
+
+// forwardTarget is a target of an http sink with its circuit breaker
+type forwardTarget struct {
+	cfg      HTTPTargetConfig
+	name     string
+	client   *http.Client
+	attempts int
+	breaker  *circuitBreaker
+}
+
+// httpSink forwards events to downstream HTTP endpoints, turning the service
+// into a webhook relay. Each event is sent to every target at once, and each
+// target has its own retries and circuit breaker, so a slow or failing one
+// doesn't hold up the others.
+type httpSink struct {
+	name    string
+	targets []*forwardTarget
+
+	mu sync.Mutex
+	// delivered holds the targets recent events were delivered to, with
+	// the events in order so the oldest can be forgotten
+	delivered map[string]map[string]bool
+	order     []string
+}
+
+// newHTTPSink creates an http sink forwarding to the targets
+func newHTTPSink(name string, targets []HTTPTargetConfig) *httpSink {
+	s := &httpSink{name: name, delivered: make(map[string]map[string]bool)}
+	for _, cfg := range targets {
+		timeout, _ := parsePositiveDuration(cfg.Timeout, defaultForwardTimeout)
+		cooldown, _ := parsePositiveDuration(cfg.Cooldown, defaultForwardCooldown)
+		target := &forwardTarget{
+			cfg:      cfg,
+			name:     cfg.name(),
+			client:   &http.Client{Timeout: timeout},
+			attempts: cfg.Attempts,
+			breaker:  &circuitBreaker{threshold: cfg.FailureThreshold, cooldown: cooldown},
+		}
+		if target.attempts == 0 {
+			target.attempts = defaultForwardAttempts
+		}
+		if target.breaker.threshold == 0 {
+			target.breaker.threshold = defaultForwardThreshold
+		}
+		forwardCircuitOpen.WithLabelValues(name, target.name).Set(0)
+		s.targets = append(s.targets, target)
+	}
+	return s
+}
+
+func (s *httpSink) Name() string { return s.name }
+
+// Publish forwards an event to every target it hasn't already been delivered
+// to, returning the errors of those that failed
+func (s *httpSink) Publish(ctx context.Context, event *webhookEvent) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.targets))
+	for i, target := range s.targets {
+		if s.wasDelivered(event.ID, target.name) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.forward(ctx, target, event); err != nil {
+				errs[i] = fmt.Errorf("target %s: %w", target.name, err)
+				return
+			}
+			s.markDelivered(event.ID, target.name)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// forward sends an event to a target, retrying network errors, 429s and
+// 5xx responses while its circuit breaker allows
+func (s *httpSink) forward(ctx context.Context, target *forwardTarget, event *webhookEvent) error {
+	var err error
+	for attempt := 1; attempt <= target.attempts; attempt++ {
+		if attempt > 1 {
+			if sleepErr := sleepUntil(ctx, clock, clock.Now().Add(forwardBackoff.backoff(attempt-1))); sleepErr != nil {
+				break
+			}
+		}
+		if !target.breaker.allow(clock.Now()) {
+			forwardRequests.WithLabelValues(s.name, target.name, "circuit_open").Inc()
+			return errCircuitOpen
+		}
+
+		var retryable bool
+		retryable, err = s.send(ctx, target, event)
+		if err == nil {
+			forwardRequests.WithLabelValues(s.name, target.name, "success").Inc()
+			s.recordOutcome(target, true)
+			return nil
+		}
+		if !retryable {
+			// The target is up but refused the event, so retrying won't
+			// help and the breaker isn't tripped
+			forwardRequests.WithLabelValues(s.name, target.name, "rejected").Inc()
+			s.recordOutcome(target, true)
+			return err
+		}
+		forwardRequests.WithLabelValues(s.name, target.name, "error").Inc()
+		s.recordOutcome(target, false)
+	}
+	return err
+}
+
+// recordOutcome records a request's outcome in the target's breaker, logging
+// and reporting when it opens or closes
+func (s *httpSink) recordOutcome(target *forwardTarget, ok bool) {
+	opened, closed := target.breaker.record(ok, clock.Now())
+	switch {
+	case opened:
+		logWarn("Circuit opened for target '%s' of sink '%s' after repeated failures, pausing requests for %s",
+			target.name, s.name, target.breaker.cooldown)
+		forwardCircuitOpen.WithLabelValues(s.name, target.name).Set(1)
+	case closed:
+		logInfo("Circuit closed for target '%s' of sink '%s'", target.name, s.name)
+		forwardCircuitOpen.WithLabelValues(s.name, target.name).Set(0)
+	}
+}
+
+// send makes one request to a target, reporting whether a failure may be
+// retried
+func (s *httpSink) send(ctx context.Context, target *forwardTarget, event *webhookEvent) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.cfg.URL, bytes.NewReader(event.Body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "monzo-webhook/"+version)
+	for key, value := range target.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set(forwardEventIDHeader, event.ID)
+	req.Header.Set(forwardEventTypeHeader, event.Type)
+	if target.cfg.Secret != "" {
+		timestamp := clock.Now().Unix()
+		req.Header.Set(forwardSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, signForwardRequest(target.cfg.Secret, timestamp, event.Body)))
+	}
+
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// wasDelivered reports whether an event was delivered to a target
+func (s *httpSink) wasDelivered(eventID, target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delivered[eventID][target]
+}
+
+// markDelivered remembers that an event was delivered to a target, so that
+// retrying the publish for the other targets doesn't send it again
+func (s *httpSink) markDelivered(eventID, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.delivered[eventID] == nil {
+		s.delivered[eventID] = make(map[string]bool)
+		s.order = append(s.order, eventID)
+		if len(s.order) > forwardDeliveredSize {
+			delete(s.delivered, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+	s.delivered[eventID][target] = true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidateHTTPSinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    SinkConfig
+		hasErr bool
+	}{
+		{name: "Valid", cfg: SinkConfig{Type: "http", Targets: []HTTPTargetConfig{
+			{URL: "https://a.example.com/hook", Secret: "s", Timeout: "2s", Attempts: 5, FailureThreshold: 3, Cooldown: "1m"},
+			{URL: "https://b.example.com/hook", Headers: map[string]string{"Authorization": "Bearer x"}},
+		}}},
+		{name: "No targets", cfg: SinkConfig{Type: "http"}, hasErr: true},
+		{name: "Invalid URL", cfg: SinkConfig{Type: "http", Targets: []HTTPTargetConfig{{URL: "a.example.com/hook"}}}, hasErr: true},
+		{name: "Duplicate host", cfg: SinkConfig{Type: "http", Targets: []HTTPTargetConfig{
+			{URL: "https://a.example.com/one"}, {URL: "https://a.example.com/two"},
+		}}, hasErr: true},
+		{name: "Named apart", cfg: SinkConfig{Type: "http", Targets: []HTTPTargetConfig{
+			{Name: "one", URL: "https://a.example.com/one"}, {Name: "two", URL: "https://a.example.com/two"},
+		}}},
+		{name: "Invalid timeout", cfg: SinkConfig{Type: "http", Targets: []HTTPTargetConfig{{URL: "https://a.example.com", Timeout: "soon"}}}, hasErr: true},
+		{name: "Negative attempts", cfg: SinkConfig{Type: "http", Targets: []HTTPTargetConfig{{URL: "https://a.example.com", Attempts: -1}}}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSinks([]SinkConfig{tt.cfg}); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	b := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	if opened, _ := b.record(false, now); opened || !b.allow(now) {
+		t.Fatal("Expected the breaker to stay closed after one failure")
+	}
+	if opened, _ := b.record(false, now); !opened || b.allow(now.Add(59*time.Second)) {
+		t.Fatal("Expected the breaker to open after two failures")
+	}
+
+	// One request tests the target after the cooldown
+	later := now.Add(time.Minute)
+	if !b.allow(later) || b.allow(later) {
+		t.Fatal("Expected one request to be allowed after the cooldown")
+	}
+	if opened, _ := b.record(false, later); opened || b.allow(later.Add(59*time.Second)) {
+		t.Fatal("Expected a failed test to keep the breaker open")
+	}
+	if !b.allow(later.Add(time.Minute)) {
+		t.Fatal("Expected another test after the cooldown")
+	}
+	if _, closed := b.record(true, later.Add(time.Minute)); !closed || !b.allow(later.Add(time.Minute)) {
+		t.Fatal("Expected a successful test to close the breaker")
+	}
+}
+
+func TestHTTPSinkPublish(t *testing.T) {
+	originalBackoff := forwardBackoff
+	defer func() { forwardBackoff = originalBackoff }()
+	forwardBackoff = RetryConfig{InitialBackoff: "1ms", MaxBackoff: "1ms"}
+
+	var received, signature atomic.Value
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(fmt.Sprintf("%s %s %s %s", r.Header.Get(forwardEventIDHeader), r.Header.Get(forwardEventTypeHeader),
+			r.Header.Get("Authorization"), body))
+		signature.Store(r.Header.Get(forwardSignatureHeader))
+	}))
+	defer good.Close()
+	var badRequests, failing atomic.Int32
+	failing.Store(1)
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badRequests.Add(1)
+		if failing.Load() == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer bad.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	sink := newHTTPSink("relay", []HTTPTargetConfig{
+		{Name: "good", URL: good.URL, Secret: "shh", Headers: map[string]string{"Authorization": "Bearer abc"}},
+		{Name: "bad", URL: bad.URL, Attempts: 2, FailureThreshold: 4, Cooldown: "1h"},
+	})
+	event := &webhookEvent{ID: "evt_1", Type: "transaction.created", Body: []byte(`{"type":"transaction.created"}`)}
+	err := sink.Publish(context.Background(), event)
+	if err == nil || !strings.Contains(err.Error(), "target bad: status 502") || strings.Contains(err.Error(), "good") {
+		t.Fatalf("Expected only the bad target to fail, got %v", err)
+	}
+	if got := received.Load(); got != `evt_1 transaction.created Bearer abc {"type":"transaction.created"}` {
+		t.Errorf("Unexpected request %q", got)
+	}
+	header, _ := signature.Load().(string)
+	timestamp, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(header, ",")[0], "t="), 10, 64)
+	if expected := fmt.Sprintf("t=%d,v1=%s", timestamp, signForwardRequest("shh", timestamp, event.Body)); header != expected || timestamp == 0 {
+		t.Errorf("Expected signature %q, got %q", expected, header)
+	}
+	if badRequests.Load() != 2 {
+		t.Errorf("Expected the bad target to be tried twice, got %d", badRequests.Load())
+	}
+
+	// Retrying the publish skips the target it was delivered to
+	received.Store("")
+	sink.Publish(context.Background(), event)
+	if received.Load() != "" || badRequests.Load() != 4 {
+		t.Errorf("Expected a retry to only send to the bad target, got %q and %d requests", received.Load(), badRequests.Load())
+	}
+
+	// The bad target's breaker is open after 4 failures
+	err = sink.Publish(context.Background(), &webhookEvent{ID: "evt_2", Body: []byte(`{}`)})
+	if err == nil || !strings.Contains(err.Error(), "circuit open") || badRequests.Load() != 4 {
+		t.Errorf("Expected the circuit to be open, got %v and %d requests", err, badRequests.Load())
+	}
+	if testutil.ToFloat64(forwardCircuitOpen.WithLabelValues("relay", "bad")) != 1 || testutil.ToFloat64(forwardCircuitOpen.WithLabelValues("relay", "good")) != 0 {
+		t.Error("Expected the open circuit to be reported")
+	}
+
+	// Rejected events aren't retried and don't trip the breaker
+	rejectingSink := newHTTPSink("rejecting", []HTTPTargetConfig{{URL: rejecting.URL, FailureThreshold: 1}})
+	for i := 0; i < 2; i++ {
+		if err := rejectingSink.Publish(context.Background(), event); err == nil || !strings.Contains(err.Error(), "status 400") {
+			t.Errorf("Expected the event to be rejected, got %v", err)
+		}
+	}
+	name := strings.TrimPrefix(rejecting.URL, "http://")
+	if testutil.ToFloat64(forwardRequests.WithLabelValues("rejecting", name, "rejected")) != 2 {
+		t.Errorf("Expected 2 rejections, got %v", testutil.ToFloat64(forwardRequests.WithLabelValues("rejecting", name, "rejected")))
+	}
+}
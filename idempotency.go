@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyConfig configures caching of webhook responses by delivery ID,
+// so that a retried delivery is answered without being processed again
+type IdempotencyConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Header     string `json:"header"`
+	TTL        string `json:"ttl"`
+	MaxEntries int    `json:"max_entries"`
+}
+
+// cachedResponse is a response recorded for a delivery
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+var (
+	idempotencyHits = metrics.newCounter("monzo_webhook_idempotency_hits_total",
+		"Deliveries answered from the idempotency cache.")
+)
+
+// webhookResponses caches responses when idempotency is enabled, or is nil
+var webhookResponses *responseCache
+
+// validate checks the idempotency configuration for invalid values
+func (c IdempotencyConfig) validate() error {
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("idempotency max_entries must not be negative")
+	}
+	if _, err := c.ttl(); err != nil {
+		return fmt.Errorf("invalid idempotency ttl: %w", err)
+	}
+	return nil
+}
+
+// header returns the request header carrying the delivery ID
+func (c IdempotencyConfig) header() string {
+	if c.Header == "" {
+		return "Idempotency-Key"
+	}
+	return c.Header
+}
+
+// ttl returns how long responses are cached, defaulting to 10 minutes
+func (c IdempotencyConfig) ttl() (time.Duration, error) {
+	if c.TTL == "" {
+		return 10 * time.Minute, nil
+	}
+	d, err := time.ParseDuration(c.TTL)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// maxEntries returns the cache size, defaulting to 10000 responses
+func (c IdempotencyConfig) maxEntries() int {
+	if c.MaxEntries == 0 {
+		return 10000
+	}
+	return c.MaxEntries
+}
+
+// responseCache is an LRU cache of responses with a fixed TTL. Deliveries
+// that are still being processed are tracked so that concurrent retries wait
+// for the original response instead of processing the event twice.
+type responseCache struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	ttl      time.Duration
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	inflight map[string]chan struct{}
+}
+
+func newResponseCache(ttl time.Duration, capacity int, now func() time.Time) *responseCache {
+	return &responseCache{
+		now:      now,
+		ttl:      ttl,
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+// begin returns the cached response for key, if there is one. Otherwise it
+// marks key as in flight and returns a done function that must be called once
+// the response is known. If another request for key is in flight, begin waits
+// for it to finish first.
+func (c *responseCache) begin(key string) (*cachedResponse, func(*cachedResponse)) {
+	c.mu.Lock()
+	for {
+		if response := c.get(key); response != nil {
+			c.mu.Unlock()
+			return response, nil
+		}
+		wait, ok := c.inflight[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-wait
+		c.mu.Lock()
+	}
+
+	wait := make(chan struct{})
+	c.inflight[key] = wait
+	c.mu.Unlock()
+
+	return nil, func(response *cachedResponse) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if response != nil {
+			c.put(key, response)
+		}
+		delete(c.inflight, key)
+		close(wait)
+	}
+}
+
+// get returns an unexpired response, marking it as recently used
+func (c *responseCache) get(key string) *cachedResponse {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	response := element.Value.(*cachedResponse)
+	if !c.now().Before(response.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return response
+}
+
+// put stores a response, evicting the least recently used entry when full
+func (c *responseCache) put(key string, response *cachedResponse) {
+	response.key = key
+	response.expires = c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		element.Value = response
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(response)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// deliveryKey identifies a delivery by its ID header, falling back to a hash
+// of the payload. Keys are scoped to the tenant.
+func deliveryKey(r *http.Request, header string, body []byte) string {
+	id := r.Header.Get(header)
+	if id == "" {
+		sum := sha256.Sum256(body)
+		id = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if tenant := tenantFromContext(r.Context()); tenant != nil {
+		return tenant.Name + "/" + id
+	}
+	return id
+}
+
+// responseRecorder captures a response while writing it to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotencyMiddleware replays the original response to retried deliveries.
+// Only successful responses are cached, so deliveries that were rejected, for
+// example because of backpressure, are processed again when Monzo retries.
+func idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cache := webhookResponses
+		if cache == nil || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeBodyReadError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := deliveryKey(r, currentConfig().Idempotency.header(), body)
+		cached, done := cache.begin(key)
+		if cached != nil {
+			logInfo("Replaying cached response for delivery %s", key)
+			idempotencyHits.Inc()
+			for name, values := range cached.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(cached.status)
+			w.Write(cached.body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if recorder.status >= 200 && recorder.status < 300 {
+				done(&cachedResponse{status: recorder.status, header: w.Header().Clone(), body: recorder.body.Bytes()})
+			} else {
+				done(nil)
+			}
+		}()
+		next(recorder, r)
+	}
+}
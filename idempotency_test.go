@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheExpiryAndEviction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newResponseCache(time.Minute, 2, func() time.Time { return now })
+
+	store := func(key string) {
+		cached, done := cache.begin(key)
+		if cached != nil {
+			t.Fatalf("Unexpected cached response for %s", key)
+		}
+		done(&cachedResponse{status: http.StatusOK, body: []byte(key)})
+	}
+
+	store("a")
+	store("b")
+	if cached, _ := cache.begin("a"); cached == nil || string(cached.body) != "a" {
+		t.Fatal("Expected a cached response for 'a'")
+	}
+
+	// 'b' is now the least recently used entry
+	store("c")
+	if cached, done := cache.begin("b"); cached != nil {
+		t.Error("Expected 'b' to have been evicted")
+	} else {
+		done(nil)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if cached, done := cache.begin("a"); cached != nil {
+		t.Error("Expected 'a' to have expired")
+	} else {
+		done(nil)
+	}
+}
+
+func TestResponseCacheWaitsForInflightDelivery(t *testing.T) {
+	cache := newResponseCache(time.Minute, 10, time.Now)
+
+	_, done := cache.begin("delivery")
+
+	var wg sync.WaitGroup
+	results := make(chan *cachedResponse, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, _ := cache.begin("delivery")
+			results <- cached
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	done(&cachedResponse{status: http.StatusOK, body: []byte("Webhook received")})
+	wg.Wait()
+	close(results)
+
+	for cached := range results {
+		if cached == nil || cached.status != http.StatusOK {
+			t.Errorf("Expected waiting requests to get the original response, got %+v", cached)
+		}
+	}
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	origCache := webhookResponses
+	origConfig := eventConfig
+	defer func() {
+		webhookResponses = origCache
+		eventConfig = origConfig
+	}()
+
+	eventConfig = EventConfig{Idempotency: IdempotencyConfig{Enabled: true}}
+	webhookResponses = newResponseCache(time.Minute, 100, time.Now)
+
+	calls := 0
+	status := http.StatusServiceUnavailable
+	handler := idempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		w.Write([]byte("response"))
+	})
+
+	send := func(deliveryID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body))
+		if deliveryID != "" {
+			req.Header.Set("Idempotency-Key", deliveryID)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// Failed responses are not cached
+	send("delivery-1", `{"type": "transaction.created"}`)
+	status = http.StatusOK
+	send("delivery-1", `{"type": "transaction.created"}`)
+	if calls != 2 {
+		t.Fatalf("Expected a failed delivery to be processed again, got %d calls", calls)
+	}
+
+	rr := send("delivery-1", `{"type": "transaction.created"}`)
+	if calls != 2 {
+		t.Errorf("Expected the retried delivery to be answered from the cache, got %d calls", calls)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != "response" || rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Unexpected replayed response: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// Without a delivery ID, identical payloads are treated as the same delivery
+	send("", `{"type": "transaction.updated"}`)
+	send("", `{"type": "transaction.updated"}`)
+	if calls != 3 {
+		t.Errorf("Expected identical payloads to be processed once, got %d calls", calls-2)
+	}
+}
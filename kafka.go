@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// KafkaConfig holds the connection settings for the Kafka brokers that kafka
+// sinks publish to
+type KafkaConfig struct {
+	Brokers  []string
+	ClientID string
+	SASL     sasl.Mechanism
+	TLS      *tls.Config
+}
+
+// kafkaConfigFromEnv builds a KafkaConfig from environment variables.
+// It returns nil if KAFKA_BROKERS is not set.
+func kafkaConfigFromEnv() (*KafkaConfig, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return nil, nil
+	}
+
+	saslPassword, err := getenvSecret("KAFKA_SASL_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &KafkaConfig{ClientID: os.Getenv("KAFKA_CLIENT_ID")}
+	for _, broker := range strings.Split(brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			cfg.Brokers = append(cfg.Brokers, broker)
+		}
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "monzo-webhook"
+	}
+
+	mechanism := strings.ToUpper(os.Getenv("KAFKA_SASL_MECHANISM"))
+	username := os.Getenv("KAFKA_SASL_USERNAME")
+	if mechanism != "" && (username == "" || saslPassword == "") {
+		return nil, errors.New("KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD must be set when KAFKA_SASL_MECHANISM is configured")
+	}
+	switch mechanism {
+	case "":
+	case "PLAIN":
+		cfg.SASL = plain.Auth{User: username, Pass: saslPassword}.AsMechanism()
+	case "SCRAM-SHA-256":
+		cfg.SASL = scram.Auth{User: username, Pass: saslPassword}.AsSha256Mechanism()
+	case "SCRAM-SHA-512":
+		cfg.SASL = scram.Auth{User: username, Pass: saslPassword}.AsSha512Mechanism()
+	default:
+		return nil, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM '%s' (supported: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512)", mechanism)
+	}
+
+	if enabled, _ := strconv.ParseBool(os.Getenv("KAFKA_TLS")); enabled {
+		cfg.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		if caFile := os.Getenv("KAFKA_TLS_CA_FILE"); caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading KAFKA_TLS_CA_FILE: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in KAFKA_TLS_CA_FILE '%s'", caFile)
+			}
+			cfg.TLS.RootCAs = pool
+		}
+	}
+
+	return cfg, nil
+}
+
+// sharedKafkaProducer creates the producer for the brokers in KAFKA_BROKERS
+// when a kafka sink is first created. The sinks share its connections.
+var sharedKafkaProducer = sync.OnceValues(func() (*KafkaProducer, error) {
+	cfg, err := kafkaConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("KAFKA_BROKERS must be set to publish to Kafka")
+	}
+	producer, err := NewKafkaProducer(*cfg)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("Kafka publishing enabled: brokers=%s client_id=%s", strings.Join(cfg.Brokers, ","), cfg.ClientID)
+	return producer, nil
+})
+
+// KafkaProducer publishes records to Kafka topics with franz-go. Records
+// with a key are partitioned with the same murmur2 hashing as the Java
+// client, so keys land on the same partition as other producers would put
+// them.
+type KafkaProducer struct {
+	client *kgo.Client
+}
+
+// NewKafkaProducer creates a producer for the given configuration.
+// Connections are established lazily on the first publish.
+func NewKafkaProducer(cfg KafkaConfig) (*KafkaProducer, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ClientID(cfg.ClientID),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+	}
+	if cfg.SASL != nil {
+		opts = append(opts, kgo.SASL(cfg.SASL))
+	}
+	if cfg.TLS != nil {
+		opts = append(opts, kgo.DialTLSConfig(cfg.TLS))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaProducer{client: client}, nil
+}
+
+// Publish writes a record and waits until the brokers have acknowledged it
+func (p *KafkaProducer) Publish(ctx context.Context, record *kgo.Record) error {
+	return p.client.ProduceSync(ctx, record).FirstErr()
+}
+
+// Connect checks that a broker can be reached, so that the first publish
+// doesn't have to connect
+func (p *KafkaProducer) Connect(ctx context.Context) error {
+	return p.client.Ping(ctx)
+}
+
+// Close flushes buffered records and closes the broker connections
+func (p *KafkaProducer) Close() error {
+	p.client.Close()
+	return nil
+}
+
+// validateKafkaSink checks a kafka sink's settings
+func validateKafkaSink(cfg SinkConfig) error {
+	if cfg.Topic == "" {
+		return errors.New("kafka sinks must have a topic")
+	}
+	return nil
+}
+
+// newKafkaSink creates a sink publishing to a topic with the shared producer
+func newKafkaSink(name string, cfg SinkConfig, producer func() (*KafkaProducer, error)) (*kafkaSink, error) {
+	p, err := producer()
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{name: name, producer: p, topic: cfg.Topic}, nil
+}
+
+// kafkaRecord returns the record an event is published as: its payload keyed
+// by account, so that events for the same account stay ordered within a
+// partition, with the event's ID and type in headers. Events without an
+// account have no key, and are spread across the partitions.
+func kafkaRecord(topic string, event *webhookEvent) *kgo.Record {
+	record := &kgo.Record{
+		Topic: topic,
+		Value: event.Body,
+		Headers: []kgo.RecordHeader{
+			{Key: "event_id", Value: []byte(event.ID)},
+			{Key: "event_type", Value: []byte(event.Type)},
+		},
+	}
+	if event.AccountID != "" {
+		record.Key = []byte(event.AccountID)
+	}
+	return record
+}
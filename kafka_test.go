@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestKafkaConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectNil     bool
+		expectError   bool
+		expectSASL    string
+		expectTLS     bool
+		expectBrokers int
+	}{
+		{
+			name:      "Kafka not configured",
+			env:       map[string]string{},
+			expectNil: true,
+		},
+		{
+			name:          "Brokers",
+			env:           map[string]string{"KAFKA_BROKERS": "a:9092, b:9092"},
+			expectBrokers: 2,
+		},
+		{
+			name: "SASL without credentials",
+			env: map[string]string{
+				"KAFKA_BROKERS":        "localhost:9092",
+				"KAFKA_SASL_MECHANISM": "PLAIN",
+			},
+			expectError: true,
+		},
+		{
+			name: "Unsupported SASL mechanism",
+			env: map[string]string{
+				"KAFKA_BROKERS":        "localhost:9092",
+				"KAFKA_SASL_MECHANISM": "GSSAPI",
+				"KAFKA_SASL_USERNAME":  "user",
+				"KAFKA_SASL_PASSWORD":  "pass",
+			},
+			expectError: true,
+		},
+		{
+			name: "SCRAM with TLS",
+			env: map[string]string{
+				"KAFKA_BROKERS":        "localhost:9093",
+				"KAFKA_SASL_MECHANISM": "scram-sha-512",
+				"KAFKA_SASL_USERNAME":  "user",
+				"KAFKA_SASL_PASSWORD":  "pass",
+				"KAFKA_TLS":            "true",
+			},
+			expectSASL:    "SCRAM-SHA-512",
+			expectTLS:     true,
+			expectBrokers: 1,
+		},
+	}
+
+	vars := []string{"KAFKA_BROKERS", "KAFKA_CLIENT_ID", "KAFKA_SASL_MECHANISM",
+		"KAFKA_SASL_USERNAME", "KAFKA_SASL_PASSWORD", "KAFKA_TLS", "KAFKA_TLS_CA_FILE"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vars {
+				t.Setenv(v, "")
+				os.Unsetenv(v)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := kafkaConfigFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expectNil {
+				if cfg != nil {
+					t.Errorf("Expected nil config, got %+v", cfg)
+				}
+				return
+			}
+			if cfg == nil {
+				t.Fatal("Expected a config, got nil")
+			}
+			if cfg.ClientID != "monzo-webhook" {
+				t.Errorf("Expected default client ID, got '%s'", cfg.ClientID)
+			}
+			if len(cfg.Brokers) != tt.expectBrokers {
+				t.Errorf("Expected %d brokers, got %v", tt.expectBrokers, cfg.Brokers)
+			}
+			if (cfg.SASL == nil && tt.expectSASL != "") || (cfg.SASL != nil && cfg.SASL.Name() != tt.expectSASL) {
+				t.Errorf("Expected SASL mechanism %q, got %v", tt.expectSASL, cfg.SASL)
+			}
+			if (cfg.TLS != nil) != tt.expectTLS {
+				t.Errorf("Expected TLS %v, got %v", tt.expectTLS, cfg.TLS)
+			}
+		})
+	}
+}
+
+func TestValidateKafkaSink(t *testing.T) {
+	if err := validateSinks([]SinkConfig{{Type: "kafka", Topic: "monzo-events"}}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := validateSinks([]SinkConfig{{Type: "kafka"}}); err == nil {
+		t.Error("Expected an error for a kafka sink without a topic")
+	}
+}
+
+func TestKafkaRecord(t *testing.T) {
+	event := &webhookEvent{ID: "evt_1", Type: "transaction.created", AccountID: "acc_1", Body: []byte(`{"type":"transaction.created"}`)}
+	record := kafkaRecord("monzo-events", event)
+	if record.Topic != "monzo-events" || string(record.Key) != "acc_1" || string(record.Value) != string(event.Body) {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+	headers := map[string]string{}
+	for _, header := range record.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	if headers["event_id"] != "evt_1" || headers["event_type"] != "transaction.created" {
+		t.Errorf("Unexpected headers: %v", headers)
+	}
+
+	// Events without an account are spread across partitions
+	event.AccountID = ""
+	if record := kafkaRecord("monzo-events", event); record.Key != nil {
+		t.Errorf("Expected no key, got %q", record.Key)
+	}
+}
+
+func TestNewKafkaSink(t *testing.T) {
+	t.Setenv("KAFKA_BROKERS", "")
+	producer, err := NewKafkaProducer(KafkaConfig{Brokers: []string{"localhost:9092"}, ClientID: "test"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer producer.Close()
+
+	sink, err := newKafkaSink("events", SinkConfig{Topic: "monzo-events"}, func() (*KafkaProducer, error) { return producer, nil })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sink.Name() != "events" || sink.topic != "monzo-events" {
+		t.Errorf("Unexpected sink: %+v", sink)
+	}
+}
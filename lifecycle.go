@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// lifecycleEventType is the type of the events published when a transaction
+// moves to a new state
+const lifecycleEventType = "transaction.lifecycle"
+
+// Transaction states
+const (
+	stateAuthorised = "authorised"
+	stateSettled    = "settled"
+	stateDeclined   = "declined"
+	stateReversed   = "reversed"
+)
+
+// lifecycleTransitions are the states each state can move to. Declined and
+// reversed transactions are final, and a settled one can only be reversed.
+var lifecycleTransitions = map[string][]string{
+	"":              {stateAuthorised, stateSettled, stateDeclined},
+	stateAuthorised: {stateSettled, stateDeclined, stateReversed},
+	stateSettled:    {stateReversed},
+}
+
+// LifecycleConfig configures tracking each transaction's lifecycle and
+// publishing its transitions
+type LifecycleConfig struct {
+	Enabled bool `json:"enabled"`
+	// TTL is how long a transaction's lifecycle is kept after its last
+	// event, defaulting to 30 days
+	TTL       string `json:"ttl"`
+	KeyPrefix string `json:"key_prefix"`
+}
+
+var lifecycleTransitionsTotal = metrics.newCounterVec("monzo_webhook_lifecycle_transitions_total",
+	"Transaction lifecycle transitions published, by the state moved to.", "state")
+
+// lifecycleTransition is a transaction moving from one state to another,
+// because of the event with EventID
+type lifecycleTransition struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	At      time.Time `json:"at"`
+	EventID string    `json:"event_id"`
+}
+
+// transactionLifecycle is a transaction's current state and how it got there,
+// with the amount of its last event
+type transactionLifecycle struct {
+	State       string                `json:"state"`
+	Amount      float64               `json:"amount"`
+	Transitions []lifecycleTransition `json:"transitions"`
+}
+
+// lifecycleTracker keeps each transaction's lifecycle in Redis, or the event
+// store without it, and publishes a transaction.lifecycle event for each
+// transition
+type lifecycleTracker struct {
+	state   stateStore
+	cfg     LifecycleConfig
+	publish func(eventType string, body []byte, auth string) error
+	now     func() time.Time
+}
+
+// transactionLifecycles is nil unless lifecycle tracking is enabled
+var transactionLifecycles *lifecycleTracker
+
+// validate checks the lifecycle configuration for invalid values
+func (c LifecycleConfig) validate() error {
+	if _, err := parsePositiveDuration(c.TTL, 30*24*time.Hour); err != nil {
+		return fmt.Errorf("invalid lifecycle ttl: %w", err)
+	}
+	return nil
+}
+
+// keyPrefix returns the prefix of transaction lifecycle keys
+func (c LifecycleConfig) keyPrefix() string {
+	if c.KeyPrefix == "" {
+		return "monzo-webhook:lifecycle:"
+	}
+	return c.KeyPrefix
+}
+
+func newLifecycleTracker(cfg LifecycleConfig, state stateStore) *lifecycleTracker {
+	return &lifecycleTracker{state: state, cfg: cfg, publish: publishGeneratedEvent, now: clock.Now}
+}
+
+// transactionState returns the state a transaction's data moves it to. A
+// transaction whose amount drops to zero was reversed, as Monzo does when an
+// authorisation is cancelled or expires, while one that was always for zero,
+// such as a card check, isn't.
+func transactionState(previous transactionLifecycle, data map[string]interface{}) string {
+	if reason, _ := data["decline_reason"].(string); reason != "" {
+		return stateDeclined
+	}
+	if amount, ok := data["amount"].(float64); ok && amount == 0 && previous.Amount != 0 {
+		return stateReversed
+	}
+	if settled, _ := data["settled"].(string); settled != "" {
+		return stateSettled
+	}
+	return stateAuthorised
+}
+
+// canTransition reports whether a transaction can move between two states.
+// Events that arrive out of order, such as an update with the authorised
+// data after the settled one, don't move a transaction back.
+func canTransition(from, to string) bool {
+	for _, state := range lifecycleTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// apply moves a transaction to the state its event puts it in, and publishes
+// the transition. Events that don't change the state, such as redeliveries
+// and notes being edited, publish nothing.
+func (t *lifecycleTracker) apply(ctx context.Context, event *webhookEvent) {
+	if t == nil || (event.Type != "transaction.created" && event.Type != "transaction.updated") {
+		return
+	}
+	data, _ := event.Payload["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+	if id == "" {
+		return
+	}
+	key := t.cfg.keyPrefix()
+	if event.Tenant != nil {
+		key += event.Tenant.Name + ":"
+	}
+	key += id
+
+	var lifecycle transactionLifecycle
+	stored, ok, err := t.state.get(ctx, key)
+	if ok {
+		err = json.Unmarshal([]byte(stored), &lifecycle)
+	}
+	if err != nil {
+		logWarn("Error reading the lifecycle of transaction %s: %v", id, err)
+		return
+	}
+
+	state := transactionState(lifecycle, data)
+	if !canTransition(lifecycle.State, state) {
+		if state != lifecycle.State {
+			logDebug("Ignored %s event %s for transaction %s: can't move from %s to %s", event.Type, event.ID, id, lifecycle.State, state)
+		}
+		return
+	}
+	transition := lifecycleTransition{From: lifecycle.State, To: state, At: t.now().UTC(), EventID: event.ID}
+	lifecycle.State = state
+	lifecycle.Amount, _ = data["amount"].(float64)
+	lifecycle.Transitions = append(lifecycle.Transitions, transition)
+
+	ttl, _ := parsePositiveDuration(t.cfg.TTL, 30*24*time.Hour)
+	encoded, err := json.Marshal(lifecycle)
+	if err == nil {
+		err = t.state.set(ctx, key, string(encoded), ttl)
+	}
+	if err != nil {
+		logWarn("Error saving the lifecycle of transaction %s: %v", id, err)
+		return
+	}
+
+	lifecycleData := map[string]interface{}{
+		"transaction_id": id,
+		"account_id":     event.AccountID,
+		"from":           transition.From,
+		"to":             transition.To,
+		"sequence":       len(lifecycle.Transitions),
+		"event_id":       event.ID,
+	}
+	if event.Tenant != nil {
+		lifecycleData["tenant"] = event.Tenant.Name
+	}
+	for _, field := range []string{"amount", "currency", "description", "settled", "decline_reason"} {
+		if value, ok := data[field]; ok {
+			lifecycleData[field] = value
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{"type": lifecycleEventType, "data": lifecycleData})
+	if err != nil {
+		logError("Error encoding the lifecycle transition of transaction %s: %v", id, err)
+		return
+	}
+	lifecycleTransitionsTotal.WithLabelValues(state).Inc()
+	eventTraces.update(event.ID, func(trace *eventTrace) {
+		trace.MatchedRules = append(trace.MatchedRules, traceRule{Kind: "lifecycle", Rule: transition.From + " -> " + transition.To})
+	})
+	if err := t.publish(lifecycleEventType, body, "lifecycle"); err != nil {
+		logError("Error publishing the lifecycle transition of transaction %s: %v", id, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransactionState(t *testing.T) {
+	authorised := transactionLifecycle{State: stateAuthorised, Amount: -350}
+	tests := []struct {
+		name     string
+		previous transactionLifecycle
+		data     string
+		expect   string
+	}{
+		{name: "Authorised", data: `{"amount":-350,"settled":""}`, expect: stateAuthorised},
+		{name: "Settled", previous: authorised, data: `{"amount":-350,"settled":"2024-01-02T00:00:00Z"}`, expect: stateSettled},
+		{name: "Declined", data: `{"amount":-350,"decline_reason":"INSUFFICIENT_FUNDS"}`, expect: stateDeclined},
+		{name: "Reversed", previous: authorised, data: `{"amount":0,"settled":""}`, expect: stateReversed},
+		{name: "Card check", data: `{"amount":0,"settled":""}`, expect: stateAuthorised},
+		{name: "Card check settled", previous: transactionLifecycle{State: stateAuthorised}, data: `{"amount":0,"settled":"2024-01-02T00:00:00Z"}`, expect: stateSettled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data map[string]interface{}
+			json.Unmarshal([]byte(tt.data), &data)
+			if got := transactionState(tt.previous, data); got != tt.expect {
+				t.Errorf("Expected %s, got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestLifecycleTrackerApply(t *testing.T) {
+	_, client := newFakeRedis(t)
+	var published []map[string]interface{}
+	tracker := newLifecycleTracker(LifecycleConfig{Enabled: true}, redisState{client: client})
+	tracker.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	tracker.publish = func(eventType string, body []byte, auth string) error {
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		published = append(published, payload["data"].(map[string]interface{}))
+		return nil
+	}
+
+	steps := []struct {
+		name      string
+		eventType string
+		data      string
+		expect    string
+	}{
+		{name: "Authorised", eventType: "transaction.created", data: `{"id":"tx_1","amount":-350,"settled":""}`, expect: " -> authorised"},
+		{name: "Redelivery", eventType: "transaction.created", data: `{"id":"tx_1","amount":-350,"settled":""}`},
+		{name: "Notes edited", eventType: "transaction.updated", data: `{"id":"tx_1","amount":-350,"settled":"","notes":"lunch"}`},
+		{name: "Settled", eventType: "transaction.updated", data: `{"id":"tx_1","amount":-350,"settled":"2024-01-02T00:00:00Z"}`, expect: "authorised -> settled"},
+		{name: "Out of order", eventType: "transaction.updated", data: `{"id":"tx_1","amount":-350,"settled":""}`},
+		{name: "Other event type", eventType: "account.balance_updated", data: `{"id":"tx_1","amount":0}`},
+		{name: "Reversed", eventType: "transaction.updated", data: `{"id":"tx_1","amount":0,"settled":"2024-01-02T00:00:00Z"}`, expect: "settled -> reversed"},
+		{name: "Final", eventType: "transaction.updated", data: `{"id":"tx_1","amount":-350,"settled":"2024-01-02T00:00:00Z"}`},
+	}
+	for _, step := range steps {
+		count := len(published)
+		body := `{"type":"` + step.eventType + `","data":` + step.data + `}`
+		event := &webhookEvent{ID: "evt_" + step.name, Type: step.eventType, AccountID: "acc_1", Body: []byte(body)}
+		json.Unmarshal(event.Body, &event.Payload)
+		tracker.apply(context.Background(), event)
+
+		if step.expect == "" {
+			if len(published) != count {
+				t.Errorf("%s: expected no transition, got %v", step.name, published[count:])
+			}
+			continue
+		}
+		if len(published) != count+1 {
+			t.Fatalf("%s: expected a transition, got %d", step.name, len(published)-count)
+		}
+		got := published[count]
+		if transition := got["from"].(string) + " -> " + got["to"].(string); transition != step.expect {
+			t.Errorf("%s: expected %s, got %s", step.name, step.expect, transition)
+		}
+		if got["event_id"] != event.ID || got["transaction_id"] != "tx_1" || got["account_id"] != "acc_1" {
+			t.Errorf("%s: unexpected transition %v", step.name, got)
+		}
+	}
+
+	var sequences []float64
+	for _, data := range published {
+		sequences = append(sequences, data["sequence"].(float64))
+	}
+	if !reflect.DeepEqual(sequences, []float64{1, 2, 3}) {
+		t.Errorf("Expected sequences 1, 2, 3, got %v", sequences)
+	}
+}
+
+func TestLifecycleTrackerDisabled(t *testing.T) {
+	var tracker *lifecycleTracker
+	event := &webhookEvent{Type: "transaction.created", Payload: map[string]interface{}{"data": map[string]interface{}{"id": "tx_1"}}}
+	tracker.apply(context.Background(), event)
+}
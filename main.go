@@ -8,10 +8,13 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/its-the-vibe/monzo-webhook/monzo"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -27,7 +30,90 @@ const (
 
 // EventConfig represents the configuration for webhook events
 type EventConfig struct {
-	Channel string `json:"channel"`
+	Channel     string            `json:"channel"`
+	Stream      StreamConfig      `json:"stream"`
+	Alerts      AlertConfig       `json:"alerts"`
+	Tenants     []TenantConfig    `json:"tenants"`
+	Workers     WorkerConfig      `json:"workers"`
+	Priorities  []PriorityRule    `json:"priorities"`
+	Idempotency IdempotencyConfig `json:"idempotency"`
+	Sinks       []SinkConfig      `json:"sinks"`
+	Spool       SpoolConfig       `json:"spool"`
+	Retry       RetryConfig       `json:"retry"`
+	Trace       TraceConfig       `json:"trace"`
+	Demo        []DemoScenario    `json:"demo"`
+	Dedup       DedupConfig       `json:"dedup"`
+	Changes     ChangesConfig     `json:"changes"`
+	Lifecycle   LifecycleConfig   `json:"lifecycle"`
+	Classifier  ClassifierConfig  `json:"classifier"`
+	Anomalies   AnomalyConfig     `json:"anomalies"`
+	Forecast    ForecastConfig    `json:"forecast"`
+	Heatmap     HeatmapConfig     `json:"heatmap"`
+	Splits      SplitConfig       `json:"splits"`
+	Failover    FailoverConfig    `json:"failover"`
+	MonzoAPI    MonzoAPIConfig    `json:"monzo_api"`
+	AccessLog   AccessLogConfig   `json:"access_log"`
+	Pots        PotsConfig        `json:"pots"`
+	Commands    CommandsConfig    `json:"commands"`
+	Attachments AttachmentsConfig `json:"attachments"`
+	EventTypes  EventTypeFilter   `json:"event_types"`
+	StatusPage  StatusPageConfig  `json:"status_page"`
+	WebhookTest WebhookTestConfig `json:"webhook_test"`
+
+	// PublishWhen drops events that don't match any of these rules, when set
+	PublishWhen []EventRule `json:"publish_when"`
+
+	// Rules filter, route and tag events with CEL expressions
+	Rules []CELRule `json:"rules"`
+
+	// Pipelines are flows of events independent of the main one, each on
+	// its own webhook path
+	Pipelines []PipelineConfig `json:"pipelines"`
+
+	// Transform trims the payloads published for matching events
+	Transform []TransformRule `json:"transform"`
+
+	// Profiles are payload shapes that sinks select by name
+	Profiles map[string]ProfileConfig `json:"profiles"`
+
+	// SinkProfiles selects the profile of the sinks configured by the
+	// top-level settings and environment variables, by sink name
+	SinkProfiles map[string]string `json:"sink_profiles"`
+
+	// Script runs a Lua script on each event before it's published
+	Script ScriptConfig `json:"script"`
+
+	// RequestBudget is how long a webhook request may take to publish its
+	// event, counted from when it was received
+	RequestBudget string `json:"request_budget"`
+
+	// Auth selects how each endpoint authenticates requests, by endpoint name
+	Auth map[string]EndpointAuthConfig `json:"auth"`
+
+	MerchantAliases []MerchantAlias `json:"merchant_aliases"`
+
+	// Accounts labels events for these accounts
+	Accounts []AccountConfig `json:"accounts"`
+
+	// StrictDecoding rejects events whose payload doesn't match the typed
+	// Monzo structs, instead of only logging a warning
+	StrictDecoding bool `json:"strict_decoding"`
+
+	// FeatureFlags gate risky features per environment
+	FeatureFlags FeatureFlagsConfig `json:"feature_flags"`
+
+	// Store keeps every received webhook in an embedded SQLite database
+	Store StoreConfig `json:"store"`
+
+	// Warmup fills caches and connects to sinks before the server is ready
+	Warmup WarmupConfig `json:"warmup"`
+
+	// Retention prunes old events from the event store and the spools
+	Retention RetentionConfig `json:"retention"`
+
+	// Replicas is how many instances serve webhooks behind a load balancer,
+	// so that validation can warn about settings that don't work across them
+	Replicas int `json:"replicas"`
 }
 
 var redisClient *redis.Client
@@ -54,52 +140,118 @@ func parseLogLevel(level string) LogLevel {
 
 // logDebug logs a message at DEBUG level
 func logDebug(format string, v ...interface{}) {
-	if currentLogLevel <= DEBUG {
+	if logLevel() <= DEBUG {
 		log.Printf("[DEBUG] "+format, v...)
 	}
 }
 
 // logInfo logs a message at INFO level
 func logInfo(format string, v ...interface{}) {
-	if currentLogLevel <= INFO {
+	if logLevel() <= INFO {
 		log.Printf("[INFO] "+format, v...)
 	}
 }
 
 // logWarn logs a message at WARN level
 func logWarn(format string, v ...interface{}) {
-	if currentLogLevel <= WARN {
+	if logLevel() <= WARN {
 		log.Printf("[WARN] "+format, v...)
 	}
 }
 
 // logError logs a message at ERROR level
 func logError(format string, v ...interface{}) {
-	if currentLogLevel <= ERROR {
+	if logLevel() <= ERROR {
 		log.Printf("[ERROR] "+format, v...)
 	}
 }
 
-// loadEventConfig loads the event configuration from a JSON file
+// loadEventConfig loads the event configuration from a JSON, YAML or TOML
+// file, or from environment variables and flags alone if filename is empty
 func loadEventConfig(filename string) error {
-	data, err := os.ReadFile(filename)
+	config, err := readEventConfig(filename)
 	if err != nil {
 		return err
 	}
+	eventConfig = config
+	return nil
+}
 
-	err = json.Unmarshal(data, &eventConfig)
-	if err != nil {
-		return err
+// runReload calls load periodically, to pick up changes stored in Redis by
+// other instances, until ctx is cancelled
+func runReload(ctx context.Context, what string, load func(context.Context) error, interval time.Duration) {
+	for {
+		if sleepUntil(ctx, clock, clock.Now().Add(interval)) != nil {
+			return
+		}
+		if err := load(ctx); err != nil {
+			logWarn("Error reloading %s: %v", what, err)
+		}
 	}
+}
 
+// validate checks the event configuration for invalid values
+func (c EventConfig) validate() error {
+	for _, err := range c.checks() {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// checks validates each section of the event configuration, so that every
+// problem can be reported rather than only the first
+func (c EventConfig) checks() []error {
+	return []error{
+		c.Stream.validate(),
+		c.Workers.validate(),
+		validatePriorities(c.Priorities),
+		c.Idempotency.validate(),
+		validateSinks(c.Sinks),
+		c.Spool.validate(),
+		c.Retry.validate(),
+		validateRequestBudget(c.RequestBudget),
+		c.Script.validate(),
+		c.Trace.validate(),
+		validateDemoScenarios(c.Demo),
+		c.Dedup.validate(),
+		c.Changes.validate(),
+		c.Lifecycle.validate(),
+		c.Classifier.validate(),
+		validateMerchantAliases(c.MerchantAliases),
+		c.Anomalies.validate(),
+		c.Forecast.validate(c.Stream),
+		c.Heatmap.validate(c.Stream),
+		c.Splits.validate(),
+		c.Failover.validate(),
+		c.MonzoAPI.validate(),
+		validateAccounts(c.Accounts),
+		validateAccountTokens(c.Accounts, c.MonzoAPI.Tokens),
+		c.Pots.validate(),
+		c.Commands.validate(),
+		c.Attachments.validate(),
+		c.EventTypes.validate(),
+		validateEventRules("publish_when", c.PublishWhen),
+		validateCELRules(c.Rules),
+		validateTransformRules(c.Transform),
+		validatePipelines(c.Pipelines),
+		validateProfiles(c.Profiles, c.SinkProfiles, c.Sinks, c.Pipelines),
+		validateEndpointAuth(c.Auth, c.Tenants),
+		validateTenants(c.Tenants),
+		validateFeatureFlags(c.FeatureFlags, c.Sinks, c.Pipelines),
+		c.Warmup.validate(),
+		c.Retention.validate(),
+		c.Store.validate(),
+	}
+}
+
 // basicAuthMiddleware checks HTTP Basic Authentication if configured
 func basicAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// If basic auth is not configured, skip authentication
-		if basicAuthUsername == "" && basicAuthPassword == "" {
+		expectedUsername, expectedPassword := webhookBasicAuth()
+		if expectedUsername == "" && expectedPassword == "" && webhookCredentials == nil && len(currentConfig().Tenants) == 0 {
 			next(w, r)
 			return
 		}
@@ -107,11 +259,27 @@ func basicAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Get the Authorization header
 		username, password, ok := r.BasicAuth()
 
+		// In multi-tenant mode, the credentials identify the tenant
+		if ok {
+			if tenant := matchTenant(username, password); tenant != nil {
+				logDebug("Basic auth successful for tenant: %s", tenant.Name)
+				next(w, r.WithContext(withTenant(r.Context(), tenant)))
+				return
+			}
+		}
+
+		// Any of the credentials in the htpasswd file are accepted
+		if ok && webhookCredentials != nil && webhookCredentials.verify(username, password) {
+			logDebug("Basic auth successful for user: %s", username)
+			next(w, r)
+			return
+		}
+
 		// Check if credentials are valid using constant-time comparison to prevent timing attacks
-		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(basicAuthUsername)) == 1
-		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(basicAuthPassword)) == 1
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
 
-		if !ok || !usernameMatch || !passwordMatch {
+		if !ok || expectedUsername == "" || !usernameMatch || !passwordMatch {
 			logWarn("Unauthorized webhook request - invalid credentials")
 			w.Header().Set("WWW-Authenticate", `Basic realm="Webhook"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -124,6 +292,181 @@ func basicAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// accountIDFromPayload returns data.account_id from a webhook payload, or an
+// empty string if it is not present
+func accountIDFromPayload(payload map[string]interface{}) string {
+	data, ok := payload["data"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	accountID, _ := data["account_id"].(string)
+	return accountID
+}
+
+// validatePayload decodes a webhook body into the typed Monzo structs and
+// validates it
+func validatePayload(body []byte) error {
+	event, err := monzo.Decode(body)
+	if err != nil {
+		return err
+	}
+	return event.Validate()
+}
+
+// newWebhookEvent assigns an ID and priority to a received event, starts its
+// trace and normalises its merchant description
+func newWebhookEvent(eventType string, body []byte, payload map[string]interface{}, tenant *TenantConfig, auth string) *webhookEvent {
+	received := clock.Now()
+	event := newReceivedEvent(newEventID(received), received, eventType, body, payload, tenant)
+
+	rules := matchedRules(eventType, payload)
+	if merchant, ok := merchantMutes.match(payload); ok {
+		event.MutedMerchant = merchant
+		rules = append(rules, traceRule{Kind: "mute", Rule: "merchant " + merchant})
+	}
+	celRules := matchingCELRules(currentConfig().Rules, payload)
+	for _, rule := range celRules {
+		rules = append(rules, traceRule{Kind: "rule", Rule: fmt.Sprintf("%s: %s", rule.Name, rule.When)})
+	}
+	eventTraces.start(event, auth, rules)
+
+	original := event.Body
+	if applyCELRules(celRules, event) {
+		eventTraces.recordTransformation(event.ID, "rules", original, event.Body)
+	}
+	// Compare Monzo's data, before it's enriched
+	original = event.Body
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	if recordChanges(ctx, stateFor(redisClient), currentConfig().Changes, event) {
+		eventTraces.recordTransformation(event.ID, "changes", original, event.Body)
+	}
+	cancel()
+	for _, enrichment := range receiveEnrichments {
+		enrichment.apply(event)
+	}
+	return event
+}
+
+// newReceivedEvent creates an event with an ID and priority, without
+// starting its trace or changing its body
+func newReceivedEvent(id string, received time.Time, eventType string, body []byte, payload map[string]interface{}, tenant *TenantConfig) *webhookEvent {
+	event := &webhookEvent{
+		ID:        id,
+		Type:      eventType,
+		AccountID: accountIDFromPayload(payload),
+		Body:      body,
+		Payload:   payload,
+		Tenant:    tenant,
+		Priority:  eventPriority(currentConfig().Priorities, eventType, payload),
+		Received:  received,
+	}
+	logInfo("Assigned ID %s to %s event", event.ID, eventType)
+	return event
+}
+
+// receiveEnrichment changes an event's payload as it's received, recording
+// the change in its trace
+type receiveEnrichment struct {
+	// name selects the enrichment in a pipeline's enrich list
+	name  string
+	trace string
+	fn    func(event *webhookEvent) bool
+}
+
+func (e receiveEnrichment) apply(event *webhookEvent) {
+	original := event.Body
+	if e.fn(event) {
+		eventTraces.recordTransformation(event.ID, e.trace, original, event.Body)
+	}
+}
+
+// receiveEnrichments are applied in order to every event received on /webhook
+var receiveEnrichments = []receiveEnrichment{
+	{name: "merchant_aliases", trace: "merchant_alias", fn: func(event *webhookEvent) bool {
+		return normaliseMerchant(merchantAliases, event)
+	}},
+	{name: "account_labels", trace: "account_label", fn: func(event *webhookEvent) bool {
+		return labelAccount(knownAccounts, currentConfig().Accounts, event)
+	}},
+	{name: "pot_names", trace: "pot_name", fn: func(event *webhookEvent) bool {
+		return resolvePotName(potNames, event)
+	}},
+}
+
+// publishedOutcome is the trace outcome of an event processed without error
+func publishedOutcome(event *webhookEvent) string {
+	if event.Dropped {
+		return "dropped by script"
+	}
+	return "published"
+}
+
+// processEvent enriches an event, passes it through the script and publishes
+// it to every configured sink, returning an error if a required sink failed
+func processEvent(ctx context.Context, event *webhookEvent) error {
+	// Mirrored events were enriched by the instance that received them, which
+	// also sent their alerts and settlement events
+	mirrored := event.Origin != ""
+	if !mirrored {
+		for _, enrichment := range processEnrichments {
+			enrichment.fn(ctx, event)
+		}
+		if !runScript(ctx, currentConfig().Script, event) {
+			event.Dropped = true
+			return nil
+		}
+		spendAnomalies.check(ctx, event)
+	}
+	if err := publishToSinks(ctx, currentSinks(), currentConfig().Transform, event); err != nil {
+		return err
+	}
+	if failover != nil {
+		failover.markPublished(ctx, event)
+	}
+	if !mirrored {
+		expenseSplits.apply(ctx, event)
+		transactionLifecycles.apply(ctx, event)
+	}
+	return nil
+}
+
+// publishGeneratedEvent publishes an event generated by the server itself,
+// such as a demo event, through the same pipeline as received webhooks
+func publishGeneratedEvent(eventType string, body []byte, auth string) error {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return err
+	}
+
+	webhookEventsReceived.WithLabelValues(eventType).Inc()
+	return dispatchEvent(newWebhookEvent(eventType, body, payload, nil, auth))
+}
+
+// dispatchEvent queues an event for the worker pool, or processes it straight
+// away if asynchronous processing is disabled
+func dispatchEvent(event *webhookEvent) error {
+	if bufferOnStandby(event) {
+		return nil
+	}
+	if asyncEnabled() {
+		if !asyncQueue.Push(event) {
+			eventTraces.setOutcome(event.ID, "rejected: queue full")
+			return fmt.Errorf("event queue is full")
+		}
+		eventTraces.setOutcome(event.ID, "queued")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), currentConfig().Retry.timeout())
+	defer cancel()
+	if err := processEvent(ctx, event); err != nil {
+		eventTraces.setOutcome(event.ID, "failed: "+err.Error())
+		return err
+	}
+	eventTraces.setOutcome(event.ID, publishedOutcome(event))
+	return nil
+}
+
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -131,13 +474,30 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer r.Body.Close()
+	cfg := currentConfig()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		writeBodyReadError(w, err)
 		return
 	}
 
+	// Account the event against the tenant's quota in multi-tenant mode
+	tenant := tenantFromContext(r.Context())
+	if tenant != nil {
+		decision := enforceTenantQuota(r.Context(), tenant, len(body))
+		if !decision.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(decision.retryAfter.Seconds())+1))
+			http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// Convert bodies a proxy re-encoded to UTF-8, keeping the raw body for
+	// the event store
+	raw := body
+	body, encoding := utf8Body(r, raw)
+
 	// Parse the webhook payload to get the event type
 	var payload map[string]interface{}
 	err = json.Unmarshal(body, &payload)
@@ -154,10 +514,47 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check the payload against the typed structs for known event types
+	if err := validatePayload(body); err != nil {
+		if cfg.StrictDecoding {
+			logWarn("Rejecting %s event: %v", eventType, err)
+			http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		logWarn("Received %s event that doesn't match the expected payload: %v", eventType, err)
+	}
+
 	logInfo("Received webhook event: %s", eventType)
+	webhookEventsReceived.WithLabelValues(eventType).Inc()
+	lastEventReceived.Store(clock.Now().UnixNano())
+
+	// Acknowledge events that aren't to be published, so Monzo doesn't retry
+	// them, keeping them in the event store with the section that filtered
+	// them out
+	auth := authResult(tenant)
+	if section := filteredBy(cfg, eventType, payload); section != "" {
+		logInfo("Dropping %s event: filtered by %s", eventType, section)
+		received := clock.Now()
+		event := &webhookEvent{
+			ID:        newEventID(received),
+			Type:      eventType,
+			AccountID: accountIDFromPayload(payload),
+			Tenant:    tenant,
+			Received:  received,
+			TraceID:   traceIDFromRequest(r),
+			Encoding:  encoding,
+		}
+		storedEvents.record(event, raw, deliveryFromRequest(r, event, auth), section)
+		eventsFiltered.WithLabelValues(eventType).Inc()
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Webhook ignored")); err != nil {
+			logError("Error writing response: %v", err)
+		}
+		return
+	}
 
 	// Only log payload at DEBUG level
-	if currentLogLevel <= DEBUG {
+	if logLevel() <= DEBUG {
 		jsonOutput, err := json.MarshalIndent(payload, "", "  ")
 		if err != nil {
 			logError("Error formatting JSON: %v", err)
@@ -167,18 +564,75 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Publish to Redis if client is configured
-	if redisClient != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	event := newWebhookEvent(eventType, body, payload, tenant, auth)
+	event.TraceID = traceIDFromRequest(r)
+	event.Encoding = encoding
+	storedEvents.record(event, raw, deliveryFromRequest(r, event, auth), "")
+	w.Header().Set("X-Event-ID", event.ID)
+	defer func() {
+		observeWithExemplar(webhookRequestDuration, clock.Now().Sub(event.Received).Seconds(), eventExemplar(event))
+	}()
+
+	// Leave publishing to the active instance. This is checked before
+	// duplicates, so the standby doesn't claim deliveries it won't publish.
+	if bufferOnStandby(event) {
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Webhook received")); err != nil {
+			logError("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// Skip events that Monzo has already delivered
+	releaseDelivery := func() {}
+	if cfg.Dedup.Enabled {
+		var original string
+		original, releaseDelivery = claimDelivery(r.Context(), stateFor(redisClient), cfg.Dedup, event, clock.Now())
+		if original != "" {
+			logInfo("Suppressing duplicate %s event %s (first delivered as %s)", eventType, event.ID, original)
+			duplicatesSuppressed.WithLabelValues(eventType).Inc()
+			eventTraces.setOutcome(event.ID, "duplicate of "+original)
+			w.WriteHeader(http.StatusOK)
+			if _, err := w.Write([]byte("Duplicate webhook ignored")); err != nil {
+				logError("Error writing response: %v", err)
+			}
+			return
+		}
+	}
+
+	// Hand the event to the worker pool if asynchronous processing is enabled
+	if asyncEnabled() {
+		// Ask Monzo to redeliver later rather than accepting events we can't keep up with
+		status := cfg.Workers.backpressure(asyncQueue.Len(), event.Priority)
+		if status == 0 && !asyncQueue.Push(event) {
+			status = http.StatusServiceUnavailable
+		}
+		if status != 0 {
+			retryAfter, _ := cfg.Workers.retryAfter()
+			logWarn("Event queue is under pressure (%d queued) - rejecting %s event with %d", asyncQueue.Len(), eventType, status)
+			backpressureRejections.WithLabelValues(strconv.Itoa(status)).Inc()
+			releaseDelivery()
+			eventTraces.setOutcome(event.ID, fmt.Sprintf("rejected: %d %s", status, http.StatusText(status)))
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		logDebug("Queued %s event %s with priority %d", eventType, event.ID, event.Priority)
+		eventTraces.setOutcome(event.ID, "queued")
+	} else {
+		ctx, cancel := publishContext(r.Context(), cfg, event.Received, clock.Now())
 		defer cancel()
 
-		err = redisClient.Publish(ctx, eventConfig.Channel, body).Err()
-		if err != nil {
-			logError("Error publishing to Redis channel '%s': %v", eventConfig.Channel, err)
-			// Don't fail the request if Redis publish fails
-		} else {
-			logInfo("Published webhook to Redis channel: %s", eventConfig.Channel)
+		if err := processEvent(ctx, event); err != nil {
+			if r.Context().Err() != nil {
+				logWarn("Client disconnected before %s event %s was published", eventType, event.ID)
+			}
+			releaseDelivery()
+			eventTraces.setOutcome(event.ID, "failed: "+err.Error())
+			http.Error(w, "Error publishing webhook", http.StatusServiceUnavailable)
+			return
 		}
+		eventTraces.setOutcome(event.ID, publishedOutcome(event))
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -188,6 +642,12 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdout))
+}
+
+// serve runs the webhook server with the config file named by the -config
+// flag, if any
+func serve(configFlag string) {
 	// Set log level from environment variable
 	logLevelStr := os.Getenv("LOG_LEVEL")
 	if logLevelStr == "" {
@@ -196,38 +656,198 @@ func main() {
 	currentLogLevel = parseLogLevel(logLevelStr)
 	logInfo("Log level set to: %s", strings.ToUpper(logLevelStr))
 
-	// Load event configuration
-	configFile := os.Getenv("CONFIG_FILE")
+	// Load event configuration, from environment variables and flags alone if
+	// there's no config file
+	configFile := configFilePath(configFlag)
+	err := loadEventConfig(configFile)
+	if err != nil && configFile == "" {
+		logError("Invalid configuration: %v", err)
+		logError("Please create a configuration file with the channel name, or set REDIS_CHANNEL")
+		os.Exit(1)
+	} else if err != nil {
+		logError("Error loading configuration file '%s': %v", configFile, err)
+		os.Exit(1)
+	}
+	eventConfigFile = configFile
 	if configFile == "" {
-		configFile = "config.json"
+		logInfo("No configuration file - using environment variables and flags: channel=%s", eventConfig.Channel)
+	} else {
+		logInfo("Loaded event configuration from %s: channel=%s", configFile, eventConfig.Channel)
+	}
+	var lint configCheck
+	checkBestPractices(&lint, eventConfig)
+	for _, warning := range lint.warnings {
+		logWarn("Configuration: %s", warning)
+	}
+	if rendered, err := renderConfig(eventConfig); err != nil {
+		logWarn("Error rendering event configuration: %v", err)
+	} else {
+		logDebug("Effective event configuration: %s", rendered)
+	}
+	if eventConfig.Stream.Name != "" {
+		logInfo("Redis stream publishing enabled: stream=%s max_len=%d max_age=%s",
+			eventConfig.Stream.Name, eventConfig.Stream.MaxLen, eventConfig.Stream.MaxAge)
 	}
 
-	err := loadEventConfig(configFile)
+	// Read credentials from Vault if it is configured
+	vault, err := vaultFromEnv()
 	if err != nil {
-		logError("Error loading configuration file '%s': %v", configFile, err)
-		logError("Please create a configuration file with the channel name")
+		logError("Invalid Vault configuration: %v", err)
 		os.Exit(1)
 	}
-	logInfo("Loaded event configuration from %s: channel=%s", configFile, eventConfig.Channel)
+	if vault != nil {
+		if err := vault.login(context.Background()); err != nil {
+			logError("Error authenticating with Vault at %s: %v", vault.addr, err)
+			os.Exit(1)
+		}
+		logInfo("Vault enabled: addr=%s", vault.addr)
+	}
 
 	// Load basic auth credentials from environment variables
 	basicAuthUsername = os.Getenv("WEBHOOK_USERNAME")
-	basicAuthPassword = os.Getenv("WEBHOOK_PASSWORD")
-
-	if basicAuthUsername != "" && basicAuthPassword != "" {
-		logInfo("Basic authentication enabled for webhook endpoint")
-	} else if basicAuthUsername != "" || basicAuthPassword != "" {
-		logWarn("Basic auth partially configured - both WEBHOOK_USERNAME and WEBHOOK_PASSWORD must be set. Authentication disabled.")
-		basicAuthUsername = ""
-		basicAuthPassword = ""
+	basicAuthPassword, err = getenvSecret("WEBHOOK_PASSWORD")
+	if err != nil {
+		logError("Invalid basic auth configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// Or from Vault, replacing them when the secret changes
+	if path := os.Getenv("VAULT_WEBHOOK_AUTH_PATH"); path != "" {
+		if vault == nil || basicAuthUsername != "" || basicAuthPassword != "" {
+			logError("VAULT_WEBHOOK_AUTH_PATH requires VAULT_ADDR, and can't be used with WEBHOOK_USERNAME and WEBHOOK_PASSWORD")
+			os.Exit(1)
+		}
+		creds, err := vault.secret(context.Background(), "webhook credentials", path, []string{"username", "password"}, func(creds map[string]string) {
+			credentialsMu.Lock()
+			basicAuthUsername, basicAuthPassword = creds["username"], creds["password"]
+			credentialsMu.Unlock()
+		})
+		if err != nil {
+			logError("%v", err)
+			os.Exit(1)
+		}
+		basicAuthUsername, basicAuthPassword = creds["username"], creds["password"]
+	}
+
+	if len(eventConfig.Tenants) > 0 {
+		logInfo("Multi-tenant mode enabled with %d tenants", len(eventConfig.Tenants))
+	}
+
+	webhookCredentials, err = htpasswdFromEnv()
+	if err != nil {
+		logError("Error loading webhook credentials: %v", err)
+		os.Exit(1)
+	}
+
+	webhookAuth, err = newTokenAuthenticator(eventConfig.Auth[webhookEndpoint])
+	if err != nil {
+		logError("Invalid webhook authentication configuration: %v", err)
+		os.Exit(1)
+	}
+
+	if webhookAuth != nil {
+		logInfo("Webhook endpoint authentication enabled: type=%s", webhookAuth.kind)
+		if basicAuthUsername != "" || basicAuthPassword != "" || webhookCredentials != nil {
+			logWarn("WEBHOOK_USERNAME, WEBHOOK_PASSWORD and WEBHOOK_HTPASSWD_FILE are ignored because the webhook endpoint uses %s authentication", webhookAuth.kind)
+		}
 	} else {
-		logInfo("Basic authentication not configured - webhook endpoint is unprotected")
+		if basicAuthUsername != "" && basicAuthPassword != "" {
+			logInfo("Basic authentication enabled for webhook endpoint")
+		} else if basicAuthUsername != "" || basicAuthPassword != "" {
+			logWarn("Basic auth partially configured - both WEBHOOK_USERNAME and WEBHOOK_PASSWORD must be set. Ignoring them.")
+			basicAuthUsername = ""
+			basicAuthPassword = ""
+		}
+		if webhookCredentials != nil {
+			logInfo("Basic authentication enabled for webhook endpoint with credentials from %s", webhookCredentials.path)
+			// Pick up rotated credentials without a restart
+			go runReload(context.Background(), "webhook credentials", webhookCredentials.load, time.Minute)
+		}
+		if basicAuthUsername == "" && webhookCredentials == nil && len(eventConfig.Tenants) == 0 {
+			logInfo("Basic authentication not configured - webhook endpoint is unprotected")
+		}
+	}
+
+	// Restrict the webhook endpoint to known address ranges
+	webhookAllowlist, err = ipAllowlistFromEnv()
+	if err != nil {
+		logError("Invalid IP allowlist configuration: %v", err)
+		os.Exit(1)
+	}
+	if webhookAllowlist != nil {
+		logInfo("Webhook IP allowlist enabled: %d ranges, proxy header=%q", len(webhookAllowlist.allowed), webhookAllowlist.header)
+	}
+
+	// Limit the size of webhook bodies
+	maxBodyBytes, err = maxBodyBytesFromEnv()
+	if err != nil {
+		logError("Invalid body size limit: %v", err)
+		os.Exit(1)
+	}
+	logInfo("Webhook body size limit: %d bytes", maxBodyBytes)
+
+	// Load the admin API token from environment variables
+	adminToken, err = getenvSecret("ADMIN_TOKEN")
+	if err != nil {
+		logError("Invalid admin API configuration: %v", err)
+		os.Exit(1)
+	}
+	if adminToken != "" {
+		logInfo("Admin API enabled")
+	}
+
+	// Report publish errors and panics to Sentry when configured
+	errorReporter, err = sentryFromEnv()
+	if err != nil {
+		logError("Invalid Sentry configuration: %v", err)
+		os.Exit(1)
+	}
+	if errorReporter != nil {
+		logInfo("Sentry error reporting enabled: host=%s", errorReporter.host)
+	}
+
+	pusher, err := metricsPusherFromEnv()
+	if err != nil {
+		logError("Invalid metrics push configuration: %v", err)
+		os.Exit(1)
+	}
+	if pusher != nil {
+		logInfo("Pushing metrics every %v: url=%s format=%s", pusher.interval, pusher.url, pusher.format)
+		go pusher.run(context.Background())
 	}
 
 	// Configure Redis connection
 	redisHost := os.Getenv("REDIS_HOST")
 	redisPort := os.Getenv("REDIS_PORT")
-	redisPassword := os.Getenv("REDIS_PASSWORD")
+	password, err := getenvSecret("REDIS_PASSWORD")
+	if err != nil {
+		logError("Invalid Redis configuration: %v", err)
+		os.Exit(1)
+	}
+	// A username selects a Redis ACL user, which only needs to publish
+	redisUsername := &credentialValue{value: os.Getenv("REDIS_USERNAME")}
+	redisPassword := &credentialValue{value: password}
+	if path := os.Getenv("VAULT_REDIS_PATH"); path != "" {
+		if vault == nil || password != "" {
+			logError("VAULT_REDIS_PATH requires VAULT_ADDR, and can't be used with REDIS_PASSWORD")
+			os.Exit(1)
+		}
+		setCredentials := func(creds map[string]string) {
+			if creds["username"] != "" {
+				redisUsername.set(creds["username"])
+			}
+			redisPassword.set(creds["password"])
+		}
+		creds, err := vault.secret(context.Background(), "Redis credentials", path, []string{"password"}, setCredentials)
+		if err != nil {
+			logError("%v", err)
+			os.Exit(1)
+		}
+		setCredentials(creds)
+	}
+	if vault != nil {
+		go runReload(context.Background(), "Vault secrets", vault.refresh, time.Minute)
+	}
 
 	// Set defaults
 	if redisHost == "" {
@@ -240,22 +860,603 @@ func main() {
 	// Initialize Redis client
 	redisAddr := fmt.Sprintf("%s:%s", redisHost, redisPort)
 	redisClient = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: redisPassword, // empty string means no password
+		Addr: redisAddr,
+		// Read for each new connection, so rotated credentials are picked
+		// up. An empty password means no password.
+		CredentialsProvider: func() (string, string) { return redisUsername.get(), redisPassword.get() },
 	})
 
+	// Pick up credentials rotated in secret files without a restart
+	if watchCredentialSecrets(redisPassword) {
+		go runReload(context.Background(), "secret files", reloadSecrets, time.Minute)
+	}
+
 	// Test Redis connection
 	ctx := context.Background()
 	_, err = redisClient.Ping(ctx).Result()
-	if err != nil {
+	redisDisabled := err != nil && eventConfig.Spool.Dir == ""
+	go monitorRedis(context.Background(), redisClient, redisDisabled, eventConfig.Spool.Dir != "", 15*time.Second)
+	if err != nil && eventConfig.Spool.Dir != "" {
+		// Keep the client so that events are spooled until Redis is reachable
+		logWarn("Could not connect to Redis at %s: %v", redisAddr, err)
+		logWarn("Redis events will be spooled to %s until Redis is available.", eventConfig.Spool.Dir)
+	} else if err != nil {
+		// Redis features are set up at startup, so they stay disabled
+		// until a restart. The service state shows it.
 		logWarn("Could not connect to Redis at %s: %v", redisAddr, err)
 		logWarn("Redis publishing will be disabled. Webhook will continue to work without Redis.")
+		serviceStatus.degrade(redisComponent, redisDisabledReason)
 		redisClient = nil
 	} else {
 		logInfo("Connected to Redis at %s", redisAddr)
+
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		logRedisPermissions(checkCtx, redisClient, redisUsername.get(), eventConfig, monzoAPIConfigured(eventConfig))
+		cancel()
+
+		if eventConfig.Stream.Name != "" {
+			go runStreamMonitor(context.Background(), redisClient, eventConfig.Stream)
+		}
+	}
+
+	// Publish to the Redis stream from the top-level settings
+	var redisSinks []Sink
+	if redisClient != nil && eventConfig.Stream.Name != "" {
+		redisSinks = append(redisSinks, &streamSink{client: redisClient, cfg: eventConfig.Stream})
+	}
+
+	// Configure optional AWS sinks, sharing one configuration
+	snsPublisher, err := snsPublisherFromEnv(sharedAWSConfig)
+	if err != nil {
+		logError("Invalid SNS configuration: %v", err)
+		os.Exit(1)
+	}
+	if snsPublisher != nil {
+		addSink(&snsSink{publisher: snsPublisher}, false)
+		logInfo("SNS publishing enabled: topic=%s", snsPublisher.TopicARN)
+	}
+	sqsPublisher, err := sqsPublisherFromEnv(sharedAWSConfig)
+	if err != nil {
+		logError("Invalid SQS configuration: %v", err)
+		os.Exit(1)
+	}
+	if sqsPublisher != nil {
+		addSink(&sqsSink{publisher: sqsPublisher}, false)
+		logInfo("SQS publishing enabled: queue=%s", sqsPublisher.QueueURL)
+	}
+
+	if eventConfig.Attachments.Enabled {
+		attachmentArchive, err = newAttachmentArchiver(eventConfig.Attachments, sharedAWSConfig)
+		if err != nil {
+			logError("Invalid attachments configuration: %v", err)
+			os.Exit(1)
+		}
+		logInfo("Attachment archiving enabled: location=%s", attachmentArchive.store.location(""))
+	}
+
+	if eventConfig.Store.Path != "" {
+		storedEvents, err = openEventStore(eventConfig.Store)
+		if err != nil {
+			logError("Error opening event store: %v", err)
+			os.Exit(1)
+		}
+		logInfo("Event store enabled: path=%s purge_delay=%s", eventConfig.Store.Path, storedEvents.purgeDelay)
+		storedEventSource = storedEvents
+
+		// Without Redis, keep dedup claims, transaction state and tenant
+		// usage in the event store
+		if redisClient == nil {
+			localState, err = openSQLiteState(storedEvents.db, clock.Now)
+			if err != nil {
+				logError("Error opening the event store's state: %v", err)
+				os.Exit(1)
+			}
+			tenantUsage.state = localState
+			logInfo("Keeping state in the event store, as Redis is unavailable")
+		}
+	}
+
+	// Mirror events to a peer instance, and accept the events it mirrors
+	mirrorConfig, err = mirrorConfigFromEnv()
+	if err != nil {
+		logError("Invalid mirroring configuration: %v", err)
+		os.Exit(1)
+	}
+	if mirrorConfig != nil {
+		if mirrorConfig.URL != "" {
+			addSink(newMirrorSink(mirrorConfig), false)
+			logInfo("Mirroring events to %s as instance %s", redactURL(mirrorConfig.URL), mirrorConfig.InstanceID)
+		}
+		logInfo("Accepting mirrored events on /mirror as instance %s", mirrorConfig.InstanceID)
+	}
+
+	// Add the Redis channel from the top-level settings and the sinks from
+	// the config file, which are replaced when it is reloaded
+	configSinks, err = newConfigSinks(eventConfig, redisClient, nil)
+	if err != nil {
+		logError("Error configuring %v", err)
+		os.Exit(1)
+	}
+	for _, s := range configSinks {
+		if err := addSink(s.entry.sink, s.entry.required); err != nil {
+			logError("Error configuring sink: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Without the event store, events are read back from the first
+	// PostgreSQL sink's table
+	if storedEventSource == nil {
+		for _, s := range configSinks {
+			if postgres, ok := s.entry.sink.(*postgresSink); ok {
+				storedEventSource = postgres.writer
+				break
+			}
+		}
+	}
+
+	// Spool events for the Redis stream to disk while Redis is unavailable
+	for _, sink := range redisSinks {
+		if eventConfig.Spool.Dir != "" {
+			spooling, err := newSpoolingSink(sink, eventConfig.Spool)
+			if err != nil {
+				logError("Error opening spool for sink '%s': %v", sink.Name(), err)
+				os.Exit(1)
+			}
+			sink = spooling
+		}
+		if err := addSink(sink, false); err != nil {
+			logError("Error configuring sink: %v", err)
+			os.Exit(1)
+		}
+	}
+	if redisClient != nil && eventConfig.Spool.Dir != "" {
+		interval, _ := eventConfig.Spool.replayInterval()
+		go runSpoolReplay(context.Background(), interval)
+		logInfo("Redis spool enabled: dir=%s max_file_bytes=%d replay_interval=%s",
+			eventConfig.Spool.Dir, eventConfig.Spool.maxFileBytes(), interval)
+	}
+	if len(sinks) == 0 {
+		logWarn("No sinks configured - webhook events will only be logged")
+	}
+
+	// Prune old events from the event store and the spools, and purge
+	// deleted events from the event store
+	maxAge := eventConfig.Retention.maxAge()
+	switch {
+	case maxAge > 0 && storedEvents == nil && eventConfig.Spool.Dir == "":
+		logWarn("Retention is configured but neither the event store nor a spool is enabled - nothing will be pruned")
+	case maxAge > 0:
+		go runRetention(context.Background(), eventConfig.Retention)
+		logInfo("Retention enabled: max_age=%s interval=%s", maxAge, eventConfig.Retention.interval())
+	case storedEvents != nil:
+		go runRetention(context.Background(), eventConfig.Retention)
+	}
+
+	// Start the worker pool if asynchronous processing is enabled
+	if eventConfig.Workers.Count > 0 {
+		asyncQueue = newEventQueue(eventConfig.Workers.queueSize())
+		startWorkers(asyncQueue, eventConfig.Workers.Count)
+		logInfo("Asynchronous processing enabled: workers=%d queue_size=%d priority_rules=%d",
+			eventConfig.Workers.Count, eventConfig.Workers.queueSize(), len(eventConfig.Priorities))
+	}
+
+	// Cache responses by delivery ID if idempotency is enabled
+	if eventConfig.Idempotency.Enabled {
+		ttl, _ := eventConfig.Idempotency.ttl()
+		webhookResponses = newResponseCache(ttl, eventConfig.Idempotency.maxEntries(), clock.Now)
+		logInfo("Idempotency enabled: header=%s ttl=%s max_entries=%d",
+			eventConfig.Idempotency.header(), ttl, eventConfig.Idempotency.maxEntries())
+	}
+
+	state := stateFor(redisClient)
+	if eventConfig.Dedup.Enabled {
+		if state == nil {
+			logWarn("Duplicate delivery suppression is enabled but neither Redis nor the event store is available - duplicates will be published")
+		} else {
+			logInfo("Duplicate delivery suppression enabled: window=%s", eventConfig.Dedup.window())
+		}
+	}
+
+	if eventConfig.Changes.Enabled && state == nil {
+		logWarn("Transaction changes are enabled but neither Redis nor the event store is available - updates will be published without them")
+	}
+	if eventConfig.Lifecycle.Enabled {
+		if state == nil {
+			logWarn("Transaction lifecycles are enabled but neither Redis nor the event store is available - no lifecycle events will be published")
+		} else {
+			transactionLifecycles = newLifecycleTracker(eventConfig.Lifecycle, state)
+		}
+	}
+
+	eventTraces = newTraceStore(eventConfig.Trace.maxEvents())
+
+	// Only publish while holding the failover lease
+	if eventConfig.Failover.Enabled {
+		if redisClient == nil {
+			logError("Failover requires Redis, which is unavailable")
+			os.Exit(1)
+		}
+		failover = newFailoverCoordinator(eventConfig.Failover, redisClient, dispatchEvent, clock.Now)
+		if err := failover.renew(context.Background()); err != nil {
+			logWarn("Error acquiring failover lease: %v", err)
+		}
+		if !failover.active() {
+			logInfo("Failover: %s is the standby instance - buffering events", failover.identity)
+			serviceStatus.degrade(failoverComponent, failoverStandbyReason)
+		}
+		go failover.run(context.Background())
+		logInfo("Failover enabled: lease_ttl=%s buffer_window=%s buffer_size=%d",
+			eventConfig.Failover.leaseTTL(), eventConfig.Failover.bufferWindow(), eventConfig.Failover.bufferSize())
+	}
+
+	// Tell consumers when events are published without enrichment
+	serviceStatus.publish = publishGeneratedEvent
+
+	if eventConfig.Classifier.URL != "" {
+		transactionClassifier = newClassifier(eventConfig.Classifier, clock.Now)
+		logInfo("Category classification enabled: url=%s", redactURL(eventConfig.Classifier.URL))
+	}
+
+	// Tasks run after the server starts, before it's reported ready
+	var warmups []warmupTask
+
+	monzoTokenManager, err = monzoTokenManagerFromEnv(context.Background(), eventConfig.MonzoAPI, redisClient)
+	if err != nil {
+		logError("Invalid Monzo API token configuration: %v", err)
+		os.Exit(1)
+	}
+	var token *credentialValue
+	var accountManagers map[string]*tokenManager
+	if monzoTokenManager != nil {
+		token = monzoTokenManager.token
+		if tokens := monzoTokenManager.tokens(); tokens.AccessToken == "" && tokens.RefreshToken == "" {
+			monzoReauthRequired.Set(1)
+			logWarn("No Monzo API tokens are stored yet - the service must be authorised")
+		}
+		logInfo("Monzo API tokens managed: store=%s refresh_before=%s", eventConfig.MonzoAPI.Tokens.Store, monzoTokenManager.refreshBefore)
+		go monzoTokenManager.run(context.Background())
+
+		// Accounts with their own tokens refresh them separately
+		accountManagers, err = accountTokenManagers(context.Background(), eventConfig.MonzoAPI, eventConfig.Accounts, monzoTokenManager, redisClient)
+		if err != nil {
+			logError("Invalid Monzo API token configuration: %v", err)
+			os.Exit(1)
+		}
+		for account, manager := range accountManagers {
+			if tokens := manager.tokens(); tokens.AccessToken == "" && tokens.RefreshToken == "" {
+				manager.setReauthRequired(true)
+				logWarn("No Monzo API tokens are stored yet for account %s - it must be authorised", account)
+			}
+			go manager.run(context.Background())
+		}
+		if len(accountManagers) > 0 {
+			logInfo("Monzo API tokens managed separately for %d accounts", len(accountManagers))
+		}
+
+		// Obtain tokens through the running service with the OAuth flow
+		if redirectURL := os.Getenv("MONZO_REDIRECT_URL"); redirectURL != "" {
+			if parsed, err := url.Parse(redirectURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				logError("Invalid MONZO_REDIRECT_URL: must be an http or https URL")
+				os.Exit(1)
+			}
+			if adminToken == "" {
+				logWarn("MONZO_REDIRECT_URL is set but ADMIN_TOKEN isn't - the OAuth flow is disabled")
+			} else {
+				monzoOAuth = newOAuthFlow(monzoTokenManager, eventConfig.MonzoAPI.Tokens.AuthURL, redirectURL, clock.Now)
+				monzoOAuth.accounts = accountManagers
+				logInfo("Monzo OAuth flow enabled: redirect_url=%s", redirectURL)
+			}
+		}
+	} else if token, err = monzoAccessToken(vault); err != nil {
+		logError("Invalid Monzo API configuration: %v", err)
+		os.Exit(1)
+	}
+	if token != nil {
+		monzoAPI = newMonzoClient(eventConfig.MonzoAPI, token, clock.Now)
+		logInfo("Monzo API client enabled: url=%s", monzoAPI.baseURL)
+		if redisClient != nil && !eventConfig.MonzoAPI.Cache.Disabled {
+			monzoAPI.cache = newMonzoCache(redisClient, eventConfig.MonzoAPI.Cache)
+			logInfo("Monzo API lookups cached in Redis: transaction_ttl=%s merchant_ttl=%s",
+				monzoAPI.cache.transactionTTL, monzoAPI.cache.merchantTTL)
+		}
+		for _, account := range eventConfig.Accounts {
+			if manager := accountManagers[account.ID]; manager != nil {
+				client := monzoAPI.addAccount(eventConfig.MonzoAPI, account, manager.token)
+				logInfo("Monzo API client for account %s uses its own tokens: rate_limit=%g burst=%g",
+					account.ID, client.limiter.rate, client.limiter.burst)
+			}
+		}
+		warmups = append(warmups, warmupTask{name: "monzo_api", fn: func(ctx context.Context) error {
+			whoami, err := monzoAPI.whoAmI(ctx)
+			if err != nil {
+				return fmt.Errorf("access token check failed: %w", err)
+			}
+			logInfo("Monzo API authenticated: user_id=%s client_id=%s", whoami.UserID, whoami.ClientID)
+			return nil
+		}})
+		if monzoAPI.cache != nil && !eventConfig.MonzoAPI.Enrichment.Disabled {
+			warmups = append(warmups, warmupTask{name: "merchants", fn: func(ctx context.Context) error {
+				return warmMerchants(ctx, monzoAPI, currentConfig().Accounts, eventConfig.Warmup.merchantDays())
+			}})
+		}
+	}
+
+	if len(eventConfig.Accounts) > 0 {
+		if monzoAPI == nil {
+			logInfo("Labelling events for %d accounts from config", len(eventConfig.Accounts))
+		} else {
+			loadAccounts := func(ctx context.Context) error {
+				return knownAccounts.load(ctx, monzoAPI, currentConfig().Accounts)
+			}
+			warmups = append(warmups, warmupTask{name: "accounts", fn: func(ctx context.Context) error {
+				if err := loadAccounts(ctx); err != nil {
+					return fmt.Errorf("error reading account details from the Monzo API, labelling events from config only: %w", err)
+				}
+				logInfo("Labelling events for %d accounts with details from the Monzo API", len(eventConfig.Accounts))
+				return nil
+			}})
+			go runReload(context.Background(), "account details", loadAccounts, time.Hour)
+		}
+	}
+
+	if eventConfig.Pots.Enabled {
+		if monzoAPI == nil {
+			logWarn("Pot name resolution is enabled but no Monzo access token is configured - pot names are disabled")
+		} else {
+			syncPots := func(ctx context.Context) error {
+				return potNames.sync(ctx, monzoAPI, currentConfig().Accounts)
+			}
+			warmups = append(warmups, warmupTask{name: "pots", fn: syncPots})
+			go runReload(context.Background(), "pots", syncPots, eventConfig.Pots.syncInterval())
+			logInfo("Pot name resolution enabled: sync_interval=%s", eventConfig.Pots.syncInterval())
+		}
 	}
 
-	http.HandleFunc("/webhook", basicAuthMiddleware(webhookHandler))
+	// Perform Monzo actions sent on the commands channel
+	if eventConfig.Commands.Channel != "" {
+		switch {
+		case monzoAPI == nil:
+			logWarn("The commands channel is configured but no Monzo access token is configured - commands are disabled")
+		case redisClient == nil:
+			logWarn("The commands channel is configured but Redis is unavailable - commands are disabled")
+		default:
+			go runCommands(context.Background(), redisClient, monzoAPI, eventConfig.Commands)
+			logInfo("Commands channel enabled: channel=%s results_channel=%s actions=%v",
+				eventConfig.Commands.Channel, eventConfig.Commands.ResultsChannel, eventConfig.Commands.Actions)
+		}
+	}
+
+	publicURL, err := getenvSecret("WEBHOOK_PUBLIC_URL")
+	if err != nil {
+		logError("Invalid WEBHOOK_PUBLIC_URL: %v", err)
+		os.Exit(1)
+	}
+	if publicURL != "" {
+		u, err := url.Parse(publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logError("WEBHOOK_PUBLIC_URL must be an http or https URL")
+			os.Exit(1)
+		}
+		if basicAuthUsername != "" && u.User == nil {
+			logWarn("WEBHOOK_PUBLIC_URL has no credentials, but the webhook endpoint uses basic authentication - Monzo's deliveries will be rejected")
+		}
+		if monzoAPI == nil {
+			logWarn("WEBHOOK_PUBLIC_URL is set but no Monzo access token is configured - the webhook won't be registered")
+		} else {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				accountIDs, err := webhookAccounts(ctx, monzoAPI, eventConfig.Accounts)
+				if err == nil {
+					err = registerWebhooks(ctx, monzoAPI, publicURL, accountIDs)
+				}
+				if err != nil {
+					logError("Error registering the webhook with Monzo: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Discover the accounts, and register the webhook for them, once the
+	// service is authorised through the OAuth flow
+	if monzoOAuth != nil {
+		monzoOAuth.authorised = func(ctx context.Context, account string) {
+			if err := discoverApprovedAccounts(ctx, monzoAPI.forAccount(account), publicURL, 15*time.Second); err != nil {
+				logError("Error discovering Monzo accounts after authorisation: %v", err)
+			}
+		}
+	}
+
+	if eventConfig.Anomalies.Enabled {
+		spendAnomalies = newAnomalyDetector(eventConfig.Anomalies, sendAlert)
+		logInfo("Spend anomaly detection enabled: multiplier=%g, min_samples=%d",
+			eventConfig.Anomalies.multiplier(), eventConfig.Anomalies.minSamples())
+	}
+
+	history := transactionHistory(storedEventSource, redisClient, eventConfig.Stream.Name)
+	if eventConfig.Forecast.Enabled {
+		if history == nil {
+			logWarn("Cashflow forecast is enabled but there is no event store or Redis stream to read - forecasts are disabled")
+		} else {
+			cashflowForecaster = &forecaster{
+				cfg:     eventConfig.Forecast,
+				history: history,
+				now:     clock.Now,
+			}
+			logInfo("Cashflow forecast enabled: history_days=%d horizon_days=%d",
+				eventConfig.Forecast.historyDays(), eventConfig.Forecast.horizonDays())
+			if eventConfig.Forecast.PublishAt != "" {
+				go runForecastPublisher(context.Background(), cashflowForecaster)
+			}
+		}
+	}
+
+	if eventConfig.Heatmap.Enabled {
+		if redisClient == nil {
+			logWarn("Spending heatmap is enabled but Redis is unavailable - the heatmap is disabled")
+		} else {
+			spendingHeatmap = newSpendHeatmap(eventConfig.Heatmap, redisClient, eventConfig.Stream.Name)
+			logInfo("Spending heatmap enabled: timezone=%s", spendingHeatmap.location)
+			// Read the stream's history now, so the first request only
+			// reads what was added since
+			go func() {
+				if err := spendingHeatmap.update(context.Background()); err != nil {
+					logWarn("Error reading the spending heatmap's history, retrying on the first request: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Build signed export bundles from the transaction history when a key is
+	// configured
+	exportKey, err := exportSigningKeyFromEnv()
+	if err != nil {
+		logError("Invalid export configuration: %v", err)
+		os.Exit(1)
+	}
+	if exportKey != nil {
+		if history == nil {
+			logWarn("EXPORT_SIGNING_KEY is set but there is no event store or Redis stream to export from - exports are disabled")
+		} else {
+			transactionExporter = &exporter{
+				history: history,
+				key:     exportKey,
+				now:     clock.Now,
+			}
+			logInfo("Transaction exports enabled: key fingerprint=%s", transactionExporter.fingerprint())
+		}
+	}
+
+	// Reprocess the events in the Redis stream through the current pipeline
+	if redisClient != nil && eventConfig.Stream.Name != "" {
+		eventReprocessor = newReprocessor(redisClient, eventConfig.Stream.Name)
+	}
+
+	// Load the feature flags' overrides from Redis, recording the flags'
+	// states in the metrics as they change
+	featureFlags = newFeatureFlagSet(redisClient)
+	if err := featureFlags.load(context.Background()); err != nil {
+		logWarn("Error loading feature flag overrides: %v", err)
+	}
+	go runReload(context.Background(), "feature flags", featureFlags.load, 30*time.Second)
+
+	// Load the muted merchants, keeping them in Redis when it's available
+	merchantMutes = newMerchantMuteList(redisClient)
+	if redisClient != nil {
+		if err := merchantMutes.load(context.Background()); err != nil {
+			logWarn("Error loading muted merchants: %v", err)
+		}
+		go runReload(context.Background(), "muted merchants", merchantMutes.load, time.Minute)
+	}
+
+	// Load the merchant aliases, with overrides kept in Redis
+	merchantAliases = newMerchantAliasTable(eventConfig.MerchantAliases, redisClient)
+	if redisClient != nil {
+		if err := merchantAliases.load(context.Background()); err != nil {
+			logWarn("Error loading merchant alias overrides: %v", err)
+		}
+		go runReload(context.Background(), "merchant aliases", merchantAliases.load, time.Minute)
+	}
+
+	// Load the split transactions, keeping them in Redis when it's available
+	expenseSplits = newSplitLedger(eventConfig.Splits, redisClient)
+	if redisClient != nil {
+		if err := expenseSplits.load(context.Background()); err != nil {
+			logWarn("Error loading split transactions: %v", err)
+		}
+		go runReload(context.Background(), "split transactions", expenseSplits.load, time.Minute)
+	}
+
+	// Publish synthetic events for demos instead of waiting for real ones
+	if demoMode, _ := strconv.ParseBool(os.Getenv("DEMO_MODE")); demoMode {
+		if len(eventConfig.Demo) == 0 {
+			logWarn("DEMO_MODE is on but no demo scenarios are configured")
+		} else {
+			logWarn("DEMO_MODE is on - publishing synthetic events for %d scenarios", len(eventConfig.Demo))
+			go runDemoScenarios(context.Background(), eventConfig.Demo)
+		}
+	}
+
+	// Start the independent pipelines, each with its own sinks
+	for _, cfg := range eventConfig.Pipelines {
+		p, err := newPipeline(cfg, redisClient)
+		if err != nil {
+			logError("Error starting pipelines: %v", err)
+			os.Exit(1)
+		}
+		logInfo("Pipeline '%s' enabled on %s with %d sinks", cfg.Name, cfg.Path, len(p.sinks))
+		runningPipelines = append(runningPipelines, p)
+	}
+
+	// Apply changes to the config file without a restart
+	if eventConfigFile != "" {
+		go watchEventConfig(context.Background(), configWatchInterval)
+	}
+
+	// The server has its own mux, so that handlers registered on the default
+	// one, such as net/http/pprof's, aren't exposed
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", ipAllowlistMiddleware(maxBodyMiddleware(webhookAuthMiddleware(idempotencyMiddleware(webhookHandler)))))
+	mux.HandleFunc("/webhook/test", ipAllowlistMiddleware(maxBodyMiddleware(webhookAuthMiddleware(webhookTestHandler))))
+	for _, p := range runningPipelines {
+		mux.HandleFunc(p.cfg.Path, ipAllowlistMiddleware(maxBodyMiddleware(webhookAuthMiddleware(p.handler))))
+	}
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/catalog", catalogHandler)
+	if eventConfig.StatusPage.Enabled {
+		mux.HandleFunc("/status", statusPageHandler)
+	}
+	if mirrorConfig != nil {
+		// Mirrored requests are authenticated by their signature
+		mux.HandleFunc("/mirror", maxBodyMiddleware(mirrorHandler))
+	}
+	if adminToken != "" {
+		mux.HandleFunc("/admin/usage", adminAuthMiddleware(adminUsageHandler))
+		mux.HandleFunc("/admin/config", adminAuthMiddleware(adminConfigHandler))
+		mux.HandleFunc("/admin/overrides", adminAuthMiddleware(adminOverridesHandler))
+		mux.HandleFunc("/admin/overrides/{name}", adminAuthMiddleware(adminOverrideHandler))
+		mux.HandleFunc("/admin/events/{id}/trace", adminAuthMiddleware(adminEventTraceHandler))
+		mux.HandleFunc("/admin/feature-flags", adminAuthMiddleware(adminFeatureFlagsHandler))
+		mux.HandleFunc("/admin/feature-flags/{name}", adminAuthMiddleware(adminFeatureFlagHandler))
+		mux.HandleFunc("/admin/mutes", adminAuthMiddleware(adminMutesHandler))
+		mux.HandleFunc("/admin/mutes/{merchant}", adminAuthMiddleware(adminMuteHandler))
+		mux.HandleFunc("/admin/merchant-aliases", adminAuthMiddleware(adminMerchantAliasesHandler))
+		mux.HandleFunc("/admin/merchant-aliases/{pattern}", adminAuthMiddleware(adminMerchantAliasHandler))
+		mux.HandleFunc("/admin/splits", adminAuthMiddleware(adminSplitsHandler))
+		mux.HandleFunc("/admin/splits/{transaction}", adminAuthMiddleware(adminSplitHandler))
+		if cashflowForecaster != nil {
+			mux.HandleFunc("/stats/forecast", adminAuthMiddleware(statsForecastHandler))
+		}
+		if spendingHeatmap != nil {
+			mux.HandleFunc("/stats/heatmap", adminAuthMiddleware(statsHeatmapHandler))
+		}
+		if transactionExporter != nil {
+			mux.HandleFunc("/admin/exports", adminAuthMiddleware(adminExportHandler))
+		}
+		if eventReprocessor != nil {
+			mux.HandleFunc("/admin/reprocess", adminAuthMiddleware(adminReprocessHandler))
+		}
+		if storedEventSource != nil {
+			mux.HandleFunc("/admin/replay", adminAuthMiddleware(adminReplayHandler))
+			mux.HandleFunc("/events", adminAuthMiddleware(eventsHandler))
+			mux.HandleFunc("/admin/transactions/export", adminAuthMiddleware(adminTransactionsExportHandler))
+		}
+		if storedEvents != nil {
+			mux.HandleFunc("/admin/deletions", adminAuthMiddleware(adminDeletionsHandler))
+			mux.HandleFunc("/admin/deletions/{id}/restore", adminAuthMiddleware(adminDeletionRestoreHandler))
+		}
+		if monzoOAuth != nil {
+			mux.HandleFunc("/auth/start", browserAdminAuthMiddleware(authStartHandler))
+			mux.HandleFunc("/auth/callback", authCallbackHandler)
+		}
+	}
+
+	// Serve runtime profiles on a separate address when configured
+	if addr := os.Getenv("PPROF_ADDR"); addr != "" {
+		go servePprof(addr)
+	}
 
 	// Get port from environment variable, default to 8080
 	port := os.Getenv("PORT")
@@ -268,6 +1469,65 @@ func main() {
 		port = ":" + port
 	}
 
+	var handler http.Handler = mux
+	if errorReporter != nil {
+		handler = sentryRecoverMiddleware(errorReporter, handler)
+	}
+	server := &http.Server{Addr: port, Handler: handler}
+
+	// Log every request separately from the application logs when enabled
+	accessLog, err := accessLoggerFromConfig(eventConfig.AccessLog)
+	if err != nil {
+		logError("Invalid access log configuration: %v", err)
+		os.Exit(1)
+	}
+	if accessLog != nil {
+		server.Handler = accessLogMiddleware(accessLog, handler)
+		path := eventConfig.AccessLog.Path
+		if path == "" || path == "-" {
+			path = "stdout"
+		}
+		logInfo("Access log enabled: path=%s", path)
+	}
+
+	// Serve HTTPS directly if a certificate is configured
+	server.TLSConfig, err = serverTLSConfigFromEnv()
+	if err != nil {
+		logError("Invalid TLS configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// Or obtain a certificate automatically from an ACME CA
+	acme, err := acmeManagerFromEnv()
+	if err != nil {
+		logError("Invalid ACME configuration: %v", err)
+		os.Exit(1)
+	}
+	if acme != nil {
+		if server.TLSConfig != nil {
+			logError("ACME_DOMAIN can't be used with TLS_CERT_FILE and TLS_KEY_FILE")
+			os.Exit(1)
+		}
+		server.TLSConfig = acme.tlsConfig()
+		logInfo("Automatic certificates enabled: domains=%s directory=%s cache_dir=%s",
+			strings.Join(acme.domains, ","), acme.directoryURL, acme.cacheDir)
+	}
+
+	// Fill the caches and connect to the sinks, reporting not ready until done
+	if redisClient != nil {
+		warmups = append(warmups, warmupTask{name: "redis", fn: func(ctx context.Context) error {
+			return redisClient.Ping(ctx).Err()
+		}})
+	}
+	warmups = append(warmups, sinkWarmupTasks(currentSinks())...)
+	warmingUp.Store(true)
+	go runWarmup(context.Background(), warmups, eventConfig.Warmup.timeout())
+
+	if server.TLSConfig != nil {
+		logInfo("Starting webhook server with TLS on port %s", port)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+
 	logInfo("Starting webhook server on port %s", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	log.Fatal(server.ListenAndServe())
 }
@@ -341,3 +341,46 @@ func TestMainBasicAuthEnvVarLoading(t *testing.T) {
 		})
 	}
 }
+
+func TestWebhookHandlerStrictDecoding(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+
+	basicAuthUsername, basicAuthPassword = "", ""
+	sinks = nil
+
+	valid := `{"type":"transaction.created","data":{"id":"tx_1","account_id":"acc_1","created":"2015-09-04T14:28:40Z","amount":-350,"currency":"GBP"}}`
+	invalid := `{"type":"transaction.created","data":{"id":"tx_1","amount":"lots","currency":"GBP"}}`
+
+	tests := []struct {
+		name               string
+		strict             bool
+		body               string
+		expectedStatusCode int
+	}{
+		{name: "Valid transaction", strict: true, body: valid, expectedStatusCode: http.StatusOK},
+		{name: "Invalid transaction with strict decoding", strict: true, body: invalid, expectedStatusCode: http.StatusBadRequest},
+		{name: "Invalid transaction without strict decoding", body: invalid, expectedStatusCode: http.StatusOK},
+		{name: "Unknown event type", strict: true, body: `{"type":"account.updated","data":{}}`, expectedStatusCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventConfig = EventConfig{StrictDecoding: tt.strict}
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(tt.body))
+			rr := httptest.NewRecorder()
+			webhookHandler(rr, req)
+
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatusCode, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
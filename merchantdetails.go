@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MonzoEnrichmentConfig configures adding merchant details from the Monzo API
+// to transaction.created events whose merchant Monzo didn't expand
+type MonzoEnrichmentConfig struct {
+	Disabled bool `json:"disabled"`
+	// Timeout limits the lookups for each event, including retries,
+	// defaulting to 3s
+	Timeout string `json:"timeout"`
+}
+
+var merchantEnrichments = metrics.newCounterVec("monzo_webhook_merchant_enrichments_total",
+	"transaction.created events enriched with merchant details from the Monzo API, by result (enriched, error).", "result")
+
+// validate checks the enrichment configuration for invalid values
+func (c MonzoEnrichmentConfig) validate() error {
+	if _, err := parsePositiveDuration(c.Timeout, 3*time.Second); err != nil {
+		return fmt.Errorf("invalid monzo_api enrichment timeout: %w", err)
+	}
+	return nil
+}
+
+// enrichMerchant replaces the merchant ID of a transaction.created event with
+// the merchant's details, and fills in its category if Monzo left it out. The
+// event is published as it is if the lookup fails or times out. Tenants'
+// events are left alone, as their transactions aren't visible to the
+// server's Monzo tokens, and looking them up would spend its rate limit on
+// IDs a tenant chose.
+func enrichMerchant(ctx context.Context, client *monzoClient, cfg MonzoEnrichmentConfig, event *webhookEvent) {
+	if client == nil || cfg.Disabled || event.Type != "transaction.created" || event.Tenant != nil {
+		return
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	transactionID, _ := data["id"].(string)
+	var merchantID string
+	switch merchant := data["merchant"].(type) {
+	case string:
+		merchantID = merchant
+	case map[string]interface{}:
+		if name, _ := merchant["name"].(string); name == "" {
+			merchantID, _ = merchant["id"].(string)
+		}
+	}
+	if merchantID == "" || !monzoIDPattern.MatchString(transactionID) {
+		return
+	}
+
+	timeout, _ := parsePositiveDuration(cfg.Timeout, 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// Only the shared tokens affect enrichment for every account
+	client = client.forAccount(event.AccountID)
+	merchant, err := client.merchant(ctx, merchantID, transactionID)
+	if errors.Is(err, errMonzoUnauthorized) && client.account == "" {
+		serviceStatus.degrade(enrichmentComponent, "enrichment disabled: "+err.Error())
+	}
+	if err != nil {
+		merchantEnrichments.WithLabelValues("error").Inc()
+		logWarn("Error looking up merchant %s of %s event %s: %v", merchantID, event.Type, event.ID, client.wrapError(err))
+		return
+	}
+	if client.account == "" {
+		serviceStatus.recover(enrichmentComponent)
+	}
+
+	// Round trip through JSON so the payload holds the same types as one
+	// decoded from a webhook
+	var details map[string]interface{}
+	encoded, err := json.Marshal(merchant)
+	if err == nil {
+		err = json.Unmarshal(encoded, &details)
+	}
+	if err != nil {
+		logError("Error encoding merchant %s of %s event %s: %v", merchantID, event.Type, event.ID, err)
+		return
+	}
+	data["merchant"] = details
+	if category, _ := data["category"].(string); category == "" && merchant.Category != "" {
+		data["category"] = merchant.Category
+	}
+
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding enriched %s event %s: %v", event.Type, event.ID, err)
+		return
+	}
+	merchantEnrichments.WithLabelValues("enriched").Inc()
+	eventTraces.recordTransformation(event.ID, "merchant_details", event.Body, body)
+	event.Body = body
+}
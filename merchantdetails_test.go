@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEnrichMerchant(t *testing.T) {
+	originalStatus := serviceStatus
+	defer func() { serviceStatus = originalStatus }()
+	serviceStatus = &statusTracker{now: time.Now, degraded: make(map[string]componentStatus)}
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/transactions/tx_slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"transaction": {"id": "tx_1", "merchant": {"id": "merch_1", "name": "Coffee Shop", "category": "eating_out", "address": {"city": "London"}}}}`))
+	}))
+	defer server.Close()
+	_, redisClient := newFakeRedis(t)
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+	client.cache = newMonzoCache(redisClient, MonzoAPICacheConfig{})
+
+	tests := []struct {
+		name           string
+		cfg            MonzoEnrichmentConfig
+		tenant         bool
+		body           string
+		expectCalls    int32
+		expectName     string
+		expectCategory string
+	}{
+		{name: "Merchant ID", body: `{"type":"transaction.created","data":{"id":"tx_1","merchant":"merch_1"}}`, expectCalls: 1, expectName: "Coffee Shop", expectCategory: "eating_out"},
+		{name: "Cached merchant", body: `{"type":"transaction.created","data":{"id":"tx_2","merchant":{"id":"merch_1"},"category":"groceries"}}`, expectName: "Coffee Shop", expectCategory: "groceries"},
+		{name: "Expanded merchant", body: `{"type":"transaction.created","data":{"id":"tx_3","merchant":{"id":"merch_9","name":"Bakery"}}}`, expectName: "Bakery"},
+		{name: "No merchant", body: `{"type":"transaction.created","data":{"id":"tx_4","merchant":null}}`},
+		{name: "Updated event", body: `{"type":"transaction.updated","data":{"id":"tx_5","merchant":"merch_2"}}`},
+		{name: "Disabled", cfg: MonzoEnrichmentConfig{Disabled: true}, body: `{"type":"transaction.created","data":{"id":"tx_6","merchant":"merch_2"}}`},
+		{name: "Timeout", cfg: MonzoEnrichmentConfig{Timeout: "50ms"}, body: `{"type":"transaction.created","data":{"id":"tx_slow","merchant":"merch_3"}}`, expectCalls: 1},
+		{name: "Tenant", tenant: true, body: `{"type":"transaction.created","data":{"id":"tx_7","merchant":"merch_4"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &webhookEvent{ID: "evt_1", Body: []byte(tt.body)}
+			json.Unmarshal(event.Body, &event.Payload)
+			event.Type, _ = event.Payload["type"].(string)
+			if tt.tenant {
+				event.Tenant = &TenantConfig{Name: "alice"}
+			}
+			before := calls.Load()
+
+			enrichMerchant(context.Background(), client, tt.cfg, event)
+
+			if got := calls.Load() - before; got != tt.expectCalls {
+				t.Errorf("Expected %d API calls, got %d", tt.expectCalls, got)
+			}
+			var published struct {
+				Data struct {
+					Merchant json.RawMessage `json:"merchant"`
+					Category string          `json:"category"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(event.Body, &published); err != nil {
+				t.Fatalf("Invalid body: %v", err)
+			}
+			var merchant struct {
+				Name string `json:"name"`
+			}
+			json.Unmarshal(published.Data.Merchant, &merchant)
+			if merchant.Name != tt.expectName || published.Data.Category != tt.expectCategory {
+				t.Errorf("Unexpected payload: %s", event.Body)
+			}
+		})
+	}
+}
+
+func TestEnrichMerchantExpiredToken(t *testing.T) {
+	originalStatus := serviceStatus
+	defer func() { serviceStatus = originalStatus }()
+	serviceStatus = &statusTracker{now: time.Now, degraded: make(map[string]componentStatus), publish: func(string, []byte, string) error { return nil }}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "expired"}, time.Now)
+
+	body := `{"type":"transaction.created","data":{"id":"tx_1","merchant":"merch_1"}}`
+	event := &webhookEvent{Type: "transaction.created", Body: []byte(body)}
+	json.Unmarshal(event.Body, &event.Payload)
+	before := testutil.ToFloat64(merchantEnrichments.WithLabelValues("error"))
+	enrichMerchant(context.Background(), client, MonzoEnrichmentConfig{}, event)
+
+	if string(event.Body) != body {
+		t.Errorf("Expected the payload to be unchanged, got %s", event.Body)
+	}
+	if testutil.ToFloat64(merchantEnrichments.WithLabelValues("error"))-before != 1 {
+		t.Error("Expected the failed lookup to be counted")
+	}
+	components := serviceStatus.components()
+	if len(components) != 1 || components[0].Component != enrichmentComponent || components[0].Status != "degraded" {
+		t.Errorf("Expected enrichment to be degraded, got %+v", components)
+	}
+}
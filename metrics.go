@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricDef describes a registered metric, for generating the dashboards
+// and alert rules that use it
+type metricDef struct {
+	collector prometheus.Collector
+	name      string
+	help      string
+	kind      string
+	labels    []string
+}
+
+// metricsRegistry is the Prometheus registry of every metric exposed on
+// /metrics, which also keeps the definitions of the service's own metrics
+type metricsRegistry struct {
+	*prometheus.Registry
+
+	mu   sync.Mutex
+	defs []metricDef
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{Registry: prometheus.NewRegistry()}
+}
+
+// metrics holds the service's metrics, along with the Go runtime's and the
+// process's
+var metrics = func() *metricsRegistry {
+	r := newMetricsRegistry()
+	r.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return r
+}()
+
+var (
+	webhookEventsReceived = metrics.newCounterVec("monzo_webhook_events_received_total",
+		"Webhook events received, by event type.", "type")
+	sinkPublishTotal = metrics.newCounterVec("monzo_webhook_sink_publish_total",
+		"Publish attempts, by sink and result.", "sink", "result")
+	webhookRequestDuration = metrics.newHistogram("monzo_webhook_request_duration_seconds",
+		"Time taken to respond to webhook events, from receiving them.")
+)
+
+// newCounter registers a counter without labels
+func (r *metricsRegistry) newCounter(name, help string) prometheus.Counter {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	r.register(counter, name, help, "counter", nil)
+	return counter
+}
+
+// newCounterVec registers a counter with the given label names
+func (r *metricsRegistry) newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	r.register(vec, name, help, "counter", labels)
+	return vec
+}
+
+// newGauge registers a gauge without labels
+func (r *metricsRegistry) newGauge(name, help string) prometheus.Gauge {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+	r.register(gauge, name, help, "gauge", nil)
+	return gauge
+}
+
+// newGaugeVec registers a gauge with the given label names
+func (r *metricsRegistry) newGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	r.register(vec, name, help, "gauge", labels)
+	return vec
+}
+
+// newHistogram registers a latency histogram without labels
+func (r *metricsRegistry) newHistogram(name, help string) prometheus.Histogram {
+	histogram := prometheus.NewHistogram(latencyHistogramOpts(name, help))
+	r.register(histogram, name, help, "histogram", nil)
+	return histogram
+}
+
+// newHistogramVec registers a latency histogram with the given label names
+func (r *metricsRegistry) newHistogramVec(name, help string, labels ...string) *prometheus.HistogramVec {
+	vec := prometheus.NewHistogramVec(latencyHistogramOpts(name, help), labels)
+	r.register(vec, name, help, "histogram", labels)
+	return vec
+}
+
+func (r *metricsRegistry) register(c prometheus.Collector, name, help, kind string, labels []string) {
+	r.MustRegister(c)
+
+	r.mu.Lock()
+	r.defs = append(r.defs, metricDef{collector: c, name: name, help: help, kind: kind, labels: labels})
+	r.mu.Unlock()
+}
+
+// definitions returns the definitions of the registered metrics, in the
+// order they were registered
+func (r *metricsRegistry) definitions() []metricDef {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]metricDef(nil), r.defs...)
+}
+
+// definition returns the definition of a registered metric
+func (r *metricsRegistry) definition(c prometheus.Collector) (metricDef, bool) {
+	for _, def := range r.definitions() {
+		if def.collector == c {
+			return def, true
+		}
+	}
+	return metricDef{}, false
+}
+
+// latencyHistogramOpts configures a histogram of durations in seconds with
+// both classic buckets and, for scrapers that ask for the protobuf format,
+// native buckets about 10% wide
+func latencyHistogramOpts(name, help string) prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{
+		Name:                            name,
+		Help:                            help,
+		Buckets:                         prometheus.DefBuckets,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  160,
+		NativeHistogramMinResetDuration: time.Hour,
+	}
+}
+
+// observeWithExemplar records a value with an exemplar, such as the ID of the
+// event that took that long
+func observeWithExemplar(o prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	o.(prometheus.ExemplarObserver).ObserveWithExemplar(value, exemplar)
+}
+
+// metricsHandler serves all registered metrics in the best format the
+// scraper accepts: the text format, OpenMetrics with exemplars, or protobuf
+// with native histograms
+var metricsHandler = promhttp.HandlerFor(metrics, promhttp.HandlerOpts{
+	EnableOpenMetrics: true,
+	ErrorLog:          promErrorLogger{},
+}).ServeHTTP
+
+// promErrorLogger logs errors serving the metrics at the ERROR level
+type promErrorLogger struct{}
+
+func (promErrorLogger) Println(v ...interface{}) {
+	logError("Error writing metrics: %v", fmt.Sprint(v...))
+}
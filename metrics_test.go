@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestMetricsRegistryDefinitions(t *testing.T) {
+	registry := newMetricsRegistry()
+	counter := registry.newCounterVec("test_events_total", "Test events.", "type")
+	gauge := registry.newGauge("test_length", "Test length.")
+	unregistered := newMetricsRegistry().newGauge("test_other", "Another metric.")
+
+	defs := registry.definitions()
+	if len(defs) != 2 || defs[0].name != "test_events_total" || defs[1].name != "test_length" {
+		t.Fatalf("Expected the metrics in registration order, got %+v", defs)
+	}
+	if def, ok := registry.definition(counter); !ok || def.kind != "counter" || len(def.labels) != 1 || def.labels[0] != "type" {
+		t.Errorf("Unexpected counter definition: %+v", def)
+	}
+	if def, ok := registry.definition(gauge); !ok || def.kind != "gauge" || len(def.labels) != 0 {
+		t.Errorf("Unexpected gauge definition: %+v", def)
+	}
+	if _, ok := registry.definition(unregistered); ok {
+		t.Error("Expected no definition for a metric of another registry")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	webhookEventsReceived.WithLabelValues("metrics.test").Inc()
+
+	rr := httptest.NewRecorder()
+	metricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `monzo_webhook_events_received_total{type="metrics.test"}`) {
+		t.Errorf("Expected events counter in output, got:\n%s", rr.Body.String())
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	webhookEventsReceived.WithLabelValues("metrics.test").Inc()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	metricsHandler(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Expected an OpenMetrics content type, got '%s'", ct)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "# TYPE monzo_webhook_events_received counter\n") {
+		t.Errorf("Expected the counter family without its _total suffix, got:\n%s", body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Expected output to end with # EOF, got:\n%s", body)
+	}
+}
+
+func TestMetricsHandlerNativeHistograms(t *testing.T) {
+	observeWithExemplar(webhookRequestDuration, 0.5, prometheus.Labels{"event_id": "evt_metrics"})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3")
+	metricsHandler(rr, req)
+
+	decoder := expfmt.NewDecoder(rr.Body, expfmt.ResponseFormat(rr.Header()))
+	for {
+		var family dto.MetricFamily
+		if err := decoder.Decode(&family); err != nil {
+			t.Fatalf("Histogram not found in the protobuf output: %v", err)
+		}
+		if family.GetName() != "monzo_webhook_request_duration_seconds" {
+			continue
+		}
+		h := family.GetMetric()[0].GetHistogram()
+		if h.Schema == nil || len(h.GetPositiveSpan()) == 0 {
+			t.Errorf("Expected native buckets, got %v", h)
+		}
+		if len(h.GetBucket()) != len(prometheus.DefBuckets) {
+			t.Errorf("Expected the classic buckets too, got %d", len(h.GetBucket()))
+		}
+		found := false
+		for _, exemplar := range h.GetExemplars() {
+			for _, label := range exemplar.GetLabel() {
+				found = found || (label.GetName() == "event_id" && label.GetValue() == "evt_metrics")
+			}
+		}
+		if !found {
+			t.Errorf("Expected an exemplar with the event ID, got %v", h.GetExemplars())
+		}
+		return
+	}
+}
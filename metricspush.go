@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var metricsPushes = metrics.newCounterVec("monzo_webhook_metrics_pushes_total",
+	"Pushes of the metrics to a Pushgateway or remote write endpoint, by result.", "result")
+
+// Metrics push formats
+const (
+	pushFormatPushgateway = "pushgateway"
+	pushFormatRemoteWrite = "remote_write"
+)
+
+// metricsPusher pushes the metrics on an interval, for deployments where
+// nothing can scrape /metrics, such as behind a home NAT
+type metricsPusher struct {
+	url      string
+	format   string
+	interval time.Duration
+	job      string
+	instance string
+	username string
+	password string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	now      func() time.Time
+}
+
+// metricsPusherFromEnv configures pushing from METRICS_PUSH_URL and related
+// variables, returning nil if it isn't set
+func metricsPusherFromEnv() (*metricsPusher, error) {
+	pushURL := os.Getenv("METRICS_PUSH_URL")
+	if pushURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(pushURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("METRICS_PUSH_URL must be an http or https URL")
+	}
+
+	format := os.Getenv("METRICS_PUSH_FORMAT")
+	switch format {
+	case "":
+		format = pushFormatPushgateway
+	case pushFormatPushgateway, pushFormatRemoteWrite:
+	default:
+		return nil, fmt.Errorf("METRICS_PUSH_FORMAT must be %s or %s", pushFormatPushgateway, pushFormatRemoteWrite)
+	}
+	interval, err := parsePositiveDuration(os.Getenv("METRICS_PUSH_INTERVAL"), 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid METRICS_PUSH_INTERVAL: %w", err)
+	}
+	password, err := getenvSecret("METRICS_PUSH_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+
+	job := os.Getenv("METRICS_PUSH_JOB")
+	if job == "" {
+		job = "monzo-webhook"
+	}
+	instance := os.Getenv("METRICS_PUSH_INSTANCE")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return &metricsPusher{
+		url:      strings.TrimSuffix(pushURL, "/"),
+		format:   format,
+		interval: interval,
+		job:      job,
+		instance: instance,
+		username: os.Getenv("METRICS_PUSH_USERNAME"),
+		password: password,
+		gatherer: metrics,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      clock.Now,
+	}, nil
+}
+
+// run pushes the metrics every interval until ctx is cancelled
+func (p *metricsPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pushCtx, cancel := context.WithTimeout(ctx, p.interval)
+			if err := p.push(pushCtx); err != nil {
+				logWarn("Error pushing metrics to %s: %v", p.url, err)
+				metricsPushes.WithLabelValues("error").Inc()
+			} else {
+				metricsPushes.WithLabelValues("success").Inc()
+			}
+			cancel()
+		}
+	}
+}
+
+// push sends the current metrics
+func (p *metricsPusher) push(ctx context.Context) error {
+	if p.format == pushFormatRemoteWrite {
+		return p.remoteWrite(ctx)
+	}
+
+	// Replace the metrics in the job and instance's group with the current
+	// ones, in the text format
+	pusher := push.New(p.url, p.job).
+		Grouping("instance", p.instance).
+		Gatherer(p.gatherer).
+		Client(p.client).
+		Format(expfmt.NewFormat(expfmt.TypeTextPlain)).
+		Header(http.Header{"User-Agent": {"monzo-webhook/" + version}})
+	if p.username != "" || p.password != "" {
+		pusher = pusher.BasicAuth(p.username, p.password)
+	}
+	return pusher.PushContext(ctx)
+}
+
+// remoteWrite sends the current metrics as a snappy-compressed Prometheus
+// remote write request
+func (p *metricsPusher) remoteWrite(ctx context.Context) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, remoteWriteBody(samples(families), p.job, p.instance, p.now()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "monzo-webhook/"+version)
+	if p.username != "" || p.password != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// metricSample is a value of one series, as it's named in the text format
+type metricSample struct {
+	name   string
+	labels []string
+	values []string
+	value  float64
+}
+
+// samples flattens gathered metric families into samples, with histograms as
+// their classic buckets, count and sum, and summaries as their quantiles,
+// count and sum
+func samples(families []*dto.MetricFamily) []metricSample {
+	var samples []metricSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			var labels, values []string
+			for _, pair := range m.GetLabel() {
+				labels = append(labels, pair.GetName())
+				values = append(values, pair.GetValue())
+			}
+			with := func(label, value string) ([]string, []string) {
+				return append(labels[:len(labels):len(labels)], label), append(values[:len(values):len(values)], value)
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, metricSample{name: name, labels: labels, values: values, value: m.GetCounter().GetValue()})
+			case dto.MetricType_GAUGE:
+				samples = append(samples, metricSample{name: name, labels: labels, values: values, value: m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, metricSample{name: name, labels: labels, values: values, value: m.GetUntyped().GetValue()})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.GetBucket() {
+					bucketLabels, bucketValues := with("le", strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64))
+					samples = append(samples, metricSample{name: name + "_bucket", labels: bucketLabels, values: bucketValues, value: float64(bucket.GetCumulativeCount())})
+				}
+				infLabels, infValues := with("le", "+Inf")
+				samples = append(samples,
+					metricSample{name: name + "_bucket", labels: infLabels, values: infValues, value: float64(h.GetSampleCount())},
+					metricSample{name: name + "_count", labels: labels, values: values, value: float64(h.GetSampleCount())},
+					metricSample{name: name + "_sum", labels: labels, values: values, value: h.GetSampleSum()})
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, quantile := range s.GetQuantile() {
+					quantileLabels, quantileValues := with("quantile", strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64))
+					samples = append(samples, metricSample{name: name, labels: quantileLabels, values: quantileValues, value: quantile.GetValue()})
+				}
+				samples = append(samples,
+					metricSample{name: name + "_count", labels: labels, values: values, value: float64(s.GetSampleCount())},
+					metricSample{name: name + "_sum", labels: labels, values: values, value: s.GetSampleSum()})
+			}
+		}
+	}
+	return samples
+}
+
+// Field numbers from Prometheus's remote.proto and types.proto
+const (
+	protoWriteRequestTimeseries = 1
+	protoTimeSeriesLabels       = 1
+	protoTimeSeriesSamples      = 2
+	protoLabelName              = 1
+	protoLabelValue             = 2
+	protoSampleValue            = 1
+	protoSampleTimestamp        = 2
+)
+
+// remoteWriteBody encodes samples as a prometheus.WriteRequest, each with the
+// job and instance labels. Labels are sorted by name, as the protocol
+// requires.
+func remoteWriteBody(samples []metricSample, job, instance string, now time.Time) []byte {
+	var body []byte
+	for _, sample := range samples {
+		names := append([]string{"__name__", "instance", "job"}, sample.labels...)
+		values := append([]string{sample.name, instance, job}, sample.values...)
+		order := make([]int, len(names))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(a, b int) bool { return names[order[a]] < names[order[b]] })
+
+		var series []byte
+		for _, i := range order {
+			var label []byte
+			label = protowire.AppendTag(label, protoLabelName, protowire.BytesType)
+			label = protowire.AppendString(label, names[i])
+			label = protowire.AppendTag(label, protoLabelValue, protowire.BytesType)
+			label = protowire.AppendString(label, values[i])
+			series = protowire.AppendTag(series, protoTimeSeriesLabels, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var s []byte
+		s = protowire.AppendTag(s, protoSampleValue, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, protoSampleTimestamp, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(now.UnixMilli()))
+		series = protowire.AppendTag(series, protoTimeSeriesSamples, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		body = protowire.AppendTag(body, protoWriteRequestTimeseries, protowire.BytesType)
+		body = protowire.AppendBytes(body, series)
+	}
+	return body
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoFields decodes a protobuf message into its fields by number, keeping
+// varints as uint64, fixed64 values as float64 and length-delimited fields as
+// bytes
+func protoFields(t *testing.T, data []byte) map[int][]interface{} {
+	t.Helper()
+	fields := make(map[int][]interface{})
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatalf("Invalid field key")
+		}
+		data = data[n:]
+		field := int(num)
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			fields[field] = append(fields[field], v)
+			data = data[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			fields[field] = append(fields[field], math.Float64frombits(v))
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			fields[field] = append(fields[field], v)
+			data = data[n:]
+		default:
+			t.Fatalf("Unexpected wire type %d", typ)
+		}
+	}
+	return fields
+}
+
+func TestSamples(t *testing.T) {
+	registry := newMetricsRegistry()
+	counter := registry.newCounterVec("test_events_total", "Test events.", "type")
+	latency := registry.newHistogramVec("test_duration_seconds", "Test durations.", "sink")
+	counter.WithLabelValues("transaction.created").Inc()
+	latency.WithLabelValues("redis").Observe(0.05)
+	latency.WithLabelValues("redis").Observe(0.5)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	var got []string
+	for _, s := range samples(families) {
+		line := s.name
+		for i, label := range s.labels {
+			line += " " + label + "=" + s.values[i]
+		}
+		got = append(got, line+" "+strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	expected := []string{
+		"test_duration_seconds_bucket sink=redis le=0.005 0",
+		"test_duration_seconds_bucket sink=redis le=0.01 0",
+		"test_duration_seconds_bucket sink=redis le=0.025 0",
+		"test_duration_seconds_bucket sink=redis le=0.05 1",
+		"test_duration_seconds_bucket sink=redis le=0.1 1",
+		"test_duration_seconds_bucket sink=redis le=0.25 1",
+		"test_duration_seconds_bucket sink=redis le=0.5 2",
+		"test_duration_seconds_bucket sink=redis le=1 2",
+		"test_duration_seconds_bucket sink=redis le=2.5 2",
+		"test_duration_seconds_bucket sink=redis le=5 2",
+		"test_duration_seconds_bucket sink=redis le=10 2",
+		"test_duration_seconds_bucket sink=redis le=+Inf 2",
+		"test_duration_seconds_count sink=redis 2",
+		"test_duration_seconds_sum sink=redis 0.55",
+		"test_events_total type=transaction.created 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected samples:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestMetricsPushRemoteWrite(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.newCounterVec("test_events_total", "Test events.", "type").WithLabelValues("transaction.created").Inc()
+
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := &metricsPusher{url: server.URL, format: pushFormatRemoteWrite, job: "monzo-webhook", instance: "home",
+		username: "123", password: "token", gatherer: registry, client: server.Client(), now: func() time.Time { return now }}
+	if err := p.push(context.Background()); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	if header.Get("Content-Encoding") != "snappy" || header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("Unexpected headers: %v", header)
+	}
+	if user, pass, ok := (&http.Request{Header: header}).BasicAuth(); !ok || user != "123" || pass != "token" {
+		t.Errorf("Expected basic auth, got %q %q", user, pass)
+	}
+
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("Body is not snappy-compressed: %v", err)
+	}
+	request := protoFields(t, decoded)
+	if len(request[protoWriteRequestTimeseries]) != 1 {
+		t.Fatalf("Expected 1 time series, got %d", len(request[protoWriteRequestTimeseries]))
+	}
+	series := protoFields(t, request[protoWriteRequestTimeseries][0].([]byte))
+	var labels []string
+	for _, raw := range series[protoTimeSeriesLabels] {
+		label := protoFields(t, raw.([]byte))
+		labels = append(labels, string(label[protoLabelName][0].([]byte))+"="+string(label[protoLabelValue][0].([]byte)))
+	}
+	if got := strings.Join(labels, ","); got != "__name__=test_events_total,instance=home,job=monzo-webhook,type=transaction.created" {
+		t.Errorf("Unexpected labels: %s", got)
+	}
+	sample := protoFields(t, series[protoTimeSeriesSamples][0].([]byte))
+	if sample[protoSampleValue][0] != 1.0 || sample[protoSampleTimestamp][0] != uint64(now.UnixMilli()) {
+		t.Errorf("Unexpected sample: %v", sample)
+	}
+}
+
+func TestMetricsPushPushgateway(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.newCounterVec("test_events_total", "Test events.", "type").WithLabelValues("transaction.created").Inc()
+
+	tests := []struct {
+		name       string
+		instance   string
+		status     int
+		expectPath string
+		expectErr  bool
+	}{
+		{name: "Pushed", instance: "home", status: http.StatusOK, expectPath: "/metrics/job/monzo-webhook/instance/home"},
+		{name: "Instance with a slash", instance: "pods/a", status: http.StatusOK, expectPath: "/metrics/job/monzo-webhook/instance@base64/cG9kcy9h"},
+		{name: "Rejected", instance: "home", status: http.StatusBadRequest, expectPath: "/metrics/job/monzo-webhook/instance/home", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, path = r.Method, r.URL.EscapedPath()
+				data, _ := io.ReadAll(r.Body)
+				body = string(data)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			p := &metricsPusher{url: server.URL, format: pushFormatPushgateway, job: "monzo-webhook", instance: tt.instance,
+				gatherer: registry, client: server.Client(), now: time.Now}
+			err := p.push(context.Background())
+			if tt.expectErr != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+			if method != http.MethodPut || path != tt.expectPath {
+				t.Errorf("Expected PUT %s, got %s %s", tt.expectPath, method, path)
+			}
+			if !strings.Contains(body, `test_events_total{type="transaction.created"} 1`) {
+				t.Errorf("Expected the text format, got %q", body)
+			}
+		})
+	}
+}
+
+func TestMetricsPusherFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		expectNil   bool
+		expectError bool
+	}{
+		{name: "Disabled", expectNil: true},
+		{name: "Pushgateway", env: map[string]string{"METRICS_PUSH_URL": "http://pushgateway:9091/"}},
+		{name: "Remote write", env: map[string]string{"METRICS_PUSH_URL": "https://prometheus/api/v1/write", "METRICS_PUSH_FORMAT": "remote_write", "METRICS_PUSH_INTERVAL": "1m"}},
+		{name: "Invalid URL", env: map[string]string{"METRICS_PUSH_URL": "pushgateway:9091"}, expectError: true},
+		{name: "Unknown format", env: map[string]string{"METRICS_PUSH_URL": "http://pushgateway:9091", "METRICS_PUSH_FORMAT": "graphite"}, expectError: true},
+		{name: "Invalid interval", env: map[string]string{"METRICS_PUSH_URL": "http://pushgateway:9091", "METRICS_PUSH_INTERVAL": "soon"}, expectError: true},
+	}
+	vars := []string{"METRICS_PUSH_URL", "METRICS_PUSH_FORMAT", "METRICS_PUSH_INTERVAL", "METRICS_PUSH_PASSWORD", "METRICS_PUSH_PASSWORD_FILE"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range vars {
+				t.Setenv(name, tt.env[name])
+				if tt.env[name] == "" {
+					os.Unsetenv(name)
+				}
+			}
+			p, err := metricsPusherFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (p == nil) != tt.expectNil {
+				t.Fatalf("Expected nil %v, got %+v", tt.expectNil, p)
+			}
+			if p != nil && (p.job != "monzo-webhook" || strings.HasSuffix(p.url, "/") || p.interval <= 0) {
+				t.Errorf("Unexpected pusher: %+v", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers on mirrored requests
+const (
+	mirrorOriginHeader    = "X-Mirror-Origin"
+	mirrorEventIDHeader   = "X-Mirror-Event-ID"
+	mirrorTenantHeader    = "X-Mirror-Tenant"
+	mirrorSignatureHeader = "X-Mirror-Signature"
+)
+
+// mirrorMaxSkew is how old a mirrored request's signature may be, to limit
+// replays
+const mirrorMaxSkew = 5 * time.Minute
+
+var mirroredEventsReceived = metrics.newCounterVec("monzo_webhook_mirror_received_total",
+	"Events received from a mirroring peer, by origin instance.", "origin")
+
+// MirrorConfig configures mirroring of events to and from a peer instance,
+// such as a standby deployment in another region
+type MirrorConfig struct {
+	// URL is the peer's /mirror endpoint. Events are only received from
+	// peers when it is empty.
+	URL        string
+	Secret     string
+	InstanceID string
+}
+
+// mirrorConfig is set when mirroring is configured
+var mirrorConfig *MirrorConfig
+
+// mirrorConfigFromEnv reads the mirroring configuration from MIRROR_URL,
+// MIRROR_SECRET and MIRROR_INSTANCE_ID. It returns nil if neither MIRROR_URL
+// nor MIRROR_SECRET is set.
+func mirrorConfigFromEnv() (*MirrorConfig, error) {
+	secret, err := getenvSecret("MIRROR_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	cfg := &MirrorConfig{
+		URL:        os.Getenv("MIRROR_URL"),
+		Secret:     secret,
+		InstanceID: os.Getenv("MIRROR_INSTANCE_ID"),
+	}
+	if cfg.URL == "" && cfg.Secret == "" {
+		return nil, nil
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("MIRROR_SECRET must be set when MIRROR_URL is configured")
+	}
+	// Mirrored events carry transactions, so they're only sent encrypted
+	if cfg.URL != "" && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("invalid MIRROR_URL '%s' (expected an https URL)", redactURL(cfg.URL))
+	}
+	if cfg.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("MIRROR_INSTANCE_ID is not set and the hostname is unknown: %w", err)
+		}
+		cfg.InstanceID = hostname
+	}
+	return cfg, nil
+}
+
+// signMirrorRequest returns the signature of a mirrored event: an HMAC-SHA256
+// of the timestamp, origin, event ID, tenant and body. The tenant is empty for
+// events without one. The origin, event ID and tenant are each prefixed with
+// their length, as instance IDs default to hostnames containing dots, so a
+// request can't be re-split into a different origin and event ID.
+func signMirrorRequest(secret string, timestamp int64, origin, eventID, tenant string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	for _, field := range []string{origin, eventID, tenant} {
+		fmt.Fprintf(mac, "%d:%s.", len(field), field)
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMirrorRequest checks a mirrored request's signature header, which has
+// the form t=<unix time>,v1=<hex signature>
+func verifyMirrorRequest(secret string, header http.Header, body []byte, now time.Time) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header.Get(mirrorSignatureHeader), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("missing or malformed signature")
+	}
+	if skew := now.Sub(time.Unix(t, 0)); skew > mirrorMaxSkew || skew < -mirrorMaxSkew {
+		return errors.New("signature timestamp is too old")
+	}
+	expected := signMirrorRequest(secret, t, header.Get(mirrorOriginHeader), header.Get(mirrorEventIDHeader),
+		header.Get(mirrorTenantHeader), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// mirrorSink forwards events to a peer instance. Events that were themselves
+// mirrored are not forwarded, so two instances mirroring to each other don't
+// send events back and forth.
+type mirrorSink struct {
+	cfg    *MirrorConfig
+	client *http.Client
+	now    func() time.Time
+}
+
+func newMirrorSink(cfg *MirrorConfig) *mirrorSink {
+	return &mirrorSink{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, now: clock.Now}
+}
+
+func (s *mirrorSink) Name() string { return "mirror" }
+
+func (s *mirrorSink) Publish(ctx context.Context, event *webhookEvent) error {
+	if event.Origin != "" {
+		logDebug("Not mirroring %s event %s back from %s", event.Type, event.ID, event.Origin)
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(event.Body))
+	if err != nil {
+		return err
+	}
+	timestamp := s.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(mirrorOriginHeader, s.cfg.InstanceID)
+	req.Header.Set(mirrorEventIDHeader, event.ID)
+	var tenant string
+	if event.Tenant != nil {
+		tenant = event.Tenant.Name
+		req.Header.Set(mirrorTenantHeader, tenant)
+	}
+	req.Header.Set(mirrorSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp,
+		signMirrorRequest(s.cfg.Secret, timestamp, s.cfg.InstanceID, event.ID, tenant, event.Body)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tenantByName returns the configured tenant with a name, or nil
+func tenantByName(name string) *TenantConfig {
+	tenants := currentConfig().Tenants
+	for i := range tenants {
+		if tenants[i].Name == name {
+			return &tenants[i]
+		}
+	}
+	return nil
+}
+
+// mirrorHandler receives events mirrored by a peer instance and publishes them
+// to this instance's sinks with their original IDs
+func mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyReadError(w, err)
+		return
+	}
+	if err := verifyMirrorRequest(mirrorConfig.Secret, r.Header, body, clock.Now()); err != nil {
+		logWarn("Rejected mirrored event: %v", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	origin := r.Header.Get(mirrorOriginHeader)
+	eventID := r.Header.Get(mirrorEventIDHeader)
+	if origin == "" || eventID == "" {
+		http.Error(w, "Missing mirror headers", http.StatusBadRequest)
+		return
+	}
+	if origin == mirrorConfig.InstanceID {
+		logWarn("Rejected event %s mirrored from this instance - check MIRROR_URL", eventID)
+		http.Error(w, "Mirror loop detected", http.StatusLoopDetected)
+		return
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	eventType, _ := payload["type"].(string)
+	if eventType == "" {
+		http.Error(w, "Missing event type", http.StatusBadRequest)
+		return
+	}
+
+	var tenant *TenantConfig
+	if name := r.Header.Get(mirrorTenantHeader); name != "" {
+		if tenant = tenantByName(name); tenant == nil {
+			logWarn("Mirrored event %s is for unknown tenant '%s'", eventID, name)
+		}
+	}
+
+	// A signed request can be replayed until its timestamp is too old
+	claimed, release := claimMirroredEvent(r.Context(), stateFor(redisClient), origin, eventID)
+	if !claimed {
+		logInfo("Ignoring replay of event %s mirrored from %s", eventID, origin)
+		w.Header().Set("X-Event-ID", eventID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	webhookEventsReceived.WithLabelValues(eventType).Inc()
+	mirroredEventsReceived.WithLabelValues(origin).Inc()
+	event := newMirroredEvent(eventID, origin, eventType, body, payload, tenant)
+	w.Header().Set("X-Event-ID", event.ID)
+
+	if err := dispatchEvent(event); err != nil {
+		logError("Error publishing %s event %s mirrored from %s: %v", eventType, eventID, origin, err)
+		release()
+		http.Error(w, "Error publishing event", http.StatusServiceUnavailable)
+		return
+	}
+	// Stored once it's accepted, as the peer retries events that fail, so
+	// that retries don't store it more than once
+	storedEvents.record(event, body, deliveryFromRequest(r, event, "mirror "+origin), "")
+	logInfo("Received %s event %s mirrored from %s", eventType, eventID, origin)
+	w.WriteHeader(http.StatusOK)
+}
+
+// newMirroredEvent creates an event received from a peer. The peer already
+// applied rules, recorded changes and enriched the body it mirrored, so only
+// this instance's merchant mutes are matched.
+func newMirroredEvent(id, origin, eventType string, body []byte, payload map[string]interface{}, tenant *TenantConfig) *webhookEvent {
+	event := newReceivedEvent(id, clock.Now(), eventType, body, payload, tenant)
+	event.Origin = origin
+	var rules []traceRule
+	if merchant, ok := merchantMutes.match(payload); ok {
+		event.MutedMerchant = merchant
+		rules = append(rules, traceRule{Kind: "mute", Rule: "merchant " + merchant})
+	}
+	eventTraces.start(event, "mirror "+origin, rules)
+	return event
+}
+
+// claimMirroredEvent records a mirrored event's ID in the state, reporting
+// false if it was already received. Claims last as long as a signature is
+// accepted. The returned release function forgets the event again, so the
+// peer can retry it. Without state, or when it fails, every event is new.
+func claimMirroredEvent(ctx context.Context, state stateStore, origin, eventID string) (bool, func()) {
+	release := func() {}
+	if state == nil {
+		return true, release
+	}
+	key := currentConfig().Dedup.keyPrefix() + "mirror:" + origin + ":" + eventID
+	claimed, err := state.setNX(ctx, key, "1", 2*mirrorMaxSkew)
+	if err != nil {
+		logWarn("Error checking event %s mirrored from %s for replays: %v", eventID, origin, err)
+		return true, release
+	}
+	if !claimed {
+		return false, release
+	}
+	return true, func() {
+		if err := state.del(context.Background(), key); err != nil {
+			logWarn("Error releasing replay key for event %s mirrored from %s: %v", eventID, origin, err)
+		}
+	}
+}
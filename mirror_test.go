@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMirrorConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		secret      string
+		instanceID  string
+		expectNil   bool
+		expectError bool
+	}{
+		{name: "Disabled", expectNil: true},
+		{name: "Sender", url: "https://standby.example.com/mirror", secret: "s", instanceID: "eu-west-1"},
+		{name: "Receiver only", secret: "s", instanceID: "eu-central-1"},
+		{name: "Missing secret", url: "https://standby.example.com/mirror", expectError: true},
+		{name: "Invalid URL", url: "standby.example.com", secret: "s", expectError: true},
+		{name: "Plain HTTP", url: "http://standby.example.com/mirror", secret: "s", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MIRROR_URL", tt.url)
+			t.Setenv("MIRROR_SECRET", tt.secret)
+			t.Setenv("MIRROR_INSTANCE_ID", tt.instanceID)
+
+			cfg, err := mirrorConfigFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expectNil != (cfg == nil) {
+				t.Fatalf("Expected nil config: %v, got %+v", tt.expectNil, cfg)
+			}
+			if cfg != nil && (cfg.URL != tt.url || cfg.InstanceID != tt.instanceID) {
+				t.Errorf("Unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestVerifyMirrorRequest(t *testing.T) {
+	now := time.Unix(1709283600, 0)
+	body := []byte(`{"type":"transaction.created"}`)
+	header := func(timestamp int64, signature string) http.Header {
+		h := http.Header{}
+		h.Set(mirrorOriginHeader, "eu-west-1")
+		h.Set(mirrorEventIDHeader, "01HQZ")
+		h.Set(mirrorTenantHeader, "alice")
+		h.Set(mirrorSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, signature))
+		return h
+	}
+	valid := signMirrorRequest("secret", now.Unix(), "eu-west-1", "01HQZ", "alice", body)
+	otherTenant := header(now.Unix(), valid)
+	otherTenant.Set(mirrorTenantHeader, "bob")
+	// A hostname origin re-split so that part of it moves into the event ID
+	hostname := header(now.Unix(), signMirrorRequest("secret", now.Unix(), "eu.host", "01HQZ", "alice", body))
+	hostname.Set(mirrorOriginHeader, "eu")
+	hostname.Set(mirrorEventIDHeader, "host.01HQZ")
+
+	tests := []struct {
+		name        string
+		header      http.Header
+		body        []byte
+		expectError bool
+	}{
+		{name: "Valid", header: header(now.Unix(), valid), body: body},
+		{name: "Tampered body", header: header(now.Unix(), valid), body: []byte(`{"type":"account.updated"}`), expectError: true},
+		{name: "Wrong secret", header: header(now.Unix(), signMirrorRequest("other", now.Unix(), "eu-west-1", "01HQZ", "alice", body)), body: body, expectError: true},
+		{name: "Too old", header: header(now.Add(-10*time.Minute).Unix(), signMirrorRequest("secret", now.Add(-10*time.Minute).Unix(), "eu-west-1", "01HQZ", "alice", body)), body: body, expectError: true},
+		{name: "Changed tenant", header: otherTenant, body: body, expectError: true},
+		{name: "Re-split origin and event ID", header: hostname, body: body, expectError: true},
+		{name: "Missing", header: http.Header{}, body: body, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyMirrorRequest("secret", tt.header, tt.body, now)
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMirrorRoundTrip(t *testing.T) {
+	origConfig := mirrorConfig
+	origSinks := sinks
+	origQueue := asyncQueue
+	origEventConfig := eventConfig
+	defer func() {
+		mirrorConfig = origConfig
+		sinks = origSinks
+		asyncQueue = origQueue
+		eventConfig = origEventConfig
+	}()
+	asyncQueue = nil
+	eventConfig = EventConfig{Tenants: []TenantConfig{{Name: "alice", Username: "alice", Password: "a"}}}
+
+	// The standby receives mirrored events, and mirrors back to the primary
+	var primaryRequests int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { primaryRequests++ }))
+	defer primary.Close()
+	standbySink := &fakeSink{name: "archive"}
+	sinks = []sinkEntry{
+		{sink: standbySink},
+		{sink: newMirrorSink(&MirrorConfig{URL: primary.URL, Secret: "shared", InstanceID: "eu-central-1"})},
+	}
+	mirrorConfig = &MirrorConfig{Secret: "shared", InstanceID: "eu-central-1"}
+	standby := httptest.NewServer(http.HandlerFunc(mirrorHandler))
+	defer standby.Close()
+
+	sink := newMirrorSink(&MirrorConfig{URL: standby.URL, Secret: "shared", InstanceID: "eu-west-1"})
+	body := []byte(`{"type":"transaction.created","data":{"account_id":"acc_1"}}`)
+	event := &webhookEvent{ID: "01HQZX3Y8M2N4P6Q8R0S2T4V6W", Type: "transaction.created", Body: body, Tenant: &eventConfig.Tenants[0]}
+	if err := sink.Publish(context.Background(), event); err != nil {
+		t.Fatalf("Mirroring failed: %v", err)
+	}
+
+	if standbySink.count() != 1 {
+		t.Fatalf("Expected the standby to publish the event, got %d", standbySink.count())
+	}
+	mirrored := standbySink.events[0]
+	if mirrored.ID != event.ID || mirrored.Origin != "eu-west-1" || !bytes.Equal(mirrored.Body, body) ||
+		mirrored.Tenant == nil || mirrored.Tenant.Name != "alice" {
+		t.Errorf("Unexpected mirrored event: %+v", mirrored)
+	}
+	if primaryRequests != 0 {
+		t.Errorf("Expected the mirrored event not to be sent back, got %d requests", primaryRequests)
+	}
+
+	// An instance rejects events it mirrored itself
+	loop := newMirrorSink(&MirrorConfig{URL: standby.URL, Secret: "shared", InstanceID: "eu-central-1"})
+	if err := loop.Publish(context.Background(), &webhookEvent{ID: "01HQZX3Y8M2N4P6Q8R0S2T4V6X", Type: "transaction.created", Body: body}); err == nil {
+		t.Error("Expected an error when mirroring to itself")
+	}
+
+	// Requests signed with another secret are rejected
+	wrong := newMirrorSink(&MirrorConfig{URL: standby.URL, Secret: "other", InstanceID: "eu-west-1"})
+	if err := wrong.Publish(context.Background(), &webhookEvent{ID: "01HQZX3Y8M2N4P6Q8R0S2T4V6Y", Type: "transaction.created", Body: body}); err == nil {
+		t.Error("Expected an error for an invalid signature")
+	}
+	if standbySink.count() != 1 {
+		t.Errorf("Expected rejected events not to be published, got %d", standbySink.count())
+	}
+}
+
+func TestMirrorHandlerReplay(t *testing.T) {
+	origConfig := mirrorConfig
+	origSinks := sinks
+	origQueue := asyncQueue
+	origState := localState
+	origAliases := merchantAliases
+	origStore := storedEvents
+	defer func() {
+		mirrorConfig = origConfig
+		sinks = origSinks
+		asyncQueue = origQueue
+		localState = origState
+		merchantAliases = origAliases
+		storedEvents = origStore
+	}()
+	storedEvents = newReplayStore(t)
+	asyncQueue = nil
+	now := time.Now()
+	localState = openTestState(t, filepath.Join(t.TempDir(), "events.db"), &now)
+	merchantAliases = newMerchantAliasTable([]MerchantAlias{{Pattern: "AMZN*", Alias: "Amazon"}}, nil)
+	archive := &fakeSink{name: "archive", err: errors.New("unavailable")}
+	sinks = []sinkEntry{{sink: archive, required: true}}
+	mirrorConfig = &MirrorConfig{Secret: "shared", InstanceID: "eu-central-1"}
+
+	body := []byte(`{"type":"transaction.created","data":{"account_id":"acc_1","description":"AMZN Mktp"}}`)
+	timestamp := time.Now().Unix()
+	signature := fmt.Sprintf("t=%d,v1=%s", timestamp,
+		signMirrorRequest("shared", timestamp, "eu-west-1", "01HQZX3Y8M2N4P6Q8R0S2T4V6W", "", body))
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/mirror", bytes.NewReader(body))
+		req.Header.Set(mirrorOriginHeader, "eu-west-1")
+		req.Header.Set(mirrorEventIDHeader, "01HQZX3Y8M2N4P6Q8R0S2T4V6W")
+		req.Header.Set(mirrorSignatureHeader, signature)
+		rr := httptest.NewRecorder()
+		mirrorHandler(rr, req)
+		return rr.Code
+	}
+
+	// An event that failed to publish can be sent again
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code 503, got %d", code)
+	}
+	archive.err = nil
+	if code := send(); code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", code)
+	}
+	if archive.count() != 2 {
+		t.Fatalf("Expected the retry to be published, got %d attempts", archive.count())
+	}
+	// The peer already enriched the body
+	if !bytes.Equal(archive.events[1].Body, body) {
+		t.Errorf("Expected the mirrored body to be published unchanged, got %s", archive.events[1].Body)
+	}
+
+	// A replay of the same request isn't published again
+	if code := send(); code != http.StatusOK {
+		t.Fatalf("Expected status code 200 for a replay, got %d", code)
+	}
+	if archive.count() != 2 {
+		t.Errorf("Expected the replay not to be published, got %d attempts", archive.count())
+	}
+
+	// The event is stored once, with its origin
+	stored, _, err := storedEvents.queryEvents(context.Background(), eventQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stored) != 1 || stored[0].ID != "01HQZX3Y8M2N4P6Q8R0S2T4V6W" || stored[0].Delivery.Auth != "mirror eu-west-1" {
+		t.Errorf("Expected the mirrored event to be stored once, got %+v", stored)
+	}
+}
@@ -0,0 +1,139 @@
+package monzo
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// EventType describes a type of event Monzo sends: its payload's JSON Schema
+// and an example event
+type EventType struct {
+	Type        string                 `json:"type"`
+	Description string                 `json:"description"`
+	Schema      map[string]interface{} `json:"schema"`
+	Example     json.RawMessage        `json:"example"`
+}
+
+// schemaProvider is implemented by types whose JSON encoding can't be
+// derived from their fields
+type schemaProvider interface {
+	JSONSchema() map[string]interface{}
+}
+
+// JSONSchema describes a merchant, which is either an object or its ID
+func (Merchant) JSONSchema() map[string]interface{} {
+	type merchant Merchant
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "description": "The merchant's ID"},
+			Schema(merchant{}),
+		},
+	}
+}
+
+// exampleTransaction is the example payload of transaction events
+var exampleTransaction = Transaction{
+	ID:          "tx_00008zIcpb1TB4yeIFXMzx",
+	Created:     time.Date(2015, 9, 4, 14, 28, 40, 0, time.UTC),
+	Description: "AMAZON EU SARL AMAZON.CO.UK/",
+	Amount:      -10000,
+	Currency:    "GBP",
+	AccountID:   "acc_00008gju41AHyfLUzBUk8A",
+	Category:    "shopping",
+	Merchant: &Merchant{
+		ID:       "merch_00008zIcpbAKe8shBxXUtl",
+		GroupID:  "grp_00008zIcpbBOaAr7TTP3sv",
+		Name:     "Amazon",
+		Category: "shopping",
+		Online:   true,
+		Address:  &MerchantAddress{City: "London", Country: "GB", Postcode: "EC1V 9NR"},
+	},
+}
+
+// EventTypes returns the event types this package has payload types for
+func EventTypes() []EventType {
+	return []EventType{
+		newEventType(TypeTransactionCreated, "A transaction was created on an account, such as a card payment or a transfer.", exampleTransaction),
+		newEventType(TypeTransactionUpdated, "A transaction changed, for example when it settled or its category or notes were edited.", exampleTransaction),
+	}
+}
+
+func newEventType(eventType, description string, example interface{}) EventType {
+	data, _ := json.Marshal(example)
+	body, _ := json.Marshal(Event{Type: eventType, Data: data})
+	return EventType{
+		Type:        eventType,
+		Description: description,
+		Schema:      Schema(example),
+		Example:     body,
+	}
+}
+
+// Schema returns the JSON Schema of a value's JSON encoding, derived from its
+// type. Fields without omitempty are required.
+func Schema(v interface{}) map[string]interface{} {
+	return typeSchema(reflect.TypeOf(v))
+}
+
+var (
+	timeType           = reflect.TypeOf(time.Time{})
+	rawMessageType     = reflect.TypeOf(json.RawMessage{})
+	schemaProviderType = reflect.TypeOf((*schemaProvider)(nil)).Elem()
+)
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Implements(schemaProviderType) {
+		return reflect.Zero(t).Interface().(schemaProvider).JSONSchema()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == rawMessageType {
+		// Any JSON value
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
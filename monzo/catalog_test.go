@@ -0,0 +1,70 @@
+package monzo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventTypesExamplesAreValid(t *testing.T) {
+	for _, eventType := range EventTypes() {
+		event, err := Decode(eventType.Example)
+		if err != nil {
+			t.Fatalf("%s: example doesn't decode: %v", eventType.Type, err)
+		}
+		if event.Type != eventType.Type {
+			t.Errorf("%s: example has type '%s'", eventType.Type, event.Type)
+		}
+		if err := event.Validate(); err != nil {
+			t.Errorf("%s: example is invalid: %v", eventType.Type, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema(Transaction{})
+	properties := schema["properties"].(map[string]interface{})
+
+	tests := []struct {
+		field  string
+		expect map[string]interface{}
+	}{
+		{field: "id", expect: map[string]interface{}{"type": "string"}},
+		{field: "created", expect: map[string]interface{}{"type": "string", "format": "date-time"}},
+		{field: "amount", expect: map[string]interface{}{"type": "integer"}},
+		{field: "is_load", expect: map[string]interface{}{"type": "boolean"}},
+		{field: "account_balance", expect: map[string]interface{}{"type": "integer"}},
+		{field: "metadata", expect: map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": map[string]interface{}{"type": "string"},
+		}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(properties[tt.field], tt.expect) {
+			t.Errorf("Expected %s to be %v, got %v", tt.field, tt.expect, properties[tt.field])
+		}
+	}
+
+	required := schema["required"].([]string)
+	expected := []string{"id", "created", "description", "amount", "currency", "account_id"}
+	if !reflect.DeepEqual(required, expected) {
+		t.Errorf("Expected required fields %v, got %v", expected, required)
+	}
+
+	// A merchant is either an ID or an object
+	merchant := properties["merchant"].(map[string]interface{})["oneOf"].([]interface{})
+	if len(merchant) != 2 || merchant[0].(map[string]interface{})["type"] != "string" {
+		t.Fatalf("Unexpected merchant schema: %v", merchant)
+	}
+	object := merchant[1].(map[string]interface{})
+	if _, ok := object["properties"].(map[string]interface{})["address"]; !ok {
+		t.Errorf("Expected the merchant object to have an address, got %v", object)
+	}
+}
+
+func TestSchemaRawMessage(t *testing.T) {
+	schema := Schema(Event{})
+	data := schema["properties"].(map[string]interface{})["data"]
+	if !reflect.DeepEqual(data, map[string]interface{}{}) {
+		t.Errorf("Expected raw JSON to be any value, got %v", data)
+	}
+}
@@ -0,0 +1,183 @@
+// Package monzo defines the payloads of Monzo webhook events, so that they
+// can be decoded into typed structs and validated.
+package monzo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Event types sent by Monzo
+const (
+	TypeTransactionCreated = "transaction.created"
+	TypeTransactionUpdated = "transaction.updated"
+)
+
+// Event is a webhook event. Data holds the raw payload of the event, which
+// depends on its type.
+type Event struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Transaction is the payload of transaction events. Amounts are in minor
+// units of the currency, negative for debits.
+type Transaction struct {
+	ID            string            `json:"id"`
+	Created       time.Time         `json:"created"`
+	Settled       string            `json:"settled,omitempty"`
+	Description   string            `json:"description"`
+	Amount        int64             `json:"amount"`
+	Currency      string            `json:"currency"`
+	LocalAmount   int64             `json:"local_amount,omitempty"`
+	LocalCurrency string            `json:"local_currency,omitempty"`
+	AccountID     string            `json:"account_id"`
+	Category      string            `json:"category,omitempty"`
+	Merchant      *Merchant         `json:"merchant,omitempty"`
+	Notes         string            `json:"notes,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	IsLoad        bool              `json:"is_load,omitempty"`
+	DeclineReason string            `json:"decline_reason,omitempty"`
+	Counterparty  *Counterparty     `json:"counterparty,omitempty"`
+	Attachments   []Attachment      `json:"attachments,omitempty"`
+
+	// AccountBalance is the account's balance after the transaction, when
+	// Monzo includes it
+	AccountBalance *int64 `json:"account_balance,omitempty"`
+}
+
+// Merchant is the merchant of a card transaction. Monzo sends either the full
+// merchant or just its ID, in which case only ID is set.
+type Merchant struct {
+	ID       string           `json:"id"`
+	GroupID  string           `json:"group_id,omitempty"`
+	Name     string           `json:"name,omitempty"`
+	Logo     string           `json:"logo,omitempty"`
+	Emoji    string           `json:"emoji,omitempty"`
+	Category string           `json:"category,omitempty"`
+	Online   bool             `json:"online,omitempty"`
+	ATM      bool             `json:"atm,omitempty"`
+	Address  *MerchantAddress `json:"address,omitempty"`
+}
+
+// MerchantAddress is where a merchant is located
+type MerchantAddress struct {
+	Address   string  `json:"address,omitempty"`
+	City      string  `json:"city,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	Postcode  string  `json:"postcode,omitempty"`
+	Region    string  `json:"region,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+}
+
+// Attachment is a file attached to a transaction, such as a receipt. FileURL
+// expires, so the file must be downloaded to be kept.
+type Attachment struct {
+	ID         string    `json:"id"`
+	ExternalID string    `json:"external_id,omitempty"`
+	FileURL    string    `json:"file_url"`
+	FileType   string    `json:"file_type,omitempty"`
+	Created    time.Time `json:"created,omitempty"`
+}
+
+// Counterparty is the other party of a bank transfer
+type Counterparty struct {
+	Name          string `json:"name,omitempty"`
+	AccountNumber string `json:"account_number,omitempty"`
+	SortCode      string `json:"sort_code,omitempty"`
+	UserID        string `json:"user_id,omitempty"`
+}
+
+// UnmarshalJSON decodes a merchant from either an object or an ID
+func (m *Merchant) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		*m = Merchant{}
+		return json.Unmarshal(data, &m.ID)
+	}
+	type merchant Merchant
+	return json.Unmarshal(data, (*merchant)(m))
+}
+
+// ValidationError describes the fields of a payload that are missing or invalid
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid payload: " + strings.Join(e.Problems, "; ")
+}
+
+// Decode decodes a webhook body into an event, checking that it has a type
+func Decode(body []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.Type == "" {
+		return nil, &ValidationError{Problems: []string{"type is required"}}
+	}
+	return &event, nil
+}
+
+// IsTransaction reports whether the event's data is a Transaction
+func (e *Event) IsTransaction() bool {
+	return strings.HasPrefix(e.Type, "transaction.")
+}
+
+// Transaction decodes and validates the event's data as a transaction
+func (e *Event) Transaction() (*Transaction, error) {
+	if !e.IsTransaction() {
+		return nil, fmt.Errorf("%s events are not transactions", e.Type)
+	}
+	var tx Transaction
+	if err := json.Unmarshal(e.Data, &tx); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+	if err := tx.Validate(); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// Validate checks that a transaction has the fields Monzo always sends
+func (t *Transaction) Validate() error {
+	var problems []string
+	if t.ID == "" {
+		problems = append(problems, "data.id is required")
+	}
+	if t.AccountID == "" {
+		problems = append(problems, "data.account_id is required")
+	}
+	if t.Created.IsZero() {
+		problems = append(problems, "data.created is required")
+	}
+	if len(t.Currency) != 3 || strings.ToUpper(t.Currency) != t.Currency {
+		problems = append(problems, fmt.Sprintf("data.currency must be a 3-letter ISO 4217 code, got '%s'", t.Currency))
+	}
+	if t.LocalCurrency != "" && len(t.LocalCurrency) != 3 {
+		problems = append(problems, fmt.Sprintf("data.local_currency must be a 3-letter ISO 4217 code, got '%s'", t.LocalCurrency))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// IsDeclined reports whether the transaction was declined
+func (t *Transaction) IsDeclined() bool {
+	return t.DeclineReason != ""
+}
+
+// Validate decodes and validates the event's data for the types it knows,
+// returning nil for other types
+func (e *Event) Validate() error {
+	if !e.IsTransaction() {
+		return nil
+	}
+	_, err := e.Transaction()
+	return err
+}
@@ -0,0 +1,103 @@
+package monzo
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventTransaction(t *testing.T) {
+	body := `{
+		"type": "transaction.created",
+		"data": {
+			"id": "tx_00008zIcpb1TB4yeIFXMzx",
+			"created": "2015-09-04T14:28:40Z",
+			"description": "AMAZON EU SARL AMAZON.CO.UK/",
+			"amount": -10000,
+			"currency": "GBP",
+			"account_id": "acc_00008gju41AHyfLUzBUk8A",
+			"category": "shopping",
+			"is_load": false,
+			"settled": "",
+			"merchant": {
+				"id": "merch_00008zIcpbAKe8shBxXUtl",
+				"group_id": "grp_00008zIcpbBOaAr7TTP3sv",
+				"name": "Amazon",
+				"address": {"city": "London", "country": "GB", "latitude": 51.5, "longitude": -0.1}
+			}
+		}
+	}`
+
+	event, err := Decode([]byte(body))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	tx, err := event.Transaction()
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	if tx.ID != "tx_00008zIcpb1TB4yeIFXMzx" || tx.Amount != -10000 || tx.Currency != "GBP" {
+		t.Errorf("Unexpected transaction: %+v", tx)
+	}
+	if !tx.Created.Equal(time.Date(2015, 9, 4, 14, 28, 40, 0, time.UTC)) {
+		t.Errorf("Unexpected created time: %v", tx.Created)
+	}
+	if tx.Merchant == nil || tx.Merchant.Name != "Amazon" || tx.Merchant.Address.City != "London" {
+		t.Errorf("Unexpected merchant: %+v", tx.Merchant)
+	}
+	if tx.IsDeclined() {
+		t.Error("Expected the transaction not to be declined")
+	}
+}
+
+func TestMerchantUnmarshalID(t *testing.T) {
+	event, _ := Decode([]byte(`{"type":"transaction.created","data":{"id":"tx_1","created":"2015-09-04T14:28:40Z","currency":"GBP","account_id":"acc_1","merchant":"merch_1"}}`))
+	tx, err := event.Transaction()
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	if tx.Merchant == nil || tx.Merchant.ID != "merch_1" || tx.Merchant.Name != "" {
+		t.Errorf("Expected a merchant with only an ID, got %+v", tx.Merchant)
+	}
+}
+
+func TestEventValidate(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		expectValidation bool
+		expectError      bool
+	}{
+		{name: "Valid", body: `{"type":"transaction.updated","data":{"id":"tx_1","created":"2015-09-04T14:28:40Z","currency":"EUR","account_id":"acc_1"}}`},
+		{name: "Missing fields", body: `{"type":"transaction.created","data":{"currency":"gbp"}}`, expectValidation: true, expectError: true},
+		{name: "Wrong type for amount", body: `{"type":"transaction.created","data":{"amount":"ten"}}`, expectError: true},
+		{name: "Unknown event type", body: `{"type":"account.updated","data":{"anything":1}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := Decode([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			err = event.Validate()
+			if tt.expectError != (err != nil) {
+				t.Fatalf("Expected error=%v, got %v", tt.expectError, err)
+			}
+			var validation *ValidationError
+			if errors.As(err, &validation) != tt.expectValidation {
+				t.Errorf("Expected a ValidationError=%v, got %T", tt.expectValidation, err)
+			}
+		})
+	}
+}
+
+func TestDecodeRequiresType(t *testing.T) {
+	if _, err := Decode([]byte(`{"data":{}}`)); err == nil {
+		t.Error("Expected an error for a payload without a type")
+	}
+	if _, err := Decode([]byte(`not json`)); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// MonzoAPIConfig configures the client shared by the features that call the
+// Monzo API. The access token is read from MONZO_ACCESS_TOKEN or Vault, or
+// kept fresh by the token manager.
+type MonzoAPIConfig struct {
+	// URL is the API's base URL, defaulting to https://api.monzo.com
+	URL string `json:"url"`
+	// RateLimit is the average number of requests per second, defaulting
+	// to 2, and Burst how many can be made at once, defaulting to 5
+	RateLimit float64 `json:"rate_limit"`
+	Burst     int     `json:"burst"`
+	// MaxRetries is how many times a request is retried after a 429 or a
+	// server error, defaulting to 3
+	MaxRetries int `json:"max_retries"`
+	// MaxRetryAfter is the longest Retry-After that is waited for before
+	// giving up, defaulting to 1m
+	MaxRetryAfter string `json:"max_retry_after"`
+	// Timeout limits each attempt, defaulting to 10s
+	Timeout string `json:"timeout"`
+	// Cache configures caching of lookups in Redis
+	Cache MonzoAPICacheConfig `json:"cache"`
+	// Enrichment configures adding merchant details to events
+	Enrichment MonzoEnrichmentConfig `json:"enrichment"`
+	// Tokens configures refreshing the access token with OAuth
+	Tokens MonzoTokenConfig `json:"tokens"`
+}
+
+const defaultMonzoAPIURL = "https://api.monzo.com"
+
+var (
+	monzoAPIRequests = metrics.newCounterVec("monzo_webhook_monzo_api_requests_total",
+		"Monzo API requests, by operation and status code (or error).", "operation", "status")
+	monzoAPIDuration = metrics.newHistogramVec("monzo_webhook_monzo_api_request_duration_seconds",
+		"Time taken by Monzo API requests, by operation.", "operation")
+	monzoAPIThrottled = metrics.newCounterVec("monzo_webhook_monzo_api_throttle_seconds_total",
+		"Total time Monzo API requests waited for the rate limiter, by operation.", "operation")
+)
+
+// errMonzoUnauthorized is returned when the Monzo API rejects the access
+// token, usually because it has expired
+var errMonzoUnauthorized = errors.New("Monzo API rejected the access token")
+
+// monzoAPIError is an error response from the Monzo API
+type monzoAPIError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *monzoAPIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("Monzo API returned status %d", e.Status)
+	}
+	return fmt.Sprintf("Monzo API returned status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *monzoAPIError) Is(target error) bool {
+	return target == errMonzoUnauthorized && e.Status == http.StatusUnauthorized
+}
+
+// validate checks the Monzo API configuration for invalid values
+func (c MonzoAPIConfig) validate() error {
+	if c.URL != "" && !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("monzo_api url must be an http or https URL")
+	}
+	if c.RateLimit < 0 || c.Burst < 0 || c.MaxRetries < 0 {
+		return fmt.Errorf("monzo_api rate_limit, burst and max_retries must not be negative")
+	}
+	if _, err := parsePositiveDuration(c.MaxRetryAfter, time.Minute); err != nil {
+		return fmt.Errorf("invalid monzo_api max_retry_after: %w", err)
+	}
+	if _, err := parsePositiveDuration(c.Timeout, 10*time.Second); err != nil {
+		return fmt.Errorf("invalid monzo_api timeout: %w", err)
+	}
+	if err := c.Cache.validate(); err != nil {
+		return err
+	}
+	if err := c.Tokens.validate(); err != nil {
+		return err
+	}
+	return c.Enrichment.validate()
+}
+
+// rateLimiter is a token bucket allowing burst requests at once and rate
+// requests per second on average. A 429 pauses every caller, so that the
+// features sharing the client back off together.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu          sync.Mutex
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newRateLimiter(rate float64, burst int, now func() time.Time) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), now: now, tokens: float64(burst), last: now()}
+}
+
+// reserve takes a token, returning how long to wait before using it
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	if paused := l.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+	return wait
+}
+
+// pause holds every request until the given time
+func (l *rateLimiter) pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// monzoClient calls the Monzo API, limiting the rate of requests and
+// retrying those that are rate limited or fail with a server error
+type monzoClient struct {
+	baseURL       string
+	token         *credentialValue
+	client        *http.Client
+	limiter       *rateLimiter
+	maxRetries    int
+	maxRetryAfter time.Duration
+	now           func() time.Time
+
+	// cache is set when Redis is available and caching isn't disabled
+	cache *monzoCache
+
+	// account is the account whose own tokens the client uses, and parent
+	// the shared client, for the clients of accounts with their own tokens
+	account string
+	parent  *monzoClient
+	// accountClients are the clients of the accounts with their own tokens, on
+	// the shared client
+	accountClients map[string]*monzoClient
+}
+
+// monzoAPI is set when a Monzo access token is configured
+var monzoAPI *monzoClient
+
+// monzoAccessToken returns the Monzo access token from MONZO_ACCESS_TOKEN, or
+// from Vault at VAULT_MONZO_PATH, replaced when the secret changes. It
+// returns nil if neither is set.
+func monzoAccessToken(vault *vaultClient) (*credentialValue, error) {
+	value, err := getenvSecret("MONZO_ACCESS_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	path := os.Getenv("VAULT_MONZO_PATH")
+	if path == "" {
+		if value == "" {
+			return nil, nil
+		}
+		return &credentialValue{value: value}, nil
+	}
+	if vault == nil || value != "" {
+		return nil, fmt.Errorf("VAULT_MONZO_PATH requires VAULT_ADDR, and can't be used with MONZO_ACCESS_TOKEN")
+	}
+	token := &credentialValue{}
+	secret, err := vault.secret(context.Background(), "Monzo access token", path, []string{"access_token"}, func(secret map[string]string) {
+		token.set(secret["access_token"])
+	})
+	if err != nil {
+		return nil, err
+	}
+	token.set(secret["access_token"])
+	return token, nil
+}
+
+func newMonzoClient(cfg MonzoAPIConfig, token *credentialValue, now func() time.Time) *monzoClient {
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = defaultMonzoAPIURL
+	}
+	rate := cfg.RateLimit
+	if rate == 0 {
+		rate = 2
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = 5
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+	maxRetryAfter, _ := parsePositiveDuration(cfg.MaxRetryAfter, time.Minute)
+	timeout, _ := parsePositiveDuration(cfg.Timeout, 10*time.Second)
+	return &monzoClient{
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		token:         token,
+		client:        &http.Client{Timeout: timeout},
+		limiter:       newRateLimiter(rate, burst, now),
+		maxRetries:    maxRetries,
+		maxRetryAfter: maxRetryAfter,
+		now:           now,
+	}
+}
+
+// addAccount gives an account its own client, with its own token and rate
+// limiter, sharing c's cache. Accounts are added before the clients are used.
+func (c *monzoClient) addAccount(cfg MonzoAPIConfig, account AccountConfig, token *credentialValue) *monzoClient {
+	if account.Tokens.RateLimit > 0 {
+		cfg.RateLimit = account.Tokens.RateLimit
+	}
+	if account.Tokens.Burst > 0 {
+		cfg.Burst = account.Tokens.Burst
+	}
+	client := newMonzoClient(cfg, token, c.now)
+	client.cache = c.cache
+	client.account = account.ID
+	client.parent = c
+	if c.accountClients == nil {
+		c.accountClients = make(map[string]*monzoClient)
+	}
+	c.accountClients[account.ID] = client
+	return client
+}
+
+// forAccount returns the client for requests about an account: the
+// account's own if it has tokens of its own, or else the shared client
+func (c *monzoClient) forAccount(accountID string) *monzoClient {
+	if c == nil {
+		return nil
+	}
+	if c.parent != nil {
+		return c.parent.forAccount(accountID)
+	}
+	if client, ok := c.accountClients[accountID]; ok {
+		return client
+	}
+	return c
+}
+
+// clientsFor returns the clients serving accounts, each once, or just c if
+// no accounts are configured
+func (c *monzoClient) clientsFor(accounts []AccountConfig) []*monzoClient {
+	var clients []*monzoClient
+	for _, account := range accounts {
+		if client := c.forAccount(account.ID); !slices.Contains(clients, client) {
+			clients = append(clients, client)
+		}
+	}
+	if len(clients) == 0 {
+		return []*monzoClient{c}
+	}
+	return clients
+}
+
+// servedAccounts returns the IDs of the accounts c serves
+func (c *monzoClient) servedAccounts(accounts []AccountConfig) []string {
+	var ids []string
+	for _, account := range accounts {
+		if c.forAccount(account.ID) == c {
+			ids = append(ids, account.ID)
+		}
+	}
+	return ids
+}
+
+// wrapError names the account of an account's client in err
+func (c *monzoClient) wrapError(err error) error {
+	if c.account == "" {
+		return err
+	}
+	return fmt.Errorf("account %s tokens: %w", c.account, err)
+}
+
+// do makes a request to the Monzo API and decodes the response into v. form
+// is sent as the body of POST, PUT and PATCH requests and as the query string
+// of others. operation names the request in metrics and logs.
+func (c *monzoClient) do(ctx context.Context, operation, method, path string, form url.Values, v interface{}) error {
+	if method != http.MethodGet && !featureFlags.gate(flagMonzoWrites) {
+		return fmt.Errorf("%s: %w", operation, errMonzoWritesDisabled)
+	}
+	for retry := 0; ; retry++ {
+		wait := c.limiter.reserve()
+		if wait > 0 {
+			monzoAPIThrottled.WithLabelValues(operation).Add(wait.Seconds())
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+		}
+
+		started := time.Now()
+		retryAfter, err := c.attempt(ctx, method, path, form, v)
+		monzoAPIDuration.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+
+		var apiErr *monzoAPIError
+		switch {
+		case err == nil:
+			monzoAPIRequests.WithLabelValues(operation, "200").Inc()
+			return nil
+		case errors.As(err, &apiErr):
+			monzoAPIRequests.WithLabelValues(operation, strconv.Itoa(apiErr.Status)).Inc()
+		default:
+			monzoAPIRequests.WithLabelValues(operation, "error").Inc()
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		// Requests that may have been processed are only retried if they
+		// are safe to repeat
+		rateLimited := apiErr != nil && apiErr.Status == http.StatusTooManyRequests
+		serverError := apiErr == nil || apiErr.Status >= 500
+		if retry >= c.maxRetries || !(rateLimited || serverError && method == http.MethodGet) {
+			return err
+		}
+
+		delay := time.Duration(1<<retry) * time.Second
+		if rateLimited && retryAfter > 0 {
+			delay = retryAfter
+		}
+		if delay > c.maxRetryAfter {
+			return fmt.Errorf("%w, retry after %v", err, delay)
+		}
+		if rateLimited {
+			c.limiter.pause(c.now().Add(delay))
+			delay = 0
+		}
+		logWarn("Monzo API %s request failed, retrying (%d/%d): %v", operation, retry+1, c.maxRetries, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// attempt makes a single request, returning the Retry-After delay of a 429
+func (c *monzoClient) attempt(ctx context.Context, method, path string, form url.Values, v interface{}) (time.Duration, error) {
+	var body io.Reader
+	target := c.baseURL + path
+	hasBody := method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+	if hasBody {
+		body = strings.NewReader(form.Encode())
+	} else if len(form) > 0 {
+		target += "?" + form.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	if hasBody {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token.get())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &monzoAPIError{Status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(apiErr)
+		return parseRetryAfter(resp.Header.Get("Retry-After"), c.now()), apiErr
+	}
+	if v == nil {
+		io.Copy(io.Discard, resp.Body)
+		return 0, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, fmt.Errorf("invalid Monzo API response: %w", err)
+	}
+	return 0, nil
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, returning zero if it's missing or invalid
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// monzoWhoAmI describes the access token
+type monzoWhoAmI struct {
+	Authenticated bool   `json:"authenticated"`
+	ClientID      string `json:"client_id"`
+	UserID        string `json:"user_id"`
+}
+
+// whoAmI checks the access token
+func (c *monzoClient) whoAmI(ctx context.Context) (monzoWhoAmI, error) {
+	var result monzoWhoAmI
+	err := c.do(ctx, "whoami", http.MethodGet, "/ping/whoami", nil, &result)
+	return result, err
+}
+
+// transaction fetches a transaction with its merchant expanded, from the
+// cache if it was fetched recently
+func (c *monzoClient) transaction(ctx context.Context, id string) (*monzo.Transaction, error) {
+	var result struct {
+		Transaction monzo.Transaction `json:"transaction"`
+	}
+	if c.cache.get(ctx, "transaction", id, &result.Transaction) {
+		return &result.Transaction, nil
+	}
+	query := url.Values{"expand[]": {"merchant"}}
+	if err := c.do(ctx, "transaction", http.MethodGet, "/transactions/"+url.PathEscape(id), query, &result); err != nil {
+		return nil, err
+	}
+	c.cache.cacheTransaction(ctx, &result.Transaction)
+	return &result.Transaction, nil
+}
+
+// recentTransactions lists an account's transactions since a time, with
+// their merchants expanded, caching each of them
+func (c *monzoClient) recentTransactions(ctx context.Context, accountID string, since time.Time) ([]monzo.Transaction, error) {
+	var result struct {
+		Transactions []monzo.Transaction `json:"transactions"`
+	}
+	query := url.Values{
+		"account_id": {accountID},
+		"since":      {since.UTC().Format(time.RFC3339)},
+		"expand[]":   {"merchant"},
+	}
+	if err := c.do(ctx, "transactions", http.MethodGet, "/transactions", query, &result); err != nil {
+		return nil, err
+	}
+	for i := range result.Transactions {
+		c.cache.cacheTransaction(ctx, &result.Transactions[i])
+	}
+	return result.Transactions, nil
+}
+
+// merchant returns a merchant's details. The API only returns merchants
+// expanded in transactions, so on a cache miss the merchant is read from
+// transactionID, a transaction made with it.
+func (c *monzoClient) merchant(ctx context.Context, id, transactionID string) (*monzo.Merchant, error) {
+	var merchant monzo.Merchant
+	if c.cache.get(ctx, "merchant", id, &merchant) {
+		return &merchant, nil
+	}
+	tx, err := c.transaction(ctx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Merchant == nil || tx.Merchant.ID != id {
+		return nil, fmt.Errorf("transaction %s wasn't made with merchant %s", transactionID, id)
+	}
+	return tx.Merchant, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMonzoClientTransaction(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			t.Errorf("Unexpected Authorization header: %s", r.Header.Get("Authorization"))
+		}
+		if r.URL.Path != "/transactions/tx_1" || r.URL.Query().Get("expand[]") != "merchant" {
+			t.Errorf("Unexpected request: %s", r.URL)
+		}
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code": "too_many_requests", "message": "Slow down"}`))
+			return
+		}
+		w.Write([]byte(`{"transaction": {"id": "tx_1", "amount": -350, "merchant": {"id": "merch_1", "name": "Coffee Shop"}}}`))
+	}))
+	defer server.Close()
+
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "secret-token"}, time.Now)
+	rateLimited := testutil.ToFloat64(monzoAPIRequests.WithLabelValues("transaction", "429"))
+	started := time.Now()
+	tx, err := client.transaction(context.Background(), "tx_1")
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	if tx.ID != "tx_1" || tx.Amount != -350 {
+		t.Errorf("Unexpected transaction: %+v", tx)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected the rate limited request to be retried, got %d calls", calls.Load())
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("Expected the retry to wait for Retry-After, took %v", elapsed)
+	}
+	if got := testutil.ToFloat64(monzoAPIRequests.WithLabelValues("transaction", "429")) - rateLimited; got != 1 {
+		t.Errorf("Expected 1 rate limited request to be counted, got %g", got)
+	}
+}
+
+func TestMonzoClientErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		status     int
+		retryAfter string
+		calls      int32
+		expect     string
+	}{
+		{name: "Unauthorized", method: http.MethodGet, status: http.StatusUnauthorized, calls: 1, expect: "status 401"},
+		{name: "Retry-After too long", method: http.MethodGet, status: http.StatusTooManyRequests, retryAfter: "3600", calls: 1, expect: "retry after 1h0m0s"},
+		{name: "POST server errors aren't retried", method: http.MethodPost, status: http.StatusBadGateway, calls: 1, expect: "status 502"},
+		{name: "Not found", method: http.MethodGet, status: http.StatusNotFound, calls: 1, expect: "not_found: Transaction not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				if tt.status == http.StatusNotFound {
+					w.Write([]byte(`{"code": "not_found", "message": "Transaction not found"}`))
+				}
+			}))
+			defer server.Close()
+
+			client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+			err := client.do(context.Background(), "test", tt.method, "/test", nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("Expected an error containing '%s', got %v", tt.expect, err)
+			}
+			if calls.Load() != tt.calls {
+				t.Errorf("Expected %d calls, got %d", tt.calls, calls.Load())
+			}
+			if unauthorized := errors.Is(err, errMonzoUnauthorized); unauthorized != (tt.status == http.StatusUnauthorized) {
+				t.Errorf("Expected errors.Is(errMonzoUnauthorized) to be %v", !unauthorized)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(2, 3, func() time.Time { return now })
+
+	// The burst is available at once, then requests are spaced by the rate
+	for i := 0; i < 3; i++ {
+		if wait := limiter.reserve(); wait != 0 {
+			t.Errorf("Expected request %d not to wait, got %v", i+1, wait)
+		}
+	}
+	if wait := limiter.reserve(); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", wait)
+	}
+	if wait := limiter.reserve(); wait != time.Second {
+		t.Errorf("Expected to wait 1s, got %v", wait)
+	}
+
+	// A pause holds every request until it ends
+	now = now.Add(10 * time.Second)
+	limiter.pause(now.Add(30 * time.Second))
+	if wait := limiter.reserve(); wait != 30*time.Second {
+		t.Errorf("Expected to wait for the pause, got %v", wait)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"soon":                          0,
+	}
+	for header, expect := range tests {
+		if got := parseRetryAfter(header, now); got != expect {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", header, got, expect)
+		}
+	}
+}
+
+func TestMonzoAPIConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    MonzoAPIConfig
+		hasErr bool
+	}{
+		{name: "Defaults", cfg: MonzoAPIConfig{}},
+		{name: "Valid", cfg: MonzoAPIConfig{URL: "https://api.monzo.com", RateLimit: 0.5, Burst: 2, MaxRetryAfter: "30s", Timeout: "5s"}},
+		{name: "Invalid URL", cfg: MonzoAPIConfig{URL: "api.monzo.com"}, hasErr: true},
+		{name: "Negative rate", cfg: MonzoAPIConfig{RateLimit: -1}, hasErr: true},
+		{name: "Invalid timeout", cfg: MonzoAPIConfig{Timeout: "soon"}, hasErr: true},
+		{name: "Invalid enrichment timeout", cfg: MonzoAPIConfig{Enrichment: MonzoEnrichmentConfig{Timeout: "-1s"}}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error: %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
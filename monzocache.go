@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+	"github.com/redis/go-redis/v9"
+)
+
+// MonzoAPICacheConfig configures how long Monzo API lookups are cached in
+// Redis, so that repeated lookups, such as for each transaction.updated event
+// of a transaction, don't each call the API
+type MonzoAPICacheConfig struct {
+	Disabled       bool   `json:"disabled"`
+	TransactionTTL string `json:"transaction_ttl"`
+	MerchantTTL    string `json:"merchant_ttl"`
+	KeyPrefix      string `json:"key_prefix"`
+}
+
+var (
+	monzoAPICacheLookups = metrics.newCounterVec("monzo_webhook_monzo_api_cache_total",
+		"Monzo API cache lookups, by kind (transaction, merchant) and result (hit, miss, error).", "kind", "result")
+)
+
+// validate checks the cache configuration for invalid values
+func (c MonzoAPICacheConfig) validate() error {
+	if _, err := parsePositiveDuration(c.TransactionTTL, time.Hour); err != nil {
+		return fmt.Errorf("invalid monzo_api cache transaction_ttl: %w", err)
+	}
+	if _, err := parsePositiveDuration(c.MerchantTTL, 24*time.Hour); err != nil {
+		return fmt.Errorf("invalid monzo_api cache merchant_ttl: %w", err)
+	}
+	return nil
+}
+
+// monzoCache stores Monzo API responses in Redis. Redis errors are logged and
+// treated as misses, so the API is called instead.
+type monzoCache struct {
+	client         *redis.Client
+	transactionTTL time.Duration
+	merchantTTL    time.Duration
+	keyPrefix      string
+}
+
+func newMonzoCache(client *redis.Client, cfg MonzoAPICacheConfig) *monzoCache {
+	transactionTTL, _ := parsePositiveDuration(cfg.TransactionTTL, time.Hour)
+	merchantTTL, _ := parsePositiveDuration(cfg.MerchantTTL, 24*time.Hour)
+	keyPrefix := cfg.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = "monzo-webhook:monzo-api:"
+	}
+	return &monzoCache{client: client, transactionTTL: transactionTTL, merchantTTL: merchantTTL, keyPrefix: keyPrefix}
+}
+
+// get decodes the cached value of kind with the given ID into v, reporting
+// whether it was found
+func (c *monzoCache) get(ctx context.Context, kind, id string, v interface{}) bool {
+	if c == nil {
+		return false
+	}
+	data, err := c.client.Get(ctx, c.keyPrefix+kind+":"+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		monzoAPICacheLookups.WithLabelValues(kind, "miss").Inc()
+		return false
+	}
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		monzoAPICacheLookups.WithLabelValues(kind, "error").Inc()
+		logWarn("Error reading cached Monzo %s %s: %v", kind, id, err)
+		return false
+	}
+	monzoAPICacheLookups.WithLabelValues(kind, "hit").Inc()
+	return true
+}
+
+// set caches a value of kind with the given ID for ttl
+func (c *monzoCache) set(ctx context.Context, kind, id string, v interface{}, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = c.client.Set(ctx, c.keyPrefix+kind+":"+id, data, ttl).Err()
+	}
+	if err != nil {
+		logWarn("Error caching Monzo %s %s: %v", kind, id, err)
+	}
+}
+
+// forget removes a cached value of kind with the given ID, once it has changed
+func (c *monzoCache) forget(ctx context.Context, kind, id string) {
+	if c == nil {
+		return
+	}
+	if err := c.client.Del(ctx, c.keyPrefix+kind+":"+id).Err(); err != nil {
+		logWarn("Error removing cached Monzo %s %s: %v", kind, id, err)
+	}
+}
+
+// cacheTransaction caches a transaction and its merchant, if it was expanded
+func (c *monzoCache) cacheTransaction(ctx context.Context, tx *monzo.Transaction) {
+	if c == nil {
+		return
+	}
+	c.set(ctx, "transaction", tx.ID, tx, c.transactionTTL)
+	if tx.Merchant != nil && tx.Merchant.Name != "" {
+		c.set(ctx, "merchant", tx.Merchant.ID, tx.Merchant, c.merchantTTL)
+	}
+}
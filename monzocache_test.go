@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonzoClientCache(t *testing.T) {
+	fake, client := newFakeRedis(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"transaction": {"id": "tx_1", "amount": -350, "merchant": {"id": "merch_1", "name": "Coffee Shop", "category": "eating_out"}}}`))
+	}))
+	defer server.Close()
+
+	monzoClient := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+	monzoClient.cache = newMonzoCache(client, MonzoAPICacheConfig{TransactionTTL: "10m"})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		tx, err := monzoClient.transaction(ctx, "tx_1")
+		if err != nil {
+			t.Fatalf("transaction failed: %v", err)
+		}
+		if tx.Merchant == nil || tx.Merchant.Name != "Coffee Shop" {
+			t.Errorf("Unexpected transaction: %+v", tx)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the second lookup to be cached, got %d calls", calls.Load())
+	}
+
+	// The merchant was cached with the transaction
+	merchant, err := monzoClient.merchant(ctx, "merch_1", "tx_2")
+	if err != nil {
+		t.Fatalf("merchant failed: %v", err)
+	}
+	if merchant.Category != "eating_out" || calls.Load() != 1 {
+		t.Errorf("Expected the merchant from the cache, got %+v after %d calls", merchant, calls.Load())
+	}
+
+	fake.mu.Lock()
+	transactionTTL := fake.ttls["monzo-webhook:monzo-api:transaction:tx_1"]
+	merchantTTL := fake.ttls["monzo-webhook:monzo-api:merchant:merch_1"]
+	fake.mu.Unlock()
+	if transactionTTL != 10*time.Minute || merchantTTL != 24*time.Hour {
+		t.Errorf("Expected TTLs of 10m and 24h, got %v and %v", transactionTTL, merchantTTL)
+	}
+}
+
+func TestMonzoClientMerchantMiss(t *testing.T) {
+	_, client := newFakeRedis(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"transaction": {"id": "tx_1", "merchant": {"id": "merch_1", "name": "Coffee Shop"}}}`))
+	}))
+	defer server.Close()
+
+	monzoClient := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+	monzoClient.cache = newMonzoCache(client, MonzoAPICacheConfig{})
+
+	merchant, err := monzoClient.merchant(context.Background(), "merch_1", "tx_1")
+	if err != nil || merchant.Name != "Coffee Shop" {
+		t.Errorf("Expected the merchant from the transaction, got %+v, %v", merchant, err)
+	}
+	if _, err := monzoClient.merchant(context.Background(), "merch_2", "tx_1"); err == nil {
+		t.Error("Expected an error for a merchant the transaction wasn't made with")
+	}
+}
+
+func TestMonzoAPICacheConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    MonzoAPICacheConfig
+		hasErr bool
+	}{
+		{name: "Defaults", cfg: MonzoAPICacheConfig{}},
+		{name: "Valid", cfg: MonzoAPICacheConfig{TransactionTTL: "5m", MerchantTTL: "168h"}},
+		{name: "Invalid transaction TTL", cfg: MonzoAPICacheConfig{TransactionTTL: "forever"}, hasErr: true},
+		{name: "Invalid merchant TTL", cfg: MonzoAPICacheConfig{MerchantTTL: "-1h"}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error: %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MonzoTokenConfig configures keeping the Monzo API's OAuth tokens and
+// refreshing the access token before it expires. Tokens aren't managed when
+// Store is empty.
+type MonzoTokenConfig struct {
+	// Store is where the tokens are kept: file or redis
+	Store string `json:"store"`
+	// Path is the file the tokens are kept in, for the file store
+	Path string `json:"path"`
+	// Key is the Redis key the tokens are kept in, defaulting to
+	// monzo-webhook:monzo-tokens
+	Key string `json:"key"`
+	// RefreshBefore is how long before the access token expires it is
+	// refreshed, defaulting to 10m
+	RefreshBefore string `json:"refresh_before"`
+	// AuthURL is where users authorise the service, defaulting to
+	// https://auth.monzo.com
+	AuthURL string `json:"auth_url"`
+}
+
+// AccountTokenConfig gives an account its own Monzo API tokens, kept apart
+// from the shared ones with the same store, and its own rate budget. It's
+// for accounts that belong to another user, so that their tokens expiring
+// doesn't affect requests for the other accounts.
+type AccountTokenConfig struct {
+	// Path is the file the account's tokens are kept in, for the file store,
+	// defaulting to the shared path with the account ID before its extension
+	Path string `json:"path"`
+	// Key is the Redis key the account's tokens are kept in, defaulting to
+	// the shared key followed by a colon and the account ID
+	Key string `json:"key"`
+	// RateLimit and Burst limit the account's requests, defaulting to
+	// monzo_api's rate_limit and burst
+	RateLimit float64 `json:"rate_limit"`
+	Burst     int     `json:"burst"`
+}
+
+var (
+	monzoTokenRefreshes = metrics.newCounterVec("monzo_webhook_monzo_token_refreshes_total",
+		"Refreshes of the Monzo API access token, by result (success, error, rejected).", "result")
+	monzoTokenExpiry = metrics.newGauge("monzo_webhook_monzo_token_expiry_timestamp_seconds",
+		"When the Monzo API access token expires, as a Unix timestamp.")
+	monzoReauthRequired = metrics.newGauge("monzo_webhook_monzo_reauth_required",
+		"1 when the Monzo API tokens can't be refreshed and the service must be authorised again, otherwise 0.")
+	monzoAccountTokenExpiry = metrics.newGaugeVec("monzo_webhook_monzo_account_token_expiry_timestamp_seconds",
+		"When the access token of each account with its own Monzo API tokens expires, as a Unix timestamp.", "account")
+	monzoAccountReauthRequired = metrics.newGaugeVec("monzo_webhook_monzo_account_reauth_required",
+		"1 for each account with its own Monzo API tokens that must be authorised again, otherwise 0.", "account")
+)
+
+// errMonzoReauthRequired is returned when there's no refresh token, or Monzo
+// rejected it, so the service must be authorised again
+var errMonzoReauthRequired = errors.New("Monzo API re-authentication required")
+
+// monzoTokens are the OAuth tokens for the Monzo API
+type monzoTokens struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	UserID       string    `json:"user_id,omitempty"`
+}
+
+// tokenStore keeps the tokens, so that refreshed ones survive restarts. A
+// store that has no tokens yet returns nil.
+type tokenStore interface {
+	load(ctx context.Context) (*monzoTokens, error)
+	save(ctx context.Context, tokens monzoTokens) error
+}
+
+// fileTokenStore keeps the tokens in a file only the server's user can read
+type fileTokenStore struct {
+	path string
+}
+
+func (s fileTokenStore) load(ctx context.Context) (*monzoTokens, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens monzoTokens
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token file %s: %w", s.path, err)
+	}
+	return &tokens, nil
+}
+
+// save replaces the file atomically, so a crash can't leave it half written
+func (s fileTokenStore) save(ctx context.Context, tokens monzoTokens) error {
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(s.path), ".monzo-tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path)
+}
+
+// redisTokenStore keeps the tokens in a Redis key, shared by every instance
+type redisTokenStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s redisTokenStore) load(ctx context.Context) (*monzoTokens, error) {
+	data, err := s.client.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens monzoTokens
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid tokens in %s: %w", s.key, err)
+	}
+	return &tokens, nil
+}
+
+func (s redisTokenStore) save(ctx context.Context, tokens monzoTokens) error {
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key, data, 0).Err()
+}
+
+// validate checks the token configuration for invalid values
+func (c MonzoTokenConfig) validate() error {
+	switch c.Store {
+	case "", "redis":
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("monzo_api tokens path is required for the file store")
+		}
+	default:
+		return fmt.Errorf("monzo_api tokens store must be file or redis")
+	}
+	if _, err := parsePositiveDuration(c.RefreshBefore, 10*time.Minute); err != nil {
+		return fmt.Errorf("invalid monzo_api tokens refresh_before: %w", err)
+	}
+	if c.AuthURL != "" && !strings.HasPrefix(c.AuthURL, "http://") && !strings.HasPrefix(c.AuthURL, "https://") {
+		return fmt.Errorf("monzo_api tokens auth_url must be an http or https URL")
+	}
+	return nil
+}
+
+// key returns the Redis key the tokens are kept in
+func (c MonzoTokenConfig) key() string {
+	if c.Key == "" {
+		return "monzo-webhook:monzo-tokens"
+	}
+	return c.Key
+}
+
+// location returns the file or Redis key the shared tokens are kept in
+func (c MonzoTokenConfig) location() string {
+	if c.Store == "file" {
+		return c.Path
+	}
+	return c.key()
+}
+
+// location returns the file or Redis key an account's tokens are kept in,
+// with the store of shared
+func (c AccountTokenConfig) location(shared MonzoTokenConfig, accountID string) string {
+	if shared.Store == "file" {
+		if c.Path != "" {
+			return c.Path
+		}
+		ext := filepath.Ext(shared.Path)
+		return strings.TrimSuffix(shared.Path, ext) + "." + accountID + ext
+	}
+	if c.Key != "" {
+		return c.Key
+	}
+	return shared.key() + ":" + accountID
+}
+
+// validateAccountTokens checks the tokens of the accounts that have their
+// own, which need the shared tokens' store and must each be kept apart
+func validateAccountTokens(accounts []AccountConfig, shared MonzoTokenConfig) error {
+	locations := map[string]string{shared.location(): "the shared tokens"}
+	for _, account := range accounts {
+		if account.Tokens == nil {
+			continue
+		}
+		if shared.Store == "" {
+			return fmt.Errorf("account '%s' tokens require a monzo_api tokens store", account.ID)
+		}
+		if account.Tokens.RateLimit < 0 || account.Tokens.Burst < 0 {
+			return fmt.Errorf("account '%s' tokens rate_limit and burst must not be negative", account.ID)
+		}
+		location := account.Tokens.location(shared, account.ID)
+		if other, ok := locations[location]; ok {
+			return fmt.Errorf("account '%s' tokens must not be kept in %s with %s", account.ID, location, other)
+		}
+		locations[location] = "account '" + account.ID + "'"
+	}
+	return nil
+}
+
+// newTokenStore returns the store of type kind keeping the tokens at
+// location, a file or Redis key
+func newTokenStore(kind, location string, client *redis.Client) (tokenStore, error) {
+	if kind == "redis" {
+		if client == nil {
+			return nil, fmt.Errorf("monzo_api tokens store redis requires Redis")
+		}
+		return redisTokenStore{client: client, key: location}, nil
+	}
+	return fileTokenStore{path: location}, nil
+}
+
+// tokenManager keeps the Monzo API's access token fresh, refreshing it before
+// it expires and saving each new pair of tokens to the store
+type tokenManager struct {
+	store         tokenStore
+	baseURL       string
+	clientID      string
+	clientSecret  string
+	refreshBefore time.Duration
+	client        *http.Client
+	now           func() time.Time
+	// account is the account whose own tokens are managed, or empty for the
+	// shared tokens
+	account string
+
+	// token is the access token the Monzo API client uses
+	token *credentialValue
+
+	mu      sync.Mutex
+	current monzoTokens
+	// changed wakes run when the tokens are replaced, such as by the OAuth
+	// flow
+	changed chan struct{}
+}
+
+// monzoTokenManager is set when the Monzo API's tokens are managed
+var monzoTokenManager *tokenManager
+
+func newTokenManager(cfg MonzoTokenConfig, store tokenStore, baseURL, clientID, clientSecret string, now func() time.Time) *tokenManager {
+	refreshBefore, _ := parsePositiveDuration(cfg.RefreshBefore, 10*time.Minute)
+	return &tokenManager{
+		store:         store,
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		refreshBefore: refreshBefore,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		now:           now,
+		token:         &credentialValue{},
+		changed:       make(chan struct{}, 1),
+	}
+}
+
+// monzoTokenManagerFromEnv creates the token manager when cfg.Tokens selects
+// a store, with the OAuth client from MONZO_CLIENT_ID and MONZO_CLIENT_SECRET.
+// Until the store has tokens, MONZO_REFRESH_TOKEN and MONZO_ACCESS_TOKEN are
+// used. It returns nil if tokens aren't managed.
+func monzoTokenManagerFromEnv(ctx context.Context, cfg MonzoAPIConfig, client *redis.Client) (*tokenManager, error) {
+	if cfg.Tokens.Store == "" {
+		return nil, nil
+	}
+	clientID := os.Getenv("MONZO_CLIENT_ID")
+	clientSecret, err := getenvSecret("MONZO_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("monzo_api tokens requires MONZO_CLIENT_ID and MONZO_CLIENT_SECRET")
+	}
+	if os.Getenv("VAULT_MONZO_PATH") != "" {
+		return nil, fmt.Errorf("monzo_api tokens can't be used with VAULT_MONZO_PATH")
+	}
+	var seed monzoTokens
+	if seed.RefreshToken, err = getenvSecret("MONZO_REFRESH_TOKEN"); err != nil {
+		return nil, err
+	}
+	if seed.AccessToken, err = getenvSecret("MONZO_ACCESS_TOKEN"); err != nil {
+		return nil, err
+	}
+
+	store, err := newTokenStore(cfg.Tokens.Store, cfg.Tokens.location(), client)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = defaultMonzoAPIURL
+	}
+	manager := newTokenManager(cfg.Tokens, store, baseURL, clientID, clientSecret, clock.Now)
+	if err := manager.load(ctx, seed); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// accountTokenManagers creates a token manager for each account with its own
+// tokens, sharing the OAuth client of shared. Accounts' tokens are obtained
+// with the OAuth flow, so until then their managers have none.
+func accountTokenManagers(ctx context.Context, cfg MonzoAPIConfig, accounts []AccountConfig, shared *tokenManager, client *redis.Client) (map[string]*tokenManager, error) {
+	managers := make(map[string]*tokenManager)
+	for _, account := range accounts {
+		if account.Tokens == nil {
+			continue
+		}
+		if shared == nil {
+			return nil, fmt.Errorf("account '%s' tokens require a monzo_api tokens store", account.ID)
+		}
+		store, err := newTokenStore(cfg.Tokens.Store, account.Tokens.location(cfg.Tokens, account.ID), client)
+		if err != nil {
+			return nil, err
+		}
+		manager := newTokenManager(cfg.Tokens, store, shared.baseURL, shared.clientID, shared.clientSecret, shared.now)
+		manager.account = account.ID
+		if err := manager.load(ctx, monzoTokens{}); err != nil {
+			return nil, fmt.Errorf("account '%s' tokens: %w", account.ID, err)
+		}
+		managers[account.ID] = manager
+	}
+	return managers, nil
+}
+
+// describe names the tokens in logs
+func (m *tokenManager) describe() string {
+	if m.account == "" {
+		return "the Monzo API"
+	}
+	return "account " + m.account + "'s Monzo API"
+}
+
+// setReauthRequired reports whether the tokens must be authorised again
+func (m *tokenManager) setReauthRequired(required bool) {
+	value := 0.0
+	if required {
+		value = 1
+	}
+	if m.account == "" {
+		monzoReauthRequired.Set(value)
+	} else {
+		monzoAccountReauthRequired.WithLabelValues(m.account).Set(value)
+	}
+}
+
+// load reads the tokens from the store, falling back to seed, such as a
+// refresh token from the environment, when the store has none
+func (m *tokenManager) load(ctx context.Context, seed monzoTokens) error {
+	tokens, err := m.store.load(ctx)
+	if err != nil {
+		return err
+	}
+	if tokens == nil {
+		tokens = &seed
+	}
+	m.use(*tokens)
+	return nil
+}
+
+// use makes tokens the current ones, without saving them
+func (m *tokenManager) use(tokens monzoTokens) {
+	m.mu.Lock()
+	m.current = tokens
+	m.mu.Unlock()
+	m.token.set(tokens.AccessToken)
+	if !tokens.ExpiresAt.IsZero() {
+		if m.account == "" {
+			monzoTokenExpiry.Set(float64(tokens.ExpiresAt.Unix()))
+		} else {
+			monzoAccountTokenExpiry.WithLabelValues(m.account).Set(float64(tokens.ExpiresAt.Unix()))
+		}
+	}
+	if tokens.AccessToken != "" || tokens.RefreshToken != "" {
+		m.setReauthRequired(false)
+	}
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// save stores new tokens and makes them the current ones
+func (m *tokenManager) save(ctx context.Context, tokens monzoTokens) error {
+	if err := m.store.save(ctx, tokens); err != nil {
+		return err
+	}
+	m.use(tokens)
+	return nil
+}
+
+func (m *tokenManager) tokens() monzoTokens {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// refresh exchanges the refresh token for new tokens and saves them
+func (m *tokenManager) refresh(ctx context.Context) error {
+	current := m.tokens()
+	if current.RefreshToken == "" {
+		return errMonzoReauthRequired
+	}
+	tokens, err := m.requestTokens(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {current.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	return m.save(ctx, tokens)
+}
+
+// requestTokens requests tokens from Monzo's token endpoint with the client's
+// credentials. A rejected grant means the service must be authorised again.
+func (m *tokenManager) requestTokens(ctx context.Context, form url.Values) (monzoTokens, error) {
+	form.Set("client_id", m.clientID)
+	form.Set("client_secret", m.clientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return monzoTokens{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return monzoTokens{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		apiErr := &monzoAPIError{Status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(apiErr)
+		return monzoTokens{}, fmt.Errorf("%w: %v", errMonzoReauthRequired, apiErr)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return monzoTokens{}, &monzoAPIError{Status: resp.StatusCode}
+	}
+
+	var result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		UserID       string `json:"user_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return monzoTokens{}, fmt.Errorf("invalid Monzo token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return monzoTokens{}, fmt.Errorf("invalid Monzo token response: no access token")
+	}
+	return monzoTokens{
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
+		ExpiresAt:    m.now().Add(time.Duration(result.ExpiresIn) * time.Second).UTC(),
+		UserID:       result.UserID,
+	}, nil
+}
+
+// refreshDelay returns how long to wait before refreshing the current
+// access token
+func (m *tokenManager) refreshDelay() time.Duration {
+	tokens := m.tokens()
+	if tokens.AccessToken == "" || tokens.ExpiresAt.IsZero() {
+		return 0
+	}
+	return tokens.ExpiresAt.Add(-m.refreshBefore).Sub(m.now())
+}
+
+// run refreshes the access token before it expires until ctx is done. Failed
+// refreshes are retried every minute, except when re-authentication is
+// required, which waits for new tokens.
+func (m *tokenManager) run(ctx context.Context) {
+	select {
+	case <-m.changed:
+	default:
+	}
+	for {
+		delay := m.refreshDelay()
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.changed:
+				continue
+			case <-time.After(delay):
+			}
+		}
+
+		err := m.refresh(ctx)
+		switch {
+		case err == nil:
+			monzoTokenRefreshes.WithLabelValues("success").Inc()
+			logInfo("Refreshed %s access token, expires at %s", m.describe(), m.tokens().ExpiresAt.Format(time.RFC3339))
+			continue
+		case errors.Is(err, errMonzoReauthRequired):
+			monzoTokenRefreshes.WithLabelValues("rejected").Inc()
+			m.setReauthRequired(true)
+			logError("Can't refresh %s tokens, authorise the service again: %v", m.describe(), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.changed:
+			}
+		default:
+			monzoTokenRefreshes.WithLabelValues("error").Inc()
+			logWarn("Error refreshing %s access token, retrying in a minute: %v", m.describe(), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.changed:
+			case <-time.After(time.Minute):
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonzoTokenConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       MonzoTokenConfig
+		expectErr string
+	}{
+		{name: "Not managed"},
+		{name: "Redis", cfg: MonzoTokenConfig{Store: "redis", RefreshBefore: "5m"}},
+		{name: "File", cfg: MonzoTokenConfig{Store: "file", Path: "/var/lib/monzo-webhook/tokens.json"}},
+		{name: "File without path", cfg: MonzoTokenConfig{Store: "file"}, expectErr: "path is required"},
+		{name: "Unknown store", cfg: MonzoTokenConfig{Store: "vault"}, expectErr: "must be file or redis"},
+		{name: "Invalid refresh_before", cfg: MonzoTokenConfig{Store: "redis", RefreshBefore: "soon"}, expectErr: "refresh_before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.expectErr == "" && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if tt.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tt.expectErr)) {
+				t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestTokenStores(t *testing.T) {
+	_, client := newFakeRedis(t)
+	tokens := monzoTokens{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), UserID: "user_1"}
+	stores := map[string]tokenStore{
+		"file":  fileTokenStore{path: filepath.Join(t.TempDir(), "tokens.json")},
+		"redis": redisTokenStore{client: client, key: "monzo-webhook:monzo-tokens"},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if loaded, err := store.load(context.Background()); err != nil || loaded != nil {
+				t.Fatalf("Expected no tokens in an empty store, got %v %v", loaded, err)
+			}
+			if err := store.save(context.Background(), tokens); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := store.load(context.Background())
+			if err != nil || loaded == nil || !reflect.DeepEqual(*loaded, tokens) {
+				t.Errorf("Expected %+v, got %+v %v", tokens, loaded, err)
+			}
+		})
+	}
+}
+
+func TestTokenManagerRefresh(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/oauth2/token" || r.PostForm.Get("grant_type") != "refresh_token" ||
+			r.PostForm.Get("client_id") != "oauth2client_1" || r.PostForm.Get("client_secret") != "secret" {
+			t.Errorf("Unexpected token request: %s %v", r.URL.Path, r.PostForm)
+		}
+		switch r.PostForm.Get("refresh_token") {
+		case "refresh_1":
+			w.Write([]byte(`{"access_token":"access_2","refresh_token":"refresh_2","expires_in":21600,"token_type":"Bearer","user_id":"user_1"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"unauthorized.bad_refresh_token","message":"Refresh token has been evicted"}`))
+		}
+	}))
+	defer server.Close()
+
+	store := fileTokenStore{path: filepath.Join(t.TempDir(), "tokens.json")}
+	manager := newTokenManager(MonzoTokenConfig{Store: "file"}, store, server.URL, "oauth2client_1", "secret", func() time.Time { return now })
+	if err := manager.load(context.Background(), monzoTokens{RefreshToken: "refresh_1"}); err != nil {
+		t.Fatal(err)
+	}
+	if delay := manager.refreshDelay(); delay != 0 {
+		t.Errorf("Expected an immediate refresh without an access token, got %v", delay)
+	}
+
+	if err := manager.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expect := monzoTokens{AccessToken: "access_2", RefreshToken: "refresh_2", ExpiresAt: now.Add(6 * time.Hour), UserID: "user_1"}
+	if got := manager.tokens(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %+v, got %+v", expect, got)
+	}
+	if manager.token.get() != "access_2" {
+		t.Errorf("Expected the client's token to be replaced, got %s", manager.token.get())
+	}
+	if stored, _ := store.load(context.Background()); stored == nil || !reflect.DeepEqual(*stored, expect) {
+		t.Errorf("Expected the tokens to be saved, got %+v", stored)
+	}
+	if delay := manager.refreshDelay(); delay != 6*time.Hour-10*time.Minute {
+		t.Errorf("Expected a refresh 10 minutes before expiry, got %v", delay)
+	}
+
+	// refresh_2 is rejected
+	if err := manager.refresh(context.Background()); !errors.Is(err, errMonzoReauthRequired) {
+		t.Errorf("Expected re-authentication to be required, got %v", err)
+	}
+	if manager.token.get() != "access_2" {
+		t.Error("Expected a failed refresh to keep the current token")
+	}
+}
+
+func TestTokenManagerRefreshWithoutRefreshToken(t *testing.T) {
+	manager := newTokenManager(MonzoTokenConfig{}, fileTokenStore{path: filepath.Join(t.TempDir(), "tokens.json")}, "http://127.0.0.1:0", "id", "secret", time.Now)
+	if err := manager.refresh(context.Background()); !errors.Is(err, errMonzoReauthRequired) {
+		t.Errorf("Expected re-authentication to be required, got %v", err)
+	}
+}
+
+func TestValidateAccountTokens(t *testing.T) {
+	redis := MonzoTokenConfig{Store: "redis"}
+	file := MonzoTokenConfig{Store: "file", Path: "/var/lib/monzo-webhook/tokens.json"}
+	tests := []struct {
+		name      string
+		shared    MonzoTokenConfig
+		accounts  []AccountConfig
+		expectErr string
+	}{
+		{name: "No account tokens", accounts: []AccountConfig{{ID: "acc_1"}}},
+		{name: "Redis", shared: redis, accounts: []AccountConfig{{ID: "acc_1", Tokens: &AccountTokenConfig{}}, {ID: "acc_2", Tokens: &AccountTokenConfig{RateLimit: 1}}}},
+		{name: "File", shared: file, accounts: []AccountConfig{{ID: "acc_1", Tokens: &AccountTokenConfig{}}, {ID: "acc_2", Tokens: &AccountTokenConfig{Path: "/tmp/bob.json"}}}},
+		{name: "Not managed", accounts: []AccountConfig{{ID: "acc_1", Tokens: &AccountTokenConfig{}}}, expectErr: "require a monzo_api tokens store"},
+		{name: "Negative burst", shared: redis, accounts: []AccountConfig{{ID: "acc_1", Tokens: &AccountTokenConfig{Burst: -1}}}, expectErr: "must not be negative"},
+		{name: "Shared key", shared: redis, accounts: []AccountConfig{{ID: "acc_1", Tokens: &AccountTokenConfig{Key: "monzo-webhook:monzo-tokens"}}},
+			expectErr: "with the shared tokens"},
+		{name: "Same path", shared: file, accounts: []AccountConfig{{ID: "acc_1", Tokens: &AccountTokenConfig{Path: "/tmp/tokens.json"}},
+			{ID: "acc_2", Tokens: &AccountTokenConfig{Path: "/tmp/tokens.json"}}}, expectErr: "with account 'acc_1'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAccountTokens(tt.accounts, tt.shared)
+			if tt.expectErr == "" && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if tt.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tt.expectErr)) {
+				t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestAccountTokenManagers(t *testing.T) {
+	dir := t.TempDir()
+	cfg := MonzoAPIConfig{Tokens: MonzoTokenConfig{Store: "file", Path: filepath.Join(dir, "tokens.json")}}
+	stored := monzoTokens{AccessToken: "access_bob", RefreshToken: "refresh_bob"}
+	if err := (fileTokenStore{path: filepath.Join(dir, "tokens.acc_2.json")}).save(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := newTokenManager(cfg.Tokens, fileTokenStore{path: cfg.Tokens.Path}, "http://127.0.0.1:0", "oauth2client_1", "secret", time.Now)
+	accounts := []AccountConfig{{ID: "acc_1"}, {ID: "acc_2", Tokens: &AccountTokenConfig{}}, {ID: "acc_3", Tokens: &AccountTokenConfig{}}}
+	managers, err := accountTokenManagers(context.Background(), cfg, accounts, shared, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(managers) != 2 || managers["acc_1"] != nil {
+		t.Fatalf("Expected managers for acc_2 and acc_3, got %v", managers)
+	}
+	if got := managers["acc_2"].tokens(); !reflect.DeepEqual(got, stored) || managers["acc_2"].token.get() != "access_bob" {
+		t.Errorf("Expected acc_2's own tokens, got %+v", got)
+	}
+	if got := managers["acc_3"].tokens(); got.AccessToken != "" || got.RefreshToken != "" {
+		t.Errorf("Expected acc_3 to have no tokens until it's authorised, got %+v", got)
+	}
+	if managers["acc_3"].clientID != "oauth2client_1" || managers["acc_3"].account != "acc_3" {
+		t.Errorf("Expected acc_3's manager to share the OAuth client, got %+v", managers["acc_3"])
+	}
+}
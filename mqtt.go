@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultMQTTTopic is the topic template used when an mqtt sink has no topic
+const defaultMQTTTopic = "monzo/{account}/{type}"
+
+// mqttKeepAlive is how often the client pings an idle broker, so that a
+// connection silently dropped by the network is noticed and re-established
+const mqttKeepAlive = 30 * time.Second
+
+// mqttPlaceholder matches a placeholder in a topic template
+var mqttPlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// MQTTConfig holds the connection settings for the MQTT broker
+type MQTTConfig struct {
+	Host     string
+	Username string
+	Password string
+	TLS      *tls.Config
+	ClientID string
+}
+
+// mqttConfigFromEnv builds an MQTTConfig from environment variables. It
+// returns nil if MQTT_URL is not set.
+func mqttConfigFromEnv() (*MQTTConfig, error) {
+	rawURL, err := getenvSecret("MQTT_URL")
+	if err != nil || rawURL == "" {
+		return nil, err
+	}
+	cfg, err := parseMQTTURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ClientID = os.Getenv("MQTT_CLIENT_ID")
+	if cfg.ClientID == "" {
+		// Brokers disconnect a client when another connects with its ID,
+		// so each instance needs its own
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		cfg.ClientID = "monzo-webhook-" + hex.EncodeToString(suffix)
+	}
+	return cfg, nil
+}
+
+// parseMQTTURL parses an mqtt:// or mqtts:// broker URL
+func parseMQTTURL(rawURL string) (*MQTTConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// url.Error includes the URL, and with it the password
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid MQTT_URL: %w", err)
+	}
+
+	cfg := &MQTTConfig{}
+	defaultPort := "1883"
+	switch u.Scheme {
+	case "mqtt":
+	case "mqtts":
+		defaultPort = "8883"
+		cfg.TLS = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("invalid MQTT_URL scheme '%s' (expected mqtt or mqtts)", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	cfg.Host = net.JoinHostPort(host, port)
+	if u.User != nil {
+		cfg.Username = u.User.Username()
+		cfg.Password, _ = u.User.Password()
+	}
+	return cfg, nil
+}
+
+// sharedMQTTPublisher connects to the broker in MQTT_URL when an mqtt sink is
+// first created. The sinks share its connection, as a broker disconnects a
+// client when another connects with the same client ID.
+var sharedMQTTPublisher = sync.OnceValues(func() (*MQTTPublisher, error) {
+	cfg, err := mqttConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("MQTT_URL must be set to publish to MQTT")
+	}
+	logInfo("MQTT publishing enabled: host=%s client_id=%s", cfg.Host, cfg.ClientID)
+	return NewMQTTPublisher(*cfg), nil
+})
+
+// validateMQTTSink checks an mqtt sink's topic template and QoS
+func validateMQTTSink(cfg SinkConfig) error {
+	if err := validateMQTTTopic(cfg.Topic); err != nil {
+		return fmt.Errorf("invalid topic '%s': %w", cfg.Topic, err)
+	}
+	if cfg.QoS != nil && (*cfg.QoS < 0 || *cfg.QoS > 2) {
+		return fmt.Errorf("invalid qos %d (expected 0, 1 or 2)", *cfg.QoS)
+	}
+	return nil
+}
+
+// newMQTTSink creates a sink publishing to the shared broker connection,
+// with QoS 1 unless the sink sets its own
+func newMQTTSink(name string, cfg SinkConfig, publisher func() (*MQTTPublisher, error)) (*mqttSink, error) {
+	p, err := publisher()
+	if err != nil {
+		return nil, err
+	}
+	s := &mqttSink{name: name, publisher: p, topic: cfg.Topic, qos: 1, retain: cfg.Retain}
+	if s.topic == "" {
+		s.topic = defaultMQTTTopic
+	}
+	if cfg.QoS != nil {
+		s.qos = byte(*cfg.QoS)
+	}
+	return s, nil
+}
+
+// validateMQTTTopic checks that a topic template's placeholders are known and
+// that it has no wildcards, which can't be published to
+func validateMQTTTopic(topic string) error {
+	for _, match := range mqttPlaceholder.FindAllStringSubmatch(topic, -1) {
+		switch match[1] {
+		case "account", "type", "tenant":
+		default:
+			return fmt.Errorf("unknown placeholder %s", match[0])
+		}
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return errors.New("topics can't contain the wildcards + and #")
+	}
+	return nil
+}
+
+// mqttTopic renders a topic template for an event. Values are made into a
+// single topic level, and fields an event doesn't have, such as the account
+// of a non-transaction event, are rendered as "none".
+func mqttTopic(template string, event *webhookEvent) string {
+	return mqttPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		var value string
+		switch placeholder {
+		case "{account}":
+			value = event.AccountID
+		case "{type}":
+			value = event.Type
+		case "{tenant}":
+			if event.Tenant != nil {
+				value = event.Tenant.Name
+			}
+		}
+		if value == "" {
+			return "none"
+		}
+		return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(value)
+	})
+}
+
+// MQTTPublisher publishes messages to an MQTT broker with paho, which
+// reconnects automatically when the connection is lost
+type MQTTPublisher struct {
+	host   string
+	client mqtt.Client
+
+	// mu serialises connecting, so that concurrent publishes don't each
+	// start a connection
+	mu sync.Mutex
+}
+
+// NewMQTTPublisher creates a publisher for the given configuration. The
+// connection is established lazily on the first publish.
+func NewMQTTPublisher(cfg MQTTConfig) *MQTTPublisher {
+	scheme := "tcp"
+	if cfg.TLS != nil {
+		scheme = "ssl"
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(scheme + "://" + cfg.Host).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetTLSConfig(cfg.TLS).
+		SetProtocolVersion(4).
+		SetCleanSession(true).
+		SetKeepAlive(mqttKeepAlive).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logWarn("MQTT connection to %s lost, reconnecting: %v", cfg.Host, err)
+		})
+	return &MQTTPublisher{host: cfg.Host, client: mqtt.NewClient(opts)}
+}
+
+// Publish sends a message and, for QoS 1 and 2, waits until the broker has
+// acknowledged it. QoS 1 and 2 messages in flight when the connection is
+// lost are resent once it's back, and are then reported as published without
+// waiting for the broker. QoS 0 messages are dropped while reconnecting.
+func (p *MQTTPublisher) Publish(ctx context.Context, topic string, body []byte, qos byte, retain bool) error {
+	if err := p.Connect(ctx); err != nil {
+		return err
+	}
+	return waitMQTT(ctx, p.client.Publish(topic, qos, retain, body))
+}
+
+// Connect connects to the broker, if not already connected, so that the
+// first publish doesn't have to
+func (p *MQTTPublisher) Connect(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client.IsConnected() {
+		return nil
+	}
+	if err := waitMQTT(ctx, p.client.Connect()); err != nil {
+		return fmt.Errorf("MQTT connect to %s: %w", p.host, err)
+	}
+	return nil
+}
+
+// Close disconnects from the broker, waiting briefly for in-flight messages
+func (p *MQTTPublisher) Close() error {
+	p.client.Disconnect(250)
+	return nil
+}
+
+// waitMQTT waits for a paho operation to complete or the context to end
+func waitMQTT(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// mutedMerchantsKey is the Redis set holding the muted merchants
+const mutedMerchantsKey = "monzo-webhook:muted-merchants"
+
+// merchantMuteList is the set of merchants whose events are not sent to
+// notification sinks. Merchants are matched case-insensitively by ID or name.
+// The list is persisted in Redis when connected, so that it survives
+// restarts and is shared between instances.
+type merchantMuteList struct {
+	client *redis.Client
+
+	mu        sync.RWMutex
+	merchants map[string]string
+}
+
+var merchantMutes = newMerchantMuteList(nil)
+
+func newMerchantMuteList(client *redis.Client) *merchantMuteList {
+	return &merchantMuteList{client: client, merchants: make(map[string]string)}
+}
+
+// load replaces the list with the one stored in Redis
+func (m *merchantMuteList) load(ctx context.Context) error {
+	if m.client == nil {
+		return nil
+	}
+	members, err := m.client.SMembers(ctx, mutedMerchantsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	merchants := make(map[string]string, len(members))
+	for _, merchant := range members {
+		merchants[strings.ToLower(merchant)] = merchant
+	}
+	m.mu.Lock()
+	m.merchants = merchants
+	m.mu.Unlock()
+	return nil
+}
+
+// add mutes a merchant
+func (m *merchantMuteList) add(ctx context.Context, merchant string) error {
+	if m.client != nil {
+		if err := m.client.SAdd(ctx, mutedMerchantsKey, merchant).Err(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.merchants[strings.ToLower(merchant)] = merchant
+	m.mu.Unlock()
+	return nil
+}
+
+// remove unmutes a merchant, reporting whether it was muted
+func (m *merchantMuteList) remove(ctx context.Context, merchant string) (bool, error) {
+	m.mu.RLock()
+	stored, ok := m.merchants[strings.ToLower(merchant)]
+	m.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	if m.client != nil {
+		if err := m.client.SRem(ctx, mutedMerchantsKey, stored).Err(); err != nil {
+			return false, err
+		}
+	}
+	m.mu.Lock()
+	delete(m.merchants, strings.ToLower(merchant))
+	m.mu.Unlock()
+	return true, nil
+}
+
+// list returns the muted merchants in order
+func (m *merchantMuteList) list() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	merchants := make([]string, 0, len(m.merchants))
+	for _, merchant := range m.merchants {
+		merchants = append(merchants, merchant)
+	}
+	sort.Strings(merchants)
+	return merchants
+}
+
+// match returns the muted merchant an event is for, if any. The merchant is
+// either an object with an ID, group ID and name, or just an ID.
+func (m *merchantMuteList) match(payload map[string]interface{}) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.merchants) == 0 {
+		return "", false
+	}
+
+	var candidates []interface{}
+	if merchant, ok := lookupField(payload, "data.merchant"); ok {
+		if object, ok := merchant.(map[string]interface{}); ok {
+			candidates = []interface{}{object["id"], object["group_id"], object["name"]}
+		} else {
+			candidates = []interface{}{merchant}
+		}
+	}
+	for _, candidate := range candidates {
+		if s, ok := candidate.(string); ok && s != "" {
+			if merchant, ok := m.merchants[strings.ToLower(s)]; ok {
+				return merchant, true
+			}
+		}
+	}
+	return "", false
+}
+
+// adminMutesHandler lists the muted merchants
+func adminMutesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"merchants": merchantMutes.list(),
+	})
+}
+
+// adminMuteHandler mutes a merchant with PUT and unmutes it with DELETE
+func adminMuteHandler(w http.ResponseWriter, r *http.Request) {
+	merchant := r.PathValue("merchant")
+
+	switch r.Method {
+	case http.MethodPut:
+		if err := merchantMutes.add(r.Context(), merchant); err != nil {
+			logError("Error muting merchant '%s': %v", merchant, err)
+			http.Error(w, "Error saving mute list", http.StatusServiceUnavailable)
+			return
+		}
+		logInfo("Muted notifications for merchant '%s'", merchant)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		removed, err := merchantMutes.remove(r.Context(), merchant)
+		if err != nil {
+			logError("Error unmuting merchant '%s': %v", merchant, err)
+			http.Error(w, "Error saving mute list", http.StatusServiceUnavailable)
+			return
+		}
+		if !removed {
+			http.Error(w, "Merchant is not muted", http.StatusNotFound)
+			return
+		}
+		logInfo("Unmuted notifications for merchant '%s'", merchant)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMerchantMuteListMatch(t *testing.T) {
+	mutes := newMerchantMuteList(nil)
+	mutes.add(context.Background(), "Pret A Manger")
+	mutes.add(context.Background(), "merch_123")
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected string
+	}{
+		{name: "Merchant name", payload: `{"data":{"merchant":{"id":"merch_456","name":"PRET A MANGER"}}}`, expected: "Pret A Manger"},
+		{name: "Merchant ID", payload: `{"data":{"merchant":{"id":"merch_123","name":"Coffee Shop"}}}`, expected: "merch_123"},
+		{name: "Unexpanded merchant", payload: `{"data":{"merchant":"merch_123"}}`, expected: "merch_123"},
+		{name: "Other merchant", payload: `{"data":{"merchant":{"id":"merch_789","name":"Tesco"}}}`},
+		{name: "No merchant", payload: `{"data":{"merchant":null}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload map[string]interface{}
+			json.Unmarshal([]byte(tt.payload), &payload)
+
+			merchant, ok := mutes.match(payload)
+			if ok != (tt.expected != "") || merchant != tt.expected {
+				t.Errorf("Expected '%s', got '%s' (matched=%v)", tt.expected, merchant, ok)
+			}
+		})
+	}
+}
+
+func TestAdminMuteHandlers(t *testing.T) {
+	origMutes := merchantMutes
+	defer func() { merchantMutes = origMutes }()
+
+	server, client := newFakeRedis(t)
+	merchantMutes = newMerchantMuteList(client)
+
+	request := func(method, merchant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/mutes/"+url.PathEscape(merchant), nil)
+		req.SetPathValue("merchant", merchant)
+		rr := httptest.NewRecorder()
+		adminMuteHandler(rr, req)
+		return rr
+	}
+
+	if rr := request(http.MethodPut, "Pret A Manger"); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code 204, got %d", rr.Code)
+	}
+	if !server.sets[mutedMerchantsKey]["Pret A Manger"] {
+		t.Error("Expected the muted merchant to be stored in Redis")
+	}
+
+	// A fresh list picks up the stored merchants
+	reloaded := newMerchantMuteList(client)
+	if err := reloaded.load(context.Background()); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if got := reloaded.list(); len(got) != 1 || got[0] != "Pret A Manger" {
+		t.Errorf("Expected the reloaded list to contain the merchant, got %v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	adminMutesHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/mutes", nil))
+	var response struct {
+		Merchants []string `json:"merchants"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(response.Merchants) != 1 || response.Merchants[0] != "Pret A Manger" {
+		t.Errorf("Unexpected merchants: %v", response.Merchants)
+	}
+
+	if rr := request(http.MethodDelete, "pret a manger"); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code 204, got %d", rr.Code)
+	}
+	if len(server.sets[mutedMerchantsKey]) != 0 {
+		t.Errorf("Expected the merchant to be removed from Redis, got %v", server.sets[mutedMerchantsKey])
+	}
+	if rr := request(http.MethodDelete, "Pret A Manger"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code 404 for a merchant that isn't muted, got %d", rr.Code)
+	}
+}
+
+func TestMutedMerchantSkipsNotificationSinks(t *testing.T) {
+	origMutes := merchantMutes
+	defer func() { merchantMutes = origMutes }()
+
+	merchantMutes = newMerchantMuteList(nil)
+	merchantMutes.add(context.Background(), "Pret A Manger")
+
+	storage := &fakeSink{name: "redis"}
+	notifications := &fakeSink{name: "push"}
+	entries := []sinkEntry{{sink: storage}, {sink: &notificationSink{sink: notifications}}}
+
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"transaction.created","data":{"merchant":{"name":"Pret A Manger"}}}`), &payload)
+	event := newWebhookEvent("transaction.created", nil, payload, nil, "disabled")
+	if event.MutedMerchant != "Pret A Manger" {
+		t.Fatalf("Expected the event to be muted, got '%s'", event.MutedMerchant)
+	}
+
+	before := testutil.ToFloat64(sinkPublishTotal.WithLabelValues("push", "muted"))
+	if err := publishToSinks(context.Background(), entries, nil, event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if storage.count() != 1 {
+		t.Errorf("Expected the muted event to still be published to storage, got %d", storage.count())
+	}
+	if notifications.count() != 0 {
+		t.Errorf("Expected the muted event not to reach the notification sink, got %d", notifications.count())
+	}
+	if got := testutil.ToFloat64(sinkPublishTotal.WithLabelValues("push", "muted")) - before; got != 1 {
+		t.Errorf("Expected 1 muted publish, got %v", got)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMonzoAuthURL is where users are sent to authorise the service
+const defaultMonzoAuthURL = "https://auth.monzo.com"
+
+// oauthStateTTL is how long the user has to authorise the service after
+// starting the flow
+const oauthStateTTL = 10 * time.Minute
+
+// monzoApprovalWindow is how long the user has to approve access in the
+// Monzo app once the service is authorised
+const monzoApprovalWindow = 5 * time.Minute
+
+var monzoAuthorisations = metrics.newCounterVec("monzo_webhook_monzo_authorisations_total",
+	"Monzo OAuth authorisations completed through /auth/callback, by result (success, invalid_state, denied, error).", "result")
+
+// oauthFlow obtains the Monzo API's tokens through the OAuth authorization
+// code flow, saving them with the token manager
+type oauthFlow struct {
+	manager     *tokenManager
+	authURL     string
+	redirectURL string
+	now         func() time.Time
+	// accounts are the token managers of the accounts with their own tokens
+	accounts map[string]*tokenManager
+	// authorised runs once tokens have been obtained, such as to discover
+	// the accounts they can see. account is empty for the shared tokens.
+	authorised func(ctx context.Context, account string)
+
+	mu sync.Mutex
+	// states are the flows that were started, by state. Each can be used
+	// once.
+	states map[string]oauthState
+}
+
+// oauthState is a flow that was started, for the shared tokens or an
+// account's own
+type oauthState struct {
+	account string
+	expires time.Time
+}
+
+// monzoOAuth is set when tokens are managed and MONZO_REDIRECT_URL is set
+var monzoOAuth *oauthFlow
+
+func newOAuthFlow(manager *tokenManager, authURL, redirectURL string, now func() time.Time) *oauthFlow {
+	if authURL == "" {
+		authURL = defaultMonzoAuthURL
+	}
+	return &oauthFlow{
+		manager:     manager,
+		authURL:     strings.TrimSuffix(authURL, "/"),
+		redirectURL: redirectURL,
+		now:         now,
+		states:      make(map[string]oauthState),
+	}
+}
+
+// start returns the URL to send the user to, with a new state, to obtain
+// the shared tokens or, if account is set, that account's own
+func (f *oauthFlow) start(account string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(random)
+
+	f.mu.Lock()
+	now := f.now()
+	for s, started := range f.states {
+		if now.After(started.expires) {
+			delete(f.states, s)
+		}
+	}
+	f.states[state] = oauthState{account: account, expires: now.Add(oauthStateTTL)}
+	f.mu.Unlock()
+
+	query := url.Values{
+		"client_id":     {f.manager.clientID},
+		"redirect_uri":  {f.redirectURL},
+		"response_type": {"code"},
+		"state":         {state},
+	}
+	return f.authURL + "/?" + query.Encode(), nil
+}
+
+// useState reports whether a state was issued by start and hasn't expired,
+// with the account it was issued for, and forgets it
+func (f *oauthFlow) useState(state string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	started, ok := f.states[state]
+	delete(f.states, state)
+	return started.account, ok && !f.now().After(started.expires)
+}
+
+// managerFor returns the token manager of an account's own tokens, or the
+// shared one
+func (f *oauthFlow) managerFor(account string) *tokenManager {
+	if manager, ok := f.accounts[account]; ok {
+		return manager
+	}
+	return f.manager
+}
+
+// browserAdminAuthMiddleware is adminAuthMiddleware for pages opened in a
+// browser, which can't send a bearer token: the admin token can also be
+// given as the password of HTTP Basic authentication, with any username
+func browserAdminAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	bearer := adminAuthMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			bearer(w, r)
+			return
+		}
+		_, password, ok := r.BasicAuth()
+		expected := currentAdminToken()
+		if expected == "" || !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			logWarn("Unauthorized admin request to %s", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authStartHandler sends the user to Monzo to authorise the service, for an
+// account with its own tokens with ?account=
+func authStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account := r.URL.Query().Get("account")
+	if _, ok := monzoOAuth.accounts[account]; account != "" && !ok {
+		http.Error(w, "Account not configured with its own tokens", http.StatusBadRequest)
+		return
+	}
+	target, err := monzoOAuth.start(account)
+	if err != nil {
+		logError("Error starting the Monzo OAuth flow: %v", err)
+		http.Error(w, "Error starting authorisation", http.StatusInternalServerError)
+		return
+	}
+	if account == "" {
+		logInfo("Started the Monzo OAuth flow")
+	} else {
+		logInfo("Started the Monzo OAuth flow for account %s", account)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// authCallbackHandler exchanges the code Monzo redirects the user back with
+// for tokens, and saves them. It's authenticated by the state, since Monzo
+// sends the user's browser here without the admin token.
+func authCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	account, ok := monzoOAuth.useState(query.Get("state"))
+	if !ok {
+		logWarn("Monzo OAuth callback with an unknown or expired state")
+		monzoAuthorisations.WithLabelValues("invalid_state").Inc()
+		http.Error(w, "Unknown or expired state, start again from /auth/start", http.StatusBadRequest)
+		return
+	}
+	if reason := query.Get("error"); reason != "" || query.Get("code") == "" {
+		logWarn("Monzo OAuth authorisation was not granted: %s", reason)
+		monzoAuthorisations.WithLabelValues("denied").Inc()
+		http.Error(w, "Authorisation was not granted", http.StatusBadRequest)
+		return
+	}
+
+	manager := monzoOAuth.managerFor(account)
+	tokens, err := manager.requestTokens(r.Context(), url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {monzoOAuth.redirectURL},
+		"code":         {query.Get("code")},
+	})
+	if err == nil {
+		err = manager.save(r.Context(), tokens)
+	}
+	if err != nil {
+		logError("Error completing the Monzo OAuth flow: %v", err)
+		monzoAuthorisations.WithLabelValues("error").Inc()
+		http.Error(w, "Error obtaining tokens from Monzo", http.StatusBadGateway)
+		return
+	}
+	logInfo("Monzo API authorised through OAuth: user_id=%s expires_at=%s account=%s", tokens.UserID, tokens.ExpiresAt.Format(time.RFC3339), account)
+	monzoAuthorisations.WithLabelValues("success").Inc()
+	if monzoOAuth.authorised != nil {
+		go func(authorised func(context.Context, string)) {
+			ctx, cancel := context.WithTimeout(context.Background(), monzoApprovalWindow)
+			defer cancel()
+			authorised(ctx, account)
+		}(monzoOAuth.authorised)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Authorised. Approve access in the Monzo app before the service can read your account.")
+}
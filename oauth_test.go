@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOAuthFlow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != "code_1" ||
+			r.PostForm.Get("redirect_uri") != "https://webhooks.example.com/auth/callback" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":"bad_request.invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"access_1","refresh_token":"refresh_1","expires_in":21600,"user_id":"user_1"}`))
+	}))
+	defer server.Close()
+
+	original := monzoOAuth
+	defer func() { monzoOAuth = original }()
+	store := fileTokenStore{path: filepath.Join(t.TempDir(), "tokens.json")}
+	manager := newTokenManager(MonzoTokenConfig{Store: "file"}, store, server.URL, "oauth2client_1", "secret", func() time.Time { return now })
+	monzoOAuth = newOAuthFlow(manager, "https://auth.example.com/", "https://webhooks.example.com/auth/callback", func() time.Time { return now })
+	authorised := make(chan struct{}, 1)
+	monzoOAuth.authorised = func(ctx context.Context, account string) { authorised <- struct{}{} }
+
+	start := func() string {
+		w := httptest.NewRecorder()
+		authStartHandler(w, httptest.NewRequest(http.MethodGet, "/auth/start", nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected a redirect, got %d", w.Code)
+		}
+		location, _ := url.Parse(w.Header().Get("Location"))
+		query := location.Query()
+		if location.Host != "auth.example.com" || query.Get("client_id") != "oauth2client_1" || query.Get("response_type") != "code" ||
+			query.Get("redirect_uri") != "https://webhooks.example.com/auth/callback" || query.Get("state") == "" {
+			t.Errorf("Unexpected authorisation URL: %s", location)
+		}
+		return query.Get("state")
+	}
+	callback := func(query string) int {
+		w := httptest.NewRecorder()
+		authCallbackHandler(w, httptest.NewRequest(http.MethodGet, "/auth/callback?"+query, nil))
+		return w.Code
+	}
+
+	state := start()
+	if code := callback("state=unknown&code=code_1"); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown state to be rejected, got %d", code)
+	}
+	if code := callback("state=" + state + "&code=code_1"); code != http.StatusOK {
+		t.Fatalf("Expected the callback to succeed, got %d", code)
+	}
+	select {
+	case <-authorised:
+	case <-time.After(time.Second):
+		t.Error("Expected the authorised hook to run")
+	}
+	if manager.token.get() != "access_1" {
+		t.Errorf("Expected the new access token to be used, got %s", manager.token.get())
+	}
+	if stored, _ := store.load(context.Background()); stored == nil || stored.RefreshToken != "refresh_1" {
+		t.Errorf("Expected the tokens to be saved, got %+v", stored)
+	}
+	if code := callback("state=" + state + "&code=code_1"); code != http.StatusBadRequest {
+		t.Errorf("Expected a state to be usable once, got %d", code)
+	}
+
+	if code := callback("state=" + start() + "&error=access_denied"); code != http.StatusBadRequest {
+		t.Errorf("Expected a denied authorisation to fail, got %d", code)
+	}
+	if code := callback("state=" + start() + "&code=code_2"); code != http.StatusBadGateway {
+		t.Errorf("Expected a rejected code to fail, got %d", code)
+	}
+
+	state = start()
+	now = now.Add(oauthStateTTL + time.Second)
+	if code := callback("state=" + state + "&code=code_1"); code != http.StatusBadRequest {
+		t.Errorf("Expected an expired state to be rejected, got %d", code)
+	}
+}
+
+func TestOAuthFlowForAccount(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"access_bob","refresh_token":"refresh_bob","expires_in":21600,"user_id":"user_2"}`))
+	}))
+	defer server.Close()
+
+	original := monzoOAuth
+	defer func() { monzoOAuth = original }()
+	dir := t.TempDir()
+	shared := newTokenManager(MonzoTokenConfig{Store: "file"}, fileTokenStore{path: filepath.Join(dir, "tokens.json")}, server.URL, "oauth2client_1", "secret", time.Now)
+	account := newTokenManager(MonzoTokenConfig{Store: "file"}, fileTokenStore{path: filepath.Join(dir, "tokens.acc_2.json")}, server.URL, "oauth2client_1", "secret", time.Now)
+	account.account = "acc_2"
+	monzoOAuth = newOAuthFlow(shared, "https://auth.example.com/", "https://webhooks.example.com/auth/callback", func() time.Time { return now })
+	monzoOAuth.accounts = map[string]*tokenManager{"acc_2": account}
+	authorised := make(chan string, 1)
+	monzoOAuth.authorised = func(ctx context.Context, account string) { authorised <- account }
+
+	w := httptest.NewRecorder()
+	authStartHandler(w, httptest.NewRequest(http.MethodGet, "/auth/start?account=acc_1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an account without its own tokens to be rejected, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	authStartHandler(w, httptest.NewRequest(http.MethodGet, "/auth/start?account=acc_2", nil))
+	location, _ := url.Parse(w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	authCallbackHandler(w, httptest.NewRequest(http.MethodGet, "/auth/callback?code=code_1&state="+location.Query().Get("state"), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the callback to succeed, got %d", w.Code)
+	}
+	select {
+	case got := <-authorised:
+		if got != "acc_2" {
+			t.Errorf("Expected the authorised hook to run for acc_2, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the authorised hook to run")
+	}
+	if account.token.get() != "access_bob" || shared.token.get() != "" {
+		t.Errorf("Expected only acc_2's token to be replaced, got %q and shared %q", account.token.get(), shared.token.get())
+	}
+}
+
+func TestBrowserAdminAuthMiddleware(t *testing.T) {
+	origToken := adminToken
+	defer func() { adminToken = origToken }()
+	adminToken = "admin-secret"
+
+	handler := browserAdminAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name      string
+		configure func(r *http.Request)
+		expect    int
+	}{
+		{name: "No credentials", configure: func(r *http.Request) {}, expect: http.StatusUnauthorized},
+		{name: "Basic", configure: func(r *http.Request) { r.SetBasicAuth("admin", "admin-secret") }, expect: http.StatusOK},
+		{name: "Wrong basic password", configure: func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, expect: http.StatusUnauthorized},
+		{name: "Bearer", configure: func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-secret") }, expect: http.StatusOK},
+		{name: "Wrong bearer", configure: func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, expect: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/auth/start", nil)
+			tt.configure(r)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.expect {
+				t.Errorf("Expected status %d, got %d", tt.expect, w.Code)
+			}
+		})
+	}
+}
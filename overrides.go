@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on how long a runtime override lasts. Every override expires, so a
+// change made during an incident can't be forgotten.
+const (
+	defaultOverrideTTL = time.Hour
+	maxOverrideTTL     = 24 * time.Hour
+)
+
+// Names of the settings that can be overridden at runtime. A sink is muted
+// with sinks.<name>.muted.
+const (
+	overrideLogLevel          = "log_level"
+	overrideAnomalyMultiplier = "anomalies.multiplier"
+	overrideMaxLag            = "stream.lag_alert.max_lag"
+	overrideMaxPending        = "stream.lag_alert.max_pending"
+)
+
+// runtimeOverride temporarily replaces a setting until it expires
+type runtimeOverride struct {
+	Name    string    `json:"name"`
+	Value   string    `json:"value"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	timer *time.Timer
+}
+
+// overrideStore holds the runtime overrides. They are kept in memory only, so
+// a restart reverts every setting to its configured value.
+type overrideStore struct {
+	now func() time.Time
+
+	mu        sync.RWMutex
+	overrides map[string]*runtimeOverride
+}
+
+var runtimeOverrides = newOverrideStore(clockNow)
+
+func newOverrideStore(now func() time.Time) *overrideStore {
+	return &overrideStore{now: now, overrides: make(map[string]*runtimeOverride)}
+}
+
+// sinkMutedOverride returns the override name that mutes a sink
+func sinkMutedOverride(sink string) string {
+	return "sinks." + sink + ".muted"
+}
+
+// validateOverride checks that a setting can be overridden with a value
+func validateOverride(name, value string) error {
+	switch name {
+	case overrideLogLevel:
+		switch strings.ToUpper(value) {
+		case "DEBUG", "INFO", "WARN", "ERROR":
+			return nil
+		}
+		return fmt.Errorf("log_level must be DEBUG, INFO, WARN or ERROR")
+	case overrideAnomalyMultiplier:
+		if f, err := strconv.ParseFloat(value, 64); err != nil || f <= 1 {
+			return fmt.Errorf("anomalies.multiplier must be a number greater than 1")
+		}
+		return nil
+	case overrideMaxLag, overrideMaxPending:
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		return nil
+	}
+	if sink, ok := strings.CutPrefix(name, "sinks."); ok && strings.HasSuffix(sink, ".muted") && sink != ".muted" {
+		sink = strings.TrimSuffix(sink, ".muted")
+		if !isSinkName(sink) {
+			return fmt.Errorf("unknown sink '%s'", sink)
+		}
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s must be true or false", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting '%s'", name)
+}
+
+// isSinkName reports whether a sink of the main flow or of a pipeline, such
+// as archive/file, has a name
+func isSinkName(name string) bool {
+	named := func(e sinkEntry) bool { return e.sink.Name() == name }
+	if slices.ContainsFunc(currentSinks(), named) {
+		return true
+	}
+	for _, p := range runningPipelines {
+		if slices.ContainsFunc(p.sinks, named) {
+			return true
+		}
+	}
+	return false
+}
+
+// set overrides a setting until the TTL elapses, replacing any earlier
+// override of it
+func (s *overrideStore) set(name, value string, ttl time.Duration) (runtimeOverride, error) {
+	if err := validateOverride(name, value); err != nil {
+		return runtimeOverride{}, err
+	}
+	if ttl <= 0 || ttl > maxOverrideTTL {
+		return runtimeOverride{}, fmt.Errorf("ttl must be positive and at most %s", maxOverrideTTL)
+	}
+
+	now := s.now()
+	override := &runtimeOverride{Name: name, Value: value, Created: now.UTC(), Expires: now.Add(ttl).UTC()}
+	override.timer = time.AfterFunc(ttl, func() { s.expire(override) })
+
+	s.mu.Lock()
+	if existing, ok := s.overrides[name]; ok {
+		existing.timer.Stop()
+	}
+	s.overrides[name] = override
+	s.mu.Unlock()
+
+	logInfo("Runtime override set: %s=%s until %s", name, value, override.Expires.Format(time.RFC3339))
+	return *override, nil
+}
+
+// expire removes an override once its TTL has elapsed, unless it has since
+// been replaced
+func (s *overrideStore) expire(override *runtimeOverride) {
+	s.mu.Lock()
+	current, ok := s.overrides[override.Name]
+	if ok && current == override {
+		delete(s.overrides, override.Name)
+	}
+	s.mu.Unlock()
+
+	if ok && current == override {
+		logInfo("Runtime override expired: %s=%s", override.Name, override.Value)
+	}
+}
+
+// remove ends an override early, returning false if there was none
+func (s *overrideStore) remove(name string) bool {
+	s.mu.Lock()
+	override, ok := s.overrides[name]
+	if ok {
+		override.timer.Stop()
+		delete(s.overrides, name)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		logInfo("Runtime override removed: %s=%s", name, override.Value)
+	}
+	return ok
+}
+
+// get returns an override's value, if it is set and hasn't expired
+func (s *overrideStore) get(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	override, ok := s.overrides[name]
+	if !ok || !s.now().Before(override.Expires) {
+		return "", false
+	}
+	return override.Value, true
+}
+
+// float returns a numeric setting, or def if it isn't overridden
+func (s *overrideStore) float(name string, def float64) float64 {
+	if value, ok := s.get(name); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+// integer returns an integer setting, or def if it isn't overridden
+func (s *overrideStore) integer(name string, def int64) int64 {
+	if value, ok := s.get(name); ok {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// enabled returns whether a boolean setting is overridden to true
+func (s *overrideStore) enabled(name string) bool {
+	value, _ := s.get(name)
+	enabled, _ := strconv.ParseBool(value)
+	return enabled
+}
+
+// list returns the overrides that haven't expired, sorted by name
+func (s *overrideStore) list() []runtimeOverride {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.now()
+	overrides := []runtimeOverride{}
+	for _, override := range s.overrides {
+		if now.Before(override.Expires) {
+			overrides = append(overrides, *override)
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Name < overrides[j].Name })
+	return overrides
+}
+
+// logLevel returns the log level, taking a runtime override into account
+func logLevel() LogLevel {
+	if value, ok := runtimeOverrides.get(overrideLogLevel); ok {
+		return parseLogLevel(value)
+	}
+	return currentLogLevel
+}
+
+// adminOverridesHandler lists the runtime overrides
+func adminOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"overrides": runtimeOverrides.list(),
+	})
+}
+
+// adminOverrideHandler overrides a setting with PUT and ends the override
+// with DELETE. PUT takes a body like {"value": "DEBUG", "ttl": "30m"}; the
+// TTL defaults to an hour.
+func adminOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Value string `json:"value"`
+			TTL   string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		ttl, err := parsePositiveDuration(req.TTL, defaultOverrideTTL)
+		if err != nil {
+			http.Error(w, "Invalid ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		override, err := runtimeOverrides.set(name, req.Value, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, override)
+	case http.MethodDelete:
+		if !runtimeOverrides.remove(name) {
+			http.Error(w, "Override not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withSinks replaces the configured sinks with fakes of the given names for
+// the rest of the test
+func withSinks(t *testing.T, names ...string) {
+	t.Helper()
+	origSinks := sinks
+	t.Cleanup(func() { sinks = origSinks })
+	sinks = nil
+	for _, name := range names {
+		sinks = append(sinks, sinkEntry{sink: &fakeSink{name: name}})
+	}
+}
+
+func TestValidateOverride(t *testing.T) {
+	withSinks(t, "slack")
+	origPipelines := runningPipelines
+	t.Cleanup(func() { runningPipelines = origPipelines })
+	runningPipelines = []*pipeline{{sinks: []sinkEntry{{sink: &fakeSink{name: "archive/file"}}}}}
+	tests := []struct {
+		name        string
+		setting     string
+		value       string
+		expectError bool
+	}{
+		{name: "Log level", setting: "log_level", value: "debug"},
+		{name: "Invalid log level", setting: "log_level", value: "TRACE", expectError: true},
+		{name: "Anomaly multiplier", setting: "anomalies.multiplier", value: "5"},
+		{name: "Anomaly multiplier too low", setting: "anomalies.multiplier", value: "1", expectError: true},
+		{name: "Max lag", setting: "stream.lag_alert.max_lag", value: "5000"},
+		{name: "Negative max pending", setting: "stream.lag_alert.max_pending", value: "-1", expectError: true},
+		{name: "Mute sink", setting: "sinks.slack.muted", value: "true"},
+		{name: "Mute sink with invalid value", setting: "sinks.slack.muted", value: "yes please", expectError: true},
+		{name: "Mute without sink name", setting: "sinks..muted", value: "true", expectError: true},
+		{name: "Mute unknown sink", setting: "sinks.slak.muted", value: "true", expectError: true},
+		{name: "Mute pipeline sink", setting: "sinks.archive/file.muted", value: "true"},
+		{name: "Mute pipeline sink without its pipeline", setting: "sinks.file.muted", value: "true", expectError: true},
+		{name: "Unknown setting", setting: "channel", value: "other", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateOverride(tt.setting, tt.value)
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestOverrideStore(t *testing.T) {
+	withSinks(t, "slack", "archive")
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	s := newOverrideStore(func() time.Time { return now })
+
+	if _, err := s.set("log_level", "DEBUG", 48*time.Hour); err == nil {
+		t.Error("Expected an error for a TTL over the maximum")
+	}
+	if _, err := s.set("anomalies.multiplier", "5", 30*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := s.float("anomalies.multiplier", 3); got != 5 {
+		t.Errorf("Expected the overridden multiplier, got %g", got)
+	}
+	if got := s.integer("stream.lag_alert.max_lag", 100); got != 100 {
+		t.Errorf("Expected the configured max lag, got %d", got)
+	}
+
+	// Replacing an override restarts its TTL
+	now = now.Add(20 * time.Minute)
+	override, _ := s.set("anomalies.multiplier", "4", 30*time.Minute)
+	if !override.Expires.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("Unexpected expiry: %v", override.Expires)
+	}
+	now = now.Add(20 * time.Minute)
+	if got := s.float("anomalies.multiplier", 3); got != 4 {
+		t.Errorf("Expected the replaced multiplier, got %g", got)
+	}
+
+	// Expired overrides revert to the configured value
+	now = now.Add(time.Hour)
+	if got := s.float("anomalies.multiplier", 3); got != 3 {
+		t.Errorf("Expected the configured multiplier after expiry, got %g", got)
+	}
+	if len(s.list()) != 0 {
+		t.Errorf("Expected no overrides after expiry, got %+v", s.list())
+	}
+
+	s.set("sinks.slack.muted", "true", time.Hour)
+	if !s.enabled("sinks.slack.muted") || s.enabled("sinks.archive.muted") {
+		t.Error("Expected only the slack sink to be muted")
+	}
+	if !s.remove("sinks.slack.muted") || s.remove("sinks.slack.muted") {
+		t.Error("Expected the override to be removed once")
+	}
+}
+
+func TestOverrideStoreExpiryTimer(t *testing.T) {
+	s := newOverrideStore(time.Now)
+	s.set("log_level", "DEBUG", 10*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.RLock()
+		n := len(s.overrides)
+		s.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the override to be removed when it expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRuntimeOverridesApply(t *testing.T) {
+	origOverrides := runtimeOverrides
+	origLevel := currentLogLevel
+	defer func() {
+		runtimeOverrides = origOverrides
+		currentLogLevel = origLevel
+	}()
+	runtimeOverrides = newOverrideStore(time.Now)
+	currentLogLevel = INFO
+	withSinks(t, "slack")
+
+	runtimeOverrides.set("log_level", "DEBUG", time.Hour)
+	if logLevel() != DEBUG {
+		t.Errorf("Expected the overridden log level, got %v", logLevel())
+	}
+
+	// A muted sink is skipped without an error
+	sink := &fakeSink{name: "slack"}
+	runtimeOverrides.set("sinks.slack.muted", "true", time.Hour)
+	before := testutil.ToFloat64(sinkPublishTotal.WithLabelValues("slack", "muted"))
+	if err := publishToSink(context.Background(), sink, &webhookEvent{ID: "evt", Type: "transaction.created"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sink.count() != 0 || testutil.ToFloat64(sinkPublishTotal.WithLabelValues("slack", "muted")) != before+1 {
+		t.Errorf("Expected the muted sink to be skipped, got %d events", sink.count())
+	}
+}
+
+func TestAdminOverrideHandler(t *testing.T) {
+	origOverrides := runtimeOverrides
+	defer func() { runtimeOverrides = origOverrides }()
+	runtimeOverrides = newOverrideStore(time.Now)
+
+	put := func(name, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/overrides/"+name, strings.NewReader(body))
+		req.SetPathValue("name", name)
+		rr := httptest.NewRecorder()
+		adminOverrideHandler(rr, req)
+		return rr
+	}
+
+	if rr := put("log_level", `{"value": "DEBUG", "ttl": "30m"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rr := put("log_level", `{"value": "TRACE"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid value, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := put("log_level", `{"value": "DEBUG", "ttl": "forever"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid TTL, got %d", http.StatusBadRequest, rr.Code)
+	}
+	withSinks(t, "slack")
+	if rr := put("sinks.slack.muted", `{"value": "true"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rr := put("sinks.slak.muted", `{"value": "true"}`); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "unknown sink 'slak'") {
+		t.Errorf("Expected status code %d for an unknown sink, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body)
+	}
+
+	rr := httptest.NewRecorder()
+	adminOverridesHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/overrides", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"name": "log_level"`) {
+		t.Errorf("Expected the override to be listed, got %d: %s", rr.Code, rr.Body)
+	}
+
+	for _, expected := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/overrides/log_level", nil)
+		req.SetPathValue("name", "log_level")
+		rr := httptest.NewRecorder()
+		adminOverrideHandler(rr, req)
+		if rr.Code != expected {
+			t.Errorf("Expected status code %d, got %d", expected, rr.Code)
+		}
+	}
+}
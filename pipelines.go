@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	pipelineEvents = metrics.newCounterVec("monzo_webhook_pipeline_events_total",
+		"Webhook events received by each pipeline, by result.", "pipeline", "result")
+	pipelineDuration = metrics.newHistogramVec("monzo_webhook_pipeline_duration_seconds",
+		"Time taken to respond to each pipeline's webhook events.", "pipeline")
+)
+
+// PipelineConfig is a flow of events independent of the main one, with its
+// own webhook path, filters, enrichments and sinks, such as a raw archive
+// alongside a trimmed notification flow
+type PipelineConfig struct {
+	Name string `json:"name"`
+	// Path is the webhook path the pipeline receives events on, under
+	// /webhook/
+	Path        string          `json:"path"`
+	EventTypes  EventTypeFilter `json:"event_types"`
+	PublishWhen []EventRule     `json:"publish_when"`
+	Rules       []CELRule       `json:"rules"`
+	// Enrich lists the enrichments applied to the pipeline's events, by
+	// name. Events aren't enriched when it's empty.
+	Enrich    []string        `json:"enrich"`
+	Transform []TransformRule `json:"transform"`
+	Sinks     []SinkConfig    `json:"sinks"`
+}
+
+var pipelineNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// processEnrichments are applied in order while an event is processed,
+// after receiveEnrichments. They may call other services.
+var processEnrichments = []struct {
+	name string
+	fn   func(ctx context.Context, event *webhookEvent)
+}{
+	{name: "merchant_details", fn: func(ctx context.Context, event *webhookEvent) {
+		enrichMerchant(ctx, monzoAPI, currentConfig().MonzoAPI.Enrichment, event)
+	}},
+	{name: "classifier", fn: func(ctx context.Context, event *webhookEvent) {
+		classifyEvent(ctx, transactionClassifier, event)
+	}},
+	{name: "attachments", fn: func(ctx context.Context, event *webhookEvent) {
+		attachmentArchive.archive(ctx, event)
+	}},
+}
+
+// validatePipelines checks the pipelines' names, paths and sections
+func validatePipelines(pipelines []PipelineConfig) error {
+	names := make(map[string]bool, len(pipelines))
+	paths := make(map[string]bool, len(pipelines))
+	for i, p := range pipelines {
+		if !pipelineNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("pipeline %d must have a name of lowercase letters, digits, - and _", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("pipeline '%s' is configured more than once", p.Name)
+		}
+		names[p.Name] = true
+		if !strings.HasPrefix(p.Path, "/webhook/") || p.Path == "/webhook/" || p.Path == "/webhook/test" {
+			return fmt.Errorf("pipeline '%s': path must be under /webhook/, such as /webhook/%s", p.Name, p.Name)
+		}
+		if paths[p.Path] {
+			return fmt.Errorf("pipeline '%s': path %s is used by another pipeline", p.Name, p.Path)
+		}
+		paths[p.Path] = true
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("pipeline '%s': %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p PipelineConfig) validate() error {
+	if len(p.Sinks) == 0 {
+		return fmt.Errorf("must have at least one sink")
+	}
+	sinkNames := make(map[string]bool, len(p.Sinks))
+	for _, spec := range p.Sinks {
+		name := spec.Name
+		if name == "" {
+			name = spec.Type
+		}
+		if sinkNames[name] {
+			return fmt.Errorf("sink '%s' is configured more than once; give the sinks names", name)
+		}
+		sinkNames[name] = true
+	}
+	for _, name := range p.Enrich {
+		if !isEnrichment(name) {
+			return fmt.Errorf("unknown enrichment '%s'", name)
+		}
+	}
+	for _, rule := range p.Rules {
+		if rule.Channel != "" {
+			return fmt.Errorf("rule '%s': rules can't route a pipeline's events; use a sink's when rules", rule.Name)
+		}
+	}
+	for _, err := range []error{
+		p.EventTypes.validate(),
+		validateEventRules("publish_when", p.PublishWhen),
+		validateCELRules(p.Rules),
+		validateTransformRules(p.Transform),
+		validateSinks(p.Sinks),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEnrichment reports whether an enrichment exists
+func isEnrichment(name string) bool {
+	for _, enrichment := range receiveEnrichments {
+		if enrichment.name == name {
+			return true
+		}
+	}
+	for _, enrichment := range processEnrichments {
+		if enrichment.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pipeline is a running pipeline, with its sinks
+type pipeline struct {
+	cfg    PipelineConfig
+	sinks  []sinkEntry
+	enrich map[string]bool
+}
+
+// runningPipelines are the pipelines started with the server
+var runningPipelines []*pipeline
+
+// newPipeline creates a pipeline's sinks. Sinks are named after the pipeline,
+// such as archive/file, so their metrics are kept apart from other flows'.
+// Redis sinks publish tenants' events to the tenant's channel, as the main
+// flow does.
+func newPipeline(cfg PipelineConfig, client *redis.Client) (*pipeline, error) {
+	p := &pipeline{cfg: cfg, enrich: make(map[string]bool, len(cfg.Enrich))}
+	for _, name := range cfg.Enrich {
+		p.enrich[name] = true
+	}
+	for _, spec := range cfg.Sinks {
+		if spec.Name == "" {
+			spec.Name = spec.Type
+		}
+		spec.Name = cfg.Name + "/" + spec.Name
+		sink, err := newConfiguredSink(spec, client)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline '%s': %s sink: %w", cfg.Name, spec.Type, err)
+		}
+		target := sink
+		if notify, ok := sink.(*notificationSink); ok {
+			target = notify.sink
+		}
+		if redisSink, ok := target.(*redisSink); ok {
+			redisSink.tenants = true
+		}
+		p.sinks = append(p.sinks, sinkEntry{sink: sink, required: spec.Required, when: spec.When, profile: spec.Profile, flag: spec.Flag, sample: spec.Sample})
+	}
+	return p, nil
+}
+
+// handler receives webhooks for the pipeline. Events are processed while the
+// request waits, within the request budget, and aren't deduplicated.
+func (p *pipeline) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defer r.Body.Close()
+	cfg := currentConfig()
+	name := p.cfg.Name
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyReadError(w, err)
+		return
+	}
+
+	// Account the event against the tenant's quota, as for the main webhook
+	tenant := tenantFromContext(r.Context())
+	if tenant != nil {
+		decision := enforceTenantQuota(r.Context(), tenant, len(body))
+		if !decision.allowed {
+			pipelineEvents.WithLabelValues(name, "rejected").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(decision.retryAfter.Seconds())+1))
+			http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	raw := body
+	body, encoding := utf8Body(r, raw)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		pipelineEvents.WithLabelValues(name, "rejected").Inc()
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	eventType, ok := payload["type"].(string)
+	if !ok || eventType == "" {
+		pipelineEvents.WithLabelValues(name, "rejected").Inc()
+		http.Error(w, "Missing event type", http.StatusBadRequest)
+		return
+	}
+	if err := validatePayload(body); err != nil {
+		if cfg.StrictDecoding {
+			logWarn("Pipeline '%s' rejecting %s event: %v", name, eventType, err)
+			pipelineEvents.WithLabelValues(name, "rejected").Inc()
+			http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		logWarn("Pipeline '%s' received %s event that doesn't match the expected payload: %v", name, eventType, err)
+	}
+
+	received := clock.Now()
+	event := &webhookEvent{
+		ID:        newEventID(received),
+		Type:      eventType,
+		AccountID: accountIDFromPayload(payload),
+		Body:      body,
+		Payload:   payload,
+		Tenant:    tenant,
+		Received:  received,
+		TraceID:   traceIDFromRequest(r),
+		Encoding:  encoding,
+	}
+	auth := authResult(tenant)
+	delivery := deliveryFromRequest(r, event, fmt.Sprintf("pipeline %s (%s)", name, auth))
+
+	// Store filtered events too, as the main webhook does
+	filters := EventConfig{EventTypes: p.cfg.EventTypes, PublishWhen: p.cfg.PublishWhen, Rules: p.cfg.Rules}
+	if section := filteredBy(filters, eventType, payload); section != "" {
+		logInfo("Pipeline '%s' dropping %s event: filtered by %s", name, eventType, section)
+		storedEvents.record(event, raw, delivery, section)
+		pipelineEvents.WithLabelValues(name, "filtered").Inc()
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Webhook ignored")); err != nil {
+			logError("Error writing response: %v", err)
+		}
+		return
+	}
+
+	logInfo("Pipeline '%s' received %s event %s", name, eventType, event.ID)
+	storedEvents.record(event, raw, delivery, "")
+	w.Header().Set("X-Event-ID", event.ID)
+	defer func() {
+		observeWithExemplar(pipelineDuration.WithLabelValues(name), clock.Now().Sub(received).Seconds(), eventExemplar(event))
+	}()
+
+	var rules []traceRule
+	celRules := matchingCELRules(p.cfg.Rules, payload)
+	for _, rule := range celRules {
+		rules = append(rules, traceRule{Kind: "rule", Rule: fmt.Sprintf("%s: %s", rule.Name, rule.When)})
+	}
+	eventTraces.start(event, delivery.Auth, rules)
+	original := event.Body
+	if applyCELRules(celRules, event) {
+		eventTraces.recordTransformation(event.ID, "rules", original, event.Body)
+	}
+
+	ctx, cancel := publishContext(r.Context(), cfg, received, clock.Now())
+	defer cancel()
+
+	for _, enrichment := range receiveEnrichments {
+		if p.enrich[enrichment.name] {
+			enrichment.apply(event)
+		}
+	}
+	for _, enrichment := range processEnrichments {
+		if p.enrich[enrichment.name] {
+			enrichment.fn(ctx, event)
+		}
+	}
+
+	if err := publishToSinks(ctx, p.sinks, p.cfg.Transform, event); err != nil {
+		logError("Pipeline '%s' failed to publish %s event %s: %v", name, eventType, event.ID, err)
+		pipelineEvents.WithLabelValues(name, "failed").Inc()
+		eventTraces.setOutcome(event.ID, "failed: "+err.Error())
+		http.Error(w, "Error publishing webhook", http.StatusServiceUnavailable)
+		return
+	}
+	pipelineEvents.WithLabelValues(name, "published").Inc()
+	eventTraces.setOutcome(event.ID, "published")
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("Webhook received")); err != nil {
+		logError("Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidatePipelines(t *testing.T) {
+	archive := PipelineConfig{Name: "archive", Path: "/webhook/archive", Sinks: []SinkConfig{{Type: "file", Path: "/tmp/archive.jsonl"}}}
+	with := func(change func(p *PipelineConfig)) []PipelineConfig {
+		p := archive
+		change(&p)
+		return []PipelineConfig{p}
+	}
+
+	tests := []struct {
+		name      string
+		pipelines []PipelineConfig
+		wantErr   bool
+	}{
+		{name: "No pipelines"},
+		{name: "Valid", pipelines: []PipelineConfig{archive, {
+			Name: "notify", Path: "/webhook/notify", Enrich: []string{"merchant_aliases", "classifier"},
+			EventTypes: EventTypeFilter{Allow: []string{"transaction.created"}},
+			Rules:      []CELRule{{Name: "big", When: "data.amount < -10000", Tags: []string{"big"}}},
+			Transform:  []TransformRule{{Fields: map[string]string{"id": "data.id"}}},
+			Sinks:      []SinkConfig{{Type: "redis", Channel: "monzo-notify"}},
+		}}},
+		{name: "Missing name", pipelines: with(func(p *PipelineConfig) { p.Name = "" }), wantErr: true},
+		{name: "Invalid name", pipelines: with(func(p *PipelineConfig) { p.Name = "Raw Archive" }), wantErr: true},
+		{name: "Duplicate name", pipelines: []PipelineConfig{archive, archive}, wantErr: true},
+		{name: "Duplicate path", pipelines: []PipelineConfig{archive, {Name: "copy", Path: "/webhook/archive", Sinks: archive.Sinks}}, wantErr: true},
+		{name: "Path outside /webhook/", pipelines: with(func(p *PipelineConfig) { p.Path = "/archive" }), wantErr: true},
+		{name: "Test path", pipelines: with(func(p *PipelineConfig) { p.Path = "/webhook/test" }), wantErr: true},
+		{name: "No sinks", pipelines: with(func(p *PipelineConfig) { p.Sinks = nil }), wantErr: true},
+		{name: "Duplicate sink names", pipelines: with(func(p *PipelineConfig) { p.Sinks = append(p.Sinks, p.Sinks[0]) }), wantErr: true},
+		{name: "Invalid sink", pipelines: with(func(p *PipelineConfig) { p.Sinks = []SinkConfig{{Type: "redis"}} }), wantErr: true},
+		{name: "Unknown enrichment", pipelines: with(func(p *PipelineConfig) { p.Enrich = []string{"horoscope"} }), wantErr: true},
+		{name: "Routing rule", pipelines: with(func(p *PipelineConfig) { p.Rules = []CELRule{{Name: "big", When: "true", Channel: "alerts"}} }), wantErr: true},
+		{name: "Invalid filter", pipelines: with(func(p *PipelineConfig) { p.EventTypes.Deny = []string{""} }), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePipelines(tt.pipelines); (err != nil) != tt.wantErr {
+				t.Errorf("validatePipelines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewPipelineNamesSinks(t *testing.T) {
+	p, err := newPipeline(PipelineConfig{Name: "archive", Path: "/webhook/archive", Sinks: []SinkConfig{
+		{Type: "file", Path: filepath.Join(t.TempDir(), "raw.jsonl")},
+		{Type: "file", Name: "chained", Path: filepath.Join(t.TempDir(), "chained.jsonl"), Chain: true},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"archive/file", "archive/chained"} {
+		if got := p.sinks[i].sink.Name(); got != expected {
+			t.Errorf("Expected sink %d to be named '%s', got '%s'", i, expected, got)
+		}
+		p.sinks[i].sink.(*fileSink).Close()
+	}
+
+	if _, err := newPipeline(PipelineConfig{Name: "notify", Sinks: []SinkConfig{{Type: "redis", Channel: "monzo"}}}, nil); err == nil {
+		t.Error("Expected an error for a Redis sink without a Redis connection")
+	}
+}
+
+func TestPipelineHandler(t *testing.T) {
+	origConfig, origAliases := eventConfig, merchantAliases
+	defer func() { eventConfig, merchantAliases = origConfig, origAliases }()
+	eventConfig = EventConfig{EventTypes: EventTypeFilter{Deny: []string{"transaction.*"}}}
+	merchantAliases = newMerchantAliasTable([]MerchantAlias{{Pattern: "PRET A MANGER*", Alias: "Pret"}}, nil)
+
+	archiveSink := &fakeSink{name: "archive/file"}
+	archive := &pipeline{cfg: PipelineConfig{Name: "archive"}, sinks: []sinkEntry{{sink: archiveSink, required: true}}}
+	notifySink := &fakeSink{name: "notify/redis"}
+	notify := &pipeline{
+		cfg: PipelineConfig{
+			Name:       "notify",
+			EventTypes: EventTypeFilter{Allow: []string{"transaction.created"}},
+			Rules:      []CELRule{{Name: "big", When: "data.amount < -10000", Tags: []string{"big"}}},
+			Enrich:     []string{"merchant_aliases"},
+			Transform:  []TransformRule{{Fields: map[string]string{"id": "data.id", "merchant": "data.description", "tags": "tags"}}},
+		},
+		sinks:  []sinkEntry{{sink: notifySink, required: true}},
+		enrich: map[string]bool{"merchant_aliases": true},
+	}
+
+	created := `{"type":"transaction.created","data":{"id":"tx_1","amount":-12500,"description":"PRET A MANGER 123"}}`
+	tests := []struct {
+		name      string
+		pipeline  *pipeline
+		body      string
+		status    int
+		published string
+	}{
+		{name: "Archived unchanged despite the main filters", pipeline: archive, body: created, status: http.StatusOK, published: created},
+		{name: "Enriched, tagged and trimmed", pipeline: notify, body: created, status: http.StatusOK, published: `{"id":"tx_1","merchant":"Pret","tags":["big"]}`},
+		{name: "Filtered by type", pipeline: notify, body: `{"type":"transaction.updated","data":{"id":"tx_1","amount":-12500}}`, status: http.StatusOK},
+		{name: "Invalid JSON", pipeline: notify, body: `{`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := tt.pipeline.sinks[0].sink.(*fakeSink)
+			before := sink.count()
+			rr := httptest.NewRecorder()
+			tt.pipeline.handler(rr, httptest.NewRequest(http.MethodPost, "/webhook/"+tt.pipeline.cfg.Name, bytes.NewBufferString(tt.body)))
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+			if tt.published == "" {
+				if sink.count() != before {
+					t.Errorf("Expected the event not to be published")
+				}
+				return
+			}
+			if sink.count() != before+1 {
+				t.Fatalf("Expected the event to be published")
+			}
+			if got := string(sink.events[before].Body); got != tt.published {
+				t.Errorf("Expected %s, got %s", tt.published, got)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(pipelineEvents.WithLabelValues("notify", "filtered")); got != 1 {
+		t.Errorf("Expected 1 filtered event for the notify pipeline, got %v", got)
+	}
+	if got := testutil.ToFloat64(pipelineEvents.WithLabelValues("archive", "published")); got != 1 {
+		t.Errorf("Expected 1 published event for the archive pipeline, got %v", got)
+	}
+
+	// A failing required sink is reported so the sender retries
+	archiveSink.err = errors.New("unavailable")
+	rr := httptest.NewRecorder()
+	archive.handler(rr, httptest.NewRequest(http.MethodPost, "/webhook/archive", bytes.NewBufferString(created)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when a required sink fails, got %d", rr.Code)
+	}
+}
+
+func TestPipelineHandlerWithTenants(t *testing.T) {
+	origUsage, origStore := tenantUsage, storedEvents
+	defer func() { tenantUsage, storedEvents = origUsage, origStore }()
+	tenantUsage = newUsageTracker(time.Now)
+	storedEvents = newReplayStore(t)
+
+	tenant := &TenantConfig{Name: "alice", Quota: QuotaConfig{MaxEvents: 2}}
+	sink := &fakeSink{name: "notify/redis"}
+	notify := &pipeline{
+		cfg:   PipelineConfig{Name: "notify", EventTypes: EventTypeFilter{Allow: []string{"transaction.created"}}},
+		sinks: []sinkEntry{{sink: sink, required: true}},
+	}
+
+	for i, tt := range []struct {
+		eventType string
+		status    int
+	}{
+		{eventType: "transaction.created", status: http.StatusOK},
+		{eventType: "account.balance_updated", status: http.StatusOK},
+		{eventType: "transaction.created", status: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook/notify", bytes.NewBufferString(`{"type":"`+tt.eventType+`","data":{}}`))
+		rr := httptest.NewRecorder()
+		notify.handler(rr, req.WithContext(withTenant(req.Context(), tenant)))
+		if rr.Code != tt.status {
+			t.Fatalf("Request %d: expected status %d, got %d", i+1, tt.status, rr.Code)
+		}
+	}
+	if sink.count() != 1 {
+		t.Errorf("Expected only the event within the quota to be published, got %d", sink.count())
+	}
+
+	// Published and filtered events are stored with the tenant and pipeline
+	stored, _, err := storedEvents.queryEvents(context.Background(), eventQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("Expected 2 stored events, got %d", len(stored))
+	}
+	for i, filteredBy := range []string{"", "event_types"} {
+		if stored[i].FilteredBy != filteredBy || stored[i].Delivery.Tenant != "alice" || stored[i].Delivery.Auth != "pipeline notify (tenant alice)" {
+			t.Errorf("Unexpected stored event %+v", stored[i])
+		}
+	}
+}
+
+func TestNewPipelineRoutesTenants(t *testing.T) {
+	fake, client := newFakeRedis(t)
+	p, err := newPipeline(PipelineConfig{Name: "notify", Sinks: []SinkConfig{
+		{Type: "redis", Channel: "monzo-notify"},
+		{Type: "redis", Name: "alerts", Channel: "monzo-alerts", Notify: true},
+	}}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tenant *TenantConfig
+		expect []string
+	}{
+		{name: "Tenant", tenant: &TenantConfig{Name: "alice", Channel: "monzo-alice"}, expect: []string{"monzo-alice", "monzo-alice"}},
+		{name: "Tenant without a channel", tenant: &TenantConfig{Name: "bob"}, expect: []string{"monzo-notify", "monzo-alerts"}},
+		{name: "No tenant", expect: []string{"monzo-notify", "monzo-alerts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &webhookEvent{ID: tt.name, Type: "transaction.created", Tenant: tt.tenant, Body: []byte(tt.name)}
+			for i, entry := range p.sinks {
+				if err := entry.sink.Publish(context.Background(), event); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				fake.mu.Lock()
+				messages := fake.published[tt.expect[i]]
+				fake.mu.Unlock()
+				if len(messages) == 0 || messages[len(messages)-1] != tt.name {
+					t.Errorf("Expected sink %s to publish on %s", entry.sink.Name(), tt.expect[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresTablePattern is what the events table may be called, so that it
+// can be used in statements without quoting
+var postgresTablePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// defaultPostgresTable is the table a postgres sink inserts into when it has
+// no table of its own
+const defaultPostgresTable = "monzo_events"
+
+var postgresConnections = metrics.newGaugeVec("monzo_webhook_postgres_connections",
+	"Open connections to PostgreSQL, by table and state (idle, in_use).", "table", "state")
+
+// postgresMigrations create and evolve the events table. They are applied in
+// order, each once, and recorded in the migrations table. %[1]s is the table.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s (
+  id TEXT PRIMARY KEY,
+  type TEXT NOT NULL,
+  account_id TEXT,
+  transaction_id TEXT,
+  amount BIGINT,
+  currency TEXT,
+  created TIMESTAMPTZ,
+  received_at TIMESTAMPTZ NOT NULL,
+  payload JSONB NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS %[1]s_created_idx ON %[1]s (created)`,
+	`CREATE INDEX IF NOT EXISTS %[1]s_account_id_created_idx ON %[1]s (account_id, created)`,
+	`CREATE INDEX IF NOT EXISTS %[1]s_type_idx ON %[1]s (type)`,
+}
+
+// PostgresConfig holds the connection pool settings for PostgreSQL, and the
+// table a writer inserts into
+type PostgresConfig struct {
+	Pool  *pgxpool.Config
+	Table string
+}
+
+// postgresConfigFromEnv builds a PostgresConfig from environment variables.
+// It returns nil if POSTGRES_URL is not set.
+func postgresConfigFromEnv() (*PostgresConfig, error) {
+	rawURL, err := getenvSecret("POSTGRES_URL")
+	if err != nil || rawURL == "" {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return nil, errors.New("POSTGRES_URL must be a postgres:// URL")
+	}
+	if u.User.Username() == "" {
+		return nil, errors.New("POSTGRES_URL must include a user")
+	}
+
+	// The parse error has the password redacted
+	pool, err := pgxpool.ParseConfig(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid POSTGRES_URL: %w", err)
+	}
+	if pool.ConnConfig.Database == "" {
+		pool.ConnConfig.Database = pool.ConnConfig.User
+	}
+	pool.MaxConns = 4
+	if value := os.Getenv("POSTGRES_MAX_CONNS"); value != "" {
+		maxConns, err := strconv.Atoi(value)
+		if err != nil || maxConns <= 0 {
+			return nil, fmt.Errorf("invalid POSTGRES_MAX_CONNS '%s', must be a positive integer", value)
+		}
+		pool.MaxConns = int32(maxConns)
+	}
+	return &PostgresConfig{Pool: pool}, nil
+}
+
+// postgresWriters are the writers for each table, shared by the sinks that
+// insert into it so that its connections are kept when the config is
+// reloaded
+var (
+	postgresWritersMu sync.Mutex
+	postgresWriters   = make(map[string]*PostgresWriter)
+)
+
+// sharedPostgresWriter returns the writer for a table in the database in
+// POSTGRES_URL, creating it and migrating the table the first time, if the
+// database is reachable
+func sharedPostgresWriter(table string) (*PostgresWriter, error) {
+	postgresWritersMu.Lock()
+	defer postgresWritersMu.Unlock()
+	if writer, ok := postgresWriters[table]; ok {
+		return writer, nil
+	}
+
+	cfg, err := postgresConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("POSTGRES_URL must be set to insert into PostgreSQL")
+	}
+	cfg.Table = table
+	writer, err := NewPostgresWriter(*cfg)
+	if err != nil {
+		return nil, err
+	}
+	migrateCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := writer.Migrate(migrateCtx); err != nil {
+		logWarn("Error migrating PostgreSQL table %s, will retry before the first insert: %v", table, err)
+	}
+	conn := cfg.Pool.ConnConfig
+	logInfo("PostgreSQL publishing enabled: addr=%s database=%s table=%s",
+		net.JoinHostPort(conn.Host, strconv.Itoa(int(conn.Port))), conn.Database, table)
+	postgresWriters[table] = writer
+	return writer, nil
+}
+
+// validatePostgresSink checks that a postgres sink's table can be used in
+// statements without quoting
+func validatePostgresSink(cfg SinkConfig) error {
+	if cfg.Table != "" && !postgresTablePattern.MatchString(cfg.Table) {
+		return fmt.Errorf("invalid table '%s', must be lowercase letters, digits and '_'", cfg.Table)
+	}
+	return nil
+}
+
+// newPostgresSink creates a sink inserting into its table, monzo_events
+// unless it names another
+func newPostgresSink(name string, cfg SinkConfig, writer func(table string) (*PostgresWriter, error)) (*postgresSink, error) {
+	table := cfg.Table
+	if table == "" {
+		table = defaultPostgresTable
+	}
+	w, err := writer(table)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresSink{name: name, writer: w}, nil
+}
+
+// PostgresWriter inserts events into a PostgreSQL table, over a pgx pool of
+// up to MaxConns connections. The table is created, and later migrated, by
+// the first writer to connect.
+type PostgresWriter struct {
+	pool  *pgxpool.Pool
+	table string
+
+	mu       sync.Mutex
+	migrated bool
+}
+
+// NewPostgresWriter creates a writer for the given configuration.
+// Connections are established lazily.
+func NewPostgresWriter(cfg PostgresConfig) (*PostgresWriter, error) {
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg.Pool)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresWriter{pool: pool, table: cfg.Table}, nil
+}
+
+func (w *PostgresWriter) recordConnections() {
+	stat := w.pool.Stat()
+	postgresConnections.WithLabelValues(w.table, "idle").Set(float64(stat.IdleConns()))
+	postgresConnections.WithLabelValues(w.table, "in_use").Set(float64(stat.AcquiredConns()))
+}
+
+// Migrate applies the migrations that haven't been applied yet, holding an
+// advisory lock so that instances starting together don't race
+func (w *PostgresWriter) Migrate(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.migrated {
+		return nil
+	}
+
+	conn, err := w.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer w.recordConnections()
+	defer conn.Release()
+
+	lock := fnv.New64a()
+	lock.Write([]byte("monzo-webhook:" + w.table))
+	key := strconv.FormatInt(int64(lock.Sum64()), 10)
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock("+key+")"); err != nil {
+		return err
+	}
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock("+key+")")
+
+	migrations := w.table + "_migrations"
+	if _, err := conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+migrations+
+		" (version INTEGER PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())"); err != nil {
+		return err
+	}
+	var applied int
+	if err := conn.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM "+migrations).Scan(&applied); err != nil {
+		return err
+	}
+
+	for version := applied + 1; version <= len(postgresMigrations); version++ {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, fmt.Sprintf(postgresMigrations[version-1], w.table)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (version) VALUES (%d)", migrations, version))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		logInfo("Applied PostgreSQL migration %d to table %s", version, w.table)
+	}
+	w.migrated = true
+	return nil
+}
+
+// Connect migrates the table and checks a connection, so that the first
+// insert doesn't have to open one
+func (w *PostgresWriter) Connect(ctx context.Context) error {
+	if err := w.Migrate(ctx); err != nil {
+		return err
+	}
+	defer w.recordConnections()
+	return w.pool.Ping(ctx)
+}
+
+// Insert writes an event, with the columns queried most often extracted from
+// its payload. Events already inserted, such as redeliveries, are skipped.
+// Values are sent as text, which the server converts to the columns' types.
+func (w *PostgresWriter) Insert(ctx context.Context, event *webhookEvent) error {
+	if err := w.Migrate(ctx); err != nil {
+		return fmt.Errorf("migrating table %s: %w", w.table, err)
+	}
+	defer w.recordConnections()
+
+	text := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return &s
+	}
+	data, _ := event.Payload["data"].(map[string]interface{})
+	var transactionID, amount, currency, created *string
+	if strings.HasPrefix(event.Type, "transaction.") {
+		id, _ := data["id"].(string)
+		transactionID = text(id)
+	}
+	if value, ok := data["amount"].(float64); ok {
+		amount = text(strconv.FormatInt(int64(value), 10))
+	}
+	if value, ok := data["currency"].(string); ok {
+		currency = text(value)
+	}
+	if value, ok := data["created"].(string); ok {
+		if _, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			created = text(value)
+		}
+	}
+	received := event.Received.UTC().Format(time.RFC3339Nano)
+
+	_, err := w.pool.Exec(ctx, "INSERT INTO "+w.table+
+		" (id, type, account_id, transaction_id, amount, currency, created, received_at, payload)"+
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (id) DO NOTHING",
+		text(event.ID), text(event.Type), text(event.AccountID), transactionID, amount, currency, created, received, string(event.Body))
+	return err
+}
+
+// queryEvents reads the inserted events matching a query, in the
+// order they were received. The cursor is the last event's received time, in
+// microseconds since the epoch, and its ID.
+func (w *PostgresWriter) queryEvents(ctx context.Context, query eventQuery) ([]storedEvent, string, error) {
+	var conditions []string
+	var args []any
+	param := func(value string) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "received_at >= "+param(query.From.UTC().Format(time.RFC3339Nano)))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "received_at < "+param(query.To.UTC().Format(time.RFC3339Nano)))
+	}
+	if query.After != "" {
+		micros, id, ok := strings.Cut(query.After, ":")
+		if _, err := strconv.ParseInt(micros, 10, 64); !ok || err != nil {
+			return nil, "", errInvalidEventCursor
+		}
+		conditions = append(conditions, fmt.Sprintf(
+			"(received_at, id) > (timestamptz 'epoch' + %s::bigint * interval '1 microsecond', %s)", param(micros), param(id)))
+	}
+	if query.AccountID != "" {
+		conditions = append(conditions, "account_id = "+param(query.AccountID))
+	}
+	if query.MinAmount != nil {
+		conditions = append(conditions, "amount >= "+param(strconv.FormatInt(*query.MinAmount, 10)))
+	}
+	if query.MaxAmount != nil {
+		conditions = append(conditions, "amount <= "+param(strconv.FormatInt(*query.MaxAmount, 10)))
+	}
+	if len(query.Types) > 0 {
+		var types []string
+		for _, eventType := range query.Types {
+			if prefix, ok := strings.CutSuffix(eventType, "*"); ok {
+				types = append(types, "starts_with(type, "+param(prefix)+")")
+			} else {
+				types = append(types, "type = "+param(eventType))
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(types, " OR ")+")")
+	}
+
+	sql := "SELECT id, type, coalesce(account_id, ''), (extract(epoch FROM received_at) * 1000000)::bigint, payload FROM " + w.table
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY received_at, id LIMIT " + strconv.Itoa(query.Limit+1)
+
+	if err := w.Migrate(ctx); err != nil {
+		return nil, "", fmt.Errorf("migrating table %s: %w", w.table, err)
+	}
+	defer w.recordConnections()
+	rows, err := w.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var events []storedEvent
+	var next string
+	for rows.Next() {
+		if len(events) == query.Limit {
+			last := events[len(events)-1]
+			next = strconv.FormatInt(last.ReceivedAt.UnixMicro(), 10) + ":" + last.ID
+			break
+		}
+		var event storedEvent
+		var micros int64
+		if err := rows.Scan(&event.ID, &event.Type, &event.AccountID, &micros, &event.Body); err != nil {
+			return nil, "", err
+		}
+		event.ReceivedAt = time.UnixMicro(micros).UTC()
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return events, next, nil
+}
+
+// Close closes the pool's connections
+func (w *PostgresWriter) Close() error {
+	w.pool.Close()
+	w.recordConnections()
+	return nil
+}
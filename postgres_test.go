@@ -0,0 +1,717 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPostgresConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		expectNil    bool
+		expectError  bool
+		expectAddr   string
+		expectDB     string
+		expectSSL    string
+		expectVerify bool
+	}{
+		{
+			name:      "PostgreSQL not configured",
+			env:       map[string]string{},
+			expectNil: true,
+		},
+		{
+			name:       "Defaults",
+			env:        map[string]string{"POSTGRES_URL": "postgres://monzo:secret@db/events"},
+			expectAddr: "db:5432",
+			expectDB:   "events",
+			expectSSL:  "prefer",
+		},
+		{
+			name:         "Database defaults to the user",
+			env:          map[string]string{"POSTGRES_URL": "postgresql://monzo@db:6432?sslmode=verify-full"},
+			expectAddr:   "db:6432",
+			expectDB:     "monzo",
+			expectSSL:    "verify-full",
+			expectVerify: true,
+		},
+		{
+			name:        "Wrong scheme",
+			env:         map[string]string{"POSTGRES_URL": "mysql://monzo@db/events"},
+			expectError: true,
+		},
+		{
+			name:        "Missing user",
+			env:         map[string]string{"POSTGRES_URL": "postgres://db/events"},
+			expectError: true,
+		},
+		{
+			name:        "Unsupported sslmode",
+			env:         map[string]string{"POSTGRES_URL": "postgres://monzo:secret@db/events?sslmode=always"},
+			expectError: true,
+		},
+		{
+			name:        "Invalid max connections",
+			env:         map[string]string{"POSTGRES_URL": "postgres://monzo@db/events", "POSTGRES_MAX_CONNS": "0"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"POSTGRES_URL", "POSTGRES_URL_FILE", "POSTGRES_MAX_CONNS"} {
+				t.Setenv(name, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := postgresConfigFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expectNil {
+				if cfg != nil {
+					t.Errorf("Expected nil config, got %+v", cfg)
+				}
+				return
+			}
+			conn := cfg.Pool.ConnConfig
+			if addr := net.JoinHostPort(conn.Host, strconv.Itoa(int(conn.Port))); addr != tt.expectAddr || conn.Database != tt.expectDB {
+				t.Errorf("Unexpected address %s and database %s", addr, conn.Database)
+			}
+			if cfg.Pool.MaxConns != 4 {
+				t.Errorf("Expected 4 connections by default, got %d", cfg.Pool.MaxConns)
+			}
+			if conn.TLSConfig == nil || conn.TLSConfig.InsecureSkipVerify == tt.expectVerify {
+				t.Errorf("Expected certificate verification %v", tt.expectVerify)
+			}
+			if tt.expectSSL == "prefer" && len(conn.Fallbacks) != 1 {
+				t.Errorf("Expected a fallback without TLS, got %d", len(conn.Fallbacks))
+			}
+		})
+	}
+}
+
+func TestPostgresSinkConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SinkConfig
+		table   string
+		wantErr bool
+	}{
+		{name: "Default table", cfg: SinkConfig{Type: "postgres"}, table: "monzo_events"},
+		{name: "Table", cfg: SinkConfig{Type: "postgres", Table: "webhooks"}, table: "webhooks"},
+		{name: "Table needing quotes", cfg: SinkConfig{Type: "postgres", Table: "Events; DROP"}, wantErr: true},
+		{name: "Chained", cfg: SinkConfig{Type: "postgres", Chain: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSinks([]SinkConfig{tt.cfg})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			var table string
+			sink, err := newPostgresSink("events", tt.cfg, func(name string) (*PostgresWriter, error) {
+				table = name
+				pool, _ := pgxpool.ParseConfig("postgres://monzo@localhost/monzo")
+				return NewPostgresWriter(PostgresConfig{Pool: pool, Table: name})
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sink.Name() != "events" || table != tt.table {
+				t.Errorf("Expected sink 'events' for table %s, got '%s' for %s", tt.table, sink.Name(), table)
+			}
+		})
+	}
+}
+
+func TestSharedPostgresWriter(t *testing.T) {
+	t.Setenv("POSTGRES_URL", "")
+	t.Setenv("POSTGRES_URL_FILE", "")
+	if _, err := sharedPostgresWriter("monzo_events"); err == nil {
+		t.Fatal("Expected an error without POSTGRES_URL")
+	}
+
+	server := newFakePostgres(t, "md5")
+	t.Setenv("POSTGRES_URL", "postgres://monzo:secret@"+server.listener.Addr().String()+"/monzo?sslmode=disable")
+	t.Cleanup(func() {
+		postgresWritersMu.Lock()
+		defer postgresWritersMu.Unlock()
+		delete(postgresWriters, "shared_events")
+	})
+	writer, err := sharedPostgresWriter("shared_events")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer writer.Close()
+	if again, _ := sharedPostgresWriter("shared_events"); again != writer {
+		t.Error("Expected sinks for the same table to share a writer")
+	}
+	if writer.table != "shared_events" || !writer.migrated {
+		t.Errorf("Expected table shared_events to be migrated, got %s", writer.table)
+	}
+}
+
+// fakePostgres is a PostgreSQL server that authenticates with the given
+// method, records the statements it's sent and answers the migration version
+// query with version
+type fakePostgres struct {
+	listener net.Listener
+	auth     string
+	password string
+	version  int
+	// failInserts makes inserts into the events table fail
+	failInserts bool
+	// rows are returned for parameterised SELECT statements
+	rows [][]string
+
+	mu          sync.Mutex
+	connections int
+	statements  []string
+	inserts     [][]*string
+}
+
+func newFakePostgres(t *testing.T, auth string) *fakePostgres {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &fakePostgres{listener: listener, auth: auth, password: "secret"}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakePostgres) config(t *testing.T) PostgresConfig {
+	pool, err := pgxpool.ParseConfig("postgres://monzo:secret@" + s.listener.Addr().String() + "/monzo?sslmode=disable")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool.MaxConns = 2
+	return PostgresConfig{Pool: pool, Table: "monzo_events"}
+}
+
+func (s *fakePostgres) writer(t *testing.T, cfg PostgresConfig) *PostgresWriter {
+	writer, err := NewPostgresWriter(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { writer.Close() })
+	return writer
+}
+
+func (s *fakePostgres) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// columns describes the result columns of a statement: the migration
+// version, the events selected by queryEvents, or none
+func (s *fakePostgres) columns(sql string) []pgproto3.FieldDescription {
+	column := func(name string, oid uint32) pgproto3.FieldDescription {
+		return pgproto3.FieldDescription{Name: []byte(name), DataTypeOID: oid, DataTypeSize: -1, TypeModifier: -1}
+	}
+	switch {
+	case strings.Contains(sql, "max(version)"):
+		return []pgproto3.FieldDescription{column("coalesce", pgtype.Int4OID)}
+	case strings.HasPrefix(sql, "SELECT id"):
+		return []pgproto3.FieldDescription{column("id", pgtype.TextOID), column("type", pgtype.TextOID),
+			column("account_id", pgtype.TextOID), column("received", pgtype.Int8OID), column("payload", pgtype.TextOID)}
+	}
+	return nil
+}
+
+// result returns the rows a statement selects
+func (s *fakePostgres) result(sql string) [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.Contains(sql, "max(version)") {
+		return [][]string{{strconv.Itoa(s.version)}}
+	}
+	return s.rows
+}
+
+// dataRow encodes a row's values, as text or in binary as the client asked
+func (s *fakePostgres) dataRow(columns []pgproto3.FieldDescription, formats []int16, row []string) *pgproto3.DataRow {
+	values := make([][]byte, len(row))
+	for i, value := range row {
+		values[i] = []byte(value)
+		if resultFormat(formats, i) == pgtype.BinaryFormatCode {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			switch columns[i].DataTypeOID {
+			case pgtype.Int4OID:
+				values[i] = binary.BigEndian.AppendUint32(nil, uint32(n))
+			case pgtype.Int8OID:
+				values[i] = binary.BigEndian.AppendUint64(nil, uint64(n))
+			}
+		}
+	}
+	return &pgproto3.DataRow{Values: values}
+}
+
+// resultFormat returns the format a result column was bound with
+func resultFormat(formats []int16, i int) int16 {
+	switch {
+	case len(formats) == 1:
+		return formats[0]
+	case len(formats) > i:
+		return formats[i]
+	}
+	return pgtype.TextFormatCode
+}
+
+func (s *fakePostgres) handle(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+
+	startup, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if _, ok := startup.(*pgproto3.SSLRequest); ok {
+		conn.Write([]byte{'N'})
+		if startup, err = backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+	}
+	if _, ok := startup.(*pgproto3.StartupMessage); !ok {
+		return
+	}
+	if !s.authenticate(backend) {
+		backend.Flush()
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "16.0"})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	backend.Flush()
+
+	prepared := make(map[string]string)
+	var sql string
+	var bound []*string
+	var formats []int16
+	var failed bool
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			// Pings are empty statements
+			if !strings.HasPrefix(msg.String, "--") && msg.String != ";" {
+				s.mu.Lock()
+				s.statements = append(s.statements, msg.String)
+				s.mu.Unlock()
+			}
+			if columns := s.columns(msg.String); columns != nil {
+				backend.Send(&pgproto3.RowDescription{Fields: columns})
+				for _, row := range s.result(msg.String) {
+					backend.Send(s.dataRow(columns, nil, row))
+				}
+			}
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("OK")})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.Parse:
+			prepared[msg.Name] = msg.Query
+			backend.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Describe:
+			query := prepared[msg.Name]
+			if msg.ObjectType == 'P' {
+				query = sql
+			} else {
+				// Parameters are described as text, which pgx sends strings as
+				oids := make([]uint32, strings.Count(query, "$"))
+				for i := range oids {
+					oids[i] = pgtype.TextOID
+				}
+				backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: oids})
+			}
+			if columns := s.columns(query); columns != nil {
+				// A portal's columns are in the formats they were bound with
+				if msg.ObjectType == 'P' {
+					for i := range columns {
+						columns[i].Format = resultFormat(formats, i)
+					}
+				}
+				backend.Send(&pgproto3.RowDescription{Fields: columns})
+			} else {
+				backend.Send(&pgproto3.NoData{})
+			}
+		case *pgproto3.Bind:
+			sql = prepared[msg.PreparedStatement]
+			bound = make([]*string, len(msg.Parameters))
+			for i, value := range msg.Parameters {
+				if value != nil {
+					text := string(value)
+					bound[i] = &text
+				}
+			}
+			formats = append([]int16(nil), msg.ResultFormatCodes...)
+			backend.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Execute:
+			if failed {
+				continue
+			}
+			if s.failInserts && strings.HasPrefix(sql, "INSERT INTO monzo_events ") {
+				failed = true
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "23502", Message: "null value in column"})
+				continue
+			}
+			s.mu.Lock()
+			s.statements = append(s.statements, sql)
+			if len(bound) > 0 {
+				s.inserts = append(s.inserts, bound)
+			}
+			s.mu.Unlock()
+			if columns := s.columns(sql); columns != nil {
+				rows := s.result(sql)
+				for _, row := range rows {
+					backend.Send(s.dataRow(columns, formats, row))
+				}
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT " + strconv.Itoa(len(rows)))})
+			} else {
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")})
+			}
+		case *pgproto3.Sync:
+			failed = false
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.Terminate:
+			return
+		}
+		if err := backend.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// authenticate asks for the password with the server's method, and reports
+// whether the client knew it
+func (s *fakePostgres) authenticate(backend *pgproto3.Backend) bool {
+	refuse := func() bool {
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+		return false
+	}
+	receive := func(authType uint32) (pgproto3.FrontendMessage, bool) {
+		if err := backend.Flush(); err != nil {
+			return nil, false
+		}
+		backend.SetAuthType(authType)
+		msg, err := backend.Receive()
+		return msg, err == nil
+	}
+
+	switch s.auth {
+	case "trust":
+		return true
+	case "cleartext", "md5":
+		expected := s.password
+		if s.auth == "md5" {
+			salt := [4]byte{1, 2, 3, 4}
+			backend.Send(&pgproto3.AuthenticationMD5Password{Salt: salt})
+			inner := md5.Sum([]byte(s.password + "monzo"))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt[:]...))
+			expected = "md5" + hex.EncodeToString(outer[:])
+		} else {
+			backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+		}
+		msg, ok := receive(pgproto3.AuthTypeCleartextPassword)
+		if !ok {
+			return false
+		}
+		if password, _ := msg.(*pgproto3.PasswordMessage); password == nil || password.Password != expected {
+			return refuse()
+		}
+		return true
+	case "scram":
+		backend.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}})
+		msg, ok := receive(pgproto3.AuthTypeSASL)
+		if !ok {
+			return false
+		}
+		initial, _ := msg.(*pgproto3.SASLInitialResponse)
+		if initial == nil || initial.AuthMechanism != "SCRAM-SHA-256" {
+			return false
+		}
+		clientFirstBare := strings.TrimPrefix(string(initial.Data), "n,,")
+		_, nonce, _ := strings.Cut(clientFirstBare, ",r=")
+		salt := []byte("salty")
+		serverFirst := "r=" + nonce + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		backend.Send(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)})
+
+		msg, ok = receive(pgproto3.AuthTypeSASLContinue)
+		if !ok {
+			return false
+		}
+		response, _ := msg.(*pgproto3.SASLResponse)
+		if response == nil {
+			return false
+		}
+		withoutProof, proof, _ := strings.Cut(string(response.Data), ",p=")
+		authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+
+		mac := func(key []byte, message string) []byte {
+			h := hmac.New(sha256.New, key)
+			h.Write([]byte(message))
+			return h.Sum(nil)
+		}
+		salted, _ := pbkdf2.Key(sha256.New, s.password, salt, 4096, sha256.Size)
+		clientKey := mac(salted, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		expected := mac(storedKey[:], authMessage)
+		for i := range expected {
+			expected[i] ^= clientKey[i]
+		}
+		if !hmac.Equal([]byte(proof), []byte(base64.StdEncoding.EncodeToString(expected))) {
+			return refuse()
+		}
+		signature := mac(mac(salted, "Server Key"), authMessage)
+		backend.Send(&pgproto3.AuthenticationSASLFinal{Data: []byte("v=" + base64.StdEncoding.EncodeToString(signature))})
+		return true
+	}
+	return false
+}
+
+func (s *fakePostgres) snapshot() (int, []string, [][]*string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections, append([]string(nil), s.statements...), append([][]*string(nil), s.inserts...)
+}
+
+func testPostgresEvent() *webhookEvent {
+	return &webhookEvent{
+		ID:        "evt_1",
+		Type:      "transaction.created",
+		AccountID: "acc_1",
+		Body:      []byte(`{"type":"transaction.created"}`),
+		Payload: map[string]interface{}{
+			"type": "transaction.created",
+			"data": map[string]interface{}{
+				"id":         "tx_1",
+				"account_id": "acc_1",
+				"amount":     float64(-1250),
+				"currency":   "GBP",
+				"created":    "2024-03-01T09:00:00.000Z",
+			},
+		},
+		Received: time.Date(2024, 3, 1, 9, 0, 1, 0, time.UTC),
+	}
+}
+
+func TestPostgresWriterInsert(t *testing.T) {
+	for _, auth := range []string{"trust", "cleartext", "md5", "scram"} {
+		t.Run(auth, func(t *testing.T) {
+			server := newFakePostgres(t, auth)
+			writer := server.writer(t, server.config(t))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := writer.Insert(ctx, testPostgresEvent()); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+
+			_, statements, inserts := server.snapshot()
+			migrations := 0
+			for _, statement := range statements {
+				if strings.Contains(statement, "INSERT INTO monzo_events_migrations") {
+					migrations++
+				}
+			}
+			if migrations != len(postgresMigrations) {
+				t.Errorf("Expected %d migrations, got %d", len(postgresMigrations), migrations)
+			}
+			if !strings.Contains(statements[len(statements)-1], "ON CONFLICT (id) DO NOTHING") {
+				t.Errorf("Expected the insert last, got %s", statements[len(statements)-1])
+			}
+
+			if len(inserts) != 1 {
+				t.Fatalf("Expected 1 insert, got %d", len(inserts))
+			}
+			expected := []string{"evt_1", "transaction.created", "acc_1", "tx_1", "-1250", "GBP",
+				"2024-03-01T09:00:00.000Z", "2024-03-01T09:00:01Z", `{"type":"transaction.created"}`}
+			for i, value := range inserts[0] {
+				if value == nil || *value != expected[i] {
+					t.Errorf("Parameter $%d: expected %q, got %v", i+1, expected[i], value)
+				}
+			}
+		})
+	}
+}
+
+func TestPostgresWriterNullColumns(t *testing.T) {
+	server := newFakePostgres(t, "trust")
+	writer := server.writer(t, server.config(t))
+
+	event := &webhookEvent{ID: "evt_2", Type: "account.updated", Body: []byte(`{}`), Received: time.Now()}
+	if err := writer.Insert(context.Background(), event); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	_, _, inserts := server.snapshot()
+	for _, i := range []int{2, 3, 4, 5, 6} {
+		if inserts[0][i] != nil {
+			t.Errorf("Expected parameter $%d to be NULL, got %q", i+1, *inserts[0][i])
+		}
+	}
+}
+
+func TestPostgresWriterSkipsAppliedMigrations(t *testing.T) {
+	server := newFakePostgres(t, "trust")
+	server.version = len(postgresMigrations)
+	writer := server.writer(t, server.config(t))
+
+	if err := writer.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	_, statements, _ := server.snapshot()
+	for _, statement := range statements {
+		if strings.EqualFold(statement, "begin") {
+			t.Errorf("Expected no migrations, got %v", statements)
+		}
+	}
+	if !strings.Contains(statements[0], "pg_advisory_lock") || !strings.Contains(statements[len(statements)-1], "pg_advisory_unlock") {
+		t.Errorf("Expected migrations to hold the advisory lock, got %v", statements)
+	}
+}
+
+func TestPostgresWriterPool(t *testing.T) {
+	server := newFakePostgres(t, "md5")
+	writer := server.writer(t, server.config(t))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writer.Insert(context.Background(), testPostgresEvent()); err != nil {
+				t.Errorf("Insert failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	connections, _, inserts := server.snapshot()
+	if len(inserts) != 10 {
+		t.Errorf("Expected 10 inserts, got %d", len(inserts))
+	}
+	if connections > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", connections)
+	}
+}
+
+func TestPostgresWriterErrors(t *testing.T) {
+	server := newFakePostgres(t, "scram")
+	server.failInserts = true
+	writer := server.writer(t, server.config(t))
+
+	for i := 0; i < 2; i++ {
+		err := writer.Insert(context.Background(), testPostgresEvent())
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "23502" {
+			t.Fatalf("Expected a not-null violation, got %v", err)
+		}
+	}
+	// Errors from the server leave the connection usable
+	if connections, _, _ := server.snapshot(); connections != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", connections)
+	}
+
+	cfg := server.config(t)
+	cfg.Pool.ConnConfig.Password = "wrong"
+	err := server.writer(t, cfg).Connect(context.Background())
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "28P01" {
+		t.Errorf("Expected an authentication failure, got %v", err)
+	}
+}
+
+func TestPostgresWriterQueryEvents(t *testing.T) {
+	server := newFakePostgres(t, "trust")
+	server.version = len(postgresMigrations)
+	server.rows = [][]string{
+		{"evt_1", "transaction.created", "acc_1", "1709283600000000", `{"type": "transaction.created"}`},
+		{"evt_2", "transaction.updated", "acc_1", "1709283600123456", `{"type": "transaction.updated"}`},
+		{"evt_3", "transaction.created", "", "1709283601000000", `{}`},
+	}
+	writer := server.writer(t, server.config(t))
+
+	minAmount := int64(-5000)
+	query := eventQuery{
+		From:      time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Types:     []string{"transaction.*", "card.created"},
+		AccountID: "acc_1",
+		MinAmount: &minAmount,
+		After:     "1709283500000000:evt_0",
+		Limit:     2,
+	}
+	events, next, err := writer.queryEvents(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 2 || events[1].ID != "evt_2" || events[1].Type != "transaction.updated" || events[1].AccountID != "acc_1" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if !events[1].ReceivedAt.Equal(time.Date(2024, 3, 1, 9, 0, 0, 123456000, time.UTC)) {
+		t.Errorf("Unexpected received time %v", events[1].ReceivedAt)
+	}
+	if next != "1709283600123456:evt_2" {
+		t.Errorf("Unexpected next cursor %q", next)
+	}
+
+	_, statements, params := server.snapshot()
+	sql := statements[len(statements)-1]
+	for _, part := range []string{"received_at >= $1", "(received_at, id) > (timestamptz 'epoch' + $2::bigint * interval '1 microsecond', $3)",
+		"account_id = $4", "amount >= $5", "(starts_with(type, $6) OR type = $7)", "ORDER BY received_at, id LIMIT 3"} {
+		if !strings.Contains(sql, part) {
+			t.Errorf("Expected %q in %s", part, sql)
+		}
+	}
+	var values []string
+	for _, value := range params[len(params)-1] {
+		values = append(values, *value)
+	}
+	if strings.Join(values, " ") != "2024-03-01T00:00:00Z 1709283500000000 evt_0 acc_1 -5000 transaction. card.created" {
+		t.Errorf("Unexpected parameters %v", values)
+	}
+
+	if _, _, err := writer.queryEvents(context.Background(), eventQuery{After: "evt_2", Limit: 1}); !errors.Is(err, errInvalidEventCursor) {
+		t.Errorf("Expected an invalid cursor error, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// PotsConfig configures syncing the list of pots from the Monzo API, so that
+// pot IDs in events can be resolved to pot names
+type PotsConfig struct {
+	Enabled bool `json:"enabled"`
+	// SyncInterval is how often the list is synced, defaulting to 15m
+	SyncInterval string `json:"sync_interval"`
+}
+
+var (
+	potsKnown = metrics.newGauge("monzo_webhook_pots",
+		"Pots whose names are known, from the last sync.")
+)
+
+// validate checks the pots configuration for invalid values
+func (c PotsConfig) validate() error {
+	if _, err := parsePositiveDuration(c.SyncInterval, 15*time.Minute); err != nil {
+		return fmt.Errorf("invalid pots sync_interval: %w", err)
+	}
+	return nil
+}
+
+// syncInterval returns how often pots are synced
+func (c PotsConfig) syncInterval() time.Duration {
+	d, _ := parsePositiveDuration(c.SyncInterval, 15*time.Minute)
+	return d
+}
+
+// monzoPot is a pot as returned by the Monzo API
+type monzoPot struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted"`
+}
+
+// pots lists the pots of an account
+func (c *monzoClient) pots(ctx context.Context, accountID string) ([]monzoPot, error) {
+	var result struct {
+		Pots []monzoPot `json:"pots"`
+	}
+	query := url.Values{"current_account_id": {accountID}}
+	err := c.do(ctx, "pots", http.MethodGet, "/pots", query, &result)
+	return result.Pots, err
+}
+
+// potCatalogue holds the names of pots, by ID
+type potCatalogue struct {
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+var potNames = &potCatalogue{names: make(map[string]string)}
+
+// sync replaces the catalogue with the pots of the configured accounts, or of
+// every open account the access token can see if none are configured. Deleted
+// pots are kept, since events can still refer to them. If an account with its
+// own tokens fails, the other accounts are synced and the known pots are kept.
+func (c *potCatalogue) sync(ctx context.Context, client *monzoClient, accounts []AccountConfig) error {
+	var accountIDs []string
+	for _, account := range accounts {
+		accountIDs = append(accountIDs, account.ID)
+	}
+	if len(accountIDs) == 0 {
+		found, err := client.accounts(ctx)
+		if err != nil {
+			return err
+		}
+		for _, account := range found {
+			if !account.Closed {
+				accountIDs = append(accountIDs, account.ID)
+			}
+		}
+	}
+
+	names := make(map[string]string)
+	var errs []error
+	for _, accountID := range accountIDs {
+		own := client.forAccount(accountID)
+		pots, err := own.pots(ctx, accountID)
+		if err != nil {
+			err = fmt.Errorf("listing pots of account %s: %w", accountID, err)
+			if own == client {
+				return err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		for _, pot := range pots {
+			names[pot.ID] = pot.Name
+		}
+	}
+
+	c.mu.Lock()
+	if len(errs) > 0 {
+		for id, name := range c.names {
+			if _, ok := names[id]; !ok {
+				names[id] = name
+			}
+		}
+	}
+	c.names = names
+	c.mu.Unlock()
+	potsKnown.Set(float64(len(names)))
+	logDebug("Synced %d pots from %d accounts", len(names), len(accountIDs))
+	return errors.Join(errs...)
+}
+
+// name returns a pot's name, or an empty string if it isn't known
+func (c *potCatalogue) name(id string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.names[id]
+}
+
+// resolvePotName adds data.pot_name to events that refer to a known pot, by
+// data.pot_id or, for transfers to and from pots, data.metadata.pot_id. It
+// returns whether the payload changed. Tenants' events are left alone, so
+// that a tenant can't read the server's pot names by sending their IDs.
+func resolvePotName(c *potCatalogue, event *webhookEvent) bool {
+	if event.Tenant != nil {
+		return false
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	potID, _ := data["pot_id"].(string)
+	if potID == "" {
+		metadata, _ := data["metadata"].(map[string]interface{})
+		potID, _ = metadata["pot_id"].(string)
+	}
+	if potID == "" {
+		return false
+	}
+	name := c.name(potID)
+	if name == "" {
+		return false
+	}
+
+	data["pot_name"] = name
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding %s event %s with its pot name: %v", event.Type, event.ID, err)
+		return false
+	}
+	event.Body = body
+	return true
+}
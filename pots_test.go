@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPotCatalogueSync(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/accounts":
+			w.Write([]byte(`{"accounts": [{"id": "acc_1"}, {"id": "acc_2", "closed": true}]}`))
+		case "/pots":
+			if account := r.URL.Query().Get("current_account_id"); account != "acc_1" {
+				t.Errorf("Expected pots of acc_1 only, got %s", account)
+			}
+			w.Write([]byte(`{"pots": [{"id": "pot_1", "name": "Holiday"}, {"id": "pot_2", "name": "Old car", "deleted": true}]}`))
+		default:
+			t.Errorf("Unexpected request: %s", r.URL)
+		}
+	}))
+	defer server.Close()
+
+	client := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, time.Now)
+	catalogue := &potCatalogue{names: make(map[string]string)}
+	if err := catalogue.sync(context.Background(), client, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if catalogue.name("pot_1") != "Holiday" || catalogue.name("pot_2") != "Old car" {
+		t.Errorf("Unexpected pots: %v", catalogue.names)
+	}
+	if got := testutil.ToFloat64(potsKnown); got != 2 {
+		t.Errorf("Expected 2 known pots, got %g", got)
+	}
+}
+
+func TestResolvePotName(t *testing.T) {
+	catalogue := &potCatalogue{names: map[string]string{"pot_1": "Holiday"}}
+	tests := []struct {
+		name   string
+		data   map[string]interface{}
+		tenant *TenantConfig
+		expect string
+	}{
+		{name: "Transfer to a pot", data: map[string]interface{}{"metadata": map[string]interface{}{"pot_id": "pot_1"}}, expect: "Holiday"},
+		{name: "Pot event", data: map[string]interface{}{"pot_id": "pot_1"}, expect: "Holiday"},
+		{name: "Unknown pot", data: map[string]interface{}{"pot_id": "pot_9"}},
+		{name: "No pot", data: map[string]interface{}{"id": "tx_1"}},
+		{name: "Tenant", data: map[string]interface{}{"pot_id": "pot_1"}, tenant: &TenantConfig{Name: "alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &webhookEvent{ID: "evt_1", Type: "transaction.created", Tenant: tt.tenant, Payload: map[string]interface{}{"data": tt.data}}
+			if changed := resolvePotName(catalogue, event); changed != (tt.expect != "") {
+				t.Fatalf("Expected changed to be %v", tt.expect != "")
+			}
+			if tt.expect == "" {
+				return
+			}
+			var body struct {
+				Data struct {
+					PotName string `json:"pot_name"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(event.Body, &body); err != nil || body.Data.PotName != tt.expect {
+				t.Errorf("Expected pot_name '%s', got %s (%v)", tt.expect, event.Body, err)
+			}
+		})
+	}
+}
+
+func TestPotsConfigValidate(t *testing.T) {
+	if err := (PotsConfig{SyncInterval: "5m"}).validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+	if err := (PotsConfig{SyncInterval: "often"}).validate(); err == nil {
+		t.Error("Expected an error for an invalid sync_interval")
+	}
+}
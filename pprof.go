@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// pprofMux serves the runtime profiles of net/http/pprof under /debug/pprof/.
+// Requests must present ADMIN_TOKEN like admin API requests, as profiles
+// and symbols reveal the server's internals. The command line isn't served,
+// since it may hold secrets.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", adminAuthMiddleware(pprof.Index))
+	mux.HandleFunc("/debug/pprof/profile", adminAuthMiddleware(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", adminAuthMiddleware(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", adminAuthMiddleware(pprof.Trace))
+	return mux
+}
+
+// servePprof serves runtime profiles on addr, such as localhost:6060, apart
+// from the webhook port so that they can be kept off the public network
+func servePprof(addr string) {
+	if currentAdminToken() == "" {
+		logWarn("Profiling is served on %s, but ADMIN_TOKEN isn't set, so every request is refused", addr)
+	}
+
+	server := &http.Server{Addr: addr, Handler: pprofMux(), ReadHeaderTimeout: 10 * time.Second}
+	logInfo("Serving runtime profiles on %s/debug/pprof/", addr)
+	if err := server.ListenAndServe(); err != nil {
+		logError("Error serving runtime profiles on %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofMux(t *testing.T) {
+	origToken := adminToken
+	defer func() { adminToken = origToken }()
+
+	tests := []struct {
+		name   string
+		token  string
+		auth   string
+		status int
+	}{
+		{name: "No admin token", auth: "Bearer ", status: http.StatusUnauthorized},
+		{name: "Admin token required", token: "secret", status: http.StatusUnauthorized},
+		{name: "Admin token given", token: "secret", auth: "Bearer secret", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.token
+			req := httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			pprofMux().ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected %d, got %d", tt.status, rec.Code)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), "goroutine profile") {
+				t.Errorf("Expected a goroutine profile, got: %s", rec.Body.String())
+			}
+		})
+	}
+
+	// The command line isn't served, as it may hold secrets
+	adminToken = "secret"
+	req := httptest.NewRequest("GET", "/debug/pprof/cmdline", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	pprofMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the command line, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// Built-in payload profiles
+const (
+	// profileRaw publishes the payload as it is
+	profileRaw = "raw"
+	// profileEnvelope wraps the payload with the event's metadata
+	profileEnvelope = "envelope"
+	// profileNormalised gives transactions the same fields and types
+	// whatever Monzo sent, such as the merchant always being an object
+	profileNormalised = "normalised"
+	// profileMinimal is a slim summary, for notifications
+	profileMinimal = "minimal"
+)
+
+var builtinProfiles = []string{profileRaw, profileEnvelope, profileNormalised, profileMinimal}
+
+// ProfileConfig is a payload shape defined once and selected by name by any
+// number of sinks
+type ProfileConfig struct {
+	// Format is the built-in profile the payload is shaped with, defaulting
+	// to raw
+	Format string `json:"format"`
+	// Fields trims the payload first, as a transform rule's fields do
+	Fields map[string]string `json:"fields"`
+}
+
+// eventEnvelope is the envelope profile's payload
+type eventEnvelope struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Received  time.Time       `json:"received"`
+	AccountID string          `json:"account_id,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	TraceID   string          `json:"trace_id,omitempty"`
+	Encoding  string          `json:"encoding,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// minimalFields are the minimal profile's fields, by their paths in the
+// payload. Fields the payload doesn't have are left out.
+var minimalFields = map[string]string{
+	"transaction_id": "data.id",
+	"account_id":     "data.account_id",
+	"amount":         "data.amount",
+	"currency":       "data.currency",
+	"description":    "data.description",
+	"merchant":       "data.merchant.name",
+	"category":       "data.category",
+	"account_label":  "data.account_label",
+}
+
+// isBuiltinProfile reports whether a profile is built in
+func isBuiltinProfile(name string) bool {
+	for _, profile := range builtinProfiles {
+		if profile == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProfiles checks the defined profiles, and that each profile
+// selected by a sink exists
+func validateProfiles(profiles map[string]ProfileConfig, sinkProfiles map[string]string, specs []SinkConfig, pipelines []PipelineConfig) error {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile := profiles[name]
+		if isBuiltinProfile(name) {
+			return fmt.Errorf("profile '%s' is built in and can't be redefined", name)
+		}
+		if profile.Format != "" && !isBuiltinProfile(profile.Format) {
+			return fmt.Errorf("profile '%s': format must be one of %s", name, strings.Join(builtinProfiles, ", "))
+		}
+		if len(profile.Fields) > 0 {
+			if err := validateTransformRules([]TransformRule{{Fields: profile.Fields}}); err != nil {
+				return fmt.Errorf("profile '%s': %w", name, err)
+			}
+		}
+	}
+
+	exists := func(name string) bool {
+		_, ok := profiles[name]
+		return ok || isBuiltinProfile(name)
+	}
+	for i, spec := range specs {
+		if spec.Profile != "" && !exists(spec.Profile) {
+			return fmt.Errorf("sink %d: unknown profile '%s'", i+1, spec.Profile)
+		}
+	}
+	for _, pipeline := range pipelines {
+		for i, spec := range pipeline.Sinks {
+			if spec.Profile != "" && !exists(spec.Profile) {
+				return fmt.Errorf("pipeline '%s': sink %d: unknown profile '%s'", pipeline.Name, i+1, spec.Profile)
+			}
+		}
+	}
+	for sink, profile := range sinkProfiles {
+		if !exists(profile) {
+			return fmt.Errorf("sink_profiles: sink '%s' has unknown profile '%s'", sink, profile)
+		}
+	}
+	return nil
+}
+
+// profileFor returns the profile a sink publishes with: its own, or the one
+// selected for its name in sink_profiles
+func profileFor(entry sinkEntry, sinkProfiles map[string]string) string {
+	if entry.profile != "" {
+		return entry.profile
+	}
+	return sinkProfiles[entry.sink.Name()]
+}
+
+// shapeEvent returns the event as it's published with a profile, based on
+// its published body. The raw profile and unknown ones return it unchanged.
+func shapeEvent(name string, profiles map[string]ProfileConfig, event *webhookEvent) *webhookEvent {
+	profile, ok := profiles[name]
+	if !ok {
+		profile = ProfileConfig{Format: name}
+	}
+	if profile.Format == "" {
+		profile.Format = profileRaw
+	}
+	if profile.Format == profileRaw && len(profile.Fields) == 0 {
+		return event
+	}
+
+	body, err := shapeBody(profile, event)
+	if err != nil {
+		logError("Error shaping %s event %s with profile '%s', publishing it as it is: %v", event.Type, event.ID, name, err)
+		return event
+	}
+	eventTraces.recordTransformation(event.ID, "profile "+name, event.Body, body)
+	shaped := *event
+	shaped.Body = body
+	return &shaped
+}
+
+func shapeBody(profile ProfileConfig, event *webhookEvent) ([]byte, error) {
+	body := event.Body
+	if len(profile.Fields) > 0 {
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		projected, err := json.Marshal(TransformRule{Fields: profile.Fields}.project(payload))
+		if err != nil {
+			return nil, err
+		}
+		body = projected
+	}
+
+	switch profile.Format {
+	case profileEnvelope:
+		envelope := eventEnvelope{
+			ID:        event.ID,
+			Type:      event.Type,
+			Received:  event.Received.UTC(),
+			AccountID: event.AccountID,
+			TraceID:   event.TraceID,
+			Encoding:  event.Encoding,
+			Payload:   body,
+		}
+		if event.Tenant != nil {
+			envelope.Tenant = event.Tenant.Name
+		}
+		return json.Marshal(envelope)
+	case profileNormalised:
+		return normaliseTransaction(body)
+	case profileMinimal:
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		minimal := TransformRule{Fields: minimalFields}.project(payload)
+		minimal["id"] = event.ID
+		minimal["type"] = event.Type
+		return json.Marshal(minimal)
+	}
+	return body, nil
+}
+
+// normaliseTransaction re-encodes a transaction event's data with the monzo
+// package's types, keeping fields it doesn't know, such as ones added by
+// enrichment. Other events, and transactions it can't decode, are returned
+// as they are.
+func normaliseTransaction(body []byte) ([]byte, error) {
+	decoded, err := monzo.Decode(body)
+	if err != nil || !decoded.IsTransaction() {
+		return body, nil
+	}
+	tx, err := decoded.Transaction()
+	if err != nil {
+		return body, nil
+	}
+
+	var payload, data, typed map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(decoded.Data, &data); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(encoded, &typed); err != nil {
+		return nil, err
+	}
+	for key, value := range typed {
+		data[key] = value
+	}
+	payload["data"] = data
+	return json.Marshal(payload)
+}
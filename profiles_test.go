@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateProfiles(t *testing.T) {
+	tests := []struct {
+		name         string
+		profiles     map[string]ProfileConfig
+		sinkProfiles map[string]string
+		sinks        []SinkConfig
+		pipelines    []PipelineConfig
+		expectErr    string
+	}{
+		{name: "None"},
+		{name: "Valid", profiles: map[string]ProfileConfig{"receipt": {Format: "envelope", Fields: map[string]string{"id": "data.id"}}},
+			sinkProfiles: map[string]string{"kafka": "envelope"}, sinks: []SinkConfig{{Type: "redis", Profile: "receipt"}},
+			pipelines: []PipelineConfig{{Name: "notify", Sinks: []SinkConfig{{Type: "redis", Profile: "minimal"}}}}},
+		{name: "Built-in name", profiles: map[string]ProfileConfig{"minimal": {}}, expectErr: "built in"},
+		{name: "Unknown format", profiles: map[string]ProfileConfig{"slim": {Format: "compact"}}, expectErr: "format must be one of"},
+		{name: "Invalid fields", profiles: map[string]ProfileConfig{"slim": {Fields: map[string]string{"id": "data..id"}}}, expectErr: "profile 'slim'"},
+		{name: "Unknown sink profile", sinks: []SinkConfig{{Type: "redis", Profile: "slim"}}, expectErr: "sink 1: unknown profile 'slim'"},
+		{name: "Unknown pipeline sink profile", pipelines: []PipelineConfig{{Name: "notify", Sinks: []SinkConfig{{Type: "redis", Profile: "slim"}}}},
+			expectErr: "pipeline 'notify'"},
+		{name: "Unknown sink_profiles profile", sinkProfiles: map[string]string{"kafka": "slim"}, expectErr: "sink 'kafka'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateProfiles(tt.profiles, tt.sinkProfiles, tt.sinks, tt.pipelines)
+			if tt.expectErr == "" && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if tt.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tt.expectErr)) {
+				t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestShapeEvent(t *testing.T) {
+	body := `{"type":"transaction.created","data":{"id":"tx_1","created":"2024-01-01T12:00:00Z","account_id":"acc_1","amount":-350,"currency":"GBP","description":"PRET","merchant":"merch_1","account_label":"Joint"}}`
+	received := time.Date(2024, 1, 1, 12, 0, 1, 0, time.UTC)
+	profiles := map[string]ProfileConfig{
+		"receipt": {Format: "envelope", Fields: map[string]string{"id": "data.id"}},
+		"ids":     {Fields: map[string]string{"id": "data.id"}},
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		expect string
+	}{
+		{name: "raw", expect: body},
+		{name: "envelope", expect: `{"id":"evt_1","type":"transaction.created","received":"2024-01-01T12:00:01Z","account_id":"acc_1","tenant":"alice","payload":` + body + `}`},
+		{name: "normalised", expect: `{"type":"transaction.created","data":{"id":"tx_1","created":"2024-01-01T12:00:00Z","account_id":"acc_1","amount":-350,"currency":"GBP","description":"PRET","merchant":{"id":"merch_1"},"account_label":"Joint"}}`},
+		{name: "normalised", body: `{"type":"account.balance_updated","data":{"balance":100}}`, expect: `{"type":"account.balance_updated","data":{"balance":100}}`},
+		{name: "minimal", expect: `{"id":"evt_1","type":"transaction.created","transaction_id":"tx_1","account_id":"acc_1","amount":-350,"currency":"GBP","description":"PRET","account_label":"Joint"}`},
+		{name: "receipt", expect: `{"id":"evt_1","type":"transaction.created","received":"2024-01-01T12:00:01Z","account_id":"acc_1","tenant":"alice","payload":{"id":"tx_1"}}`},
+		{name: "ids", expect: `{"id":"tx_1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.body == "" {
+				tt.body = body
+			}
+			event := &webhookEvent{ID: "evt_1", Type: "transaction.created", AccountID: "acc_1", Tenant: &TenantConfig{Name: "alice"}, Received: received, Body: []byte(tt.body)}
+			shaped := shapeEvent(tt.name, profiles, event)
+
+			var got, expect interface{}
+			json.Unmarshal(shaped.Body, &got)
+			json.Unmarshal([]byte(tt.expect), &expect)
+			if !reflect.DeepEqual(got, expect) {
+				t.Errorf("Expected %s, got %s", tt.expect, shaped.Body)
+			}
+			if string(event.Body) != tt.body {
+				t.Error("Expected the event itself to be unchanged")
+			}
+		})
+	}
+}
+
+func TestPublishToSinksProfiles(t *testing.T) {
+	originalConfig := eventConfig
+	defer func() { eventConfig = originalConfig }()
+	eventConfig = EventConfig{SinkProfiles: map[string]string{"kafka": "minimal", "audit": "envelope"}}
+
+	body := []byte(`{"type":"transaction.created","data":{"id":"tx_1","amount":-350}}`)
+	var payload map[string]interface{}
+	json.Unmarshal(body, &payload)
+	event := &webhookEvent{ID: "evt_1", Type: "transaction.created", Body: body, Payload: payload}
+
+	kafka := &fakeSink{name: "kafka"}
+	notify := &fakeSink{name: "notify"}
+	audit := &fakeSink{name: "audit"}
+	channel := &fakeSink{name: "redis"}
+	entries := []sinkEntry{{sink: kafka}, {sink: notify, profile: "minimal"}, {sink: audit, profile: "raw"}, {sink: channel}}
+	if err := publishToSinks(context.Background(), entries, nil, event); err != nil {
+		t.Fatal(err)
+	}
+
+	minimal := `{"amount":-350,"id":"evt_1","transaction_id":"tx_1","type":"transaction.created"}`
+	for _, tt := range []struct {
+		sink   *fakeSink
+		expect string
+	}{{kafka, minimal}, {notify, minimal}, {audit, string(body)}, {channel, string(body)}} {
+		if tt.sink.count() != 1 || string(tt.sink.events[0].Body) != tt.expect {
+			t.Errorf("Expected sink '%s' to get %s, got %+v", tt.sink.name, tt.expect, tt.sink.events)
+		}
+	}
+	if kafka.events[0] != notify.events[0] {
+		t.Error("Expected the minimal payload to be shaped once for both sinks")
+	}
+}
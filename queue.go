@@ -0,0 +1,336 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WorkerConfig configures asynchronous event processing. When Count is zero,
+// events are published to the sinks before the webhook request is answered.
+// Otherwise webhooks are answered once queued, so Monzo doesn't redeliver
+// events that then fail to publish, even to required sinks.
+type WorkerConfig struct {
+	Count      int    `json:"count"`
+	QueueSize  int    `json:"queue_size"`
+	HighWater  int    `json:"high_water"`
+	RetryAfter string `json:"retry_after"`
+}
+
+// PriorityRule assigns a priority to events that match it. Type matches the
+// event type exactly, or as a prefix when it ends in '*'. Field, if set, is a
+// dotted path into the payload that must be present and non-empty.
+type PriorityRule struct {
+	Type     string `json:"type"`
+	Field    string `json:"field"`
+	Priority int    `json:"priority"`
+}
+
+// webhookEvent is a received webhook on its way to the sinks. ID is a ULID
+// assigned at ingest, used to correlate the event across sinks and logs.
+type webhookEvent struct {
+	ID        string
+	Type      string
+	AccountID string
+	Body      []byte
+	Payload   map[string]interface{}
+	Tenant    *TenantConfig
+	Priority  int
+	Received  time.Time
+
+	// MutedMerchant is set when the event is for a muted merchant, and is
+	// then not published to notification sinks
+	MutedMerchant string
+
+	// Origin is the instance that first received a mirrored event. It is
+	// empty for events received or generated by this instance.
+	Origin string
+
+	// Channel is the Redis channel a rule or the script routed the event
+	// to, if any
+	Channel string
+
+	// Dropped is set when the script dropped the event, which is then
+	// acknowledged without being published
+	Dropped bool
+
+	// TraceID is the trace ID from the traceparent header of the request
+	// that delivered the event, if any
+	TraceID string
+
+	// Encoding is the encoding the body was received in when it wasn't
+	// plain UTF-8, such as utf-16le. Body and Payload have been converted.
+	Encoding string
+}
+
+var (
+	queueDepth = metrics.newGaugeVec("monzo_webhook_queue_depth",
+		"Events waiting for a worker, by priority.", "priority")
+	queueWaitSeconds = metrics.newCounterVec("monzo_webhook_queue_wait_seconds_total",
+		"Total time events spent waiting for a worker, by priority.", "priority")
+	queueWaitDuration = metrics.newHistogramVec("monzo_webhook_queue_wait_duration_seconds",
+		"Time events spent waiting for a worker, by priority.", "priority")
+	backpressureRejections = metrics.newCounterVec("monzo_webhook_backpressure_rejections_total",
+		"Webhook events rejected because the event queue was under pressure, by status code.", "status")
+)
+
+// asyncQueue holds events waiting for the worker pool, or is nil when events
+// are processed synchronously
+var asyncQueue *eventQueue
+
+// validate checks the worker configuration for invalid values
+func (c WorkerConfig) validate() error {
+	if c.Count < 0 {
+		return fmt.Errorf("workers count must not be negative")
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("workers queue_size must not be negative")
+	}
+	if c.HighWater < 0 || c.HighWater > c.queueSize() {
+		return fmt.Errorf("workers high_water must be between 0 and queue_size")
+	}
+	if _, err := c.retryAfter(); err != nil {
+		return fmt.Errorf("invalid workers retry_after: %w", err)
+	}
+	return nil
+}
+
+// queueSize returns the queue capacity, defaulting to 1000 events
+func (c WorkerConfig) queueSize() int {
+	if c.QueueSize == 0 {
+		return 1000
+	}
+	return c.QueueSize
+}
+
+// highWater returns the queue depth above which normal and low priority
+// events are rejected, defaulting to 80% of the queue size
+func (c WorkerConfig) highWater() int {
+	if c.HighWater > 0 {
+		return c.HighWater
+	}
+	if mark := c.queueSize() * 80 / 100; mark > 0 {
+		return mark
+	}
+	return c.queueSize()
+}
+
+// retryAfter returns the delay suggested to Monzo when an event is rejected
+// because of backpressure, defaulting to 30 seconds
+func (c WorkerConfig) retryAfter() (time.Duration, error) {
+	if c.RetryAfter == "" {
+		return 30 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.RetryAfter)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// backpressure returns the status code to reject an event with, given the
+// current queue depth, or zero if the event should be accepted. Above the
+// high-water mark only events with a positive priority are accepted, so that
+// urgent events keep flowing while Monzo spreads out the rest.
+func (c WorkerConfig) backpressure(depth, priority int) int {
+	if depth >= c.queueSize() {
+		return http.StatusServiceUnavailable
+	}
+	if depth >= c.highWater() && priority <= 0 {
+		return http.StatusTooManyRequests
+	}
+	return 0
+}
+
+// validatePriorities checks that every priority rule matches something
+func validatePriorities(rules []PriorityRule) error {
+	for i, rule := range rules {
+		if rule.Type == "" && rule.Field == "" {
+			return fmt.Errorf("priority rule %d must have a type or field", i+1)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to an event
+func (r PriorityRule) matches(eventType string, payload map[string]interface{}) bool {
+	if prefix, ok := strings.CutSuffix(r.Type, "*"); ok {
+		if !strings.HasPrefix(eventType, prefix) {
+			return false
+		}
+	} else if r.Type != "" && r.Type != eventType {
+		return false
+	}
+
+	if r.Field != "" {
+		value, ok := lookupField(payload, r.Field)
+		if !ok || value == nil || value == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// eventPriority returns the priority of the first matching rule, or zero
+func eventPriority(rules []PriorityRule, eventType string, payload map[string]interface{}) int {
+	for _, rule := range rules {
+		if rule.matches(eventType, payload) {
+			return rule.Priority
+		}
+	}
+	return 0
+}
+
+// lookupField returns the value at a dotted path such as "data.merchant.name"
+func lookupField(payload map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// eventQueue is a bounded priority queue. Higher priorities are popped first
+// and events of equal priority are popped in arrival order.
+type eventQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	items    eventHeap
+	seq      uint64
+	capacity int
+	closed   bool
+}
+
+func newEventQueue(capacity int) *eventQueue {
+	q := &eventQueue{capacity: capacity}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds an event, returning false if the queue is full or closed
+func (q *eventQueue) Push(event *webhookEvent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || len(q.items) >= q.capacity {
+		return false
+	}
+
+	q.seq++
+	heap.Push(&q.items, queuedEvent{event: event, seq: q.seq})
+	queueDepth.WithLabelValues(strconv.Itoa(event.Priority)).Inc()
+	q.cond.Signal()
+	return true
+}
+
+// Pop blocks until an event is available. It returns false once the queue
+// has been closed and drained.
+func (q *eventQueue) Pop() (*webhookEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+
+	event := heap.Pop(&q.items).(queuedEvent).event
+	priority := strconv.Itoa(event.Priority)
+	queueDepth.WithLabelValues(priority).Add(-1)
+	wait := clock.Now().Sub(event.Received).Seconds()
+	queueWaitSeconds.WithLabelValues(priority).Add(wait)
+	observeWithExemplar(queueWaitDuration.WithLabelValues(priority), wait, eventExemplar(event))
+	return event, true
+}
+
+// Len returns the number of waiting events
+func (q *eventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Close stops accepting events and wakes idle workers so they can exit
+func (q *eventQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// queuedEvent is an event in the heap with its arrival sequence number
+type queuedEvent struct {
+	event *webhookEvent
+	seq   uint64
+}
+
+// eventHeap implements heap.Interface, ordered by priority then arrival
+type eventHeap []queuedEvent
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].event.Priority != h[j].event.Priority {
+		return h[i].event.Priority > h[j].event.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(queuedEvent)) }
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// startWorkers starts count workers that publish queued events until the
+// queue is closed. The returned WaitGroup completes when they have exited.
+func startWorkers(q *eventQueue, count int) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				event, ok := q.Pop()
+				if !ok {
+					return
+				}
+				processQueuedEvent(event)
+			}
+		}()
+	}
+	return &wg
+}
+
+// processQueuedEvent publishes an event taken from the queue
+func processQueuedEvent(event *webhookEvent) {
+	defer errorReporter.recoverPanic(sentryEventTags(event, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), currentConfig().Retry.timeout())
+	defer cancel()
+	if err := processEvent(ctx, event); err != nil {
+		logError("Error processing queued %s event %s: %v", event.Type, event.ID, err)
+		eventTraces.setOutcome(event.ID, "failed: "+err.Error())
+	} else {
+		eventTraces.setOutcome(event.ID, publishedOutcome(event))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventPriority(t *testing.T) {
+	rules := []PriorityRule{
+		{Type: "transaction.created", Field: "data.decline_reason", Priority: 10},
+		{Type: "transaction.created", Priority: 5},
+		{Type: "transaction.*", Priority: -5},
+	}
+
+	tests := []struct {
+		name             string
+		eventType        string
+		payload          map[string]interface{}
+		expectedPriority int
+	}{
+		{
+			name:             "Declined transaction",
+			eventType:        "transaction.created",
+			payload:          map[string]interface{}{"data": map[string]interface{}{"decline_reason": "INSUFFICIENT_FUNDS"}},
+			expectedPriority: 10,
+		},
+		{
+			name:             "Empty decline reason is not a decline",
+			eventType:        "transaction.created",
+			payload:          map[string]interface{}{"data": map[string]interface{}{"decline_reason": ""}},
+			expectedPriority: 5,
+		},
+		{
+			name:             "Normal transaction",
+			eventType:        "transaction.created",
+			payload:          map[string]interface{}{"data": map[string]interface{}{}},
+			expectedPriority: 5,
+		},
+		{
+			name:             "Prefix match",
+			eventType:        "transaction.updated",
+			payload:          map[string]interface{}{},
+			expectedPriority: -5,
+		},
+		{
+			name:             "No match",
+			eventType:        "balance.updated",
+			payload:          map[string]interface{}{},
+			expectedPriority: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventPriority(rules, tt.eventType, tt.payload); got != tt.expectedPriority {
+				t.Errorf("Expected priority %d, got %d", tt.expectedPriority, got)
+			}
+		})
+	}
+}
+
+func TestEventQueueOrdering(t *testing.T) {
+	q := newEventQueue(10)
+
+	pushed := []struct {
+		eventType string
+		priority  int
+	}{
+		{"update-1", -5},
+		{"normal-1", 0},
+		{"decline-1", 10},
+		{"normal-2", 0},
+		{"decline-2", 10},
+	}
+	for _, p := range pushed {
+		if !q.Push(&webhookEvent{Type: p.eventType, Priority: p.priority, Received: time.Now()}) {
+			t.Fatalf("Push of %s failed", p.eventType)
+		}
+	}
+
+	expected := []string{"decline-1", "decline-2", "normal-1", "normal-2", "update-1"}
+	for _, want := range expected {
+		event, ok := q.Pop()
+		if !ok {
+			t.Fatal("Pop returned no event")
+		}
+		if event.Type != want {
+			t.Errorf("Expected %s, got %s", want, event.Type)
+		}
+	}
+}
+
+func TestEventQueueCapacityAndClose(t *testing.T) {
+	q := newEventQueue(2)
+
+	for i := 0; i < 2; i++ {
+		if !q.Push(&webhookEvent{Type: "transaction.created", Received: time.Now()}) {
+			t.Fatalf("Push %d failed", i+1)
+		}
+	}
+	if q.Push(&webhookEvent{Type: "transaction.created", Received: time.Now()}) {
+		t.Error("Expected Push to fail when the queue is full")
+	}
+
+	q.Close()
+	if q.Push(&webhookEvent{Type: "transaction.created", Received: time.Now()}) {
+		t.Error("Expected Push to fail once the queue is closed")
+	}
+
+	// Queued events are still drained after Close
+	for i := 0; i < 2; i++ {
+		if _, ok := q.Pop(); !ok {
+			t.Fatalf("Expected queued event %d after Close", i+1)
+		}
+	}
+	if _, ok := q.Pop(); ok {
+		t.Error("Expected Pop to report a closed, empty queue")
+	}
+}
+
+func TestWebhookHandlerAsync(t *testing.T) {
+	origQueue := asyncQueue
+	origConfig := eventConfig
+	origRedisClient := redisClient
+	defer func() {
+		asyncQueue = origQueue
+		eventConfig = origConfig
+		redisClient = origRedisClient
+	}()
+
+	redisClient = nil
+	eventConfig = EventConfig{
+		Priorities: []PriorityRule{{Type: "transaction.created", Field: "data.decline_reason", Priority: 10}},
+	}
+	asyncQueue = newEventQueue(1)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook",
+			bytes.NewBufferString(`{"type": "transaction.created", "data": {"decline_reason": "CARD_BLOCKED"}}`))
+		rr := httptest.NewRecorder()
+		webhookHandler(rr, req)
+		return rr
+	}
+
+	if rr := send(); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := send(); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d when the queue is full, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	event, _ := asyncQueue.Pop()
+	if event.Priority != 10 {
+		t.Errorf("Expected priority 10, got %d", event.Priority)
+	}
+
+	// A worker drains the queue and exits once it is closed
+	asyncQueue.Push(event)
+	asyncQueue.Close()
+	done := make(chan struct{})
+	go func() {
+		startWorkers(asyncQueue, 2).Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Workers did not exit after the queue was closed")
+	}
+	if asyncQueue.Len() != 0 {
+		t.Errorf("Expected an empty queue, got %d events", asyncQueue.Len())
+	}
+}
+
+func TestWorkerConfigBackpressure(t *testing.T) {
+	cfg := WorkerConfig{QueueSize: 10}
+
+	tests := []struct {
+		name           string
+		depth          int
+		priority       int
+		expectedStatus int
+	}{
+		{name: "Below high-water mark", depth: 7, priority: 0, expectedStatus: 0},
+		{name: "At high-water mark", depth: 8, priority: 0, expectedStatus: http.StatusTooManyRequests},
+		{name: "Low priority above high-water mark", depth: 9, priority: -5, expectedStatus: http.StatusTooManyRequests},
+		{name: "High priority above high-water mark", depth: 9, priority: 10, expectedStatus: 0},
+		{name: "Full queue", depth: 10, priority: 10, expectedStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.backpressure(tt.depth, tt.priority); got != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, got)
+			}
+		})
+	}
+}
+
+func TestWorkerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      WorkerConfig
+		expectError bool
+	}{
+		{name: "Defaults", config: WorkerConfig{}},
+		{name: "Valid", config: WorkerConfig{Count: 4, QueueSize: 100, HighWater: 50, RetryAfter: "1m"}},
+		{name: "High water above queue size", config: WorkerConfig{QueueSize: 100, HighWater: 200}, expectError: true},
+		{name: "Invalid retry_after", config: WorkerConfig{RetryAfter: "soon"}, expectError: true},
+		{name: "Negative count", config: WorkerConfig{Count: -1}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerBackpressure(t *testing.T) {
+	origQueue := asyncQueue
+	origConfig := eventConfig
+	defer func() {
+		asyncQueue = origQueue
+		eventConfig = origConfig
+	}()
+
+	eventConfig = EventConfig{
+		Workers:    WorkerConfig{QueueSize: 2, HighWater: 1, RetryAfter: "45s"},
+		Priorities: []PriorityRule{{Type: "transaction.created", Field: "data.decline_reason", Priority: 10}},
+	}
+	asyncQueue = newEventQueue(eventConfig.Workers.queueSize())
+
+	send := func(payload string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+		rr := httptest.NewRecorder()
+		webhookHandler(rr, req)
+		return rr
+	}
+	normal := `{"type": "transaction.created", "data": {}}`
+	decline := `{"type": "transaction.created", "data": {"decline_reason": "CARD_BLOCKED"}}`
+
+	if rr := send(normal); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	rr := send(normal)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d above the high-water mark, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "45" {
+		t.Errorf("Expected Retry-After '45', got '%s'", rr.Header().Get("Retry-After"))
+	}
+
+	if rr := send(decline); rr.Code != http.StatusOK {
+		t.Errorf("Expected a high priority event to be accepted, got %d", rr.Code)
+	}
+
+	rr = send(decline)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d when the queue is full, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "45" {
+		t.Errorf("Expected Retry-After '45', got '%s'", rr.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var redisPermissionMissing = metrics.newGaugeVec("monzo_webhook_redis_permission_missing",
+	"1 for each command and channel or key the Redis user isn't allowed, from the startup check.", "command", "target")
+
+// redisPermission is a command a feature needs to run on a channel or key,
+// and the setting that needs it. Targets ending in * are key patterns.
+type redisPermission struct {
+	Command string
+	Target  string
+	Setting string
+}
+
+// channel reports whether the permission's target is a channel rather than a
+// key
+func (p redisPermission) channel() bool {
+	return p.Command == "PUBLISH" || p.Command == "SUBSCRIBE"
+}
+
+// requiredRedisPermissions lists the commands the enabled features run, with
+// the channels and keys they run them on. Channels set by the script hook or
+// given to /admin/reprocess aren't known until they're used, so they aren't
+// listed. monzoAPI is whether the Monzo API client is enabled, which the
+// API cache and commands need.
+func requiredRedisPermissions(c EventConfig, monzoAPI bool) []redisPermission {
+	var required []redisPermission
+	seen := make(map[string]bool)
+	add := func(target, setting string, commands ...string) {
+		for _, command := range commands {
+			if target == "" || seen[command+" "+target] {
+				continue
+			}
+			seen[command+" "+target] = true
+			required = append(required, redisPermission{Command: command, Target: target, Setting: setting})
+		}
+	}
+
+	add(c.Channel, "channel", "PUBLISH")
+	for _, account := range c.Accounts {
+		add(account.Channel, fmt.Sprintf("accounts[%s].channel", account.ID), "PUBLISH")
+	}
+	for _, tenant := range c.Tenants {
+		add(tenant.Channel, fmt.Sprintf("tenants[%s].channel", tenant.Name), "PUBLISH")
+	}
+	for _, rule := range c.Rules {
+		add(rule.Channel, fmt.Sprintf("rules[%s].channel", rule.Name), "PUBLISH")
+	}
+	for i, sink := range c.Sinks {
+		if sink.Type == "redis" {
+			add(sink.Channel, fmt.Sprintf("sinks[%d].channel", i), "PUBLISH")
+		}
+	}
+	for _, pipeline := range c.Pipelines {
+		for _, rule := range pipeline.Rules {
+			add(rule.Channel, fmt.Sprintf("pipelines[%s].rules[%s].channel", pipeline.Name, rule.Name), "PUBLISH")
+		}
+		for i, sink := range pipeline.Sinks {
+			if sink.Type == "redis" {
+				add(sink.Channel, fmt.Sprintf("pipelines[%s].sinks[%d].channel", pipeline.Name, i), "PUBLISH")
+			}
+		}
+	}
+	add(c.Alerts.Channel, "alerts.channel", "PUBLISH")
+	add(c.WebhookTest.Channel, "webhook_test.channel", "PUBLISH")
+
+	// The stream monitor trims the stream and reads its length, oldest entry
+	// and consumer groups, and the history features read its entries
+	if c.Stream.Name != "" {
+		add(c.Stream.Name, "stream.name", "XADD", "XLEN", "XRANGE", "EXISTS", "XINFO")
+		if maxAge, _ := c.Stream.maxAge(); maxAge > 0 {
+			add(c.Stream.Name, "stream.max_age", "XTRIM")
+		}
+	}
+
+	// Dedup claims, transaction changes and lifecycles are kept in keys
+	// that expire
+	if c.Dedup.Enabled {
+		add(c.Dedup.keyPrefix()+"*", "dedup", "SET", "GET", "DEL")
+	}
+	if c.Changes.Enabled {
+		add(c.Changes.keyPrefix()+"*", "changes", "GET", "SET")
+	}
+	if c.Lifecycle.Enabled {
+		add(c.Lifecycle.keyPrefix()+"*", "lifecycle", "GET", "SET")
+	}
+
+	// The lease is renewed with a script, which runs GET and PEXPIRE
+	if c.Failover.Enabled {
+		add(c.Failover.keyPrefix()+"lease", "failover", "SET", "EVALSHA", "EVAL", "GET", "PEXPIRE")
+		add(c.Failover.keyPrefix()+"published:*", "failover", "EXISTS", "SET")
+	}
+
+	if monzoAPI && !c.MonzoAPI.Cache.Disabled {
+		cache := newMonzoCache(nil, c.MonzoAPI.Cache)
+		add(cache.keyPrefix+"*", "monzo_api.cache", "GET", "SET", "DEL")
+	}
+	if c.MonzoAPI.Tokens.Store == "redis" {
+		add(c.MonzoAPI.Tokens.key(), "monzo_api.tokens", "GET", "SET")
+		for _, account := range c.Accounts {
+			if account.Tokens != nil {
+				add(account.Tokens.location(c.MonzoAPI.Tokens, account.ID), fmt.Sprintf("accounts[%s].tokens", account.ID), "GET", "SET")
+			}
+		}
+	}
+	if monzoAPI && c.Commands.Channel != "" {
+		add(c.Commands.Channel, "commands.channel", "SUBSCRIBE")
+		add(commandClaimPrefix+"*", "commands.channel", "SET", "DEL")
+		if c.Commands.allows(commandDeposit) {
+			add(depositTotalPrefix+"*", "commands.max_deposit_total", "GET", "INCRBY", "EXPIRE")
+		}
+		add(c.Commands.ResultsChannel, "commands.results_channel", "PUBLISH")
+	}
+
+	// Feature flag overrides, muted merchants, merchant alias overrides and
+	// split transactions are always kept in Redis when it's available
+	add(c.FeatureFlags.key(), "feature_flags", "HGETALL", "HSET", "HDEL")
+	add(mutedMerchantsKey, "muted merchants", "SMEMBERS", "SADD", "SREM")
+	add(merchantAliasesKey, "merchant aliases", "HGETALL", "HSET", "HDEL")
+	add(expenseSplitsKey, "splits", "HGETALL", "HSET", "HDEL")
+	return required
+}
+
+// args returns a command that checks the permission when it's queued. Key
+// patterns are checked with a key that matches them.
+func (p redisPermission) args() []interface{} {
+	target := p.Target
+	if !p.channel() && strings.HasSuffix(target, "*") {
+		target = strings.TrimSuffix(target, "*") + "permission-check"
+	}
+	switch p.Command {
+	case "PUBLISH":
+		return []interface{}{"PUBLISH", target, ""}
+	case "XADD":
+		return []interface{}{"XADD", target, "*", "monzo-webhook", "permission-check"}
+	case "XTRIM":
+		return []interface{}{"XTRIM", target, "MINID", "0"}
+	case "XRANGE":
+		return []interface{}{"XRANGE", target, "-", "+", "COUNT", "1"}
+	case "XINFO":
+		return []interface{}{"XINFO", "GROUPS", target}
+	case "SET":
+		return []interface{}{"SET", target, "permission-check", "NX", "PX", "1"}
+	case "PEXPIRE":
+		return []interface{}{"PEXPIRE", target, "1"}
+	case "EVAL":
+		return []interface{}{"EVAL", "return 0", "1", target}
+	case "EVALSHA":
+		return []interface{}{"EVALSHA", renewLeaseScript.Hash(), "1", target}
+	case "SADD", "SREM", "HDEL":
+		return []interface{}{p.Command, target, "permission-check"}
+	case "HSET":
+		return []interface{}{"HSET", target, "permission-check", ""}
+	}
+	return []interface{}{p.Command, target}
+}
+
+// checkRedisPermissions reports which of the required permissions the Redis
+// user is denied. Redis checks a command's permissions when it's queued in a
+// transaction, so the commands are queued and the transaction discarded,
+// and nothing is published or written. The check needs MULTI and DISCARD.
+func checkRedisPermissions(ctx context.Context, client *redis.Client, required []redisPermission) ([]redisPermission, error) {
+	if len(required) == 0 {
+		return nil, nil
+	}
+	conn := client.Conn()
+	defer conn.Close()
+	if err := conn.Do(ctx, "MULTI").Err(); err != nil {
+		return nil, fmt.Errorf("starting a transaction to check permissions, which needs +multi +discard: %w", err)
+	}
+	defer conn.Do(context.Background(), "DISCARD")
+	return deniedRedisPermissions(required, func(args ...interface{}) error {
+		return conn.Do(ctx, args...).Err()
+	})
+}
+
+// deniedRedisPermissions queues each permission's command with queue,
+// returning those that were refused with NOPERM. Commands that can't be
+// queued, such as SUBSCRIBE, are refused after their permissions are
+// checked, so that refusal means they're allowed.
+func deniedRedisPermissions(required []redisPermission, queue func(args ...interface{}) error) ([]redisPermission, error) {
+	var denied []redisPermission
+	for _, permission := range required {
+		err := queue(permission.args()...)
+		switch {
+		case err == nil, strings.Contains(err.Error(), "not allowed inside a transaction"):
+			redisPermissionMissing.DeleteLabelValues(permission.Command, permission.Target)
+		case strings.HasPrefix(err.Error(), "NOPERM"):
+			redisPermissionMissing.WithLabelValues(permission.Command, permission.Target).Set(1)
+			denied = append(denied, permission)
+		default:
+			return denied, fmt.Errorf("checking %s %s: %w", permission.Command, permission.Target, err)
+		}
+	}
+	return denied, nil
+}
+
+// redisACLRule returns the ACL SETUSER command granting the permissions
+func redisACLRule(username string, permissions []redisPermission) string {
+	if username == "" {
+		username = "default"
+	}
+	commands := make(map[string]bool)
+	var channels, keys []string
+	seen := make(map[string]bool)
+	for _, permission := range permissions {
+		commands["+"+strings.ToLower(permission.Command)] = true
+		pattern := "~" + permission.Target
+		if permission.channel() {
+			pattern = "&" + permission.Target
+		}
+		if seen[pattern] {
+			continue
+		}
+		seen[pattern] = true
+		if permission.channel() {
+			channels = append(channels, pattern)
+		} else {
+			keys = append(keys, pattern)
+		}
+	}
+	rule := []string{"ACL", "SETUSER", username}
+	for command := range commands {
+		rule = append(rule, command)
+	}
+	sort.Strings(rule[3:])
+	rule = append(rule, channels...)
+	return strings.Join(append(rule, keys...), " ")
+}
+
+// logRedisPermissions checks the Redis user's permissions at startup and
+// logs any that are missing with the ACL rule that grants them, rather than
+// leaving them to fail with NOPERM when they're used
+func logRedisPermissions(ctx context.Context, client *redis.Client, username string, cfg EventConfig, monzoAPI bool) {
+	required := requiredRedisPermissions(cfg, monzoAPI)
+	denied, err := checkRedisPermissions(ctx, client, required)
+	if err != nil {
+		logWarn("Could not check the Redis user's permissions: %v", err)
+		return
+	}
+	if len(denied) == 0 {
+		logInfo("Redis user is allowed the %d commands the enabled features need", len(required))
+		return
+	}
+	for _, permission := range denied {
+		logError("Redis user isn't allowed to run %s on %s, needed by %s - it will fail with NOPERM",
+			permission.Command, permission.Target, permission.Setting)
+	}
+	logError("Grant the missing permissions with: %s", redisACLRule(username, denied))
+}
+
+// monzoAPIConfigured reports whether the Monzo API client will be enabled,
+// before it's created
+func monzoAPIConfigured(c EventConfig) bool {
+	if c.MonzoAPI.Tokens.Store != "" {
+		return true
+	}
+	for _, name := range []string{"MONZO_ACCESS_TOKEN", "MONZO_ACCESS_TOKEN_FILE", "VAULT_MONZO_PATH"} {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequiredRedisPermissions(t *testing.T) {
+	cfg := EventConfig{
+		Channel:  "monzo-webhook",
+		Stream:   StreamConfig{Name: "monzo-events", MaxAge: "720h"},
+		Accounts: []AccountConfig{{ID: "acc_1", Channel: "monzo-joint", Tokens: &AccountTokenConfig{}}, {ID: "acc_2"}},
+		Rules:    []CELRule{{Name: "big", Channel: "monzo-big"}, {Name: "tag", Tags: []string{"x"}}},
+		Sinks: []SinkConfig{
+			{Type: "redis", Channel: "monzo-notify"},
+			{Type: "redis", Channel: "monzo-webhook"},
+			{Type: "file", Path: "/var/log/events.jsonl"},
+		},
+		Alerts:   AlertConfig{Channel: "monzo-alerts"},
+		Commands: CommandsConfig{Channel: "monzo-commands", ResultsChannel: "monzo-command-results", Actions: []string{"deposit"}},
+		Dedup:    DedupConfig{Enabled: true},
+		Failover: FailoverConfig{Enabled: true, KeyPrefix: "ha:"},
+		MonzoAPI: MonzoAPIConfig{Tokens: MonzoTokenConfig{Store: "redis"}},
+	}
+	required := func(monzoAPI bool) string {
+		var got []string
+		for _, permission := range requiredRedisPermissions(cfg, monzoAPI) {
+			got = append(got, fmt.Sprintf("%s %s (%s)", permission.Command, permission.Target, permission.Setting))
+		}
+		return strings.Join(got, "\n")
+	}
+
+	expected := []string{
+		"PUBLISH monzo-webhook (channel)",
+		"PUBLISH monzo-joint (accounts[acc_1].channel)",
+		"PUBLISH monzo-big (rules[big].channel)",
+		"PUBLISH monzo-notify (sinks[0].channel)",
+		"PUBLISH monzo-alerts (alerts.channel)",
+		"XADD monzo-events (stream.name)",
+		"XLEN monzo-events (stream.name)",
+		"XRANGE monzo-events (stream.name)",
+		"EXISTS monzo-events (stream.name)",
+		"XINFO monzo-events (stream.name)",
+		"XTRIM monzo-events (stream.max_age)",
+		"SET monzo-webhook:dedup:* (dedup)",
+		"GET monzo-webhook:dedup:* (dedup)",
+		"DEL monzo-webhook:dedup:* (dedup)",
+		"SET ha:lease (failover)",
+		"EVALSHA ha:lease (failover)",
+		"EVAL ha:lease (failover)",
+		"GET ha:lease (failover)",
+		"PEXPIRE ha:lease (failover)",
+		"EXISTS ha:published:* (failover)",
+		"SET ha:published:* (failover)",
+		"GET monzo-webhook:monzo-tokens (monzo_api.tokens)",
+		"SET monzo-webhook:monzo-tokens (monzo_api.tokens)",
+		"GET monzo-webhook:monzo-tokens:acc_1 (accounts[acc_1].tokens)",
+		"SET monzo-webhook:monzo-tokens:acc_1 (accounts[acc_1].tokens)",
+		"HGETALL monzo-webhook:feature-flags (feature_flags)",
+		"HSET monzo-webhook:feature-flags (feature_flags)",
+		"HDEL monzo-webhook:feature-flags (feature_flags)",
+		"SMEMBERS monzo-webhook:muted-merchants (muted merchants)",
+		"SADD monzo-webhook:muted-merchants (muted merchants)",
+		"SREM monzo-webhook:muted-merchants (muted merchants)",
+		"HGETALL monzo-webhook:merchant-aliases (merchant aliases)",
+		"HSET monzo-webhook:merchant-aliases (merchant aliases)",
+		"HDEL monzo-webhook:merchant-aliases (merchant aliases)",
+		"HGETALL monzo-webhook:splits (splits)",
+		"HSET monzo-webhook:splits (splits)",
+		"HDEL monzo-webhook:splits (splits)",
+	}
+	if got := required(false); got != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), got)
+	}
+
+	// The API cache and commands need the Monzo API client
+	got := required(true)
+	for _, permission := range []string{
+		"GET monzo-webhook:monzo-api:* (monzo_api.cache)",
+		"SUBSCRIBE monzo-commands (commands.channel)",
+		"SET monzo-webhook:command:* (commands.channel)",
+		"INCRBY monzo-webhook:deposits:* (commands.max_deposit_total)",
+		"PUBLISH monzo-command-results (commands.results_channel)",
+	} {
+		if !strings.Contains(got, permission) {
+			t.Errorf("Expected %q with the Monzo API, got:\n%s", permission, got)
+		}
+	}
+}
+
+func TestDeniedRedisPermissions(t *testing.T) {
+	required := []redisPermission{
+		{Command: "PUBLISH", Target: "monzo-webhook"},
+		{Command: "PUBLISH", Target: "monzo-alerts"},
+		{Command: "XADD", Target: "monzo-events"},
+		{Command: "SUBSCRIBE", Target: "monzo-commands"},
+	}
+	var queued []string
+	denied, err := deniedRedisPermissions(required, func(args ...interface{}) error {
+		queued = append(queued, fmt.Sprint(args...))
+		switch args[1] {
+		case "monzo-alerts":
+			return errors.New("NOPERM No permissions to access a channel")
+		case "monzo-events":
+			return errors.New("NOPERM User monzo has no permissions to run the 'xadd' command")
+		case "monzo-commands":
+			return errors.New("ERR Command not allowed inside a transaction")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(denied) != 2 || denied[0].Target != "monzo-alerts" || denied[1].Target != "monzo-events" {
+		t.Errorf("Expected monzo-alerts and monzo-events to be denied, got %+v", denied)
+	}
+	if len(queued) != 4 || !strings.HasPrefix(queued[2], "XADD") {
+		t.Errorf("Expected each command to be queued, got %q", queued)
+	}
+	if testutil.ToFloat64(redisPermissionMissing.WithLabelValues("PUBLISH", "monzo-alerts")) != 1 || testutil.ToFloat64(redisPermissionMissing.WithLabelValues("PUBLISH", "monzo-webhook")) != 0 {
+		t.Error("Expected the missing permissions to be reported in the metric")
+	}
+
+	_, err = deniedRedisPermissions(required, func(args ...interface{}) error { return errors.New("connection reset") })
+	if err == nil || !strings.Contains(err.Error(), "PUBLISH monzo-webhook") {
+		t.Errorf("Expected other errors to stop the check, got %v", err)
+	}
+}
+
+func TestRedisACLRule(t *testing.T) {
+	denied := []redisPermission{
+		{Command: "XADD", Target: "monzo-events"},
+		{Command: "PUBLISH", Target: "monzo-webhook"},
+		{Command: "PUBLISH", Target: "monzo-alerts"},
+		{Command: "SET", Target: "monzo-webhook:dedup:*"},
+		{Command: "GET", Target: "monzo-webhook:dedup:*"},
+		{Command: "SUBSCRIBE", Target: "monzo-commands"},
+	}
+	expected := "ACL SETUSER monzo +get +publish +set +subscribe +xadd &monzo-webhook &monzo-alerts &monzo-commands ~monzo-events ~monzo-webhook:dedup:*"
+	if got := redisACLRule("monzo", denied); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := redisACLRule("", denied[1:2]); got != "ACL SETUSER default +publish &monzo-webhook" {
+		t.Errorf("Expected the default user, got %q", got)
+	}
+}
+
+func TestRedisPermissionArgs(t *testing.T) {
+	tests := []struct {
+		permission redisPermission
+		expected   string
+	}{
+		{redisPermission{Command: "PUBLISH", Target: "monzo-*"}, "PUBLISH monzo-* "},
+		{redisPermission{Command: "GET", Target: "monzo-webhook:dedup:*"}, "GET monzo-webhook:dedup:permission-check"},
+		{redisPermission{Command: "SET", Target: "ha:lease"}, "SET ha:lease permission-check NX PX 1"},
+		{redisPermission{Command: "XINFO", Target: "monzo-events"}, "XINFO GROUPS monzo-events"},
+		{redisPermission{Command: "EVAL", Target: "ha:lease"}, "EVAL return 0 1 ha:lease"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.permission.Command, func(t *testing.T) {
+			var got []string
+			for _, arg := range tt.permission.args() {
+				got = append(got, fmt.Sprint(arg))
+			}
+			if strings.Join(got, " ") != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, strings.Join(got, " "))
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// monzoWebhook is a webhook registered with the Monzo API
+type monzoWebhook struct {
+	ID        string `json:"id"`
+	AccountID string `json:"account_id"`
+	URL       string `json:"url"`
+}
+
+// webhooks lists the webhooks registered for an account
+func (c *monzoClient) webhooks(ctx context.Context, accountID string) ([]monzoWebhook, error) {
+	var result struct {
+		Webhooks []monzoWebhook `json:"webhooks"`
+	}
+	err := c.do(ctx, "webhooks", http.MethodGet, "/webhooks", url.Values{"account_id": {accountID}}, &result)
+	return result.Webhooks, err
+}
+
+// registerWebhook registers a webhook for an account
+func (c *monzoClient) registerWebhook(ctx context.Context, accountID, webhookURL string) (monzoWebhook, error) {
+	var result struct {
+		Webhook monzoWebhook `json:"webhook"`
+	}
+	form := url.Values{"account_id": {accountID}, "url": {webhookURL}}
+	err := c.do(ctx, "register_webhook", http.MethodPost, "/webhooks", form, &result)
+	return result.Webhook, err
+}
+
+// webhookAccounts returns the accounts to register the webhook for: the
+// configured accounts, or else every open account the token can see
+func webhookAccounts(ctx context.Context, client *monzoClient, accounts []AccountConfig) ([]string, error) {
+	var ids []string
+	for _, account := range accounts {
+		ids = append(ids, account.ID)
+	}
+	if len(ids) > 0 {
+		return ids, nil
+	}
+	found, err := client.accounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return openAccountIDs(found), nil
+}
+
+// openAccountIDs returns the IDs of the accounts that aren't closed
+func openAccountIDs(found []monzoAccount) []string {
+	var ids []string
+	for _, account := range found {
+		if !account.Closed {
+			ids = append(ids, account.ID)
+		}
+	}
+	return ids
+}
+
+// discoverAccounts lists the accounts the Monzo API's token can see, once
+// the service has been authorised: it logs them, so that unlabelled ones
+// can be named in the config, reads the configured accounts' details for
+// their labels, and registers webhookURL, if set, for the configured
+// accounts or else every open one. Configured accounts with tokens of their
+// own are left to their own client.
+func discoverAccounts(ctx context.Context, client *monzoClient, webhookURL string) error {
+	found, err := client.accounts(ctx)
+	if err != nil {
+		return err
+	}
+	accounts := currentConfig().Accounts
+	served := client.servedAccounts(accounts)
+	var others []string
+	for _, account := range accounts {
+		if !slices.Contains(served, account.ID) {
+			others = append(others, account.ID)
+		}
+	}
+	knownAccounts.set(found, accounts, others)
+	for _, account := range found {
+		if account.Closed {
+			continue
+		}
+		accountType := accountTypes[account.Type]
+		if accountType == "" {
+			accountType = account.Type
+		}
+		if label, _ := knownAccounts.lookup(accounts, account.ID); label != "" {
+			logInfo("Discovered Monzo account %s: type=%s label=%s", account.ID, accountType, label)
+		} else {
+			logInfo("Discovered Monzo account %s: type=%s - add it to accounts in the config to label its events", account.ID, accountType)
+		}
+	}
+
+	if webhookURL == "" {
+		return nil
+	}
+	ids := served
+	if len(accounts) == 0 {
+		ids = openAccountIDs(found)
+	}
+	return registerWebhooks(ctx, client, webhookURL, ids)
+}
+
+// registerWebhooks registers webhookURL with Monzo for each account that
+// doesn't already have it, logging the registration IDs. An account that
+// fails doesn't stop the others from being registered.
+func registerWebhooks(ctx context.Context, client *monzoClient, webhookURL string, accountIDs []string) error {
+	var errs []error
+	for _, accountID := range accountIDs {
+		client := client.forAccount(accountID)
+		registered, err := client.webhooks(ctx, accountID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", accountID, err))
+			continue
+		}
+		existing := ""
+		for _, webhook := range registered {
+			if webhook.URL == webhookURL {
+				existing = webhook.ID
+				break
+			}
+		}
+		if existing != "" {
+			logInfo("Webhook already registered with Monzo for account %s: id=%s", accountID, existing)
+			continue
+		}
+
+		webhook, err := client.registerWebhook(ctx, accountID, webhookURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", accountID, err))
+			continue
+		}
+		logInfo("Registered webhook with Monzo for account %s: id=%s url=%s", accountID, webhook.ID, redactURL(webhookURL))
+	}
+	return errors.Join(errs...)
+}
+
+// discoverApprovedAccounts runs discoverAccounts until it succeeds or ctx is
+// done. The Monzo API refuses requests after authorisation until the user
+// approves access in the Monzo app, so failures are retried every interval.
+func discoverApprovedAccounts(ctx context.Context, client *monzoClient, webhookURL string, interval time.Duration) error {
+	for {
+		err := discoverAccounts(ctx, client, webhookURL)
+		if err == nil {
+			return nil
+		}
+		logWarn("Error discovering Monzo accounts, retrying until access is approved in the Monzo app: %v", err)
+		if sleepErr := sleepContext(ctx, interval); sleepErr != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// configWatchInterval is how often the config file is checked for changes
+const configWatchInterval = 5 * time.Second
+
+// reloadableSections are the sections of the config file, by JSON name, that
+// are applied when it is reloaded. Changes to the others take effect after a
+// restart.
+var reloadableSections = map[string]bool{
+	"channel":         true,
+	"tenants":         true,
+	"priorities":      true,
+	"sinks":           true,
+	"alerts":          true,
+	"retry":           true,
+	"strict_decoding": true,
+	"event_types":     true,
+	"publish_when":    true,
+	"webhook_test":    true,
+	"rules":           true,
+	"transform":       true,
+	"feature_flags":   true,
+	"request_budget":  true,
+	"script":          true,
+	"profiles":        true,
+	"sink_profiles":   true,
+}
+
+// configMu guards eventConfig and sinks once the server is running, so that a
+// reload replaces them together
+var configMu sync.RWMutex
+
+var configReloads = metrics.newCounterVec("monzo_webhook_config_reloads_total",
+	"Reloads of the config file, by result.", "result")
+
+// currentConfig returns the event configuration, which is replaced when the
+// config file is reloaded
+func currentConfig() EventConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return eventConfig
+}
+
+// currentSinks returns the sinks events are published to
+func currentSinks() []sinkEntry {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return sinks
+}
+
+// configSink is a sink created from the config file, kept so that it is
+// reused when the file is reloaded without changing it
+type configSink struct {
+	cfg   SinkConfig
+	entry sinkEntry
+}
+
+// configSinks are the sinks created from the config file, in order
+var configSinks []configSink
+
+// newConfigSinks creates the sinks from the config file, starting with the
+// Redis channel from the top-level settings, which tenants' own channels take
+// precedence over. Sinks that are unchanged from previous are reused, and a
+// changed Redis sink keeps its spool.
+func newConfigSinks(cfg EventConfig, client *redis.Client, previous []configSink) ([]configSink, error) {
+	reuse := make(map[string]configSink, len(previous))
+	for _, s := range previous {
+		reuse[s.entry.sink.Name()] = s
+	}
+
+	specs := cfg.Sinks
+	if cfg.Channel != "" {
+		specs = append([]SinkConfig{{Type: "redis", Name: "redis", Channel: cfg.Channel}}, cfg.Sinks...)
+	}
+
+	var result []configSink
+	for i, spec := range specs {
+		if spec.Type == "redis" && client == nil {
+			logWarn("Skipping Redis sink for channel '%s' - Redis is not connected", spec.Channel)
+			continue
+		}
+		name := spec.Name
+		if name == "" {
+			name = spec.Type
+		}
+		prev, ok := reuse[name]
+		if ok && reflect.DeepEqual(prev.cfg, spec) {
+			result = append(result, prev)
+			continue
+		}
+
+		sink, err := newConfiguredSink(spec, client)
+		if err != nil {
+			return nil, fmt.Errorf("%s sink: %w", spec.Type, err)
+		}
+		if cfg.Channel != "" && i == 0 {
+			sink.(*redisSink).routed = true
+		}
+		// Spool events for optional Redis sinks to disk while Redis is unavailable
+		if spec.Type == "redis" && !spec.Required && cfg.Spool.Dir != "" {
+			if spooling, ok := prev.entry.sink.(*spoolingSink); ok {
+				sink = &spoolingSink{sink: sink, spool: spooling.spool}
+			} else if sink, err = newSpoolingSink(sink, cfg.Spool); err != nil {
+				return nil, fmt.Errorf("opening spool for sink '%s': %w", name, err)
+			}
+		}
+		result = append(result, configSink{cfg: spec, entry: sinkEntry{sink: sink, required: spec.Required, when: spec.When, profile: spec.Profile, flag: spec.Flag, sample: spec.Sample}})
+	}
+	return result, nil
+}
+
+// closeSink releases the files held by a sink that was replaced or removed,
+// unless its spool is still in use
+func closeSink(sink Sink, spoolsInUse map[*spool]bool) {
+	switch s := sink.(type) {
+	case *spoolingSink:
+		if !spoolsInUse[s.spool] {
+			if pending := s.spool.Pending(); pending > 0 {
+				logWarn("Sink '%s' was removed with %d spooled events, which are kept until it is added again", s.Name(), pending)
+			}
+			s.spool.Close()
+		}
+		closeSink(s.sink, spoolsInUse)
+	case *notificationSink:
+		closeSink(s.sink, spoolsInUse)
+	case *fileSink:
+		if err := s.Close(); err != nil {
+			logWarn("Error closing sink '%s': %v", s.Name(), err)
+		}
+	case *s3ArchiveSink:
+		s.Close()
+	}
+}
+
+// changedSections compares two configurations, returning the sections that
+// differ, split into those that can be reloaded and those that need a restart
+func changedSections(current, next EventConfig) (reloadable, restart []string) {
+	cv, nv := reflect.ValueOf(current), reflect.ValueOf(next)
+	for i := 0; i < cv.NumField(); i++ {
+		if reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(cv.Type().Field(i).Tag.Get("json"), ",")
+		if reloadableSections[name] {
+			reloadable = append(reloadable, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return reloadable, restart
+}
+
+// reloadEventConfig reads the config file again and applies the reloadable
+// sections that have changed, replacing the configuration and sinks
+// together. Settings given by environment variables and flags still take
+// precedence. If the file is invalid, or a sink can't be created, the current
+// configuration is kept.
+func reloadEventConfig(ctx context.Context) error {
+	next, err := readEventConfig(eventConfigFile)
+	if err != nil {
+		return err
+	}
+
+	current := currentConfig()
+	reloadable, restart := changedSections(current, next)
+	if len(restart) > 0 {
+		logWarn("Changes to %s in %s take effect after a restart", strings.Join(restart, ", "), eventConfigFile)
+	}
+	if len(reloadable) == 0 {
+		return nil
+	}
+
+	merged := current
+	mv, nv := reflect.ValueOf(&merged).Elem(), reflect.ValueOf(next)
+	for i := 0; i < mv.NumField(); i++ {
+		name, _, _ := strings.Cut(mv.Type().Field(i).Tag.Get("json"), ",")
+		if reloadableSections[name] {
+			mv.Field(i).Set(nv.Field(i))
+		}
+	}
+
+	built, err := newConfigSinks(merged, redisClient, configSinks)
+	if err != nil {
+		return err
+	}
+	previous := make(map[Sink]bool, len(configSinks))
+	for _, s := range configSinks {
+		previous[s.entry.sink] = true
+	}
+	var entries []sinkEntry
+	names := make(map[string]bool)
+	for _, entry := range currentSinks() {
+		if !previous[entry.sink] {
+			entries = append(entries, entry)
+			names[entry.sink.Name()] = true
+		}
+	}
+	inUse := make(map[Sink]bool, len(built))
+	spoolsInUse := make(map[*spool]bool)
+	for _, s := range built {
+		if names[s.entry.sink.Name()] {
+			return fmt.Errorf("duplicate sink name '%s'", s.entry.sink.Name())
+		}
+		names[s.entry.sink.Name()] = true
+		entries = append(entries, s.entry)
+		inUse[s.entry.sink] = true
+		if spooling, ok := s.entry.sink.(*spoolingSink); ok {
+			spoolsInUse[spooling.spool] = true
+		}
+	}
+
+	configMu.Lock()
+	eventConfig = merged
+	sinks = entries
+	replaced := configSinks
+	configSinks = built
+	configMu.Unlock()
+
+	for _, s := range replaced {
+		if !inUse[s.entry.sink] {
+			closeSink(s.entry.sink, spoolsInUse)
+		}
+	}
+	logInfo("Reloaded %s from %s", strings.Join(reloadable, ", "), eventConfigFile)
+	return nil
+}
+
+// fileModTime returns when a file was last modified, or the zero time if it
+// can't be read
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// watchEventConfig reloads the config file on SIGHUP or when it changes,
+// until ctx is cancelled
+func watchEventConfig(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(eventConfigFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			logInfo("Received SIGHUP - reloading %s", eventConfigFile)
+		case <-ticker.C:
+			if fileModTime(eventConfigFile).Equal(modTime) {
+				continue
+			}
+		}
+		modTime = fileModTime(eventConfigFile)
+
+		if err := reloadEventConfig(ctx); err != nil {
+			logError("Error reloading %s, keeping the current configuration: %v", eventConfigFile, err)
+			configReloads.WithLabelValues("error").Inc()
+			continue
+		}
+		configReloads.WithLabelValues("success").Inc()
+	}
+}
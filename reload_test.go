@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangedSections(t *testing.T) {
+	current := EventConfig{Channel: "monzo", Workers: WorkerConfig{Count: 2}}
+	next := EventConfig{
+		Channel:    "monzo-events",
+		Workers:    WorkerConfig{Count: 4},
+		Priorities: []PriorityRule{{Type: "transaction.created", Priority: 10}},
+	}
+
+	reloadable, restart := changedSections(current, next)
+	if !reflect.DeepEqual(reloadable, []string{"channel", "priorities"}) {
+		t.Errorf("Expected channel and priorities to be reloadable, got %v", reloadable)
+	}
+	if !reflect.DeepEqual(restart, []string{"workers"}) {
+		t.Errorf("Expected workers to need a restart, got %v", restart)
+	}
+
+	if reloadable, restart := changedSections(current, current); len(reloadable) != 0 || len(restart) != 0 {
+		t.Errorf("Expected no changes, got %v and %v", reloadable, restart)
+	}
+}
+
+func TestReloadEventConfig(t *testing.T) {
+	origConfig := eventConfig
+	origFile := eventConfigFile
+	origSinks := sinks
+	origConfigSinks := configSinks
+	origClient := redisClient
+	defer func() {
+		eventConfig = origConfig
+		eventConfigFile = origFile
+		sinks = origSinks
+		configSinks = origConfigSinks
+		redisClient = origClient
+	}()
+
+	dir := t.TempDir()
+	eventConfigFile = filepath.Join(dir, "config.json")
+	writeConfig := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(eventConfigFile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(dir, "archive.jsonl")
+	audit := filepath.Join(dir, "audit.jsonl")
+
+	_, redisClient = newFakeRedis(t)
+	eventConfig = EventConfig{
+		Channel: "monzo",
+		Workers: WorkerConfig{Count: 2},
+		Sinks:   []SinkConfig{{Type: "file", Name: "archive", Path: archive}},
+	}
+	var err error
+	configSinks, err = newConfigSinks(eventConfig, redisClient, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	static := &fakeSink{name: "kafka"}
+	sinks = []sinkEntry{{sink: static}}
+	for _, s := range configSinks {
+		sinks = append(sinks, s.entry)
+	}
+	archiveSink := configSinks[1].entry.sink
+
+	// Reloadable sections are applied, and unchanged sinks are kept
+	writeConfig(`{
+		"channel": "monzo-events",
+		"workers": {"count": 4},
+		"priorities": [{"type": "transaction.created", "priority": 10}],
+		"sinks": [
+			{"type": "file", "name": "archive", "path": "` + archive + `"},
+			{"type": "file", "name": "audit", "path": "` + audit + `", "required": true}
+		]
+	}`)
+	if err := reloadEventConfig(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cfg := currentConfig()
+	if cfg.Channel != "monzo-events" || len(cfg.Priorities) != 1 {
+		t.Errorf("Expected the channel and priorities to be reloaded, got %q and %v", cfg.Channel, cfg.Priorities)
+	}
+	if cfg.Workers.Count != 2 {
+		t.Errorf("Expected the worker count to need a restart, got %d", cfg.Workers.Count)
+	}
+
+	current := currentSinks()
+	if len(current) != 4 {
+		t.Fatalf("Expected 4 sinks, got %d", len(current))
+	}
+	if current[0].sink != static {
+		t.Error("Expected sinks not from the config file to be kept")
+	}
+	channel, ok := current[1].sink.(*redisSink)
+	if !ok || channel.channel != "monzo-events" || !channel.routed {
+		t.Errorf("Expected the channel sink to publish to monzo-events, got %+v", current[1].sink)
+	}
+	if current[2].sink != archiveSink {
+		t.Error("Expected the unchanged archive sink to be reused")
+	}
+	if current[3].sink.Name() != "audit" || !current[3].required {
+		t.Errorf("Expected the required audit sink to be added, got %s", current[3].sink.Name())
+	}
+
+	// An invalid file is rejected, keeping the current configuration
+	writeConfig(`{"channel": "other", "sinks": [{"type": "carrier-pigeon"}]}`)
+	if err := reloadEventConfig(context.Background()); err == nil {
+		t.Error("Expected an error for an invalid config file, got nil")
+	}
+	if currentConfig().Channel != "monzo-events" {
+		t.Errorf("Expected the configuration to be kept, got channel %q", currentConfig().Channel)
+	}
+
+	// Removed sinks are closed
+	writeConfig(`{"channel": "monzo-events", "workers": {"count": 4}, "priorities": [{"type": "transaction.created", "priority": 10}]}`)
+	if err := reloadEventConfig(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(currentSinks()) != 2 {
+		t.Errorf("Expected 2 sinks, got %d", len(currentSinks()))
+	}
+	if err := archiveSink.Publish(context.Background(), &webhookEvent{Body: []byte(`{}`)}); err == nil {
+		t.Error("Expected the removed archive sink to be closed")
+	}
+}
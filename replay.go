@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// defaultReplayLimit and maxReplayLimit bound the events replayed by one
+// request
+const (
+	defaultReplayLimit = 1000
+	maxReplayLimit     = 10000
+)
+
+var replayedEvents = metrics.newCounterVec("monzo_webhook_replayed_events_total",
+	"Stored events re-published to the sinks by the admin API, by result (published, dropped, failed).", "result")
+
+// replayResult counts the events replayed by a request
+type replayResult struct {
+	Published int `json:"published"`
+	Dropped   int `json:"dropped"`
+	Failed    int `json:"failed"`
+	// Next is the cursor to continue after when the limit was reached
+	Next string `json:"next,omitempty"`
+}
+
+// replay re-publishes the stored events matching a query to the given sinks.
+// With a speed, events are replayed with the time between them divided by
+// it, rather than as fast as possible. Each event is enriched again and passed through the script and transform,
+// as when it was received, but it isn't deduplicated, compared for changes,
+// split or checked for anomalies, so replays don't repeat alerts.
+func replay(ctx context.Context, source eventSource, query eventQuery, speed float64, entries []sinkEntry) (replayResult, error) {
+	var result replayResult
+	stored, next, err := source.queryEvents(ctx, query)
+	if err != nil {
+		return result, err
+	}
+	result.Next = next
+
+	// Time is simulated from the first event's, at the replay's speed
+	var simulated Clock
+	if speed > 0 && len(stored) > 0 {
+		simulated = newSimulatedClock(stored[0].ReceivedAt, speed)
+	}
+
+	cfg := currentConfig()
+	for _, s := range stored {
+		if simulated != nil {
+			if err := sleepUntil(ctx, simulated, s.ReceivedAt); err != nil {
+				return result, err
+			}
+		}
+		// Events that were filtered out when they were received weren't
+		// published then either
+		if s.FilteredBy != "" {
+			replayedEvents.WithLabelValues("dropped").Inc()
+			result.Dropped++
+			continue
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(s.Body, &payload); err != nil {
+			logWarn("Skipping unreadable stored event %s: %v", s.ID, err)
+			replayedEvents.WithLabelValues("failed").Inc()
+			result.Failed++
+			continue
+		}
+		// Payloads stored after they were published have been enriched
+		revertEnrichments(payload)
+		body, err := json.Marshal(payload)
+		if err != nil {
+			replayedEvents.WithLabelValues("failed").Inc()
+			result.Failed++
+			continue
+		}
+		event := &webhookEvent{
+			ID:        s.ID,
+			Type:      s.Type,
+			AccountID: accountIDFromPayload(payload),
+			Body:      body,
+			Payload:   payload,
+			Received:  s.ReceivedAt,
+			Encoding:  s.Delivery.Encoding,
+		}
+
+		applyCELRules(matchingCELRules(cfg.Rules, payload), event)
+		for _, enrichment := range receiveEnrichments {
+			enrichment.fn(event)
+		}
+		for _, enrichment := range processEnrichments {
+			enrichment.fn(ctx, event)
+		}
+		if !runScript(ctx, cfg.Script, event) {
+			replayedEvents.WithLabelValues("dropped").Inc()
+			result.Dropped++
+			continue
+		}
+		if err := publishToSinks(ctx, entries, cfg.Transform, event); err != nil {
+			replayedEvents.WithLabelValues("failed").Inc()
+			return result, fmt.Errorf("publishing event %s: %w", s.ID, err)
+		}
+		replayedEvents.WithLabelValues("published").Inc()
+		result.Published++
+	}
+	return result, nil
+}
+
+// adminReplayHandler replays stored events with POST and query parameters
+// like ?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z&type=transaction.*,
+// optionally limited to some sinks with sink=kafka. It responds once they're
+// published.
+func adminReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	query, err := parseEventQuery(params, defaultReplayLimit, maxReplayLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var speed float64
+	if value := params.Get("speed"); value != "" {
+		speed, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(speed > 0) || math.IsInf(speed, 0) {
+			http.Error(w, "speed must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := currentSinks()
+	if names := params["sink"]; len(names) > 0 {
+		var selected []sinkEntry
+		for _, name := range names {
+			found := false
+			for _, entry := range entries {
+				if entry.sink.Name() == name {
+					selected = append(selected, entry)
+					found = true
+				}
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("unknown sink '%s'", name), http.StatusBadRequest)
+				return
+			}
+		}
+		entries = selected
+	}
+
+	result, err := replay(r.Context(), storedEventSource, query, speed, entries)
+	if errors.Is(err, errInvalidEventCursor) {
+		http.Error(w, "after must be a previous response's next", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logError("Error replaying stored events: %v", err)
+		http.Error(w, "Error replaying stored events", http.StatusServiceUnavailable)
+		return
+	}
+	logInfo("Replayed stored events: published=%d dropped=%d failed=%d", result.Published, result.Dropped, result.Failed)
+	writeJSON(w, http.StatusOK, result)
+}
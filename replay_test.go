@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newReplayStore returns an event store holding an event a minute from
+// 09:00 for each of the given types
+func newReplayStore(t *testing.T, types ...string) *eventStore {
+	store, err := openEventStore(StoreConfig{Path: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+
+	for i, eventType := range types {
+		event := &webhookEvent{
+			ID:       fmt.Sprintf("evt_%d", i+1),
+			Type:     eventType,
+			Received: time.Date(2024, 3, 1, 9, i, 0, 0, time.UTC),
+		}
+		body := fmt.Sprintf(`{"type":%q,"data":{"id":"tx_%d","account_id":"acc_1"}}`, eventType, i+1)
+		if i == 2 {
+			body = "not json"
+		}
+		store.record(event, []byte(body), storedDelivery{}, "")
+	}
+	return store
+}
+
+func TestEventStoreQueryEvents(t *testing.T) {
+	store := newReplayStore(t, "transaction.created", "account.balance_updated", "transaction.updated", "transaction.created")
+
+	tests := []struct {
+		name       string
+		query      eventQuery
+		expectIDs  []string
+		expectNext string
+	}{
+		{
+			name:      "Every event",
+			query:     eventQuery{Limit: 10},
+			expectIDs: []string{"evt_1", "evt_2", "evt_3", "evt_4"},
+		},
+		{
+			name:       "Limited",
+			query:      eventQuery{Limit: 2},
+			expectIDs:  []string{"evt_1", "evt_2"},
+			expectNext: "2",
+		},
+		{
+			name:      "After a cursor",
+			query:     eventQuery{After: "2", Limit: 10},
+			expectIDs: []string{"evt_3", "evt_4"},
+		},
+		{
+			name:      "Time range",
+			query:     eventQuery{From: time.Date(2024, 3, 1, 9, 1, 0, 0, time.UTC), To: time.Date(2024, 3, 1, 9, 3, 0, 0, time.UTC), Limit: 10},
+			expectIDs: []string{"evt_2", "evt_3"},
+		},
+		{
+			name:       "Types",
+			query:      eventQuery{Types: []string{"transaction.*"}, Limit: 2},
+			expectIDs:  []string{"evt_1", "evt_3"},
+			expectNext: "3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, next, err := store.queryEvents(context.Background(), tt.query)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var ids []string
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.expectIDs) {
+				t.Errorf("Expected %v, got %v", tt.expectIDs, ids)
+			}
+			if next != tt.expectNext {
+				t.Errorf("Expected next %q, got %q", tt.expectNext, next)
+			}
+		})
+	}
+
+	if _, _, err := store.queryEvents(context.Background(), eventQuery{After: "x", Limit: 10}); !errors.Is(err, errInvalidEventCursor) {
+		t.Errorf("Expected an invalid cursor error, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	originalConfig := eventConfig
+	defer func() { eventConfig = originalConfig }()
+	eventConfig = EventConfig{Transform: []TransformRule{{Fields: map[string]string{"id": "data.id"}}}}
+
+	store := newReplayStore(t, "transaction.created", "account.balance_updated", "transaction.updated")
+	sink := &fakeSink{name: "replay"}
+
+	result, err := replay(context.Background(), store, eventQuery{Limit: 10}, 0, []sinkEntry{{sink: sink}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expect := (replayResult{Published: 2, Failed: 1}); result != expect {
+		t.Errorf("Expected %+v, got %+v", expect, result)
+	}
+	if sink.count() != 2 {
+		t.Fatalf("Expected 2 published events, got %d", sink.count())
+	}
+	if got := sink.events[0]; got.ID != "evt_1" || got.AccountID != "acc_1" || string(got.Body) != `{"id":"tx_1"}` {
+		t.Errorf("Expected the stored event, transformed, got %s %s %s", got.ID, got.AccountID, got.Body)
+	}
+
+	// At a speed, events are replayed with the time between them, scaled
+	paced := &fakeSink{name: "replay-paced"}
+	began := time.Now()
+	result, err = replay(context.Background(), store, eventQuery{Limit: 10}, 6000, []sinkEntry{{sink: paced}})
+	if err != nil || result.Published != 2 {
+		t.Fatalf("Expected 2 published events, got %+v, %v", result, err)
+	}
+	if elapsed := time.Since(began); elapsed < 15*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 2 minutes at 6000x to take 20ms, took %v", elapsed)
+	}
+
+	// A failing required sink stops the replay
+	failing := &fakeSink{name: "replay-required", err: errors.New("unavailable")}
+	result, err = replay(context.Background(), store, eventQuery{Limit: 10}, 0, []sinkEntry{{sink: failing, required: true}})
+	if err == nil || result.Published != 0 || failing.count() != 1 {
+		t.Errorf("Expected the replay to stop at the first event, got %+v, %v", result, err)
+	}
+}
+
+func TestAdminReplayHandler(t *testing.T) {
+	originalSinks, originalSource := sinks, storedEventSource
+	defer func() { sinks, storedEventSource = originalSinks, originalSource }()
+
+	kafka := &fakeSink{name: "kafka"}
+	redis := &fakeSink{name: "redis"}
+	sinks = []sinkEntry{{sink: kafka}, {sink: redis}}
+	storedEventSource = newReplayStore(t, "transaction.created", "account.balance_updated")
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		expect int
+	}{
+		{name: "Wrong method", method: http.MethodGet, expect: http.StatusMethodNotAllowed},
+		{name: "Invalid from", method: http.MethodPost, query: "from=yesterday", expect: http.StatusBadRequest},
+		{name: "To before from", method: http.MethodPost, query: "from=2024-03-02T00:00:00Z&to=2024-03-01T00:00:00Z", expect: http.StatusBadRequest},
+		{name: "Limit too high", method: http.MethodPost, query: "limit=100000", expect: http.StatusBadRequest},
+		{name: "Unknown sink", method: http.MethodPost, query: "sink=sqs", expect: http.StatusBadRequest},
+		{name: "Invalid speed", method: http.MethodPost, query: "speed=0", expect: http.StatusBadRequest},
+		{name: "Invalid cursor", method: http.MethodPost, query: "after=evt_1", expect: http.StatusBadRequest},
+		{name: "Replay to one sink", method: http.MethodPost, query: "type=transaction.*,card.*&sink=kafka&from=2024-03-01T00:00:00Z", expect: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminReplayHandler(w, httptest.NewRequest(tt.method, "/admin/replay?"+tt.query, nil))
+			if w.Code != tt.expect {
+				t.Errorf("Expected status %d, got %d: %s", tt.expect, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if kafka.count() != 1 || redis.count() != 0 {
+		t.Errorf("Expected 1 event replayed to kafka only, got %d and %d", kafka.count(), redis.count())
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultReprocessLimit and maxReprocessLimit bound the events reprocessed by
+// one request
+const (
+	defaultReprocessLimit = 1000
+	maxReprocessLimit     = 10000
+)
+
+var reprocessedEvents = metrics.newCounterVec("monzo_webhook_reprocessed_events_total",
+	"Stored events re-run through the pipeline by the admin API, by result (published, dropped, failed).", "result")
+
+// reprocessRequest selects the stored events to reprocess and the channel to
+// republish them to. After continues from the stream ID a previous request
+// stopped at.
+type reprocessRequest struct {
+	Channel string    `json:"channel"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	After   string    `json:"after"`
+	Types   []string  `json:"types"`
+	Limit   int       `json:"limit"`
+}
+
+// reprocessResult counts the events reprocessed by a request
+type reprocessResult struct {
+	Channel   string `json:"channel"`
+	Published int    `json:"published"`
+	Dropped   int    `json:"dropped"`
+	Failed    int    `json:"failed"`
+	// Next is the stream ID to continue after when the limit was reached
+	Next string `json:"next,omitempty"`
+}
+
+// eventReprocessor re-runs the events stored in the Redis stream through the
+// current pipeline. It is nil unless there's a stream to read from.
+var eventReprocessor *reprocessor
+
+type reprocessor struct {
+	read    func(ctx context.Context, start, end string, count int64) ([]redis.XMessage, error)
+	publish func(ctx context.Context, channel string, body []byte) error
+}
+
+func newReprocessor(client *redis.Client, stream string) *reprocessor {
+	return &reprocessor{
+		read: func(ctx context.Context, start, end string, count int64) ([]redis.XMessage, error) {
+			return client.XRangeN(ctx, stream, start, end, count).Result()
+		},
+		publish: func(ctx context.Context, channel string, body []byte) error {
+			return client.Publish(ctx, channel, body).Err()
+		},
+	}
+}
+
+// revertEnrichments puts back Monzo's values of the fields enrichment
+// replaced, and removes the fields it added, so a stored payload is
+// enriched again as if it had just been received
+func revertEnrichments(payload map[string]interface{}) {
+	delete(payload, "changes")
+	delete(payload, "tags")
+	data, ok := payload["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if original, ok := data["original_description"]; ok {
+		data["description"] = original
+		delete(data, "original_description")
+	}
+	if original, ok := data["monzo_category"]; ok {
+		data["category"] = original
+		delete(data, "monzo_category")
+	}
+	for _, field := range []string{"account_label", "account_details", "pot_name"} {
+		delete(data, field)
+	}
+}
+
+// reprocess re-runs the stored events matching a request through the rules,
+// enrichments, script and transform, and publishes them to its channel.
+// Events aren't deduplicated, compared for changes or published to the
+// configured sinks, so reprocessing has no effect on the live flow.
+func (p *reprocessor) reprocess(ctx context.Context, req reprocessRequest) (reprocessResult, error) {
+	result := reprocessResult{Channel: req.Channel}
+	start, end := "-", "+"
+	switch {
+	case req.After != "":
+		start = "(" + req.After
+	case !req.Since.IsZero():
+		start = strconv.FormatInt(req.Since.UnixMilli(), 10)
+	}
+	if !req.Until.IsZero() {
+		end = strconv.FormatInt(req.Until.UnixMilli(), 10)
+	}
+	entries, err := p.read(ctx, start, end, int64(req.Limit)+1)
+	if err != nil {
+		return result, err
+	}
+	if len(entries) > req.Limit {
+		entries = entries[:req.Limit]
+		result.Next = entries[len(entries)-1].ID
+	}
+
+	types := EventTypeFilter{Allow: req.Types}
+	cfg := currentConfig()
+	for _, entry := range entries {
+		eventType, _ := entry.Values["type"].(string)
+		if len(req.Types) > 0 && !types.allows(eventType) {
+			continue
+		}
+		id, _ := entry.Values["id"].(string)
+		stored, _ := entry.Values["payload"].(string)
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(stored), &payload); err != nil {
+			logWarn("Skipping unreadable stored event %s: %v", entry.ID, err)
+			reprocessedEvents.WithLabelValues("failed").Inc()
+			result.Failed++
+			continue
+		}
+		revertEnrichments(payload)
+		body, err := json.Marshal(payload)
+		if err != nil {
+			reprocessedEvents.WithLabelValues("failed").Inc()
+			result.Failed++
+			continue
+		}
+		received, _ := streamIDTime(entry.ID)
+		event := &webhookEvent{
+			ID:        id,
+			Type:      eventType,
+			AccountID: accountIDFromPayload(payload),
+			Body:      body,
+			Payload:   payload,
+			Received:  received,
+		}
+
+		applyCELRules(matchingCELRules(cfg.Rules, payload), event)
+		for _, enrichment := range receiveEnrichments {
+			enrichment.fn(event)
+		}
+		for _, enrichment := range processEnrichments {
+			enrichment.fn(ctx, event)
+		}
+		if !runScript(ctx, cfg.Script, event) {
+			reprocessedEvents.WithLabelValues("dropped").Inc()
+			result.Dropped++
+			continue
+		}
+		published := transformEvent(cfg.Transform, event)
+		if err := p.publish(ctx, req.Channel, published.Body); err != nil {
+			reprocessedEvents.WithLabelValues("failed").Inc()
+			return result, fmt.Errorf("publishing event %s: %w", id, err)
+		}
+		reprocessedEvents.WithLabelValues("published").Inc()
+		result.Published++
+	}
+	return result, nil
+}
+
+// adminReprocessHandler reprocesses stored events with POST and a body like
+// {"channel": "monzo-reprocessed", "since": "2024-01-01T00:00:00Z",
+// "types": ["transaction.created"]}. It responds once they're published.
+func adminReprocessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req reprocessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Channel == "" {
+		http.Error(w, "channel is required", http.StatusBadRequest)
+		return
+	}
+	if !req.Until.IsZero() && req.Until.Before(req.Since) {
+		http.Error(w, "until must not be before since", http.StatusBadRequest)
+		return
+	}
+	if req.Limit < 0 || req.Limit > maxReprocessLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxReprocessLimit), http.StatusBadRequest)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultReprocessLimit
+	}
+
+	result, err := eventReprocessor.reprocess(r.Context(), req)
+	if err != nil {
+		logError("Error reprocessing stored events: %v", err)
+		http.Error(w, "Error reprocessing stored events", http.StatusServiceUnavailable)
+		return
+	}
+	logInfo("Reprocessed stored events to channel '%s': published=%d dropped=%d failed=%d",
+		req.Channel, result.Published, result.Dropped, result.Failed)
+	writeJSON(w, http.StatusOK, result)
+}
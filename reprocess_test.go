@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRevertEnrichments(t *testing.T) {
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"transaction.created","tags":["big"],"changes":[],"data":{"id":"tx_1",
+		"description":"Amazon","original_description":"AMZN MKTP UK*1A2B3C",
+		"category":"shopping","monzo_category":"general",
+		"account_label":"Joint","account_details":{"type":"uk_retail_joint"},"pot_name":"Holiday"}}`), &payload)
+	revertEnrichments(payload)
+
+	var expect map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"transaction.created","data":{"id":"tx_1","description":"AMZN MKTP UK*1A2B3C","category":"general"}}`), &expect)
+	if !reflect.DeepEqual(payload, expect) {
+		t.Errorf("Expected %v, got %v", expect, payload)
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	originalConfig := eventConfig
+	defer func() { eventConfig = originalConfig }()
+	eventConfig = EventConfig{Transform: []TransformRule{{Fields: map[string]string{"id": "data.id", "description": "data.description"}}}}
+
+	entries := []redis.XMessage{
+		{ID: "1704067200000-0", Values: map[string]interface{}{"id": "evt_1", "type": "transaction.created",
+			"payload": `{"type":"transaction.created","data":{"id":"tx_1","description":"Amazon","original_description":"AMZN"}}`}},
+		{ID: "1704067200000-1", Values: map[string]interface{}{"id": "evt_2", "type": "account.balance_updated", "payload": `{"type":"account.balance_updated"}`}},
+		{ID: "1704067200001-0", Values: map[string]interface{}{"id": "evt_3", "type": "transaction.updated", "payload": `not json`}},
+		{ID: "1704067200002-0", Values: map[string]interface{}{"id": "evt_4", "type": "transaction.created", "payload": `{"data":{"id":"tx_2"}}`}},
+	}
+	var ranges []string
+	var published []string
+	p := &reprocessor{
+		read: func(ctx context.Context, start, end string, count int64) ([]redis.XMessage, error) {
+			ranges = append(ranges, start+" "+end)
+			if int(count) < len(entries) {
+				return entries[:count], nil
+			}
+			return entries, nil
+		},
+		publish: func(ctx context.Context, channel string, body []byte) error {
+			published = append(published, channel+" "+string(body))
+			return nil
+		},
+	}
+
+	result, err := p.reprocess(context.Background(), reprocessRequest{Channel: "monzo-reprocessed", After: "1704060000000-0", Types: []string{"transaction.*"}, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := reprocessResult{Channel: "monzo-reprocessed", Published: 1, Failed: 1, Next: "1704067200001-0"}
+	if result != expect {
+		t.Errorf("Expected %+v, got %+v", expect, result)
+	}
+	if !reflect.DeepEqual(ranges, []string{"(1704060000000-0 +"}) {
+		t.Errorf("Expected to read after the given ID, got %v", ranges)
+	}
+	if !reflect.DeepEqual(published, []string{`monzo-reprocessed {"description":"AMZN","id":"tx_1"}`}) {
+		t.Errorf("Expected the reverted, transformed event, got %v", published)
+	}
+}
+
+func TestAdminReprocessHandlerValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		expect int
+	}{
+		{name: "Wrong method", method: http.MethodGet, expect: http.StatusMethodNotAllowed},
+		{name: "Invalid JSON", method: http.MethodPost, body: `{`, expect: http.StatusBadRequest},
+		{name: "No channel", method: http.MethodPost, body: `{}`, expect: http.StatusBadRequest},
+		{name: "Until before since", method: http.MethodPost, body: `{"channel":"c","since":"2024-02-01T00:00:00Z","until":"2024-01-01T00:00:00Z"}`, expect: http.StatusBadRequest},
+		{name: "Limit too high", method: http.MethodPost, body: `{"channel":"c","limit":100000}`, expect: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminReprocessHandler(w, httptest.NewRequest(tt.method, "/admin/reprocess", strings.NewReader(tt.body)))
+			if w.Code != tt.expect {
+				t.Errorf("Expected status %d, got %d", tt.expect, w.Code)
+			}
+		})
+	}
+}
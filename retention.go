@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RetentionConfig configures pruning of old events from the event store and
+// the spools
+type RetentionConfig struct {
+	// MaxAge is how long events are kept, such as 2160h for 90 days.
+	// Nothing is pruned without it.
+	MaxAge string `json:"max_age"`
+	// Interval is how often events are pruned, defaulting to an hour
+	Interval string `json:"interval"`
+}
+
+var retentionPruned = metrics.newCounterVec("monzo_webhook_retention_pruned_total",
+	"Rows and records deleted by the retention job, by kind (events, purged, state, spool).", "kind")
+
+// validate checks the retention configuration for invalid values
+func (c RetentionConfig) validate() error {
+	if c.MaxAge != "" {
+		if _, err := parsePositiveDuration(c.MaxAge, 0); err != nil {
+			return fmt.Errorf("invalid retention max_age: %w", err)
+		}
+	}
+	if _, err := parsePositiveDuration(c.Interval, time.Hour); err != nil {
+		return fmt.Errorf("invalid retention interval: %w", err)
+	}
+	return nil
+}
+
+// maxAge returns how long events are kept, or zero to keep them forever
+func (c RetentionConfig) maxAge() time.Duration {
+	d, _ := parsePositiveDuration(c.MaxAge, 0)
+	return d
+}
+
+func (c RetentionConfig) interval() time.Duration {
+	d, _ := parsePositiveDuration(c.Interval, time.Hour)
+	return d
+}
+
+// pruneRetained deletes the stored and spooled events received more than
+// maxAge before now, and purges the stored events deleted more than the
+// store's purge delay ago, along with the event store's expired state. With a
+// zero maxAge, deleted events are only purged.
+func pruneRetained(now time.Time, maxAge time.Duration) {
+	cutoff := now.Add(-maxAge)
+	if storedEvents != nil && maxAge > 0 {
+		deletion, err := storedEvents.softDelete(eventQuery{To: cutoff}, "retention", now)
+		if err != nil {
+			logError("Error deleting old events from the event store: %v", err)
+		} else if deletion != nil {
+			retentionPruned.WithLabelValues("events").Add(float64(deletion.Events))
+			logInfo("Deleted %d events received before %s from the event store as %s, to be purged after %s",
+				deletion.Events, cutoff.UTC().Format(time.RFC3339), deletion.ID, deletion.PurgeAt.Format(time.RFC3339))
+		}
+	}
+	if storedEvents != nil {
+		purgeCutoff := now.Add(-storedEvents.purgeDelay)
+		events, err := storedEvents.prune(purgeCutoff)
+		if err != nil {
+			logError("Error purging deleted events from the event store: %v", err)
+		} else if events > 0 {
+			retentionPruned.WithLabelValues("purged").Add(float64(events))
+			logInfo("Purged %d events deleted before %s from the event store", events, purgeCutoff.UTC().Format(time.RFC3339))
+		}
+	}
+	if localState != nil {
+		state, err := localState.prune()
+		if err != nil {
+			logError("Error pruning expired state from the event store: %v", err)
+		} else {
+			retentionPruned.WithLabelValues("state").Add(float64(state))
+		}
+	}
+	if maxAge == 0 {
+		return
+	}
+
+	for _, entry := range currentSinks() {
+		sink, ok := entry.sink.(*spoolingSink)
+		if !ok {
+			continue
+		}
+		pruned, err := sink.spool.Prune(cutoff)
+		if err != nil {
+			logError("Error pruning the spool of sink '%s': %v", sink.Name(), err)
+		}
+		if pruned > 0 {
+			retentionPruned.WithLabelValues("spool").Add(float64(pruned))
+			spoolPending.WithLabelValues(sink.Name()).Set(float64(sink.spool.Pending()))
+			logWarn("Pruned %d spooled events for sink '%s' received before %s, without replaying them", pruned, sink.Name(), cutoff.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// runRetention prunes old events and purges deleted ones every interval until
+// ctx is cancelled
+func runRetention(ctx context.Context, cfg RetentionConfig) {
+	for {
+		pruneRetained(clock.Now(), cfg.maxAge())
+		if sleepUntil(ctx, clock, clock.Now().Add(cfg.interval())) != nil {
+			return
+		}
+	}
+}
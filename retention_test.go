@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetentionConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       RetentionConfig
+		expectErr bool
+	}{
+		{name: "Empty", cfg: RetentionConfig{}},
+		{name: "Valid", cfg: RetentionConfig{MaxAge: "2160h", Interval: "30m"}},
+		{name: "Invalid max_age", cfg: RetentionConfig{MaxAge: "90 days"}, expectErr: true},
+		{name: "Negative max_age", cfg: RetentionConfig{MaxAge: "-1h"}, expectErr: true},
+		{name: "Invalid interval", cfg: RetentionConfig{Interval: "0s"}, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.expectErr {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestEventStorePrune(t *testing.T) {
+	// Events a minute apart from 09:00
+	store := newReplayStore(t, "transaction.created", "transaction.updated", "transaction.created", "account.balance_updated")
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	state, err := openSQLiteState(store.db, func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	state.set(ctx, "changed", "1", 0)
+	state.set(ctx, "changed", "2", 0)
+	state.set(ctx, "deleted", "1", 0)
+	state.del(ctx, "deleted")
+	state.set(ctx, "expiring", "1", time.Minute)
+	state.set(ctx, "kept", "1", time.Hour)
+
+	// Only events deleted before the cutoff are purged
+	if _, err := store.softDelete(eventQuery{To: time.Date(2024, 3, 1, 9, 2, 0, 0, time.UTC)}, "retention", now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	later, err := store.softDelete(eventQuery{Types: []string{"account.balance_updated"}}, "admin", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	events, err := store.prune(now)
+	if err != nil || events != 2 {
+		t.Fatalf("Expected 2 events purged, got %d, %v", events, err)
+	}
+	if pruned, err := state.prune(); err != nil || pruned != 1 {
+		t.Errorf("Expected the expired key to be pruned, got %d, %v", pruned, err)
+	}
+	if _, err := store.restore(later.ID, now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Cursors still point at the same events
+	stored, _, err := store.queryEvents(ctx, eventQuery{After: "3", Limit: 10})
+	if err != nil || len(stored) != 1 || stored[0].ID != "evt_4" {
+		t.Errorf("Expected evt_4 after the cursor, got %v, %v", stored, err)
+	}
+	for key, expect := range map[string]string{"changed": "2", "kept": "1"} {
+		if value, ok, _ := state.get(ctx, key); !ok || value != expect {
+			t.Errorf("Expected %s to be %s, got %q", key, expect, value)
+		}
+	}
+	state.set(ctx, "new", "1", 0)
+	var keys int
+	if err := store.db.QueryRow(`SELECT count(*) FROM state`).Scan(&keys); err != nil || keys != 3 {
+		t.Errorf("Expected 3 keys after pruning, got %d, %v", keys, err)
+	}
+}
+
+func TestSpoolPrune(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 200)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Close()
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		record := spoolRecord{ID: fmt.Sprintf("evt_%d", i), Received: start.Add(time.Duration(i) * time.Hour), Type: "transaction.created", Payload: []byte(`{}`)}
+		if err := s.Append(record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	pruned, err := s.Prune(start.Add(4 * time.Hour))
+	if err != nil || pruned != 4 {
+		t.Fatalf("Expected 4 events pruned, got %d, %v", pruned, err)
+	}
+	if s.Pending() != 2 {
+		t.Errorf("Expected 2 pending events, got %d", s.Pending())
+	}
+	var replayed []string
+	s.Replay(func(record spoolRecord) error {
+		replayed = append(replayed, record.ID)
+		return nil
+	})
+	if fmt.Sprint(replayed) != "[evt_4 evt_5]" {
+		t.Errorf("Expected the newer events to be replayed, got %v", replayed)
+	}
+}
+
+func TestPruneRetained(t *testing.T) {
+	originalEvents, originalState, originalSinks := storedEvents, localState, sinks
+	defer func() { storedEvents, localState, sinks = originalEvents, originalState, originalSinks }()
+
+	storedEvents = newReplayStore(t, "transaction.created", "transaction.updated")
+	localState = nil
+	spooling, err := newSpoolingSink(&fakeSink{name: "retention-spooled"}, SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer spooling.spool.Close()
+	spooling.spool.Append(spoolRecord{ID: "evt_old", Received: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Payload: []byte(`{}`)})
+	sinks = []sinkEntry{{sink: spooling}}
+
+	before := testutil.ToFloat64(retentionPruned.WithLabelValues("events"))
+	beforeSpool := testutil.ToFloat64(retentionPruned.WithLabelValues("spool"))
+	pruneRetained(time.Date(2024, 3, 31, 9, 1, 0, 0, time.UTC), 30*24*time.Hour)
+	if got := testutil.ToFloat64(retentionPruned.WithLabelValues("events")) - before; got != 1 {
+		t.Errorf("Expected 1 event pruned, got %v", got)
+	}
+	if got := testutil.ToFloat64(retentionPruned.WithLabelValues("spool")) - beforeSpool; got != 1 {
+		t.Errorf("Expected 1 spooled event pruned, got %v", got)
+	}
+	if spooling.spool.Pending() != 0 {
+		t.Errorf("Expected no pending events, got %d", spooling.spool.Pending())
+	}
+	var ids []string
+	storedEvents.each(func(event storedEvent) error {
+		ids = append(ids, event.ID)
+		return nil
+	})
+	if fmt.Sprint(ids) != "[evt_2]" {
+		t.Errorf("Expected evt_2 to be kept, got %v", ids)
+	}
+	if files, _ := filepath.Glob(filepath.Join(spooling.spool.dir, "spool-*.jsonl")); len(files) != 0 {
+		t.Errorf("Expected the spool file to be removed, got %v", files)
+	}
+}
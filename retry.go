@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryConfig configures how publishes that fail are retried
+type RetryConfig struct {
+	Attempts       int     `json:"attempts"`
+	InitialBackoff string  `json:"initial_backoff"`
+	MaxBackoff     string  `json:"max_backoff"`
+	Jitter         float64 `json:"jitter"`
+	Timeout        string  `json:"timeout"`
+}
+
+var (
+	sinkRetries = metrics.newCounterVec("monzo_webhook_sink_retries_total",
+		"Publish attempts retried after a failure, by sink.", "sink")
+)
+
+// validate checks the retry configuration for invalid values
+func (c RetryConfig) validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("retry attempts must not be negative")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+	initial, err := parsePositiveDuration(c.InitialBackoff, 100*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("invalid retry initial_backoff: %w", err)
+	}
+	max, err := parsePositiveDuration(c.MaxBackoff, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("invalid retry max_backoff: %w", err)
+	}
+	if max < initial {
+		return fmt.Errorf("retry max_backoff must not be less than initial_backoff")
+	}
+	if _, err := parsePositiveDuration(c.Timeout, 5*time.Second); err != nil {
+		return fmt.Errorf("invalid retry timeout: %w", err)
+	}
+	return nil
+}
+
+// attempts returns the number of attempts per sink, defaulting to 1 (no retries)
+func (c RetryConfig) attempts() int {
+	if c.Attempts == 0 {
+		return 1
+	}
+	return c.Attempts
+}
+
+// timeout returns how long publishing an event may take, including retries,
+// defaulting to 5 seconds
+func (c RetryConfig) timeout() time.Duration {
+	d, _ := parsePositiveDuration(c.Timeout, 5*time.Second)
+	return d
+}
+
+// validateRequestBudget checks the request_budget setting
+func validateRequestBudget(budget string) error {
+	if _, err := parsePositiveDuration(budget, 0); err != nil {
+		return fmt.Errorf("invalid request_budget: %w", err)
+	}
+	return nil
+}
+
+// publishContext returns the context a webhook request publishes its event
+// with. It's cancelled when the request's context is, such as when the client
+// disconnects. With a request budget, the deadline is the end of the budget,
+// counted from when the event was received, or the retry timeout if one is
+// set and ends sooner. Without one, it's the retry timeout.
+func publishContext(parent context.Context, cfg EventConfig, received, now time.Time) (context.Context, context.CancelFunc) {
+	deadline := now.Add(cfg.Retry.timeout())
+	if budget, _ := parsePositiveDuration(cfg.RequestBudget, 0); budget > 0 {
+		if end := received.Add(budget); cfg.Retry.Timeout == "" || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	return context.WithDeadline(parent, deadline)
+}
+
+// backoff returns the delay before the given retry (1 for the first retry).
+// The delay doubles with each retry up to max_backoff, and is then reduced
+// by a random amount of up to jitter times itself.
+func (c RetryConfig) backoff(retry int) time.Duration {
+	initial, _ := parsePositiveDuration(c.InitialBackoff, 100*time.Millisecond)
+	max, _ := parsePositiveDuration(c.MaxBackoff, 2*time.Second)
+
+	d := initial
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if c.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * c.Jitter * float64(d))
+	}
+	return d
+}
+
+// publishResult classifies the outcome of a publish for metrics and traces
+func publishResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, errSpooled):
+		return "spooled"
+	case errors.Is(err, errMuted):
+		return "muted"
+	default:
+		return "error"
+	}
+}
+
+// parsePositiveDuration parses a duration, returning def when s is empty
+func parsePositiveDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// publishWithRetry publishes an event to a sink, retrying failures with
+// exponential backoff until the attempts run out or ctx is done. Spooled
+// events are not retried, as the spool replays them itself.
+func publishWithRetry(ctx context.Context, cfg RetryConfig, sink Sink, event *webhookEvent) error {
+	attempts := cfg.attempts()
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		err := sink.Publish(ctx, event)
+		eventTraces.recordSinkAttempt(event.ID, sink.Name(), attempt, started, publishResult(err), err)
+		if err == nil || errors.Is(err, errSpooled) || errors.Is(err, errMuted) || attempt >= attempts {
+			return err
+		}
+
+		delay := cfg.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		logWarn("Attempt %d/%d to publish %s event %s to sink '%s' failed, retrying in %v: %v",
+			attempt, attempts, event.Type, event.ID, sink.Name(), delay, err)
+		sinkRetries.WithLabelValues(sink.Name()).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
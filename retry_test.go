@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// flakySink fails its first failures publishes, then succeeds
+type flakySink struct {
+	fakeSink
+	failures int
+}
+
+func (s *flakySink) Publish(ctx context.Context, event *webhookEvent) error {
+	s.fakeSink.Publish(ctx, event)
+	if s.count() <= s.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestRetryConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      RetryConfig
+		expectError bool
+	}{
+		{name: "Defaults", config: RetryConfig{}},
+		{name: "Valid", config: RetryConfig{Attempts: 5, InitialBackoff: "50ms", MaxBackoff: "1s", Jitter: 0.5, Timeout: "10s"}},
+		{name: "Negative attempts", config: RetryConfig{Attempts: -1}, expectError: true},
+		{name: "Jitter above 1", config: RetryConfig{Jitter: 1.5}, expectError: true},
+		{name: "Max backoff below initial", config: RetryConfig{InitialBackoff: "1s", MaxBackoff: "500ms"}, expectError: true},
+		{name: "Invalid timeout", config: RetryConfig{Timeout: "-1s"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRetryConfigBackoff(t *testing.T) {
+	cfg := RetryConfig{InitialBackoff: "100ms", MaxBackoff: "1s"}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, want := range expected {
+		if got := cfg.backoff(i + 1); got != want {
+			t.Errorf("Retry %d: expected %v, got %v", i+1, want, got)
+		}
+	}
+
+	cfg.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := cfg.backoff(3); got < 200*time.Millisecond || got > 400*time.Millisecond {
+			t.Fatalf("Expected a jittered backoff between 200ms and 400ms, got %v", got)
+		}
+	}
+}
+
+func TestPublishWithRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		attempts      int
+		expectedCalls int
+		expectError   bool
+	}{
+		{name: "No retries by default", failures: 1, expectedCalls: 1, expectError: true},
+		{name: "Succeeds after retries", failures: 2, attempts: 3, expectedCalls: 3},
+		{name: "Gives up after all attempts", failures: 5, attempts: 3, expectedCalls: 3, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &flakySink{fakeSink: fakeSink{name: "flaky"}, failures: tt.failures}
+			cfg := RetryConfig{Attempts: tt.attempts, InitialBackoff: "1ms", MaxBackoff: "2ms"}
+
+			err := publishWithRetry(context.Background(), cfg, sink, &webhookEvent{Type: "transaction.created"})
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if sink.count() != tt.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tt.expectedCalls, sink.count())
+			}
+		})
+	}
+}
+
+func TestPublishWithRetryStopsAtDeadline(t *testing.T) {
+	sink := &fakeSink{name: "down", err: errors.New("connection refused")}
+	cfg := RetryConfig{Attempts: 10, InitialBackoff: "1s", MaxBackoff: "1s"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := publishWithRetry(ctx, cfg, sink, &webhookEvent{}); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected to give up without waiting past the deadline, took %v", elapsed)
+	}
+	if sink.count() != 1 {
+		t.Errorf("Expected 1 call, got %d", sink.count())
+	}
+}
+
+func TestPublishWithRetryDoesNotRetrySpooled(t *testing.T) {
+	sink := &fakeSink{name: "redis", err: fmt.Errorf("%w: connection refused", errSpooled)}
+	cfg := RetryConfig{Attempts: 3, InitialBackoff: "1ms"}
+
+	if err := publishWithRetry(context.Background(), cfg, sink, &webhookEvent{}); !errors.Is(err, errSpooled) {
+		t.Errorf("Expected the spooled error, got %v", err)
+	}
+	if sink.count() != 1 {
+		t.Errorf("Expected 1 call, got %d", sink.count())
+	}
+}
+
+func TestPublishContext(t *testing.T) {
+	received := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	now := received.Add(time.Second)
+
+	tests := []struct {
+		name     string
+		cfg      EventConfig
+		deadline time.Time
+	}{
+		{name: "Default retry timeout", deadline: now.Add(5 * time.Second)},
+		{name: "Retry timeout", cfg: EventConfig{Retry: RetryConfig{Timeout: "2s"}}, deadline: now.Add(2 * time.Second)},
+		{name: "Budget from when received", cfg: EventConfig{RequestBudget: "8s"}, deadline: received.Add(8 * time.Second)},
+		{name: "Budget ends before the retry timeout", cfg: EventConfig{RequestBudget: "3s", Retry: RetryConfig{Timeout: "10s"}}, deadline: received.Add(3 * time.Second)},
+		{name: "Retry timeout ends before the budget", cfg: EventConfig{RequestBudget: "10s", Retry: RetryConfig{Timeout: "2s"}}, deadline: now.Add(2 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := publishContext(context.Background(), tt.cfg, received, now)
+			defer cancel()
+			if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(tt.deadline) {
+				t.Errorf("Expected deadline %v, got %v", tt.deadline, deadline)
+			}
+		})
+	}
+
+	t.Run("Cancelled with the request", func(t *testing.T) {
+		parent, cancelRequest := context.WithCancel(context.Background())
+		ctx, cancel := publishContext(parent, EventConfig{}, time.Now(), time.Now())
+		defer cancel()
+		cancelRequest()
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			t.Errorf("Expected the publish to be cancelled with the request, got %v", ctx.Err())
+		}
+	})
+}
+
+func TestValidateRequestBudget(t *testing.T) {
+	for budget, valid := range map[string]bool{"": true, "8s": true, "0s": false, "soon": false} {
+		if err := validateRequestBudget(budget); (err == nil) != valid {
+			t.Errorf("validateRequestBudget(%q) = %v, expected valid=%v", budget, err, valid)
+		}
+	}
+}
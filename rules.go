@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+var ruleMatches = metrics.newCounterVec("monzo_webhook_rule_matches_total",
+	"Events matching each CEL rule, by rule name.", "rule")
+
+// CELRule is a condition on an event's payload, written in CEL, with what to
+// do with the events that match it. Every matching rule applies, so one rule
+// can tag events that another routes.
+type CELRule struct {
+	Name string `json:"name"`
+	// When is a CEL expression over the payload, such as
+	// event.type == 'transaction.created' && data.amount < -10000
+	When string `json:"when"`
+	// Drop stops matching events from being published
+	Drop bool `json:"drop"`
+	// Channel routes matching events to a Redis channel, instead of their
+	// account's, tenant's or the top-level channel
+	Channel string `json:"channel"`
+	// Tags are added to the payload's top-level tags
+	Tags []string `json:"tags"`
+}
+
+// validateCELRules checks that the rules are named, compile and do something
+func validateCELRules(rules []CELRule) error {
+	names := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d must have a name", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule '%s' is configured more than once", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.When == "" {
+			return fmt.Errorf("rule '%s' must have a when expression", rule.Name)
+		}
+		if _, err := compileCEL(rule.When); err != nil {
+			return fmt.Errorf("rule '%s': invalid when expression: %w", rule.Name, err)
+		}
+		if !rule.Drop && rule.Channel == "" && len(rule.Tags) == 0 {
+			return fmt.Errorf("rule '%s' must drop, route or tag events", rule.Name)
+		}
+	}
+	return nil
+}
+
+// matches reports whether an event's payload matches the rule. Expressions
+// that fail, such as by reading a field the payload doesn't have, don't.
+func (r CELRule) matches(payload map[string]interface{}) bool {
+	expr, err := compileCEL(r.When)
+	if err != nil {
+		return false
+	}
+	matched, err := evalCELBool(expr, payload)
+	if err != nil {
+		logDebug("Rule '%s' didn't match: %v", r.Name, err)
+		return false
+	}
+	return matched
+}
+
+// droppingRule returns the first matching rule that drops events, or nil
+func droppingRule(rules []CELRule, payload map[string]interface{}) *CELRule {
+	for i, rule := range rules {
+		if rule.Drop && rule.matches(payload) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// matchingCELRules returns the rules an event's payload matches
+func matchingCELRules(rules []CELRule, payload map[string]interface{}) []CELRule {
+	var matched []CELRule
+	for _, rule := range rules {
+		if rule.matches(payload) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// applyCELRules routes and tags an event as the rules it matched say. The
+// first rule with a channel routes the event. It returns whether the payload
+// changed.
+func applyCELRules(matched []CELRule, event *webhookEvent) bool {
+	tags, listed := event.Payload["tags"].([]interface{})
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if s, ok := tag.(string); ok {
+			seen[s] = true
+		}
+	}
+
+	var added []interface{}
+	for _, rule := range matched {
+		ruleMatches.WithLabelValues(rule.Name).Inc()
+		if event.Channel == "" {
+			event.Channel = rule.Channel
+		}
+		for _, tag := range rule.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				added = append(added, tag)
+			}
+		}
+	}
+	if len(added) == 0 {
+		return false
+	}
+	if !listed && event.Payload["tags"] != nil {
+		logWarn("Not tagging %s event %s: its payload has tags that aren't a list", event.Type, event.ID)
+		return false
+	}
+
+	event.Payload["tags"] = append(tags, added...)
+	body, err := json.Marshal(event.Payload)
+	if err != nil {
+		logError("Error encoding tagged %s event %s: %v", event.Type, event.ID, err)
+		return false
+	}
+	event.Body = body
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateCELRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []CELRule
+		wantErr bool
+	}{
+		{name: "No rules"},
+		{name: "Valid", rules: []CELRule{{Name: "big", When: "data.amount < -10000", Channel: "monzo-alerts", Tags: []string{"big"}}, {Name: "pots", When: "event.type.startsWith('pot.')", Drop: true}}},
+		{name: "Missing name", rules: []CELRule{{When: "true", Drop: true}}, wantErr: true},
+		{name: "Duplicate name", rules: []CELRule{{Name: "a", When: "true", Drop: true}, {Name: "a", When: "false", Drop: true}}, wantErr: true},
+		{name: "Missing expression", rules: []CELRule{{Name: "a", Drop: true}}, wantErr: true},
+		{name: "Invalid expression", rules: []CELRule{{Name: "a", When: "data.amount <", Drop: true}}, wantErr: true},
+		{name: "No action", rules: []CELRule{{Name: "a", When: "true"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCELRules(tt.rules); (err != nil) != tt.wantErr {
+				t.Errorf("validateCELRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilteredByRules(t *testing.T) {
+	cfg := EventConfig{Rules: []CELRule{
+		{Name: "tag-all", When: "true", Tags: []string{"seen"}},
+		{Name: "drop-pots", When: "event.type.startsWith('pot.') || data.description == 'ROUND UP'", Drop: true},
+	}}
+
+	tests := []struct {
+		name     string
+		payload  map[string]interface{}
+		expected string
+	}{
+		{name: "Dropped by type", payload: map[string]interface{}{"type": "pot.updated", "data": map[string]interface{}{}}, expected: "rules"},
+		{name: "Dropped by field", payload: map[string]interface{}{"type": "transaction.created", "data": map[string]interface{}{"description": "ROUND UP"}}, expected: "rules"},
+		{name: "Kept", payload: map[string]interface{}{"type": "transaction.created", "data": map[string]interface{}{"description": "PRET"}}},
+		{name: "Kept when the expression fails", payload: map[string]interface{}{"type": "transaction.created", "data": map[string]interface{}{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filteredBy(cfg, tt.payload["type"].(string), tt.payload); got != tt.expected {
+				t.Errorf("Expected filtered by '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewWebhookEventAppliesRules(t *testing.T) {
+	origConfig, origTraces := eventConfig, eventTraces
+	defer func() { eventConfig, eventTraces = origConfig, origTraces }()
+	eventTraces = newTraceStore(10)
+	eventConfig = EventConfig{Rules: []CELRule{
+		{Name: "big", When: "event.type == 'transaction.created' && data.amount < -10000", Channel: "monzo-alerts", Tags: []string{"big-spend", "review"}},
+		{Name: "eating-out", When: "data.category == 'eating_out'", Channel: "monzo-food", Tags: []string{"review", "food"}},
+		{Name: "income", When: "data.amount > 0", Tags: []string{"income"}},
+	}}
+
+	body := []byte(`{"type":"transaction.created","tags":["existing"],"data":{"id":"tx_1","amount":-12500,"category":"eating_out"}}`)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	event := newWebhookEvent("transaction.created", body, payload, nil, "basic")
+
+	if event.Channel != "monzo-alerts" {
+		t.Errorf("Expected the first matching rule's channel, got '%s'", event.Channel)
+	}
+	var published struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(event.Body, &published); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"existing", "big-spend", "review", "food"}; !reflect.DeepEqual(published.Tags, expected) {
+		t.Errorf("Expected tags %v, got %v", expected, published.Tags)
+	}
+
+	trace, _ := eventTraces.get(event.ID)
+	var rules []string
+	for _, rule := range trace.MatchedRules {
+		if rule.Kind == "rule" {
+			rules = append(rules, rule.Rule)
+		}
+	}
+	if len(rules) != 2 || rules[0] != "big: "+eventConfig.Rules[0].When {
+		t.Errorf("Expected the matched rules in the trace, got %v", rules)
+	}
+}
+
+func TestApplyCELRulesKeepsNonListTags(t *testing.T) {
+	event := &webhookEvent{Type: "transaction.created", Body: []byte(`{"tags":"mine"}`), Payload: map[string]interface{}{"tags": "mine"}}
+	if applyCELRules([]CELRule{{Name: "tag", Channel: "monzo-alerts", Tags: []string{"big"}}}, event) {
+		t.Error("Expected tags that aren't a list to be left alone")
+	}
+	if event.Payload["tags"] != "mine" || event.Channel != "monzo-alerts" {
+		t.Errorf("Expected the event to be routed but not tagged, got %+v", event)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Client reads and writes objects in an S3 bucket. Requests go to the
+// virtual-hosted bucket endpoint, or path-style to AWS_ENDPOINT_URL_S3 when
+// it's set, such as for MinIO.
+type s3Client struct {
+	bucket string
+	client *s3.Client
+}
+
+// newS3Client returns a client for a bucket in the configured region
+func newS3Client(bucket string, loadConfig func() (aws.Config, error)) (*s3Client, error) {
+	awsConfig, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if awsConfig.Region == "" {
+		return nil, errors.New("AWS_REGION must be set to use S3")
+	}
+	return &s3Client{
+		bucket: bucket,
+		client: s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+			o.UsePathStyle = awsEndpointFromEnv("s3") != ""
+		}),
+	}, nil
+}
+
+// put uploads an object
+func (c *s3Client) put(ctx context.Context, key, contentType string, body []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	_, err := c.client.PutObject(ctx, input)
+	return awsAPIError(err)
+}
+
+// exists reports whether an object exists, or the bucket for an empty key
+func (c *s3Client) exists(ctx context.Context, key string) (bool, error) {
+	var err error
+	if key == "" {
+		_, err = c.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.bucket)})
+	} else {
+		_, err = c.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(key)})
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, awsAPIError(err)
+	}
+	return true, nil
+}
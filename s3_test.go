@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestS3Client(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	var mu sync.Mutex
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-2/s3/aws4_request") {
+			t.Errorf("Unexpected Authorization header: %s", r.Header.Get("Authorization"))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			if r.URL.Path == "/receipts/denied" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+		case http.MethodHead:
+			if _, ok := objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+
+	t.Setenv("AWS_REGION", "eu-west-2")
+	client, err := newS3Client("receipts", loadAWSConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	if exists, err := client.exists(ctx, "tx_1/attach_1.jpg"); err != nil || exists {
+		t.Errorf("Expected no object, got %v, %v", exists, err)
+	}
+	if err := client.put(ctx, "tx_1/attach_1.jpg", "image/jpeg", []byte("receipt")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if objects["/receipts/tx_1/attach_1.jpg"] != "receipt" {
+		t.Errorf("Expected the object to be stored path-style, got %v", objects)
+	}
+	if exists, err := client.exists(ctx, "tx_1/attach_1.jpg"); err != nil || !exists {
+		t.Errorf("Expected the object to exist, got %v, %v", exists, err)
+	}
+	if err := client.put(ctx, "denied", "", nil); err == nil || err.Error() != "AccessDenied: Access Denied" {
+		t.Errorf("Expected an AccessDenied error, got %v", err)
+	}
+}
+
+func TestNewS3ClientWithoutRegion(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := newS3Client("receipts", loadAWSConfig); err == nil {
+		t.Error("Expected an error without a region")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// defaultArchivePrefix is the key prefix of an S3 sink's objects when none is
+// configured
+const defaultArchivePrefix = "monzo-webhook/{year}/{month}/{day}/"
+
+// archiveFlushDelay is how long after an hour ends its batch is uploaded, so
+// that events received just before the hour ends are still in it
+const archiveFlushDelay = time.Minute
+
+// archiveBatchExt is the extension of batches buffered on disk
+const archiveBatchExt = ".jsonl"
+
+var archiveUploads = metrics.newCounterVec("monzo_webhook_archive_uploads_total",
+	"Batches uploaded by S3 sinks, by sink and result (success, error).", "sink", "result")
+
+// archivePlaceholder matches a placeholder in an S3 sink's prefix
+var archivePlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// validateArchivePrefix checks that a prefix's placeholders are known
+func validateArchivePrefix(prefix string) error {
+	for _, match := range archivePlaceholder.FindAllStringSubmatch(prefix, -1) {
+		switch match[1] {
+		case "year", "month", "day", "hour", "type", "account", "tenant":
+		default:
+			return fmt.Errorf("unknown placeholder %s in prefix", match[0])
+		}
+	}
+	return nil
+}
+
+// archivePrefix renders a prefix for an event received in an hour. Fields an
+// event doesn't have, such as the account of a non-transaction event, are
+// rendered as "none".
+func archivePrefix(prefix string, event *webhookEvent, hour time.Time) string {
+	return archivePlaceholder.ReplaceAllStringFunc(prefix, func(placeholder string) string {
+		var value string
+		switch placeholder {
+		case "{year}":
+			return hour.Format("2006")
+		case "{month}":
+			return hour.Format("01")
+		case "{day}":
+			return hour.Format("02")
+		case "{hour}":
+			return hour.Format("15")
+		case "{type}":
+			value = event.Type
+		case "{account}":
+			value = event.AccountID
+		case "{tenant}":
+			if event.Tenant != nil {
+				value = event.Tenant.Name
+			}
+		}
+		if value == "" {
+			return "none"
+		}
+		return url.PathEscape(value)
+	})
+}
+
+// archiveBatch is the events received in an hour for an object, buffered in
+// a file until the hour is over
+type archiveBatch struct {
+	key  string
+	hour time.Time
+	file *os.File
+}
+
+// s3ArchiveSink archives raw payloads to an S3-compatible bucket, batched into
+// a gzipped JSON Lines object for each hour and prefix. Batches are buffered
+// on disk, so that those not uploaded when the server stops are uploaded when
+// it next starts.
+type s3ArchiveSink struct {
+	name   string
+	client *s3Client
+	prefix string
+	dir    string
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// batches are the open batches, by prefix and hour
+	batches map[string]*archiveBatch
+	// closed are the object keys of batches that are complete but not yet
+	// uploaded
+	closed []string
+}
+
+// newS3ArchiveSink creates an S3 sink buffering batches in a directory of
+// dir named after it, and starts uploading them
+func newS3ArchiveSink(name string, cfg SinkConfig, loadAWSConfig func() (aws.Config, error)) (*s3ArchiveSink, error) {
+	client, err := newS3Client(cfg.Bucket, loadAWSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("archiving to S3: %w", err)
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultArchivePrefix
+	}
+	s := &s3ArchiveSink{
+		name:    name,
+		client:  client,
+		prefix:  prefix,
+		dir:     filepath.Join(cfg.Dir, name),
+		batches: make(map[string]*archiveBatch),
+	}
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	// Batches left by a previous run are complete, as new events start new
+	// batches
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		escaped, ok := strings.CutSuffix(entry.Name(), archiveBatchExt)
+		if !ok {
+			continue
+		}
+		if key, err := url.PathUnescape(escaped); err == nil {
+			s.closed = append(s.closed, key)
+		}
+	}
+	if len(s.closed) > 0 {
+		logInfo("Sink '%s' has %d batches from a previous run to upload", name, len(s.closed))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *s3ArchiveSink) Name() string { return s.name }
+
+// Publish appends an event to the batch for its prefix and the hour it was
+// received in
+func (s *s3ArchiveSink) Publish(ctx context.Context, event *webhookEvent) error {
+	record := fileRecord{ID: event.ID, Received: event.Received, Type: event.Type, Payload: event.Body}
+	if event.Tenant != nil {
+		record.Tenant = event.Tenant.Name
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	hour := event.Received.UTC().Truncate(time.Hour)
+	prefix := archivePrefix(s.prefix, event, hour)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch, ok := s.batches[prefix+hour.String()]
+	if !ok {
+		// Keys are unique by the first event's ID, so a batch started for an
+		// hour that was already uploaded, such as after a restart, doesn't
+		// replace it
+		key := fmt.Sprintf("%s%s-%s.jsonl.gz", prefix, hour.Format("2006-01-02T15"), event.ID)
+		f, err := os.OpenFile(s.batchPath(key), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		batch = &archiveBatch{key: key, hour: hour, file: f}
+		s.batches[prefix+hour.String()] = batch
+	}
+	_, err = batch.file.Write(append(line, '\n'))
+	return err
+}
+
+// batchPath returns the file a batch is buffered in
+func (s *s3ArchiveSink) batchPath(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+archiveBatchExt)
+}
+
+// run uploads batches every minute until ctx is cancelled. The first upload
+// waits a minute too, so that a sink replaced by a reload has closed and
+// uploaded its own batches before they're seen as left over.
+func (s *s3ArchiveSink) run(ctx context.Context) {
+	for {
+		if sleepUntil(ctx, clock, clock.Now().Add(time.Minute)) != nil {
+			return
+		}
+		s.flush(ctx, clock.Now(), false)
+	}
+}
+
+// flush closes the batches of hours that ended before now, or every batch if
+// all is set, and uploads the closed batches. Batches that fail to upload are
+// kept and retried by the next flush.
+func (s *s3ArchiveSink) flush(ctx context.Context, now time.Time, all bool) {
+	s.mu.Lock()
+	for id, batch := range s.batches {
+		if all || !now.Before(batch.hour.Add(time.Hour+archiveFlushDelay)) {
+			batch.file.Close()
+			delete(s.batches, id)
+			s.closed = append(s.closed, batch.key)
+		}
+	}
+	keys := s.closed
+	s.closed = nil
+	s.mu.Unlock()
+
+	sort.Strings(keys)
+	var failed []string
+	for _, key := range keys {
+		// A batch left over from a replaced sink may have been uploaded by it
+		if _, err := os.Stat(s.batchPath(key)); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := s.upload(ctx, key); err != nil {
+			logError("Error uploading batch %s for sink '%s': %v", key, s.name, err)
+			archiveUploads.WithLabelValues(s.name, "error").Inc()
+			failed = append(failed, key)
+			continue
+		}
+		logInfo("Uploaded batch %s for sink '%s'", key, s.name)
+		archiveUploads.WithLabelValues(s.name, "success").Inc()
+	}
+
+	if len(failed) > 0 {
+		s.mu.Lock()
+		s.closed = append(s.closed, failed...)
+		s.mu.Unlock()
+	}
+}
+
+// upload gzips a closed batch and uploads it, removing it once it's uploaded
+func (s *s3ArchiveSink) upload(ctx context.Context, key string) error {
+	path := s.batchPath(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := s.client.put(ctx, key, "application/gzip", buf.Bytes()); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// warm checks that the bucket exists and can be reached with the credentials
+func (s *s3ArchiveSink) warm(ctx context.Context) error {
+	ok, err := s.client.exists(ctx, "")
+	if err == nil && !ok {
+		err = fmt.Errorf("bucket %s not found", s.client.bucket)
+	}
+	return err
+}
+
+// Close stops the sink and uploads every batch, including those of the
+// current hour. Batches that fail to upload are left on disk, to be uploaded
+// when the sink is next created.
+func (s *s3ArchiveSink) Close() error {
+	s.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	s.flush(ctx, clock.Now(), true)
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchivePrefix(t *testing.T) {
+	hour := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	event := &webhookEvent{Type: "transaction.created", AccountID: "acc_1", Tenant: &TenantConfig{Name: "alice"}}
+
+	tests := []struct {
+		name   string
+		prefix string
+		event  *webhookEvent
+		expect string
+	}{
+		{name: "Default", prefix: defaultArchivePrefix, event: event, expect: "monzo-webhook/2024/03/01/"},
+		{name: "Every placeholder", prefix: "{tenant}/{account}/{type}/{year}{month}{day}{hour}/", event: event,
+			expect: "alice/acc_1/transaction.created/2024030109/"},
+		{name: "Missing fields", prefix: "{tenant}/{account}/", event: &webhookEvent{Type: "pot.updated"}, expect: "none/none/"},
+		{name: "Escaped", prefix: "{account}/", event: &webhookEvent{AccountID: "a/b c"}, expect: "a%2Fb%20c/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := archivePrefix(tt.prefix, tt.event, hour); got != tt.expect {
+				t.Errorf("Expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+
+	if err := validateArchivePrefix("{year}/{minute}/"); err == nil {
+		t.Error("Expected an error for an unknown placeholder")
+	}
+}
+
+func TestValidateS3Sinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    SinkConfig
+		hasErr bool
+	}{
+		{name: "Valid", cfg: SinkConfig{Type: "s3", Bucket: "archive", Dir: "/var/lib/archive", Prefix: "{type}/"}},
+		{name: "No bucket", cfg: SinkConfig{Type: "s3", Dir: "/var/lib/archive"}, hasErr: true},
+		{name: "No dir", cfg: SinkConfig{Type: "s3", Bucket: "archive"}, hasErr: true},
+		{name: "Unknown placeholder", cfg: SinkConfig{Type: "s3", Bucket: "archive", Dir: "/var/lib/archive", Prefix: "{date}/"}, hasErr: true},
+		{name: "Chained", cfg: SinkConfig{Type: "s3", Bucket: "archive", Dir: "/var/lib/archive", Chain: true}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSinks([]SinkConfig{tt.cfg}); (err != nil) != tt.hasErr {
+				t.Errorf("Expected error %v, got %v", tt.hasErr, err)
+			}
+		})
+	}
+}
+
+// newTestArchiveBucket returns a fake S3 endpoint for the archive bucket,
+// whose objects are decompressed into the returned map. Uploads fail while
+// fail is set.
+func newTestArchiveBucket(t *testing.T) (map[string]string, *sync.Mutex, *bool) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	var mu sync.Mutex
+	fail := false
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPut {
+			return
+		}
+		if fail {
+			// Not an error the SDK retries
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("Expected a gzipped object: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(zr)
+		objects[strings.TrimPrefix(r.URL.Path, "/archive/")] = string(data)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+	return objects, &mu, &fail
+}
+
+func TestS3ArchiveSink(t *testing.T) {
+	objects, mu, fail := newTestArchiveBucket(t)
+	dir := t.TempDir()
+	sink, err := newS3ArchiveSink("archive", SinkConfig{Type: "s3", Bucket: "archive", Dir: dir, Prefix: "{type}/"}, loadAWSConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sink.cancel()
+
+	received := time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)
+	events := []*webhookEvent{
+		{ID: "evt_1", Type: "transaction.created", Received: received, Body: []byte(`{"n":1}`)},
+		{ID: "evt_2", Type: "transaction.created", Received: received.Add(30 * time.Minute), Body: []byte(`{"n":2}`)},
+		{ID: "evt_3", Type: "transaction.updated", Received: received, Body: []byte(`{"n":3}`)},
+		{ID: "evt_4", Type: "transaction.created", Received: received.Add(time.Hour), Body: []byte(`{"n":4}`)},
+	}
+	for _, event := range events {
+		if err := sink.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Nothing is uploaded until the hour is over, and a failed upload is
+	// kept for the next flush
+	sink.flush(context.Background(), received.Add(45*time.Minute), false)
+	mu.Lock()
+	*fail = true
+	mu.Unlock()
+	sink.flush(context.Background(), received.Add(50*time.Minute), false)
+	mu.Lock()
+	if len(objects) != 0 {
+		t.Fatalf("Expected no uploads, got %v", objects)
+	}
+	*fail = false
+	mu.Unlock()
+	sink.flush(context.Background(), received.Add(55*time.Minute), false)
+
+	mu.Lock()
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expected := []string{"transaction.created/2024-03-01T09-evt_1.jsonl.gz", "transaction.updated/2024-03-01T09-evt_3.jsonl.gz"}
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected objects %v, got %v", expected, keys)
+	}
+	var ids []string
+	scanner := bufio.NewScanner(strings.NewReader(objects[expected[0]]))
+	for scanner.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid record %s: %v", scanner.Text(), err)
+		}
+		ids = append(ids, record.ID)
+	}
+	mu.Unlock()
+	if strings.Join(ids, ",") != "evt_1,evt_2" {
+		t.Errorf("Expected evt_1 and evt_2 in the first batch, got %v", ids)
+	}
+
+	// Closing uploads the current hour's batch
+	sink.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(objects["transaction.created/2024-03-01T10-evt_4.jsonl.gz"], `"payload":{"n":4}`) {
+		t.Errorf("Expected the current batch to be uploaded on close, got %v", objects)
+	}
+	if entries, _ := os.ReadDir(sink.dir); len(entries) != 0 {
+		t.Errorf("Expected uploaded batches to be removed, got %d", len(entries))
+	}
+}
+
+func TestS3ArchiveSinkUploadsLeftoverBatches(t *testing.T) {
+	objects, mu, _ := newTestArchiveBucket(t)
+	dir := t.TempDir()
+	cfg := SinkConfig{Type: "s3", Bucket: "archive", Dir: dir}
+
+	// A run that stopped without uploading leaves its batch behind
+	previous, err := newS3ArchiveSink("archive", cfg, loadAWSConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	previous.cancel()
+	event := &webhookEvent{ID: "evt_1", Type: "transaction.created", Received: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC), Body: []byte(`{}`)}
+	if err := previous.Publish(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sink, err := newS3ArchiveSink("archive", cfg, loadAWSConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sink.cancel()
+	sink.flush(context.Background(), event.Received, false)
+
+	mu.Lock()
+	defer mu.Unlock()
+	data, ok := objects["monzo-webhook/2024/03/01/2024-03-01T09-evt_1.jsonl.gz"]
+	if !ok || !bytes.Contains([]byte(data), []byte(`"id":"evt_1"`)) {
+		t.Errorf("Expected the leftover batch to be uploaded, got %v", objects)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// SampleConfig limits a sink to a share of the events, so that analytical
+// consumers can work on a representative subset without the full volume.
+// Events are selected by a hash of their ID, so a redelivered or replayed
+// event is sampled the same way every time.
+type SampleConfig struct {
+	// Percent is the share of events published, from 0 to 100
+	Percent float64 `json:"percent"`
+	// By is a payload field, such as data.category, whose values are
+	// sampled at their own Percents, and the others at Percent
+	By       string             `json:"by"`
+	Percents map[string]float64 `json:"percents"`
+}
+
+// validate checks the sampling percentages are between 0 and 100
+func (c SampleConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("sample percent must be between 0 and 100")
+	}
+	if len(c.Percents) > 0 && c.By == "" {
+		return fmt.Errorf("sample percents need a field to sample by")
+	}
+	for value, percent := range c.Percents {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("sample percent for '%s' must be between 0 and 100", value)
+		}
+	}
+	return nil
+}
+
+// percent returns the share of events like this one that are published
+func (c SampleConfig) percent(payload map[string]interface{}) float64 {
+	if c.By == "" {
+		return c.Percent
+	}
+	value, _ := lookupField(payload, c.By)
+	if s, ok := value.(string); ok {
+		if percent, ok := c.Percents[s]; ok {
+			return percent
+		}
+	}
+	return c.Percent
+}
+
+// selects reports whether an event is in the sample
+func (c SampleConfig) selects(event *webhookEvent) bool {
+	percent := c.percent(event.Payload)
+	if percent >= 100 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(event.ID))
+	return float64(h.Sum64()%10000) < percent*100
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSampleConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       SampleConfig
+		expectErr bool
+	}{
+		{name: "Percent", cfg: SampleConfig{Percent: 10}},
+		{name: "Stratified", cfg: SampleConfig{Percent: 5, By: "data.category", Percents: map[string]float64{"groceries": 50}}},
+		{name: "Negative percent", cfg: SampleConfig{Percent: -1}, expectErr: true},
+		{name: "Percent over 100", cfg: SampleConfig{Percent: 101}, expectErr: true},
+		{name: "Percents without a field", cfg: SampleConfig{Percents: map[string]float64{"groceries": 50}}, expectErr: true},
+		{name: "Invalid stratum percent", cfg: SampleConfig{By: "data.category", Percents: map[string]float64{"groceries": 150}}, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.expectErr {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestSampleConfigSelects(t *testing.T) {
+	cfg := SampleConfig{Percent: 10, By: "data.category", Percents: map[string]float64{"groceries": 50, "transfers": 0}}
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		for _, category := range []string{"groceries", "transfers", "eating_out"} {
+			event := &webhookEvent{ID: fmt.Sprintf("evt_%d", i), Payload: map[string]interface{}{
+				"data": map[string]interface{}{"category": category},
+			}}
+			if cfg.selects(event) {
+				counts[category]++
+			}
+			if cfg.selects(event) != cfg.selects(event) {
+				t.Fatalf("Expected event %s to be sampled the same way every time", event.ID)
+			}
+		}
+	}
+
+	expected := map[string][2]int{"groceries": {4800, 5200}, "transfers": {0, 0}, "eating_out": {900, 1100}}
+	for category, bounds := range expected {
+		if counts[category] < bounds[0] || counts[category] > bounds[1] {
+			t.Errorf("Expected between %d and %d %s events, got %d", bounds[0], bounds[1], category, counts[category])
+		}
+	}
+}
+
+func TestPublishToSampledSink(t *testing.T) {
+	sampled := &fakeSink{name: "sampled-analytics"}
+	entries := []sinkEntry{{sink: sampled, sample: &SampleConfig{Percent: 25}}}
+
+	for i := 0; i < 400; i++ {
+		event := &webhookEvent{ID: fmt.Sprintf("evt_%d", i), Type: "transaction.created", Body: []byte(`{}`), Payload: map[string]interface{}{}}
+		if err := publishToSinks(context.Background(), entries, nil, event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if sampled.count() < 70 || sampled.count() > 130 {
+		t.Errorf("Expected about 100 sampled events, got %d", sampled.count())
+	}
+	if got := testutil.ToFloat64(sinkPublishTotal.WithLabelValues("sampled-analytics", "sampled")); int(got) != 400-sampled.count() {
+		t.Errorf("Expected %d events counted as sampled out, got %v", 400-sampled.count(), got)
+	}
+}
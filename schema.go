@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/its-the-vibe/monzo-webhook/monzo"
+)
+
+// schemaIDBase is the base of the $id of exported JSON Schemas
+const schemaIDBase = "https://github.com/its-the-vibe/monzo-webhook/schemas/"
+
+// protoPackage is the package of the exported protobuf definitions
+const protoPackage = "monzowebhook.v1"
+
+// normalisedEvent is the normalised profile's payload for transaction events
+type normalisedEvent struct {
+	Type string            `json:"type"`
+	Data monzo.Transaction `json:"data"`
+}
+
+// envelopeSchema returns the JSON Schema of the envelope profile's payload
+func envelopeSchema() map[string]interface{} {
+	schema := monzo.Schema(eventEnvelope{})
+	schema["properties"].(map[string]interface{})["payload"] = map[string]interface{}{
+		"description": "The published payload, shaped by the profile's fields if it has any",
+	}
+	return withSchemaHeader(schema, "envelope.schema.json", "Envelope",
+		"An event wrapped with its metadata, as published by the envelope profile")
+}
+
+// normalisedEventSchema returns the JSON Schema of the normalised profile's
+// payload. Transaction events' data is re-encoded from the typed fields, so
+// merchant is always an object; other events are as Monzo sent them.
+func normalisedEventSchema() map[string]interface{} {
+	transaction := monzo.Schema(monzo.Transaction{})
+	properties := transaction["properties"].(map[string]interface{})
+	merchant := properties["merchant"].(map[string]interface{})["oneOf"].([]interface{})
+	properties["merchant"] = merchant[len(merchant)-1]
+
+	schema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"type": map[string]interface{}{"type": "string"},
+			"data": map[string]interface{}{},
+		},
+		"required": []string{"type", "data"},
+		"if": map[string]interface{}{
+			"properties": map[string]interface{}{"type": map[string]interface{}{"type": "string", "pattern": `^transaction\.`}},
+		},
+		"then": map[string]interface{}{
+			"properties": map[string]interface{}{"data": transaction},
+		},
+	}
+	return withSchemaHeader(schema, "normalised-event.schema.json", "NormalisedEvent",
+		"An event as published by the normalised profile")
+}
+
+func withSchemaHeader(schema map[string]interface{}, id, title, description string) map[string]interface{} {
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = schemaIDBase + id
+	schema["title"] = title
+	schema["description"] = description
+	return schema
+}
+
+var (
+	protoTimeType       = reflect.TypeOf(time.Time{})
+	protoRawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// protoMessage is a message of the exported protobuf definitions, derived
+// from a Go struct
+type protoMessage struct {
+	name   string
+	goType reflect.Type
+}
+
+// protoDefinitions returns a proto3 file with a message for each of the
+// given structs and the structs their fields use, named by the Go type
+// unless given a name. Field names are the JSON names, so the messages'
+// JSON encoding, with the field names preserved, matches the published
+// payloads.
+func protoDefinitions(roots []protoMessage) string {
+	names := make(map[reflect.Type]string)
+	var messages []protoMessage
+	var add func(t reflect.Type, name string)
+	add = func(t reflect.Type, name string) {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t == protoTimeType {
+			return
+		}
+		if _, ok := names[t]; ok {
+			return
+		}
+		if name == "" {
+			name = t.Name()
+		}
+		names[t] = name
+		messages = append(messages, protoMessage{name: name, goType: t})
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				add(t.Field(i).Type, "")
+			}
+		}
+	}
+	for _, root := range roots {
+		add(root.goType, root.name)
+	}
+
+	var imports []string
+	var body strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&body, "\nmessage %s {\n", message.name)
+		number := 0
+		for i := 0; i < message.goType.NumField(); i++ {
+			field := message.goType.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			number++
+			fieldType, imported := protoFieldType(field.Type, names)
+			if imported != "" && !containsString(imports, imported) {
+				imports = append(imports, imported)
+			}
+			fmt.Fprintf(&body, "  %s %s = %d;\n", fieldType, name, number)
+		}
+		body.WriteString("}\n")
+	}
+
+	var out strings.Builder
+	out.WriteString("// Code generated by webhook-server schema export. DO NOT EDIT.\n\n")
+	out.WriteString("syntax = \"proto3\";\n\n")
+	fmt.Fprintf(&out, "package %s;\n", protoPackage)
+	if len(imports) > 0 {
+		out.WriteString("\n")
+		for _, imported := range imports {
+			fmt.Fprintf(&out, "import \"%s\";\n", imported)
+		}
+	}
+	out.WriteString(body.String())
+	return out.String()
+}
+
+// protoFieldType returns the proto3 type of a field of a Go type, and the
+// file it must import, if any
+func protoFieldType(t reflect.Type, names map[reflect.Type]string) (string, string) {
+	switch {
+	case t == protoTimeType:
+		return "google.protobuf.Timestamp", "google/protobuf/timestamp.proto"
+	case t == protoRawMessageType:
+		return "google.protobuf.Value", "google/protobuf/struct.proto"
+	case t.Kind() == reflect.Pointer && t.Elem().Kind() != reflect.Struct:
+		// A pointer distinguishes a missing value from the zero value
+		fieldType, imported := protoFieldType(t.Elem(), names)
+		return "optional " + fieldType, imported
+	case t.Kind() == reflect.Pointer:
+		return protoFieldType(t.Elem(), names)
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		fieldType, imported := protoFieldType(t.Elem(), names)
+		return "repeated " + fieldType, imported
+	case t.Kind() == reflect.Map:
+		fieldType, imported := protoFieldType(t.Elem(), names)
+		return "map<string, " + fieldType + ">", imported
+	case t.Kind() == reflect.Struct:
+		return names[t], ""
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string", ""
+	case reflect.Bool:
+		return "bool", ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int64", ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint64", ""
+	case reflect.Float32, reflect.Float64:
+		return "double", ""
+	}
+	return "google.protobuf.Value", "google/protobuf/struct.proto"
+}
+
+// schemaFile is a file written by schema export
+type schemaFile struct {
+	name string
+	data []byte
+}
+
+// schemaFiles returns the files schema export writes in a format: jsonschema,
+// proto or all
+func schemaFiles(format string) ([]schemaFile, error) {
+	var files []schemaFile
+	if format == "jsonschema" || format == "all" {
+		for _, schema := range []map[string]interface{}{envelopeSchema(), normalisedEventSchema()} {
+			data, err := json.MarshalIndent(schema, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, schemaFile{strings.TrimPrefix(schema["$id"].(string), schemaIDBase), append(data, '\n')})
+		}
+	}
+	if format == "proto" || format == "all" {
+		proto := protoDefinitions([]protoMessage{
+			{name: "Envelope", goType: reflect.TypeOf(eventEnvelope{})},
+			{name: "NormalisedEvent", goType: reflect.TypeOf(normalisedEvent{})},
+		})
+		files = append(files, schemaFile{"monzo_webhook.proto", []byte(proto)})
+	}
+	if files == nil {
+		return nil, fmt.Errorf("unknown format '%s', must be jsonschema, proto or all", format)
+	}
+	return files, nil
+}
+
+// runSchema implements the schema export command, which writes JSON Schemas
+// and protobuf definitions of the published payloads, generated from the
+// structs that encode them, for consumers in other languages to generate
+// their types from. It returns the process exit code.
+func runSchema(args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintln(out, "usage: webhook-server schema export [-dir DIR] [-format jsonschema|proto|all]")
+		return 2
+	}
+	flags := flag.NewFlagSet("schema export", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dir := flags.String("dir", ".", "directory to write the schemas to")
+	format := flags.String("format", "all", "what to write: jsonschema, proto or all")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	files, err := schemaFiles(*format)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+	for _, file := range files {
+		path := filepath.Join(*dir, file.name)
+		if err := os.WriteFile(path, file.data, 0o644); err != nil {
+			fmt.Fprintf(out, "Error writing %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Fprintf(out, "Wrote %s\n", path)
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopeSchema(t *testing.T) {
+	schema := envelopeSchema()
+	properties := schema["properties"].(map[string]interface{})
+	if _, ok := properties["payload"].(map[string]interface{})["type"]; ok {
+		t.Errorf("Expected the payload to be any JSON value, got %v", properties["payload"])
+	}
+	expect := []string{"id", "type", "received", "payload"}
+	if required := schema["required"].([]string); !reflect.DeepEqual(required, expect) {
+		t.Errorf("Expected required fields %v, got %v", expect, required)
+	}
+}
+
+func TestNormalisedEventSchema(t *testing.T) {
+	schema := normalisedEventSchema()
+	data := schema["then"].(map[string]interface{})["properties"].(map[string]interface{})["data"].(map[string]interface{})
+	merchant := data["properties"].(map[string]interface{})["merchant"].(map[string]interface{})
+	if merchant["type"] != "object" {
+		t.Errorf("Expected a normalised merchant to always be an object, got %v", merchant)
+	}
+}
+
+func TestProtoDefinitions(t *testing.T) {
+	proto := protoDefinitions([]protoMessage{{name: "NormalisedEvent", goType: reflect.TypeOf(normalisedEvent{})}})
+	for _, expect := range []string{
+		`import "google/protobuf/timestamp.proto";`,
+		"message NormalisedEvent {\n  string type = 1;\n  Transaction data = 2;\n}",
+		"  google.protobuf.Timestamp created = 2;",
+		"  Merchant merchant = 11;",
+		"  map<string, string> metadata = 13;",
+		"  repeated Attachment attachments = 17;",
+		"  optional int64 account_balance = 18;",
+		"message MerchantAddress {",
+		"  double latitude = 6;",
+	} {
+		if !strings.Contains(proto, expect) {
+			t.Errorf("Expected the definitions to contain %q, got:\n%s", expect, proto)
+		}
+	}
+	if strings.Count(proto, "message Merchant {") != 1 {
+		t.Error("Expected each message to be defined once")
+	}
+}
+
+func TestRunSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		expectCode int
+		expect     []string
+	}{
+		{name: "All", args: []string{"export"}, expect: []string{"envelope.schema.json", "normalised-event.schema.json", "monzo_webhook.proto"}},
+		{name: "Proto", args: []string{"export", "-format", "proto"}, expect: []string{"monzo_webhook.proto"}},
+		{name: "Unknown format", args: []string{"export", "-format", "avro"}, expectCode: 2},
+		{name: "No subcommand", expectCode: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var out bytes.Buffer
+			if code := runSchema(append(tt.args, "-dir", dir), &out); code != tt.expectCode {
+				t.Fatalf("Expected exit code %d, got %d: %s", tt.expectCode, code, out.String())
+			}
+			entries, _ := os.ReadDir(dir)
+			var written []string
+			for _, entry := range entries {
+				written = append(written, entry.Name())
+			}
+			for _, name := range tt.expect {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("Expected %s to be written, got %v", name, written)
+				}
+			}
+			if len(written) != len(tt.expect) {
+				t.Errorf("Expected %v, got %v", tt.expect, written)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var scriptRuns = metrics.newCounterVec("monzo_webhook_script_runs_total",
+	"Events passed to the script hook, by result (unchanged, modified, dropped, error).", "result")
+
+// defaultScriptTimeout is how long the script may take for an event when its
+// timeout isn't set
+const defaultScriptTimeout = 2 * time.Second
+
+// luaArrayType names the metatable marking tables decoded from JSON arrays,
+// so that an empty one is encoded as [] rather than {}
+const luaArrayType = "json_array"
+
+// luaMaxDepth is how deeply tables returned by a script may be nested, which
+// also stops a table that contains itself from being encoded forever
+const luaMaxDepth = 100
+
+// ScriptConfig runs a Lua script on each event before it's published, which
+// can change its payload, drop it or route it to another channel. The script
+// is compiled when the config is loaded and run by an embedded interpreter,
+// so no process is started for each event.
+type ScriptConfig struct {
+	Path    string `json:"path"`
+	Timeout string `json:"timeout"`
+	// OnError is what happens to an event when the script fails: publish
+	// (the default) publishes it unchanged, and drop drops it
+	OnError string `json:"on_error"`
+}
+
+// scriptOutput is what the script's handle function returned. Returning nil
+// leaves the event unchanged.
+type scriptOutput struct {
+	Drop    bool
+	Channel string
+	Payload map[string]interface{}
+}
+
+// validate checks the script configuration for invalid values, and compiles
+// the script so that a reload picks up changes to it
+func (c ScriptConfig) validate() error {
+	if c.Path == "" {
+		if c.Timeout != "" || c.OnError != "" {
+			return fmt.Errorf("script must have a path")
+		}
+		return nil
+	}
+	timeout, err := parsePositiveDuration(c.Timeout, defaultScriptTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid script timeout: %w", err)
+	}
+	switch c.OnError {
+	case "", "publish", "drop":
+	default:
+		return fmt.Errorf("script on_error must be publish or drop")
+	}
+	if _, err := loadScript(c.Path, timeout); err != nil {
+		return fmt.Errorf("script: %w", err)
+	}
+	return nil
+}
+
+// runScript passes an event through the script, applying what it returns. It
+// returns whether the event should still be published.
+func runScript(ctx context.Context, cfg ScriptConfig, event *webhookEvent) bool {
+	if cfg.Path == "" {
+		return true
+	}
+	out, err := execScript(ctx, cfg, event)
+	if err != nil {
+		scriptRuns.WithLabelValues("error").Inc()
+		if cfg.OnError == "drop" {
+			logError("Dropping %s event %s: script failed: %v", event.Type, event.ID, err)
+			return false
+		}
+		logError("Publishing %s event %s unchanged: script failed: %v", event.Type, event.ID, err)
+		return true
+	}
+	if out.Drop {
+		logInfo("Script dropped %s event %s", event.Type, event.ID)
+		scriptRuns.WithLabelValues("dropped").Inc()
+		return false
+	}
+
+	changed := false
+	if out.Channel != "" && out.Channel != event.Channel {
+		event.Channel = out.Channel
+		changed = true
+	}
+	if out.Payload != nil {
+		body, err := json.Marshal(out.Payload)
+		if err != nil {
+			// Unreachable for a payload converted from Lua values
+			logError("Error encoding %s event %s from the script: %v", event.Type, event.ID, err)
+		} else if !bytes.Equal(body, event.Body) {
+			original := event.Body
+			event.Payload = out.Payload
+			event.Body = body
+			eventTraces.recordTransformation(event.ID, "script", original, body)
+			changed = true
+		}
+	}
+	if changed {
+		scriptRuns.WithLabelValues("modified").Inc()
+	} else {
+		scriptRuns.WithLabelValues("unchanged").Inc()
+	}
+	return true
+}
+
+// execScript calls the script's handle function with the event
+func execScript(ctx context.Context, cfg ScriptConfig, event *webhookEvent) (scriptOutput, error) {
+	timeout, _ := parsePositiveDuration(cfg.Timeout, defaultScriptTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	script, err := cachedScript(cfg.Path, timeout)
+	if err != nil {
+		return scriptOutput{}, err
+	}
+	out, err := script.run(ctx, event)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return scriptOutput{}, fmt.Errorf("timed out after %v", timeout)
+	}
+	return out, err
+}
+
+// luaScript is a compiled script, with a pool of interpreters that have run
+// it. An interpreter can only handle one event at a time, so events handled
+// concurrently each take their own.
+type luaScript struct {
+	path  string
+	proto *lua.FunctionProto
+	pool  sync.Pool
+}
+
+// luaScripts are the compiled scripts, by path
+var luaScripts sync.Map
+
+// luaLibs are the standard libraries a script can use. io, os and package
+// are left out, so that a script can't read files or run commands.
+var luaLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// luaNull stands for JSON's null in a script, as nil can't be a table value
+type luaNull struct{}
+
+// loadScript compiles a script and runs it in a first interpreter, which
+// must leave a global handle function, replacing any previous compilation
+func loadScript(path string, timeout time.Duration) (*luaScript, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), path)
+	if err != nil {
+		return nil, firstLine(err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, firstLine(err)
+	}
+
+	s := &luaScript{path: path, proto: proto}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	L, err := s.newState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.pool.Put(L)
+	luaScripts.Store(path, s)
+	return s, nil
+}
+
+// cachedScript returns the script compiled when the config was loaded
+func cachedScript(path string, timeout time.Duration) (*luaScript, error) {
+	if s, ok := luaScripts.Load(path); ok {
+		return s.(*luaScript), nil
+	}
+	return loadScript(path, timeout)
+}
+
+// newState creates an interpreter with the script's globals
+func (s *luaScript) newState(ctx context.Context) (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range luaLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// The base library's functions that read files
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+	null := L.NewUserData()
+	null.Value = luaNull{}
+	L.SetGlobal("null", null)
+	L.NewTypeMetatable(luaArrayType).RawSetString("__name", lua.LString(luaArrayType))
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, firstLine(err)
+	}
+	if _, ok := L.GetGlobal("handle").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("%s must define a handle function", s.path)
+	}
+	return L, nil
+}
+
+// run calls handle with the event on an interpreter from the pool. An
+// interpreter that was stopped part way through isn't reused, as the
+// script's globals may be left half changed.
+func (s *luaScript) run(ctx context.Context, event *webhookEvent) (scriptOutput, error) {
+	L, _ := s.pool.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = s.newState(ctx); err != nil {
+			return scriptOutput{}, err
+		}
+	}
+	L.SetContext(ctx)
+	out, err := s.call(L, event)
+	L.RemoveContext()
+	if ctx.Err() != nil {
+		L.Close()
+	} else {
+		s.pool.Put(L)
+	}
+	return out, err
+}
+
+// call passes the event to handle as a table with its id, type, account_id,
+// channel and payload, and reads the table it returns
+func (s *luaScript) call(L *lua.LState, event *webhookEvent) (scriptOutput, error) {
+	var payload interface{}
+	if err := json.Unmarshal(event.Body, &payload); err != nil {
+		return scriptOutput{}, err
+	}
+	input := L.NewTable()
+	input.RawSetString("id", lua.LString(event.ID))
+	input.RawSetString("type", lua.LString(event.Type))
+	if event.AccountID != "" {
+		input.RawSetString("account_id", lua.LString(event.AccountID))
+	}
+	if event.Channel != "" {
+		input.RawSetString("channel", lua.LString(event.Channel))
+	}
+	input.RawSetString("payload", toLua(L, payload))
+
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("handle"), NRet: 1, Protect: true}, input); err != nil {
+		return scriptOutput{}, firstLine(err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	var out scriptOutput
+	if ret == lua.LNil {
+		return out, nil
+	}
+	table, ok := ret.(*lua.LTable)
+	if !ok {
+		return out, fmt.Errorf("handle returned a %s, expected a table or nil", ret.Type())
+	}
+	out.Drop = lua.LVAsBool(table.RawGetString("drop"))
+	if channel, ok := table.RawGetString("channel").(lua.LString); ok {
+		out.Channel = string(channel)
+	}
+	if value := table.RawGetString("payload"); value != lua.LNil {
+		decoded, err := fromLua(value, 0)
+		if err != nil {
+			return scriptOutput{}, fmt.Errorf("invalid payload: %w", err)
+		}
+		if out.Payload, ok = decoded.(map[string]interface{}); !ok {
+			return scriptOutput{}, errors.New("invalid payload: expected a table of fields")
+		}
+		// The payload handed back as it was, whose fields may be encoded
+		// in another order
+		if reflect.DeepEqual(decoded, payload) {
+			out.Payload = nil
+		}
+	}
+	return out, nil
+}
+
+// toLua converts a value decoded from JSON to a Lua value
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return L.GetGlobal("null")
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for i, item := range v {
+			table.RawSetInt(i+1, toLua(L, item))
+		}
+		L.SetMetatable(table, L.GetTypeMetatable(luaArrayType))
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// fromLua converts a Lua value to one that can be encoded as JSON. Tables
+// are arrays if they were decoded from one or have only the keys 1 to n, and
+// objects otherwise.
+func fromLua(value lua.LValue, depth int) (interface{}, error) {
+	if depth > luaMaxDepth {
+		return nil, fmt.Errorf("tables nested more than %d deep", luaMaxDepth)
+	}
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%v isn't a JSON number", f)
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LUserData:
+		if _, ok := v.Value.(luaNull); ok {
+			return nil, nil
+		}
+	case *lua.LTable:
+		count := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+		n := v.MaxN()
+		if meta, ok := v.Metatable.(*lua.LTable); (ok && meta.RawGetString("__name") == lua.LString(luaArrayType)) || (n > 0 && n == count) {
+			items := make([]interface{}, n)
+			for i := range items {
+				item, err := fromLua(v.RawGetInt(i+1), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				items[i] = item
+			}
+			return items, nil
+		}
+		fields := make(map[string]interface{}, count)
+		var err error
+		v.ForEach(func(key, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			name, ok := key.(lua.LString)
+			if !ok {
+				err = fmt.Errorf("key %s isn't a string", key)
+				return
+			}
+			fields[string(name)], err = fromLua(item, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("a %s can't be encoded as JSON", value.Type())
+}
+
+// firstLine drops the stack trace from a Lua error
+func firstLine(err error) error {
+	msg, _, _ := strings.Cut(err.Error(), "\n")
+	return errors.New(msg)
+}
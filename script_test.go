@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeScript writes a Lua script to a temporary file, returning its path
+func writeScript(t *testing.T, source string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.lua")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScriptConfigValidate(t *testing.T) {
+	hook := writeScript(t, "function handle(event) end")
+	tests := []struct {
+		name        string
+		cfg         ScriptConfig
+		expectError bool
+	}{
+		{name: "Disabled"},
+		{name: "Script", cfg: ScriptConfig{Path: hook, Timeout: "500ms", OnError: "drop"}},
+		{name: "Settings without a path", cfg: ScriptConfig{Timeout: "1s"}, expectError: true},
+		{name: "Missing script", cfg: ScriptConfig{Path: filepath.Join(t.TempDir(), "missing.lua")}, expectError: true},
+		{name: "Syntax error", cfg: ScriptConfig{Path: writeScript(t, "function handle(event)")}, expectError: true},
+		{name: "No handle function", cfg: ScriptConfig{Path: writeScript(t, "local x = 1")}, expectError: true},
+		{name: "Error loading", cfg: ScriptConfig{Path: writeScript(t, "error('broken')")}, expectError: true},
+		{name: "Files aren't available", cfg: ScriptConfig{Path: writeScript(t, "local f = io.open('/etc/passwd')")}, expectError: true},
+		{name: "Invalid timeout", cfg: ScriptConfig{Path: hook, Timeout: "soon"}, expectError: true},
+		{name: "Unknown on_error", cfg: ScriptConfig{Path: hook, OnError: "retry"}, expectError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if err != nil && strings.Contains(err.Error(), "\n") {
+				t.Errorf("Expected a one-line error, got %q", err)
+			}
+		})
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	origTraces := eventTraces
+	defer func() { eventTraces = origTraces }()
+	eventTraces = newTraceStore(10)
+	body := `{"type":"transaction.created","data":{"amount":-450,"labels":[],"merchant":null}}`
+
+	tests := []struct {
+		name          string
+		script        string
+		onError       string
+		timeout       string
+		expectPublish bool
+		expectBody    string
+		expectChannel string
+		expectResult  string
+	}{
+		{name: "No result", script: "function handle(event) end", expectPublish: true, expectBody: body, expectResult: "unchanged"},
+		{name: "Same payload", script: "function handle(event) return {payload = event.payload} end", expectPublish: true, expectBody: body, expectResult: "unchanged"},
+		{name: "Payload", script: "function handle(event) return {payload = {amount = event.payload.data.amount}} end", expectPublish: true, expectBody: `{"amount":-450}`, expectResult: "modified"},
+		{name: "Changed field", script: `function handle(event)
+			event.payload.data.notes = "lunch"
+			table.insert(event.payload.data.labels, "work")
+			event.payload.data.merchant = nil
+			return {payload = event.payload}
+		end`, expectPublish: true, expectBody: `{"data":{"amount":-450,"labels":["work"],"notes":"lunch"},"type":"transaction.created"}`, expectResult: "modified"},
+		{name: "Route", script: "function handle(event) return {channel = 'monzo-alerts'} end", expectPublish: true, expectBody: body, expectChannel: "monzo-alerts", expectResult: "modified"},
+		{name: "Drop", script: "function handle(event) return {drop = true} end", expectBody: body, expectResult: "dropped"},
+		{name: "Reads the event", script: `function handle(event)
+			if event.account_id == "acc_1" and event.type == "transaction.created" and event.payload.data.merchant == null then
+				return {channel = "acc-1"}
+			end
+		end`, expectPublish: true, expectBody: body, expectChannel: "acc-1", expectResult: "modified"},
+		{name: "Failure publishes", script: "function handle(event) error('broken') end", expectPublish: true, expectBody: body, expectResult: "error"},
+		{name: "Failure drops", script: "function handle(event) error('broken') end", onError: "drop", expectBody: body, expectResult: "error"},
+		{name: "Invalid result", script: "function handle(event) return 'yes' end", onError: "drop", expectBody: body, expectResult: "error"},
+		{name: "Invalid payload", script: "function handle(event) return {payload = {[true] = 1}} end", onError: "drop", expectBody: body, expectResult: "error"},
+		{name: "Timeout", script: "function handle(event) while true do end end", timeout: "50ms", expectPublish: true, expectBody: body, expectResult: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &webhookEvent{ID: "evt_" + strings.ReplaceAll(tt.name, " ", "_"), Type: "transaction.created", AccountID: "acc_1", Body: []byte(body)}
+			eventTraces.start(event, "test", nil)
+			cfg := ScriptConfig{Path: writeScript(t, tt.script), OnError: tt.onError, Timeout: tt.timeout}
+			if err := cfg.validate(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			before := testutil.ToFloat64(scriptRuns.WithLabelValues(tt.expectResult))
+
+			if got := runScript(context.Background(), cfg, event); got != tt.expectPublish {
+				t.Errorf("Expected publish %v, got %v", tt.expectPublish, got)
+			}
+			if string(event.Body) != tt.expectBody || event.Channel != tt.expectChannel {
+				t.Errorf("Unexpected event: body %s, channel %q", event.Body, event.Channel)
+			}
+			if testutil.ToFloat64(scriptRuns.WithLabelValues(tt.expectResult))-before != 1 {
+				t.Errorf("Expected the %s result to be counted", tt.expectResult)
+			}
+		})
+	}
+}
+
+func TestRunScriptTrace(t *testing.T) {
+	origTraces := eventTraces
+	defer func() { eventTraces = origTraces }()
+	eventTraces = newTraceStore(10)
+	event := &webhookEvent{ID: "evt_trace", Type: "transaction.created", Body: []byte(`{"type":"transaction.created"}`)}
+	eventTraces.start(event, "test", nil)
+
+	cfg := ScriptConfig{Path: writeScript(t, `function handle(event)
+		event.payload.tags = {"lua"}
+		return {payload = event.payload}
+	end`)}
+	if !runScript(context.Background(), cfg, event) {
+		t.Fatal("Expected the event to be published")
+	}
+	if tags, _ := event.Payload["tags"].([]interface{}); len(tags) != 1 {
+		t.Errorf("Expected the payload to be replaced, got %v", event.Payload)
+	}
+
+	trace, _ := eventTraces.get(event.ID)
+	if len(trace.Transformations) != 1 || trace.Transformations[0].Name != "script" {
+		t.Errorf("Expected a script transformation in the trace, got %+v", trace.Transformations)
+	}
+}
+
+func TestRunScriptConcurrently(t *testing.T) {
+	// Each interpreter counts the events it handles, so the counts would be
+	// lost or interleaved if two events shared one
+	cfg := ScriptConfig{Path: writeScript(t, `local handled = 0
+	function handle(event)
+		handled = handled + 1
+		local before = handled
+		for i = 1, 1000 do end
+		if handled ~= before then error("interleaved") end
+		return {channel = event.id}
+	end`), OnError: "drop"}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			event := &webhookEvent{ID: id, Type: "transaction.created", Body: []byte(`{"type":"transaction.created"}`)}
+			if !runScript(context.Background(), cfg, event) || event.Channel != id {
+				t.Errorf("Unexpected result for %s: channel %q", id, event.Channel)
+			}
+		}("evt_" + string(rune('a'+i)))
+	}
+	wg.Wait()
+}
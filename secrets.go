@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretFile is a secret read from the file named by a *_FILE environment
+// variable, as Docker and Kubernetes mount secrets
+type secretFile struct {
+	path     string
+	value    string
+	onChange func(string)
+}
+
+var (
+	secretFilesMu sync.Mutex
+	secretFiles   = make(map[string]*secretFile)
+)
+
+// credentialsMu guards the credentials that are replaced when their secret
+// files change: basicAuthUsername, basicAuthPassword and adminToken
+var credentialsMu sync.RWMutex
+
+// getenvSecret returns the value of an environment variable, or the contents
+// of the file named by its _FILE variant, without trailing newlines. Setting
+// both is an error.
+func getenvSecret(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		return "", fmt.Errorf("only one of %s and %s_FILE can be set", name, name)
+	}
+	value, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %w", name, err)
+	}
+
+	secretFilesMu.Lock()
+	secretFiles[name] = &secretFile{path: path, value: value}
+	secretFilesMu.Unlock()
+	return value, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// watchSecret calls onChange with the new value whenever the file a secret
+// was read from changes. It returns false if the secret wasn't read from a
+// file.
+func watchSecret(name string, onChange func(string)) bool {
+	secretFilesMu.Lock()
+	defer secretFilesMu.Unlock()
+	secret, ok := secretFiles[name]
+	if ok {
+		secret.onChange = onChange
+	}
+	return ok
+}
+
+// reloadSecrets re-reads the watched secret files, calling onChange for those
+// that have changed. A file that can't be read keeps its previous value.
+func reloadSecrets(ctx context.Context) error {
+	secretFilesMu.Lock()
+	names := make([]string, 0, len(secretFiles))
+	for name, secret := range secretFiles {
+		if secret.onChange != nil {
+			names = append(names, name)
+		}
+	}
+	secretFilesMu.Unlock()
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		secretFilesMu.Lock()
+		secret := secretFiles[name]
+		secretFilesMu.Unlock()
+
+		value, err := readSecretFile(secret.path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s_FILE: %v", name, err))
+			continue
+		}
+		if value == secret.value {
+			continue
+		}
+		secretFilesMu.Lock()
+		secret.value = value
+		secretFilesMu.Unlock()
+		secret.onChange(value)
+		logInfo("Reloaded %s from %s", name, secret.path)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// webhookBasicAuth returns the webhook's basic authentication credentials
+func webhookBasicAuth() (username, password string) {
+	credentialsMu.RLock()
+	defer credentialsMu.RUnlock()
+	return basicAuthUsername, basicAuthPassword
+}
+
+// currentAdminToken returns the admin API token
+func currentAdminToken() string {
+	credentialsMu.RLock()
+	defer credentialsMu.RUnlock()
+	return adminToken
+}
+
+// watchCredentialSecrets replaces the webhook password, admin token and
+// Redis password when their secret files change, returning whether any are
+// watched. Secrets only used when connecting, such as Kafka's, are read at
+// startup.
+func watchCredentialSecrets(redisPassword *credentialValue) bool {
+	watched := watchSecret("WEBHOOK_PASSWORD", func(value string) {
+		credentialsMu.Lock()
+		basicAuthPassword = value
+		credentialsMu.Unlock()
+	})
+	if watchSecret("ADMIN_TOKEN", func(value string) {
+		credentialsMu.Lock()
+		adminToken = value
+		credentialsMu.Unlock()
+	}) {
+		watched = true
+	}
+	if watchSecret("REDIS_PASSWORD", redisPassword.set) {
+		watched = true
+	}
+	return watched
+}
+
+// credentialValue is a credential that can be replaced while in use
+type credentialValue struct {
+	mu    sync.RWMutex
+	value string
+}
+
+func (c *credentialValue) get() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.value
+}
+
+func (c *credentialValue) set(value string) {
+	c.mu.Lock()
+	c.value = value
+	c.mu.Unlock()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetenvSecret(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretPath, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		file        string
+		expected    string
+		expectError bool
+	}{
+		{name: "Environment variable", value: "from-env", expected: "from-env"},
+		{name: "File with trailing newline", file: secretPath, expected: "from-file"},
+		{name: "Neither set", expected: ""},
+		{name: "Both set", value: "from-env", file: secretPath, expectError: true},
+		{name: "Missing file", file: filepath.Join(dir, "missing"), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_SECRET", tt.value)
+			t.Setenv("TEST_SECRET_FILE", tt.file)
+			defer func() {
+				secretFilesMu.Lock()
+				delete(secretFiles, "TEST_SECRET")
+				secretFilesMu.Unlock()
+			}()
+
+			value, err := getenvSecret("TEST_SECRET")
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if value != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, value)
+			}
+		})
+	}
+}
+
+func TestReloadSecrets(t *testing.T) {
+	defer func() {
+		secretFilesMu.Lock()
+		delete(secretFiles, "TEST_SECRET")
+		secretFilesMu.Unlock()
+	}()
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SECRET_FILE", path)
+
+	if watchSecret("TEST_SECRET", func(string) {}) {
+		t.Error("Expected a secret that hasn't been read not to be watched")
+	}
+	if _, err := getenvSecret("TEST_SECRET"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	current := &credentialValue{value: "first"}
+	changes := 0
+	if !watchSecret("TEST_SECRET", func(value string) {
+		changes++
+		current.set(value)
+	}) {
+		t.Fatal("Expected the secret to be watched")
+	}
+
+	if err := reloadSecrets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changes != 0 {
+		t.Errorf("Expected no change for an unchanged file, got %d", changes)
+	}
+
+	if err := os.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadSecrets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changes != 1 || current.get() != "second" {
+		t.Errorf("Expected one change to 'second', got %d changes and '%s'", changes, current.get())
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadSecrets(context.Background()); err == nil {
+		t.Error("Expected an error for a missing file, got nil")
+	}
+	if current.get() != "second" {
+		t.Errorf("Expected the previous value to be kept, got '%s'", current.get())
+	}
+}
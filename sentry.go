@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var sentryEventsTotal = metrics.newCounterVec(
+	"monzo_webhook_sentry_events_total",
+	"Errors and panics reported to Sentry, by kind and result",
+	"kind", "result",
+)
+
+// errorReporter reports errors and panics to Sentry when SENTRY_DSN is set
+var errorReporter *sentryReporter
+
+// sentryMaxInFlight bounds the error reports waiting to be sent, so that a
+// burst of failures doesn't pile up requests to Sentry
+const sentryMaxInFlight = 10
+
+// sentryTimeout bounds sending a report, and waiting for a panic's report to
+// be sent
+const sentryTimeout = 10 * time.Second
+
+// sentryReporter reports to a Sentry project with the Sentry SDK, whose
+// transport sends reports in the background
+type sentryReporter struct {
+	client *sentry.Client
+	host   string
+}
+
+// sentryFromEnv returns a reporter for SENTRY_DSN, or nil if it's not set
+func sentryFromEnv() (*sentryReporter, error) {
+	dsn, err := getenvSecret("SENTRY_DSN")
+	if err != nil || dsn == "" {
+		return nil, err
+	}
+	return newSentryReporter(dsn, os.Getenv("SENTRY_ENVIRONMENT"))
+}
+
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	parsed, err := sentry.NewDsn(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: %w", err)
+	}
+	transport := sentry.NewHTTPTransport()
+	transport.BufferSize = sentryMaxInFlight
+	transport.Timeout = sentryTimeout
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: environment,
+		Release:     "monzo-webhook@" + version,
+		Transport:   transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: %w", err)
+	}
+	return &sentryReporter{client: client, host: parsed.GetHost()}, nil
+}
+
+// sentryScope returns a scope that tags reports
+func sentryScope(tags map[string]string) *sentry.Scope {
+	scope := sentry.NewScope()
+	scope.SetTags(tags)
+	return scope
+}
+
+// captureError reports an error in the background. Reports are dropped
+// while sentryMaxInFlight others are waiting to be sent. It's a no-op on a
+// nil reporter.
+func (s *sentryReporter) captureError(err error, tags map[string]string) {
+	if s == nil || err == nil {
+		return
+	}
+	s.record("error", s.client.CaptureException(err, nil, sentryScope(tags)))
+}
+
+// capturePanic reports a recovered panic, waiting for it to be sent since
+// the process may be about to exit. It must be called from the deferred
+// function that recovered the panic so that the stack trace includes it.
+func (s *sentryReporter) capturePanic(value interface{}, tags map[string]string) {
+	if s == nil {
+		return
+	}
+	err, ok := value.(error)
+	if !ok {
+		err = fmt.Errorf("%v", value)
+	}
+	event := s.client.EventFromException(err, sentry.LevelFatal)
+	if !ok {
+		event.Exception[len(event.Exception)-1].Type = "panic"
+	}
+	for i := range event.Exception {
+		event.Exception[i].Mechanism = &sentry.Mechanism{Type: "panic"}
+		event.Exception[i].Mechanism.SetUnhandled()
+	}
+	s.record("panic", s.client.CaptureEvent(event, nil, sentryScope(tags)))
+	if !s.client.Flush(sentryTimeout) {
+		logWarn("Timed out reporting panic to Sentry")
+	}
+}
+
+// recoverPanic reports a panic in the deferring goroutine and then resumes
+// panicking, so that the process fails as it would have without Sentry:
+//
+//	defer errorReporter.recoverPanic(tags)
+func (s *sentryReporter) recoverPanic(tags map[string]string) {
+	if value := recover(); value != nil {
+		s.capturePanic(value, tags)
+		panic(value)
+	}
+}
+
+// record counts a report handed to the SDK's transport, or dropped by the
+// SDK when it returns no ID
+func (s *sentryReporter) record(kind string, id *sentry.EventID) {
+	if id == nil {
+		sentryEventsTotal.WithLabelValues(kind, "dropped").Inc()
+		return
+	}
+	logDebug("Queued %s %s for Sentry", kind, *id)
+	sentryEventsTotal.WithLabelValues(kind, "queued").Inc()
+}
+
+// sentryEventTags returns the tags that identify an event and the sink it
+// was being published to
+func sentryEventTags(event *webhookEvent, sink Sink) map[string]string {
+	tags := map[string]string{"event_type": event.Type, "event_id": event.ID}
+	if event.Tenant != nil {
+		tags["tenant"] = event.Tenant.Name
+	}
+	if sink != nil {
+		tags["sink"] = sink.Name()
+		if channel := sinkChannel(sink, event); channel != "" {
+			tags["channel"] = channel
+		}
+	}
+	return tags
+}
+
+// sinkChannel returns the Redis channel a sink publishes an event to, if any
+func sinkChannel(sink Sink, event *webhookEvent) string {
+	switch s := sink.(type) {
+	case *redisSink:
+		return s.channelFor(event)
+	case *notificationSink:
+		return sinkChannel(s.sink, event)
+	case *spoolingSink:
+		return sinkChannel(s.sink, event)
+	}
+	return ""
+}
+
+// sentryRecoverMiddleware reports panics in HTTP handlers before letting
+// net/http handle them as usual, by logging them and closing the connection
+func sentryRecoverMiddleware(s *sentryReporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value != http.ErrAbortHandler {
+				s.capturePanic(value, map[string]string{"method": r.Method, "path": r.URL.Path})
+			}
+			panic(value)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSentryReporter(t *testing.T) {
+	tests := []struct {
+		dsn    string
+		host   string
+		hasErr bool
+	}{
+		{dsn: "https://abc@o1.ingest.sentry.io/42", host: "o1.ingest.sentry.io"},
+		{dsn: "http://abc@sentry.internal:9000/relay/7", host: "sentry.internal"},
+		{dsn: "https://o1.ingest.sentry.io/42", hasErr: true},
+		{dsn: "https://abc@o1.ingest.sentry.io/", hasErr: true},
+		{dsn: "ftp://abc@o1.ingest.sentry.io/42", hasErr: true},
+	}
+	for _, tt := range tests {
+		s, err := newSentryReporter(tt.dsn, "test")
+		if (err != nil) != tt.hasErr {
+			t.Errorf("newSentryReporter(%q): expected error: %v, got %v", tt.dsn, tt.hasErr, err)
+			continue
+		}
+		if err == nil && s.host != tt.host {
+			t.Errorf("newSentryReporter(%q): expected host %q, got %q", tt.dsn, tt.host, s.host)
+		}
+	}
+}
+
+// testSentryEvent is the part of a reported event the tests check
+type testSentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Level       string            `json:"level"`
+	Environment string            `json:"environment"`
+	Release     string            `json:"release"`
+	Tags        map[string]string `json:"tags"`
+	Exception   []struct {
+		Type      string `json:"type"`
+		Value     string `json:"value"`
+		Mechanism *struct {
+			Type    string `json:"type"`
+			Handled *bool  `json:"handled"`
+		} `json:"mechanism"`
+		Stacktrace *struct {
+			Frames []struct {
+				Function string `json:"function"`
+				Module   string `json:"module"`
+				InApp    bool   `json:"in_app"`
+			} `json:"frames"`
+		} `json:"stacktrace"`
+	} `json:"exception"`
+}
+
+// newTestSentry returns a reporter for a fake Sentry server and a channel
+// receiving the events it's sent
+func newTestSentry(t *testing.T) (*sentryReporter, chan testSentryEvent) {
+	t.Helper()
+	events := make(chan testSentryEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/envelope/" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("X-Sentry-Auth"); !strings.Contains(auth, "sentry_key=public") {
+			t.Errorf("Expected the public key in X-Sentry-Auth, got '%s'", auth)
+		}
+		lines := bufio.NewScanner(r.Body)
+		lines.Buffer(nil, 1<<20)
+		var items []string
+		for lines.Scan() {
+			items = append(items, lines.Text())
+		}
+		if len(items) != 3 || !strings.Contains(items[1], `"type":"event"`) {
+			t.Errorf("Expected an envelope with one event, got %v", items)
+			return
+		}
+		var event testSentryEvent
+		if err := json.Unmarshal([]byte(items[2]), &event); err != nil {
+			t.Errorf("Invalid event: %v", err)
+		}
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+
+	s, err := newSentryReporter(strings.Replace(server.URL, "://", "://public@", 1)+"/42", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, events
+}
+
+func TestSentryCaptureError(t *testing.T) {
+	s, events := newTestSentry(t)
+	event := &webhookEvent{ID: "evt_1", Type: "transaction.created", Tenant: &TenantConfig{Name: "household", Channel: "household-events"}}
+	sink := &notificationSink{sink: &redisSink{name: "redis", channel: "monzo-events", routed: true}}
+
+	s.captureError(errors.New("connection refused"), sentryEventTags(event, sink))
+	select {
+	case got := <-events:
+		if got.Level != "error" || got.Environment != "test" || got.Release != "monzo-webhook@"+version || len(got.EventID) != 32 {
+			t.Errorf("Unexpected event: %+v", got)
+		}
+		if got.Exception[len(got.Exception)-1].Value != "connection refused" {
+			t.Errorf("Expected the error message, got '%s'", got.Exception[len(got.Exception)-1].Value)
+		}
+		expected := map[string]string{"event_type": "transaction.created", "event_id": "evt_1", "tenant": "household", "sink": "redis", "channel": "household-events"}
+		for k, v := range expected {
+			if got.Tags[k] != v {
+				t.Errorf("Expected tag %s=%s, got '%s'", k, v, got.Tags[k])
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the error to be reported")
+	}
+
+	// Reporting is a no-op without a DSN
+	var disabled *sentryReporter
+	disabled.captureError(errors.New("ignored"), nil)
+	disabled.capturePanic("ignored", nil)
+}
+
+func TestSentryRecoverMiddleware(t *testing.T) {
+	s, events := newTestSentry(t)
+	handler := sentryRecoverMiddleware(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		var m map[string]string
+		m["boom"] = "nil map"
+	}))
+
+	serve := func(path string) (recovered interface{}) {
+		defer func() { recovered = recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, nil))
+		return nil
+	}
+
+	if recovered := serve("/webhook"); recovered == nil {
+		t.Fatal("Expected the panic to be resumed")
+	}
+	got := <-events
+	exception := got.Exception[len(got.Exception)-1]
+	if got.Level != "fatal" || got.Tags["path"] != "/webhook" || !strings.Contains(exception.Value, "nil map") {
+		t.Errorf("Unexpected event: %+v", got)
+	}
+	if exception.Stacktrace == nil || len(exception.Stacktrace.Frames) == 0 {
+		t.Fatal("Expected a stack trace")
+	}
+	if exception.Mechanism == nil || exception.Mechanism.Type != "panic" || exception.Mechanism.Handled == nil || *exception.Mechanism.Handled {
+		t.Errorf("Expected an unhandled panic mechanism, got %+v", exception.Mechanism)
+	}
+	frames := exception.Stacktrace.Frames
+	found := false
+	for _, frame := range frames {
+		if strings.HasPrefix(frame.Function, "TestSentryRecoverMiddleware") {
+			found = frame.InApp
+		}
+	}
+	if !found {
+		t.Errorf("Expected the handler's frame to be in the stack trace, got %+v", frames)
+	}
+
+	if recovered := serve("/abort"); recovered != http.ErrAbortHandler {
+		t.Fatalf("Expected ErrAbortHandler to be resumed, got %v", recovered)
+	}
+	select {
+	case got := <-events:
+		t.Errorf("Expected ErrAbortHandler not to be reported, got %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
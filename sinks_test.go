@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSink records published events and fails with err if set
+type fakeSink struct {
+	name string
+	err  error
+
+	mu     sync.Mutex
+	events []*webhookEvent
+}
+
+func (s *fakeSink) Name() string { return s.name }
+
+func (s *fakeSink) Publish(ctx context.Context, event *webhookEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return s.err
+}
+
+func (s *fakeSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+func TestPublishToSinks(t *testing.T) {
+	event := &webhookEvent{Type: "transaction.created", Body: []byte(`{}`)}
+
+	t.Run("Optional failures are not returned", func(t *testing.T) {
+		failing := &fakeSink{name: "failing", err: errors.New("unavailable")}
+		healthy := &fakeSink{name: "healthy"}
+
+		err := publishToSinks(context.Background(), []sinkEntry{{sink: failing}, {sink: healthy}}, nil, event)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if failing.count() != 1 || healthy.count() != 1 {
+			t.Errorf("Expected every sink to receive the event, got %d and %d", failing.count(), healthy.count())
+		}
+		if got := testutil.ToFloat64(sinkPublishTotal.WithLabelValues("failing", "error")); got != 1 {
+			t.Errorf("Expected 1 error for the failing sink, got %v", got)
+		}
+	})
+
+	t.Run("Required failure stops the fan-out", func(t *testing.T) {
+		required := &fakeSink{name: "required", err: errors.New("nacked")}
+		optional := &fakeSink{name: "optional"}
+
+		err := publishToSinks(context.Background(), []sinkEntry{{sink: optional}, {sink: required, required: true}}, nil, event)
+		if err == nil || !strings.Contains(err.Error(), "required sink 'required'") {
+			t.Errorf("Expected the required sink's error, got %v", err)
+		}
+		if optional.count() != 0 {
+			t.Errorf("Expected optional sinks to be skipped, got %d events", optional.count())
+		}
+	})
+
+	t.Run("Sinks with rules only get matching events", func(t *testing.T) {
+		threshold := 500.0
+		all := &fakeSink{name: "all"}
+		alerts := &fakeSink{name: "large-transactions"}
+		entries := []sinkEntry{
+			{sink: all, required: true},
+			{sink: alerts, required: true, when: []EventRule{{Type: "transaction.*", Field: "data.amount", Abs: true, GTE: &threshold}}},
+		}
+
+		for _, amount := range []float64{-120, -2500} {
+			event := &webhookEvent{Type: "transaction.created", Body: []byte(`{}`), Payload: map[string]interface{}{
+				"data": map[string]interface{}{"amount": amount},
+			}}
+			if err := publishToSinks(context.Background(), entries, nil, event); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		if all.count() != 2 || alerts.count() != 1 {
+			t.Errorf("Expected 2 events and 1 large transaction, got %d and %d", all.count(), alerts.count())
+		}
+		if got := testutil.ToFloat64(sinkPublishTotal.WithLabelValues("large-transactions", "filtered")); got != 1 {
+			t.Errorf("Expected 1 filtered event, got %v", got)
+		}
+	})
+}
+
+func TestAddSinkRejectsDuplicateNames(t *testing.T) {
+	origSinks := sinks
+	defer func() { sinks = origSinks }()
+	sinks = nil
+
+	if err := addSink(&fakeSink{name: "archive"}, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := addSink(&fakeSink{name: "archive"}, false); err == nil {
+		t.Error("Expected an error for a duplicate sink name")
+	}
+}
+
+func TestValidateSinks(t *testing.T) {
+	tests := []struct {
+		name        string
+		sinks       []SinkConfig
+		expectError bool
+	}{
+		{name: "No sinks"},
+		{name: "Redis and file", sinks: []SinkConfig{{Type: "redis", Channel: "audit"}, {Type: "file", Path: "/tmp/archive.jsonl"}}},
+		{name: "Redis without channel", sinks: []SinkConfig{{Type: "redis"}}, expectError: true},
+		{name: "File without path", sinks: []SinkConfig{{Type: "file"}}, expectError: true},
+		{name: "Unknown type", sinks: []SinkConfig{{Type: "carrier-pigeon"}}, expectError: true},
+		{name: "Chained Redis sink", sinks: []SinkConfig{{Type: "redis", Channel: "audit", Chain: true}}, expectError: true},
+		{name: "Rule without comparison", sinks: []SinkConfig{{Type: "redis", Channel: "alerts", When: []EventRule{{Field: "data.amount"}}}}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSinks(tt.sinks)
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive", "events.jsonl")
+	sink, err := newConfiguredSink(SinkConfig{Type: "file", Path: path}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sink.(*fileSink).Close()
+
+	if sink.Name() != "file" {
+		t.Errorf("Expected default name 'file', got '%s'", sink.Name())
+	}
+
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []*webhookEvent{
+		{Type: "transaction.created", Body: []byte("{\n  \"type\": \"transaction.created\"\n}"), Received: received},
+		{Type: "transaction.updated", Body: []byte(`{"type":"transaction.updated"}`), Received: received, Tenant: &TenantConfig{Name: "alice"}},
+	}
+	for _, event := range events {
+		if err := sink.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d: %q", len(lines), data)
+	}
+
+	var record fileRecord
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatalf("Invalid JSON line: %v", err)
+	}
+	if record.Type != "transaction.updated" || record.Tenant != "alice" || !record.Received.Equal(received) {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+}
+
+func TestRedisSinkChannel(t *testing.T) {
+	origConfig := eventConfig
+	defer func() { eventConfig = origConfig }()
+	eventConfig = EventConfig{Accounts: []AccountConfig{
+		{ID: "acc_joint", Label: "Joint", Channel: "monzo-joint"},
+		{ID: "acc_personal", Label: "Personal"},
+	}}
+
+	fake, client := newFakeRedis(t)
+	tenant := &TenantConfig{Name: "alice", Channel: "monzo-alice"}
+	noChannel := &TenantConfig{Name: "bob"}
+
+	tests := []struct {
+		name    string
+		routed  bool
+		account string
+		tenant  *TenantConfig
+		rule    string
+		expect  string
+	}{
+		{name: "Rule channel over account channel", routed: true, account: "acc_joint", rule: "monzo-alerts", expect: "monzo-alerts"},
+		{name: "Account channel", routed: true, account: "acc_joint", expect: "monzo-joint"},
+		{name: "Tenant channel over account channel", routed: true, account: "acc_joint", tenant: tenant, expect: "monzo-alice"},
+		{name: "Tenant without a channel", routed: true, account: "acc_joint", tenant: noChannel, expect: "monzo-events"},
+		{name: "Account without a channel", routed: true, account: "acc_personal", expect: "monzo-events"},
+		{name: "Tenant channel", routed: true, account: "acc_personal", tenant: tenant, expect: "monzo-alice"},
+		{name: "Unknown account", routed: true, account: "acc_other", expect: "monzo-events"},
+		{name: "Not routed", account: "acc_joint", tenant: tenant, expect: "monzo-events"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &redisSink{name: "redis", client: client, channel: "monzo-events", routed: tt.routed}
+			event := &webhookEvent{ID: tt.name, Type: "transaction.created", AccountID: tt.account, Tenant: tt.tenant, Channel: tt.rule, Body: []byte(tt.name)}
+			if err := sink.Publish(context.Background(), event); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			messages := fake.published[tt.expect]
+			if len(messages) == 0 || messages[len(messages)-1] != tt.name {
+				t.Errorf("Expected the event on channel %s, got %v", tt.expect, fake.published)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// expenseSplitsKey is the Redis hash holding split transactions, from
+// transaction ID to the JSON encoded splitRecord
+const expenseSplitsKey = "monzo-webhook:splits"
+
+// settlementEventType is the type of the events published when a
+// transaction is split
+const settlementEventType = "settlement.owed"
+
+// SplitConfig configures shared expenses: the people they are shared with,
+// and rules that split matching transactions automatically
+type SplitConfig struct {
+	People []string    `json:"people"`
+	Rules  []SplitRule `json:"rules"`
+}
+
+// SplitRule splits transaction.created events whose field matches a pattern.
+// Field defaults to data.description, and the pattern is case-insensitive and
+// may use * as a wildcard. Shares are the percentage of the amount each
+// person owes; the rest is the account holder's.
+type SplitRule struct {
+	Name    string             `json:"name"`
+	Field   string             `json:"field"`
+	Pattern string             `json:"pattern"`
+	Shares  map[string]float64 `json:"shares"`
+}
+
+// splitRecord is a split transaction. Amounts are in minor units. Owed is
+// positive when the person owes the account holder, so a split debit adds to
+// their balance and a split credit, such as them paying the holder back,
+// takes from it.
+type splitRecord struct {
+	TransactionID string             `json:"transaction_id"`
+	AccountID     string             `json:"account_id,omitempty"`
+	Description   string             `json:"description,omitempty"`
+	Amount        int64              `json:"amount"`
+	Currency      string             `json:"currency"`
+	Shares        map[string]float64 `json:"shares"`
+	Owed          map[string]int64   `json:"owed"`
+	Rule          string             `json:"rule,omitempty"`
+	Created       time.Time          `json:"created"`
+}
+
+var expenseSplitsRecorded = metrics.newCounterVec("monzo_webhook_splits_total",
+	"Transactions split with other people, by source (rule or admin).", "source")
+
+// splitLedger keeps the split transactions and the running balance between
+// the account holder and each person. Splits are stored in Redis when it's
+// available, so that they survive restarts.
+type splitLedger struct {
+	client  *redis.Client
+	people  []string
+	rules   []SplitRule
+	matches []*regexp.Regexp
+	publish func(eventType string, body []byte, auth string) error
+	now     func() time.Time
+
+	mu      sync.RWMutex
+	records map[string]splitRecord
+}
+
+var expenseSplits = &splitLedger{records: make(map[string]splitRecord)}
+
+// validate checks the split configuration for unknown people and invalid
+// shares
+func (c SplitConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, person := range c.People {
+		if person == "" || seen[person] {
+			return fmt.Errorf("splits people must be unique and non-empty")
+		}
+		seen[person] = true
+	}
+	for i, rule := range c.Rules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("split rule %d: pattern is required", i+1)
+		}
+		if err := validateShares(c.People, rule.Shares); err != nil {
+			return fmt.Errorf("split rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateShares checks that shares are for known people and add up to no
+// more than 100%
+func validateShares(people []string, shares map[string]float64) error {
+	if len(shares) == 0 {
+		return fmt.Errorf("shares are required")
+	}
+	known := make(map[string]bool, len(people))
+	for _, person := range people {
+		known[person] = true
+	}
+	var total float64
+	for person, percent := range shares {
+		if !known[person] {
+			return fmt.Errorf("unknown person '%s'", person)
+		}
+		if percent <= 0 {
+			return fmt.Errorf("share for '%s' must be positive", person)
+		}
+		total += percent
+	}
+	if total > 100 {
+		return fmt.Errorf("shares add up to %g%%, more than 100%%", total)
+	}
+	return nil
+}
+
+// field returns the payload field the rule matches, defaulting to
+// data.description
+func (r SplitRule) field() string {
+	if r.Field == "" {
+		return "data.description"
+	}
+	return r.Field
+}
+
+func newSplitLedger(cfg SplitConfig, client *redis.Client) *splitLedger {
+	l := &splitLedger{
+		client:  client,
+		people:  cfg.People,
+		rules:   cfg.Rules,
+		publish: publishGeneratedEvent,
+		now:     clock.Now,
+		records: make(map[string]splitRecord),
+	}
+	for _, rule := range cfg.Rules {
+		l.matches = append(l.matches, compileWildcard(rule.Pattern))
+	}
+	return l
+}
+
+// load replaces the splits with the ones stored in Redis
+func (l *splitLedger) load(ctx context.Context) error {
+	if l.client == nil {
+		return nil
+	}
+	stored, err := l.client.HGetAll(ctx, expenseSplitsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	records := make(map[string]splitRecord, len(stored))
+	for id, value := range stored {
+		var record splitRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			logWarn("Ignoring unreadable split for transaction '%s': %v", id, err)
+			continue
+		}
+		records[id] = record
+	}
+
+	l.mu.Lock()
+	l.records = records
+	l.mu.Unlock()
+	return nil
+}
+
+// get returns the split for a transaction
+func (l *splitLedger) get(transactionID string) (splitRecord, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, ok := l.records[transactionID]
+	return record, ok
+}
+
+// record saves a split, replacing any earlier split of the same transaction,
+// and publishes a settlement.owed event for it
+func (l *splitLedger) record(ctx context.Context, record splitRecord) (splitRecord, error) {
+	record.Owed = make(map[string]int64, len(record.Shares))
+	for person, percent := range record.Shares {
+		record.Owed[person] = int64(math.Round(-float64(record.Amount) * percent / 100))
+	}
+	if record.Created.IsZero() {
+		record.Created = l.now().UTC()
+	}
+
+	if l.client != nil {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return record, err
+		}
+		if err := l.client.HSet(ctx, expenseSplitsKey, record.TransactionID, value).Err(); err != nil {
+			return record, err
+		}
+	}
+	l.mu.Lock()
+	l.records[record.TransactionID] = record
+	l.mu.Unlock()
+
+	source := "admin"
+	if record.Rule != "" {
+		source = "rule"
+	}
+	expenseSplitsRecorded.WithLabelValues(source).Inc()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type": settlementEventType,
+		"data": map[string]interface{}{
+			"transaction_id": record.TransactionID,
+			"account_id":     record.AccountID,
+			"description":    record.Description,
+			"amount":         record.Amount,
+			"currency":       record.Currency,
+			"shares":         record.Shares,
+			"owed":           record.Owed,
+			"balances":       l.balances(),
+		},
+	})
+	if err != nil {
+		return record, err
+	}
+	if err := l.publish(settlementEventType, body, "splits"); err != nil {
+		logError("Error publishing settlement for transaction '%s': %v", record.TransactionID, err)
+	}
+	return record, nil
+}
+
+// remove deletes the split of a transaction, reporting whether there was one
+func (l *splitLedger) remove(ctx context.Context, transactionID string) (bool, error) {
+	if _, ok := l.get(transactionID); !ok {
+		return false, nil
+	}
+	if l.client != nil {
+		if err := l.client.HDel(ctx, expenseSplitsKey, transactionID).Err(); err != nil {
+			return false, err
+		}
+	}
+	l.mu.Lock()
+	delete(l.records, transactionID)
+	l.mu.Unlock()
+	return true, nil
+}
+
+// balances returns what each person owes the account holder, by currency.
+// Negative amounts are owed to the person.
+func (l *splitLedger) balances() map[string]map[string]int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[string]map[string]int64, len(l.people))
+	for _, person := range l.people {
+		balances[person] = make(map[string]int64)
+	}
+	for _, record := range l.records {
+		for person, owed := range record.Owed {
+			if balances[person] == nil {
+				balances[person] = make(map[string]int64)
+			}
+			balances[person][record.Currency] += owed
+		}
+	}
+	return balances
+}
+
+// apply splits a transaction.created event using the first matching rule.
+// Transactions that are already split, for example by the admin API, are
+// left alone, so redelivered events aren't split twice.
+func (l *splitLedger) apply(ctx context.Context, event *webhookEvent) {
+	if len(l.rules) == 0 || event.Type != "transaction.created" {
+		return
+	}
+	data, ok := event.Payload["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	id, _ := data["id"].(string)
+	amount, _ := data["amount"].(float64)
+	if declined, _ := data["decline_reason"].(string); id == "" || amount == 0 || declined != "" {
+		return
+	}
+	if _, ok := l.get(id); ok {
+		return
+	}
+
+	for i, rule := range l.rules {
+		value, ok := lookupField(event.Payload, rule.field())
+		text, isString := value.(string)
+		if !ok || !isString || !l.matches[i].MatchString(text) {
+			continue
+		}
+
+		record := splitRecord{
+			TransactionID: id,
+			AccountID:     event.AccountID,
+			Amount:        int64(amount),
+			Shares:        rule.Shares,
+			Rule:          rule.Name,
+		}
+		record.Description, _ = data["description"].(string)
+		record.Currency, _ = data["currency"].(string)
+		if record.Rule == "" {
+			record.Rule = fmt.Sprintf("rules[%d]", i)
+		}
+
+		if _, err := l.record(ctx, record); err != nil {
+			logError("Error splitting transaction '%s': %v", id, err)
+			return
+		}
+		logInfo("Split transaction %s with %d people using rule '%s'", id, len(rule.Shares), record.Rule)
+		eventTraces.update(event.ID, func(trace *eventTrace) {
+			trace.MatchedRules = append(trace.MatchedRules, traceRule{Kind: "split", Rule: record.Rule})
+		})
+		return
+	}
+}
+
+// adminSplitsHandler lists the balance with each person and the split
+// transactions, newest first
+func adminSplitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	expenseSplits.mu.RLock()
+	splits := make([]splitRecord, 0, len(expenseSplits.records))
+	for _, record := range expenseSplits.records {
+		splits = append(splits, record)
+	}
+	expenseSplits.mu.RUnlock()
+	sort.Slice(splits, func(i, j int) bool { return splits[i].Created.After(splits[j].Created) })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"balances": expenseSplits.balances(),
+		"splits":   splits,
+	})
+}
+
+// adminSplitHandler splits a transaction with PUT and removes its split with
+// DELETE. PUT takes a body like {"shares": {"alex": 50}, "amount": -4500,
+// "currency": "GBP", "description": "Dinner"}; the amount and currency are
+// only needed for transactions that haven't been split before.
+func adminSplitHandler(w http.ResponseWriter, r *http.Request) {
+	transactionID := r.PathValue("transaction")
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Shares      map[string]float64 `json:"shares"`
+			Amount      int64              `json:"amount"`
+			Currency    string             `json:"currency"`
+			Description string             `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+			return
+		}
+		if err := validateShares(expenseSplits.people, body.Shares); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		record, existing := expenseSplits.get(transactionID)
+		record.TransactionID = transactionID
+		record.Shares = body.Shares
+		record.Rule = ""
+		if body.Amount != 0 {
+			record.Amount = body.Amount
+		}
+		if body.Currency != "" {
+			record.Currency = body.Currency
+		}
+		if body.Description != "" {
+			record.Description = body.Description
+		}
+		if !existing && (record.Amount == 0 || record.Currency == "") {
+			http.Error(w, "amount and currency are required for a transaction that hasn't been split", http.StatusBadRequest)
+			return
+		}
+
+		record, err := expenseSplits.record(r.Context(), record)
+		if err != nil {
+			logError("Error saving split for transaction '%s': %v", transactionID, err)
+			http.Error(w, "Error saving split", http.StatusServiceUnavailable)
+			return
+		}
+		logInfo("Split transaction %s with %d people", transactionID, len(record.Shares))
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodDelete:
+		removed, err := expenseSplits.remove(r.Context(), transactionID)
+		if err != nil {
+			logError("Error removing split for transaction '%s': %v", transactionID, err)
+			http.Error(w, "Error saving split", http.StatusServiceUnavailable)
+			return
+		}
+		if !removed {
+			http.Error(w, "Transaction is not split", http.StatusNotFound)
+			return
+		}
+		logInfo("Removed split for transaction %s", transactionID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
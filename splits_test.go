@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transactionEvent builds a transaction.created event from its data
+func transactionEvent(data string) *webhookEvent {
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"transaction.created","data":`+data+`}`), &payload)
+	return &webhookEvent{Type: "transaction.created", Payload: payload}
+}
+
+func TestSplitConfigValidate(t *testing.T) {
+	people := []string{"alex", "sam"}
+	tests := []struct {
+		name        string
+		cfg         SplitConfig
+		expectError bool
+	}{
+		{name: "Empty", cfg: SplitConfig{}},
+		{name: "Valid rule", cfg: SplitConfig{People: people, Rules: []SplitRule{{Pattern: "OCTOPUS ENERGY*", Shares: map[string]float64{"alex": 50}}}}},
+		{name: "Shares add up to 100", cfg: SplitConfig{People: people, Rules: []SplitRule{{Pattern: "*", Shares: map[string]float64{"alex": 60, "sam": 40}}}}},
+		{name: "Duplicate person", cfg: SplitConfig{People: []string{"alex", "alex"}}, expectError: true},
+		{name: "Missing pattern", cfg: SplitConfig{People: people, Rules: []SplitRule{{Shares: map[string]float64{"alex": 50}}}}, expectError: true},
+		{name: "Unknown person", cfg: SplitConfig{People: people, Rules: []SplitRule{{Pattern: "*", Shares: map[string]float64{"jo": 50}}}}, expectError: true},
+		{name: "Over 100%", cfg: SplitConfig{People: people, Rules: []SplitRule{{Pattern: "*", Shares: map[string]float64{"alex": 60, "sam": 50}}}}, expectError: true},
+		{name: "Zero share", cfg: SplitConfig{People: people, Rules: []SplitRule{{Pattern: "*", Shares: map[string]float64{"alex": 0}}}}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err != nil) != tt.expectError {
+				t.Errorf("Expected error=%v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestSplitLedgerApply(t *testing.T) {
+	ledger := newSplitLedger(SplitConfig{
+		People: []string{"alex", "sam"},
+		Rules: []SplitRule{
+			{Name: "energy", Pattern: "OCTOPUS ENERGY*", Shares: map[string]float64{"alex": 50}},
+			{Name: "takeaway", Field: "data.category", Pattern: "eating_out", Shares: map[string]float64{"alex": 100.0 / 3, "sam": 100.0 / 3}},
+			{Name: "alex pays back", Field: "data.counterparty.name", Pattern: "ALEX *", Shares: map[string]float64{"alex": 100}},
+		},
+	}, nil)
+	var published []map[string]interface{}
+	ledger.publish = func(eventType string, body []byte, auth string) error {
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		published = append(published, payload)
+		return nil
+	}
+
+	ctx := context.Background()
+	ledger.apply(ctx, transactionEvent(`{"id":"tx_1","amount":-9000,"currency":"GBP","description":"OCTOPUS ENERGY 0123"}`))
+	ledger.apply(ctx, transactionEvent(`{"id":"tx_2","amount":-3000,"currency":"GBP","description":"Dishoom","category":"eating_out"}`))
+	ledger.apply(ctx, transactionEvent(`{"id":"tx_3","amount":-1200,"currency":"GBP","description":"Tesco","category":"groceries"}`))
+	ledger.apply(ctx, transactionEvent(`{"id":"tx_4","amount":2000,"currency":"GBP","description":"Rent","counterparty":{"name":"ALEX SMITH"}}`))
+	ledger.apply(ctx, transactionEvent(`{"id":"tx_5","amount":-5000,"currency":"GBP","description":"OCTOPUS ENERGY","decline_reason":"INSUFFICIENT_FUNDS"}`))
+	// A redelivered event is not split again
+	ledger.apply(ctx, transactionEvent(`{"id":"tx_1","amount":-9000,"currency":"GBP","description":"OCTOPUS ENERGY 0123"}`))
+
+	if len(published) != 3 {
+		t.Fatalf("Expected 3 settlement events, got %d", len(published))
+	}
+	if published[0]["type"] != settlementEventType {
+		t.Errorf("Expected type %s, got %v", settlementEventType, published[0]["type"])
+	}
+
+	balances := ledger.balances()
+	// alex: 4500 (energy) + 1000 (takeaway) - 2000 (paid back)
+	if balances["alex"]["GBP"] != 3500 || balances["sam"]["GBP"] != 1000 {
+		t.Errorf("Unexpected balances: %v", balances)
+	}
+
+	last := published[len(published)-1]["data"].(map[string]interface{})
+	if last["transaction_id"] != "tx_4" || last["balances"].(map[string]interface{})["alex"].(map[string]interface{})["GBP"] != float64(3500) {
+		t.Errorf("Unexpected settlement event: %v", last)
+	}
+}
+
+func TestAdminSplitHandlers(t *testing.T) {
+	origSplits := expenseSplits
+	defer func() { expenseSplits = origSplits }()
+
+	server, client := newFakeRedis(t)
+	expenseSplits = newSplitLedger(SplitConfig{People: []string{"alex"}}, client)
+	var published int
+	expenseSplits.publish = func(eventType string, body []byte, auth string) error {
+		published++
+		return nil
+	}
+	expenseSplits.now = func() time.Time { return time.Date(2026, 1, 24, 8, 30, 0, 0, time.UTC) }
+
+	request := func(method, transaction, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/splits/"+transaction, strings.NewReader(body))
+		req.SetPathValue("transaction", transaction)
+		rr := httptest.NewRecorder()
+		adminSplitHandler(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+		expectedOwed   int64
+	}{
+		{name: "New split without an amount", method: http.MethodPut, body: `{"shares":{"alex":50}}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown person", method: http.MethodPut, body: `{"shares":{"jo":50},"amount":-4500,"currency":"GBP"}`, expectedStatus: http.StatusBadRequest},
+		{name: "New split", method: http.MethodPut, body: `{"shares":{"alex":50},"amount":-4500,"currency":"GBP","description":"Dinner"}`, expectedStatus: http.StatusOK, expectedOwed: 2250},
+		{name: "Change shares", method: http.MethodPut, body: `{"shares":{"alex":20}}`, expectedStatus: http.StatusOK, expectedOwed: 900},
+		{name: "Remove", method: http.MethodDelete, expectedStatus: http.StatusNoContent},
+		{name: "Remove again", method: http.MethodDelete, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := request(tt.method, "tx_dinner", tt.body)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedOwed == 0 {
+				return
+			}
+			var record splitRecord
+			json.NewDecoder(rr.Body).Decode(&record)
+			if record.Owed["alex"] != tt.expectedOwed || record.Description != "Dinner" {
+				t.Errorf("Unexpected split: %+v", record)
+			}
+			// Another instance picks up the split from Redis
+			reloaded := newSplitLedger(SplitConfig{People: []string{"alex"}}, client)
+			if err := reloaded.load(context.Background()); err != nil {
+				t.Fatalf("load failed: %v", err)
+			}
+			if reloaded.balances()["alex"]["GBP"] != tt.expectedOwed {
+				t.Errorf("Expected the reloaded balance to be %d, got %v", tt.expectedOwed, reloaded.balances())
+			}
+		})
+	}
+
+	if published != 2 {
+		t.Errorf("Expected 2 settlement events, got %d", published)
+	}
+	if _, ok := server.hashes[expenseSplitsKey]["tx_dinner"]; ok {
+		t.Error("Expected the split to be removed from Redis")
+	}
+
+	rr := httptest.NewRecorder()
+	adminSplitsHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/splits", nil))
+	var response struct {
+		Balances map[string]map[string]int64 `json:"balances"`
+		Splits   []splitRecord               `json:"splits"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if _, ok := response.Balances["alex"]; !ok || len(response.Splits) != 0 {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolConfig configures the disk spool used when Redis is unavailable
+type SpoolConfig struct {
+	Dir            string `json:"dir"`
+	MaxFileBytes   int64  `json:"max_file_bytes"`
+	ReplayInterval string `json:"replay_interval"`
+}
+
+// spoolRecord is a spooled event, one per line of a spool file
+type spoolRecord struct {
+	ID        string          `json:"id"`
+	Received  time.Time       `json:"received"`
+	Type      string          `json:"type"`
+	AccountID string          `json:"account_id,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Priority  int             `json:"priority,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+	Encoding  string          `json:"encoding,omitempty"`
+
+	MutedMerchant string `json:"muted_merchant,omitempty"`
+	Channel       string `json:"channel,omitempty"`
+}
+
+// errSpooled is returned, wrapped, by sinks that failed to publish an event
+// but saved it to be replayed later
+var errSpooled = errors.New("event spooled for replay")
+
+// spoolingReason is why the spool component is degraded while events are
+// spooled
+const spoolingReason = "events are spooled to disk until their sinks recover"
+
+var (
+	spoolPending = metrics.newGaugeVec("monzo_webhook_spool_pending_events",
+		"Spooled events waiting to be replayed, by sink.", "sink")
+	spoolReplayed = metrics.newCounterVec("monzo_webhook_spool_replayed_events_total",
+		"Spooled events replayed successfully, by sink.", "sink")
+)
+
+// validate checks the spool configuration for invalid values
+func (c SpoolConfig) validate() error {
+	if c.MaxFileBytes < 0 {
+		return fmt.Errorf("spool max_file_bytes must not be negative")
+	}
+	if _, err := c.replayInterval(); err != nil {
+		return fmt.Errorf("invalid spool replay_interval: %w", err)
+	}
+	return nil
+}
+
+// maxFileBytes returns the size at which spool files are rotated, defaulting to 10 MiB
+func (c SpoolConfig) maxFileBytes() int64 {
+	if c.MaxFileBytes == 0 {
+		return 10 << 20
+	}
+	return c.MaxFileBytes
+}
+
+// replayInterval returns how often replay is attempted, defaulting to 10 seconds
+func (c SpoolConfig) replayInterval() (time.Duration, error) {
+	if c.ReplayInterval == "" {
+		return 10 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.ReplayInterval)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// spool is a write-ahead log of events in rotated JSON Lines files. Events are
+// appended to the newest file and replayed oldest first.
+type spool struct {
+	dir          string
+	maxFileBytes int64
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	pending int
+
+	// replaying is held while spool files are replayed or pruned
+	replaying sync.Mutex
+}
+
+// openSpool opens the spool in dir, counting events left over from a
+// previous run so that they are replayed too
+func openSpool(dir string, maxFileBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxFileBytes: maxFileBytes}
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		records, err := readSpoolFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.pending += len(records)
+	}
+	return s, nil
+}
+
+// Pending returns the number of events waiting to be replayed
+func (s *spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Append writes a record to the current spool file, rotating it if full
+func (s *spool) Append(record spoolRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil && s.size+int64(len(line)) > s.maxFileBytes {
+		s.rotate()
+	}
+	if s.file == nil {
+		path := filepath.Join(s.dir, fmt.Sprintf("spool-%020d.jsonl", time.Now().UnixNano()))
+		s.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		s.size = 0
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.pending++
+	return nil
+}
+
+// rotate closes the current file so the next append starts a new one
+func (s *spool) rotate() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// files returns the spool files, oldest first
+func (s *spool) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "spool-*.jsonl"))
+	sort.Strings(files)
+	return files, err
+}
+
+// Replay publishes spooled events oldest first, stopping at the first
+// failure. Replayed events are removed from the spool. It returns the number
+// of events replayed.
+func (s *spool) Replay(publish func(spoolRecord) error) (int, error) {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	// Close the current file so that everything spooled so far can be
+	// replayed, while new events go to a new file
+	s.mu.Lock()
+	s.rotate()
+	files, err := s.files()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, path := range files {
+		records, err := readSpoolFile(path)
+		if err != nil {
+			return replayed, err
+		}
+
+		for i, record := range records {
+			if err := publish(record); err != nil {
+				// Keep the events that haven't been replayed yet
+				if rewriteErr := writeSpoolFile(path, records[i:]); rewriteErr != nil {
+					logError("Error rewriting spool file '%s': %v", path, rewriteErr)
+				}
+				return replayed, err
+			}
+			replayed++
+			s.mu.Lock()
+			s.pending--
+			s.mu.Unlock()
+		}
+
+		if err := os.Remove(path); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Prune removes spooled events received before cutoff, which are no longer
+// worth replaying. It returns the number of events removed.
+func (s *spool) Prune(cutoff time.Time) (int, error) {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	s.mu.Lock()
+	s.rotate()
+	files, err := s.files()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, path := range files {
+		records, err := readSpoolFile(path)
+		if err != nil {
+			return pruned, err
+		}
+		var kept []spoolRecord
+		for _, record := range records {
+			if !record.Received.Before(cutoff) {
+				kept = append(kept, record)
+			}
+		}
+		if len(kept) == len(records) {
+			continue
+		}
+		if len(kept) == 0 {
+			err = os.Remove(path)
+		} else {
+			err = writeSpoolFile(path, kept)
+		}
+		if err != nil {
+			return pruned, err
+		}
+		pruned += len(records) - len(kept)
+		s.mu.Lock()
+		s.pending -= len(records) - len(kept)
+		s.mu.Unlock()
+	}
+	return pruned, nil
+}
+
+// Close closes the current spool file
+func (s *spool) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+}
+
+// readSpoolFile reads every record in a spool file. A truncated last line,
+// left by a crash mid-write, is skipped.
+func readSpoolFile(path string) ([]spoolRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []spoolRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record spoolRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			logWarn("Skipping unreadable line in spool file '%s': %v", path, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// writeSpoolFile atomically replaces a spool file with the given records
+func writeSpoolFile(path string, records []spoolRecord) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// spoolingSink wraps a sink so that events it fails to publish are spooled to
+// disk and replayed once it recovers. While spooled events are waiting, new
+// events are spooled behind them so that they are delivered in order.
+type spoolingSink struct {
+	sink  Sink
+	spool *spool
+}
+
+func newSpoolingSink(sink Sink, cfg SpoolConfig) (*spoolingSink, error) {
+	s, err := openSpool(filepath.Join(cfg.Dir, sink.Name()), cfg.maxFileBytes())
+	if err != nil {
+		return nil, err
+	}
+	spoolPending.WithLabelValues(sink.Name()).Set(float64(s.Pending()))
+	if s.Pending() > 0 {
+		serviceStatus.degrade(spoolComponent, spoolingReason)
+	}
+	return &spoolingSink{sink: sink, spool: s}, nil
+}
+
+func (s *spoolingSink) Name() string { return s.sink.Name() }
+
+func (s *spoolingSink) warm(ctx context.Context) error { return warmSink(ctx, s.sink) }
+
+func (s *spoolingSink) Publish(ctx context.Context, event *webhookEvent) error {
+	var err error
+	if s.spool.Pending() > 0 {
+		err = errors.New("earlier events are waiting to be replayed")
+	} else {
+		err = s.sink.Publish(ctx, event)
+	}
+	if err == nil || errors.Is(err, errMuted) {
+		return err
+	}
+	// The request was abandoned, and the sender will retry it
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	record := spoolRecord{
+		ID:        event.ID,
+		Received:  event.Received,
+		Type:      event.Type,
+		AccountID: event.AccountID,
+		Priority:  event.Priority,
+		Payload:   event.Body,
+		Encoding:  event.Encoding,
+
+		MutedMerchant: event.MutedMerchant,
+		Channel:       event.Channel,
+	}
+	if event.Tenant != nil {
+		record.Tenant = event.Tenant.Name
+	}
+	if spoolErr := s.spool.Append(record); spoolErr != nil {
+		return fmt.Errorf("%w (spooling failed: %v)", err, spoolErr)
+	}
+	spoolPending.WithLabelValues(s.Name()).Set(float64(s.spool.Pending()))
+	serviceStatus.degrade(spoolComponent, spoolingReason)
+	return fmt.Errorf("%w: %v", errSpooled, err)
+}
+
+// replay publishes spooled events to the wrapped sink
+func (s *spoolingSink) replay(ctx context.Context) {
+	if s.spool.Pending() == 0 {
+		return
+	}
+
+	replayed, err := s.spool.Replay(func(record spoolRecord) error {
+		publishCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		started := time.Now()
+		err := s.sink.Publish(publishCtx, record.event())
+		result := "replayed"
+		switch {
+		case errors.Is(err, errMuted):
+			result, err = "muted", nil
+		case err != nil:
+			result = "error"
+		}
+		eventTraces.recordSinkAttempt(record.ID, s.Name(), 0, started, result, err)
+		return err
+	})
+	spoolReplayed.WithLabelValues(s.Name()).Add(float64(replayed))
+	spoolPending.WithLabelValues(s.Name()).Set(float64(s.spool.Pending()))
+
+	if replayed > 0 {
+		logInfo("Replayed %d spooled events to sink '%s'", replayed, s.Name())
+	}
+	if err != nil {
+		logDebug("Spool replay to sink '%s' stopped: %v", s.Name(), err)
+	}
+}
+
+// event reconstructs the webhook event from a spool record
+func (r spoolRecord) event() *webhookEvent {
+	event := &webhookEvent{
+		ID:        r.ID,
+		Type:      r.Type,
+		AccountID: r.AccountID,
+		Body:      r.Payload,
+		Priority:  r.Priority,
+		Received:  r.Received,
+		Encoding:  r.Encoding,
+
+		MutedMerchant: r.MutedMerchant,
+		Channel:       r.Channel,
+	}
+	if r.Tenant != "" {
+		event.Tenant = tenantByName(r.Tenant)
+	}
+	return event
+}
+
+// runSpoolReplay periodically replays events spooled by the current sinks
+// until ctx is cancelled
+func runSpoolReplay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pending := 0
+		for _, entry := range currentSinks() {
+			if sink, ok := entry.sink.(*spoolingSink); ok {
+				sink.replay(ctx)
+				pending += sink.spool.Pending()
+			}
+		}
+		if pending == 0 {
+			serviceStatus.recover(spoolComponent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolRotationAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 200)
+	if err != nil {
+		t.Fatalf("openSpool failed: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		record := spoolRecord{Type: fmt.Sprintf("event-%d", i), Payload: []byte(`{"type":"transaction.created"}`)}
+		if err := s.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if s.Pending() != 5 {
+		t.Errorf("Expected 5 pending events, got %d", s.Pending())
+	}
+	if files, _ := s.files(); len(files) < 2 {
+		t.Errorf("Expected the spool to rotate into several files, got %d", len(files))
+	}
+
+	// Fail part way through, as if Redis went down again
+	var replayed []string
+	fail := errors.New("connection refused")
+	n, err := s.Replay(func(record spoolRecord) error {
+		if len(replayed) == 3 {
+			return fail
+		}
+		replayed = append(replayed, record.Type)
+		return nil
+	})
+	if !errors.Is(err, fail) || n != 3 {
+		t.Fatalf("Expected 3 events replayed before the failure, got %d, %v", n, err)
+	}
+	if s.Pending() != 2 {
+		t.Errorf("Expected 2 pending events, got %d", s.Pending())
+	}
+
+	// Events left over are counted when the spool is reopened
+	s.Close()
+	s, err = openSpool(dir, 200)
+	if err != nil {
+		t.Fatalf("openSpool failed: %v", err)
+	}
+	if s.Pending() != 2 {
+		t.Errorf("Expected 2 pending events after reopening, got %d", s.Pending())
+	}
+
+	n, err = s.Replay(func(record spoolRecord) error {
+		replayed = append(replayed, record.Type)
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected the remaining 2 events to be replayed, got %d, %v", n, err)
+	}
+	for i, eventType := range replayed {
+		if want := fmt.Sprintf("event-%d", i); eventType != want {
+			t.Errorf("Expected %s at position %d, got %s", want, i, eventType)
+		}
+	}
+	if files, _ := s.files(); len(files) != 0 {
+		t.Errorf("Expected replayed spool files to be removed, got %v", files)
+	}
+}
+
+func TestReadSpoolFileSkipsTruncatedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool-1.jsonl")
+	data := `{"type":"transaction.created","payload":{}}` + "\n" + `{"type":"transac`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readSpoolFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0].Type != "transaction.created" {
+		t.Errorf("Expected only the complete record, got %+v", records)
+	}
+}
+
+func TestSpoolingSink(t *testing.T) {
+	origConfig := eventConfig
+	defer func() { eventConfig = origConfig }()
+	eventConfig = EventConfig{Tenants: []TenantConfig{{Name: "alice", Channel: "alice-events"}}}
+
+	inner := &fakeSink{name: "redis", err: errors.New("connection refused")}
+	sink, err := newSpoolingSink(inner, SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("newSpoolingSink failed: %v", err)
+	}
+	defer sink.spool.Close()
+
+	tenant := &eventConfig.Tenants[0]
+	event := &webhookEvent{Type: "transaction.created", Body: []byte(`{}`), Tenant: tenant, Received: time.Now()}
+	if err := publishToSink(context.Background(), sink, event); err != nil {
+		t.Fatalf("Expected a spooled event not to be reported as a failure, got %v", err)
+	}
+
+	// While events are waiting, new events are spooled behind them even if
+	// the sink has recovered
+	inner.err = nil
+	if err := sink.Publish(context.Background(), event); !errors.Is(err, errSpooled) {
+		t.Errorf("Expected the event to be spooled, got %v", err)
+	}
+	if inner.count() != 1 {
+		t.Errorf("Expected the recovered sink not to be called directly, got %d calls", inner.count())
+	}
+
+	sink.replay(context.Background())
+	if sink.spool.Pending() != 0 {
+		t.Errorf("Expected the spool to be drained, got %d pending", sink.spool.Pending())
+	}
+	if inner.count() != 3 {
+		t.Errorf("Expected 2 replayed events, got %d calls in total", inner.count())
+	}
+	if replayedTenant := inner.events[1].Tenant; replayedTenant == nil || replayedTenant.Channel != "alice-events" {
+		t.Errorf("Expected the tenant to be restored on replay, got %+v", replayedTenant)
+	}
+
+	if err := sink.Publish(context.Background(), event); err != nil {
+		t.Errorf("Expected events to be published directly once drained, got %v", err)
+	}
+}
+
+func TestSpoolingSinkDoesNotSpoolCancelled(t *testing.T) {
+	inner := &fakeSink{name: "redis", err: fmt.Errorf("publishing: %w", context.Canceled)}
+	sink, err := newSpoolingSink(inner, SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("newSpoolingSink failed: %v", err)
+	}
+	defer sink.spool.Close()
+
+	event := &webhookEvent{Type: "transaction.created", Body: []byte(`{}`), Received: time.Now()}
+	if err := sink.Publish(context.Background(), event); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation to be returned, got %v", err)
+	}
+	if sink.spool.Pending() != 0 {
+		t.Errorf("Expected an abandoned request's event not to be spooled, got %d pending", sink.spool.Pending())
+	}
+}
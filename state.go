@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// stateStore keeps small values that expire, such as dedup claims and the
+// last state of each transaction
+type stateStore interface {
+	// get returns a key's value, and false if it isn't set or has expired
+	get(ctx context.Context, key string) (string, bool, error)
+	// set sets a key's value, expiring after ttl unless it's zero
+	set(ctx context.Context, key, value string, ttl time.Duration) error
+	// setNX sets a key's value unless it is already set, reporting whether
+	// it was set
+	setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// incrBy adds n to a key's integer value, starting from zero if it isn't
+	// set, and returns the new value. The key expires after ttl from the
+	// last change.
+	incrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+	del(ctx context.Context, key string) error
+}
+
+// localState keeps state in the event store when it's enabled, for
+// deployments without Redis
+var localState *sqliteState
+
+// stateFor returns where state is kept: in Redis when there's a client, or
+// else in the event store. It returns nil when there's neither.
+func stateFor(client *redis.Client) stateStore {
+	if client != nil {
+		return redisState{client: client}
+	}
+	if localState != nil {
+		return localState
+	}
+	return nil
+}
+
+// redisState keeps state in Redis keys
+type redisState struct {
+	client *redis.Client
+}
+
+func (s redisState) get(ctx context.Context, key string) (string, bool, error) {
+	value, err := s.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (s redisState) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s redisState) setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s redisState) incrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.IncrBy(ctx, key, n)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (s redisState) del(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
+
+// storeStateSchema creates the event store's table of state kept without
+// Redis
+const storeStateSchema = `CREATE TABLE IF NOT EXISTS state (
+  key TEXT PRIMARY KEY,
+  value TEXT NOT NULL,
+  expires_at TEXT
+)`
+
+// sqliteState keeps state in the event store, a row for each key. Expired
+// rows are ignored until they're deleted by prune.
+type sqliteState struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func openSQLiteState(db *sql.DB, now func() time.Time) (*sqliteState, error) {
+	if _, err := db.Exec(storeStateSchema); err != nil {
+		return nil, err
+	}
+	return &sqliteState{db: db, now: now}, nil
+}
+
+// expiresAt returns the stored expiry of a value set now for ttl, or nil if
+// it doesn't expire
+func (s *sqliteState) expiresAt(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return s.now().Add(ttl).UTC().Format(storeTimeLayout)
+}
+
+func (s *sqliteState) get(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM state WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)`,
+		key, s.now().UTC().Format(storeTimeLayout)).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (s *sqliteState) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO state (key, value, expires_at) VALUES (?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		key, value, s.expiresAt(ttl))
+	return err
+}
+
+func (s *sqliteState) setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	// A key that has expired is set as if it had been deleted
+	result, err := s.db.ExecContext(ctx, `INSERT INTO state (key, value, expires_at) VALUES (?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+WHERE state.expires_at IS NOT NULL AND state.expires_at <= ?`,
+		key, value, s.expiresAt(ttl), s.now().UTC().Format(storeTimeLayout))
+	if err != nil {
+		return false, err
+	}
+	set, err := result.RowsAffected()
+	return set > 0, err
+}
+
+func (s *sqliteState) incrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	// A key that has expired counts from zero, as if it had been deleted
+	var value int64
+	err := s.db.QueryRowContext(ctx, `INSERT INTO state (key, value, expires_at) VALUES (?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET value = CASE
+    WHEN state.expires_at IS NOT NULL AND state.expires_at <= ? THEN excluded.value
+    ELSE CAST(state.value AS INTEGER) + CAST(excluded.value AS INTEGER)
+  END, expires_at = excluded.expires_at
+RETURNING CAST(value AS INTEGER)`,
+		key, strconv.FormatInt(n, 10), s.expiresAt(ttl), s.now().UTC().Format(storeTimeLayout)).Scan(&value)
+	return value, err
+}
+
+func (s *sqliteState) del(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM state WHERE key = ?`, key)
+	return err
+}
+
+// prune deletes the keys that have expired, returning how many were deleted
+func (s *sqliteState) prune() (int, error) {
+	result, err := s.db.Exec(`DELETE FROM state WHERE expires_at <= ?`, s.now().UTC().Format(storeTimeLayout))
+	if err != nil {
+		return 0, err
+	}
+	pruned, _ := result.RowsAffected()
+	return int(pruned), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestState opens the state of an event store at path, with a clock
+// that's read from now
+func openTestState(t *testing.T, path string, now *time.Time) *sqliteState {
+	t.Helper()
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	state, err := openSQLiteState(db, func() time.Time { return *now })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return state
+}
+
+func TestSQLiteState(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.db")
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	state := openTestState(t, path, &now)
+
+	if _, ok, err := state.get(ctx, "missing"); ok || err != nil {
+		t.Errorf("Expected a missing key, got %v, %v", ok, err)
+	}
+	if set, err := state.setNX(ctx, "claim", "evt_1", time.Hour); !set || err != nil {
+		t.Errorf("Expected the key to be set, got %v, %v", set, err)
+	}
+	if set, _ := state.setNX(ctx, "claim", "evt_2", time.Hour); set {
+		t.Error("Expected a key that's set not to be set again")
+	}
+	state.set(ctx, "forever", "1", 0)
+	state.set(ctx, "deleted", "1", 0)
+	state.del(ctx, "deleted")
+	state.set(ctx, "updated", "1", time.Hour)
+	state.set(ctx, "updated", "2", 3*time.Hour)
+
+	// The latest value of each key is read back when the store is reopened
+	now = now.Add(2 * time.Hour)
+	reopened := openTestState(t, path, &now)
+	tests := []struct {
+		key       string
+		expect    string
+		expectSet bool
+	}{
+		{key: "claim"},
+		{key: "forever", expect: "1", expectSet: true},
+		{key: "deleted"},
+		{key: "updated", expect: "2", expectSet: true},
+	}
+	for _, tt := range tests {
+		value, ok, err := reopened.get(ctx, tt.key)
+		if err != nil || ok != tt.expectSet || value != tt.expect {
+			t.Errorf("Expected %s to be %q (%v), got %q (%v), %v", tt.key, tt.expect, tt.expectSet, value, ok, err)
+		}
+	}
+
+	// An expired key can be claimed again
+	if set, _ := reopened.setNX(ctx, "claim", "evt_3", time.Hour); !set {
+		t.Error("Expected an expired key to be set")
+	}
+
+	// Totals count from zero, and again once they've expired
+	for _, step := range []struct {
+		n, expect int64
+		advance   time.Duration
+	}{{n: 500, expect: 500}, {n: 250, expect: 750}, {n: -500, expect: 250}, {n: 100, expect: 100, advance: 2 * time.Hour}} {
+		now = now.Add(step.advance)
+		if total, err := reopened.incrBy(ctx, "total", step.n, time.Hour); total != step.expect || err != nil {
+			t.Errorf("Expected a total of %d after adding %d, got %d, %v", step.expect, step.n, total, err)
+		}
+	}
+}
+
+func TestClaimDeliveryInEventStore(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	state := openTestState(t, filepath.Join(t.TempDir(), "events.db"), &now)
+	cfg := DedupConfig{Enabled: true, Window: "1h"}
+	payload := map[string]interface{}{"data": map[string]interface{}{"id": "tx_1"}}
+
+	first := &webhookEvent{ID: "01FIRST", Type: "transaction.created", Payload: payload}
+	if original, _ := claimDelivery(context.Background(), state, cfg, first, now); original != "" {
+		t.Fatalf("Expected the first delivery to be new, got duplicate of '%s'", original)
+	}
+	second := &webhookEvent{ID: "01SECOND", Type: "transaction.created", Payload: payload}
+	original, release := claimDelivery(context.Background(), state, cfg, second, now.Add(time.Minute))
+	if original != "01FIRST" {
+		t.Errorf("Expected a duplicate of '01FIRST', got '%s'", original)
+	}
+	release()
+	if original, _ := claimDelivery(context.Background(), state, cfg, second, now.Add(time.Minute)); original != "01FIRST" {
+		t.Errorf("Expected releasing a duplicate to keep the claim, got '%s'", original)
+	}
+}
+
+func TestStateFor(t *testing.T) {
+	originalState := localState
+	defer func() { localState = originalState }()
+
+	localState = nil
+	if state := stateFor(nil); state != nil {
+		t.Errorf("Expected no state, got %T", state)
+	}
+	_, client := newFakeRedis(t)
+	if _, ok := stateFor(client).(redisState); !ok {
+		t.Errorf("Expected Redis to be preferred, got %T", stateFor(client))
+	}
+	now := time.Now()
+	localState = openTestState(t, filepath.Join(t.TempDir(), "events.db"), &now)
+	if state := stateFor(nil); state != localState {
+		t.Errorf("Expected the event store's state, got %T", state)
+	}
+}
+
+func TestUsageTrackerKeptInState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	now := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	tenant := &TenantConfig{Name: "alice", Quota: QuotaConfig{MaxEvents: 2, Window: "1h"}}
+
+	tracker := newUsageTracker(func() time.Time { return now })
+	tracker.state = openTestState(t, path, &now)
+	tracker.record(tenant, 10)
+
+	// A restarted tracker carries on with the same window
+	restarted := newUsageTracker(func() time.Time { return now })
+	restarted.state = openTestState(t, path, &now)
+	if decision := restarted.record(tenant, 10); !decision.allowed {
+		t.Fatal("Expected the second event to be allowed")
+	}
+	if decision := restarted.record(tenant, 10); decision.allowed {
+		t.Error("Expected the third event in the window to be rejected")
+	}
+	usage := restarted.snapshot([]TenantConfig{*tenant})["alice"]
+	if usage.Events != 2 || usage.Bytes != 20 || usage.RejectedEvents != 1 {
+		t.Errorf("Expected the usage to be kept across the restart, got %+v", usage)
+	}
+
+	// Once the window ends, the kept usage expires
+	now = now.Add(time.Hour)
+	later := newUsageTracker(func() time.Time { return now })
+	later.state = openTestState(t, path, &now)
+	if usage := later.snapshot([]TenantConfig{*tenant})["alice"]; usage.TotalEvents != 0 {
+		t.Errorf("Expected no usage after the window, got %+v", usage)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Types of the events published when a component becomes degraded or
+// recovers
+const (
+	statusDegradedEventType  = "status.degraded"
+	statusRecoveredEventType = "status.recovered"
+)
+
+// Component statuses
+const (
+	componentDegraded = "degraded"
+	componentOK       = "ok"
+)
+
+// Components other than enrichment that the service state depends on
+const (
+	redisComponent    = "redis"
+	spoolComponent    = "spool"
+	failoverComponent = "failover"
+)
+
+// Service states, from the most to the least severe. The service is in the
+// most severe state of its degraded components.
+const (
+	stateDegradedNoRedis      = "degraded-no-redis"
+	stateBuffering            = "buffering"
+	stateDegradedNoEnrichment = "degraded-no-enrichment"
+	stateHealthy              = "healthy"
+)
+
+var serviceStates = []string{stateDegradedNoRedis, stateBuffering, stateDegradedNoEnrichment, stateHealthy}
+
+// componentStates are the states degraded components put the service in, by
+// default
+var componentStates = map[string]string{
+	redisComponent:      stateDegradedNoRedis,
+	spoolComponent:      stateBuffering,
+	failoverComponent:   stateBuffering,
+	enrichmentComponent: stateDegradedNoEnrichment,
+}
+
+var (
+	componentsDegraded = metrics.newGaugeVec("monzo_webhook_component_degraded",
+		"Whether a component is degraded (1) or healthy (0).", "component")
+	serviceStateGauge = metrics.newGaugeVec("monzo_webhook_service_state",
+		"1 for the service's current state (healthy, degraded-no-redis, degraded-no-enrichment or buffering), 0 for the others.", "state")
+)
+
+func init() {
+	serviceStateGauge.WithLabelValues(stateHealthy).Set(1)
+}
+
+// componentStatus is the status of a component that events depend on, such as
+// enrichment
+type componentStatus struct {
+	Component string `json:"component"`
+	Status    string `json:"status"`
+	// State is the service state the component puts the server in while
+	// it's degraded
+	State  string    `json:"state,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// statusTracker tracks degraded components, publishing a status event when a
+// component becomes degraded or recovers so consumers know events are
+// published without it
+type statusTracker struct {
+	publish func(eventType string, body []byte, auth string) error
+	now     func() time.Time
+
+	mu       sync.Mutex
+	degraded map[string]componentStatus
+	// current is the service state last recorded, empty until a component
+	// is first degraded
+	current string
+}
+
+// serviceStatus is the status of the server's components. Its publish func is
+// set in main.
+var serviceStatus = &statusTracker{now: clockNow, degraded: make(map[string]componentStatus)}
+
+// degrade marks a component as degraded, publishing a status.degraded event
+// unless it's already degraded for the same reason
+func (s *statusTracker) degrade(component, reason string) {
+	s.degradeAs(component, componentStates[component], reason)
+}
+
+// degradeAs marks a component as degraded, putting the service in state,
+// such as a Redis outage that only buffers events because they're spooled
+func (s *statusTracker) degradeAs(component, state, reason string) {
+	s.mu.Lock()
+	if current, ok := s.degraded[component]; ok && current.Reason == reason && current.State == state {
+		s.mu.Unlock()
+		return
+	}
+	status := componentStatus{Component: component, Status: componentDegraded, State: state, Reason: reason, Since: s.now().UTC()}
+	s.degraded[component] = status
+	s.mu.Unlock()
+
+	componentsDegraded.WithLabelValues(component).Set(1)
+	logWarn("Component %s is degraded: %s", component, reason)
+	s.updateState()
+	s.publishStatus(statusDegradedEventType, status)
+}
+
+// recover marks a component as healthy again, publishing a status.recovered
+// event if it was degraded
+func (s *statusTracker) recover(component string) {
+	s.mu.Lock()
+	if _, ok := s.degraded[component]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.degraded, component)
+	s.mu.Unlock()
+
+	componentsDegraded.WithLabelValues(component).Set(0)
+	logInfo("Component %s has recovered", component)
+	s.updateState()
+	s.publishStatus(statusRecoveredEventType, componentStatus{Component: component, Status: componentOK, Since: s.now().UTC()})
+}
+
+func (s *statusTracker) publishStatus(eventType string, status componentStatus) {
+	if s.publish == nil {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"type": eventType, "data": status})
+	if err != nil {
+		logError("Error encoding %s event: %v", eventType, err)
+		return
+	}
+	if err := s.publish(eventType, body, "status"); err != nil {
+		logError("Error publishing %s event for %s: %v", eventType, status.Component, err)
+	}
+}
+
+// state returns the service state: the most severe state of the degraded
+// components, or healthy
+func (s *statusTracker) state() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stateLocked()
+}
+
+func (s *statusTracker) stateLocked() string {
+	for _, state := range serviceStates {
+		for _, status := range s.degraded {
+			if status.State == state {
+				return state
+			}
+		}
+	}
+	return stateHealthy
+}
+
+// updateState records a change of the service state in the logs and metrics
+func (s *statusTracker) updateState() {
+	s.mu.Lock()
+	previous := s.current
+	if previous == "" {
+		previous = stateHealthy
+	}
+	state := s.stateLocked()
+	s.current = state
+	s.mu.Unlock()
+
+	for _, st := range serviceStates {
+		value := 0.0
+		if st == state {
+			value = 1
+		}
+		serviceStateGauge.WithLabelValues(st).Set(value)
+	}
+	if state == previous {
+		return
+	}
+	if state == stateHealthy {
+		logInfo("Service state changed from %s to %s", previous, state)
+	} else {
+		logWarn("Service state changed from %s to %s", previous, state)
+	}
+}
+
+// components returns the degraded components, sorted by name
+func (s *statusTracker) components() []componentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	components := make([]componentStatus, 0, len(s.degraded))
+	for _, status := range s.degraded {
+		components = append(components, status)
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].Component < components[j].Component })
+	return components
+}
+
+// readyzHandler reports whether the server is ready, with its service state
+// and details of any degraded components. A degraded server still accepts
+// webhooks, so it responds 200 either way rather than being taken out of
+// rotation, and only 503 while it warms up after starting.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	components := serviceStatus.components()
+	status, code := "ready", http.StatusOK
+	if len(components) > 0 {
+		status = componentDegraded
+	}
+	if warmingUp.Load() {
+		status, code = "warming", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "state": serviceStatus.state(), "degraded": components})
+}
+
+// redisDisabledReason is why the redis component is degraded when Redis was
+// unreachable at startup without a spool
+const redisDisabledReason = "unreachable at startup - Redis publishing and features are disabled until the server is restarted"
+
+// monitorRedis checks Redis every interval until ctx is cancelled
+func monitorRedis(ctx context.Context, client *redis.Client, disabled, spooled bool, interval time.Duration) {
+	check := func(ctx context.Context) error {
+		checkRedis(ctx, client, disabled, spooled)
+		return nil
+	}
+	check(ctx)
+	runReload(ctx, "Redis status", check, interval)
+}
+
+// checkRedis pings Redis, recording whether it's reachable in the service
+// state. If it was unreachable at startup without a spool, Redis is
+// disabled, so reaching it again only changes the reason until the server
+// is restarted. With a spool, an outage only buffers events.
+func checkRedis(ctx context.Context, client *redis.Client, disabled, spooled bool) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := client.Ping(ctx).Err()
+	switch {
+	case disabled && err != nil:
+		serviceStatus.degrade(redisComponent, redisDisabledReason)
+	case disabled:
+		serviceStatus.degrade(redisComponent, "reachable again, but Redis publishing and features are disabled until the server is restarted")
+	case err != nil && spooled:
+		serviceStatus.degradeAs(redisComponent, stateBuffering, "unreachable - events are spooled to disk until it recovers")
+	case err != nil:
+		serviceStatus.degrade(redisComponent, "unreachable - events can't be published to Redis")
+	default:
+		serviceStatus.recover(redisComponent)
+	}
+}
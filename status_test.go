@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStatusTracker(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	type publishedEvent struct {
+		eventType string
+		auth      string
+		data      componentStatus
+	}
+	var published []publishedEvent
+	s := &statusTracker{
+		now:      func() time.Time { return now },
+		degraded: make(map[string]componentStatus),
+		publish: func(eventType string, body []byte, auth string) error {
+			var payload struct {
+				Type string          `json:"type"`
+				Data componentStatus `json:"data"`
+			}
+			if err := json.Unmarshal(body, &payload); err != nil || payload.Type != eventType {
+				t.Errorf("Unexpected %s event body: %s", eventType, body)
+			}
+			published = append(published, publishedEvent{eventType, auth, payload.Data})
+			return nil
+		},
+	}
+
+	s.recover("enrichment")
+	if len(published) != 0 {
+		t.Errorf("Expected no event for a healthy component, got %+v", published)
+	}
+
+	s.degrade("enrichment", "enrichment disabled: token expired")
+	s.degrade("enrichment", "enrichment disabled: token expired")
+	if len(published) != 1 {
+		t.Fatalf("Expected a single event while degraded for the same reason, got %+v", published)
+	}
+	expected := componentStatus{Component: "enrichment", Status: "degraded", State: stateDegradedNoEnrichment, Reason: "enrichment disabled: token expired", Since: now}
+	if published[0].eventType != statusDegradedEventType || published[0].auth != "status" || published[0].data != expected {
+		t.Errorf("Unexpected status.degraded event: %+v", published[0])
+	}
+	if testutil.ToFloat64(componentsDegraded.WithLabelValues("enrichment")) != 1 {
+		t.Error("Expected the degraded gauge to be set")
+	}
+
+	s.degrade("enrichment", "enrichment disabled: classifier unreachable")
+	if len(published) != 2 {
+		t.Errorf("Expected a new event when the reason changes, got %+v", published)
+	}
+
+	s.recover("enrichment")
+	if len(published) != 3 || published[2].eventType != statusRecoveredEventType || published[2].data.Status != "ok" {
+		t.Errorf("Unexpected status.recovered event: %+v", published)
+	}
+	if testutil.ToFloat64(componentsDegraded.WithLabelValues("enrichment")) != 0 || len(s.components()) != 0 {
+		t.Error("Expected enrichment to be healthy")
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	originalStatus := serviceStatus
+	defer func() { serviceStatus = originalStatus }()
+	serviceStatus = &statusTracker{now: time.Now, degraded: make(map[string]componentStatus)}
+
+	check := func(code int, expected string, degraded int) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		readyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var response struct {
+			Status   string            `json:"status"`
+			State    string            `json:"state"`
+			Degraded []componentStatus `json:"degraded"`
+		}
+		json.NewDecoder(rr.Body).Decode(&response)
+		if rr.Code != code || response.Status != expected || len(response.Degraded) != degraded || response.State != serviceStatus.state() {
+			t.Errorf("Expected %d %s with %d degraded components, got %d %+v", code, expected, degraded, rr.Code, response)
+		}
+	}
+
+	check(http.StatusOK, "ready", 0)
+	serviceStatus.degrade("enrichment", "enrichment disabled: token expired")
+	check(http.StatusOK, "degraded", 1)
+	warmingUp.Store(true)
+	check(http.StatusServiceUnavailable, "warming", 1)
+	warmingUp.Store(false)
+
+	rr := httptest.NewRecorder()
+	readyzHandler(rr, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d, got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
+
+func TestServiceState(t *testing.T) {
+	s := &statusTracker{now: time.Now, degraded: make(map[string]componentStatus)}
+	steps := []struct {
+		name   string
+		change func()
+		expect string
+	}{
+		{name: "Healthy", change: s.updateState, expect: stateHealthy},
+		{name: "No enrichment", change: func() { s.degrade(enrichmentComponent, "classifier unreachable") }, expect: stateDegradedNoEnrichment},
+		{name: "Standby", change: func() { s.degrade(failoverComponent, failoverStandbyReason) }, expect: stateBuffering},
+		{name: "Redis down", change: func() { s.degrade(redisComponent, "unreachable") }, expect: stateDegradedNoRedis},
+		{name: "Redis down with a spool", change: func() { s.degradeAs(redisComponent, stateBuffering, "unreachable - spooling") }, expect: stateBuffering},
+		{name: "Redis recovered", change: func() { s.recover(redisComponent) }, expect: stateBuffering},
+		{name: "Active", change: func() { s.recover(failoverComponent) }, expect: stateDegradedNoEnrichment},
+		{name: "Enrichment recovered", change: func() { s.recover(enrichmentComponent) }, expect: stateHealthy},
+	}
+	for _, step := range steps {
+		step.change()
+		if state := s.state(); state != step.expect {
+			t.Errorf("%s: expected %s, got %s", step.name, step.expect, state)
+		}
+		for _, state := range serviceStates {
+			expect := 0.0
+			if state == step.expect {
+				expect = 1
+			}
+			if got := testutil.ToFloat64(serviceStateGauge.WithLabelValues(state)); got != expect {
+				t.Errorf("%s: expected monzo_webhook_service_state{state=%q} to be %v, got %v", step.name, state, expect, got)
+			}
+		}
+	}
+}
+
+func TestCheckRedis(t *testing.T) {
+	originalStatus := serviceStatus
+	defer func() { serviceStatus = originalStatus }()
+
+	_, client := newFakeRedis(t)
+	unreachable := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialerRetries: 1})
+	defer unreachable.Close()
+
+	tests := []struct {
+		name     string
+		client   *redis.Client
+		disabled bool
+		spooled  bool
+		expect   string
+		reason   string
+	}{
+		{name: "Reachable", client: client, expect: stateHealthy},
+		{name: "Unreachable", client: unreachable, expect: stateDegradedNoRedis, reason: "unreachable"},
+		{name: "Unreachable with a spool", client: unreachable, spooled: true, expect: stateBuffering, reason: "spooled"},
+		{name: "Disabled", client: unreachable, disabled: true, expect: stateDegradedNoRedis, reason: "disabled until the server is restarted"},
+		{name: "Disabled but reachable", client: client, disabled: true, expect: stateDegradedNoRedis, reason: "reachable again"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceStatus = &statusTracker{now: time.Now, degraded: make(map[string]componentStatus)}
+			checkRedis(context.Background(), tt.client, tt.disabled, tt.spooled)
+			if state := serviceStatus.state(); state != tt.expect {
+				t.Errorf("Expected %s, got %s", tt.expect, state)
+			}
+			if components := serviceStatus.components(); tt.reason != "" && (len(components) != 1 || !strings.Contains(components[0].Reason, tt.reason)) {
+				t.Errorf("Expected a reason containing %q, got %+v", tt.reason, components)
+			}
+		})
+	}
+}
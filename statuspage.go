@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusPageConfig configures the public status page at /status
+type StatusPageConfig struct {
+	Enabled bool `json:"enabled"`
+	// Title is shown at the top of the page
+	Title string `json:"title"`
+}
+
+// Status page colours, from best to worst
+const (
+	statusGreen = "green"
+	statusAmber = "amber"
+	statusRed   = "red"
+)
+
+// serverStarted is when the server started, for its uptime
+var serverStarted = clock.Now()
+
+// lastEventReceived is when the last webhook event was received, in Unix
+// nanoseconds, or 0 if none has been
+var lastEventReceived atomic.Int64
+
+// sinkOutcome is the result of the last attempt to publish to a sink
+type sinkOutcome struct {
+	result string
+	at     time.Time
+}
+
+// sinkHealthTracker records the outcome of the last publish to each sink
+type sinkHealthTracker struct {
+	mu   sync.Mutex
+	last map[string]sinkOutcome
+}
+
+var sinkHealth = &sinkHealthTracker{last: make(map[string]sinkOutcome)}
+
+func (t *sinkHealthTracker) record(sink, result string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last[sink] = sinkOutcome{result: result, at: at}
+}
+
+// status returns a sink's colour and when it was last published to. A sink
+// is red when its last publish failed, amber when its events are being
+// spooled, and green otherwise, including before anything is published.
+func (t *sinkHealthTracker) status(sink string) (string, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outcome := t.last[sink]
+	switch outcome.result {
+	case "error":
+		return statusRed, outcome.at
+	case "spooled":
+		return statusAmber, outcome.at
+	}
+	return statusGreen, outcome.at
+}
+
+// statusPageSink is a sink on the status page
+type statusPageSink struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	LastPublish *time.Time `json:"last_publish,omitempty"`
+}
+
+// statusPage is what the status page shows. It leaves out event contents
+// and degradation reasons, since the page is unauthenticated.
+type statusPage struct {
+	Title             string           `json:"title"`
+	Status            string           `json:"status"`
+	State             string           `json:"state"`
+	Started           time.Time        `json:"started"`
+	UptimeSeconds     int64            `json:"uptime_seconds"`
+	LastEventReceived *time.Time       `json:"last_event_received"`
+	Sinks             []statusPageSink `json:"sinks"`
+	Degraded          []string         `json:"degraded"`
+}
+
+// currentStatusPage returns the status of the server at now. The overall
+// status is the worst of the sinks', at least amber while a component is
+// degraded, and red while events can't be published to Redis.
+func currentStatusPage(title string, entries []sinkEntry, now time.Time) statusPage {
+	page := statusPage{
+		Title:         title,
+		Status:        statusGreen,
+		Started:       serverStarted.UTC(),
+		UptimeSeconds: int64(now.Sub(serverStarted).Seconds()),
+		Sinks:         make([]statusPageSink, 0, len(entries)),
+		Degraded:      []string{},
+	}
+	if page.Title == "" {
+		page.Title = "Monzo Webhook"
+	}
+	if nanos := lastEventReceived.Load(); nanos != 0 {
+		received := time.Unix(0, nanos).UTC()
+		page.LastEventReceived = &received
+	}
+
+	worse := func(status string) {
+		if status == statusRed || status == statusAmber && page.Status == statusGreen {
+			page.Status = status
+		}
+	}
+	for _, entry := range entries {
+		sink := statusPageSink{Name: entry.sink.Name()}
+		var last time.Time
+		sink.Status, last = sinkHealth.status(sink.Name)
+		if !last.IsZero() {
+			last = last.UTC()
+			sink.LastPublish = &last
+		}
+		worse(sink.Status)
+		page.Sinks = append(page.Sinks, sink)
+	}
+	page.State = serviceStatus.state()
+	if page.State == stateDegradedNoRedis {
+		worse(statusRed)
+	}
+	for _, component := range serviceStatus.components() {
+		page.Degraded = append(page.Degraded, component.Component)
+		worse(statusAmber)
+	}
+	return page
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return clock.Now().Sub(*t).Round(time.Second).String() + " ago"
+	},
+	"uptime": func(seconds int64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="30">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+.dot { display: inline-block; width: 0.8em; height: 0.8em; border-radius: 50%; margin-right: 0.4em; }
+.green { background: #2e9e44; } .amber { background: #e8a317; } .red { background: #d0312d; }
+td { padding: 0.2em 1em 0.2em 0; }
+</style>
+</head>
+<body>
+<h1><span class="dot {{.Status}}"></span>{{.Title}}</h1>
+<table>
+<tr><td>State</td><td>{{.State}}</td></tr>
+<tr><td>Uptime</td><td>{{uptime .UptimeSeconds}}</td></tr>
+<tr><td>Last event</td><td>{{ago .LastEventReceived}}</td></tr>
+</table>
+<h2>Sinks</h2>
+<table>
+{{range .Sinks}}<tr><td><span class="dot {{.Status}}"></span>{{.Name}}</td><td>{{ago .LastPublish}}</td></tr>
+{{else}}<tr><td>No sinks are configured</td></tr>
+{{end}}</table>
+{{if .Degraded}}<p>Degraded: {{range $i, $c := .Degraded}}{{if $i}}, {{end}}{{$c}}{{end}}</p>{{end}}
+</body>
+</html>
+`))
+
+// statusPageHandler serves the status page, as HTML for browsers or as JSON
+// when requested with ?format=json or an Accept header. It's unauthenticated
+// so that it can be shown on a household dashboard.
+func statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := currentStatusPage(currentConfig().StatusPage.Title, currentSinks(), clock.Now())
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, page); err != nil {
+		logError("Error writing status page: %v", err)
+	}
+}
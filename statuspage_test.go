@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCurrentStatusPage(t *testing.T) {
+	origHealth, origStatus := sinkHealth, serviceStatus
+	origReceived := lastEventReceived.Load()
+	defer func() {
+		sinkHealth, serviceStatus = origHealth, origStatus
+		lastEventReceived.Store(origReceived)
+	}()
+
+	now := time.Now()
+	entries := []sinkEntry{{sink: &fakeSink{name: "redis"}}, {sink: &fakeSink{name: "kafka"}}}
+
+	tests := []struct {
+		name     string
+		outcomes map[string]string
+		degraded string
+		status   string
+		state    string
+		sinks    []string
+	}{
+		{name: "Nothing published yet", status: statusGreen, state: stateHealthy, sinks: []string{statusGreen, statusGreen}},
+		{name: "Healthy", outcomes: map[string]string{"redis": "success", "kafka": "success"}, status: statusGreen, state: stateHealthy, sinks: []string{statusGreen, statusGreen}},
+		{name: "Spooling", outcomes: map[string]string{"redis": "spooled", "kafka": "success"}, status: statusAmber, state: stateHealthy, sinks: []string{statusAmber, statusGreen}},
+		{name: "Degraded component", outcomes: map[string]string{"redis": "success"}, degraded: enrichmentComponent, status: statusAmber, state: stateDegradedNoEnrichment, sinks: []string{statusGreen, statusGreen}},
+		{name: "No Redis", outcomes: map[string]string{"kafka": "success"}, degraded: redisComponent, status: statusRed, state: stateDegradedNoRedis, sinks: []string{statusGreen, statusGreen}},
+		{name: "Failing sink", outcomes: map[string]string{"redis": "spooled", "kafka": "error"}, status: statusRed, state: stateHealthy, sinks: []string{statusAmber, statusRed}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sinkHealth = &sinkHealthTracker{last: make(map[string]sinkOutcome)}
+			for sink, result := range tt.outcomes {
+				sinkHealth.record(sink, result, now.Add(-time.Minute))
+			}
+			serviceStatus = &statusTracker{now: time.Now, degraded: make(map[string]componentStatus)}
+			if tt.degraded != "" {
+				serviceStatus.degrade(tt.degraded, "unavailable")
+			}
+
+			page := currentStatusPage("", entries, now)
+			if page.Status != tt.status || page.State != tt.state {
+				t.Errorf("Expected status %s and state %s, got %s and %s", tt.status, tt.state, page.Status, page.State)
+			}
+			for i, sink := range page.Sinks {
+				if sink.Status != tt.sinks[i] {
+					t.Errorf("Expected sink %s to be %s, got %s", sink.Name, tt.sinks[i], sink.Status)
+				}
+				if _, published := tt.outcomes[sink.Name]; published != (sink.LastPublish != nil) {
+					t.Errorf("Unexpected last publish time for sink %s: %v", sink.Name, sink.LastPublish)
+				}
+			}
+			if (tt.degraded != "") != (len(page.Degraded) == 1) {
+				t.Errorf("Unexpected degraded components: %v", page.Degraded)
+			}
+		})
+	}
+}
+
+func TestStatusPageHandler(t *testing.T) {
+	origConfig, origSinks := eventConfig, sinks
+	origReceived := lastEventReceived.Load()
+	defer func() {
+		eventConfig, sinks = origConfig, origSinks
+		lastEventReceived.Store(origReceived)
+	}()
+
+	eventConfig = EventConfig{StatusPage: StatusPageConfig{Enabled: true, Title: "Household <Money>"}}
+	sinks = []sinkEntry{{sink: &fakeSink{name: "redis"}}}
+	lastEventReceived.Store(time.Now().Add(-5 * time.Minute).UnixNano())
+
+	rr := httptest.NewRecorder()
+	statusPageHandler(rr, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML page, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	for _, expected := range []string{"Household &lt;Money&gt;", "5m", "redis"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("Expected the page to contain %q, got: %s", expected, rr.Body.String())
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set("Accept", "application/json")
+	statusPageHandler(rr, req)
+	var page statusPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if page.LastEventReceived == nil || len(page.Sinks) != 1 || page.Sinks[0].Name != "redis" {
+		t.Errorf("Unexpected status: %+v", page)
+	}
+
+	rr = httptest.NewRecorder()
+	statusPageHandler(rr, httptest.NewRequest(http.MethodPost, "/status", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// storeTimeLayout is how times are stored: fixed width, so that they sort in
+// time order, and readable by SQLite's date and time functions
+const storeTimeLayout = "2006-01-02T15:04:05.000000Z"
+
+// storeEventsSchema creates the event store's table of received webhooks,
+// indexed for the query API. Events are read in rowid order, which is the
+// order they were received in.
+const storeEventsSchema = `CREATE TABLE IF NOT EXISTS events (
+  event_id TEXT NOT NULL,
+  type TEXT NOT NULL,
+  account_id TEXT,
+  received_at TEXT NOT NULL,
+  body BLOB NOT NULL,
+  metadata TEXT NOT NULL,
+  filtered_by TEXT,
+  deletion_id TEXT
+);
+CREATE INDEX IF NOT EXISTS events_received_at ON events (received_at);
+CREATE INDEX IF NOT EXISTS events_type ON events (type, received_at);
+CREATE INDEX IF NOT EXISTS events_account_id ON events (account_id, received_at);
+CREATE INDEX IF NOT EXISTS events_event_id ON events (event_id);
+CREATE INDEX IF NOT EXISTS events_deletion_id ON events (deletion_id) WHERE deletion_id IS NOT NULL`
+
+var storeWrites = metrics.newCounterVec("monzo_webhook_store_writes_total",
+	"Received webhooks written to the event store, by result (ok, error).", "result")
+
+// StoreConfig configures the event store, an embedded SQLite database that
+// keeps every received webhook as a durable history, whether or not it's
+// published
+type StoreConfig struct {
+	// Path is the database file. The store is disabled without one.
+	Path string `json:"path"`
+	// PurgeDelay is how long deleted events are kept, so that they can be
+	// restored, before they're purged. Defaults to a week; 0s purges them
+	// when they're deleted.
+	PurgeDelay string `json:"purge_delay"`
+}
+
+// defaultPurgeDelay is how long deleted events are kept by default
+const defaultPurgeDelay = 7 * 24 * time.Hour
+
+// validate checks the store configuration for invalid values
+func (c StoreConfig) validate() error {
+	if _, err := c.purgeDelay(); err != nil {
+		return fmt.Errorf("invalid store purge_delay: %w", err)
+	}
+	return nil
+}
+
+// purgeDelay returns how long deleted events are kept before they're purged
+func (c StoreConfig) purgeDelay() (time.Duration, error) {
+	if c.PurgeDelay == "" {
+		return defaultPurgeDelay, nil
+	}
+	d, err := time.ParseDuration(c.PurgeDelay)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return d, err
+}
+
+// storedDelivery is how a stored webhook was delivered
+type storedDelivery struct {
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	TraceID    string `json:"trace_id,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	Auth       string `json:"auth,omitempty"`
+	// Encoding is the encoding the body was received in when it wasn't
+	// plain UTF-8
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// storedEvent is a row of the event store
+type storedEvent struct {
+	Rowid      int64
+	ID         string
+	Type       string
+	AccountID  string
+	ReceivedAt time.Time
+	// Body is converted to UTF-8, and RawBody is as it was received
+	Body     []byte
+	RawBody  []byte
+	Delivery storedDelivery
+	// FilteredBy is the config section that stopped the event from being
+	// published, if any
+	FilteredBy string
+}
+
+// eventStore writes received webhooks to a SQLite database. Deleted events
+// are kept until they're purged, but aren't read.
+type eventStore struct {
+	db         *sql.DB
+	purgeDelay time.Duration
+}
+
+// storedEvents is set when the event store is enabled
+var storedEvents *eventStore
+
+// openSQLite opens a SQLite database, creating it if it doesn't exist. It's
+// written with a write-ahead log, so that it can be read while it's written,
+// and writers wait for each other rather than failing.
+func openSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func openEventStore(cfg StoreConfig) (*eventStore, error) {
+	db, err := openSQLite(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range []string{storeEventsSchema, storeDeletionsSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &eventStore{db: db}
+	s.purgeDelay, _ = cfg.purgeDelay()
+	return s, nil
+}
+
+// deliveryFromRequest returns how a webhook was delivered
+func deliveryFromRequest(r *http.Request, event *webhookEvent, auth string) storedDelivery {
+	delivery := storedDelivery{
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		TraceID:    event.TraceID,
+		Auth:       auth,
+		Encoding:   event.Encoding,
+	}
+	if event.Tenant != nil {
+		delivery.Tenant = event.Tenant.Name
+	}
+	return delivery
+}
+
+// record writes a received webhook with its body as received, before it was
+// enriched, and the config section that filtered it out, if any. Errors are
+// logged, since the event is still published.
+func (s *eventStore) record(event *webhookEvent, body []byte, delivery storedDelivery, filteredBy string) {
+	if s == nil {
+		return
+	}
+	metadata, _ := json.Marshal(delivery)
+	var accountID, filtered interface{}
+	if event.AccountID != "" {
+		accountID = event.AccountID
+	}
+	if filteredBy != "" {
+		filtered = filteredBy
+	}
+	// Keep bodies as text, so they can be queried with SQLite's JSON
+	// functions, unless they aren't valid UTF-8
+	var stored interface{} = body
+	if utf8.Valid(body) {
+		stored = string(body)
+	}
+
+	_, err := s.db.Exec(`INSERT INTO events (event_id, type, account_id, received_at, body, metadata, filtered_by) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.Type, accountID, event.Received.UTC().Format(storeTimeLayout), stored, string(metadata), filtered)
+	if err != nil {
+		logError("Error writing %s event %s to the event store: %v", event.Type, event.ID, err)
+		storeWrites.WithLabelValues("error").Inc()
+		return
+	}
+	storeWrites.WithLabelValues("ok").Inc()
+}
+
+// storedEventColumns are the columns scanned by scanStoredEvent
+const storedEventColumns = "rowid, event_id, type, account_id, received_at, body, metadata, filtered_by"
+
+func scanStoredEvent(rows *sql.Rows) (storedEvent, error) {
+	var event storedEvent
+	var accountID, filteredBy sql.NullString
+	var received, metadata string
+	if err := rows.Scan(&event.Rowid, &event.ID, &event.Type, &accountID, &received, &event.RawBody, &metadata, &filteredBy); err != nil {
+		return event, err
+	}
+	event.AccountID = accountID.String
+	event.FilteredBy = filteredBy.String
+	event.ReceivedAt, _ = time.Parse(storeTimeLayout, received)
+	json.Unmarshal([]byte(metadata), &event.Delivery)
+	event.Body = decodeStoredBody(event.RawBody, event.Delivery.Encoding)
+	return event, nil
+}
+
+// sqliteWhere returns the SQL condition selecting the events that haven't been
+// deleted and might match the query, apart from its cursor and limit. The
+// amount range isn't in the condition, as it's read from the body, so
+// selected events are still checked with matches.
+func (q eventQuery) sqliteWhere() (string, []interface{}) {
+	conditions := []string{"deletion_id IS NULL"}
+	var args []interface{}
+	if !q.From.IsZero() {
+		conditions = append(conditions, "received_at >= ?")
+		args = append(args, q.From.UTC().Format(storeTimeLayout))
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, "received_at < ?")
+		args = append(args, q.To.UTC().Format(storeTimeLayout))
+	}
+	if len(q.Types) > 0 {
+		var types []string
+		for _, eventType := range q.Types {
+			// Event types have no GLOB wildcards of their own
+			if prefix, ok := strings.CutSuffix(eventType, "*"); ok {
+				types = append(types, "type GLOB ?")
+				args = append(args, prefix+"*")
+			} else {
+				types = append(types, "type = ?")
+				args = append(args, eventType)
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(types, " OR ")+")")
+	}
+	if q.AccountID != "" {
+		conditions = append(conditions, "account_id = ?")
+		args = append(args, q.AccountID)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// each calls fn with every stored event that hasn't been deleted, oldest
+// first
+func (s *eventStore) each(fn func(storedEvent) error) error {
+	rows, err := s.db.Query(`SELECT ` + storedEventColumns + ` FROM events WHERE deletion_id IS NULL ORDER BY rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		event, err := scanStoredEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// queryEvents reads the stored events matching a query, with the last
+// event's rowid as the cursor
+func (s *eventStore) queryEvents(ctx context.Context, query eventQuery) ([]storedEvent, string, error) {
+	var after int64
+	if query.After != "" {
+		var err error
+		if after, err = strconv.ParseInt(query.After, 10, 64); err != nil {
+			return nil, "", errInvalidEventCursor
+		}
+	}
+	where, args := query.sqliteWhere()
+	statement := `SELECT ` + storedEventColumns + ` FROM events WHERE rowid > ? AND ` + where + ` ORDER BY rowid`
+	args = append([]interface{}{after}, args...)
+	// Without an amount range, every selected event matches
+	if query.MinAmount == nil && query.MaxAmount == nil {
+		statement += ` LIMIT ?`
+		args = append(args, query.Limit+1)
+	}
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var events []storedEvent
+	for len(events) <= query.Limit && rows.Next() {
+		event, err := scanStoredEvent(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		if query.matches(event) {
+			events = append(events, event)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(events) > query.Limit {
+		events = events[:query.Limit]
+		next = strconv.FormatInt(events[len(events)-1].Rowid, 10)
+	}
+	return events, next, nil
+}
+
+// prune purges the stored events of deletions made before cutoff, and those
+// deletions. It returns the number of events purged.
+func (s *eventStore) prune(cutoff time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	at := cutoff.UTC().Format(storeTimeLayout)
+	result, err := tx.Exec(`DELETE FROM events WHERE deletion_id IN (SELECT deletion_id FROM deletions WHERE deleted_at < ?)`, at)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM deletions WHERE deleted_at < ?`, at); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	purged, _ := result.RowsAffected()
+	return int(purged), nil
+}
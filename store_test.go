@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStore(t *testing.T) {
+	store, err := openEventStore(StoreConfig{Path: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.db.Close()
+
+	received := time.Date(2024, 3, 1, 9, 0, 0, 123456000, time.UTC)
+	r := httptest.NewRequest("POST", "/webhook", nil)
+	r.Header.Set("User-Agent", "Monzo")
+	bodies := [][]byte{
+		[]byte(`{"type": "transaction.created", "data": {"account_id": "acc_1"}}`),
+		{'{', 0xff, '}'},
+	}
+	for i, body := range bodies {
+		event := &webhookEvent{ID: "evt_" + string(rune('a'+i)), Type: "transaction.created", Received: received, TraceID: "trace"}
+		if i == 0 {
+			event.AccountID = "acc_1"
+		}
+		store.record(event, body, deliveryFromRequest(r, event, "basic"), "")
+	}
+
+	var stored []storedEvent
+	store.each(func(event storedEvent) error {
+		stored = append(stored, event)
+		return nil
+	})
+	if len(stored) != len(bodies) {
+		t.Fatalf("Expected %d stored events, got %d", len(bodies), len(stored))
+	}
+	for i, event := range stored {
+		if !bytes.Equal(event.Body, bodies[i]) {
+			t.Errorf("Expected body %q, got %q", bodies[i], event.Body)
+		}
+		if !event.ReceivedAt.Equal(received) {
+			t.Errorf("Expected received at %v, got %v", received, event.ReceivedAt)
+		}
+	}
+	if got := stored[0]; got.ID != "evt_a" || got.AccountID != "acc_1" || got.Delivery.UserAgent != "Monzo" || got.Delivery.Auth != "basic" || got.Delivery.TraceID != "trace" {
+		t.Errorf("Unexpected stored event: %+v", got)
+	}
+	if stored[1].AccountID != "" {
+		t.Errorf("Expected no account, got %s", stored[1].AccountID)
+	}
+
+	// Recording without a store does nothing
+	var disabled *eventStore
+	disabled.record(&webhookEvent{}, nil, storedDelivery{}, "")
+}
+
+func TestEventStoreQueriesUseIndexes(t *testing.T) {
+	store := newReplayStore(t, "transaction.created")
+	tests := []struct {
+		query  eventQuery
+		expect string
+	}{
+		{query: eventQuery{From: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}, expect: "events_received_at"},
+		{query: eventQuery{Types: []string{"transaction.created"}}, expect: "events_type"},
+		{query: eventQuery{AccountID: "acc_1"}, expect: "events_account_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expect, func(t *testing.T) {
+			where, args := tt.query.sqliteWhere()
+			rows, err := store.db.Query(`EXPLAIN QUERY PLAN SELECT `+storedEventColumns+` FROM events WHERE `+where, args...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer rows.Close()
+			var plan []string
+			for rows.Next() {
+				var id, parent, unused int
+				var detail string
+				rows.Scan(&id, &parent, &unused, &detail)
+				plan = append(plan, detail)
+			}
+			if !strings.Contains(strings.Join(plan, "\n"), tt.expect) {
+				t.Errorf("Expected the query to use %s, got %v", tt.expect, plan)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StreamConfig represents the configuration for publishing to a Redis stream
+type StreamConfig struct {
+	Name            string         `json:"name"`
+	MaxLen          int64          `json:"max_len"`
+	MaxAge          string         `json:"max_age"`
+	MonitorInterval string         `json:"monitor_interval"`
+	LagAlert        LagAlertConfig `json:"lag_alert"`
+}
+
+// LagAlertConfig represents the consumer group thresholds that trigger alerts
+type LagAlertConfig struct {
+	MaxLag     int64 `json:"max_lag"`
+	MaxPending int64 `json:"max_pending"`
+}
+
+var (
+	streamLength = metrics.newGaugeVec("monzo_webhook_stream_length",
+		"Number of entries in the Redis stream.", "stream")
+	streamOldestEntryAge = metrics.newGaugeVec("monzo_webhook_stream_oldest_entry_age_seconds",
+		"Age of the oldest entry in the Redis stream.", "stream")
+	streamGroupLag = metrics.newGaugeVec("monzo_webhook_stream_consumer_group_lag",
+		"Entries not yet delivered to the consumer group.", "stream", "group")
+	streamGroupPending = metrics.newGaugeVec("monzo_webhook_stream_consumer_group_pending",
+		"Entries delivered to the consumer group but not yet acknowledged.", "stream", "group")
+	streamTrimmedEntries = metrics.newCounterVec("monzo_webhook_stream_trimmed_entries_total",
+		"Entries removed from the Redis stream by max_age trimming.", "stream")
+)
+
+// validate checks the stream configuration for invalid values
+func (c StreamConfig) validate() error {
+	if c.Name == "" {
+		return nil
+	}
+	if c.MaxLen < 0 {
+		return fmt.Errorf("stream.max_len must not be negative")
+	}
+	if _, err := c.maxAge(); err != nil {
+		return fmt.Errorf("invalid stream.max_age: %w", err)
+	}
+	if _, err := c.monitorInterval(); err != nil {
+		return fmt.Errorf("invalid stream.monitor_interval: %w", err)
+	}
+	if c.LagAlert.MaxLag < 0 || c.LagAlert.MaxPending < 0 {
+		return fmt.Errorf("stream.lag_alert thresholds must not be negative")
+	}
+	return nil
+}
+
+// maxAge returns the configured maximum entry age, or zero if unset
+func (c StreamConfig) maxAge() (time.Duration, error) {
+	if c.MaxAge == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.MaxAge)
+}
+
+// monitorInterval returns how often the stream is trimmed and measured
+func (c StreamConfig) monitorInterval() (time.Duration, error) {
+	if c.MonitorInterval == "" {
+		return 30 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.MonitorInterval)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// publishToStream appends a webhook to the configured stream, capping its
+// length with an approximate MAXLEN if configured
+func publishToStream(ctx context.Context, client *redis.Client, cfg StreamConfig, eventID, eventType string, body []byte) error {
+	args := &redis.XAddArgs{
+		Stream: cfg.Name,
+		Values: []interface{}{"id", eventID, "type", eventType, "payload", body},
+	}
+	if cfg.MaxLen > 0 {
+		args.MaxLen = cfg.MaxLen
+		args.Approx = true
+	}
+	return client.XAdd(ctx, args).Err()
+}
+
+// runStreamMonitor trims the stream by age and refreshes the stream metrics
+// every monitor interval until ctx is cancelled
+func runStreamMonitor(ctx context.Context, client *redis.Client, cfg StreamConfig) {
+	interval, _ := cfg.monitorInterval()
+
+	lagMonitor := newConsumerLagMonitor(cfg.LagAlert, sendAlert)
+
+	for {
+		if err := trimStream(ctx, client, cfg, clock.Now()); err != nil {
+			logError("Error trimming Redis stream '%s': %v", cfg.Name, err)
+		}
+		groups, err := collectStreamMetrics(ctx, client, cfg.Name, clock.Now())
+		if err != nil {
+			logError("Error collecting metrics for Redis stream '%s': %v", cfg.Name, err)
+		} else {
+			lagMonitor.check(ctx, cfg.Name, groups)
+		}
+
+		if sleepUntil(ctx, clock, clock.Now().Add(interval)) != nil {
+			return
+		}
+	}
+}
+
+// trimStream removes entries older than max_age
+func trimStream(ctx context.Context, client *redis.Client, cfg StreamConfig, now time.Time) error {
+	maxAge, _ := cfg.maxAge()
+	if maxAge <= 0 {
+		return nil
+	}
+
+	minID := strconv.FormatInt(now.Add(-maxAge).UnixMilli(), 10)
+	trimmed, err := client.XTrimMinID(ctx, cfg.Name, minID).Result()
+	if err != nil {
+		return err
+	}
+	if trimmed > 0 {
+		streamTrimmedEntries.WithLabelValues(cfg.Name).Add(float64(trimmed))
+		logDebug("Trimmed %d entries older than %s from Redis stream '%s'", trimmed, maxAge, cfg.Name)
+	}
+	return nil
+}
+
+// collectStreamMetrics records the stream length, oldest entry age and
+// consumer group lag, returning the consumer groups it found
+func collectStreamMetrics(ctx context.Context, client *redis.Client, stream string, now time.Time) ([]redis.XInfoGroup, error) {
+	length, err := client.XLen(ctx, stream).Result()
+	if err != nil {
+		return nil, err
+	}
+	streamLength.WithLabelValues(stream).Set(float64(length))
+
+	oldest, err := client.XRangeN(ctx, stream, "-", "+", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(oldest) == 0 {
+		streamOldestEntryAge.WithLabelValues(stream).Set(0)
+	} else if ts, err := streamIDTime(oldest[0].ID); err == nil {
+		streamOldestEntryAge.WithLabelValues(stream).Set(now.Sub(ts).Seconds())
+	}
+
+	if length == 0 {
+		// XINFO GROUPS fails on a stream that was never created
+		exists, err := client.Exists(ctx, stream).Result()
+		if err != nil || exists == 0 {
+			return nil, err
+		}
+	}
+
+	groups, err := client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	streamGroupLag.Reset()
+	streamGroupPending.Reset()
+	for _, group := range groups {
+		streamGroupPending.WithLabelValues(stream, group.Name).Set(float64(group.Pending))
+		if group.Lag >= 0 {
+			streamGroupLag.WithLabelValues(stream, group.Name).Set(float64(group.Lag))
+		}
+	}
+
+	return groups, nil
+}
+
+// consumerLagMonitor fires an alert when a consumer group falls behind the
+// configured thresholds and resolves it once the group has caught up
+type consumerLagMonitor struct {
+	cfg    LagAlertConfig
+	send   func(context.Context, Alert)
+	behind map[string]bool
+}
+
+func newConsumerLagMonitor(cfg LagAlertConfig, send func(context.Context, Alert)) *consumerLagMonitor {
+	return &consumerLagMonitor{cfg: cfg, send: send, behind: make(map[string]bool)}
+}
+
+// check compares each group against the thresholds and sends an alert for
+// every group whose state changed since the last check
+func (m *consumerLagMonitor) check(ctx context.Context, stream string, groups []redis.XInfoGroup) {
+	maxLag := runtimeOverrides.integer(overrideMaxLag, m.cfg.MaxLag)
+	maxPending := runtimeOverrides.integer(overrideMaxPending, m.cfg.MaxPending)
+	if maxLag == 0 && maxPending == 0 {
+		return
+	}
+
+	seen := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		seen[group.Name] = true
+
+		var reasons []string
+		if maxLag > 0 && group.Lag > maxLag {
+			reasons = append(reasons, fmt.Sprintf("lag %d exceeds %d", group.Lag, maxLag))
+		}
+		if maxPending > 0 && group.Pending > maxPending {
+			reasons = append(reasons, fmt.Sprintf("pending %d exceeds %d", group.Pending, maxPending))
+		}
+
+		behind := len(reasons) > 0
+		if behind == m.behind[group.Name] {
+			continue
+		}
+		m.behind[group.Name] = behind
+
+		alert := Alert{
+			Name:   "consumer_lag",
+			Status: AlertResolved,
+			Labels: map[string]string{
+				"stream":  stream,
+				"group":   group.Name,
+				"lag":     strconv.FormatInt(group.Lag, 10),
+				"pending": strconv.FormatInt(group.Pending, 10),
+			},
+		}
+		if behind {
+			alert.Status = AlertFiring
+			alert.Message = fmt.Sprintf("Consumer group '%s' on stream '%s' is falling behind: %s",
+				group.Name, stream, strings.Join(reasons, ", "))
+		} else {
+			alert.Message = fmt.Sprintf("Consumer group '%s' on stream '%s' has caught up", group.Name, stream)
+		}
+		m.send(ctx, alert)
+	}
+
+	// Forget groups that have been deleted
+	for name := range m.behind {
+		if !seen[name] {
+			delete(m.behind, name)
+		}
+	}
+}
+
+// streamIDTime returns the timestamp encoded in a Redis stream entry ID
+func streamIDTime(id string) (time.Time, error) {
+	ms, _, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid stream ID '%s'", id)
+	}
+	return time.UnixMilli(n), nil
+}
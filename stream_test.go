@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStreamConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      StreamConfig
+		expectError bool
+	}{
+		{name: "Stream disabled", config: StreamConfig{MaxAge: "garbage"}},
+		{name: "Name only", config: StreamConfig{Name: "monzo"}},
+		{name: "All settings", config: StreamConfig{Name: "monzo", MaxLen: 1000, MaxAge: "168h", MonitorInterval: "10s"}},
+		{name: "Negative max_len", config: StreamConfig{Name: "monzo", MaxLen: -1}, expectError: true},
+		{name: "Invalid max_age", config: StreamConfig{Name: "monzo", MaxAge: "a week"}, expectError: true},
+		{name: "Zero monitor_interval", config: StreamConfig{Name: "monzo", MonitorInterval: "0s"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamIDTime(t *testing.T) {
+	ts, err := streamIDTime("1700000000123-4")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !ts.Equal(time.UnixMilli(1700000000123)) {
+		t.Errorf("Expected %v, got %v", time.UnixMilli(1700000000123), ts)
+	}
+
+	if _, err := streamIDTime("not-an-id"); err == nil {
+		t.Error("Expected an error for an invalid ID")
+	}
+}
+
+func TestConsumerLagMonitor(t *testing.T) {
+	var sent []Alert
+	monitor := newConsumerLagMonitor(LagAlertConfig{MaxLag: 100, MaxPending: 10}, func(ctx context.Context, alert Alert) {
+		sent = append(sent, alert)
+	})
+
+	steps := []struct {
+		name           string
+		groups         []redis.XInfoGroup
+		expectedStatus []string
+	}{
+		{
+			name:   "Healthy groups send nothing",
+			groups: []redis.XInfoGroup{{Name: "notifier", Lag: 5, Pending: 1}},
+		},
+		{
+			name:           "Lag over threshold fires",
+			groups:         []redis.XInfoGroup{{Name: "notifier", Lag: 500, Pending: 1}},
+			expectedStatus: []string{AlertFiring},
+		},
+		{
+			name:   "Still behind does not fire again",
+			groups: []redis.XInfoGroup{{Name: "notifier", Lag: 600, Pending: 20}},
+		},
+		{
+			name:           "Caught up resolves",
+			groups:         []redis.XInfoGroup{{Name: "notifier", Lag: 0, Pending: 0}},
+			expectedStatus: []string{AlertResolved},
+		},
+		{
+			name:           "Pending over threshold fires",
+			groups:         []redis.XInfoGroup{{Name: "notifier", Lag: 0, Pending: 11}, {Name: "archiver", Lag: -1, Pending: 0}},
+			expectedStatus: []string{AlertFiring},
+		},
+	}
+
+	for _, step := range steps {
+		sent = nil
+		monitor.check(context.Background(), "monzo", step.groups)
+
+		if len(sent) != len(step.expectedStatus) {
+			t.Fatalf("%s: expected %d alerts, got %d: %+v", step.name, len(step.expectedStatus), len(sent), sent)
+		}
+		for i, status := range step.expectedStatus {
+			if sent[i].Status != status {
+				t.Errorf("%s: expected status %s, got %s", step.name, status, sent[i].Status)
+			}
+			if sent[i].Labels["group"] != "notifier" {
+				t.Errorf("%s: expected alert for group 'notifier', got '%s'", step.name, sent[i].Labels["group"])
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TenantConfig represents a tenant sharing this instance in multi-tenant mode.
+// Tenants are identified by their basic auth credentials.
+type TenantConfig struct {
+	Name     string      `json:"name"`
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Channel  string      `json:"channel"`
+	Quota    QuotaConfig `json:"quota"`
+}
+
+// QuotaConfig represents the usage limits applied to a tenant per window
+type QuotaConfig struct {
+	MaxEvents   int64  `json:"max_events"`
+	MaxBytes    int64  `json:"max_bytes"`
+	SoftPercent int    `json:"soft_percent"`
+	Window      string `json:"window"`
+}
+
+// TenantUsage is a tenant's accounted usage, as reported by the admin API
+type TenantUsage struct {
+	WindowStart    time.Time   `json:"window_start"`
+	WindowEnd      time.Time   `json:"window_end"`
+	Events         int64       `json:"events"`
+	Bytes          int64       `json:"bytes"`
+	RejectedEvents int64       `json:"rejected_events"`
+	TotalEvents    int64       `json:"total_events"`
+	TotalBytes     int64       `json:"total_bytes"`
+	Quota          QuotaConfig `json:"quota"`
+
+	softWarned bool
+}
+
+// quotaDecision is the outcome of accounting a single event against a quota
+type quotaDecision struct {
+	allowed    bool
+	softLimit  bool // the soft limit was crossed by this event
+	retryAfter time.Duration
+}
+
+type tenantContextKey struct{}
+
+var (
+	tenantEvents = metrics.newCounterVec("monzo_webhook_tenant_events_total",
+		"Webhook events accepted, by tenant.", "tenant")
+	tenantBytes = metrics.newCounterVec("monzo_webhook_tenant_bytes_total",
+		"Webhook payload bytes accepted, by tenant.", "tenant")
+	tenantRejections = metrics.newCounterVec("monzo_webhook_tenant_quota_rejections_total",
+		"Webhook events rejected because the tenant exceeded its quota.", "tenant")
+)
+
+var tenantUsage = newUsageTracker(clockNow)
+
+// validate checks a tenant's configuration for missing or invalid values
+func (t TenantConfig) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("tenant name must not be empty")
+	}
+	if t.Username == "" || t.Password == "" {
+		return fmt.Errorf("tenant '%s' must have a username and password", t.Name)
+	}
+	if t.Quota.MaxEvents < 0 || t.Quota.MaxBytes < 0 {
+		return fmt.Errorf("tenant '%s' quota limits must not be negative", t.Name)
+	}
+	if t.Quota.SoftPercent < 0 || t.Quota.SoftPercent > 100 {
+		return fmt.Errorf("tenant '%s' quota soft_percent must be between 0 and 100", t.Name)
+	}
+	if _, err := t.Quota.window(); err != nil {
+		return fmt.Errorf("tenant '%s' has an invalid quota window: %w", t.Name, err)
+	}
+	return nil
+}
+
+// window returns the quota accounting window, defaulting to a day
+func (q QuotaConfig) window() (time.Duration, error) {
+	if q.Window == "" {
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(q.Window)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// softPercent returns the percentage of a limit at which a warning is raised
+func (q QuotaConfig) softPercent() int {
+	if q.SoftPercent == 0 {
+		return 80
+	}
+	return q.SoftPercent
+}
+
+// validateTenants checks every tenant and that names and usernames are unique
+func validateTenants(tenants []TenantConfig) error {
+	names := make(map[string]bool)
+	usernames := make(map[string]bool)
+	for _, tenant := range tenants {
+		if err := tenant.validate(); err != nil {
+			return err
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("duplicate tenant name '%s'", tenant.Name)
+		}
+		if usernames[tenant.Username] {
+			return fmt.Errorf("duplicate tenant username '%s'", tenant.Username)
+		}
+		names[tenant.Name] = true
+		usernames[tenant.Username] = true
+	}
+	return nil
+}
+
+// matchTenant returns the tenant with the given credentials, or nil
+func matchTenant(username, password string) *TenantConfig {
+	var match *TenantConfig
+	tenants := currentConfig().Tenants
+	for i := range tenants {
+		tenant := &tenants[i]
+		// Compare against every tenant so the time taken doesn't reveal which one matched
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(tenant.Username)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(tenant.Password)) == 1
+		if usernameMatch && passwordMatch {
+			match = tenant
+		}
+	}
+	return match
+}
+
+// withTenant returns a copy of ctx carrying the authenticated tenant
+func withTenant(ctx context.Context, tenant *TenantConfig) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantFromContext returns the authenticated tenant, or nil outside multi-tenant mode
+func tenantFromContext(ctx context.Context) *TenantConfig {
+	tenant, _ := ctx.Value(tenantContextKey{}).(*TenantConfig)
+	return tenant
+}
+
+// usageTracker accounts events and bytes per tenant in fixed windows
+type usageTracker struct {
+	mu    sync.Mutex
+	now   func() time.Time
+	usage map[string]*TenantUsage
+	// state, when set, keeps each tenant's usage so a restart doesn't start
+	// a new window. It is only set for the event store, as instances
+	// sharing Redis each account their own usage.
+	state stateStore
+}
+
+// usageKeyPrefix is the prefix of the state keys tenant usage is kept in
+const usageKeyPrefix = "monzo-webhook:usage:"
+
+// storedUsage is a tenant's usage as kept in the state
+type storedUsage struct {
+	TenantUsage
+	SoftWarned bool `json:"soft_warned"`
+}
+
+func newUsageTracker(now func() time.Time) *usageTracker {
+	return &usageTracker{now: now, usage: make(map[string]*TenantUsage)}
+}
+
+// record accounts an event of size bytes against the tenant's quota. Events
+// that would exceed a hard limit are rejected and not counted as usage.
+func (u *usageTracker) record(tenant *TenantConfig, size int) quotaDecision {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage := u.current(tenant)
+	defer u.save(tenant.Name, usage)
+	quota := tenant.Quota
+
+	events := usage.Events + 1
+	bytes := usage.Bytes + int64(size)
+	if (quota.MaxEvents > 0 && events > quota.MaxEvents) || (quota.MaxBytes > 0 && bytes > quota.MaxBytes) {
+		usage.RejectedEvents++
+		return quotaDecision{retryAfter: usage.WindowEnd.Sub(u.now())}
+	}
+
+	usage.Events = events
+	usage.Bytes = bytes
+	usage.TotalEvents++
+	usage.TotalBytes += int64(size)
+
+	decision := quotaDecision{allowed: true}
+	soft := int64(quota.softPercent())
+	overSoft := (quota.MaxEvents > 0 && events*100 >= quota.MaxEvents*soft) ||
+		(quota.MaxBytes > 0 && bytes*100 >= quota.MaxBytes*soft)
+	if overSoft && !usage.softWarned {
+		usage.softWarned = true
+		decision.softLimit = true
+	}
+
+	return decision
+}
+
+// current returns the tenant's usage for the current window, starting a new
+// window if the previous one has ended
+func (u *usageTracker) current(tenant *TenantConfig) *TenantUsage {
+	window, _ := tenant.Quota.window()
+	now := u.now()
+
+	usage, ok := u.usage[tenant.Name]
+	if !ok {
+		usage = u.load(tenant.Name)
+		u.usage[tenant.Name] = usage
+	}
+	usage.Quota = tenant.Quota
+
+	if !now.Before(usage.WindowEnd) {
+		usage.WindowStart = now.Truncate(window)
+		usage.WindowEnd = usage.WindowStart.Add(window)
+		usage.Events = 0
+		usage.Bytes = 0
+		usage.RejectedEvents = 0
+		usage.softWarned = false
+	}
+
+	return usage
+}
+
+// load returns a tenant's usage kept in the state, or none. u.mu must be
+// held.
+func (u *usageTracker) load(name string) *TenantUsage {
+	if u.state == nil {
+		return &TenantUsage{}
+	}
+	value, ok, err := u.state.get(context.Background(), usageKeyPrefix+name)
+	var stored storedUsage
+	if err == nil && ok {
+		err = json.Unmarshal([]byte(value), &stored)
+	}
+	if err != nil {
+		logWarn("Error reading the usage of tenant '%s': %v", name, err)
+		return &TenantUsage{}
+	}
+	stored.TenantUsage.softWarned = stored.SoftWarned
+	return &stored.TenantUsage
+}
+
+// save keeps a tenant's usage in the state until its window ends. u.mu must
+// be held.
+func (u *usageTracker) save(name string, usage *TenantUsage) {
+	if u.state == nil {
+		return
+	}
+	value, err := json.Marshal(storedUsage{TenantUsage: *usage, SoftWarned: usage.softWarned})
+	if err == nil {
+		err = u.state.set(context.Background(), usageKeyPrefix+name, string(value), usage.WindowEnd.Sub(u.now()))
+	}
+	if err != nil {
+		logWarn("Error saving the usage of tenant '%s': %v", name, err)
+	}
+}
+
+// snapshot returns the current usage of every configured tenant
+func (u *usageTracker) snapshot(tenants []TenantConfig) map[string]TenantUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	result := make(map[string]TenantUsage, len(tenants))
+	for i := range tenants {
+		result[tenants[i].Name] = *u.current(&tenants[i])
+	}
+	return result
+}
+
+// enforceTenantQuota accounts an event for the tenant and reports whether it
+// may be processed. It raises an alert the first time the soft limit is
+// crossed in a window.
+func enforceTenantQuota(ctx context.Context, tenant *TenantConfig, size int) quotaDecision {
+	decision := tenantUsage.record(tenant, size)
+	if !decision.allowed {
+		tenantRejections.WithLabelValues(tenant.Name).Inc()
+		logWarn("Tenant '%s' exceeded its quota - rejecting webhook", tenant.Name)
+		return decision
+	}
+
+	tenantEvents.WithLabelValues(tenant.Name).Inc()
+	tenantBytes.WithLabelValues(tenant.Name).Add(float64(size))
+
+	if decision.softLimit {
+		sendAlert(ctx, Alert{
+			Name:    "tenant_quota",
+			Status:  AlertFiring,
+			Message: fmt.Sprintf("Tenant '%s' has used %d%% of its quota", tenant.Name, tenant.Quota.softPercent()),
+			Labels: map[string]string{
+				"tenant":     tenant.Name,
+				"max_events": strconv.FormatInt(tenant.Quota.MaxEvents, 10),
+				"max_bytes":  strconv.FormatInt(tenant.Quota.MaxBytes, 10),
+			},
+		})
+	}
+
+	return decision
+}
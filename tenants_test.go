@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsageTrackerRecord(t *testing.T) {
+	now := time.Date(2026, 1, 24, 12, 0, 0, 0, time.UTC)
+	tracker := newUsageTracker(func() time.Time { return now })
+	tenant := &TenantConfig{Name: "alice", Quota: QuotaConfig{MaxEvents: 5, MaxBytes: 1000}}
+
+	steps := []struct {
+		name          string
+		size          int
+		expectAllowed bool
+		expectSoft    bool
+	}{
+		{name: "First event", size: 100, expectAllowed: true},
+		{name: "Second event", size: 100, expectAllowed: true},
+		{name: "Third event", size: 100, expectAllowed: true},
+		{name: "Fourth event crosses soft limit", size: 100, expectAllowed: true, expectSoft: true},
+		{name: "Oversized event rejected", size: 700, expectAllowed: false},
+		{name: "Fifth event still allowed", size: 100, expectAllowed: true},
+		{name: "Sixth event rejected", size: 1, expectAllowed: false},
+	}
+
+	for _, step := range steps {
+		decision := tracker.record(tenant, step.size)
+		if decision.allowed != step.expectAllowed {
+			t.Errorf("%s: expected allowed=%v, got %v", step.name, step.expectAllowed, decision.allowed)
+		}
+		if decision.softLimit != step.expectSoft {
+			t.Errorf("%s: expected softLimit=%v, got %v", step.name, step.expectSoft, decision.softLimit)
+		}
+		if !decision.allowed && decision.retryAfter != 12*time.Hour {
+			t.Errorf("%s: expected retryAfter of 12h, got %v", step.name, decision.retryAfter)
+		}
+	}
+
+	usage := tracker.snapshot([]TenantConfig{*tenant})["alice"]
+	if usage.Events != 5 || usage.Bytes != 500 || usage.RejectedEvents != 2 {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+
+	// The next window starts afresh but keeps the lifetime totals
+	now = now.Add(12 * time.Hour)
+	if decision := tracker.record(tenant, 100); !decision.allowed {
+		t.Error("Expected event in new window to be allowed")
+	}
+	usage = tracker.snapshot([]TenantConfig{*tenant})["alice"]
+	if usage.Events != 1 || usage.TotalEvents != 6 || usage.TotalBytes != 600 {
+		t.Errorf("Unexpected usage after window rollover: %+v", usage)
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	tests := []struct {
+		name        string
+		tenants     []TenantConfig
+		expectError bool
+	}{
+		{name: "No tenants"},
+		{name: "Valid tenants", tenants: []TenantConfig{
+			{Name: "alice", Username: "alice", Password: "a"},
+			{Name: "bob", Username: "bob", Password: "b", Quota: QuotaConfig{MaxEvents: 10, Window: "1h"}},
+		}},
+		{name: "Missing password", tenants: []TenantConfig{{Name: "alice", Username: "alice"}}, expectError: true},
+		{name: "Duplicate username", tenants: []TenantConfig{
+			{Name: "alice", Username: "shared", Password: "a"},
+			{Name: "bob", Username: "shared", Password: "b"},
+		}, expectError: true},
+		{name: "Invalid window", tenants: []TenantConfig{
+			{Name: "alice", Username: "alice", Password: "a", Quota: QuotaConfig{Window: "daily"}},
+		}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTenants(tt.tenants)
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerWithTenants(t *testing.T) {
+	origConfig := eventConfig
+	origUsername := basicAuthUsername
+	origPassword := basicAuthPassword
+	origRedisClient := redisClient
+	origUsage := tenantUsage
+	defer func() {
+		eventConfig = origConfig
+		basicAuthUsername = origUsername
+		basicAuthPassword = origPassword
+		redisClient = origRedisClient
+		tenantUsage = origUsage
+	}()
+
+	eventConfig.Tenants = []TenantConfig{
+		{Name: "alice", Username: "alice", Password: "alicepass", Quota: QuotaConfig{MaxEvents: 1}},
+	}
+	basicAuthUsername = ""
+	basicAuthPassword = ""
+	redisClient = nil
+	tenantUsage = newUsageTracker(time.Now)
+
+	handler := basicAuthMiddleware(webhookHandler)
+	body := `{"type": "transaction.created", "data": {}}`
+
+	tests := []struct {
+		name               string
+		credentials        string
+		expectedStatusCode int
+	}{
+		{name: "Empty credentials are rejected", credentials: ":", expectedStatusCode: http.StatusUnauthorized},
+		{name: "Unknown tenant is rejected", credentials: "mallory:pass", expectedStatusCode: http.StatusUnauthorized},
+		{name: "Tenant within quota", credentials: "alice:alicepass", expectedStatusCode: http.StatusOK},
+		{name: "Tenant over quota", credentials: "alice:alicepass", expectedStatusCode: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.credentials)))
+
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatusCode, rr.Code)
+			}
+			if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+				t.Error("Expected Retry-After header on quota rejection")
+			}
+		})
+	}
+}
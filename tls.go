@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+)
+
+// serverTLSConfigFromEnv builds the TLS configuration for serving HTTPS from
+// TLS_CERT_FILE and TLS_KEY_FILE. It returns nil if neither is set, in which
+// case the server listens for plain HTTP.
+func serverTLSConfigFromEnv() (*tls.Config, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must both be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	cfg := newServerTLSConfig()
+	cfg.Certificates = []tls.Certificate{cert}
+	return cfg, nil
+}
+
+// newServerTLSConfig returns the TLS settings used for serving HTTPS: TLS 1.2
+// or later, with only forward-secret AEAD cipher suites for TLS 1.2. TLS 1.3
+// cipher suites are not configurable and are all secure.
+func newServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
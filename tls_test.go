@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and key for
+// localhost to dir, returning their paths
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestServerTLSConfigFromEnv(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	tests := []struct {
+		name        string
+		certFile    string
+		keyFile     string
+		expectTLS   bool
+		expectError bool
+	}{
+		{name: "Not configured"},
+		{name: "Certificate and key", certFile: certFile, keyFile: keyFile, expectTLS: true},
+		{name: "Certificate without key", certFile: certFile, expectError: true},
+		{name: "Missing files", certFile: certFile + ".missing", keyFile: keyFile, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TLS_CERT_FILE", tt.certFile)
+			t.Setenv("TLS_KEY_FILE", tt.keyFile)
+			cfg, err := serverTLSConfigFromEnv()
+			if (err != nil) != tt.expectError {
+				t.Fatalf("Expected error=%v, got %v", tt.expectError, err)
+			}
+			if (cfg != nil) != tt.expectTLS {
+				t.Errorf("Expected TLS=%v, got %v", tt.expectTLS, cfg != nil)
+			}
+		})
+	}
+}
+
+func TestServerTLSMinimumVersion(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	cfg, err := serverTLSConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = cfg
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		maxVersion  uint16
+		expectError bool
+	}{
+		{name: "TLS 1.3", maxVersion: tls.VersionTLS13},
+		{name: "TLS 1.2", maxVersion: tls.VersionTLS12},
+		{name: "TLS 1.1 is refused", maxVersion: tls.VersionTLS11, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         tls.VersionTLS10,
+				MaxVersion:         tt.maxVersion,
+			}}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.expectError {
+				t.Errorf("Expected error=%v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TraceConfig configures the in-memory processing traces served by the admin API
+type TraceConfig struct {
+	MaxEvents int `json:"max_events"`
+}
+
+// eventTrace records how an event was processed, for answering "why didn't
+// my consumer get this"
+type eventTrace struct {
+	ID              string                `json:"id"`
+	Type            string                `json:"type"`
+	Tenant          string                `json:"tenant,omitempty"`
+	Received        time.Time             `json:"received"`
+	Auth            string                `json:"auth"`
+	MatchedRules    []traceRule           `json:"matched_rules"`
+	Transformations []traceTransformation `json:"transformations"`
+	SinkAttempts    []traceSinkAttempt    `json:"sink_attempts"`
+	Outcome         string                `json:"outcome"`
+}
+
+// traceRule is a configured rule that matched the event
+type traceRule struct {
+	Kind string `json:"kind"`
+	Rule string `json:"rule"`
+}
+
+// traceTransformation is a change made to the event, with snippets of the
+// payload before and after
+type traceTransformation struct {
+	Name   string `json:"name"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// traceSinkAttempt is one attempt to publish the event to a sink
+type traceSinkAttempt struct {
+	Sink     string    `json:"sink"`
+	Attempt  int       `json:"attempt"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// traceSnippetBytes is the most payload kept for each side of a transformation
+const traceSnippetBytes = 256
+
+// traceStore keeps the traces of the most recent events. All methods are safe
+// to call on a nil store, which records nothing.
+type traceStore struct {
+	mu     sync.Mutex
+	traces map[string]*eventTrace
+	order  []string
+	next   int
+}
+
+var eventTraces *traceStore
+
+// validate checks the trace configuration for invalid values
+func (c TraceConfig) validate() error {
+	if c.MaxEvents < 0 {
+		return fmt.Errorf("trace max_events must not be negative")
+	}
+	return nil
+}
+
+// maxEvents returns how many traces are kept, defaulting to 1000
+func (c TraceConfig) maxEvents() int {
+	if c.MaxEvents == 0 {
+		return 1000
+	}
+	return c.MaxEvents
+}
+
+func newTraceStore(maxEvents int) *traceStore {
+	return &traceStore{
+		traces: make(map[string]*eventTrace, maxEvents),
+		order:  make([]string, maxEvents),
+	}
+}
+
+// start begins the trace of a received event, evicting the oldest trace if
+// the store is full
+func (s *traceStore) start(event *webhookEvent, auth string, rules []traceRule) {
+	if s == nil {
+		return
+	}
+	trace := &eventTrace{
+		ID:              event.ID,
+		Type:            event.Type,
+		Received:        event.Received,
+		Auth:            auth,
+		MatchedRules:    rules,
+		Transformations: []traceTransformation{},
+		SinkAttempts:    []traceSinkAttempt{},
+		Outcome:         "processing",
+	}
+	if event.Tenant != nil {
+		trace.Tenant = event.Tenant.Name
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.traces, s.order[s.next])
+	s.order[s.next] = event.ID
+	s.next = (s.next + 1) % len(s.order)
+	s.traces[event.ID] = trace
+}
+
+// update applies fn to an event's trace, if it is still kept
+func (s *traceStore) update(id string, fn func(*eventTrace)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if trace, ok := s.traces[id]; ok {
+		fn(trace)
+	}
+}
+
+// recordTransformation records a change made to an event's payload
+func (s *traceStore) recordTransformation(id, name string, before, after []byte) {
+	s.update(id, func(trace *eventTrace) {
+		trace.Transformations = append(trace.Transformations, traceTransformation{
+			Name:   name,
+			Before: traceSnippet(before),
+			After:  traceSnippet(after),
+		})
+	})
+}
+
+// recordSinkAttempt records the result of one attempt to publish to a sink
+func (s *traceStore) recordSinkAttempt(id, sink string, attempt int, started time.Time, result string, err error) {
+	s.update(id, func(trace *eventTrace) {
+		record := traceSinkAttempt{
+			Sink:     sink,
+			Attempt:  attempt,
+			Started:  started,
+			Duration: time.Since(started).String(),
+			Result:   result,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		trace.SinkAttempts = append(trace.SinkAttempts, record)
+	})
+}
+
+// setOutcome records what finally happened to an event
+func (s *traceStore) setOutcome(id, outcome string) {
+	s.update(id, func(trace *eventTrace) {
+		trace.Outcome = outcome
+	})
+}
+
+// get returns a copy of an event's trace
+func (s *traceStore) get(id string) (eventTrace, bool) {
+	if s == nil {
+		return eventTrace{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trace, ok := s.traces[id]
+	if !ok {
+		return eventTrace{}, false
+	}
+	snapshot := *trace
+	snapshot.MatchedRules = append([]traceRule{}, trace.MatchedRules...)
+	snapshot.Transformations = append([]traceTransformation{}, trace.Transformations...)
+	snapshot.SinkAttempts = append([]traceSinkAttempt{}, trace.SinkAttempts...)
+	return snapshot, true
+}
+
+// traceSnippet truncates a payload for a trace
+func traceSnippet(payload []byte) string {
+	if len(payload) <= traceSnippetBytes {
+		return string(payload)
+	}
+	return string(payload[:traceSnippetBytes]) + "..."
+}
+
+// matchedRules describes the configured rules that matched an event
+func matchedRules(eventType string, payload map[string]interface{}) []traceRule {
+	rules := []traceRule{}
+	for i, rule := range currentConfig().Priorities {
+		if rule.matches(eventType, payload) {
+			rules = append(rules, traceRule{
+				Kind: "priority",
+				Rule: fmt.Sprintf("priorities[%d]: type=%q field=%q priority=%d", i, rule.Type, rule.Field, rule.Priority),
+			})
+			break
+		}
+	}
+	return rules
+}
+
+// authResult describes how a webhook request was authenticated
+func authResult(tenant *TenantConfig) string {
+	username, password := webhookBasicAuth()
+	switch {
+	case tenant != nil:
+		return "tenant " + tenant.Name
+	case webhookAuth != nil:
+		return webhookAuth.kind
+	case username != "" || password != "" || webhookCredentials != nil:
+		return "basic"
+	default:
+		return "disabled"
+	}
+}
+
+// adminEventTraceHandler returns the processing trace of an event
+func adminEventTraceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	trace, ok := eventTraces.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "No trace for event (unknown or expired)", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, trace)
+}
+
+// traceparentPattern matches a W3C traceparent header, capturing the trace ID
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// traceIDFromRequest returns the trace ID from the request's traceparent
+// header, set by a tracing proxy in front of the server, or "" if there is
+// none
+func traceIDFromRequest(r *http.Request) string {
+	match := traceparentPattern.FindStringSubmatch(strings.TrimSpace(r.Header.Get("traceparent")))
+	if match == nil || match[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return match[1]
+}
+
+// eventExemplar returns the exemplar labels for an observation about an
+// event: its ID, which the admin API serves the trace of, and the trace ID
+// from the request that delivered it, if any
+func eventExemplar(event *webhookEvent) prometheus.Labels {
+	labels := prometheus.Labels{"event_id": event.ID}
+	if event.TraceID != "" {
+		labels["trace_id"] = event.TraceID
+	}
+	return labels
+}
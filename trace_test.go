@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceStoreEviction(t *testing.T) {
+	store := newTraceStore(2)
+	for _, id := range []string{"a", "b", "c"} {
+		store.start(&webhookEvent{ID: id, Type: "transaction.created", Received: time.Now()}, "disabled", nil)
+	}
+
+	if _, ok := store.get("a"); ok {
+		t.Error("Expected the oldest trace to be evicted")
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, ok := store.get(id); !ok {
+			t.Errorf("Expected trace '%s' to be kept", id)
+		}
+	}
+
+	// Updates to evicted traces are ignored
+	store.setOutcome("a", "published")
+	if _, ok := store.get("a"); ok {
+		t.Error("Expected an update not to recreate an evicted trace")
+	}
+}
+
+func TestTraceSnippet(t *testing.T) {
+	short := []byte(`{"type":"transaction.created"}`)
+	if got := traceSnippet(short); got != string(short) {
+		t.Errorf("Expected a short payload unchanged, got '%s'", got)
+	}
+
+	long := []byte(strings.Repeat("x", traceSnippetBytes+10))
+	if got := traceSnippet(long); len(got) != traceSnippetBytes+3 || !strings.HasSuffix(got, "...") {
+		t.Errorf("Expected a long payload to be truncated, got %d bytes", len(got))
+	}
+}
+
+func TestAdminEventTraceHandler(t *testing.T) {
+	origConfig := eventConfig
+	origSinks := sinks
+	origTraces := eventTraces
+	origUsername, origPassword := basicAuthUsername, basicAuthPassword
+	defer func() {
+		eventConfig = origConfig
+		sinks = origSinks
+		eventTraces = origTraces
+		basicAuthUsername, basicAuthPassword = origUsername, origPassword
+	}()
+
+	basicAuthUsername, basicAuthPassword = "", ""
+
+	eventConfig = EventConfig{
+		Priorities: []PriorityRule{{Type: "transaction.*", Priority: 10}},
+		Retry:      RetryConfig{Attempts: 2, InitialBackoff: "1ms"},
+	}
+	failing := &fakeSink{name: "audit", err: errors.New("connection refused")}
+	sinks = []sinkEntry{{sink: &fakeSink{name: "redis"}, required: true}, {sink: failing}}
+	eventTraces = newTraceStore(10)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"type":"transaction.created","data":{}}`))
+	rr := httptest.NewRecorder()
+	webhookHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", rr.Code)
+	}
+	id := rr.Header().Get("X-Event-ID")
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/events/"+id+"/trace", nil)
+	req.SetPathValue("id", id)
+	rr = httptest.NewRecorder()
+	adminEventTraceHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", rr.Code)
+	}
+
+	var trace eventTrace
+	if err := json.NewDecoder(rr.Body).Decode(&trace); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if trace.ID != id || trace.Type != "transaction.created" || trace.Auth != "disabled" || trace.Outcome != "published" {
+		t.Errorf("Unexpected trace: %+v", trace)
+	}
+	if len(trace.MatchedRules) != 1 || trace.MatchedRules[0].Kind != "priority" {
+		t.Errorf("Expected the priority rule to be recorded, got %+v", trace.MatchedRules)
+	}
+
+	results := map[string][]string{}
+	for _, attempt := range trace.SinkAttempts {
+		results[attempt.Sink] = append(results[attempt.Sink], attempt.Result)
+	}
+	if strings.Join(results["redis"], ",") != "success" {
+		t.Errorf("Expected one successful redis attempt, got %v", results["redis"])
+	}
+	if strings.Join(results["audit"], ",") != "error,error" {
+		t.Errorf("Expected two failed audit attempts, got %v", results["audit"])
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/events/unknown/trace", nil)
+	req.SetPathValue("id", "unknown")
+	rr = httptest.NewRecorder()
+	adminEventTraceHandler(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code 404 for an unknown event, got %d", rr.Code)
+	}
+}
+
+func TestTraceIDFromRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		expect      string
+	}{
+		{name: "Valid", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expect: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "Missing"},
+		{name: "All zero trace ID", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "Malformed", traceparent: "4bf92f3577b34da6a3ce929d0e0e4736"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhook", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			if got := traceIDFromRequest(r); got != tt.expect {
+				t.Errorf("Expected '%s', got '%s'", tt.expect, got)
+			}
+		})
+	}
+}
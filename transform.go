@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TransformRule trims the payload published for events of a type down to
+// the fields consumers need, such as a transaction's ID, amount and merchant
+// name, instead of the full Monzo payload
+type TransformRule struct {
+	// Type is an event type, or a prefix ending in *. Any type matches when
+	// it's empty.
+	Type string `json:"type"`
+	// Fields maps each field of the published payload, a dotted path such as
+	// merchant.name, to the path of its value in the Monzo payload, such as
+	// $.data.merchant.name. Fields missing from the payload are left out.
+	Fields map[string]string `json:"fields"`
+}
+
+// validateTransformRules checks the transform rules for missing fields and
+// output paths that overlap, such as merchant and merchant.name
+func validateTransformRules(rules []TransformRule) error {
+	for i, rule := range rules {
+		if strings.Contains(strings.TrimSuffix(rule.Type, "*"), "*") {
+			return fmt.Errorf("transform rule %d: type '%s' can only have * at the end", i+1, rule.Type)
+		}
+		if len(rule.Fields) == 0 {
+			return fmt.Errorf("transform rule %d must have fields", i+1)
+		}
+		outputs := make([]string, 0, len(rule.Fields))
+		for output, source := range rule.Fields {
+			if !validFieldPath(output) {
+				return fmt.Errorf("transform rule %d: field '%s' isn't a dotted path", i+1, output)
+			}
+			if !validFieldPath(transformSourcePath(source)) {
+				return fmt.Errorf("transform rule %d: field '%s' has an invalid path '%s'", i+1, output, source)
+			}
+			outputs = append(outputs, output)
+		}
+		sort.Strings(outputs)
+		for j := 1; j < len(outputs); j++ {
+			if strings.HasPrefix(outputs[j], outputs[j-1]+".") {
+				return fmt.Errorf("transform rule %d: fields '%s' and '%s' overlap", i+1, outputs[j-1], outputs[j])
+			}
+		}
+	}
+	return nil
+}
+
+// validFieldPath reports whether a path is dot-separated non-empty keys
+func validFieldPath(path string) bool {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// transformSourcePath strips the optional JSONPath root, $., from a path
+func transformSourcePath(source string) string {
+	return strings.TrimPrefix(source, "$.")
+}
+
+// transformFor returns the first rule matching an event type, or nil
+func transformFor(rules []TransformRule, eventType string) *TransformRule {
+	for i, rule := range rules {
+		if rule.Type == "" || (PriorityRule{Type: rule.Type}).matches(eventType, nil) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// project builds the trimmed payload for a rule
+func (r TransformRule) project(payload map[string]interface{}) map[string]interface{} {
+	projected := make(map[string]interface{}, len(r.Fields))
+	for output, source := range r.Fields {
+		value, ok := lookupField(payload, transformSourcePath(source))
+		if !ok {
+			continue
+		}
+		keys := strings.Split(output, ".")
+		object := projected
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := object[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				object[key] = child
+			}
+			object = child
+		}
+		object[keys[len(keys)-1]] = value
+	}
+	return projected
+}
+
+// transformEvent returns the event as it's published to the sinks, with its
+// body trimmed by the first matching rule. The event itself is unchanged, so
+// sink rules and later enrichment still see the full payload.
+func transformEvent(rules []TransformRule, event *webhookEvent) *webhookEvent {
+	rule := transformFor(rules, event.Type)
+	if rule == nil {
+		return event
+	}
+	body, err := json.Marshal(rule.project(event.Payload))
+	if err != nil {
+		logError("Error encoding transformed %s event %s, publishing it in full: %v", event.Type, event.ID, err)
+		return event
+	}
+	eventTraces.recordTransformation(event.ID, "transform", event.Body, body)
+	transformed := *event
+	transformed.Body = body
+	return &transformed
+}
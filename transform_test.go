@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestValidateTransformRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []TransformRule
+		wantErr bool
+	}{
+		{name: "No rules"},
+		{name: "Projection", rules: []TransformRule{{Type: "transaction.*", Fields: map[string]string{"id": "$.data.id", "merchant.name": "data.merchant.name"}}}},
+		{name: "No fields", rules: []TransformRule{{Type: "transaction.created"}}, wantErr: true},
+		{name: "Invalid type", rules: []TransformRule{{Type: "*.created", Fields: map[string]string{"id": "data.id"}}}, wantErr: true},
+		{name: "Empty source", rules: []TransformRule{{Fields: map[string]string{"id": "$."}}}, wantErr: true},
+		{name: "Invalid output", rules: []TransformRule{{Fields: map[string]string{"merchant..name": "data.merchant.name"}}}, wantErr: true},
+		{name: "Overlapping outputs", rules: []TransformRule{{Fields: map[string]string{"merchant": "data.merchant", "merchant.name": "data.merchant.name"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTransformRules(tt.rules); (err != nil) != tt.wantErr {
+				t.Errorf("validateTransformRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransformEvent(t *testing.T) {
+	body := []byte(`{"type":"transaction.created","data":{"id":"tx_1","amount":-350,"merchant":{"name":"Pret A Manger","logo":"https://example.com/logo.png"},"metadata":{}}}`)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	rules := []TransformRule{
+		{Type: "transaction.created", Fields: map[string]string{
+			"type":          "$.type",
+			"id":            "$.data.id",
+			"amount":        "data.amount",
+			"merchant.name": "data.merchant.name",
+			"notes":         "data.notes",
+		}},
+		{Type: "transaction.*", Fields: map[string]string{"id": "data.id"}},
+	}
+
+	tests := []struct {
+		name      string
+		eventType string
+		expected  string
+	}{
+		{name: "First matching rule", eventType: "transaction.created", expected: `{"amount":-350,"id":"tx_1","merchant":{"name":"Pret A Manger"},"type":"transaction.created"}`},
+		{name: "Prefix rule", eventType: "transaction.updated", expected: `{"id":"tx_1"}`},
+		{name: "No matching rule", eventType: "account.updated", expected: string(body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &webhookEvent{ID: "evt", Type: tt.eventType, Body: body, Payload: payload}
+			published := transformEvent(rules, event)
+			if string(published.Body) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, published.Body)
+			}
+			if string(event.Body) != string(body) {
+				t.Error("Expected the event itself to be unchanged")
+			}
+		})
+	}
+}
+
+func TestPublishToSinksTransform(t *testing.T) {
+	var mirrored []byte
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored, _ = io.ReadAll(r.Body)
+	}))
+	defer standby.Close()
+
+	body := []byte(`{"type":"transaction.created","data":{"id":"tx_1","amount":-350}}`)
+	var payload map[string]interface{}
+	json.Unmarshal(body, &payload)
+	event := &webhookEvent{ID: "evt", Type: "transaction.created", Body: body, Payload: payload}
+
+	threshold := 100.0
+	sink := &fakeSink{name: "redis"}
+	entries := []sinkEntry{
+		{sink: sink, when: []EventRule{{Field: "data.amount", Abs: true, GTE: &threshold}}},
+		{sink: newMirrorSink(&MirrorConfig{URL: standby.URL, Secret: "shared", InstanceID: "eu-west-1"})},
+	}
+	if err := publishToSinks(context.Background(), entries, []TransformRule{{Fields: map[string]string{"id": "data.id"}}}, event); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sink rules see the full payload, but the sink gets the trimmed one
+	if sink.count() != 1 || string(sink.events[0].Body) != `{"id":"tx_1"}` {
+		t.Errorf("Expected the sink to get the trimmed payload, got %+v", sink.events)
+	}
+	if !reflect.DeepEqual(mirrored, body) {
+		t.Errorf("Expected the mirror sink to get the full payload, got %s", mirrored)
+	}
+}
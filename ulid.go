@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crockfordAlphabet is the Crockford base32 alphabet used by ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates ULIDs: a 48-bit millisecond timestamp followed by
+// 80 random bits, encoded as 26 characters that sort in time order. IDs
+// generated within the same millisecond increment the random part, so they
+// are strictly increasing.
+type ulidGenerator struct {
+	mu     sync.Mutex
+	random io.Reader
+	lastMS uint64
+	last   [10]byte
+}
+
+var eventIDs = &ulidGenerator{random: rand.Reader}
+
+// newEventID returns a new ULID for an event received at now
+func newEventID(now time.Time) string {
+	return eventIDs.New(now)
+}
+
+// New returns a ULID for the given time
+func (g *ulidGenerator) New(now time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= g.lastMS {
+		// Same millisecond (or the clock went backwards): stay monotonic
+		ms = g.lastMS
+		for i := len(g.last) - 1; i >= 0; i-- {
+			g.last[i]++
+			if g.last[i] != 0 {
+				break
+			}
+		}
+	} else {
+		if _, err := io.ReadFull(g.random, g.last[:]); err != nil {
+			panic("reading random bytes for ULID: " + err.Error())
+		}
+		g.lastMS = ms
+	}
+
+	return encodeULID(ms, g.last)
+}
+
+// encodeULID encodes a timestamp and random part as 26 base32 characters
+func encodeULID(ms uint64, random [10]byte) string {
+	var out [26]byte
+
+	for i := 9; i >= 0; i-- {
+		out[i] = crockfordAlphabet[ms&31]
+		ms >>= 5
+	}
+
+	// The random part is two 40-bit halves of 8 characters each
+	for half := 0; half < 2; half++ {
+		var bits uint64
+		for _, b := range random[half*5 : half*5+5] {
+			bits = bits<<8 | uint64(b)
+		}
+		for i := 7; i >= 0; i-- {
+			out[10+half*8+i] = crockfordAlphabet[bits&31]
+			bits >>= 5
+		}
+	}
+
+	return string(out[:])
+}
+
+// ulidTime returns the time encoded in a ULID
+func ulidTime(id string) (time.Time, error) {
+	if len(id) != 26 {
+		return time.Time{}, errors.New("ULID must be 26 characters")
+	}
+
+	var ms uint64
+	for _, c := range strings.ToUpper(id[:10]) {
+		v := strings.IndexRune(crockfordAlphabet, c)
+		if v < 0 {
+			return time.Time{}, errors.New("invalid character in ULID")
+		}
+		ms = ms<<5 | uint64(v)
+	}
+	if ms >= 1<<48 {
+		return time.Time{}, errors.New("ULID timestamp out of range")
+	}
+	return time.UnixMilli(int64(ms)), nil
+}
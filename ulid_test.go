@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	tests := []struct {
+		name     string
+		ms       uint64
+		random   [10]byte
+		expected string
+	}{
+		{name: "Zero random part", ms: 1469918176385, expected: "01ARYZ6S410000000000000000"},
+		{name: "Maximum random part", ms: 0, random: [10]byte{255, 255, 255, 255, 255, 255, 255, 255, 255, 255}, expected: "0000000000ZZZZZZZZZZZZZZZZ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeULID(tt.ms, tt.random); got != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestULIDGeneratorMonotonic(t *testing.T) {
+	g := &ulidGenerator{random: bytes.NewReader(make([]byte, 20))}
+	now := time.UnixMilli(1469918176385)
+
+	first := g.New(now)
+	second := g.New(now)
+	earlier := g.New(now.Add(-time.Second))
+
+	if first != "01ARYZ6S410000000000000000" {
+		t.Errorf("Unexpected first ID '%s'", first)
+	}
+	if second != "01ARYZ6S410000000000000001" {
+		t.Errorf("Expected the random part to increment within the same millisecond, got '%s'", second)
+	}
+	if earlier <= second {
+		t.Errorf("Expected IDs to stay increasing when the clock goes backwards, got '%s' after '%s'", earlier, second)
+	}
+}
+
+func TestULIDTime(t *testing.T) {
+	now := time.UnixMilli(time.Now().UnixMilli())
+	got, err := ulidTime(newEventID(now))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !got.Equal(now) {
+		t.Errorf("Expected %v, got %v", now, got)
+	}
+
+	for _, id := range []string{"", "01ARYZ6S41", "01ARYZ6S4U0000000000000000", "80000000000000000000000000"} {
+		if _, err := ulidTime(id); err == nil {
+			t.Errorf("Expected an error for '%s'", id)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultRenewMargin is how long before a token or lease expires it is
+// renewed, as a fraction of its duration
+const vaultRenewMargin = 3
+
+// vaultMinLease is the shortest remaining lease worth renewing. A renewal
+// that returns less has reached the lease's maximum TTL, so the secret is
+// read again for new credentials instead.
+const vaultMinLease = 2 * time.Minute
+
+// vaultClient reads secrets from HashiCorp Vault with the Vault API client,
+// authenticating with a token or a Kubernetes service account, and keeps its
+// token and the secrets' leases renewed
+type vaultClient struct {
+	addr string
+
+	// kubernetesRole is set when logging in with a Kubernetes service
+	// account token instead of a Vault token
+	kubernetesRole      string
+	kubernetesMount     string
+	kubernetesTokenFile string
+
+	client *api.Client
+	now    func() time.Time
+
+	mu           sync.Mutex
+	tokenTTL     time.Duration
+	tokenExpires time.Time
+	renewable    bool
+	secrets      []*vaultSecret
+}
+
+// vaultSecret is a secret read from Vault. Dynamic secrets, such as database
+// credentials, have a lease that is renewed; others are read again to pick
+// up changes.
+type vaultSecret struct {
+	name     string
+	path     string
+	required []string
+	onChange func(map[string]string)
+
+	data          map[string]string
+	leaseID       string
+	leaseDuration time.Duration
+	leaseExpires  time.Time
+}
+
+// vaultFromEnv configures the Vault client from VAULT_ADDR, VAULT_NAMESPACE
+// and either VAULT_TOKEN or VAULT_KUBERNETES_ROLE. It returns nil if
+// VAULT_ADDR is not set.
+func vaultFromEnv() (*vaultClient, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(addr, "https://") && !strings.HasPrefix(addr, "http://") {
+		return nil, fmt.Errorf("invalid VAULT_ADDR '%s' (expected an https URL)", redactURL(addr))
+	}
+	token, err := getenvSecret("VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newVaultAPIClient(addr, os.Getenv("VAULT_NAMESPACE"), token)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &vaultClient{
+		addr:                addr,
+		kubernetesRole:      os.Getenv("VAULT_KUBERNETES_ROLE"),
+		kubernetesMount:     os.Getenv("VAULT_KUBERNETES_MOUNT"),
+		kubernetesTokenFile: os.Getenv("VAULT_KUBERNETES_TOKEN_FILE"),
+		client:              client,
+		now:                 clock.Now,
+	}
+	if (token == "") == (v.kubernetesRole == "") {
+		return nil, errors.New("exactly one of VAULT_TOKEN and VAULT_KUBERNETES_ROLE must be set when VAULT_ADDR is configured")
+	}
+	if v.kubernetesMount == "" {
+		v.kubernetesMount = "kubernetes"
+	}
+	if v.kubernetesTokenFile == "" {
+		v.kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	return v, nil
+}
+
+// newVaultAPIClient returns a Vault API client for an address, with a token
+// and namespace if they are set. The client also reads Vault's TLS settings,
+// such as VAULT_CACERT, from the environment.
+func newVaultAPIClient(addr, namespace, token string) (*api.Client, error) {
+	cfg := api.DefaultConfig()
+	if cfg.Error != nil {
+		return nil, fmt.Errorf("configuring Vault client: %w", cfg.Error)
+	}
+	cfg.Address = addr
+	cfg.Timeout = 10 * time.Second
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("configuring Vault client: %w", err)
+	}
+	// NewClient picks up VAULT_TOKEN and VAULT_NAMESPACE itself, but not
+	// VAULT_TOKEN_FILE, and a Kubernetes login must start without a token
+	client.SetToken(token)
+	client.SetNamespace(namespace)
+	return client, nil
+}
+
+// login authenticates with Vault. A Vault token is looked up to learn its
+// TTL; otherwise the Kubernetes service account token is exchanged for one.
+func (v *vaultClient) login(ctx context.Context) error {
+	if v.kubernetesRole == "" {
+		secret, err := v.client.Auth().Token().LookupSelfWithContext(ctx)
+		if err != nil {
+			return fmt.Errorf("looking up Vault token: %w", err)
+		}
+		ttl, err := secret.TokenTTL()
+		if err != nil {
+			return fmt.Errorf("looking up Vault token: %w", err)
+		}
+		renewable, _ := secret.TokenIsRenewable()
+		v.setToken("", ttl, renewable)
+		return nil
+	}
+
+	jwt, err := os.ReadFile(v.kubernetesTokenFile)
+	if err != nil {
+		return fmt.Errorf("reading Kubernetes service account token: %w", err)
+	}
+	// The login is unauthenticated, and an expired token would be rejected
+	v.client.ClearToken()
+	secret, err := v.client.Logical().WriteWithContext(ctx, "auth/"+v.kubernetesMount+"/login", map[string]interface{}{
+		"role": v.kubernetesRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return fmt.Errorf("logging in to Vault as role '%s': %w", v.kubernetesRole, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return errors.New("Vault login returned no token")
+	}
+	v.setToken(secret.Auth.ClientToken, time.Duration(secret.Auth.LeaseDuration)*time.Second, secret.Auth.Renewable)
+	return nil
+}
+
+// setToken records the token's TTL, and the token itself if it is new. A
+// TTL of zero means the token doesn't expire.
+func (v *vaultClient) setToken(token string, ttl time.Duration, renewable bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if token != "" {
+		v.client.SetToken(token)
+	}
+	v.tokenTTL = ttl
+	v.renewable = renewable
+	v.tokenExpires = time.Time{}
+	if ttl > 0 {
+		v.tokenExpires = v.now().Add(ttl)
+	}
+}
+
+// renewToken renews the token when a third of its TTL is left, logging in
+// again if it can't be renewed and a Kubernetes role is configured
+func (v *vaultClient) renewToken(ctx context.Context) error {
+	v.mu.Lock()
+	due := !v.tokenExpires.IsZero() && !v.now().Before(v.tokenExpires.Add(-v.tokenTTL/vaultRenewMargin))
+	renewable := v.renewable
+	v.mu.Unlock()
+	if !due {
+		return nil
+	}
+
+	if renewable {
+		secret, err := v.client.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err == nil && secret != nil && secret.Auth != nil {
+			v.setToken("", time.Duration(secret.Auth.LeaseDuration)*time.Second, secret.Auth.Renewable)
+			return nil
+		}
+		if err == nil {
+			err = errors.New("no token in response")
+		}
+		if v.kubernetesRole == "" {
+			return fmt.Errorf("renewing Vault token: %v", err)
+		}
+	}
+	if v.kubernetesRole == "" {
+		return errors.New("Vault token can't be renewed and will expire")
+	}
+	return v.login(ctx)
+}
+
+// read reads a secret, unwrapping the data of KV version 2 secrets. Values
+// that aren't strings are ignored.
+func (v *vaultClient) read(ctx context.Context, path string) (*api.Secret, map[string]string, error) {
+	secret, err := v.client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secret == nil {
+		return nil, nil, fmt.Errorf("no secret at %s", path)
+	}
+	fields := secret.Data
+	if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, kv2 := secret.Data["metadata"]; kv2 {
+			fields = inner
+		}
+	}
+	data := make(map[string]string, len(fields))
+	for key, value := range fields {
+		if s, ok := value.(string); ok {
+			data[key] = s
+		}
+	}
+	return secret, data, nil
+}
+
+// secret reads a secret with the required keys, calling onChange with its new
+// data whenever it changes on a later refresh
+func (v *vaultClient) secret(ctx context.Context, name, path string, required []string, onChange func(map[string]string)) (map[string]string, error) {
+	secret := &vaultSecret{name: name, path: path, required: required, onChange: onChange}
+	if err := v.fetch(ctx, secret); err != nil {
+		return nil, fmt.Errorf("reading %s from Vault: %w", name, err)
+	}
+	v.mu.Lock()
+	v.secrets = append(v.secrets, secret)
+	v.mu.Unlock()
+	logInfo("Read %s from Vault at %s", name, path)
+	return secret.data, nil
+}
+
+// fetch reads a secret and records its lease
+func (v *vaultClient) fetch(ctx context.Context, secret *vaultSecret) error {
+	resp, data, err := v.read(ctx, secret.path)
+	if err != nil {
+		return err
+	}
+	for _, key := range secret.required {
+		if data[key] == "" {
+			return fmt.Errorf("secret at %s has no '%s'", secret.path, key)
+		}
+	}
+	secret.data = data
+	secret.leaseID = resp.LeaseID
+	secret.leaseDuration = time.Duration(resp.LeaseDuration) * time.Second
+	secret.leaseExpires = v.now().Add(secret.leaseDuration)
+	return nil
+}
+
+// refresh renews the token and the secrets' leases when they are due. A
+// secret whose lease can't be renewed any further is read again, as are
+// secrets without a lease, and onChange is called if its data has changed.
+func (v *vaultClient) refresh(ctx context.Context) error {
+	if err := v.renewToken(ctx); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	secrets := append([]*vaultSecret(nil), v.secrets...)
+	v.mu.Unlock()
+
+	var errs []string
+	for _, secret := range secrets {
+		if secret.leaseID != "" {
+			if v.now().Before(secret.leaseExpires.Add(-secret.leaseDuration / vaultRenewMargin)) {
+				continue
+			}
+			resp, err := v.client.Sys().RenewWithContext(ctx, secret.leaseID, int(secret.leaseDuration.Seconds()))
+			if err == nil && time.Duration(resp.LeaseDuration)*time.Second >= vaultMinLease {
+				secret.leaseExpires = v.now().Add(time.Duration(resp.LeaseDuration) * time.Second)
+				logDebug("Renewed Vault lease for %s", secret.name)
+				continue
+			}
+			if err != nil {
+				logWarn("Error renewing Vault lease for %s, reading it again: %v", secret.name, err)
+			}
+		}
+
+		previous := secret.data
+		if err := v.fetch(ctx, secret); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", secret.name, err))
+			continue
+		}
+		if !maps.Equal(previous, secret.data) {
+			secret.onChange(secret.data)
+			logInfo("Reloaded %s from Vault", secret.name)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
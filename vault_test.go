@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault serves the parts of the Vault API used by the client: token
+// lookup and renewal, Kubernetes login, secret reads and lease renewal
+type fakeVault struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	token    string
+	secrets  map[string]map[string]interface{}
+	leaseTTL int
+	renewTTL int
+	renewals map[string]int
+	reads    map[string]int
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	v := &fakeVault{
+		token:    "s.root",
+		secrets:  map[string]map[string]interface{}{},
+		renewals: map[string]int{},
+		reads:    map[string]int{},
+	}
+	v.server = httptest.NewServer(http.HandlerFunc(v.handle))
+	t.Cleanup(v.server.Close)
+	return v
+}
+
+func (v *fakeVault) handle(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	auth := func(token string, ttl int) map[string]interface{} {
+		return map[string]interface{}{"auth": map[string]interface{}{"client_token": token, "lease_duration": ttl, "renewable": true}}
+	}
+
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["role"] != "monzo-webhook" || req["jwt"] != "service-account-jwt" {
+			reply(http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		reply(http.StatusOK, auth(v.token, 3600))
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		reply(http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": 3600, "renewable": true}})
+	case "/v1/auth/token/renew-self":
+		v.renewals["token"]++
+		reply(http.StatusOK, auth("", 3600))
+	case "/v1/sys/leases/renew":
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		leaseID, _ := req["lease_id"].(string)
+		v.renewals[leaseID]++
+		reply(http.StatusOK, map[string]interface{}{"lease_id": leaseID, "lease_duration": v.renewTTL, "renewable": true})
+	default:
+		path := r.URL.Path[len("/v1/"):]
+		data, ok := v.secrets[path]
+		if !ok {
+			reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		v.reads[path]++
+		resp := map[string]interface{}{"data": data}
+		if v.leaseTTL > 0 {
+			resp["lease_id"] = path + "/lease"
+			resp["lease_duration"] = v.leaseTTL
+		}
+		reply(http.StatusOK, resp)
+	}
+}
+
+func TestVaultFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		expectNil   bool
+		expectError bool
+	}{
+		{name: "Not configured", expectNil: true},
+		{name: "Token", env: map[string]string{"VAULT_ADDR": "https://vault.example.com/", "VAULT_TOKEN": "s.root"}},
+		{name: "Kubernetes", env: map[string]string{"VAULT_ADDR": "https://vault.example.com", "VAULT_KUBERNETES_ROLE": "monzo-webhook"}},
+		{name: "No credentials", env: map[string]string{"VAULT_ADDR": "https://vault.example.com"}, expectError: true},
+		{name: "Both credentials", env: map[string]string{"VAULT_ADDR": "https://vault.example.com", "VAULT_TOKEN": "s.root", "VAULT_KUBERNETES_ROLE": "monzo-webhook"}, expectError: true},
+		{name: "Invalid address", env: map[string]string{"VAULT_ADDR": "vault.example.com", "VAULT_TOKEN": "s.root"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"VAULT_ADDR", "VAULT_TOKEN", "VAULT_TOKEN_FILE", "VAULT_KUBERNETES_ROLE"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			v, err := vaultFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (v == nil) != tt.expectNil {
+				t.Fatalf("Expected nil=%v, got %v", tt.expectNil, v)
+			}
+			if v != nil && v.addr != "https://vault.example.com" {
+				t.Errorf("Expected the address without a trailing slash, got '%s'", v.addr)
+			}
+		})
+	}
+}
+
+func newTestVaultClient(t *testing.T, server *fakeVault, now func() time.Time) *vaultClient {
+	t.Helper()
+	client, err := newVaultAPIClient(server.server.URL, "", server.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &vaultClient{addr: server.server.URL, client: client, now: now}
+}
+
+func TestVaultSecret(t *testing.T) {
+	server := newFakeVault(t)
+	server.secrets["secret/data/monzo-webhook/webhook"] = map[string]interface{}{
+		"data":     map[string]interface{}{"username": "monzo", "password": "first"},
+		"metadata": map[string]interface{}{"version": 1},
+	}
+	server.secrets["secret/data/monzo-webhook/empty"] = map[string]interface{}{
+		"data":     map[string]interface{}{"username": "monzo"},
+		"metadata": map[string]interface{}{"version": 1},
+	}
+	v := newTestVaultClient(t, server, time.Now)
+	if err := v.login(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var changed map[string]string
+	creds, err := v.secret(context.Background(), "webhook credentials", "secret/data/monzo-webhook/webhook", []string{"username", "password"}, func(data map[string]string) {
+		changed = data
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if creds["username"] != "monzo" || creds["password"] != "first" {
+		t.Errorf("Expected the KV data to be unwrapped, got %v", creds)
+	}
+
+	if _, err := v.secret(context.Background(), "empty", "secret/data/monzo-webhook/empty", []string{"password"}, nil); err == nil {
+		t.Error("Expected an error for a secret without a required key, got nil")
+	}
+	if _, err := v.secret(context.Background(), "missing", "secret/data/missing", nil, nil); err == nil {
+		t.Error("Expected an error for a missing secret, got nil")
+	}
+
+	// Secrets without a lease are read again on each refresh
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changed != nil {
+		t.Errorf("Expected no change, got %v", changed)
+	}
+	server.mu.Lock()
+	server.secrets["secret/data/monzo-webhook/webhook"]["data"] = map[string]interface{}{"username": "monzo", "password": "second"}
+	server.mu.Unlock()
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changed["password"] != "second" {
+		t.Errorf("Expected the rotated password, got %v", changed)
+	}
+}
+
+func TestVaultLeaseRenewal(t *testing.T) {
+	server := newFakeVault(t)
+	server.secrets["database/creds/redis"] = map[string]interface{}{"username": "v-webhook-1", "password": "first"}
+	server.leaseTTL = 600
+	server.renewTTL = 600
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	v := newTestVaultClient(t, server, func() time.Time { return now })
+	if err := v.login(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var changed map[string]string
+	if _, err := v.secret(context.Background(), "Redis credentials", "database/creds/redis", []string{"password"}, func(data map[string]string) {
+		changed = data
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Nothing is due until a third of the lease is left
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if server.renewals["database/creds/redis/lease"] != 0 || server.reads["database/creds/redis"] != 1 {
+		t.Errorf("Expected no renewal or read, got %v renewals and %d reads", server.renewals, server.reads["database/creds/redis"])
+	}
+
+	now = now.Add(7 * time.Minute)
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if server.renewals["database/creds/redis/lease"] != 1 {
+		t.Errorf("Expected the lease to be renewed, got %v", server.renewals)
+	}
+
+	// Once the lease reaches its maximum TTL, new credentials are read
+	server.mu.Lock()
+	server.renewTTL = 30
+	server.secrets["database/creds/redis"] = map[string]interface{}{"username": "v-webhook-2", "password": "second"}
+	server.mu.Unlock()
+	now = now.Add(7 * time.Minute)
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changed["username"] != "v-webhook-2" || changed["password"] != "second" {
+		t.Errorf("Expected new credentials, got %v", changed)
+	}
+
+	// The token is renewed when a third of its TTL is left
+	now = now.Add(45 * time.Minute)
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if server.renewals["token"] != 1 {
+		t.Errorf("Expected the token to be renewed, got %v", server.renewals)
+	}
+}
+
+func TestVaultKubernetesLogin(t *testing.T) {
+	server := newFakeVault(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newTestVaultClient(t, server, time.Now)
+	v.client.ClearToken()
+	v.kubernetesRole = "monzo-webhook"
+	v.kubernetesMount = "kubernetes"
+	v.kubernetesTokenFile = tokenFile
+	if err := v.login(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v.client.Token() != server.token {
+		t.Errorf("Expected the token from the login, got '%s'", v.client.Token())
+	}
+
+	v.kubernetesRole = "other"
+	if err := v.login(context.Background()); err == nil {
+		t.Error("Expected an error for a rejected login, got nil")
+	}
+}
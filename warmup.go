@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var warmupDuration = metrics.newGaugeVec("monzo_webhook_warmup_duration_seconds",
+	"How long each startup warmup task took, by task and result (ok, error).", "task", "result")
+
+// warmingUp is set while the server warms up after starting, when /readyz
+// reports that it isn't ready yet
+var warmingUp atomic.Bool
+
+// WarmupConfig configures the warmup after the server starts, which fills the
+// caches and connects to the sinks before it's reported ready, so that the
+// first webhook after a deploy isn't the slowest
+type WarmupConfig struct {
+	// Timeout is the longest the server waits for the warmup before it's
+	// reported ready anyway
+	Timeout string `json:"timeout"`
+	// MerchantDays is how many days of recent transactions' merchants are
+	// cached
+	MerchantDays int `json:"merchant_days"`
+}
+
+// validate checks the warmup configuration for invalid values
+func (c WarmupConfig) validate() error {
+	if _, err := parsePositiveDuration(c.Timeout, 30*time.Second); err != nil {
+		return fmt.Errorf("invalid warmup timeout: %w", err)
+	}
+	if c.MerchantDays < 0 {
+		return fmt.Errorf("warmup merchant_days must not be negative")
+	}
+	return nil
+}
+
+func (c WarmupConfig) timeout() time.Duration {
+	timeout, _ := parsePositiveDuration(c.Timeout, 30*time.Second)
+	return timeout
+}
+
+// merchantDays returns how many days of merchants are cached, defaulting to 7
+func (c WarmupConfig) merchantDays() int {
+	if c.MerchantDays == 0 {
+		return 7
+	}
+	return c.MerchantDays
+}
+
+// warmupTask is a step of the warmup
+type warmupTask struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// sinkWarmer is implemented by sinks that connect on their first publish, to
+// connect ahead of it
+type sinkWarmer interface {
+	warm(ctx context.Context) error
+}
+
+// warmSink connects a sink if it connects on its first publish
+func warmSink(ctx context.Context, sink Sink) error {
+	if w, ok := sink.(sinkWarmer); ok {
+		return w.warm(ctx)
+	}
+	return nil
+}
+
+// sinkWarmupTasks returns a task connecting each sink that connects on its
+// first publish
+func sinkWarmupTasks(entries []sinkEntry) []warmupTask {
+	var tasks []warmupTask
+	for _, entry := range entries {
+		if _, ok := entry.sink.(sinkWarmer); !ok {
+			continue
+		}
+		sink := entry.sink
+		tasks = append(tasks, warmupTask{name: "sink:" + sink.Name(), fn: func(ctx context.Context) error {
+			return warmSink(ctx, sink)
+		}})
+	}
+	return tasks
+}
+
+// warmMerchants caches the merchants of the accounts' recent transactions, so
+// that merchant details of regular merchants are read from the cache. An
+// account that fails doesn't stop the others from being warmed.
+func warmMerchants(ctx context.Context, client *monzoClient, accounts []AccountConfig, days int) error {
+	ids, err := webhookAccounts(ctx, client, accounts)
+	if err != nil {
+		return err
+	}
+	since := client.now().AddDate(0, 0, -days)
+	merchants := make(map[string]bool)
+	var errs []error
+	for _, id := range ids {
+		transactions, err := client.forAccount(id).recentTransactions(ctx, id, since)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", id, err))
+			continue
+		}
+		for _, tx := range transactions {
+			if tx.Merchant != nil && tx.Merchant.Name != "" {
+				merchants[tx.Merchant.ID] = true
+			}
+		}
+	}
+	logInfo("Cached %d merchants from the last %d days of transactions", len(merchants), days)
+	return errors.Join(errs...)
+}
+
+// runWarmup runs the warmup tasks concurrently, and reports the server as
+// ready once they finish or the timeout passes. Failed tasks are logged, and
+// are retried by the first event that needs them.
+func runWarmup(ctx context.Context, tasks []warmupTask, timeout time.Duration) {
+	defer warmingUp.Store(false)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			taskStarted := time.Now()
+			err := task.fn(ctx)
+			result := "ok"
+			if err != nil {
+				result = "error"
+				logWarn("Warmup task %s failed: %v", task.name, err)
+			}
+			warmupDuration.WithLabelValues(task.name, result).Set(time.Since(taskStarted).Seconds())
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logInfo("Warmup finished in %s", time.Since(started).Round(time.Millisecond))
+	case <-ctx.Done():
+		logWarn("Warmup didn't finish within %s - reporting ready anyway", timeout)
+	}
+}
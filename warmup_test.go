@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRunWarmup(t *testing.T) {
+	var ran atomic.Int32
+	tasks := []warmupTask{
+		{name: "ok", fn: func(ctx context.Context) error { ran.Add(1); return nil }},
+		{name: "failing", fn: func(ctx context.Context) error {
+			ran.Add(1)
+			time.Sleep(time.Millisecond)
+			return errors.New("unreachable")
+		}},
+	}
+	warmingUp.Store(true)
+	runWarmup(context.Background(), tasks, time.Second)
+	if ran.Load() != 2 {
+		t.Errorf("Expected every task to run, %d ran", ran.Load())
+	}
+	if warmingUp.Load() {
+		t.Error("Expected the server to be ready after the warmup")
+	}
+	if testutil.ToFloat64(warmupDuration.WithLabelValues("failing", "error")) == 0 {
+		t.Error("Expected the failed task to be recorded")
+	}
+
+	// A task that doesn't finish doesn't hold up readiness past the timeout
+	warmingUp.Store(true)
+	stuck := []warmupTask{{name: "stuck", fn: func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return ctx.Err()
+	}}}
+	started := time.Now()
+	runWarmup(context.Background(), stuck, 10*time.Millisecond)
+	if time.Since(started) > 500*time.Millisecond || warmingUp.Load() {
+		t.Error("Expected the warmup to give up at the timeout")
+	}
+}
+
+func TestSinkWarmupTasks(t *testing.T) {
+	_, client := newFakeRedis(t)
+	entries := []sinkEntry{
+		{sink: &fakeSink{name: "fake"}},
+		{sink: &notificationSink{sink: &redisSink{name: "redis", client: client, channel: "events"}}},
+	}
+	tasks := sinkWarmupTasks(entries)
+	if len(tasks) != 1 || tasks[0].name != "sink:redis" {
+		t.Fatalf("Expected a task for the Redis sink only, got %v", tasks)
+	}
+	if err := tasks[0].fn(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestWarmMerchants(t *testing.T) {
+	redisServer, client := newFakeRedis(t)
+	now := time.Date(2024, 3, 8, 9, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/transactions" || r.URL.Query().Get("account_id") != "acc_1" || r.URL.Query().Get("since") != "2024-03-01T09:00:00Z" {
+			t.Errorf("Unexpected request: %s", r.URL)
+		}
+		w.Write([]byte(`{"transactions": [
+			{"id": "tx_1", "merchant": {"id": "merch_1", "name": "Coffee Shop"}},
+			{"id": "tx_2", "merchant": {"id": "merch_1", "name": "Coffee Shop"}},
+			{"id": "tx_3", "merchant": null}
+		]}`))
+	}))
+	defer server.Close()
+	monzo := newMonzoClient(MonzoAPIConfig{URL: server.URL}, &credentialValue{value: "token"}, func() time.Time { return now })
+	monzo.cache = newMonzoCache(client, MonzoAPICacheConfig{})
+
+	if err := warmMerchants(context.Background(), monzo, []AccountConfig{{ID: "acc_1"}}, 7); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	redisServer.mu.Lock()
+	_, cached := redisServer.values["monzo-webhook:monzo-api:merchant:merch_1"]
+	redisServer.mu.Unlock()
+	if !cached {
+		t.Error("Expected the merchant to be cached")
+	}
+}
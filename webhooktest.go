@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+var webhookTestEvents = metrics.newCounterVec("monzo_webhook_test_events_total",
+	"Requests to the test webhook endpoint, by result.", "result")
+
+// WebhookTestConfig configures the test webhook endpoint, /webhook/test
+type WebhookTestConfig struct {
+	// Channel is a Redis channel test events are published to. They're
+	// not published anywhere when it's empty.
+	Channel string `json:"channel"`
+}
+
+// webhookTestResult describes how /webhook would have handled a test event
+type webhookTestResult struct {
+	Test        bool   `json:"test"`
+	EventID     string `json:"event_id"`
+	Type        string `json:"type,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	Accepted    bool   `json:"accepted"`
+	Error       string `json:"error,omitempty"`
+	Warning     string `json:"warning,omitempty"`
+	FilteredBy  string `json:"filtered_by,omitempty"`
+	PublishedTo string `json:"published_to,omitempty"`
+}
+
+// webhookTestHandler checks a webhook the way /webhook would, after the same
+// authentication, but never publishes it to the sinks, so that verifying the
+// endpoint doesn't reach real consumers. Accepted events are published to the
+// test channel, if configured, with "test": true added.
+func webhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defer r.Body.Close()
+	cfg := currentConfig()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyReadError(w, err)
+		return
+	}
+
+	result := webhookTestResult{Test: true, EventID: newEventID(clock.Now())}
+	if tenant := tenantFromContext(r.Context()); tenant != nil {
+		result.Tenant = tenant.Name
+	}
+	w.Header().Set("X-Event-ID", result.EventID)
+
+	reject := func(message string) {
+		logInfo("Rejected test webhook %s: %s", result.EventID, message)
+		webhookTestEvents.WithLabelValues("rejected").Inc()
+		result.Error = message
+		writeJSON(w, http.StatusBadRequest, result)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		reject("Error parsing JSON")
+		return
+	}
+	eventType, ok := payload["type"].(string)
+	if !ok || eventType == "" {
+		reject("Missing event type")
+		return
+	}
+	result.Type = eventType
+
+	if err := validatePayload(body); err != nil {
+		if cfg.StrictDecoding {
+			reject("Invalid payload: " + err.Error())
+			return
+		}
+		result.Warning = "Payload doesn't match the expected schema: " + err.Error()
+	}
+	result.Accepted = true
+	result.FilteredBy = filteredBy(cfg, eventType, payload)
+
+	if cfg.WebhookTest.Channel != "" && redisClient != nil {
+		payload["test"] = true
+		marked, err := json.Marshal(payload)
+		if err == nil {
+			err = redisClient.Publish(r.Context(), cfg.WebhookTest.Channel, marked).Err()
+		}
+		if err != nil {
+			logError("Error publishing test webhook %s to channel '%s': %v", result.EventID, cfg.WebhookTest.Channel, err)
+			webhookTestEvents.WithLabelValues("error").Inc()
+			http.Error(w, "Error publishing test event", http.StatusInternalServerError)
+			return
+		}
+		result.PublishedTo = cfg.WebhookTest.Channel
+	}
+
+	logInfo("Received test webhook %s: %s", result.EventID, eventType)
+	webhookTestEvents.WithLabelValues("accepted").Inc()
+	writeJSON(w, http.StatusOK, result)
+}
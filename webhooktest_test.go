@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookTestHandler(t *testing.T) {
+	origConfig, origSinks, origClient := eventConfig, sinks, redisClient
+	defer func() {
+		eventConfig, sinks, redisClient = origConfig, origSinks, origClient
+	}()
+
+	fake, client := newFakeRedis(t)
+	redisClient = client
+	sink := &fakeSink{name: "redis"}
+	sinks = []sinkEntry{{sink: sink, required: true}}
+
+	valid := `{"type":"transaction.created","data":{"id":"tx_1","account_id":"acc_1","created":"2015-09-04T14:28:40Z","amount":-350,"currency":"GBP"}}`
+	invalid := `{"type":"transaction.created","data":{"id":"tx_1","amount":"lots","currency":"GBP"}}`
+
+	tests := []struct {
+		name       string
+		cfg        EventConfig
+		body       string
+		status     int
+		warning    bool
+		filteredBy string
+		published  string
+	}{
+		{name: "Valid event", body: valid, status: http.StatusOK},
+		{name: "Published to the test channel", cfg: EventConfig{WebhookTest: WebhookTestConfig{Channel: "monzo-test"}}, body: valid, status: http.StatusOK, published: "monzo-test"},
+		{name: "Filtered type", cfg: EventConfig{EventTypes: EventTypeFilter{Deny: []string{"transaction.*"}}}, body: valid, status: http.StatusOK, filteredBy: "event_types"},
+		{name: "Invalid payload", body: invalid, status: http.StatusOK, warning: true},
+		{name: "Invalid payload with strict decoding", cfg: EventConfig{StrictDecoding: true}, body: invalid, status: http.StatusBadRequest},
+		{name: "Missing type", body: `{"data":{}}`, status: http.StatusBadRequest},
+		{name: "Invalid JSON", body: `{`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventConfig = tt.cfg
+			rr := httptest.NewRecorder()
+			webhookTestHandler(rr, httptest.NewRequest(http.MethodPost, "/webhook/test", bytes.NewBufferString(tt.body)))
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+
+			var result webhookTestResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+				t.Fatalf("Invalid JSON: %v", err)
+			}
+			if !result.Test || result.EventID == "" || result.EventID != rr.Header().Get("X-Event-ID") {
+				t.Errorf("Expected a test result with the event ID, got %+v", result)
+			}
+			if result.Accepted != (tt.status == http.StatusOK) || (result.Warning != "") != tt.warning {
+				t.Errorf("Unexpected result: %+v", result)
+			}
+			if result.FilteredBy != tt.filteredBy || result.PublishedTo != tt.published {
+				t.Errorf("Expected filtered_by '%s' and published_to '%s', got %+v", tt.filteredBy, tt.published, result)
+			}
+		})
+	}
+
+	if sink.count() != 0 {
+		t.Errorf("Expected test events never to be published to the sinks, got %d", sink.count())
+	}
+	fake.mu.Lock()
+	messages := fake.published["monzo-test"]
+	fake.mu.Unlock()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message on the test channel, got %d", len(messages))
+	}
+	var published map[string]interface{}
+	if err := json.Unmarshal([]byte(messages[0]), &published); err != nil || published["test"] != true {
+		t.Errorf("Expected the published event to be marked as a test, got %s", messages[0])
+	}
+}